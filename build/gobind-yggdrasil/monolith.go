@@ -239,7 +239,9 @@ func (m *DendriteMonolith) Start() {
 			ygg, fsAPI, federation,
 		),
 	}
-	monolith.AddAllPublicRoutes(processCtx, cfg, routers, cm, &natsInstance, caches, caching.EnableMetrics)
+	if err := monolith.AddAllPublicRoutes(processCtx, cfg, routers, cm, &natsInstance, caches, caching.EnableMetrics); err != nil {
+		logrus.WithError(err).Panic("failed to add public routes")
+	}
 
 	httpRouter := mux.NewRouter()
 	httpRouter.PathPrefix(httputil.PublicClientPathPrefix).Handler(routers.Client)
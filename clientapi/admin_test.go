@@ -46,7 +46,9 @@ func TestAdminCreateToken(t *testing.T) {
 		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
 		rsAPI.SetFederationAPI(nil, nil)
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 		accessTokens := map[*test.User]userDevice{
 			aliceAdmin: {},
 			bob:        {},
@@ -197,7 +199,9 @@ func TestAdminListRegistrationTokens(t *testing.T) {
 		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
 		rsAPI.SetFederationAPI(nil, nil)
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 		accessTokens := map[*test.User]userDevice{
 			aliceAdmin: {},
 			bob:        {},
@@ -315,7 +319,9 @@ func TestAdminGetRegistrationToken(t *testing.T) {
 		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
 		rsAPI.SetFederationAPI(nil, nil)
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 		accessTokens := map[*test.User]userDevice{
 			aliceAdmin: {},
 			bob:        {},
@@ -416,7 +422,9 @@ func TestAdminDeleteRegistrationToken(t *testing.T) {
 		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
 		rsAPI.SetFederationAPI(nil, nil)
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 		accessTokens := map[*test.User]userDevice{
 			aliceAdmin: {},
 			bob:        {},
@@ -510,7 +518,9 @@ func TestAdminUpdateRegistrationToken(t *testing.T) {
 		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
 		rsAPI.SetFederationAPI(nil, nil)
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 		accessTokens := map[*test.User]userDevice{
 			aliceAdmin: {},
 			bob:        {},
@@ -695,7 +705,9 @@ func TestAdminResetPassword(t *testing.T) {
 		// Needed for changing the password/login
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 		// We mostly need the userAPI for this test, so nil for other APIs/caches etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 
 		// Create the users in the userapi and login
 		accessTokens := map[*test.User]userDevice{
@@ -800,7 +812,9 @@ func TestPurgeRoom(t *testing.T) {
 		}
 
 		// We mostly need the rsAPI for this test, so nil for other APIs/caches etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 
 		// Create the users in the userapi and login
 		accessTokens := map[*test.User]userDevice{
@@ -871,7 +885,9 @@ func TestAdminEvacuateRoom(t *testing.T) {
 		}
 
 		// We mostly need the rsAPI for this test, so nil for other APIs/caches etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 
 		// Create the users in the userapi and login
 		accessTokens := map[*test.User]userDevice{
@@ -882,16 +898,18 @@ func TestAdminEvacuateRoom(t *testing.T) {
 		testCases := []struct {
 			name         string
 			roomID       string
+			query        string
 			wantOK       bool
 			wantAffected []string
 		}{
+			{name: "Dry run lists the members to evacuate", wantOK: true, roomID: room.ID, query: "?dry_run=true", wantAffected: []string{aliceAdmin.ID, bob.ID}},
 			{name: "Can evacuate existing room", wantOK: true, roomID: room.ID, wantAffected: []string{aliceAdmin.ID, bob.ID}},
 			{name: "Can not evacuate non-existent room", wantOK: false, roomID: "!doesnotexist:localhost", wantAffected: []string{}},
 		}
 
 		for _, tc := range testCases {
 			t.Run(tc.name, func(t *testing.T) {
-				req := test.NewRequest(t, http.MethodPost, "/_dendrite/admin/evacuateRoom/"+tc.roomID)
+				req := test.NewRequest(t, http.MethodPost, "/_dendrite/admin/evacuateRoom/"+tc.roomID+tc.query)
 
 				req.Header.Set("Authorization", "Bearer "+accessTokens[aliceAdmin].accessToken)
 
@@ -975,7 +993,9 @@ func TestAdminEvacuateUser(t *testing.T) {
 		}
 
 		// We mostly need the rsAPI for this test, so nil for other APIs/caches etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 
 		// Create the users in the userapi and login
 		accessTokens := map[*test.User]userDevice{
@@ -1040,6 +1060,104 @@ func TestAdminEvacuateUser(t *testing.T) {
 	})
 }
 
+func TestAdminDeactivateUser(t *testing.T) {
+	aliceAdmin := test.NewUser(t, test.WithAccountType(uapi.AccountTypeAdmin))
+	bob := test.NewUser(t)
+	room := test.NewRoom(t, aliceAdmin)
+	room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{
+		"membership": "join",
+	}, test.WithStateKey(bob.ID))
+
+	ctx := context.Background()
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		natsInstance := jetstream.NATSInstance{}
+		defer close()
+
+		routers := httputil.NewRouters()
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+
+		// this starts the JetStream consumers
+		fsAPI := federationapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, basepkg.CreateFederationClient(cfg, nil), rsAPI, caches, nil, true)
+		rsAPI.SetFederationAPI(fsAPI, nil)
+
+		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
+
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", api.DoNotSendToOtherServers, nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
+
+		accessTokens := map[*test.User]userDevice{
+			aliceAdmin: {},
+			bob:        {},
+		}
+		createAccessTokens(t, accessTokens, userAPI, ctx, routers)
+
+		testCases := []struct {
+			name         string
+			userID       string
+			query        string
+			wantCode     int
+			wantAffected []string
+			wantDevices  []string
+		}{
+			{name: "Dry run lists the rooms and devices", userID: bob.ID, query: "?dry_run=true", wantCode: http.StatusOK, wantAffected: []string{room.ID}, wantDevices: []string{accessTokens[bob].deviceID}},
+			{name: "Can deactivate existing user", userID: bob.ID, wantCode: http.StatusOK, wantAffected: []string{room.ID}, wantDevices: []string{accessTokens[bob].deviceID}},
+			{name: "Can not deactivate user from different server", userID: "@doesnotexist:localhost", wantCode: http.StatusBadRequest, wantAffected: []string{}, wantDevices: []string{}},
+			{name: "Can not deactivate non-existent user", userID: "@doesnotexist:test", wantCode: http.StatusNotFound, wantAffected: []string{}, wantDevices: []string{}},
+		}
+
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				req := test.NewRequest(t, http.MethodPost, "/_dendrite/admin/deactivate/"+tc.userID+tc.query)
+				req.Header.Set("Authorization", "Bearer "+accessTokens[aliceAdmin].accessToken)
+
+				rec := httptest.NewRecorder()
+				routers.DendriteAdmin.ServeHTTP(rec, req)
+				t.Logf("%s", rec.Body.String())
+				if rec.Code != tc.wantCode {
+					t.Fatalf("expected http status %d, got %d: %s", tc.wantCode, rec.Code, rec.Body.String())
+				}
+
+				for field, want := range map[string][]string{"affected": tc.wantAffected, "devices": tc.wantDevices} {
+					got := []string{}
+					for _, x := range gjson.GetBytes(rec.Body.Bytes(), field).Array() {
+						got = append(got, x.Str)
+					}
+					if !reflect.DeepEqual(got, want) {
+						t.Fatalf("expected %s %#v, but got %#v", field, want, got)
+					}
+				}
+			})
+		}
+		// Wait for the FS API to have consumed every message
+		js, _ := natsInstance.Prepare(processCtx, &cfg.Global.JetStream)
+		timeout := time.After(time.Second)
+		for {
+			select {
+			case <-timeout:
+				t.Fatalf("FS API didn't process all events in time")
+			default:
+			}
+			info, err := js.ConsumerInfo(cfg.Global.JetStream.Prefixed(jetstream.OutputRoomEvent), cfg.Global.JetStream.Durable("FederationAPIRoomServerConsumer")+"Pull")
+			if err != nil {
+				time.Sleep(time.Millisecond * 10)
+				continue
+			}
+			if info.NumPending == 0 && info.NumAckPending == 0 {
+				break
+			}
+		}
+	})
+}
+
 func TestAdminMarkAsStale(t *testing.T) {
 	aliceAdmin := test.NewUser(t, test.WithAccountType(uapi.AccountTypeAdmin))
 
@@ -1058,7 +1176,9 @@ func TestAdminMarkAsStale(t *testing.T) {
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 
 		// We mostly need the rsAPI for this test, so nil for other APIs/caches etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 
 		// Create the users in the userapi and login
 		accessTokens := map[*test.User]userDevice{
@@ -1092,3 +1212,241 @@ func TestAdminMarkAsStale(t *testing.T) {
 		}
 	})
 }
+
+func TestAdminShadowBan(t *testing.T) {
+	aliceAdmin := test.NewUser(t, test.WithAccountType(uapi.AccountTypeAdmin))
+	bob := test.NewUser(t)
+	room := test.NewRoom(t, aliceAdmin)
+	room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{
+		"membership": "join",
+	}, test.WithStateKey(bob.ID))
+	message := room.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    "hello",
+	})
+
+	ctx := context.Background()
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		natsInstance := jetstream.NATSInstance{}
+		defer close()
+
+		routers := httputil.NewRouters()
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
+
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", api.DoNotSendToOtherServers, nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
+
+		accessTokens := map[*test.User]userDevice{
+			aliceAdmin: {},
+			bob:        {},
+		}
+		createAccessTokens(t, accessTokens, userAPI, ctx, routers)
+
+		shadowBan := func(t *testing.T, method, userID string) *httptest.ResponseRecorder {
+			req := test.NewRequest(t, method, "/_dendrite/admin/shadowBan/"+userID)
+			req.Header.Set("Authorization", "Bearer "+accessTokens[aliceAdmin].accessToken)
+			rec := httptest.NewRecorder()
+			routers.DendriteAdmin.ServeHTTP(rec, req)
+			return rec
+		}
+		latestEvents := func(t *testing.T) []string {
+			res := &api.QueryLatestEventsAndStateResponse{}
+			if err := rsAPI.QueryLatestEventsAndState(ctx, &api.QueryLatestEventsAndStateRequest{RoomID: room.ID}, res); err != nil {
+				t.Fatalf("failed to query latest events: %v", err)
+			}
+			return res.LatestEvents
+		}
+
+		t.Run("unknown user is not found", func(t *testing.T) {
+			rec := shadowBan(t, http.MethodPost, "@doesnotexist:test")
+			if rec.Code != http.StatusNotFound {
+				t.Fatalf("expected http status %d, got %d: %s", http.StatusNotFound, rec.Code, rec.Body.String())
+			}
+		})
+
+		t.Run("existing user can be shadow banned", func(t *testing.T) {
+			rec := shadowBan(t, http.MethodPost, bob.ID)
+			if rec.Code != http.StatusOK || !gjson.GetBytes(rec.Body.Bytes(), "shadow_banned").Bool() {
+				t.Fatalf("expected the user to be shadow banned, got %d: %s", rec.Code, rec.Body.String())
+			}
+		})
+
+		t.Run("requests from shadow banned users succeed but do nothing", func(t *testing.T) {
+			before := latestEvents(t)
+			profileBefore, err := userAPI.QueryProfile(ctx, bob.ID)
+			if err != nil {
+				t.Fatalf("failed to query profile: %v", err)
+			}
+
+			routes := []struct {
+				method     string
+				path       string
+				wantFields []string
+			}{
+				{http.MethodPut, "/_matrix/client/v3/rooms/" + room.ID + "/send/m.room.message/txn1", []string{"event_id"}},
+				{http.MethodPut, "/_matrix/client/v3/rooms/" + room.ID + "/state/m.room.topic/", []string{"event_id"}},
+				{http.MethodPut, "/_matrix/client/v3/rooms/" + room.ID + "/redact/" + message.EventID() + "/txn2", []string{"event_id"}},
+				{http.MethodPost, "/_matrix/client/v3/rooms/" + room.ID + "/invite", nil},
+				{http.MethodPost, "/_matrix/client/v3/rooms/" + room.ID + "/kick", nil},
+				{http.MethodPost, "/_matrix/client/v3/join/" + room.ID, []string{"room_id"}},
+				{http.MethodPut, "/_matrix/client/v3/rooms/" + room.ID + "/typing/" + bob.ID, nil},
+				{http.MethodPost, "/_matrix/client/v3/rooms/" + room.ID + "/receipt/m.read/" + message.EventID(), nil},
+				{http.MethodPut, "/_matrix/client/v3/profile/" + bob.ID + "/displayname", nil},
+			}
+			body := map[string]interface{}{
+				"msgtype":     "m.text",
+				"body":        "spam",
+				"topic":       "spam",
+				"user_id":     aliceAdmin.ID,
+				"typing":      true,
+				"displayname": "spammer",
+			}
+			for _, route := range routes {
+				req := test.NewRequest(t, route.method, route.path, test.WithJSONBody(t, body))
+				req.Header.Set("Authorization", "Bearer "+accessTokens[bob].accessToken)
+				rec := httptest.NewRecorder()
+				routers.Client.ServeHTTP(rec, req)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("%s %s: expected http status %d, got %d: %s", route.method, route.path, http.StatusOK, rec.Code, rec.Body.String())
+				}
+				for _, field := range route.wantFields {
+					if !gjson.GetBytes(rec.Body.Bytes(), field).Exists() {
+						t.Fatalf("%s %s: expected %q in the response: %s", route.method, route.path, field, rec.Body.String())
+					}
+				}
+			}
+
+			if after := latestEvents(t); !reflect.DeepEqual(before, after) {
+				t.Fatalf("expected no new events in the room, latest events went from %v to %v", before, after)
+			}
+			profileAfter, err := userAPI.QueryProfile(ctx, bob.ID)
+			if err != nil {
+				t.Fatalf("failed to query profile: %v", err)
+			}
+			if profileAfter.DisplayName != profileBefore.DisplayName {
+				t.Fatalf("expected the display name to be unchanged, got %q", profileAfter.DisplayName)
+			}
+		})
+
+		t.Run("lifting the shadow ban lets events through again", func(t *testing.T) {
+			rec := shadowBan(t, http.MethodDelete, bob.ID)
+			if rec.Code != http.StatusOK || gjson.GetBytes(rec.Body.Bytes(), "shadow_banned").Bool() {
+				t.Fatalf("expected the shadow ban to be lifted, got %d: %s", rec.Code, rec.Body.String())
+			}
+
+			before := latestEvents(t)
+			req := test.NewRequest(t, http.MethodPut, "/_matrix/client/v3/rooms/"+room.ID+"/send/m.room.message/txn3", test.WithJSONBody(t, map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "hello again",
+			}))
+			req.Header.Set("Authorization", "Bearer "+accessTokens[bob].accessToken)
+			rec = httptest.NewRecorder()
+			routers.Client.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected http status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+			}
+			if after := latestEvents(t); reflect.DeepEqual(before, after) {
+				t.Fatalf("expected the message to be sent into the room")
+			}
+		})
+	})
+}
+
+func TestAdminRedactUserEvents(t *testing.T) {
+	aliceAdmin := test.NewUser(t, test.WithAccountType(uapi.AccountTypeAdmin))
+	bob := test.NewUser(t)
+
+	// Bob sends three messages in each of two rooms.
+	rooms := []*test.Room{test.NewRoom(t, aliceAdmin), test.NewRoom(t, aliceAdmin)}
+	messages := make([][]string, len(rooms))
+	for i, room := range rooms {
+		room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{
+			"membership": "join",
+		}, test.WithStateKey(bob.ID))
+		for j := 0; j < 3; j++ {
+			ev := room.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    fmt.Sprintf("message %d", j),
+			})
+			messages[i] = append(messages[i], ev.EventID())
+		}
+	}
+
+	ctx := context.Background()
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		natsInstance := jetstream.NATSInstance{}
+		defer close()
+
+		routers := httputil.NewRouters()
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
+
+		// The rooms are created in order, so the second room has the most recent messages.
+		for _, room := range rooms {
+			if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", api.DoNotSendToOtherServers, nil, false); err != nil {
+				t.Fatalf("failed to send events: %v", err)
+			}
+		}
+
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
+
+		accessTokens := map[*test.User]userDevice{
+			aliceAdmin: {},
+		}
+		createAccessTokens(t, accessTokens, userAPI, ctx, routers)
+
+		testCases := []struct {
+			name         string
+			limit        int
+			wantRedacted []string
+		}{
+			{name: "limit applies across all rooms", limit: 4, wantRedacted: append([]string{messages[0][2]}, messages[1]...)},
+			{name: "everything within the limit", limit: 100, wantRedacted: append(append([]string{}, messages[0]...), messages[1]...)},
+		}
+
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				req := test.NewRequest(t, http.MethodPost, "/_dendrite/admin/redactUserEvents/"+bob.ID+"?dry_run=true", test.WithJSONBody(t, map[string]interface{}{
+					"limit": tc.limit,
+				}))
+				req.Header.Set("Authorization", "Bearer "+accessTokens[aliceAdmin].accessToken)
+
+				rec := httptest.NewRecorder()
+				routers.DendriteAdmin.ServeHTTP(rec, req)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("expected http status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+				}
+
+				redacted := map[string]bool{}
+				for _, x := range gjson.GetBytes(rec.Body.Bytes(), "redacted").Array() {
+					redacted[x.Str] = true
+				}
+				want := map[string]bool{}
+				for _, eventID := range tc.wantRedacted {
+					want[eventID] = true
+				}
+				if !reflect.DeepEqual(redacted, want) {
+					t.Fatalf("expected redacted %v, but got %v", tc.wantRedacted, rec.Body.String())
+				}
+			})
+		}
+	})
+}
@@ -15,6 +15,8 @@
 package clientapi
 
 import (
+	"fmt"
+
 	"github.com/matrix-org/dendrite/internal/httputil"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/setup/process"
@@ -26,6 +28,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/producers"
 	"github.com/matrix-org/dendrite/clientapi/routing"
 	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/dendrite/internal/spamcheck"
 	"github.com/matrix-org/dendrite/internal/transactions"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/jetstream"
@@ -45,7 +48,12 @@ func AddPublicRoutes(
 	userAPI userapi.ClientUserAPI,
 	userDirectoryProvider userapi.QuerySearchProfilesAPI,
 	extRoomsProvider api.ExtraPublicRoomsProvider, enableMetrics bool,
-) {
+) error {
+	spamCheckers, err := spamcheck.New(&cfg.Global.SpamChecker)
+	if err != nil {
+		return fmt.Errorf("failed to set up spam checkers: %w", err)
+	}
+
 	js, natsClient := natsInstance.Prepare(processContext, &cfg.Global.JetStream)
 
 	syncProducer := &producers.SyncAPIProducer{
@@ -58,11 +66,11 @@ func AddPublicRoutes(
 		ServerName:             cfg.Global.ServerName,
 	}
 
-	routing.Setup(
-		routers,
+	return routing.Setup(
+		processContext, routers,
 		cfg, rsAPI, asAPI,
 		userAPI, userDirectoryProvider, federation,
 		syncProducer, transactionsCache, fsAPI,
-		extRoomsProvider, natsClient, enableMetrics,
+		extRoomsProvider, natsClient, spamCheckers, enableMetrics,
 	)
 }
@@ -11,6 +11,7 @@ import (
 	"net/url"
 	"strings"
 	"testing"
+	"text/template"
 	"time"
 
 	"github.com/matrix-org/dendrite/appservice"
@@ -21,6 +22,7 @@ import (
 	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/httputil"
 	"github.com/matrix-org/dendrite/internal/pushrules"
+	"github.com/matrix-org/dendrite/internal/spamcheck"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver"
 	"github.com/matrix-org/dendrite/roomserver/api"
@@ -129,7 +131,9 @@ func TestGetPutDevices(t *testing.T) {
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 
 		// We mostly need the rsAPI for this test, so nil for other APIs/caches etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 
 		accessTokens := map[*test.User]userDevice{
 			alice: {},
@@ -178,7 +182,9 @@ func TestDeleteDevice(t *testing.T) {
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 
 		// We mostly need the rsAPI/ for this test, so nil for other APIs/caches etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 
 		accessTokens := map[*test.User]userDevice{
 			alice: {},
@@ -283,7 +289,9 @@ func TestDeleteDevices(t *testing.T) {
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 
 		// We mostly need the rsAPI/ for this test, so nil for other APIs/caches etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 
 		accessTokens := map[*test.User]userDevice{
 			alice: {},
@@ -450,7 +458,9 @@ func TestSetDisplayname(t *testing.T) {
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 		asPI := appservice.NewInternalAPI(processCtx, cfg, natsInstance, userAPI, rsAPI)
 
-		AddPublicRoutes(processCtx, routers, cfg, natsInstance, base.CreateFederationClient(cfg, nil), rsAPI, asPI, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, natsInstance, base.CreateFederationClient(cfg, nil), rsAPI, asPI, nil, nil, userAPI, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 
 		accessTokens := map[*test.User]userDevice{
 			alice: {},
@@ -562,7 +572,9 @@ func TestSetAvatarURL(t *testing.T) {
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 		asPI := appservice.NewInternalAPI(processCtx, cfg, natsInstance, userAPI, rsAPI)
 
-		AddPublicRoutes(processCtx, routers, cfg, natsInstance, base.CreateFederationClient(cfg, nil), rsAPI, asPI, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, natsInstance, base.CreateFederationClient(cfg, nil), rsAPI, asPI, nil, nil, userAPI, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 
 		accessTokens := map[*test.User]userDevice{
 			alice: {},
@@ -639,7 +651,9 @@ func TestTyping(t *testing.T) {
 		// Needed to create accounts
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 		// We mostly need the rsAPI/userAPI for this test, so nil for other APIs etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 
 		// Create the users in the userapi and login
 		accessTokens := map[*test.User]userDevice{
@@ -724,7 +738,9 @@ func TestMembership(t *testing.T) {
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 		rsAPI.SetUserAPI(userAPI)
 		// We mostly need the rsAPI/userAPI for this test, so nil for other APIs etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 
 		// Create the users in the userapi and login
 		accessTokens := map[*test.User]userDevice{
@@ -962,7 +978,9 @@ func TestCapabilities(t *testing.T) {
 		rsAPI.SetFederationAPI(nil, nil)
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 		// We mostly need the rsAPI/userAPI for this test, so nil for other APIs etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 
 		// Create the users in the userapi and login
 		accessTokens := map[*test.User]userDevice{
@@ -1010,7 +1028,9 @@ func TestTurnserver(t *testing.T) {
 	userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 	//rsAPI.SetUserAPI(userAPI)
 	// We mostly need the rsAPI/userAPI for this test, so nil for other APIs etc.
-	AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+	if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics); err != nil {
+		t.Fatal(err)
+	}
 
 	// Create the users in the userapi and login
 	accessTokens := map[*test.User]userDevice{
@@ -1107,7 +1127,9 @@ func Test3PID(t *testing.T) {
 		rsAPI.SetFederationAPI(nil, nil)
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 		// We mostly need the rsAPI/userAPI for this test, so nil for other APIs etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 
 		// Create the users in the userapi and login
 		accessTokens := map[*test.User]userDevice{
@@ -1284,7 +1306,9 @@ func TestPushRules(t *testing.T) {
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 
 		// We mostly need the rsAPI for this test, so nil for other APIs/caches etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 
 		accessTokens := map[*test.User]userDevice{
 			alice: {},
@@ -1671,7 +1695,9 @@ func TestKeys(t *testing.T) {
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 
 		// We mostly need the rsAPI for this test, so nil for other APIs/caches etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 
 		accessTokens := map[*test.User]userDevice{
 			alice: {},
@@ -2133,7 +2159,9 @@ func TestKeyBackup(t *testing.T) {
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 
 		// We mostly need the rsAPI for this test, so nil for other APIs/caches etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 
 		accessTokens := map[*test.User]userDevice{
 			alice: {},
@@ -2237,7 +2265,9 @@ func TestGetMembership(t *testing.T) {
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 
 		// We mostly need the rsAPI for this test, so nil for other APIs/caches etc.
-		AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
 
 		accessTokens := map[*test.User]userDevice{
 			alice: {},
@@ -2278,3 +2308,230 @@ func TestGetMembership(t *testing.T) {
 		}
 	})
 }
+
+func TestConsentRequired(t *testing.T) {
+	alice := test.NewUser(t)
+	room := "!room:test"
+	// Every route which changes something other users can see.
+	gatedRoutes := []struct {
+		method string
+		path   string
+	}{
+		{http.MethodPost, "/_matrix/client/v3/createRoom"},
+		{http.MethodPost, "/_matrix/client/v3/join/" + room},
+		{http.MethodPost, "/_matrix/client/v3/rooms/" + room + "/join"},
+		{http.MethodPost, "/_matrix/client/v3/rooms/" + room + "/invite"},
+		{http.MethodPost, "/_matrix/client/v3/rooms/" + room + "/ban"},
+		{http.MethodPost, "/_matrix/client/v3/rooms/" + room + "/unban"},
+		{http.MethodPost, "/_matrix/client/v3/rooms/" + room + "/kick"},
+		{http.MethodPost, "/_matrix/client/v3/rooms/" + room + "/send/m.room.message"},
+		{http.MethodPut, "/_matrix/client/v3/rooms/" + room + "/send/m.room.message/txn1"},
+		{http.MethodPut, "/_matrix/client/v3/rooms/" + room + "/state/m.room.topic"},
+		{http.MethodPut, "/_matrix/client/v3/rooms/" + room + "/state/m.room.topic/"},
+		{http.MethodPost, "/_matrix/client/v3/rooms/" + room + "/redact/$event"},
+		{http.MethodPut, "/_matrix/client/v3/rooms/" + room + "/redact/$event/txn1"},
+		{http.MethodPut, "/_matrix/client/v3/rooms/" + room + "/typing/" + alice.ID},
+		{http.MethodPost, "/_matrix/client/v3/rooms/" + room + "/receipt/m.read/$event"},
+		{http.MethodPost, "/_matrix/client/v3/rooms/" + room + "/read_markers"},
+		{http.MethodPost, "/_matrix/client/v3/rooms/" + room + "/upgrade"},
+		{http.MethodPut, "/_matrix/client/v3/directory/room/%23alias:test"},
+		{http.MethodDelete, "/_matrix/client/v3/directory/room/%23alias:test"},
+		{http.MethodPut, "/_matrix/client/v3/directory/list/room/" + room},
+		{http.MethodPut, "/_matrix/client/v3/profile/" + alice.ID + "/avatar_url"},
+		{http.MethodPut, "/_matrix/client/v3/profile/" + alice.ID + "/displayname"},
+		{http.MethodPut, "/_matrix/client/v3/presence/" + alice.ID + "/status"},
+	}
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, closeDB := testrig.CreateConfig(t, dbType)
+		defer closeDB()
+		cfg.Global.UserConsentOptions = config.UserConsentOptions{
+			Enabled:    true,
+			BaseURL:    "https://test",
+			FormSecret: "secret",
+			Version:    "1.0",
+		}
+		cfg.Global.UserConsentOptions.TextTemplates = template.Must(
+			template.New("blockEventsError").Parse("Agree to the policy at {{ .ConsentURL }}"),
+		)
+		natsInstance := jetstream.NATSInstance{}
+		routers := httputil.NewRouters()
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
+
+		accessTokens := map[*test.User]userDevice{
+			alice: {},
+		}
+		createAccessTokens(t, accessTokens, userAPI, processCtx.Context(), routers)
+
+		for _, route := range gatedRoutes {
+			t.Run(route.method+" "+route.path, func(t *testing.T) {
+				req := test.NewRequest(t, route.method, route.path, test.WithJSONBody(t, map[string]interface{}{}))
+				req.Header.Set("Authorization", "Bearer "+accessTokens[alice].accessToken)
+				rec := httptest.NewRecorder()
+				routers.Client.ServeHTTP(rec, req)
+				if rec.Code != http.StatusForbidden || gjson.GetBytes(rec.Body.Bytes(), "errcode").Str != "M_CONSENT_NOT_GIVEN" {
+					t.Fatalf("expected the request to be refused for missing consent, got %d: %s", rec.Code, rec.Body.String())
+				}
+			})
+		}
+
+		// Users can still leave rooms without agreeing to the policy.
+		req := test.NewRequest(t, http.MethodPost, "/_matrix/client/v3/rooms/"+room+"/leave", test.WithJSONBody(t, map[string]interface{}{}))
+		req.Header.Set("Authorization", "Bearer "+accessTokens[alice].accessToken)
+		rec := httptest.NewRecorder()
+		routers.Client.ServeHTTP(rec, req)
+		if gjson.GetBytes(rec.Body.Bytes(), "errcode").Str == "M_CONSENT_NOT_GIVEN" {
+			t.Fatalf("expected leaving to be allowed without consent: %s", rec.Body.String())
+		}
+	})
+}
+
+// spamTestChecker rejects messages saying "spam", and room creation and
+// invites by or of the configured user.
+type spamTestChecker struct {
+	spamcheck.AllowAll
+	userID string
+}
+
+func (c spamTestChecker) CheckEventForSpam(ctx context.Context, event *spamcheck.Event) error {
+	if event.Type == "m.room.message" && gjson.GetBytes(event.Content, "body").Str == "spam" {
+		return &spamcheck.Rejection{Reason: "no spam"}
+	}
+	return nil
+}
+
+func (c spamTestChecker) UserMayInvite(ctx context.Context, inviter, invitee, roomID string) error {
+	if invitee == c.userID {
+		return &spamcheck.Rejection{Reason: "no invites"}
+	}
+	return nil
+}
+
+func (c spamTestChecker) UserMayCreateRoom(ctx context.Context, userID string) error {
+	if userID == c.userID {
+		return &spamcheck.Rejection{Reason: "no rooms"}
+	}
+	return nil
+}
+
+func init() {
+	spamcheck.Register("clientapi_test", func(options map[string]interface{}) (spamcheck.SpamChecker, error) {
+		userID, _ := options["user_id"].(string)
+		return spamTestChecker{userID: userID}, nil
+	})
+}
+
+func TestSpamChecker(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	ctx := context.Background()
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, closeDB := testrig.CreateConfig(t, dbType)
+		defer closeDB()
+		cfg.ClientAPI.RateLimiting.Enabled = false
+		cfg.Global.SpamChecker.Modules = []config.SpamCheckerModule{{
+			Name:   "clientapi_test",
+			Config: map[string]interface{}{"user_id": bob.ID},
+		}}
+		natsInstance := jetstream.NATSInstance{}
+		routers := httputil.NewRouters()
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
+		rsAPI.SetUserAPI(userAPI)
+		if err := AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics); err != nil {
+			t.Fatal(err)
+		}
+
+		accessTokens := map[*test.User]userDevice{
+			alice: {},
+			bob:   {},
+		}
+		createAccessTokens(t, accessTokens, userAPI, ctx, routers)
+
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+			t.Fatal(err)
+		}
+
+		testCases := []struct {
+			name     string
+			asUser   *test.User
+			method   string
+			path     string
+			body     map[string]interface{}
+			wantCode int
+		}{
+			{
+				name:     "Alice can create a room",
+				asUser:   alice,
+				method:   http.MethodPost,
+				path:     "/_matrix/client/v3/createRoom",
+				body:     map[string]interface{}{},
+				wantCode: http.StatusOK,
+			},
+			{
+				name:     "Bob can not create a room",
+				asUser:   bob,
+				method:   http.MethodPost,
+				path:     "/_matrix/client/v3/createRoom",
+				body:     map[string]interface{}{},
+				wantCode: http.StatusForbidden,
+			},
+			{
+				name:     "Alice can not create a room inviting Bob",
+				asUser:   alice,
+				method:   http.MethodPost,
+				path:     "/_matrix/client/v3/createRoom",
+				body:     map[string]interface{}{"invite": []string{bob.ID}},
+				wantCode: http.StatusForbidden,
+			},
+			{
+				name:     "Alice can send a message",
+				asUser:   alice,
+				method:   http.MethodPut,
+				path:     "/_matrix/client/v3/rooms/" + room.ID + "/send/m.room.message/1",
+				body:     map[string]interface{}{"msgtype": "m.text", "body": "hello"},
+				wantCode: http.StatusOK,
+			},
+			{
+				name:     "Alice can not send spam",
+				asUser:   alice,
+				method:   http.MethodPut,
+				path:     "/_matrix/client/v3/rooms/" + room.ID + "/send/m.room.message/2",
+				body:     map[string]interface{}{"msgtype": "m.text", "body": "spam"},
+				wantCode: http.StatusForbidden,
+			},
+			{
+				name:     "Alice can not invite Bob",
+				asUser:   alice,
+				method:   http.MethodPost,
+				path:     "/_matrix/client/v3/rooms/" + room.ID + "/invite",
+				body:     map[string]interface{}{"user_id": bob.ID},
+				wantCode: http.StatusForbidden,
+			},
+		}
+
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				req := test.NewRequest(t, tc.method, tc.path, test.WithJSONBody(t, tc.body))
+				req.Header.Set("Authorization", "Bearer "+accessTokens[tc.asUser].accessToken)
+				rec := httptest.NewRecorder()
+				routers.Client.ServeHTTP(rec, req)
+				if rec.Code != tc.wantCode {
+					t.Fatalf("expected HTTP %d, got %d: %s", tc.wantCode, rec.Code, rec.Body.String())
+				}
+			})
+		}
+	})
+}
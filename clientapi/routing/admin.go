@@ -2,6 +2,7 @@ package routing
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -21,6 +22,7 @@ import (
 	"golang.org/x/exp/constraints"
 
 	clientapi "github.com/matrix-org/dendrite/clientapi/api"
+	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
 	"github.com/matrix-org/dendrite/internal/httputil"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -266,13 +268,13 @@ func AdminUpdateRegistrationToken(req *http.Request, cfg *config.ClientAPI, user
 	}
 }
 
-func AdminEvacuateRoom(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+func AdminEvacuateRoom(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI, dryRun bool) util.JSONResponse {
 	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 	if err != nil {
 		return util.ErrorResponse(err)
 	}
 
-	affected, err := rsAPI.PerformAdminEvacuateRoom(req.Context(), vars["roomID"])
+	affected, err := rsAPI.PerformAdminEvacuateRoom(req.Context(), vars["roomID"], dryRun)
 	switch err.(type) {
 	case nil:
 	case eventutil.ErrRoomNoExists:
@@ -288,17 +290,18 @@ func AdminEvacuateRoom(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAP
 		Code: 200,
 		JSON: map[string]interface{}{
 			"affected": affected,
+			"dry_run":  dryRun,
 		},
 	}
 }
 
-func AdminEvacuateUser(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+func AdminEvacuateUser(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI, dryRun bool) util.JSONResponse {
 	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 	if err != nil {
 		return util.ErrorResponse(err)
 	}
 
-	affected, err := rsAPI.PerformAdminEvacuateUser(req.Context(), vars["userID"])
+	affected, err := rsAPI.PerformAdminEvacuateUser(req.Context(), vars["userID"], dryRun)
 	if err != nil {
 		logrus.WithError(err).WithField("userID", vars["userID"]).Error("Failed to evacuate user")
 		return util.MessageResponse(http.StatusBadRequest, err.Error())
@@ -308,23 +311,185 @@ func AdminEvacuateUser(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAP
 		Code: 200,
 		JSON: map[string]interface{}{
 			"affected": affected,
+			"dry_run":  dryRun,
 		},
 	}
 }
 
-func AdminPurgeRoom(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+// AdminShadowBan shadow bans (POST) or unbans (DELETE) a local user. Events sent
+// by a shadow banned user are accepted, but never reach the room.
+func AdminShadowBan(req *http.Request, cfg *config.ClientAPI, userAPI api.ClientUserAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	localpart, serverName, err := cfg.Matrix.SplitLocalID('@', vars["userID"])
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam(err.Error()),
+		}
+	}
+	shadowBanned := req.Method == http.MethodPost
+	err = userAPI.PerformAdminShadowBan(req.Context(), localpart, serverName, shadowBanned)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("User does not exist"),
+		}
+	case err != nil:
+		logrus.WithError(err).WithField("userID", vars["userID"]).Error("Failed to update shadow ban")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"shadow_banned": shadowBanned,
+		},
+	}
+}
+
+// AdminDeactivateUser deactivates a local user's account, making them leave all
+// of their rooms and deleting their devices and pushers.
+func AdminDeactivateUser(req *http.Request, cfg *config.ClientAPI, userAPI api.ClientUserAPI, dryRun bool) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	localpart, serverName, err := cfg.Matrix.SplitLocalID('@', vars["userID"])
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam(err.Error()),
+		}
+	}
+	var res api.PerformAccountDeactivationResponse
+	err = userAPI.PerformAccountDeactivation(req.Context(), &api.PerformAccountDeactivationRequest{
+		Localpart:  localpart,
+		ServerName: serverName,
+		DryRun:     dryRun,
+	}, &res)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("User does not exist"),
+		}
+	case err != nil:
+		logrus.WithError(err).WithField("userID", vars["userID"]).Error("Failed to deactivate user")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if res.Rooms == nil {
+		res.Rooms = []string{}
+	}
+	if res.Devices == nil {
+		res.Devices = []string{}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"affected": res.Rooms,
+			"devices":  res.Devices,
+			"dry_run":  dryRun,
+		},
+	}
+}
+
+// AdminRedactUserEvents redacts the most recent events sent by a local user in
+// all of the rooms they are joined to.
+func AdminRedactUserEvents(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI, dryRun bool) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	request := struct {
+		Limit  int    `json:"limit"`
+		Reason string `json:"reason"`
+	}{
+		Limit: 100,
+	}
+	if req.Body != nil && req.ContentLength != 0 {
+		if err = json.NewDecoder(req.Body).Decode(&request); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.BadJSON("Failed to decode request body: " + err.Error()),
+			}
+		}
+	}
+	if request.Limit <= 0 || request.Limit > 1000 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("limit must be between 1 and 1000"),
+		}
+	}
+
+	redacted, err := rsAPI.PerformAdminRedactUserEvents(req.Context(), vars["userID"], request.Limit, request.Reason, dryRun)
+	if err != nil {
+		logrus.WithError(err).WithField("userID", vars["userID"]).Error("Failed to redact user events")
+		return util.MessageResponse(http.StatusBadRequest, err.Error())
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"redacted": redacted,
+			"dry_run":  dryRun,
+		},
+	}
+}
+
+func AdminPurgeRoom(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI, dryRun bool) util.JSONResponse {
 	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 	if err != nil {
 		return util.ErrorResponse(err)
 	}
 
-	if err = rsAPI.PerformAdminPurgeRoom(context.Background(), vars["roomID"]); err != nil {
+	affected, err := rsAPI.PerformAdminPurgeRoom(context.Background(), vars["roomID"], dryRun)
+	if err != nil {
 		return util.ErrorResponse(err)
 	}
 
 	return util.JSONResponse{
 		Code: 200,
-		JSON: struct{}{},
+		JSON: map[string]interface{}{
+			"affected": affected,
+			"dry_run":  dryRun,
+		},
+	}
+}
+
+// AdminRedactedEvent returns the original content of a redacted event for
+// moderation review, as long as it hasn't been pruned yet.
+func AdminRedactedEvent(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	event, err := rsAPI.QueryAdminRedactedEvent(req.Context(), vars["eventID"])
+	if err != nil {
+		logrus.WithError(err).WithField("event_id", vars["eventID"]).Error("Failed to query redacted event")
+		return util.ErrorResponse(err)
+	}
+	if event == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("The event is unknown, hasn't been redacted or its content has already been pruned"),
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"event": json.RawMessage(event.JSON()),
+		},
 	}
 }
 
@@ -457,6 +622,54 @@ func AdminMarkAsStale(req *http.Request, cfg *config.ClientAPI, keyAPI api.Clien
 	}
 }
 
+func AdminFederationBackoffs(req *http.Request, fsAPI federationAPI.ClientFederationAPI) util.JSONResponse {
+	backoffs, err := fsAPI.QueryFederationBackoffs(req.Context())
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("fsAPI.QueryFederationBackoffs failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"destinations": backoffs,
+		},
+	}
+}
+
+func AdminResetFederationBackoff(req *http.Request, cfg *config.ClientAPI, fsAPI federationAPI.ClientFederationAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	serverName := spec.ServerName(vars["serverName"])
+	if _, _, ok := spec.ParseAndValidateServerName(serverName); !ok {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Invalid server name"),
+		}
+	}
+	if cfg.Matrix.IsLocalServerName(serverName) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Can not reset the backoff of a local server name"),
+		}
+	}
+	if err = fsAPI.PerformResetFederationBackoff(req.Context(), serverName); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("fsAPI.PerformResetFederationBackoff failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
 func AdminDownloadState(req *http.Request, device *api.Device, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
 	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 	if err != nil {
@@ -495,3 +708,180 @@ func AdminDownloadState(req *http.Request, device *api.Device, rsAPI roomserverA
 		JSON: struct{}{},
 	}
 }
+
+// adminRoomUpgrade is the report for a room returned by /admin/roomUpgrades.
+type adminRoomUpgrade struct {
+	RoomID        string                        `json:"room_id"`
+	RoomVersion   gomatrixserverlib.RoomVersion `json:"room_version"`
+	Stable        bool                          `json:"stable"`
+	JoinedMembers int                           `json:"joined_members"`
+	LocalMembers  int                           `json:"local_members"`
+	RemoteServers []spec.ServerName             `json:"remote_servers"`
+	Bridges       []string                      `json:"bridges"`
+	BridgeUsers   int                           `json:"bridge_users"`
+	UpgradableBy  []string                      `json:"upgradable_by"`
+}
+
+// adminRoomUpgradeVersion returns the room version given in the room_version
+// query parameter, or the default room version if there isn't one.
+func adminRoomUpgradeVersion(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) (gomatrixserverlib.RoomVersion, *util.JSONResponse) {
+	roomVersion := rsAPI.DefaultRoomVersion()
+	if param := req.URL.Query().Get("room_version"); param != "" {
+		roomVersion = gomatrixserverlib.RoomVersion(param)
+	}
+	if _, err := gomatrixserverlib.GetRoomVersion(roomVersion); err != nil {
+		return "", &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.UnsupportedRoomVersion(fmt.Sprintf("Room version %q is not supported", roomVersion)),
+		}
+	}
+	return roomVersion, nil
+}
+
+// AdminRoomUpgrades implements GET /admin/roomUpgrades, which reports the rooms
+// local users are joined to that aren't on the given room version, along with
+// who would be affected by upgrading them. With POST, all of the reported rooms
+// that a local user is allowed to upgrade are upgraded.
+func AdminRoomUpgrades(req *http.Request, cfg *config.ClientAPI, rsAPI roomserverAPI.ClientRoomserverAPI, dryRun bool) util.JSONResponse {
+	roomVersion, errRes := adminRoomUpgradeVersion(req, rsAPI)
+	if errRes != nil {
+		return *errRes
+	}
+	rooms, err := rsAPI.QueryAdminRoomUpgrades(req.Context(), roomVersion)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to query rooms to upgrade")
+		return util.ErrorResponse(err)
+	}
+
+	if req.Method == http.MethodPost {
+		request := struct {
+			Notice *string `json:"notice"`
+		}{}
+		if req.Body != nil && req.ContentLength != 0 {
+			if err = json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: spec.BadJSON("Failed to decode request body: " + err.Error()),
+				}
+			}
+		}
+		upgraded := map[string]string{}
+		failed := map[string]string{}
+		for _, room := range rooms {
+			newRoomID, err := rsAPI.PerformAdminUpgradeRoom(req.Context(), room.RoomID, "", roomVersion, adminUpgradeNotice(request.Notice, roomVersion), dryRun)
+			if err != nil {
+				failed[room.RoomID] = err.Error()
+				continue
+			}
+			upgraded[room.RoomID] = newRoomID
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]interface{}{
+				"upgraded": upgraded,
+				"failed":   failed,
+				"dry_run":  dryRun,
+			},
+		}
+	}
+
+	stable := gomatrixserverlib.StableRoomVersions()
+	report := make([]adminRoomUpgrade, 0, len(rooms))
+	for _, room := range rooms {
+		_, isStable := stable[room.RoomVersion]
+		res := adminRoomUpgrade{
+			RoomID:        room.RoomID,
+			RoomVersion:   room.RoomVersion,
+			Stable:        isStable,
+			JoinedMembers: len(room.JoinedMembers),
+			RemoteServers: room.RemoteServers,
+			Bridges:       room.Bridges,
+			UpgradableBy:  room.UpgradableBy,
+		}
+		for _, member := range room.JoinedMembers {
+			_, domain, err := gomatrixserverlib.SplitID('@', member)
+			if err == nil && cfg.Matrix.IsLocalServerName(domain) {
+				res.LocalMembers++
+			}
+			for i := range cfg.Derived.ApplicationServices {
+				if cfg.Derived.ApplicationServices[i].IsInterestedInUserID(member) {
+					res.BridgeUsers++
+					break
+				}
+			}
+		}
+		report = append(report, res)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"room_version": roomVersion,
+			"rooms":        report,
+		},
+	}
+}
+
+// AdminUpgradeRoom implements POST /admin/upgradeRoom/{roomID}, which upgrades
+// the room as a local user after posting a notice to it.
+func AdminUpgradeRoom(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI, dryRun bool) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	request := struct {
+		NewVersion gomatrixserverlib.RoomVersion `json:"new_version"`
+		UserID     string                        `json:"user_id"`
+		Notice     *string                       `json:"notice"`
+	}{}
+	if req.Body != nil && req.ContentLength != 0 {
+		if err = json.NewDecoder(req.Body).Decode(&request); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.BadJSON("Failed to decode request body: " + err.Error()),
+			}
+		}
+	}
+	if request.NewVersion == "" {
+		request.NewVersion = rsAPI.DefaultRoomVersion()
+	}
+	if _, err = gomatrixserverlib.GetRoomVersion(request.NewVersion); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.UnsupportedRoomVersion(fmt.Sprintf("Room version %q is not supported", request.NewVersion)),
+		}
+	}
+
+	newRoomID, err := rsAPI.PerformAdminUpgradeRoom(req.Context(), vars["roomID"], request.UserID, request.NewVersion, adminUpgradeNotice(request.Notice, request.NewVersion), dryRun)
+	if err != nil {
+		switch e := err.(type) {
+		case eventutil.ErrRoomNoExists:
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: spec.NotFound("Room does not exist or no local users are joined to it"),
+			}
+		case roomserverAPI.ErrNotAllowed:
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: spec.Forbidden(e.Error()),
+			}
+		}
+		logrus.WithError(err).WithField("roomID", vars["roomID"]).Error("Failed to upgrade room")
+		return util.MessageResponse(http.StatusBadRequest, err.Error())
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"replacement_room": newRoomID,
+			"dry_run":          dryRun,
+		},
+	}
+}
+
+// adminUpgradeNotice returns the notice to post to a room before upgrading it.
+// If none was given, a default one is used; an empty notice posts nothing.
+func adminUpgradeNotice(notice *string, roomVersion gomatrixserverlib.RoomVersion) string {
+	if notice != nil {
+		return *notice
+	}
+	return fmt.Sprintf("This room is being upgraded to room version %s by the server administrator. Please follow the link to the new room.", roomVersion)
+}
@@ -0,0 +1,155 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"image"
+	_ "image/gif"  // register the GIF decoder
+	_ "image/jpeg" // register the JPEG decoder
+	_ "image/png"  // register the PNG decoder
+	"net/http"
+	"sync"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/mediaapi/types/mxc"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	_ "golang.org/x/image/webp" // register the WebP decoder
+)
+
+// avatarChecker checks that avatars uploaded to this server satisfy the size
+// and dimension limits of the profile policy. Avatars on other servers aren't
+// checked, as we would have to download them first.
+type avatarChecker struct {
+	policy   *config.ProfilePolicy
+	mediaCfg *config.MediaAPI
+	dbOpts   config.DatabaseOptions
+
+	// The media database is opened on first use, so that the media API has
+	// already set it up.
+	dbOnce sync.Once
+	db     storage.Database
+	dbErr  error
+}
+
+// newAvatarChecker returns nil if avatars aren't limited.
+func newAvatarChecker(cfg *config.Dendrite) *avatarChecker {
+	if !cfg.ClientAPI.ProfilePolicy.LimitsAvatars() {
+		return nil
+	}
+	return &avatarChecker{
+		policy:   &cfg.ClientAPI.ProfilePolicy,
+		mediaCfg: &cfg.MediaAPI,
+		dbOpts:   cfg.Global.DatabaseOptions,
+	}
+}
+
+func (c *avatarChecker) mediaDB() (storage.Database, error) {
+	c.dbOnce.Do(func() {
+		cm := sqlutil.NewConnectionManager(nil, c.dbOpts)
+		c.db, c.dbErr = storage.NewMediaAPIDatasource(cm, &c.mediaCfg.Database)
+	})
+	return c.db, c.dbErr
+}
+
+// check returns an error response if the avatar doesn't satisfy the limits.
+func (c *avatarChecker) check(ctx context.Context, avatarURL string) *util.JSONResponse {
+	if c == nil || avatarURL == "" {
+		return nil
+	}
+	uri, err := mxc.Parse(avatarURL)
+	if err != nil {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("avatar_url must be an mxc:// URI"),
+		}
+	}
+	if !c.mediaCfg.Matrix.IsLocalServerName(uri.ServerName) {
+		return nil
+	}
+
+	db, err := c.mediaDB()
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("failed to open the media database")
+		return &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	metadata, err := db.GetMediaMetadata(ctx, uri.MediaID, uri.ServerName)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("db.GetMediaMetadata failed")
+		return &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if metadata == nil {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("avatar_url doesn't refer to any media on this server"),
+		}
+	}
+	if c.policy.MaxAvatarSizeBytes > 0 && metadata.FileSizeBytes > types.FileSizeBytes(c.policy.MaxAvatarSizeBytes) {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam(fmt.Sprintf("avatar must be at most %d bytes", c.policy.MaxAvatarSizeBytes)),
+		}
+	}
+	if c.policy.MaxAvatarDimensions > 0 {
+		width, height, err := c.imageDimensions(metadata.Base64Hash)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Debug("failed to read avatar dimensions")
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("avatar must be an image"),
+			}
+		}
+		if width > c.policy.MaxAvatarDimensions || height > c.policy.MaxAvatarDimensions {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam(fmt.Sprintf("avatar must be at most %dx%d pixels", c.policy.MaxAvatarDimensions, c.policy.MaxAvatarDimensions)),
+			}
+		}
+	}
+	return nil
+}
+
+func (c *avatarChecker) imageDimensions(hash types.Base64Hash) (int, int, error) {
+	path, err := fileutils.GetPathFromBase64Hash(hash, c.mediaCfg.AbsBasePath, c.mediaCfg.StoreLayout)
+	if err != nil {
+		return 0, 0, err
+	}
+	encryption, err := fileutils.NewEncryption(&c.mediaCfg.Encryption)
+	if err != nil {
+		return 0, 0, err
+	}
+	f, err := fileutils.OpenStoredFile(path, encryption)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close() // nolint: errcheck
+	imgCfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	return imgCfg.Width, imgCfg.Height, nil
+}
@@ -0,0 +1,83 @@
+package routing
+
+import (
+	"context"
+	"image"
+	"image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAvatarChecker(t *testing.T) {
+	ctx := context.Background()
+	cfg := &config.Dendrite{}
+	cfg.Global.ServerName = "localhost"
+	cfg.MediaAPI.Matrix = &cfg.Global
+	cfg.MediaAPI.AbsBasePath = config.Path(t.TempDir())
+	cfg.MediaAPI.Database = config.DatabaseOptions{
+		ConnectionString:       config.DataSource("file:" + filepath.Join(t.TempDir(), "media.db")),
+		MaxOpenConnections:     1,
+		MaxIdleConnections:     1,
+		ConnMaxLifetimeSeconds: -1,
+	}
+
+	assert.Nil(t, newAvatarChecker(cfg), "avatars shouldn't be checked without limits")
+	cfg.ClientAPI.ProfilePolicy.MaxAvatarSizeBytes = 1000
+	cfg.ClientAPI.ProfilePolicy.MaxAvatarDimensions = 64
+
+	db, err := storage.NewMediaAPIDatasource(sqlutil.NewConnectionManager(nil, config.DatabaseOptions{}), &cfg.MediaAPI.Database)
+	assert.NoError(t, err)
+	storeAvatar := func(mediaID types.MediaID, hash types.Base64Hash, size int) {
+		img := image.NewGray(image.Rect(0, 0, size, size))
+		path, err := fileutils.GetPathFromBase64Hash(hash, cfg.MediaAPI.AbsBasePath, cfg.MediaAPI.StoreLayout)
+		assert.NoError(t, err)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0770))
+		f, err := os.Create(path)
+		assert.NoError(t, err)
+		assert.NoError(t, png.Encode(f, img))
+		info, err := f.Stat()
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+		assert.NoError(t, db.StoreMediaMetadata(ctx, &types.MediaMetadata{
+			MediaID:       mediaID,
+			Origin:        "localhost",
+			ContentType:   "image/png",
+			FileSizeBytes: types.FileSizeBytes(info.Size()),
+			Base64Hash:    hash,
+		}))
+	}
+	storeAvatar("small", "smallhash", 32)
+	storeAvatar("wide", "widehash", 128)
+	assert.NoError(t, db.StoreMediaMetadata(ctx, &types.MediaMetadata{
+		MediaID: "large", Origin: "localhost", ContentType: "image/png", FileSizeBytes: 2000, Base64Hash: "largehash",
+	}))
+
+	checker := newAvatarChecker(cfg)
+	tests := map[string]bool{
+		"":                          false,
+		"mxc://localhost/small":     false,
+		"mxc://remote.server/large": false,
+		"mxc://localhost/wide":      true,
+		"mxc://localhost/large":     true,
+		"mxc://localhost/unknown":   true,
+		"https://localhost/small":   true,
+	}
+	for avatarURL, wantErr := range tests {
+		resErr := checker.check(ctx, avatarURL)
+		if (resErr != nil) != wantErr {
+			t.Errorf("check(%q) = %+v, wantErr %v", avatarURL, resErr, wantErr)
+		}
+		if resErr != nil && resErr.Code != http.StatusBadRequest {
+			t.Errorf("check(%q) returned status %d", avatarURL, resErr.Code)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+
+	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+// consentTemplateData is passed to the policy templates.
+type consentTemplateData struct {
+	// The user ID, if the page was opened with a valid consent URL
+	UserID string
+	// The localpart and HMAC from the consent URL, to post back with the form
+	Localpart string
+	UserHMAC  string
+	// The version of the policy being shown
+	Version string
+	// Whether the user has already agreed to this version of the policy
+	HasConsented bool
+	// Whether the policy is shown without a user, so can't be agreed to
+	ReadOnly bool
+}
+
+// Consent implements GET and POST /_matrix/client/consent, which shows the
+// privacy policy and lets users agree to it.
+func Consent(w http.ResponseWriter, req *http.Request, userAPI userapi.ClientUserAPI, cfg *config.ClientAPI) {
+	consentCfg := &cfg.Matrix.UserConsentOptions
+	switch req.Method {
+	case http.MethodGet:
+		consentGet(w, req, userAPI, consentCfg, cfg.Matrix.ServerName)
+	case http.MethodPost:
+		consentPost(w, req, userAPI, consentCfg, cfg.Matrix.ServerName)
+	default:
+		writeHTTPMessage(w, req, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func consentGet(
+	w http.ResponseWriter, req *http.Request,
+	userAPI userapi.ClientUserAPI, consentCfg *config.UserConsentOptions,
+	serverName spec.ServerName,
+) {
+	query := req.URL.Query()
+	version := query.Get("v")
+	if version == "" {
+		version = consentCfg.Version
+	}
+	tmpl := consentCfg.Templates.Lookup(version + ".gohtml")
+	if tmpl == nil {
+		writeHTTPMessage(w, req, "Unknown policy version", http.StatusNotFound)
+		return
+	}
+
+	data := consentTemplateData{
+		Version:  version,
+		ReadOnly: true,
+	}
+	localpart, userHMAC := query.Get("u"), query.Get("h")
+	if localpart != "" && userHMAC != "" {
+		userID := userutil.MakeUserID(localpart, serverName)
+		if !validConsentHMAC(consentCfg.FormSecret, userID, userHMAC) {
+			writeHTTPMessage(w, req, "Invalid consent URL", http.StatusForbidden)
+			return
+		}
+		res := &userapi.QueryPolicyVersionResponse{}
+		if err := userAPI.QueryPolicyVersion(req.Context(), &userapi.QueryPolicyVersionRequest{
+			Localpart:  localpart,
+			ServerName: serverName,
+		}, res); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryPolicyVersion failed")
+			writeHTTPMessage(w, req, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		data.UserID = userID
+		data.Localpart = localpart
+		data.UserHMAC = userHMAC
+		data.HasConsented = res.PolicyVersion == version
+		data.ReadOnly = false
+	}
+
+	if err := tmpl.Execute(w, data); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("unable to execute consent template")
+	}
+}
+
+func consentPost(
+	w http.ResponseWriter, req *http.Request,
+	userAPI userapi.ClientUserAPI, consentCfg *config.UserConsentOptions,
+	serverName spec.ServerName,
+) {
+	if err := req.ParseForm(); err != nil {
+		writeHTTPMessage(w, req, "Unable to parse form", http.StatusBadRequest)
+		return
+	}
+	localpart, userHMAC, version := req.PostForm.Get("u"), req.PostForm.Get("h"), req.PostForm.Get("v")
+	if version != consentCfg.Version {
+		writeHTTPMessage(w, req, "Only the current version of the policy can be agreed to", http.StatusBadRequest)
+		return
+	}
+	userID := userutil.MakeUserID(localpart, serverName)
+	if localpart == "" || !validConsentHMAC(consentCfg.FormSecret, userID, userHMAC) {
+		writeHTTPMessage(w, req, "Invalid consent URL", http.StatusForbidden)
+		return
+	}
+
+	if err := userAPI.PerformUpdatePolicyVersion(req.Context(), &userapi.UpdatePolicyVersionRequest{
+		PolicyVersion: version,
+		Localpart:     localpart,
+		ServerName:    serverName,
+	}, &userapi.UpdatePolicyVersionResponse{}); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformUpdatePolicyVersion failed")
+		writeHTTPMessage(w, req, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data := consentTemplateData{
+		UserID:       userID,
+		Localpart:    localpart,
+		UserHMAC:     userHMAC,
+		Version:      version,
+		HasConsented: true,
+	}
+	if err := consentCfg.Templates.Lookup(version+".gohtml").Execute(w, data); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("unable to execute consent template")
+	}
+}
+
+func validConsentHMAC(formSecret, userID, userHMAC string) bool {
+	got, err := hex.DecodeString(userHMAC)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(formSecret))
+	_, _ = mac.Write([]byte(userID))
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// policyNoticeAccountDataType is the type of the account data of the server
+// notices user recording which version of the privacy policy has been announced
+// to all users, so that they aren't looked up again on every restart.
+const policyNoticeAccountDataType = "org.matrix.dendrite.policy_notice"
+
+type policyNoticeContent struct {
+	Version string `json:"version"`
+}
+
+// sendPolicyUpdateNotices sends a server notice to all users who haven't agreed
+// to the current version of the privacy policy and haven't been told about it.
+// It stops when ctx is done, e.g. at shutdown, and the remaining users are
+// told after the next restart.
+func sendPolicyUpdateNotices(
+	ctx context.Context,
+	cfg *config.ClientAPI,
+	userAPI userapi.ClientUserAPI,
+	rsAPI api.ClientRoomserverAPI,
+	asAPI appserviceAPI.AppServiceInternalAPI,
+	senderDevice *userapi.Device,
+) {
+	consentCfg := &cfg.Matrix.UserConsentOptions
+	logger := logrus.WithField("policy_version", consentCfg.Version)
+
+	dataRes := &userapi.QueryAccountDataResponse{}
+	if err := userAPI.QueryAccountData(ctx, &userapi.QueryAccountDataRequest{
+		UserID:   senderDevice.UserID,
+		DataType: policyNoticeAccountDataType,
+	}, dataRes); err != nil {
+		logger.WithError(err).Error("unable to query the announced policy version")
+		return
+	}
+	var announced policyNoticeContent
+	if data, ok := dataRes.GlobalAccountData[policyNoticeAccountDataType]; ok {
+		if err := json.Unmarshal(data, &announced); err != nil {
+			logger.WithError(err).Warn("unable to parse the announced policy version")
+		}
+	}
+	if announced.Version == consentCfg.Version {
+		return
+	}
+
+	res := &userapi.QueryOutdatedPolicyResponse{}
+	if err := userAPI.QueryOutdatedPolicy(ctx, &userapi.QueryOutdatedPolicyRequest{
+		PolicyVersion: consentCfg.Version,
+	}, res); err != nil {
+		logger.WithError(err).Error("unable to query users with an outdated policy")
+		return
+	}
+
+	// The server notice sender acts as an admin for the purpose of sending the notices.
+	adminDevice := *senderDevice
+	adminDevice.AccountType = userapi.AccountTypeAdmin
+
+	var sent, failed int
+	for _, userID := range res.UserIDs {
+		if ctx.Err() != nil {
+			logger.Infof("Stopped sending policy update server notices after %d, the rest are sent after a restart", sent)
+			return
+		}
+		localpart, serverName, err := cfg.Matrix.SplitLocalID('@', userID)
+		if err != nil || localpart == cfg.Matrix.ServerNotices.LocalPart {
+			continue
+		}
+		consentURL, err := consentCfg.ConsentURL(userID)
+		if err != nil {
+			logger.WithError(err).WithField("user_id", userID).Error("unable to build consent URL")
+			failed++
+			continue
+		}
+		body := &strings.Builder{}
+		if err = consentCfg.TextTemplates.ExecuteTemplate(body, "serverNoticeTemplate", map[string]string{
+			"ConsentURL": consentURL,
+		}); err != nil {
+			logger.WithError(err).Error("unable to execute server notice template")
+			return
+		}
+
+		notice := sendServerNoticeRequest{UserID: userID}
+		notice.Content.MsgType = consentCfg.ServerNoticeContent.MsgType
+		notice.Content.Body = body.String()
+		data, err := json.Marshal(notice)
+		if err != nil {
+			logger.WithError(err).Error("unable to marshal server notice")
+			return
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/", bytes.NewReader(data))
+		if err != nil {
+			logger.WithError(err).Error("unable to create server notice request")
+			return
+		}
+		noticeRes := SendServerNotice(
+			req, &cfg.Matrix.ServerNotices, cfg, userAPI, rsAPI, asAPI,
+			&adminDevice, senderDevice, nil, nil,
+		)
+		if noticeRes.Code != http.StatusOK {
+			logger.WithField("user_id", userID).Errorf("unable to send server notice: %+v", noticeRes.JSON)
+			failed++
+			continue
+		}
+
+		if err = userAPI.PerformUpdatePolicyVersion(ctx, &userapi.UpdatePolicyVersionRequest{
+			PolicyVersion:      consentCfg.Version,
+			Localpart:          localpart,
+			ServerName:         serverName,
+			ServerNoticeUpdate: true,
+		}, &userapi.UpdatePolicyVersionResponse{}); err != nil {
+			logger.WithError(err).WithField("user_id", userID).Error("unable to record policy server notice")
+			failed++
+			continue
+		}
+		sent++
+	}
+	if sent > 0 {
+		logger.Infof("Sent %d policy update server notices", sent)
+	}
+	if failed > 0 || ctx.Err() != nil {
+		// The users who weren't told are retried after the next restart.
+		return
+	}
+
+	data, err := json.Marshal(policyNoticeContent{Version: consentCfg.Version})
+	if err != nil {
+		logger.WithError(err).Error("unable to marshal the announced policy version")
+		return
+	}
+	if err = userAPI.InputAccountData(ctx, &userapi.InputAccountDataRequest{
+		UserID:      senderDevice.UserID,
+		DataType:    policyNoticeAccountDataType,
+		AccountData: data,
+	}, &userapi.InputAccountDataResponse{}); err != nil {
+		logger.WithError(err).Error("unable to record the announced policy version")
+	}
+}
@@ -29,6 +29,7 @@ import (
 	"github.com/matrix-org/gomatrixserverlib/spec"
 
 	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/internal/spamcheck"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -113,6 +114,7 @@ func CreateRoom(
 	cfg *config.ClientAPI,
 	profileAPI api.ClientUserAPI, rsAPI roomserverAPI.ClientRoomserverAPI,
 	asAPI appserviceAPI.AppServiceInternalAPI,
+	spamCheckers *spamcheck.SpamCheckers,
 ) util.JSONResponse {
 	var createRequest createRoomRequest
 	resErr := httputil.UnmarshalJSONRequest(req, &createRequest)
@@ -129,6 +131,14 @@ func CreateRoom(
 			JSON: spec.InvalidParam(err.Error()),
 		}
 	}
+	if err = spamCheckers.UserMayCreateRoom(req.Context(), device.UserID); err != nil {
+		return spamcheck.ErrorResponse(req.Context(), err)
+	}
+	for _, invitee := range createRequest.Invite {
+		if err = spamCheckers.UserMayInvite(req.Context(), device.UserID, invitee, ""); err != nil {
+			return spamcheck.ErrorResponse(req.Context(), err)
+		}
+	}
 	return createRoom(req.Context(), createRequest, device, cfg, profileAPI, rsAPI, asAPI, evTime)
 }
 
@@ -156,6 +166,13 @@ func createRoom(
 		}
 	}
 
+	if createRequest.RoomAliasName != "" {
+		alias := fmt.Sprintf("#%s:%s", createRequest.RoomAliasName, userID.Domain())
+		if resErr := checkAliasLocalpartPolicy(cfg, device, createRequest.RoomAliasName, alias); resErr != nil {
+			return *resErr
+		}
+	}
+
 	logger := util.GetLogger(ctx)
 
 	// TODO: Check room ID doesn't clash with an existing one, and we
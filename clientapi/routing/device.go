@@ -35,6 +35,18 @@ type deviceJSON struct {
 	DisplayName string `json:"display_name"`
 	LastSeenIP  string `json:"last_seen_ip"`
 	LastSeenTS  int64  `json:"last_seen_ts"`
+	// Extensions to help clients tell sessions apart
+	LastSeenUserAgent string              `json:"org.matrix.dendrite.last_seen_user_agent,omitempty"`
+	Sessions          []deviceSessionJSON `json:"org.matrix.dendrite.sessions,omitempty"`
+}
+
+// deviceSessionJSON is an IP address a device was seen using.
+type deviceSessionJSON struct {
+	IP          string `json:"ip"`
+	UserAgent   string `json:"user_agent,omitempty"`
+	Location    string `json:"location,omitempty"`
+	FirstSeenTS int64  `json:"first_seen_ts"`
+	LastSeenTS  int64  `json:"last_seen_ts"`
 }
 
 type devicesJSON struct {
@@ -49,6 +61,26 @@ type devicesDeleteJSON struct {
 	Devices []string `json:"devices"`
 }
 
+func newDeviceJSON(dev *api.Device, sessions []api.DeviceSession) deviceJSON {
+	res := deviceJSON{
+		DeviceID:          dev.ID,
+		DisplayName:       dev.DisplayName,
+		LastSeenIP:        stripIPPort(dev.LastSeenIP),
+		LastSeenTS:        dev.LastSeenTS,
+		LastSeenUserAgent: dev.UserAgent,
+	}
+	for _, session := range sessions {
+		res.Sessions = append(res.Sessions, deviceSessionJSON{
+			IP:          session.IPAddr,
+			UserAgent:   session.UserAgent,
+			Location:    session.Location,
+			FirstSeenTS: session.FirstSeenTS,
+			LastSeenTS:  session.LastSeenTS,
+		})
+	}
+	return res
+}
+
 // GetDeviceByID handles /devices/{deviceID}
 func GetDeviceByID(
 	req *http.Request, userAPI api.ClientUserAPI, device *api.Device,
@@ -56,7 +88,8 @@ func GetDeviceByID(
 ) util.JSONResponse {
 	var queryRes api.QueryDevicesResponse
 	err := userAPI.QueryDevices(req.Context(), &api.QueryDevicesRequest{
-		UserID: device.UserID,
+		UserID:          device.UserID,
+		IncludeSessions: true,
 	}, &queryRes)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("QueryDevices failed")
@@ -81,12 +114,7 @@ func GetDeviceByID(
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: deviceJSON{
-			DeviceID:    targetDevice.ID,
-			DisplayName: targetDevice.DisplayName,
-			LastSeenIP:  stripIPPort(targetDevice.LastSeenIP),
-			LastSeenTS:  targetDevice.LastSeenTS,
-		},
+		JSON: newDeviceJSON(targetDevice, queryRes.Sessions[targetDevice.ID]),
 	}
 }
 
@@ -96,7 +124,8 @@ func GetDevicesByLocalpart(
 ) util.JSONResponse {
 	var queryRes api.QueryDevicesResponse
 	err := userAPI.QueryDevices(req.Context(), &api.QueryDevicesRequest{
-		UserID: device.UserID,
+		UserID:          device.UserID,
+		IncludeSessions: true,
 	}, &queryRes)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("QueryDevices failed")
@@ -109,12 +138,7 @@ func GetDevicesByLocalpart(
 	res := devicesJSON{}
 
 	for _, dev := range queryRes.Devices {
-		res.Devices = append(res.Devices, deviceJSON{
-			DeviceID:    dev.ID,
-			DisplayName: dev.DisplayName,
-			LastSeenIP:  stripIPPort(dev.LastSeenIP),
-			LastSeenTS:  dev.LastSeenTS,
-		})
+		res.Devices = append(res.Devices, newDeviceJSON(&dev, queryRes.Sessions[dev.ID]))
 	}
 
 	return util.JSONResponse{
@@ -15,6 +15,7 @@
 package routing
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 
@@ -25,6 +26,7 @@ import (
 
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/dendrite/internal"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
@@ -130,7 +132,7 @@ func SetLocalAlias(
 	cfg *config.ClientAPI,
 	rsAPI roomserverAPI.ClientRoomserverAPI,
 ) util.JSONResponse {
-	_, domain, err := gomatrixserverlib.SplitID('#', alias)
+	localpart, domain, err := gomatrixserverlib.SplitID('#', alias)
 	if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -145,6 +147,10 @@ func SetLocalAlias(
 		}
 	}
 
+	if resErr := checkAliasLocalpartPolicy(cfg, device, localpart, alias); resErr != nil {
+		return *resErr
+	}
+
 	// Check that the alias does not fall within an exclusive namespace of an
 	// application service
 	// TODO: This code should eventually be refactored with:
@@ -234,6 +240,45 @@ func SetLocalAlias(
 	}
 }
 
+// checkAliasLocalpartPolicy returns an error response if the alias localpart
+// isn't allowed by the configured room alias policy. Application services may
+// use reserved aliases within their own alias namespaces.
+func checkAliasLocalpartPolicy(cfg *config.ClientAPI, device *userapi.Device, localpart, alias string) *util.JSONResponse {
+	allowReserved := false
+	for _, appservice := range cfg.Derived.ApplicationServices {
+		if device.AppserviceID == "" || appservice.ID != device.AppserviceID {
+			continue
+		}
+		for _, namespace := range appservice.NamespaceMap["aliases"] {
+			if namespace.RegexpObject.MatchString(alias) {
+				allowReserved = true
+			}
+		}
+	}
+
+	err := internal.ValidateLocalpartPolicy(&cfg.RoomAliasLocalpartPolicy, localpart, allowReserved)
+	var policyErr internal.LocalpartPolicyError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &policyErr):
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Room alias " + policyErr.Error()),
+		}
+	case errors.Is(err, internal.ErrLocalpartReserved):
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.RoomInUse("Room alias is reserved."),
+		}
+	default:
+		return &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+}
+
 // RemoveLocalAlias implements DELETE /directory/room/{roomAlias}
 func RemoveLocalAlias(
 	req *http.Request,
@@ -64,7 +64,11 @@ func Login(
 			return *authErr
 		}
 		// make a device/access token
-		authErr2 := completeAuth(req.Context(), cfg.Matrix, userAPI, login, req.RemoteAddr, req.UserAgent())
+		var location string
+		if cfg.Matrix.LocationHeader != "" {
+			location = req.Header.Get(cfg.Matrix.LocationHeader)
+		}
+		authErr2 := completeAuth(req.Context(), cfg.Matrix, userAPI, login, req.RemoteAddr, req.UserAgent(), location)
 		cleanup(req.Context(), &authErr2)
 		return authErr2
 	}
@@ -76,7 +80,7 @@ func Login(
 
 func completeAuth(
 	ctx context.Context, cfg *config.Global, userAPI userapi.ClientUserAPI, login *auth.Login,
-	ipAddr, userAgent string,
+	ipAddr, userAgent, location string,
 ) util.JSONResponse {
 	token, err := auth.GenerateAccessToken()
 	if err != nil {
@@ -105,6 +109,7 @@ func completeAuth(
 		ServerName:        serverName,
 		IPAddr:            ipAddr,
 		UserAgent:         userAgent,
+		Location:          location,
 	}, &performRes)
 	if err != nil {
 		return util.JSONResponse{
@@ -27,6 +27,7 @@ import (
 	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/types"
@@ -93,6 +94,7 @@ func GetAvatarURL(
 func SetAvatarURL(
 	req *http.Request, profileAPI userapi.ProfileAPI,
 	device *userapi.Device, userID string, cfg *config.ClientAPI, rsAPI api.ClientRoomserverAPI,
+	avatars *avatarChecker,
 ) util.JSONResponse {
 	if userID != device.UserID {
 		return util.JSONResponse{
@@ -130,6 +132,10 @@ func SetAvatarURL(
 		}
 	}
 
+	if resErr := avatars.check(req.Context(), r.AvatarURL); resErr != nil {
+		return *resErr
+	}
+
 	profile, changed, err := profileAPI.SetAvatarURL(req.Context(), localpart, domain, r.AvatarURL)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("profileAPI.SetAvatarURL failed")
@@ -219,6 +225,13 @@ func SetDisplayName(
 		}
 	}
 
+	if err = internal.ValidateDisplayName(&cfg.ProfilePolicy, r.DisplayName); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam(err.Error()),
+		}
+	}
+
 	profile, changed, err := profileAPI.SetDisplayName(req.Context(), localpart, domain, r.DisplayName)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("profileAPI.SetDisplayName failed")
@@ -337,10 +350,11 @@ func getProfile(
 			return nil, fedErr
 		}
 
+		displayName, avatarURL := internal.ClampRemoteProfile(&cfg.ProfilePolicy, profile.DisplayName, profile.AvatarURL)
 		return &authtypes.Profile{
 			Localpart:   localpart,
-			DisplayName: profile.DisplayName,
-			AvatarURL:   profile.AvatarURL,
+			DisplayName: displayName,
+			AvatarURL:   avatarURL,
 		}, nil
 	}
 
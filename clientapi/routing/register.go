@@ -74,6 +74,9 @@ type sessionsDict struct {
 	// If a UIA session is started by trying to delete device1, and then UIA is completed by deleting device2,
 	// the delete request will fail for device2 since the UIA was initiated by trying to delete device1.
 	deleteSessionToDeviceID map[string]string
+	// guestUserIDs binds sessions upgrading a guest account to that guest, so
+	// that a later stage can't complete the upgrade of another account.
+	guestUserIDs map[string]string
 }
 
 // defaultTimeout is the timeout used to clean up sessions
@@ -115,6 +118,7 @@ func (d *sessionsDict) deleteSession(sessionID string) {
 	delete(d.sessions, sessionID)
 	delete(d.deleteSessionToDeviceID, sessionID)
 	delete(d.sessionCompletedResult, sessionID)
+	delete(d.guestUserIDs, sessionID)
 	// stop the timer, e.g. because the registration was completed
 	if t, ok := d.timer[sessionID]; ok {
 		if !t.Stop() {
@@ -134,6 +138,7 @@ func newSessionsDict() *sessionsDict {
 		params:                  make(map[string]registerRequest),
 		timer:                   make(map[string]*time.Timer),
 		deleteSessionToDeviceID: make(map[string]string),
+		guestUserIDs:            make(map[string]string),
 	}
 }
 
@@ -194,6 +199,20 @@ func (d *sessionsDict) getDeviceToDelete(sessionID string) (string, bool) {
 	return deviceID, ok
 }
 
+func (d *sessionsDict) addGuestUserID(sessionID, userID string) {
+	d.startTimer(defaultTimeOut, sessionID)
+	d.Lock()
+	defer d.Unlock()
+	d.guestUserIDs[sessionID] = userID
+}
+
+func (d *sessionsDict) getGuestUserID(sessionID string) (string, bool) {
+	d.RLock()
+	defer d.RUnlock()
+	userID, ok := d.guestUserIDs[sessionID]
+	return userID, ok
+}
+
 var (
 	sessions = newSessionsDict()
 )
@@ -210,6 +229,9 @@ type registerRequest struct {
 	Username   string          `json:"username"`
 	ServerName spec.ServerName `json:"-"`
 	Admin      bool            `json:"admin"`
+	// The access token of a guest account to upgrade to a full account, which
+	// keeps the guest's user ID
+	GuestAccessToken string `json:"guest_access_token"`
 	// user-interactive auth params
 	Auth authDict `json:"auth"`
 
@@ -498,6 +520,7 @@ func Register(
 		r.DeviceID = data.DeviceID
 		r.InitialDisplayName = data.InitialDisplayName
 		r.InhibitLogin = data.InhibitLogin
+		r.GuestAccessToken = data.GuestAccessToken
 		// Check if the user already registered using this session, if so, return that result
 		if response, ok := sessions.getCompletedRegistration(sessionID); ok {
 			return util.JSONResponse{
@@ -512,16 +535,28 @@ func Register(
 	if req.URL.Query().Get("kind") == "guest" {
 		return handleGuestRegistration(req, r, cfg, userAPI)
 	}
+	upgradingGuest := r.GuestAccessToken != ""
+	if upgradingGuest {
+		if resErr := resolveGuestUpgrade(req, &r, sessionID, userAPI); resErr != nil {
+			return *resErr
+		}
+	} else if _, ok := sessions.getGuestUserID(sessionID); ok {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden("guest_access_token is required to continue upgrading the guest account"),
+		}
+	}
 
 	// Don't allow numeric usernames less than MAX_INT64.
-	if _, err = strconv.ParseInt(r.Username, 10, 64); err == nil {
+	if _, err = strconv.ParseInt(r.Username, 10, 64); err == nil && !upgradingGuest {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: spec.InvalidUsername("Numeric user IDs are reserved"),
 		}
 	}
 	// Auto generate a numeric username if r.Username is empty
-	if r.Username == "" {
+	generatedUsername := r.Username == ""
+	if generatedUsername {
 		nreq := &userapi.QueryNumericLocalpartRequest{
 			ServerName: r.ServerName,
 		}
@@ -543,12 +578,20 @@ func Register(
 	// Squash username to all lowercase letters
 	r.Username = strings.ToLower(r.Username)
 	switch {
+	case upgradingGuest:
+		// Guests keep the numeric username they were given when they
+		// registered, so it doesn't need validating again.
 	case r.Type == authtypes.LoginTypeApplicationService && accessTokenErr == nil:
 		// Spec-compliant case (the access_token is specified and the login type
 		// is correctly set, so it's an appservice registration)
 		if err = internal.ValidateApplicationServiceUsername(r.Username, r.ServerName); err != nil {
 			return *internal.UsernameResponse(err)
 		}
+		// Appservices may register reserved usernames, as long as they are
+		// within their namespace, which is checked later on.
+		if err = internal.ValidateLocalpartPolicy(&cfg.UserLocalpartPolicy, r.Username, true); err != nil {
+			return *internal.UsernameResponse(err)
+		}
 	case accessTokenErr == nil:
 		// Non-spec-compliant case (the access_token is specified but the login
 		// type is not known or specified)
@@ -562,6 +605,11 @@ func Register(
 		if err = internal.ValidateUsername(r.Username, r.ServerName); err != nil {
 			return *internal.UsernameResponse(err)
 		}
+		if !generatedUsername {
+			if err = internal.ValidateLocalpartPolicy(&cfg.UserLocalpartPolicy, r.Username, false); err != nil {
+				return *internal.UsernameResponse(err)
+			}
+		}
 	}
 	if err = internal.ValidatePassword(r.Password); err != nil {
 		return *internal.PasswordResponse(err)
@@ -648,6 +696,66 @@ func handleGuestRegistration(
 	}
 }
 
+// resolveGuestUpgrade checks that the guest_access_token of the request belongs
+// to a guest account, and sets the username and server name of the request to
+// the guest's, since guests keep their user ID when they upgrade to a full
+// account. The session is bound to the guest when the flow starts, and every
+// later stage must be for the same guest.
+func resolveGuestUpgrade(
+	req *http.Request,
+	r *registerRequest,
+	sessionID string,
+	userAPI userapi.ClientUserAPI,
+) *util.JSONResponse {
+	var res userapi.QueryAccessTokenResponse
+	if err := userAPI.QueryAccessToken(req.Context(), &userapi.QueryAccessTokenRequest{
+		AccessToken: r.GuestAccessToken,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryAccessToken failed")
+		return &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if res.Err != "" || res.Device == nil || res.Device.AccountType != userapi.AccountTypeGuest {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden("guest_access_token is not the access token of a guest account"),
+		}
+	}
+	if guestUserID, ok := sessions.getGuestUserID(sessionID); ok {
+		if guestUserID != res.Device.UserID {
+			return &util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: spec.Forbidden("guest_access_token doesn't belong to the guest this session is upgrading"),
+			}
+		}
+	} else if _, started := sessions.getParams(sessionID); started {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden("guest_access_token must be given when the session starts"),
+		}
+	}
+	localpart, serverName, err := gomatrixserverlib.SplitID('@', res.Device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if r.Username != "" && strings.ToLower(r.Username) != localpart {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidUsername("Guest accounts keep their user ID when they are upgraded"),
+		}
+	}
+	r.Username = localpart
+	r.ServerName = serverName
+	sessions.addGuestUserID(sessionID, res.Device.UserID)
+	return nil
+}
+
 // localpartMatchesExclusiveNamespaces will check if a given username matches any
 // application service's exclusive users namespace
 func localpartMatchesExclusiveNamespaces(
@@ -671,7 +779,6 @@ func handleRegistrationFlow(
 	accessTokenErr error,
 ) util.JSONResponse {
 	// TODO: Enable registration config flag
-	// TODO: Guest account upgrading
 
 	// TODO: Handle loading of previous session parameters from database.
 	// TODO: Handle mapping registrationRequest parameters into session parameters
@@ -738,6 +845,11 @@ func handleRegistrationFlow(
 		// Add Dummy to the list of completed registration stages
 		sessions.addCompletedSessionStage(sessionID, authtypes.LoginTypeDummy)
 
+	case authtypes.LoginTypeTerms:
+		// The user agreed to the privacy policy, this is recorded once the
+		// account has been created.
+		sessions.addCompletedSessionStage(sessionID, authtypes.LoginTypeTerms)
+
 	case "":
 		// An empty auth type means that we want to fetch the available
 		// flows. It can also mean that we want to register as an appservice
@@ -813,11 +925,41 @@ func checkAndCompleteFlow(
 ) util.JSONResponse {
 	if checkFlowCompleted(flow, cfg.Derived.Registration.Flows) {
 		// This flow was completed, registration can continue
-		return completeRegistration(
-			req.Context(), userAPI, r.Username, r.ServerName, "", r.Password, "", req.RemoteAddr,
-			req.UserAgent(), sessionID, r.InhibitLogin, r.InitialDisplayName, r.DeviceID,
-			userapi.AccountTypeUser,
-		)
+		var res util.JSONResponse
+		if r.GuestAccessToken != "" {
+			if guestUserID, ok := sessions.getGuestUserID(sessionID); !ok || guestUserID != userutil.MakeUserID(r.Username, r.ServerName) {
+				return util.JSONResponse{
+					Code: http.StatusForbidden,
+					JSON: spec.Forbidden("This session isn't upgrading this guest account"),
+				}
+			}
+			res = completeGuestUpgrade(
+				req.Context(), userAPI, r.Username, r.ServerName, r.Password, req.RemoteAddr,
+				req.UserAgent(), sessionID, r.InhibitLogin, r.InitialDisplayName, r.DeviceID,
+			)
+		} else {
+			res = completeRegistration(
+				req.Context(), userAPI, r.Username, r.ServerName, "", r.Password, "", req.RemoteAddr,
+				req.UserAgent(), sessionID, r.InhibitLogin, r.InitialDisplayName, r.DeviceID,
+				userapi.AccountTypeUser,
+			)
+		}
+		if res.Code == http.StatusOK && cfg.Matrix.UserConsentOptions.RequireAtRegistration {
+			for _, stage := range flow {
+				if stage != authtypes.LoginTypeTerms {
+					continue
+				}
+				if err := userAPI.PerformUpdatePolicyVersion(req.Context(), &userapi.UpdatePolicyVersionRequest{
+					PolicyVersion: cfg.Matrix.UserConsentOptions.Version,
+					Localpart:     r.Username,
+					ServerName:    r.ServerName,
+				}, &userapi.UpdatePolicyVersionResponse{}); err != nil {
+					util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformUpdatePolicyVersion failed")
+				}
+				break
+			}
+		}
+		return res
 	}
 	sessions.addParams(sessionID, r)
 	// There are still more stages to complete.
@@ -882,13 +1024,68 @@ func completeRegistration(
 	// Increment prometheus counter for created users
 	amtRegUsers.Inc()
 
+	return completeLogin(
+		ctx, userAPI, username, accRes.Account.ServerName, displayName, ipAddr, userAgent, sessionID,
+		inhibitLogin, deviceDisplayName, deviceID,
+	)
+}
+
+// completeGuestUpgrade turns the guest account into a full account with the
+// given password, then creates a new device for it like completeRegistration.
+// The guest's existing devices stay logged in.
+func completeGuestUpgrade(
+	ctx context.Context,
+	userAPI userapi.ClientUserAPI,
+	username string, serverName spec.ServerName,
+	password, ipAddr, userAgent, sessionID string,
+	inhibitLogin eventutil.WeakBoolean,
+	deviceDisplayName, deviceID *string,
+) util.JSONResponse {
+	if password == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.MissingParam("Missing password"),
+		}
+	}
+	if err := userAPI.PerformGuestUpgrade(ctx, username, serverName, password); err != nil {
+		if _, ok := err.(*userapi.ErrorForbidden); ok {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: spec.Forbidden(err.Error()),
+			}
+		}
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.Unknown("failed to upgrade guest account: " + err.Error()),
+		}
+	}
+
+	// Increment prometheus counter for created users
+	amtRegUsers.Inc()
+
+	return completeLogin(
+		ctx, userAPI, username, serverName, "", ipAddr, userAgent, sessionID,
+		inhibitLogin, deviceDisplayName, deviceID,
+	)
+}
+
+// completeLogin creates a device for a newly registered account, unless
+// inhibitLogin is set, and records the result for the registration session.
+func completeLogin(
+	ctx context.Context,
+	userAPI userapi.ClientUserAPI,
+	username string, serverName spec.ServerName, displayName string,
+	ipAddr, userAgent, sessionID string,
+	inhibitLogin eventutil.WeakBoolean,
+	deviceDisplayName, deviceID *string,
+) util.JSONResponse {
 	// Check whether inhibit_login option is set. If so, don't create an access
 	// token or a device for this user
 	if inhibitLogin {
 		return util.JSONResponse{
 			Code: http.StatusOK,
 			JSON: registerResponse{
-				UserID: userutil.MakeUserID(username, accRes.Account.ServerName),
+				UserID: userutil.MakeUserID(username, serverName),
 			},
 		}
 	}
@@ -1030,6 +1227,9 @@ func RegisterAvailable(
 	if err := internal.ValidateUsername(username, domain); err != nil {
 		return *internal.UsernameResponse(err)
 	}
+	if err := internal.ValidateLocalpartPolicy(&cfg.UserLocalpartPolicy, username, false); err != nil {
+		return *internal.UsernameResponse(err)
+	}
 
 	// Check if this username is reserved by an application service
 	userID := userutil.MakeUserID(username, domain)
@@ -38,6 +38,7 @@ import (
 	"github.com/matrix-org/dendrite/test/testrig"
 	"github.com/matrix-org/dendrite/userapi"
 	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/gomatrixserverlib/spec"
 	"github.com/matrix-org/util"
 	"github.com/patrickmn/go-cache"
@@ -628,6 +629,105 @@ func TestRegisterUserWithDisplayName(t *testing.T) {
 	})
 }
 
+func TestUpgradeGuest(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		defer close()
+
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		natsInstance := jetstream.NATSInstance{}
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
+		if err := cfg.Derive(); err != nil {
+			t.Fatalf("failed to derive config: %s", err)
+		}
+
+		register := func(query string, reg registerRequest) util.JSONResponse {
+			body := &bytes.Buffer{}
+			if err := json.NewEncoder(body).Encode(reg); err != nil {
+				t.Fatal(err)
+			}
+			return Register(httptest.NewRequest(http.MethodPost, "/"+query, body), userAPI, &cfg.ClientAPI)
+		}
+		registerGuest := func() registerResponse {
+			resp := register("?kind=guest", registerRequest{})
+			guest, ok := resp.JSON.(registerResponse)
+			if !ok {
+				t.Fatalf("failed to register guest: %+v", resp)
+			}
+			return guest
+		}
+		guest, otherGuest := registerGuest(), registerGuest()
+
+		// The guest can't pick a new username, and the token must be a guest's.
+		resp := register("", registerRequest{GuestAccessToken: guest.AccessToken, Username: "alice", Password: "someRandomPassword"})
+		assert.Equal(t, http.StatusBadRequest, resp.Code)
+		resp = register("", registerRequest{GuestAccessToken: "notatoken", Password: "someRandomPassword"})
+		assert.Equal(t, http.StatusForbidden, resp.Code)
+
+		// Upgrade the guest after going through the registration flow.
+		resp = register("", registerRequest{GuestAccessToken: guest.AccessToken, Password: "someRandomPassword"})
+		uia, ok := resp.JSON.(userInteractiveResponse)
+		if !ok {
+			t.Fatalf("did not receive a userInteractiveResponse: %+v", resp)
+		}
+		// Later stages of the flow can't upgrade another guest, and need a
+		// valid access token of the guest the flow was started for.
+		dummyAuth := authDict{Type: authtypes.LoginTypeDummy, Session: uia.Session}
+		resp = register("", registerRequest{GuestAccessToken: otherGuest.AccessToken, Password: "someRandomPassword", Auth: dummyAuth})
+		assert.Equal(t, http.StatusForbidden, resp.Code)
+		resp = register("", registerRequest{GuestAccessToken: "notatoken", Password: "someRandomPassword", Auth: dummyAuth})
+		assert.Equal(t, http.StatusForbidden, resp.Code)
+		resp = register("", registerRequest{Password: "someRandomPassword", Auth: dummyAuth})
+		assert.Equal(t, http.StatusForbidden, resp.Code)
+		resp = register("", registerRequest{GuestAccessToken: guest.AccessToken, Password: "someRandomPassword", Auth: dummyAuth})
+		upgraded, ok := resp.JSON.(registerResponse)
+		if !ok {
+			t.Fatalf("failed to upgrade guest: %+v", resp)
+		}
+		assert.Equal(t, guest.UserID, upgraded.UserID)
+		assert.NotEqual(t, guest.DeviceID, upgraded.DeviceID)
+
+		// The guest's access token now belongs to a full account, which can log in with the password.
+		var queryRes api.QueryAccessTokenResponse
+		assert.NoError(t, userAPI.QueryAccessToken(processCtx.Context(), &api.QueryAccessTokenRequest{AccessToken: guest.AccessToken}, &queryRes))
+		if assert.NotNil(t, queryRes.Device) {
+			assert.Equal(t, api.AccountTypeUser, queryRes.Device.AccountType)
+		}
+		localpart, serverName, err := gomatrixserverlib.SplitID('@', guest.UserID)
+		assert.NoError(t, err)
+		var accRes api.QueryAccountByPasswordResponse
+		assert.NoError(t, userAPI.QueryAccountByPassword(processCtx.Context(), &api.QueryAccountByPasswordRequest{
+			Localpart:         localpart,
+			ServerName:        serverName,
+			PlaintextPassword: "someRandomPassword",
+		}, &accRes))
+		assert.True(t, accRes.Exists)
+
+		// It can't be upgraded again.
+		resp = register("", registerRequest{GuestAccessToken: guest.AccessToken, Password: "someRandomPassword"})
+		assert.Equal(t, http.StatusForbidden, resp.Code)
+
+		// A token that no longer belongs to a guest is rejected in the middle of a flow too.
+		resp = register("", registerRequest{GuestAccessToken: otherGuest.AccessToken, Password: "someRandomPassword"})
+		uia, ok = resp.JSON.(userInteractiveResponse)
+		if !ok {
+			t.Fatalf("did not receive a userInteractiveResponse: %+v", resp)
+		}
+		dummyAuth = authDict{Type: authtypes.LoginTypeDummy, Session: uia.Session}
+		resp = register("", registerRequest{GuestAccessToken: guest.AccessToken, Password: "someRandomPassword", Auth: dummyAuth})
+		assert.Equal(t, http.StatusForbidden, resp.Code)
+		resp = register("", registerRequest{GuestAccessToken: otherGuest.AccessToken, Password: "someRandomPassword", Auth: dummyAuth})
+		upgraded, ok = resp.JSON.(registerResponse)
+		if !ok {
+			t.Fatalf("failed to upgrade guest: %+v", resp)
+		}
+		assert.Equal(t, otherGuest.UserID, upgraded.UserID)
+	})
+}
+
 func TestRegisterAdminUsingSharedSecret(t *testing.T) {
 	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
 		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
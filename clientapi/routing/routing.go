@@ -16,6 +16,7 @@ package routing
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"strings"
 
@@ -38,10 +39,12 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/producers"
 	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
 	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/internal/spamcheck"
 	"github.com/matrix-org/dendrite/internal/transactions"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/setup/process"
 )
 
 type WellKnownClientHomeserver struct {
@@ -58,12 +61,14 @@ type WellKnownClientResponse struct {
 }
 
 // Setup registers HTTP handlers with the given ServeMux. It also supplies the given http.Client
-// to clients which need to make outbound HTTP requests.
+// to clients which need to make outbound HTTP requests. It returns an error if the
+// server notices account can't be set up.
 //
 // Due to Setup being used to call many other functions, a gocyclo nolint is
 // applied:
 // nolint: gocyclo
 func Setup(
+	processCtx *process.ProcessContext,
 	routers httputil.Routers,
 	dendriteCfg *config.Dendrite,
 	rsAPI roomserverAPI.ClientRoomserverAPI,
@@ -75,8 +80,8 @@ func Setup(
 	transactionsCache *transactions.Cache,
 	federationSender federationAPI.ClientFederationAPI,
 	extRoomsProvider api.ExtraPublicRoomsProvider,
-	natsClient *nats.Conn, enableMetrics bool,
-) {
+	natsClient *nats.Conn, spamCheckers *spamcheck.SpamCheckers, enableMetrics bool,
+) error {
 	cfg := &dendriteCfg.ClientAPI
 	mscCfg := &dendriteCfg.MSCs
 	publicAPIMux := routers.Client
@@ -89,6 +94,16 @@ func Setup(
 	}
 
 	rateLimits := httputil.NewRateLimits(&cfg.RateLimiting)
+	// Users must have agreed to the privacy policy to change anything other
+	// users can see, if consent tracking is enabled. Leaving rooms and managing
+	// their own account, devices and keys is always allowed.
+	requireConsent := httputil.WithConsentRequired(userAPI, cfg.Matrix)
+	// Requests from shadow banned users that would change what other users see
+	// look like they succeeded, but nothing happens.
+	shadowBanned := func(fake func(*http.Request) util.JSONResponse) httputil.AuthAPIOption {
+		return httputil.WithShadowBanned(userAPI, cfg.Matrix, fake)
+	}
+	avatars := newAvatarChecker(dendriteCfg)
 	userInteractiveAuth := auth.NewUserInteractive(userAPI, cfg)
 
 	unstableFeatures := map[string]bool{
@@ -129,6 +144,15 @@ func Setup(
 		})).Methods(http.MethodGet, http.MethodOptions)
 	}
 
+	if cfg.Matrix.UserConsentOptions.Enabled {
+		logrus.Infof("Enabling consent tracking at %s", cfg.Matrix.UserConsentOptions.PolicyURL())
+		publicAPIMux.Handle("/consent",
+			httputil.MakeHTMLAPI("consent", enableMetrics, func(w http.ResponseWriter, req *http.Request) {
+				Consent(w, req, userAPI, cfg)
+			}),
+		).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+	}
+
 	publicAPIMux.Handle("/versions",
 		httputil.MakeExternalAPI("versions", func(req *http.Request) util.JSONResponse {
 			return util.JSONResponse{
@@ -209,20 +233,56 @@ func Setup(
 	).Methods(http.MethodGet, http.MethodPut, http.MethodDelete, http.MethodOptions)
 
 	dendriteAdminRouter.Handle("/admin/evacuateRoom/{roomID}",
-		httputil.MakeAdminAPI("admin_evacuate_room", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return AdminEvacuateRoom(req, rsAPI)
+		httputil.MakeDestructiveAdminAPI("admin_evacuate_room", userAPI, func(req *http.Request, device *userapi.Device, dryRun bool) util.JSONResponse {
+			return AdminEvacuateRoom(req, rsAPI, dryRun)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
 	dendriteAdminRouter.Handle("/admin/evacuateUser/{userID}",
-		httputil.MakeAdminAPI("admin_evacuate_user", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return AdminEvacuateUser(req, rsAPI)
+		httputil.MakeDestructiveAdminAPI("admin_evacuate_user", userAPI, func(req *http.Request, device *userapi.Device, dryRun bool) util.JSONResponse {
+			return AdminEvacuateUser(req, rsAPI, dryRun)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/shadowBan/{userID}",
+		httputil.MakeAdminAPI("admin_shadow_ban", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminShadowBan(req, cfg, userAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodDelete, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/deactivate/{userID}",
+		httputil.MakeDestructiveAdminAPI("admin_deactivate_user", userAPI, func(req *http.Request, device *userapi.Device, dryRun bool) util.JSONResponse {
+			return AdminDeactivateUser(req, cfg, userAPI, dryRun)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/redactUserEvents/{userID}",
+		httputil.MakeDestructiveAdminAPI("admin_redact_user_events", userAPI, func(req *http.Request, device *userapi.Device, dryRun bool) util.JSONResponse {
+			return AdminRedactUserEvents(req, rsAPI, dryRun)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
 	dendriteAdminRouter.Handle("/admin/purgeRoom/{roomID}",
-		httputil.MakeAdminAPI("admin_purge_room", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return AdminPurgeRoom(req, rsAPI)
+		httputil.MakeDestructiveAdminAPI("admin_purge_room", userAPI, func(req *http.Request, device *userapi.Device, dryRun bool) util.JSONResponse {
+			return AdminPurgeRoom(req, rsAPI, dryRun)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/redactedEvent/{eventID}",
+		httputil.MakeAdminAPI("admin_redacted_event", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminRedactedEvent(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/roomUpgrades",
+		httputil.MakeDestructiveAdminAPI("admin_room_upgrades", userAPI, func(req *http.Request, device *userapi.Device, dryRun bool) util.JSONResponse {
+			return AdminRoomUpgrades(req, cfg, rsAPI, dryRun)
+		}),
+	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/upgradeRoom/{roomID}",
+		httputil.MakeDestructiveAdminAPI("admin_upgrade_room", userAPI, func(req *http.Request, device *userapi.Device, dryRun bool) util.JSONResponse {
+			return AdminUpgradeRoom(req, rsAPI, dryRun)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
@@ -238,6 +298,18 @@ func Setup(
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
+	dendriteAdminRouter.Handle("/admin/federationBackoffs",
+		httputil.MakeAdminAPI("admin_federation_backoffs", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminFederationBackoffs(req, federationSender)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/resetFederationBackoff/{serverName}",
+		httputil.MakeAdminAPI("admin_reset_federation_backoff", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminResetFederationBackoff(req, cfg, federationSender)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
 	dendriteAdminRouter.Handle("/admin/fulltext/reindex",
 		httputil.MakeAdminAPI("admin_fultext_reindex", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return AdminReindex(req, cfg, device, natsClient)
@@ -255,7 +327,15 @@ func Setup(
 		logrus.Info("Enabling server notices at /_synapse/admin/v1/send_server_notice")
 		serverNotificationSender, err := getSenderDevice(context.Background(), rsAPI, userAPI, cfg)
 		if err != nil {
-			logrus.WithError(err).Fatal("unable to get account for sending sending server notices")
+			return fmt.Errorf("unable to get account for sending server notices: %w", err)
+		}
+
+		if cfg.Matrix.UserConsentOptions.Enabled {
+			processCtx.ComponentStarted()
+			go func() {
+				defer processCtx.ComponentFinished()
+				sendPolicyUpdateNotices(processCtx.Context(), cfg, userAPI, rsAPI, asAPI, serverNotificationSender)
+			}()
 		}
 
 		synapseAdminRouter.Handle("/admin/v1/send_server_notice/{txnID}",
@@ -309,8 +389,8 @@ func Setup(
 
 	v3mux.Handle("/createRoom",
 		httputil.MakeAuthAPI("createRoom", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return CreateRoom(req, device, cfg, userAPI, rsAPI, asAPI)
-		}),
+			return CreateRoom(req, device, cfg, userAPI, rsAPI, asAPI, spamCheckers)
+		}, requireConsent),
 	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/join/{roomIDOrAlias}",
 		httputil.MakeAuthAPI(spec.Join, userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
@@ -332,7 +412,7 @@ func Setup(
 			// will be processed as usual.
 			sf.Forget(vars["roomIDOrAlias"] + device.UserID)
 			return resp.(util.JSONResponse)
-		}, httputil.WithAllowGuests()),
+		}, httputil.WithAllowGuests(), requireConsent, shadowBanned(shadowBannedJoinResponse(rsAPI))),
 	).Methods(http.MethodPost, http.MethodOptions)
 
 	if mscCfg.Enabled("msc2753") {
@@ -376,7 +456,7 @@ func Setup(
 			// will be processed as usual.
 			sf.Forget(vars["roomID"] + device.UserID)
 			return resp.(util.JSONResponse)
-		}, httputil.WithAllowGuests()),
+		}, httputil.WithAllowGuests(), requireConsent, shadowBanned(shadowBannedJoinResponse(rsAPI))),
 	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/rooms/{roomID}/leave",
 		httputil.MakeAuthAPI("membership", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
@@ -410,7 +490,7 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 			return SendBan(req, userAPI, device, vars["roomID"], cfg, rsAPI, asAPI)
-		}),
+		}, requireConsent, shadowBanned(shadowBannedEmptyResponse)),
 	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/rooms/{roomID}/invite",
 		httputil.MakeAuthAPI("membership", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
@@ -421,8 +501,8 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return SendInvite(req, userAPI, device, vars["roomID"], cfg, rsAPI, asAPI)
-		}),
+			return SendInvite(req, userAPI, device, vars["roomID"], cfg, rsAPI, asAPI, spamCheckers)
+		}, requireConsent, shadowBanned(shadowBannedEmptyResponse)),
 	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/rooms/{roomID}/kick",
 		httputil.MakeAuthAPI("membership", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
@@ -431,7 +511,7 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 			return SendKick(req, userAPI, device, vars["roomID"], cfg, rsAPI, asAPI)
-		}),
+		}, requireConsent, shadowBanned(shadowBannedEmptyResponse)),
 	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/rooms/{roomID}/unban",
 		httputil.MakeAuthAPI("membership", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
@@ -440,7 +520,7 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 			return SendUnban(req, userAPI, device, vars["roomID"], cfg, rsAPI, asAPI)
-		}),
+		}, requireConsent, shadowBanned(shadowBannedEmptyResponse)),
 	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/rooms/{roomID}/send/{eventType}",
 		httputil.MakeAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
@@ -448,8 +528,8 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return SendEvent(req, device, vars["roomID"], vars["eventType"], nil, nil, cfg, rsAPI, nil)
-		}, httputil.WithAllowGuests()),
+			return SendEvent(req, device, vars["roomID"], vars["eventType"], nil, nil, cfg, rsAPI, nil, spamCheckers)
+		}, httputil.WithAllowGuests(), requireConsent, shadowBanned(shadowBannedEventResponse)),
 	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/rooms/{roomID}/send/{eventType}/{txnID}",
 		httputil.MakeAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
@@ -459,8 +539,8 @@ func Setup(
 			}
 			txnID := vars["txnID"]
 			return SendEvent(req, device, vars["roomID"], vars["eventType"], &txnID,
-				nil, cfg, rsAPI, transactionsCache)
-		}, httputil.WithAllowGuests()),
+				nil, cfg, rsAPI, transactionsCache, spamCheckers)
+		}, httputil.WithAllowGuests(), requireConsent, shadowBanned(shadowBannedEventResponse)),
 	).Methods(http.MethodPut, http.MethodOptions)
 
 	v3mux.Handle("/rooms/{roomID}/state", httputil.MakeAuthAPI("room_state", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
@@ -468,6 +548,9 @@ func Setup(
 		if err != nil {
 			return util.ErrorResponse(err)
 		}
+		if resErr := awaitFullRoomState(req.Context(), federationSender, vars["roomID"]); resErr != nil {
+			return *resErr
+		}
 		return OnIncomingStateRequest(req.Context(), device, rsAPI, vars["roomID"])
 	}, httputil.WithAllowGuests())).Methods(http.MethodGet, http.MethodOptions)
 
@@ -486,6 +569,9 @@ func Setup(
 		}
 		// If there's a trailing slash, remove it
 		eventType := strings.TrimSuffix(vars["type"], "/")
+		if resErr := awaitFullRoomState(req.Context(), federationSender, vars["roomID"]); resErr != nil {
+			return *resErr
+		}
 		eventFormat := req.URL.Query().Get("format") == "event"
 		return OnIncomingStateTypeRequest(req.Context(), device, rsAPI, vars["roomID"], eventType, "", eventFormat)
 	}, httputil.WithAllowGuests())).Methods(http.MethodGet, http.MethodOptions)
@@ -495,6 +581,9 @@ func Setup(
 		if err != nil {
 			return util.ErrorResponse(err)
 		}
+		if resErr := awaitFullRoomState(req.Context(), federationSender, vars["roomID"]); resErr != nil {
+			return *resErr
+		}
 		eventFormat := req.URL.Query().Get("format") == "event"
 		return OnIncomingStateTypeRequest(req.Context(), device, rsAPI, vars["roomID"], vars["type"], vars["stateKey"], eventFormat)
 	}, httputil.WithAllowGuests())).Methods(http.MethodGet, http.MethodOptions)
@@ -507,8 +596,8 @@ func Setup(
 			}
 			emptyString := ""
 			eventType := strings.TrimSuffix(vars["eventType"], "/")
-			return SendEvent(req, device, vars["roomID"], eventType, nil, &emptyString, cfg, rsAPI, nil)
-		}, httputil.WithAllowGuests()),
+			return SendEvent(req, device, vars["roomID"], eventType, nil, &emptyString, cfg, rsAPI, nil, spamCheckers)
+		}, httputil.WithAllowGuests(), requireConsent, shadowBanned(shadowBannedEventResponse)),
 	).Methods(http.MethodPut, http.MethodOptions)
 
 	v3mux.Handle("/rooms/{roomID}/state/{eventType}/{stateKey}",
@@ -518,8 +607,8 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 			stateKey := vars["stateKey"]
-			return SendEvent(req, device, vars["roomID"], vars["eventType"], nil, &stateKey, cfg, rsAPI, nil)
-		}, httputil.WithAllowGuests()),
+			return SendEvent(req, device, vars["roomID"], vars["eventType"], nil, &stateKey, cfg, rsAPI, nil, spamCheckers)
+		}, httputil.WithAllowGuests(), requireConsent, shadowBanned(shadowBannedEventResponse)),
 	).Methods(http.MethodPut, http.MethodOptions)
 
 	// Defined outside of handler to persist between calls
@@ -566,7 +655,7 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 			return SetLocalAlias(req, device, vars["roomAlias"], cfg, rsAPI)
-		}),
+		}, requireConsent),
 	).Methods(http.MethodPut, http.MethodOptions)
 
 	v3mux.Handle("/directory/room/{roomAlias}",
@@ -576,7 +665,7 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 			return RemoveLocalAlias(req, device, vars["roomAlias"], rsAPI)
-		}),
+		}, requireConsent),
 	).Methods(http.MethodDelete, http.MethodOptions)
 	v3mux.Handle("/directory/list/room/{roomID}",
 		httputil.MakeExternalAPI("directory_list", func(req *http.Request) util.JSONResponse {
@@ -595,7 +684,7 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 			return SetVisibility(req, rsAPI, device, vars["roomID"])
-		}),
+		}, requireConsent),
 	).Methods(http.MethodPut, http.MethodOptions)
 	v3mux.Handle("/directory/list/appservice/{networkID}/{roomID}",
 		httputil.MakeAuthAPI("directory_list", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
@@ -646,7 +735,7 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 			return SendTyping(req, device, vars["roomID"], vars["userID"], rsAPI, syncProducer)
-		}),
+		}, requireConsent, shadowBanned(shadowBannedEmptyResponse)),
 	).Methods(http.MethodPut, http.MethodOptions)
 	v3mux.Handle("/rooms/{roomID}/redact/{eventID}",
 		httputil.MakeAuthAPI("rooms_redact", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
@@ -655,7 +744,7 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 			return SendRedaction(req, device, vars["roomID"], vars["eventID"], cfg, rsAPI, nil, nil)
-		}),
+		}, requireConsent, shadowBanned(shadowBannedEventResponse)),
 	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/rooms/{roomID}/redact/{eventID}/{txnId}",
 		httputil.MakeAuthAPI("rooms_redact", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
@@ -665,7 +754,7 @@ func Setup(
 			}
 			txnID := vars["txnId"]
 			return SendRedaction(req, device, vars["roomID"], vars["eventID"], cfg, rsAPI, &txnID, transactionsCache)
-		}),
+		}, requireConsent, shadowBanned(shadowBannedEventResponse)),
 	).Methods(http.MethodPut, http.MethodOptions)
 
 	v3mux.Handle("/sendToDevice/{eventType}/{txnID}",
@@ -905,8 +994,8 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return SetAvatarURL(req, userAPI, device, vars["userID"], cfg, rsAPI)
-		}),
+			return SetAvatarURL(req, userAPI, device, vars["userID"], cfg, rsAPI, avatars)
+		}, requireConsent, shadowBanned(shadowBannedEmptyResponse)),
 	).Methods(http.MethodPut, http.MethodOptions)
 	// Browsers use the OPTIONS HTTP method to check if the CORS policy allows
 	// PUT requests, so we need to allow this method
@@ -931,7 +1020,7 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 			return SetDisplayName(req, userAPI, device, vars["userID"], cfg, rsAPI)
-		}, httputil.WithAllowGuests()),
+		}, httputil.WithAllowGuests(), requireConsent, shadowBanned(shadowBannedEmptyResponse)),
 	).Methods(http.MethodPut, http.MethodOptions)
 	// Browsers use the OPTIONS HTTP method to check if the CORS policy allows
 	// PUT requests, so we need to allow this method
@@ -1114,6 +1203,7 @@ func Setup(
 				postContent.Limit,
 				federation,
 				cfg.Matrix.ServerName,
+				&cfg.ProfilePolicy,
 			)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
@@ -1128,7 +1218,7 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 			return SaveReadMarker(req, userAPI, rsAPI, syncProducer, device, vars["roomID"])
-		}),
+		}, requireConsent, shadowBanned(shadowBannedEmptyResponse)),
 	).Methods(http.MethodPost, http.MethodOptions)
 
 	v3mux.Handle("/rooms/{roomID}/forget",
@@ -1150,8 +1240,11 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
+			if resErr := awaitFullRoomState(req.Context(), federationSender, vars["roomID"]); resErr != nil {
+				return *resErr
+			}
 			return UpgradeRoom(req, device, cfg, vars["roomID"], userAPI, rsAPI, asAPI)
-		}),
+		}, requireConsent),
 	).Methods(http.MethodPost, http.MethodOptions)
 
 	v3mux.Handle("/devices",
@@ -1493,7 +1586,7 @@ func Setup(
 			}
 
 			return SetReceipt(req, userAPI, syncProducer, device, vars["roomId"], vars["receiptType"], vars["eventId"])
-		}),
+		}, requireConsent, shadowBanned(shadowBannedEmptyResponse)),
 	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/presence/{userId}/status",
 		httputil.MakeAuthAPI("set_presence", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
@@ -1502,7 +1595,7 @@ func Setup(
 				return util.ErrorResponse(err)
 			}
 			return SetPresence(req, cfg, device, syncProducer, vars["userId"])
-		}),
+		}, requireConsent),
 	).Methods(http.MethodPut, http.MethodOptions)
 	v3mux.Handle("/presence/{userId}/status",
 		httputil.MakeAuthAPI("get_presence", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
@@ -1520,7 +1613,11 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
+			if resErr := awaitFullRoomState(req.Context(), federationSender, vars["roomID"]); resErr != nil {
+				return *resErr
+			}
 			return GetJoinedMembers(req, device, vars["roomID"], rsAPI)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
+	return nil
 }
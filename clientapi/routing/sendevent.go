@@ -25,6 +25,7 @@ import (
 
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/internal/spamcheck"
 	"github.com/matrix-org/dendrite/internal/transactions"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/types"
@@ -77,6 +78,7 @@ func SendEvent(
 	cfg *config.ClientAPI,
 	rsAPI api.ClientRoomserverAPI,
 	txnCache *transactions.Cache,
+	spamCheckers *spamcheck.SpamCheckers,
 ) util.JSONResponse {
 	roomVersion, err := rsAPI.QueryRoomVersionForRoom(req.Context(), roomID)
 	if err != nil {
@@ -172,6 +174,17 @@ func SendEvent(
 	}
 	timeToGenerateEvent := time.Since(startedGeneratingEvent)
 
+	if err = spamCheckers.CheckEventForSpam(req.Context(), &spamcheck.Event{
+		EventID:  e.EventID(),
+		RoomID:   roomID,
+		Sender:   device.UserID,
+		Type:     eventType,
+		StateKey: stateKey,
+		Content:  e.Content(),
+	}); err != nil {
+		return spamcheck.ErrorResponse(req.Context(), err)
+	}
+
 	// validate that the aliases exists
 	if eventType == spec.MRoomCanonicalAlias && stateKey != nil && *stateKey == "" {
 		aliasReq := api.AliasEvent{}
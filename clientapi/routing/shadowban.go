@@ -0,0 +1,76 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+
+	"github.com/matrix-org/dendrite/internal/httputil"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+)
+
+// The responses given to shadow banned users instead of doing what they asked,
+// which look the same as if the request had succeeded.
+
+func shadowBannedEventResponse(*http.Request) util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: sendEventResponse{"$" + util.RandomString(43)},
+	}
+}
+
+func shadowBannedEmptyResponse(*http.Request) util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+func shadowBannedJoinResponse(rsAPI roomserverAPI.ClientRoomserverAPI) func(*http.Request) util.JSONResponse {
+	return func(req *http.Request) util.JSONResponse {
+		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		roomID := vars["roomID"]
+		if roomIDOrAlias, ok := vars["roomIDOrAlias"]; ok {
+			roomID = roomIDOrAlias
+		}
+		if strings.HasPrefix(roomID, "#") {
+			aliasRes := &roomserverAPI.GetRoomIDForAliasResponse{}
+			if err = rsAPI.GetRoomIDForAlias(req.Context(), &roomserverAPI.GetRoomIDForAliasRequest{
+				Alias:              roomID,
+				IncludeAppservices: true,
+			}, aliasRes); err != nil || aliasRes.RoomID == "" {
+				return util.JSONResponse{
+					Code: http.StatusNotFound,
+					JSON: spec.NotFound("Room alias not found"),
+				}
+			}
+			roomID = aliasRes.RoomID
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct {
+				RoomID string `json:"room_id"`
+			}{roomID},
+		}
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"net/http"
 
+	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/dendrite/syncapi/synctypes"
@@ -408,3 +409,20 @@ func OnIncomingStateTypeRequest(
 		JSON: res,
 	}
 }
+
+// awaitFullRoomState waits for the full state of the room to be resynced if we
+// joined it with partial state, since the endpoints calling this need to see
+// the complete membership. Returns nil once the full state is available.
+func awaitFullRoomState(ctx context.Context, fsAPI federationAPI.ClientFederationAPI, roomID string) *util.JSONResponse {
+	if fsAPI == nil {
+		return nil
+	}
+	if err := fsAPI.AwaitFullRoomState(ctx, roomID); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("fsAPI.AwaitFullRoomState failed")
+		return &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return nil
+}
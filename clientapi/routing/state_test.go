@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"net/http"
 	"testing"
+	"time"
 
+	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
 	rsapi "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -251,3 +253,57 @@ func mustCreateStatePDU(t *testing.T, roomVer gomatrixserverlib.RoomVersion, roo
 
 	return &types.HeaderedEvent{PDU: ev}
 }
+
+type partialStateFederationAPI struct {
+	federationAPI.ClientFederationAPI
+	resynced chan struct{}
+}
+
+func (f *partialStateFederationAPI) AwaitFullRoomState(ctx context.Context, roomID string) error {
+	select {
+	case <-f.resynced:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func Test_awaitFullRoomState(t *testing.T) {
+	roomIDStr := "!id:domain"
+
+	t.Run("no federation API", func(t *testing.T) {
+		assert.Assert(t, awaitFullRoomState(context.Background(), nil, roomIDStr) == nil)
+	})
+
+	t.Run("waits for the resync to finish", func(t *testing.T) {
+		fsAPI := &partialStateFederationAPI{resynced: make(chan struct{})}
+		done := make(chan *util.JSONResponse)
+		go func() {
+			done <- awaitFullRoomState(context.Background(), fsAPI, roomIDStr)
+		}()
+
+		select {
+		case <-done:
+			t.Fatal("returned while the room still had partial state")
+		case <-time.After(time.Millisecond * 100):
+		}
+
+		close(fsAPI.resynced)
+		select {
+		case resErr := <-done:
+			assert.Assert(t, resErr == nil)
+		case <-time.After(time.Second * 5):
+			t.Fatal("didn't return after the room was resynced")
+		}
+	})
+
+	t.Run("request cancelled while state is partial", func(t *testing.T) {
+		fsAPI := &partialStateFederationAPI{resynced: make(chan struct{})}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		resErr := awaitFullRoomState(ctx, fsAPI, roomIDStr)
+		assert.Assert(t, resErr != nil)
+		assert.Equal(t, resErr.Code, http.StatusInternalServerError)
+	})
+}
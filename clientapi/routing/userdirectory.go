@@ -22,7 +22,9 @@ import (
 	"strings"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrix"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -45,6 +47,7 @@ func SearchUserDirectory(
 	limit int,
 	federation fclient.FederationClient,
 	localServerName spec.ServerName,
+	profilePolicy *config.ProfilePolicy,
 ) util.JSONResponse {
 	if limit < 10 {
 		limit = 10
@@ -116,9 +119,10 @@ knownUsersLoop:
 					}
 				}
 			}
-			if strings.Contains(fedProfile.DisplayName, searchString) {
-				profile.DisplayName = fedProfile.DisplayName
-				profile.AvatarURL = fedProfile.AvatarURL
+			displayName, avatarURL := internal.ClampRemoteProfile(profilePolicy, fedProfile.DisplayName, fedProfile.AvatarURL)
+			if strings.Contains(displayName, searchString) {
+				profile.DisplayName = displayName
+				profile.AvatarURL = avatarURL
 				results[userID] = profile
 				if len(results) == limit {
 					response.Limited = true
@@ -182,7 +182,9 @@ func (p *P2PMonolith) SetupDendrite(
 		ExtUserDirectoryProvider: userProvider,
 	}
 	p.ProcessCtx = processCtx
-	p.dendrite.AddAllPublicRoutes(processCtx, cfg, routers, cm, &natsInstance, caches, enableMetrics)
+	if err := p.dendrite.AddAllPublicRoutes(processCtx, cfg, routers, cm, &natsInstance, caches, enableMetrics); err != nil {
+		logrus.WithError(err).Fatalf("Failed to add public routes")
+	}
 
 	p.setupHttpServers(userProvider, routers, enableWebsockets)
 }
@@ -139,6 +139,9 @@ func main() {
 		cfg.ClientAPI.RegistrationDisabled = false
 		cfg.ClientAPI.OpenRegistrationWithoutVerificationEnabled = true
 		cfg.MediaAPI.BasePath = config.Path(*instanceDir)
+		if absInstanceDir, err := filepath.Abs(*instanceDir); err == nil {
+			cfg.MediaAPI.AbsBasePath = config.Path(absInstanceDir)
+		}
 		cfg.SyncAPI.Fulltext.Enabled = true
 		cfg.SyncAPI.Fulltext.IndexPath = config.Path(*instanceDir)
 		if err := cfg.Derive(); err != nil {
@@ -238,7 +241,9 @@ func main() {
 			ygg, fsAPI, federation,
 		),
 	}
-	monolith.AddAllPublicRoutes(processCtx, cfg, routers, cm, &natsInstance, caches, caching.EnableMetrics)
+	if err := monolith.AddAllPublicRoutes(processCtx, cfg, routers, cm, &natsInstance, caches, caching.EnableMetrics); err != nil {
+		logrus.WithError(err).Fatalf("Failed to add public routes")
+	}
 	if err := mscs.Enable(cfg, cm, routers, &monolith, caches); err != nil {
 		logrus.WithError(err).Fatalf("Failed to enable MSCs")
 	}
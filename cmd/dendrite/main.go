@@ -21,22 +21,15 @@ import (
 	"github.com/getsentry/sentry-go"
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/caching"
-	"github.com/matrix-org/dendrite/internal/httputil"
-	"github.com/matrix-org/dendrite/internal/sqlutil"
-	"github.com/matrix-org/dendrite/setup/jetstream"
 	"github.com/matrix-org/dendrite/setup/process"
 	"github.com/matrix-org/gomatrixserverlib/fclient"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 
-	"github.com/matrix-org/dendrite/appservice"
-	"github.com/matrix-org/dendrite/federationapi"
-	"github.com/matrix-org/dendrite/roomserver"
 	"github.com/matrix-org/dendrite/setup"
 	basepkg "github.com/matrix-org/dendrite/setup/base"
 	"github.com/matrix-org/dendrite/setup/config"
-	"github.com/matrix-org/dendrite/setup/mscs"
-	"github.com/matrix-org/dendrite/userapi"
+	"github.com/matrix-org/dendrite/setup/homeserver"
 )
 
 var (
@@ -141,53 +134,15 @@ func main() {
 		}()
 	}
 
-	federationClient := basepkg.CreateFederationClient(cfg, dnsCache)
-	httpClient := basepkg.CreateClient(cfg, dnsCache)
-
-	// prepare required dependencies
-	cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
-	routers := httputil.NewRouters()
-
-	caches := caching.NewRistrettoCache(cfg.Global.Cache.EstimatedMaxSize, cfg.Global.Cache.MaxAge, caching.EnableMetrics)
-	natsInstance := jetstream.NATSInstance{}
-	rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.EnableMetrics)
-	fsAPI := federationapi.NewInternalAPI(
-		processCtx, cfg, cm, &natsInstance, federationClient, rsAPI, caches, nil, false,
-	)
-
-	keyRing := fsAPI.KeyRing()
-
-	// The underlying roomserver implementation needs to be able to call the fedsender.
-	// This is different to rsAPI which can be the http client which doesn't need this
-	// dependency. Other components also need updating after their dependencies are up.
-	rsAPI.SetFederationAPI(fsAPI, keyRing)
-
-	userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, federationClient, caching.EnableMetrics, fsAPI.IsBlacklistedOrBackingOff)
-	asAPI := appservice.NewInternalAPI(processCtx, cfg, &natsInstance, userAPI, rsAPI)
-
-	rsAPI.SetAppserviceAPI(asAPI)
-	rsAPI.SetUserAPI(userAPI)
-
-	monolith := setup.Monolith{
-		Config:    cfg,
-		Client:    httpClient,
-		FedClient: federationClient,
-		KeyRing:   keyRing,
-
-		AppserviceAPI: asAPI,
-		// always use the concrete impl here even in -http mode because adding public routes
-		// must be done on the concrete impl not an HTTP client else fedapi will call itself
-		FederationAPI: fsAPI,
-		RoomserverAPI: rsAPI,
-		UserAPI:       userAPI,
-	}
-	monolith.AddAllPublicRoutes(processCtx, cfg, routers, cm, &natsInstance, caches, caching.EnableMetrics)
-
-	if len(cfg.MSCs.MSCs) > 0 {
-		if err := mscs.Enable(cfg, cm, routers, &monolith, caches); err != nil {
-			logrus.WithError(err).Fatalf("Failed to enable MSCs")
-		}
+	hs, err := homeserver.New(cfg, homeserver.Options{
+		ProcessContext: processCtx,
+		DNSCache:       dnsCache,
+		EnableMetrics:  caching.EnableMetrics,
+	})
+	if err != nil {
+		logrus.WithError(err).Fatalf("Failed to start Dendrite")
 	}
+	routers := hs.Routers
 
 	upCounter := prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "dendrite",
@@ -200,16 +155,53 @@ func main() {
 	prometheus.MustRegister(upCounter)
 
 	// Expose the matrix APIs directly rather than putting them under a /api path.
-	go func() {
-		basepkg.SetupAndServeHTTP(processCtx, cfg, routers, httpAddr, nil, nil)
-	}()
-	// Handle HTTPS if certificate and key are provided
-	if *unixSocket == "" && *certFile != "" && *keyFile != "" {
+	if externalListeners := cfg.Global.Listeners.External; len(externalListeners) > 0 && !bindFlagsSet() {
+		for _, listener := range externalListeners {
+			addr, err := listener.ServerAddress()
+			if err != nil {
+				logrus.WithError(err).Fatalf("Failed to parse listener address")
+			}
+			var cert, key *string
+			if listener.TLS() {
+				certPath, keyPath := string(listener.TLSCert), string(listener.TLSKey)
+				cert, key = &certPath, &keyPath
+			}
+			go basepkg.SetupAndServeHTTP(processCtx, cfg, routers, addr, cert, key)
+		}
+	} else {
 		go func() {
-			basepkg.SetupAndServeHTTP(processCtx, cfg, routers, httpsAddr, certFile, keyFile)
+			basepkg.SetupAndServeHTTP(processCtx, cfg, routers, httpAddr, nil, nil)
 		}()
+		// Handle HTTPS if certificate and key are provided
+		if *unixSocket == "" && *certFile != "" && *keyFile != "" {
+			go func() {
+				basepkg.SetupAndServeHTTP(processCtx, cfg, routers, httpsAddr, certFile, keyFile)
+			}()
+		}
+	}
+	// Serve the admin APIs and metrics separately if an internal listener is configured
+	if cfg.Global.Listeners.Internal.Enabled() {
+		go basepkg.SetupAndServeInternalHTTP(processCtx, cfg, routers)
+	}
+	// Serve the media APIs separately if a media listener is configured
+	if cfg.Global.Listeners.Media.Enabled() {
+		go basepkg.SetupAndServeMediaHTTP(processCtx, cfg, routers)
 	}
 
 	// We want to block forever to let the HTTP and HTTPS handler serve the APIs
 	basepkg.WaitForShutdown(processCtx)
 }
+
+// bindFlagsSet returns whether any of the listening addresses were given on
+// the command line, in which case they take precedence over the listeners in
+// the config.
+func bindFlagsSet() bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "unix-socket", "http-bind-address", "https-bind-address", "tls-cert", "tls-key":
+			set = true
+		}
+	})
+	return set
+}
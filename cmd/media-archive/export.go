@@ -0,0 +1,208 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
+)
+
+const exportBatchSize = 1000
+
+func exportMedia(ctx context.Context, cfg *config.MediaAPI, db storage.Database, w io.Writer) error {
+	media, err := allMedia(ctx, cfg, db)
+	if err != nil {
+		return err
+	}
+	encryption, err := fileutils.NewEncryption(&cfg.Encryption)
+	if err != nil {
+		return err
+	}
+
+	// Only export each file once, however many media refer to it.
+	hashes := make([]types.Base64Hash, 0, len(media))
+	seen := make(map[types.Base64Hash]struct{}, len(media))
+	for _, m := range media {
+		if _, ok := seen[m.Base64Hash]; !ok {
+			seen[m.Base64Hash] = struct{}{}
+			hashes = append(hashes, m.Base64Hash)
+		}
+	}
+
+	tw := tar.NewWriter(w)
+	header, err := json.Marshal(archiveHeader{
+		Format:        archiveFormat,
+		FormatVersion: archiveFormatVersion,
+		ExportedBy:    cfg.Matrix.ServerName,
+		ExportedAt:    spec.AsTimestamp(time.Now()),
+		MediaCount:    len(media),
+		FileCount:     len(hashes),
+	})
+	if err != nil {
+		return err
+	}
+	if err = writeTarFile(tw, archiveHeaderName, header); err != nil {
+		return err
+	}
+
+	for _, hash := range hashes {
+		if err = exportFile(tw, cfg, encryption, hash); err != nil {
+			return fmt.Errorf("failed to export file %s: %w", hash, err)
+		}
+	}
+
+	var lines bytes.Buffer
+	enc := json.NewEncoder(&lines)
+	for _, m := range media {
+		if err = enc.Encode(m); err != nil {
+			return err
+		}
+	}
+	if err = writeTarFile(tw, archiveMediaName, lines.Bytes()); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// allMedia returns the metadata of all local and remote media, along with the
+// metadata of their thumbnails.
+func allMedia(ctx context.Context, cfg *config.MediaAPI, db storage.Database) ([]*archiveMedia, error) {
+	var media []*archiveMedia
+	before := spec.Timestamp(math.MaxInt64)
+	for _, remote := range []bool{false, true} {
+		for offset := 0; ; offset += exportBatchSize {
+			batch, err := db.GetMediaCreatedBefore(ctx, cfg.Matrix.ServerName, remote, before, exportBatchSize, offset)
+			if err != nil {
+				return nil, fmt.Errorf("db.GetMediaCreatedBefore: %w", err)
+			}
+			for _, m := range batch {
+				thumbnails, err := db.GetThumbnails(ctx, m.MediaID, m.Origin)
+				if err != nil {
+					return nil, fmt.Errorf("db.GetThumbnails: %w", err)
+				}
+				exported := &archiveMedia{
+					MediaID:       m.MediaID,
+					Origin:        m.Origin,
+					ContentType:   m.ContentType,
+					FileSizeBytes: m.FileSizeBytes,
+					CreatedTS:     m.CreationTimestamp,
+					UploadName:    m.UploadName,
+					Base64Hash:    m.Base64Hash,
+					UserID:        m.UserID,
+				}
+				for _, t := range thumbnails {
+					exported.Thumbnails = append(exported.Thumbnails, archiveThumbnail{
+						Width:         t.ThumbnailSize.Width,
+						Height:        t.ThumbnailSize.Height,
+						ResizeMethod:  t.ThumbnailSize.ResizeMethod,
+						ContentType:   t.MediaMetadata.ContentType,
+						FileSizeBytes: t.MediaMetadata.FileSizeBytes,
+					})
+				}
+				media = append(media, exported)
+			}
+			if len(batch) < exportBatchSize {
+				break
+			}
+		}
+	}
+	return media, nil
+}
+
+// exportFile writes the file with the given hash and its thumbnails to the
+// archive. Files missing from the media store are skipped. Files are exported
+// decrypted and decompressed, so the archive doesn't depend on how the media
+// store was configured.
+func exportFile(tw *tar.Writer, cfg *config.MediaAPI, encryption *fileutils.Encryption, hash types.Base64Hash) error {
+	filePath, err := fileutils.GetPathFromBase64Hash(hash, cfg.AbsBasePath, cfg.StoreLayout)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(filePath)
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		logrus.WithField("Base64Hash", hash).Warn("Skipping missing file")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		if fileutils.StoredEncoding(name) != "" {
+			name = "file"
+		}
+		if err = exportEntry(tw, filepath.Join(dir, entry.Name()), archiveFilesDir+string(hash)+"/"+name, encryption); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func exportEntry(tw *tar.Writer, path, name string, encryption *fileutils.Encryption) error {
+	f, err := fileutils.OpenStoredFile(path, encryption)
+	if err != nil {
+		return err
+	}
+	defer f.Close() // nolint: errcheck
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     f.Size(),
+		Mode:     0640,
+		ModTime:  info.ModTime(),
+	}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+func writeTarFile(tw *tar.Writer, name string, content []byte) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     int64(len(content)),
+		Mode:     0640,
+		ModTime:  time.Now(),
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(content)
+	return err
+}
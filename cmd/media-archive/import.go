@@ -0,0 +1,209 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	archiveHashRegex     = regexp.MustCompile(`^[A-Za-z0-9_-]{3,255}$`)
+	archiveFileNameRegex = regexp.MustCompile(`^(file|thumbnail-[0-9]+x[0-9]+-(crop|scale))$`)
+)
+
+// importResult counts what was imported. Thumbnails aren't counted as files.
+type importResult struct {
+	Files        int
+	Media        int
+	SkippedFiles int
+	SkippedMedia int
+}
+
+func importMedia(ctx context.Context, cfg *config.MediaAPI, db storage.Database, r io.Reader) (*importResult, error) {
+	tr := tar.NewReader(r)
+	result := &importResult{}
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+	var header archiveHeader
+	if hdr.Name != archiveHeaderName {
+		return nil, fmt.Errorf("archive doesn't start with %s", archiveHeaderName)
+	}
+	if err = json.NewDecoder(tr).Decode(&header); err != nil {
+		return nil, fmt.Errorf("failed to decode archive header: %w", err)
+	}
+	if header.Format != archiveFormat || header.FormatVersion != archiveFormatVersion {
+		return nil, fmt.Errorf("unsupported archive format %q version %d", header.Format, header.FormatVersion)
+	}
+
+	for {
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			return result, fmt.Errorf("archive is missing %s", archiveMediaName)
+		}
+		if err != nil {
+			return result, fmt.Errorf("failed to read archive: %w", err)
+		}
+		switch {
+		case hdr.Name == archiveMediaName:
+			return result, importMetadata(ctx, cfg, db, tr, result)
+		case strings.HasPrefix(hdr.Name, archiveFilesDir):
+			if err = importFile(cfg, hdr.Name, tr, result); err != nil {
+				return result, err
+			}
+		default:
+			logrus.WithField("name", hdr.Name).Warn("Skipping unknown archive entry")
+		}
+	}
+}
+
+// importFile stores a file or thumbnail from the archive where the media store
+// expects it, unless it is already there.
+func importFile(cfg *config.MediaAPI, name string, r io.Reader, result *importResult) error {
+	hash, fileName, ok := strings.Cut(strings.TrimPrefix(name, archiveFilesDir), "/")
+	if !ok || !archiveHashRegex.MatchString(hash) || !archiveFileNameRegex.MatchString(fileName) {
+		return fmt.Errorf("invalid archive entry %q", name)
+	}
+	filePath, err := fileutils.GetPathFromBase64Hash(types.Base64Hash(hash), cfg.AbsBasePath, cfg.StoreLayout)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(filePath)
+	dst := filepath.Join(dir, fileName)
+	existing := dst
+	if fileName == "file" {
+		// The file may already be stored compressed.
+		existing = fileutils.StoredFilePath(dir)
+	}
+	if _, err = os.Stat(existing); err == nil {
+		if fileName == "file" {
+			result.SkippedFiles++
+		}
+		return nil
+	}
+	if err = os.MkdirAll(dir, 0770); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so that an interrupted import never
+	// leaves a partial file in place.
+	tmp, err := os.CreateTemp(dir, ".import-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // nolint: errcheck
+	hasher := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(tmp, hasher), r); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", dst, err)
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if fileName == "file" {
+		if actual := base64.RawURLEncoding.EncodeToString(hasher.Sum(nil)); actual != hash {
+			return fmt.Errorf("file %s in archive has hash %s, archive is corrupted", hash, actual)
+		}
+		result.Files++
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// importMetadata stores the metadata of the media whose file is in the media
+// store, unless the media is already known.
+func importMetadata(ctx context.Context, cfg *config.MediaAPI, db storage.Database, r io.Reader, result *importResult) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var m archiveMedia
+		if err := dec.Decode(&m); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to decode media: %w", err)
+		}
+		logger := logrus.WithFields(logrus.Fields{
+			"MediaID": m.MediaID,
+			"Origin":  m.Origin,
+		})
+
+		existing, err := db.GetMediaMetadata(ctx, m.MediaID, m.Origin)
+		if err != nil {
+			return fmt.Errorf("db.GetMediaMetadata: %w", err)
+		}
+		if existing != nil {
+			result.SkippedMedia++
+			continue
+		}
+		filePath, err := fileutils.GetPathFromBase64Hash(m.Base64Hash, cfg.AbsBasePath, cfg.StoreLayout)
+		if err != nil {
+			return err
+		}
+		if _, err = os.Stat(filePath); errors.Is(err, os.ErrNotExist) {
+			logger.Warn("Skipping media whose file isn't in the archive")
+			result.SkippedMedia++
+			continue
+		}
+
+		if err = db.StoreMediaMetadata(ctx, &types.MediaMetadata{
+			MediaID:           m.MediaID,
+			Origin:            m.Origin,
+			ContentType:       m.ContentType,
+			FileSizeBytes:     m.FileSizeBytes,
+			CreationTimestamp: m.CreatedTS,
+			UploadName:        m.UploadName,
+			Base64Hash:        m.Base64Hash,
+			UserID:            m.UserID,
+		}); err != nil {
+			return fmt.Errorf("db.StoreMediaMetadata: %w", err)
+		}
+		for _, t := range m.Thumbnails {
+			if err = db.StoreThumbnail(ctx, &types.ThumbnailMetadata{
+				MediaMetadata: &types.MediaMetadata{
+					MediaID:       m.MediaID,
+					Origin:        m.Origin,
+					ContentType:   t.ContentType,
+					FileSizeBytes: t.FileSizeBytes,
+				},
+				ThumbnailSize: types.ThumbnailSize{
+					Width:        t.Width,
+					Height:       t.Height,
+					ResizeMethod: t.ResizeMethod,
+				},
+			}); err != nil {
+				return fmt.Errorf("db.StoreThumbnail: %w", err)
+			}
+		}
+		result.Media++
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
+)
+
+// This is a utility for exporting the whole media store, files and metadata,
+// to a portable archive, and for importing such an archive into another
+// Dendrite instance, e.g. when migrating servers.
+//
+// The archive is a tar file. It starts with archive.json describing the
+// archive, followed by the files and their thumbnails as files/<hash>/file and
+// files/<hash>/thumbnail-<width>x<height>-<method>, and ends with media.jsonl
+// which holds the metadata of one media per line. Files are stored by their
+// hash rather than their path, so importing places them wherever the media
+// store layout of the importing server expects them.
+//
+// Importing skips files and media that already exist, so an interrupted import
+// can be run again.
+//
+// Usage: ./media-archive --config dendrite.yaml [--archive file] export
+//        ./media-archive --config dendrite.yaml [--archive file] import
+
+const (
+	archiveFormat        = "dendrite.media_archive"
+	archiveFormatVersion = 1
+
+	archiveHeaderName = "archive.json"
+	archiveMediaName  = "media.jsonl"
+	archiveFilesDir   = "files/"
+)
+
+var archivePath = flag.String("archive", "-", "the archive file to write to or read from, - for stdout/stdin")
+
+// archiveHeader is the content of archive.json.
+type archiveHeader struct {
+	Format        string          `json:"format"`
+	FormatVersion int             `json:"format_version"`
+	ExportedBy    spec.ServerName `json:"exported_by"`
+	ExportedAt    spec.Timestamp  `json:"exported_at"`
+	MediaCount    int             `json:"media_count"`
+	FileCount     int             `json:"file_count"`
+}
+
+// archiveMedia is one line of media.jsonl.
+type archiveMedia struct {
+	MediaID       types.MediaID       `json:"media_id"`
+	Origin        spec.ServerName     `json:"origin"`
+	ContentType   types.ContentType   `json:"content_type"`
+	FileSizeBytes types.FileSizeBytes `json:"file_size_bytes"`
+	CreatedTS     spec.Timestamp      `json:"created_ts"`
+	UploadName    types.Filename      `json:"upload_name,omitempty"`
+	Base64Hash    types.Base64Hash    `json:"base64hash"`
+	UserID        types.MatrixUserID  `json:"user_id,omitempty"`
+	Thumbnails    []archiveThumbnail  `json:"thumbnails,omitempty"`
+}
+
+// archiveThumbnail is the metadata of a thumbnail of a media.
+type archiveThumbnail struct {
+	Width         int                 `json:"width"`
+	Height        int                 `json:"height"`
+	ResizeMethod  string              `json:"method"`
+	ContentType   types.ContentType   `json:"content_type"`
+	FileSizeBytes types.FileSizeBytes `json:"file_size_bytes"`
+}
+
+func main() {
+	cfg := setup.ParseFlags(true)
+	cfg.Logging = append(cfg.Logging[:0], config.LogrusHook{
+		Type:  "std",
+		Level: "error",
+	})
+	ctx := context.Background()
+
+	processCtx := process.NewProcessContext()
+	cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+	db, err := storage.NewMediaAPIDatasource(cm, &cfg.MediaAPI.Database)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to connect to the media database")
+	}
+
+	switch flag.Arg(0) {
+	case "export":
+		var w io.WriteCloser = os.Stdout
+		if *archivePath != "-" {
+			if w, err = os.Create(*archivePath); err != nil {
+				logrus.WithError(err).Fatal("Failed to create archive")
+			}
+		}
+		err = exportMedia(ctx, &cfg.MediaAPI, db, w)
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+	case "import":
+		var r io.ReadCloser = os.Stdin
+		if *archivePath != "-" {
+			if r, err = os.Open(*archivePath); err != nil {
+				logrus.WithError(err).Fatal("Failed to open archive")
+			}
+		}
+		var imported *importResult
+		imported, err = importMedia(ctx, &cfg.MediaAPI, db, r)
+		_ = r.Close()
+		if imported != nil {
+			fmt.Fprintf(os.Stderr, "Imported %d files and %d media, skipped %d existing files and %d existing media\n",
+				imported.Files, imported.Media, imported.SkippedFiles, imported.SkippedMedia)
+		}
+	default:
+		err = fmt.Errorf("unknown command %q, expected export or import", flag.Arg(0))
+	}
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed")
+	}
+}
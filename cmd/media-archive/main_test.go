@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func newMediaStore(t *testing.T) (*config.MediaAPI, storage.Database) {
+	cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
+	db, err := storage.NewMediaAPIDatasource(cm, &config.DatabaseOptions{
+		ConnectionString:       config.DataSource("file:" + filepath.Join(t.TempDir(), "media.db")),
+		MaxOpenConnections:     1,
+		MaxIdleConnections:     1,
+		ConnMaxLifetimeSeconds: -1,
+	})
+	assert.NoError(t, err)
+	cfg := &config.MediaAPI{
+		Matrix:      &config.Global{},
+		AbsBasePath: config.Path(t.TempDir()),
+	}
+	cfg.Matrix.ServerName = "localhost"
+	return cfg, db
+}
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	srcCfg, srcDB := newMediaStore(t)
+
+	content := []byte("hello world")
+	sum := sha256.Sum256(content)
+	hash := types.Base64Hash(base64.RawURLEncoding.EncodeToString(sum[:]))
+	filePath, err := fileutils.GetPathFromBase64Hash(hash, srcCfg.AbsBasePath, srcCfg.StoreLayout)
+	assert.NoError(t, err)
+	assert.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0770))
+	assert.NoError(t, os.WriteFile(filePath, content, 0660))
+	assert.NoError(t, os.WriteFile(filepath.Join(filepath.Dir(filePath), "thumbnail-32x32-crop"), []byte("thumb"), 0660))
+
+	// two media referring to the same file
+	for _, m := range []*types.MediaMetadata{
+		{MediaID: "local", Origin: "localhost", Base64Hash: hash, FileSizeBytes: 11, UserID: "@alice:localhost", CreationTimestamp: 1000},
+		{MediaID: "remote", Origin: "remote", Base64Hash: hash, FileSizeBytes: 11, CreationTimestamp: 2000},
+	} {
+		assert.NoError(t, srcDB.StoreMediaMetadata(ctx, m))
+	}
+	assert.NoError(t, srcDB.StoreThumbnail(ctx, &types.ThumbnailMetadata{
+		MediaMetadata: &types.MediaMetadata{MediaID: "local", Origin: "localhost", ContentType: "image/png", FileSizeBytes: 5},
+		ThumbnailSize: types.ThumbnailSize{Width: 32, Height: 32, ResizeMethod: "crop"},
+	}))
+
+	var archive bytes.Buffer
+	assert.NoError(t, exportMedia(ctx, srcCfg, srcDB, &archive))
+
+	dstCfg, dstDB := newMediaStore(t)
+	result, err := importMedia(ctx, dstCfg, dstDB, bytes.NewReader(archive.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, &importResult{Files: 1, Media: 2}, result)
+
+	dstPath, err := fileutils.GetPathFromBase64Hash(hash, dstCfg.AbsBasePath, dstCfg.StoreLayout)
+	assert.NoError(t, err)
+	got, err := os.ReadFile(dstPath)
+	assert.NoError(t, err)
+	assert.Equal(t, content, got)
+	_, err = os.Stat(filepath.Join(filepath.Dir(dstPath), "thumbnail-32x32-crop"))
+	assert.NoError(t, err)
+
+	metadata, err := dstDB.GetMediaMetadata(ctx, "local", "localhost")
+	assert.NoError(t, err)
+	assert.NotNil(t, metadata)
+	assert.Equal(t, types.MatrixUserID("@alice:localhost"), metadata.UserID)
+	assert.Equal(t, hash, metadata.Base64Hash)
+	assert.EqualValues(t, 1000, metadata.CreationTimestamp)
+	thumbnail, err := dstDB.GetThumbnail(ctx, "local", "localhost", 32, 32, "crop")
+	assert.NoError(t, err)
+	assert.NotNil(t, thumbnail)
+
+	// importing again skips everything
+	result, err = importMedia(ctx, dstCfg, dstDB, bytes.NewReader(archive.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, &importResult{SkippedFiles: 1, SkippedMedia: 2}, result)
+}
@@ -0,0 +1,212 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/state"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+// How many events to load from the database at once.
+const exportBatchSize = 100
+
+func exportRoom(ctx context.Context, cfg *config.Dendrite, roomID string, w io.Writer) error {
+	processCtx := process.NewProcessContext()
+	cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+
+	dbOpts := cfg.RoomServer.Database
+	if dbOpts.ConnectionString == "" {
+		dbOpts = cfg.Global.DatabaseOptions
+	}
+	db, err := storage.Open(
+		processCtx.Context(), cm, &dbOpts,
+		caching.NewRistrettoCache(8*1024*1024, time.Minute*5, caching.DisableMetrics),
+	)
+	if err != nil {
+		return fmt.Errorf("storage.Open: %w", err)
+	}
+
+	roomInfo, err := db.RoomInfo(ctx, roomID)
+	if err != nil {
+		return fmt.Errorf("db.RoomInfo: %w", err)
+	}
+	if roomInfo == nil || roomInfo.IsStub() {
+		return fmt.Errorf("room %s is not known to this server", roomID)
+	}
+	stateRes := state.NewStateResolution(db, roomInfo, nil)
+
+	latestEventIDs, currentStateNID, _, err := db.LatestEventIDs(ctx, roomInfo.RoomNID)
+	if err != nil {
+		return fmt.Errorf("db.LatestEventIDs: %w", err)
+	}
+	currentState, err := stateEventIDs(ctx, db, &stateRes, currentStateNID)
+	if err != nil {
+		return err
+	}
+
+	// Find all of the events in the room.
+	rejected := map[types.EventNID]bool{}
+	var afterNID types.EventNID
+	for {
+		var page map[types.EventNID]bool
+		page, err = db.RoomEventNIDs(ctx, roomInfo.RoomNID, afterNID, 1000)
+		if err != nil {
+			return fmt.Errorf("db.RoomEventNIDs: %w", err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		for eventNID, isRejected := range page {
+			rejected[eventNID] = isRejected
+			if eventNID > afterNID {
+				afterNID = eventNID
+			}
+		}
+	}
+	eventNIDs := make([]types.EventNID, 0, len(rejected))
+	for eventNID := range rejected {
+		eventNIDs = append(eventNIDs, eventNID)
+	}
+	sort.Slice(eventNIDs, func(i, j int) bool { return eventNIDs[i] < eventNIDs[j] })
+	fmt.Fprintln(os.Stderr, "Exporting", len(eventNIDs), "events from", roomID)
+
+	// The event IDs are needed up front to know which prev events are in the archive.
+	eventIDs, err := db.EventIDs(ctx, eventNIDs)
+	if err != nil {
+		return fmt.Errorf("db.EventIDs: %w", err)
+	}
+	inArchive := make(map[string]bool, len(eventIDs))
+	for _, eventID := range eventIDs {
+		inArchive[eventID] = true
+	}
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	if err = enc.Encode(archiveHeader{
+		Format:             archiveFormat,
+		FormatVersion:      archiveFormatVersion,
+		RoomID:             roomID,
+		RoomVersion:        roomInfo.RoomVersion,
+		ExportedBy:         cfg.Global.ServerName,
+		ExportedAt:         spec.AsTimestamp(time.Now()),
+		EventCount:         len(eventNIDs),
+		ForwardExtremities: latestEventIDs,
+		StateEventIDs:      currentState,
+	}); err != nil {
+		return err
+	}
+
+	for start := 0; start < len(eventNIDs); start += exportBatchSize {
+		end := start + exportBatchSize
+		if end > len(eventNIDs) {
+			end = len(eventNIDs)
+		}
+		batch := eventNIDs[start:end]
+		events, err := db.Events(ctx, roomInfo.RoomVersion, batch)
+		if err != nil {
+			return fmt.Errorf("db.Events: %w", err)
+		}
+		byNID := make(map[types.EventNID]types.Event, len(events))
+		batchIDs := make([]string, 0, len(events))
+		for _, event := range events {
+			byNID[event.EventNID] = event
+			batchIDs = append(batchIDs, event.EventID())
+		}
+		snapshots, err := db.BulkSelectSnapshotsFromEventIDs(ctx, batchIDs)
+		if err != nil {
+			return fmt.Errorf("db.BulkSelectSnapshotsFromEventIDs: %w", err)
+		}
+		snapshotFor := make(map[string]types.StateSnapshotNID, len(batchIDs))
+		for snapshotNID, ids := range snapshots {
+			for _, eventID := range ids {
+				snapshotFor[eventID] = snapshotNID
+			}
+		}
+
+		for _, eventNID := range batch {
+			event, ok := byNID[eventNID]
+			if !ok {
+				fmt.Fprintln(os.Stderr, "Skipping event", eventIDs[eventNID], "which has no event JSON")
+				continue
+			}
+			line := archiveEvent{
+				EventID:  event.EventID(),
+				Rejected: rejected[eventNID],
+				Redacted: event.Redacted(),
+				Event:    event.JSON(),
+			}
+			switch snapshotNID := snapshotFor[event.EventID()]; {
+			case snapshotNID == 0 && event.Type() != spec.MRoomCreate:
+				line.Outlier = true
+			case !allIn(event.PrevEventIDs(), inArchive):
+				if line.StateBefore, err = stateEventIDs(ctx, db, &stateRes, snapshotNID); err != nil {
+					return err
+				}
+			}
+			if err = enc.Encode(line); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// stateEventIDs returns the IDs of the state events in the state snapshot.
+func stateEventIDs(
+	ctx context.Context, db storage.Database, stateRes *state.StateResolution, snapshotNID types.StateSnapshotNID,
+) ([]string, error) {
+	entries, err := stateRes.LoadStateAtSnapshot(ctx, snapshotNID)
+	if err != nil {
+		return nil, fmt.Errorf("stateRes.LoadStateAtSnapshot: %w", err)
+	}
+	eventNIDs := make([]types.EventNID, len(entries))
+	for i := range entries {
+		eventNIDs[i] = entries[i].EventNID
+	}
+	eventIDs, err := db.EventIDs(ctx, eventNIDs)
+	if err != nil {
+		return nil, fmt.Errorf("db.EventIDs: %w", err)
+	}
+	result := make([]string, 0, len(eventIDs))
+	for _, eventID := range eventIDs {
+		result = append(result, eventID)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func allIn(eventIDs []string, set map[string]bool) bool {
+	for _, eventID := range eventIDs {
+		if !set[eventID] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,247 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+// importEvent is an event read from an archive.
+type importEvent struct {
+	archiveEvent
+	pdu gomatrixserverlib.PDU
+	// The position of the event in the archive, to keep the import stable.
+	index int
+}
+
+// dependencies returns the IDs of the events that must be imported before this one.
+func (e *importEvent) dependencies() []string {
+	deps := e.pdu.AuthEventIDs()
+	if e.Outlier {
+		return deps
+	}
+	if e.StateBefore != nil {
+		return append(deps, e.StateBefore...)
+	}
+	return append(deps, e.pdu.PrevEventIDs()...)
+}
+
+func importRoom(ctx context.Context, cfg *config.Dendrite, r io.Reader, resign bool) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	var header archiveHeader
+	if err := dec.Decode(&header); err != nil {
+		return fmt.Errorf("failed to read archive header: %w", err)
+	}
+	if header.Format != archiveFormat || header.FormatVersion != archiveFormatVersion {
+		return fmt.Errorf("unsupported archive format %q version %d", header.Format, header.FormatVersion)
+	}
+	verImpl, err := gomatrixserverlib.GetRoomVersion(header.RoomVersion)
+	if err != nil {
+		return err
+	}
+
+	var events []*importEvent
+	var resigned int
+	for dec.More() {
+		ev := &importEvent{index: len(events)}
+		if err = dec.Decode(&ev.archiveEvent); err != nil {
+			return fmt.Errorf("failed to read event %d: %w", ev.index, err)
+		}
+		ev.pdu, err = verImpl.NewEventFromTrustedJSONWithEventID(ev.EventID, ev.Event, ev.Redacted)
+		if err != nil {
+			return fmt.Errorf("failed to parse event %s: %w", ev.EventID, err)
+		}
+		if ev.pdu.RoomID().String() != header.RoomID {
+			return fmt.Errorf("event %s belongs to room %s, not %s", ev.EventID, ev.pdu.RoomID().String(), header.RoomID)
+		}
+		if resign {
+			var signed bool
+			if ev.pdu, signed, err = resignEvent(cfg, ev.pdu); err != nil {
+				return fmt.Errorf("failed to re-sign event %s: %w", ev.EventID, err)
+			}
+			if signed {
+				resigned++
+			}
+		}
+		events = append(events, ev)
+	}
+
+	ordered, err := sortForImport(events)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "Importing", len(ordered), "events into", header.RoomID, "- re-signed", resigned, "events")
+
+	processCtx := process.NewProcessContext()
+	cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+	caches := caching.NewRistrettoCache(cfg.Global.Cache.EstimatedMaxSize, cfg.Global.Cache.MaxAge, caching.DisableMetrics)
+	natsInstance := jetstream.NATSInstance{}
+	rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+	// All of the events needed are in the archive, so the roomserver never has
+	// to ask other servers for missing events.
+	rsAPI.SetFederationAPI(nil, nil)
+	defer func() {
+		processCtx.ShutdownDendrite()
+		processCtx.WaitForComponentsToFinish()
+	}()
+
+	var failed int
+	for i, ev := range ordered {
+		input := api.InputRoomEvent{
+			Kind:   api.KindNew,
+			Event:  &types.HeaderedEvent{PDU: ev.pdu},
+			Origin: eventOrigin(ev.pdu, header.ExportedBy),
+		}
+		switch {
+		case ev.Outlier:
+			input.Kind = api.KindOutlier
+		case ev.StateBefore != nil:
+			input.HasState = true
+			input.StateEventIDs = ev.StateBefore
+		}
+		if err = api.SendInputRoomEvents(ctx, rsAPI, cfg.Global.ServerName, []api.InputRoomEvent{input}, false); err != nil {
+			// Events that were rejected when exported will most likely be rejected again.
+			if !ev.Rejected {
+				failed++
+				fmt.Fprintln(os.Stderr, "Failed to import event", ev.EventID, ":", err)
+			}
+		}
+		if (i+1)%1000 == 0 {
+			fmt.Fprintln(os.Stderr, "Imported", i+1, "of", len(ordered), "events")
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to import %d events", failed)
+	}
+	fmt.Fprintln(os.Stderr, "Import finished")
+	return nil
+}
+
+// eventOrigin returns the server that sent the event, falling back to the
+// exporting server for rooms with pseudo IDs.
+func eventOrigin(pdu gomatrixserverlib.PDU, fallback spec.ServerName) spec.ServerName {
+	if userID := pdu.SenderID().ToUserID(); userID != nil {
+		return userID.Domain()
+	}
+	return fallback
+}
+
+// resignEvent signs events sent by local users with the current signing key
+// of the server, if it hasn't signed them already. This is needed when the
+// server was moved to a new signing key, as other servers will otherwise be
+// unable to verify events sent by local users.
+func resignEvent(cfg *config.Dendrite, pdu gomatrixserverlib.PDU) (gomatrixserverlib.PDU, bool, error) {
+	userID := pdu.SenderID().ToUserID()
+	if userID == nil || !cfg.Global.IsLocalServerName(userID.Domain()) {
+		return pdu, false, nil
+	}
+	identity, err := cfg.Global.SigningIdentityFor(userID.Domain())
+	if err != nil {
+		return nil, false, err
+	}
+	var signed struct {
+		Signatures map[spec.ServerName]map[gomatrixserverlib.KeyID]json.RawMessage `json:"signatures"`
+	}
+	if err = json.Unmarshal(pdu.JSON(), &signed); err != nil {
+		return nil, false, err
+	}
+	if _, ok := signed.Signatures[identity.ServerName][identity.KeyID]; ok {
+		return pdu, false, nil
+	}
+	return pdu.Sign(string(identity.ServerName), identity.KeyID, identity.PrivateKey), true, nil
+}
+
+// sortForImport orders the events so that every event comes after all of the
+// events it depends on, preferring lower depths and then the archive order.
+// Returns an error if an event depends on an event that isn't in the archive.
+func sortForImport(events []*importEvent) ([]*importEvent, error) {
+	byID := make(map[string]*importEvent, len(events))
+	for _, ev := range events {
+		byID[ev.EventID] = ev
+	}
+	waitingFor := make(map[string]int, len(events))
+	dependents := make(map[string][]*importEvent, len(events))
+	ready := &importQueue{}
+	for _, ev := range events {
+		seen := map[string]struct{}{}
+		for _, dep := range ev.dependencies() {
+			if _, ok := seen[dep]; ok {
+				continue
+			}
+			seen[dep] = struct{}{}
+			if _, ok := byID[dep]; !ok {
+				return nil, fmt.Errorf("event %s depends on event %s, which is not in the archive", ev.EventID, dep)
+			}
+			waitingFor[ev.EventID]++
+			dependents[dep] = append(dependents[dep], ev)
+		}
+		if waitingFor[ev.EventID] == 0 {
+			heap.Push(ready, ev)
+		}
+	}
+
+	result := make([]*importEvent, 0, len(events))
+	for ready.Len() > 0 {
+		ev := heap.Pop(ready).(*importEvent)
+		result = append(result, ev)
+		for _, dependent := range dependents[ev.EventID] {
+			waitingFor[dependent.EventID]--
+			if waitingFor[dependent.EventID] == 0 {
+				heap.Push(ready, dependent)
+			}
+		}
+	}
+	if len(result) != len(events) {
+		return nil, fmt.Errorf("the events in the archive contain a cycle")
+	}
+	return result, nil
+}
+
+// importQueue is a heap of events that are ready to be imported.
+type importQueue []*importEvent
+
+func (q importQueue) Len() int { return len(q) }
+func (q importQueue) Less(i, j int) bool {
+	if q[i].pdu.Depth() != q[j].pdu.Depth() {
+		return q[i].pdu.Depth() < q[j].pdu.Depth()
+	}
+	return q[i].index < q[j].index
+}
+func (q importQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *importQueue) Push(x interface{}) { *q = append(*q, x.(*importEvent)) }
+func (q *importQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	ev := old[n-1]
+	*q = old[:n-1]
+	return ev
+}
@@ -0,0 +1,122 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/matrix-org/dendrite/setup"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
+)
+
+// This is a utility for exporting a room's events and state to a portable
+// archive, and for importing such an archive into another Dendrite instance,
+// e.g. when migrating servers or for forensic analysis.
+//
+// The archive is newline delimited JSON. The first line is a header describing
+// the room, every following line is one event of the room in the order the
+// events were stored.
+//
+// Dendrite must not be running while importing, since the import runs its own
+// roomserver against the same databases and NATS storage.
+//
+// Usage: ./room-archive --config dendrite.yaml [--archive file] export <room ID>
+//        ./room-archive --config dendrite.yaml [--archive file] [--resign=false] import
+
+const (
+	archiveFormat        = "dendrite.room_archive"
+	archiveFormatVersion = 1
+)
+
+var archivePath = flag.String("archive", "-", "the archive file to write to or read from, - for stdout/stdin")
+var resign = flag.Bool("resign", true, "when importing, sign events sent by local users with the current signing key if it hasn't signed them yet")
+
+// archiveHeader is the first line of an archive.
+type archiveHeader struct {
+	Format        string                        `json:"format"`
+	FormatVersion int                           `json:"format_version"`
+	RoomID        string                        `json:"room_id"`
+	RoomVersion   gomatrixserverlib.RoomVersion `json:"room_version"`
+	ExportedBy    spec.ServerName               `json:"exported_by"`
+	ExportedAt    spec.Timestamp                `json:"exported_at"`
+	EventCount    int                           `json:"event_count"`
+	// The latest events in the room at the time of the export
+	ForwardExtremities []string `json:"forward_extremities"`
+	// The current state of the room at the time of the export
+	StateEventIDs []string `json:"state_event_ids"`
+}
+
+// archiveEvent is one line of an archive after the header.
+type archiveEvent struct {
+	EventID  string `json:"event_id"`
+	Rejected bool   `json:"rejected,omitempty"`
+	Redacted bool   `json:"redacted,omitempty"`
+	// Outlier events were only stored as part of an auth chain or state,
+	// without the state before the event.
+	Outlier bool `json:"outlier,omitempty"`
+	// StateBefore is set for events whose prev events aren't in the archive,
+	// e.g. the join event of a room that was joined over federation.
+	StateBefore []string        `json:"state_before,omitempty"`
+	Event       json.RawMessage `json:"event"`
+}
+
+func main() {
+	cfg := setup.ParseFlags(true)
+	cfg.Logging = append(cfg.Logging[:0], config.LogrusHook{
+		Type:  "std",
+		Level: "error",
+	})
+	ctx := context.Background()
+
+	var err error
+	switch flag.Arg(0) {
+	case "export":
+		if flag.NArg() != 2 {
+			logrus.Fatal("Usage: room-archive --config dendrite.yaml [--archive file] export <room ID>")
+		}
+		var w io.WriteCloser = os.Stdout
+		if *archivePath != "-" {
+			if w, err = os.Create(*archivePath); err != nil {
+				logrus.WithError(err).Fatal("Failed to create archive")
+			}
+		}
+		err = exportRoom(ctx, cfg, flag.Arg(1), w)
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+	case "import":
+		var r io.ReadCloser = os.Stdin
+		if *archivePath != "-" {
+			if r, err = os.Open(*archivePath); err != nil {
+				logrus.WithError(err).Fatal("Failed to open archive")
+			}
+		}
+		err = importRoom(ctx, cfg, r, *resign)
+		_ = r.Close()
+	default:
+		err = fmt.Errorf("unknown command %q, expected export or import", flag.Arg(0))
+	}
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed")
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/matrix-org/dendrite/test"
+)
+
+func Test_sortForImport(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "hello"})
+	room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "world"})
+
+	// add the events in reverse, so that all of them have to be reordered
+	roomEvents := room.Events()
+	events := make([]*importEvent, 0, len(roomEvents))
+	for i := len(roomEvents) - 1; i >= 0; i-- {
+		events = append(events, &importEvent{
+			archiveEvent: archiveEvent{EventID: roomEvents[i].EventID()},
+			pdu:          roomEvents[i].PDU,
+			index:        len(events),
+		})
+	}
+
+	ordered, err := sortForImport(events)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ordered) != len(events) {
+		t.Fatalf("expected %d events, got %d", len(events), len(ordered))
+	}
+	imported := map[string]bool{}
+	for _, ev := range ordered {
+		for _, dep := range ev.dependencies() {
+			if !imported[dep] {
+				t.Fatalf("event %s was ordered before its dependency %s", ev.EventID, dep)
+			}
+		}
+		imported[ev.EventID] = true
+	}
+
+	// without the create event, nothing else can be imported
+	if _, err = sortForImport(events[:len(events)-1]); err == nil {
+		t.Fatalf("expected an error for a missing dependency")
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// copyHeaderRegex matches the start of the data of a table in a pg_dump, e.g.
+// "COPY public.local_media_repository (media_id, media_type) FROM stdin;"
+var copyHeaderRegex = regexp.MustCompile(`^COPY (?:"?[A-Za-z0-9_]+"?\.)?"?([A-Za-z0-9_]+)"? \(([^)]*)\) FROM stdin;$`)
+
+// dumpRow is a row of a table in a dump, by column name. NULL columns are absent.
+type dumpRow map[string]string
+
+// readDump reads the rows of the given tables from a plain text pg_dump and
+// calls the function for each row. The rows of other tables are skipped.
+func readDump(r io.Reader, tables map[string]func(row dumpRow) error) error {
+	br := bufio.NewReader(r)
+	var columns []string
+	var rowFn func(row dumpRow) error
+	inCopy := false
+	for lineNo := 1; ; lineNo++ {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if line == "" && err == io.EOF {
+			if inCopy {
+				return fmt.Errorf("dump ended in the middle of a table")
+			}
+			return nil
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+
+		switch {
+		case inCopy && line == `\.`:
+			inCopy = false
+		case inCopy:
+			if rowFn == nil {
+				continue
+			}
+			fields := strings.Split(line, "\t")
+			if len(fields) != len(columns) {
+				return fmt.Errorf("line %d: got %d columns, expected %d", lineNo, len(fields), len(columns))
+			}
+			row := make(dumpRow, len(columns))
+			for i, field := range fields {
+				if field == `\N` {
+					continue
+				}
+				row[columns[i]] = unescapeCopyField(field)
+			}
+			if err := rowFn(row); err != nil {
+				return err
+			}
+		default:
+			m := copyHeaderRegex.FindStringSubmatch(line)
+			if m == nil {
+				continue
+			}
+			inCopy = true
+			rowFn = tables[m[1]]
+			columns = columns[:0]
+			for _, c := range strings.Split(m[2], ",") {
+				columns = append(columns, strings.Trim(strings.TrimSpace(c), `"`))
+			}
+		}
+	}
+}
+
+// unescapeCopyField undoes the backslash escaping of the COPY text format.
+func unescapeCopyField(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] != '\\' || i+1 == len(field) {
+			b.WriteByte(field[i])
+			continue
+		}
+		i++
+		switch field[i] {
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'v':
+			b.WriteByte('\v')
+		default:
+			b.WriteByte(field[i])
+		}
+	}
+	return b.String()
+}
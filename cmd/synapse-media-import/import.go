@@ -0,0 +1,196 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// Synapse media and file IDs are random alphanumeric strings, and are used
+	// as paths, so be strict about what is accepted.
+	synapseIDRegex     = regexp.MustCompile(`^[A-Za-z0-9_=-]{5,255}$`)
+	synapseOriginRegex = regexp.MustCompile(`^[A-Za-z0-9.:\[\]_-]{1,255}$`)
+)
+
+// importResult counts what was imported.
+type importResult struct {
+	Media            int
+	Files            int
+	DuplicateFiles   int
+	SkippedMedia     int
+	QuarantinedMedia int
+	MissingFiles     int
+}
+
+// synapseMedia is the metadata of a media in the Synapse database.
+type synapseMedia struct {
+	MediaID      string
+	Origin       spec.ServerName
+	FilesystemID string
+	ContentType  string
+	CreatedTS    spec.Timestamp
+	UploadName   string
+	UserID       string
+	Quarantined  bool
+}
+
+// path returns where Synapse stores the file of the media in its media store.
+func (m *synapseMedia) path(mediaStore string, localServer spec.ServerName) (string, error) {
+	if m.Origin == localServer {
+		id := m.MediaID
+		if !synapseIDRegex.MatchString(id) {
+			return "", fmt.Errorf("invalid media ID %q", id)
+		}
+		return filepath.Join(mediaStore, "local_content", id[0:2], id[2:4], id[4:]), nil
+	}
+	id := m.FilesystemID
+	if !synapseIDRegex.MatchString(id) {
+		return "", fmt.Errorf("invalid filesystem ID %q", id)
+	}
+	if !synapseOriginRegex.MatchString(string(m.Origin)) || m.Origin == "." || m.Origin == ".." {
+		return "", fmt.Errorf("invalid origin %q", m.Origin)
+	}
+	return filepath.Join(mediaStore, "remote_content", string(m.Origin), id[0:2], id[2:4], id[4:]), nil
+}
+
+// importSynapseMedia imports the local and remote media listed in a dump of the
+// Synapse database from the Synapse media store. Media that already exist are
+// skipped, so an interrupted import can be run again.
+func importSynapseMedia(ctx context.Context, cfg *config.MediaAPI, db storage.Database, mediaStore string, dump io.Reader) (*importResult, error) {
+	result := &importResult{}
+	localServer := cfg.Matrix.ServerName
+	encryption, err := fileutils.NewEncryption(&cfg.Encryption)
+	if err != nil {
+		return result, err
+	}
+	importRow := func(row dumpRow, m *synapseMedia) error {
+		if row["url_cache"] != "" {
+			// URL preview media are only a cache, so aren't worth importing.
+			return nil
+		}
+		createdTS, err := strconv.ParseInt(row["created_ts"], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid created_ts for media %q: %w", m.MediaID, err)
+		}
+		m.CreatedTS = spec.Timestamp(createdTS)
+		m.ContentType = row["media_type"]
+		m.UploadName = row["upload_name"]
+		m.Quarantined = row["quarantined_by"] != ""
+		return importOne(ctx, cfg, db, encryption, mediaStore, m, result)
+	}
+
+	err = readDump(dump, map[string]func(row dumpRow) error{
+		"local_media_repository": func(row dumpRow) error {
+			return importRow(row, &synapseMedia{
+				MediaID: row["media_id"],
+				Origin:  localServer,
+				UserID:  row["user_id"],
+			})
+		},
+		"remote_media_cache": func(row dumpRow) error {
+			return importRow(row, &synapseMedia{
+				MediaID:      row["media_id"],
+				Origin:       spec.ServerName(row["media_origin"]),
+				FilesystemID: row["filesystem_id"],
+			})
+		},
+	})
+	return result, err
+}
+
+func importOne(ctx context.Context, cfg *config.MediaAPI, db storage.Database, encryption *fileutils.Encryption, mediaStore string, m *synapseMedia, result *importResult) error {
+	logger := logrus.WithFields(logrus.Fields{
+		"MediaID": m.MediaID,
+		"Origin":  m.Origin,
+	})
+	if m.Quarantined {
+		logger.Info("Skipping quarantined media")
+		result.QuarantinedMedia++
+		return nil
+	}
+	existing, err := db.GetMediaMetadata(ctx, types.MediaID(m.MediaID), m.Origin)
+	if err != nil {
+		return fmt.Errorf("db.GetMediaMetadata: %w", err)
+	}
+	if existing != nil {
+		result.SkippedMedia++
+		return nil
+	}
+
+	srcPath, err := m.path(mediaStore, cfg.Matrix.ServerName)
+	if err != nil {
+		return err
+	}
+	src, err := os.Open(srcPath)
+	if errors.Is(err, os.ErrNotExist) {
+		logger.WithField("path", srcPath).Warn("Skipping media whose file is missing from the media store")
+		result.MissingFiles++
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close() // nolint: errcheck
+
+	hash, size, tmpDir, err := fileutils.WriteTempFile(ctx, src, 0, cfg.TempDir(), db, encryption)
+	if errors.Is(err, fileutils.ErrHashBlocked) {
+		logger.Info("Skipping blocked media")
+		result.QuarantinedMedia++
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to copy %s: %w", srcPath, err)
+	}
+	metadata := &types.MediaMetadata{
+		MediaID:           types.MediaID(m.MediaID),
+		Origin:            m.Origin,
+		ContentType:       types.ContentType(m.ContentType),
+		FileSizeBytes:     size,
+		CreationTimestamp: m.CreatedTS,
+		UploadName:        types.Filename(m.UploadName),
+		Base64Hash:        hash,
+		UserID:            types.MatrixUserID(m.UserID),
+	}
+	_, duplicate, err := fileutils.MoveFileWithHashCheck(ctx, tmpDir, metadata, cfg.AbsBasePath, cfg.StoreLayout, encryption, fileutils.NewCompression(&cfg.Compression), cfg.Fsync, logger)
+	if err != nil {
+		return err
+	}
+	if duplicate {
+		result.DuplicateFiles++
+	} else {
+		result.Files++
+	}
+
+	if err = db.StoreMediaMetadata(ctx, metadata); err != nil {
+		return fmt.Errorf("db.StoreMediaMetadata: %w", err)
+	}
+	result.Media++
+	return nil
+}
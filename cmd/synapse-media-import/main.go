@@ -0,0 +1,84 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/setup"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/sirupsen/logrus"
+)
+
+// This is a utility for importing the media repository of a Synapse server, so
+// that a server migrating from Synapse keeps its media.
+//
+// It reads the local_media_repository and remote_media_cache tables from a
+// plain text pg_dump of the Synapse database, e.g. made with
+//
+//     pg_dump -t local_media_repository -t remote_media_cache synapse > media.sql
+//
+// and copies the files they refer to from the Synapse media_store directory
+// into the Dendrite media store. Media keep their media IDs, so existing mxc://
+// URIs keep working as long as Dendrite uses the same server name as Synapse
+// did. Thumbnails and URL previews aren't imported, thumbnails are generated
+// again when requested. Quarantined media are skipped.
+//
+// Media that already exist are skipped, so an interrupted import can be run again.
+//
+// Usage: ./synapse-media-import --config dendrite.yaml --media-store /path/to/media_store --dump media.sql
+
+var (
+	mediaStorePath = flag.String("media-store", "", "the path to the Synapse media_store directory")
+	dumpPath       = flag.String("dump", "", "the path to a plain text pg_dump of the Synapse media tables")
+)
+
+func main() {
+	cfg := setup.ParseFlags(true)
+	cfg.Logging = append(cfg.Logging[:0], config.LogrusHook{
+		Type:  "std",
+		Level: "warn",
+	})
+	if *mediaStorePath == "" || *dumpPath == "" {
+		logrus.Fatal("--media-store and --dump must be given")
+	}
+	ctx := context.Background()
+
+	processCtx := process.NewProcessContext()
+	cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+	db, err := storage.NewMediaAPIDatasource(cm, &cfg.MediaAPI.Database)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to connect to the media database")
+	}
+
+	dump, err := os.Open(*dumpPath)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to open dump")
+	}
+	defer dump.Close() // nolint: errcheck
+
+	result, err := importSynapseMedia(ctx, &cfg.MediaAPI, db, *mediaStorePath, dump)
+	fmt.Fprintf(os.Stderr, "Imported %d media with %d new files and %d duplicate files, skipped %d existing media, %d quarantined media and %d media with missing files\n",
+		result.Media, result.Files, result.DuplicateFiles, result.SkippedMedia, result.QuarantinedMedia, result.MissingFiles)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed")
+	}
+}
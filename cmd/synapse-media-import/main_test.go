@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/stretchr/testify/assert"
+)
+
+const testDump = `--
+-- PostgreSQL database dump
+--
+
+COPY public.local_media_repository (media_id, media_type, media_length, created_ts, upload_name, user_id, quarantined_by, url_cache, last_access_ts, safe_from_quarantine) FROM stdin;
+abcdefghijklmnop	text/plain	11	1000	hello\tworld.txt	@alice:localhost	\N	\N	\N	f
+quarantinedmedia	text/plain	11	1000	\N	@alice:localhost	@admin:localhost	\N	\N	f
+urlpreviewmedia	text/html	11	1000	\N	\N	\N	https://example.com	\N	f
+missingfilemedia	text/plain	11	1000	\N	@alice:localhost	\N	\N	\N	f
+\.
+
+COPY public.events (event_id, type) FROM stdin;
+$event	m.room.message
+\.
+
+COPY public.remote_media_cache (media_origin, media_id, media_type, created_ts, upload_name, media_length, filesystem_id, last_access_ts, quarantined_by) FROM stdin;
+remote.example.com	remotemediaid	text/plain	2000	\N	11	qrstuvwxyz	\N	\N
+\.
+`
+
+func newMediaStore(t *testing.T) (*config.MediaAPI, storage.Database) {
+	cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
+	db, err := storage.NewMediaAPIDatasource(cm, &config.DatabaseOptions{
+		ConnectionString:       config.DataSource("file:" + filepath.Join(t.TempDir(), "media.db")),
+		MaxOpenConnections:     1,
+		MaxIdleConnections:     1,
+		ConnMaxLifetimeSeconds: -1,
+	})
+	assert.NoError(t, err)
+	cfg := &config.MediaAPI{
+		Matrix:      &config.Global{},
+		AbsBasePath: config.Path(t.TempDir()),
+	}
+	cfg.Matrix.ServerName = "localhost"
+	return cfg, db
+}
+
+func writeSynapseFile(t *testing.T, path string, content string) {
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0770))
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0660))
+}
+
+func TestImportSynapseMedia(t *testing.T) {
+	ctx := context.Background()
+	cfg, db := newMediaStore(t)
+
+	mediaStore := t.TempDir()
+	writeSynapseFile(t, filepath.Join(mediaStore, "local_content", "ab", "cd", "efghijklmnop"), "hello world")
+	writeSynapseFile(t, filepath.Join(mediaStore, "local_content", "qu", "ar", "antinedmedia"), "quarantined")
+	writeSynapseFile(t, filepath.Join(mediaStore, "remote_content", "remote.example.com", "qr", "st", "uvwxyz"), "hello world")
+
+	result, err := importSynapseMedia(ctx, cfg, db, mediaStore, strings.NewReader(testDump))
+	assert.NoError(t, err)
+	assert.Equal(t, &importResult{Media: 2, Files: 1, DuplicateFiles: 1, QuarantinedMedia: 1, MissingFiles: 1}, result)
+
+	local, err := db.GetMediaMetadata(ctx, "abcdefghijklmnop", "localhost")
+	assert.NoError(t, err)
+	if assert.NotNil(t, local) {
+		assert.Equal(t, types.Filename("hello\tworld.txt"), local.UploadName)
+		assert.Equal(t, types.MatrixUserID("@alice:localhost"), local.UserID)
+		assert.Equal(t, types.ContentType("text/plain"), local.ContentType)
+		assert.EqualValues(t, 11, local.FileSizeBytes)
+		assert.EqualValues(t, 1000, local.CreationTimestamp)
+		path, err := fileutils.GetPathFromBase64Hash(local.Base64Hash, cfg.AbsBasePath, cfg.StoreLayout)
+		assert.NoError(t, err)
+		content, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello world", string(content))
+	}
+
+	remote, err := db.GetMediaMetadata(ctx, "remotemediaid", "remote.example.com")
+	assert.NoError(t, err)
+	if assert.NotNil(t, remote) && assert.NotNil(t, local) {
+		assert.Equal(t, local.Base64Hash, remote.Base64Hash)
+	}
+
+	for _, mediaID := range []types.MediaID{"quarantinedmedia", "urlpreviewmedia", "missingfilemedia"} {
+		m, err := db.GetMediaMetadata(ctx, mediaID, "localhost")
+		assert.NoError(t, err)
+		assert.Nil(t, m, mediaID)
+	}
+
+	// importing again skips what was imported already
+	result, err = importSynapseMedia(ctx, cfg, db, mediaStore, strings.NewReader(testDump))
+	assert.NoError(t, err)
+	assert.Equal(t, &importResult{SkippedMedia: 2, QuarantinedMedia: 1, MissingFiles: 1}, result)
+}
+
+func TestSynapseMediaPathValidation(t *testing.T) {
+	for _, m := range []synapseMedia{
+		{MediaID: "../../etc/passwd", Origin: "localhost"},
+		{MediaID: "abc", Origin: "localhost"},
+		{FilesystemID: "abcdefgh", Origin: ".."},
+		{FilesystemID: "abcdefgh", Origin: "evil/../../"},
+	} {
+		_, err := m.path("/media_store", "localhost")
+		assert.Error(t, err, "%+v", m)
+	}
+}
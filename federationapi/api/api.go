@@ -47,6 +47,14 @@ type ClientFederationAPI interface {
 	// containing only the server names (without information for membership events).
 	// The response will include this server if they are joined to the room.
 	QueryJoinedHostServerNamesInRoom(ctx context.Context, request *QueryJoinedHostServerNamesInRoomRequest, response *QueryJoinedHostServerNamesInRoomResponse) error
+	// Blocks until we have the full state of the room, if we joined it using a partial
+	// state send_join, or until the context expires. Returns immediately otherwise.
+	AwaitFullRoomState(ctx context.Context, roomID string) error
+	// Query the destinations that are currently blacklisted or being backed off from.
+	QueryFederationBackoffs(ctx context.Context) ([]FederationBackoff, error)
+	// Resets the backoff and blacklist status of a destination so that we retry
+	// sending to it straight away.
+	PerformResetFederationBackoff(ctx context.Context, serverName spec.ServerName) error
 }
 
 type RoomserverFederationAPI interface {
@@ -71,6 +79,9 @@ type RoomserverFederationAPI interface {
 	// containing only the server names (without information for membership events).
 	// The response will include this server if they are joined to the room.
 	QueryJoinedHostServerNamesInRoom(ctx context.Context, request *QueryJoinedHostServerNamesInRoomRequest, response *QueryJoinedHostServerNamesInRoomResponse) error
+	// Query whether we only have partial state for the room, i.e. we joined it using
+	// a partial state send_join and are still resyncing the full state.
+	QueryRoomHasPartialState(ctx context.Context, roomID string) bool
 	GetEventAuth(ctx context.Context, origin, s spec.ServerName, roomVersion gomatrixserverlib.RoomVersion, roomID, eventID string) (res fclient.RespEventAuth, err error)
 	GetEvent(ctx context.Context, origin, s spec.ServerName, eventID string) (res gomatrixserverlib.Transaction, err error)
 	LookupMissingEvents(ctx context.Context, origin, s spec.ServerName, roomID string, missing fclient.MissingEvents, roomVersion gomatrixserverlib.RoomVersion) (res fclient.RespMissingEvents, err error)
@@ -220,6 +231,14 @@ type PerformBroadcastEDURequest struct {
 type PerformBroadcastEDUResponse struct {
 }
 
+// FederationBackoff is the backoff status of a destination.
+type FederationBackoff struct {
+	ServerName   spec.ServerName `json:"server_name"`
+	FailureCount uint32          `json:"failure_count"`
+	BackoffUntil spec.Timestamp  `json:"backoff_until,omitempty"`
+	Blacklisted  bool            `json:"blacklisted"`
+}
+
 type PerformWakeupServersRequest struct {
 	ServerNames []spec.ServerName `json:"server_names"`
 }
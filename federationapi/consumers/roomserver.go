@@ -241,6 +241,17 @@ func (s *OutputRoomEventConsumer) processMessage(ore api.OutputNewRoomEvent, rew
 		return err
 	}
 
+	// If we joined the room with a partial state send_join then we don't know the
+	// membership of every remote server yet, so also send to the servers that the
+	// resident server told us about until the full state has been resynced.
+	partialState, err := s.db.GetPartialStateRoom(s.ctx, ore.Event.RoomID().String())
+	if err != nil {
+		return err
+	}
+	if partialState != nil {
+		joinedHostsAtEvent = append(joinedHostsAtEvent, partialState.ServersInRoom...)
+	}
+
 	// TODO: do housekeeping to evict unrenewed peeking hosts
 
 	// TODO: implement query to let the fedapi check whether a given peek is live or not
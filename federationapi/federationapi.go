@@ -15,6 +15,7 @@
 package federationapi
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/matrix-org/dendrite/internal/httputil"
@@ -32,6 +33,7 @@ import (
 	"github.com/matrix-org/dendrite/federationapi/statistics"
 	"github.com/matrix-org/dendrite/federationapi/storage"
 	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/internal/spamcheck"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/jetstream"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
@@ -52,10 +54,15 @@ func AddPublicRoutes(
 	keyRing gomatrixserverlib.JSONVerifier,
 	rsAPI roomserverAPI.FederationRoomserverAPI,
 	fedAPI federationAPI.FederationInternalAPI,
+	caches *caching.Caches,
 	enableMetrics bool,
-) {
+) error {
 	cfg := &dendriteConfig.FederationAPI
 	mscCfg := &dendriteConfig.MSCs
+	spamCheckers, err := spamcheck.New(&dendriteConfig.Global.SpamChecker)
+	if err != nil {
+		return fmt.Errorf("failed to set up spam checkers: %w", err)
+	}
 	js, _ := natsInstance.Prepare(processContext, &cfg.Matrix.JetStream)
 	producer := &producers.SyncAPIProducer{
 		JetStream:              js,
@@ -80,13 +87,21 @@ func AddPublicRoutes(
 			"FederationInternalAPI. This is a programming error.")
 	}
 
+	// A nil *caching.Caches would become a non-nil interface value, so only
+	// pass a transaction cache on if there are caches.
+	var txnCache caching.FederationTransactionCache
+	if caches != nil {
+		txnCache = caches
+	}
+
 	routing.Setup(
 		routers,
 		dendriteConfig,
 		rsAPI, f, keyRing,
 		federation, userAPI, mscCfg,
-		producer, enableMetrics,
+		producer, txnCache, spamCheckers, enableMetrics,
 	)
+	return nil
 }
 
 // NewInternalAPI returns a concerete implementation of the internal API. Callers
@@ -112,11 +127,17 @@ func NewInternalAPI(
 	if resetBlacklist {
 		_ = federationDB.RemoveAllServersFromBlacklist()
 	}
+	if resetBlacklist || !cfg.PersistBackoff {
+		if err = federationDB.RemoveAllServerBackoffs(processContext.Context()); err != nil {
+			logrus.WithError(err).Error("failed to remove persisted federation backoffs")
+		}
+	}
 
 	stats := statistics.NewStatistics(
 		federationDB,
 		cfg.FederationMaxRetries+1,
 		cfg.P2PFederationRetriesUntilAssumedOffline+1)
+	stats.PersistBackoff = cfg.PersistBackoff
 
 	js, nats := natsInstance.Prepare(processContext, &cfg.Matrix.JetStream)
 
@@ -127,6 +148,10 @@ func NewInternalAPI(
 		cfg.Matrix.DisableFederation,
 		cfg.Matrix.ServerName, federation, &stats,
 		signingInfo,
+		queue.TransactionLimits{
+			MaxPDUs: cfg.MaxPDUsPerTransaction,
+			MaxEDUs: cfg.MaxEDUsPerTransaction,
+		},
 	)
 
 	rsConsumer := consumers.NewOutputRoomEventConsumer(
@@ -178,5 +203,9 @@ func NewInternalAPI(
 	}
 	time.AfterFunc(time.Minute, cleanExpiredEDUs)
 
-	return internal.NewFederationInternalAPI(federationDB, cfg, rsAPI, federation, &stats, caches, queues, keyRing)
+	fsAPI := internal.NewFederationInternalAPI(processContext, federationDB, cfg, rsAPI, federation, &stats, caches, queues, keyRing)
+	if err = fsAPI.ResumePartialStateResyncs(processContext.Context()); err != nil {
+		logrus.WithError(err).Error("Failed to resume partial state resyncs")
+	}
+	return fsAPI
 }
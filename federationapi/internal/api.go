@@ -15,6 +15,7 @@ import (
 	"github.com/matrix-org/dendrite/internal/caching"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
 	"github.com/matrix-org/gomatrix"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/gomatrixserverlib/fclient"
@@ -24,6 +25,7 @@ import (
 
 // FederationInternalAPI is an implementation of api.FederationInternalAPI
 type FederationInternalAPI struct {
+	processCtx *process.ProcessContext
 	db         storage.Database
 	cfg        *config.FederationAPI
 	statistics *statistics.Statistics
@@ -32,9 +34,12 @@ type FederationInternalAPI struct {
 	keyRing    *gomatrixserverlib.KeyRing
 	queues     *queue.OutgoingQueues
 	joins      sync.Map // joins currently in progress
+	// rooms joined with partial state that are still resyncing, room ID -> chan struct{}
+	partialState sync.Map
 }
 
 func NewFederationInternalAPI(
+	processCtx *process.ProcessContext,
 	db storage.Database, cfg *config.FederationAPI,
 	rsAPI roomserverAPI.FederationRoomserverAPI,
 	federation fclient.FederationClient,
@@ -102,6 +107,7 @@ func NewFederationInternalAPI(
 	}
 
 	return &FederationInternalAPI{
+		processCtx: processCtx,
 		db:         db,
 		cfg:        cfg,
 		rsAPI:      rsAPI,
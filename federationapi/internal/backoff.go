@@ -0,0 +1,84 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/dendrite/federationapi/api"
+)
+
+// QueryFederationBackoffs implements api.ClientFederationAPI
+func (r *FederationInternalAPI) QueryFederationBackoffs(
+	ctx context.Context,
+) ([]api.FederationBackoff, error) {
+	// Servers that we haven't talked to since startup only have their status
+	// in the database, so look at those as well as the ones in memory.
+	serverNames := map[spec.ServerName]struct{}{}
+	for _, serverName := range r.statistics.ServerNames() {
+		serverNames[serverName] = struct{}{}
+	}
+	blacklisted, err := r.db.GetBlacklistedServers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, serverName := range blacklisted {
+		serverNames[serverName] = struct{}{}
+	}
+	backoffs, err := r.db.GetServerBackoffs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, backoff := range backoffs {
+		serverNames[backoff.ServerName] = struct{}{}
+	}
+
+	now := time.Now()
+	res := []api.FederationBackoff{}
+	for serverName := range serverNames {
+		stats := r.statistics.ForServer(serverName)
+		backoff := api.FederationBackoff{
+			ServerName:   serverName,
+			FailureCount: stats.FailureCount(),
+			Blacklisted:  stats.Blacklisted(),
+		}
+		if until := stats.BackoffInfo(); until != nil && until.After(now) {
+			backoff.BackoffUntil = spec.AsTimestamp(*until)
+		}
+		if !backoff.Blacklisted && backoff.BackoffUntil == 0 {
+			continue
+		}
+		res = append(res, backoff)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ServerName < res[j].ServerName
+	})
+	return res, nil
+}
+
+// PerformResetFederationBackoff implements api.ClientFederationAPI
+func (r *FederationInternalAPI) PerformResetFederationBackoff(
+	ctx context.Context,
+	serverName spec.ServerName,
+) error {
+	r.MarkServersAlive([]spec.ServerName{serverName})
+	// Blacklisted servers don't restore their backoff from the database, so
+	// make sure that nothing is left behind for them.
+	return r.db.RemoveServerBackoff(ctx, serverName)
+}
@@ -0,0 +1,228 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/federationapi/types"
+	rstypes "github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	partialStateResyncMinBackoff = time.Second * 5
+	partialStateResyncMaxBackoff = time.Hour
+)
+
+// partialStateJoinClient wraps the federation API so that send_join requests
+// made by gomatrixserverlib.PerformJoin ask for partial state (MSC3706). The
+// last response is kept so that we can find out whether the remote server
+// actually omitted any members.
+type partialStateJoinClient struct {
+	*FederationInternalAPI
+	response *fclient.RespSendJoin
+}
+
+func (c *partialStateJoinClient) SendJoin(
+	ctx context.Context, origin, s spec.ServerName, event gomatrixserverlib.PDU,
+) (res gomatrixserverlib.SendJoinResponse, err error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
+	defer cancel()
+	ires, err := c.federation.SendJoinPartialState(ctx, origin, s, event)
+	if err != nil {
+		return &fclient.RespSendJoin{}, err
+	}
+	c.response = &ires
+	return &ires, nil
+}
+
+// partialStateRoom builds the partial state record for a join, or returns nil
+// if partial state wasn't requested or the remote server sent us the full state
+// after all.
+func (c *partialStateJoinClient) partialStateRoom(roomID, userID, joinEventID string, joinedVia spec.ServerName) *types.PartialStateRoom {
+	if c == nil || c.response == nil || !c.response.MembersOmitted {
+		return nil
+	}
+	servers := make([]spec.ServerName, 0, len(c.response.ServersInRoom))
+	for _, server := range c.response.ServersInRoom {
+		servers = append(servers, spec.ServerName(server))
+	}
+	return &types.PartialStateRoom{
+		RoomID:        roomID,
+		UserID:        userID,
+		JoinEventID:   joinEventID,
+		JoinedVia:     joinedVia,
+		ServersInRoom: servers,
+	}
+}
+
+// AwaitFullRoomState implements api.FederationInternalAPI
+func (r *FederationInternalAPI) AwaitFullRoomState(ctx context.Context, roomID string) error {
+	ch, ok := r.partialState.Load(roomID)
+	if !ok {
+		return nil
+	}
+	select {
+	case <-ch.(chan struct{}):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// QueryRoomHasPartialState implements api.FederationInternalAPI
+func (r *FederationInternalAPI) QueryRoomHasPartialState(ctx context.Context, roomID string) bool {
+	_, ok := r.partialState.Load(roomID)
+	return ok
+}
+
+// ResumePartialStateResyncs restarts the background state resync for any rooms
+// that we had joined with partial state before the last shutdown.
+func (r *FederationInternalAPI) ResumePartialStateResyncs(ctx context.Context) error {
+	rooms, err := r.db.GetPartialStateRooms(ctx)
+	if err != nil {
+		return err
+	}
+	// Give the other components a chance to finish starting up first, since
+	// the resync goes through the roomserver.
+	for i := range rooms {
+		r.startPartialStateResync(&rooms[i], partialStateResyncMinBackoff)
+	}
+	return nil
+}
+
+// startPartialStateResync marks the room as having partial state and starts
+// downloading the full room state in the background after the given delay.
+func (r *FederationInternalAPI) startPartialStateResync(room *types.PartialStateRoom, delay time.Duration) {
+	if _, loaded := r.partialState.LoadOrStore(room.RoomID, make(chan struct{})); loaded {
+		return
+	}
+	go r.resyncPartialState(room, delay)
+}
+
+// resyncPartialState fetches the full state before the join event from the
+// servers in the room until one of them gives it to us, or until shutdown.
+func (r *FederationInternalAPI) resyncPartialState(room *types.PartialStateRoom, delay time.Duration) {
+	ctx := r.processCtx.Context()
+	logger := logrus.WithFields(logrus.Fields{
+		"room_id":    room.RoomID,
+		"joined_via": room.JoinedVia,
+	})
+
+	user, err := spec.NewUserID(room.UserID, true)
+	if err != nil {
+		logger.WithError(err).Error("Failed to resync full room state")
+		return
+	}
+
+	// Try the server that we joined through first, as it gave us the partial
+	// state in the first place, then fall back to the other servers in the room.
+	servers := []spec.ServerName{room.JoinedVia}
+	for _, server := range room.ServersInRoom {
+		if server != room.JoinedVia && !r.cfg.Matrix.IsLocalServerName(server) {
+			servers = append(servers, server)
+		}
+	}
+
+	backoff := partialStateResyncMinBackoff
+	for {
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		for _, server := range servers {
+			if r.statistics.ForServer(server).Blacklisted() {
+				continue
+			}
+			if err = r.resyncPartialStateFrom(ctx, room, user.Domain(), server); err != nil {
+				logger.WithError(err).WithField("server", server).Warn("Failed to resync full room state")
+				continue
+			}
+			if err = r.db.RemovePartialStateRoom(ctx, room.RoomID); err != nil {
+				logger.WithError(err).Error("Failed to remove partial state room")
+			}
+			if ch, ok := r.partialState.LoadAndDelete(room.RoomID); ok {
+				close(ch.(chan struct{}))
+			}
+			logger.Info("Resynced full room state after partial state join")
+			return
+		}
+
+		delay = backoff
+		if backoff *= 2; backoff > partialStateResyncMaxBackoff {
+			backoff = partialStateResyncMaxBackoff
+		}
+	}
+}
+
+// resyncPartialStateFrom asks the given server for the state before the join
+// event and hands it to the roomserver. The state is only accepted if every
+// event listed by /state_ids came back from /state and passed the checks.
+func (r *FederationInternalAPI) resyncPartialStateFrom(
+	ctx context.Context, room *types.PartialStateRoom, origin, server spec.ServerName,
+) error {
+	roomVersion, err := r.rsAPI.QueryRoomVersionForRoom(ctx, room.RoomID)
+	if err != nil {
+		return fmt.Errorf("r.rsAPI.QueryRoomVersionForRoom: %w", err)
+	}
+	stateIDs, err := r.LookupStateIDs(ctx, origin, server, room.RoomID, room.JoinEventID)
+	if err != nil {
+		return fmt.Errorf("r.LookupStateIDs: %w", err)
+	}
+	state, err := r.LookupState(ctx, origin, server, room.RoomID, room.JoinEventID, roomVersion)
+	if err != nil {
+		return fmt.Errorf("r.LookupState: %w", err)
+	}
+
+	userIDProvider := func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+		return r.rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
+	}
+	authEvents, stateEvents, err := gomatrixserverlib.CheckStateResponse(
+		ctx, state, roomVersion, r.keyRing, federatedEventProvider(ctx, r.federation, r.keyRing, origin, server, userIDProvider), userIDProvider,
+	)
+	if err != nil {
+		return fmt.Errorf("gomatrixserverlib.CheckStateResponse: %w", err)
+	}
+
+	stateEventIDs := make(map[string]struct{}, len(stateEvents))
+	for _, event := range stateEvents {
+		stateEventIDs[event.EventID()] = struct{}{}
+	}
+	for _, eventID := range stateIDs.GetStateEventIDs() {
+		if _, ok := stateEventIDs[eventID]; !ok {
+			return fmt.Errorf("state event %q is missing or failed checks", eventID)
+		}
+	}
+
+	headeredState := make([]*rstypes.HeaderedEvent, 0, len(stateEvents))
+	for _, event := range stateEvents {
+		headeredState = append(headeredState, &rstypes.HeaderedEvent{PDU: event})
+	}
+	headeredAuth := make([]*rstypes.HeaderedEvent, 0, len(authEvents))
+	for _, event := range authEvents {
+		headeredAuth = append(headeredAuth, &rstypes.HeaderedEvent{PDU: event})
+	}
+	return r.rsAPI.PerformResyncPartialState(ctx, room.RoomID, room.JoinEventID, headeredState, headeredAuth)
+}
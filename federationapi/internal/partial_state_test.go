@@ -0,0 +1,245 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/federationapi/statistics"
+	"github.com/matrix-org/dendrite/federationapi/types"
+	rsapi "github.com/matrix-org/dendrite/roomserver/api"
+	rstypes "github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/stretchr/testify/assert"
+)
+
+const partialStateRemoteServer = spec.ServerName("remote")
+
+type partialStateKeyDatabase struct {
+	gomatrixserverlib.KeyDatabase
+}
+
+func (d *partialStateKeyDatabase) FetchKeys(
+	ctx context.Context, requests map[gomatrixserverlib.PublicKeyLookupRequest]spec.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	for req := range requests {
+		if req.ServerName != partialStateRemoteServer {
+			continue
+		}
+		results[req] = gomatrixserverlib.PublicKeyLookupResult{
+			VerifyKey: gomatrixserverlib.VerifyKey{
+				Key: spec.Base64Bytes(test.PrivateKeyA.Public().(ed25519.PublicKey)),
+			},
+			ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+			ValidUntilTS: spec.AsTimestamp(time.Now().Add(time.Hour)),
+		}
+	}
+	return results, nil
+}
+
+func (d *partialStateKeyDatabase) FetcherName() string {
+	return "partialStateKeyDatabase"
+}
+
+func (d *partialStateKeyDatabase) StoreKeys(
+	ctx context.Context, results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) error {
+	return nil
+}
+
+type partialStateFedClient struct {
+	fclient.FederationClient
+	stateEvents []*rstypes.HeaderedEvent
+	// state event IDs that /state leaves out, although /state_ids lists them
+	omitted map[string]bool
+}
+
+func (c *partialStateFedClient) LookupStateIDs(
+	ctx context.Context, origin, s spec.ServerName, roomID, eventID string,
+) (fclient.RespStateIDs, error) {
+	res := fclient.RespStateIDs{}
+	for _, event := range c.stateEvents {
+		res.StateEventIDs = append(res.StateEventIDs, event.EventID())
+		res.AuthEventIDs = append(res.AuthEventIDs, event.EventID())
+	}
+	return res, nil
+}
+
+func (c *partialStateFedClient) LookupState(
+	ctx context.Context, origin, s spec.ServerName, roomID, eventID string, roomVersion gomatrixserverlib.RoomVersion,
+) (fclient.RespState, error) {
+	var events []gomatrixserverlib.PDU
+	for _, event := range c.stateEvents {
+		if !c.omitted[event.EventID()] {
+			events = append(events, event.PDU)
+		}
+	}
+	return fclient.RespState{
+		StateEvents: gomatrixserverlib.NewEventJSONsFromEvents(events),
+		AuthEvents:  gomatrixserverlib.NewEventJSONsFromEvents(events),
+	}, nil
+}
+
+type partialStateRoomserverAPI struct {
+	rsapi.FederationRoomserverAPI
+	roomVersion gomatrixserverlib.RoomVersion
+	resynced    chan []string
+}
+
+func (r *partialStateRoomserverAPI) QueryRoomVersionForRoom(ctx context.Context, roomID string) (gomatrixserverlib.RoomVersion, error) {
+	return r.roomVersion, nil
+}
+
+func (r *partialStateRoomserverAPI) QueryUserIDForSender(ctx context.Context, roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+	return spec.NewUserID(string(senderID), true)
+}
+
+func (r *partialStateRoomserverAPI) PerformResyncPartialState(
+	ctx context.Context, roomID, joinEventID string, stateEvents, authEvents []*rstypes.HeaderedEvent,
+) error {
+	eventIDs := make([]string, 0, len(stateEvents))
+	for _, event := range stateEvents {
+		eventIDs = append(eventIDs, event.EventID())
+	}
+	r.resynced <- eventIDs
+	return nil
+}
+
+func TestPartialStateJoinRoom(t *testing.T) {
+	client := &partialStateJoinClient{}
+	assert.Nil(t, client.partialStateRoom("!room:remote", "@alice:test", "$join", partialStateRemoteServer))
+
+	client.response = &fclient.RespSendJoin{MembersOmitted: false}
+	assert.Nil(t, client.partialStateRoom("!room:remote", "@alice:test", "$join", partialStateRemoteServer))
+
+	client.response = &fclient.RespSendJoin{
+		MembersOmitted: true,
+		ServersInRoom:  []string{"remote", "other"},
+	}
+	assert.Equal(t, &types.PartialStateRoom{
+		RoomID:        "!room:remote",
+		UserID:        "@alice:test",
+		JoinEventID:   "$join",
+		JoinedVia:     partialStateRemoteServer,
+		ServersInRoom: []spec.ServerName{"remote", "other"},
+	}, client.partialStateRoom("!room:remote", "@alice:test", "$join", partialStateRemoteServer))
+
+	// Nothing was joined with partial state if partial state joins are disabled.
+	var disabled *partialStateJoinClient
+	assert.Nil(t, disabled.partialStateRoom("!room:remote", "@alice:test", "$join", partialStateRemoteServer))
+}
+
+func newPartialStateTestAPI(
+	t *testing.T, processCtx *process.ProcessContext,
+	fedClient *partialStateFedClient, rsAPI *partialStateRoomserverAPI,
+) (*FederationInternalAPI, *test.InMemoryFederationDatabase) {
+	t.Helper()
+	testDB := test.NewInMemoryFederationDatabase()
+	_, key, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	cfg := config.FederationAPI{
+		Matrix: &config.Global{
+			SigningIdentity: fclient.SigningIdentity{
+				ServerName: "test",
+				KeyID:      "ed25519:1",
+				PrivateKey: key,
+			},
+		},
+	}
+	stats := statistics.NewStatistics(testDB, FailuresUntilBlacklist, FailuresUntilAssumedOffline)
+	keyRing := &gomatrixserverlib.KeyRing{KeyDatabase: &partialStateKeyDatabase{}}
+	return NewFederationInternalAPI(processCtx, testDB, &cfg, rsAPI, fedClient, &stats, nil, nil, keyRing), testDB
+}
+
+func TestResyncPartialState(t *testing.T) {
+	alice := test.NewUser(t, test.WithSigningServer(partialStateRemoteServer, "ed25519:remote", test.PrivateKeyA))
+	bob := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	stateBeforeJoin := room.CurrentState()
+	join := room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{
+		"membership": spec.Join,
+	}, test.WithStateKey(bob.ID))
+	partialState := &types.PartialStateRoom{
+		RoomID:      room.ID,
+		UserID:      bob.ID,
+		JoinEventID: join.EventID(),
+		JoinedVia:   partialStateRemoteServer,
+	}
+
+	t.Run("resyncs the full state before the join", func(t *testing.T) {
+		processCtx := process.NewProcessContext()
+		defer processCtx.ShutdownDendrite()
+		rsAPI := &partialStateRoomserverAPI{roomVersion: room.Version, resynced: make(chan []string)}
+		fedAPI, testDB := newPartialStateTestAPI(t, processCtx, &partialStateFedClient{stateEvents: stateBeforeJoin}, rsAPI)
+		assert.NoError(t, testDB.AddPartialStateRoom(context.Background(), partialState))
+
+		// The resync blocks in the roomserver until we read what it was given.
+		fedAPI.startPartialStateResync(partialState, 0)
+		assert.True(t, fedAPI.QueryRoomHasPartialState(context.Background(), room.ID))
+
+		wantEventIDs := make([]string, 0, len(stateBeforeJoin))
+		for _, event := range stateBeforeJoin {
+			wantEventIDs = append(wantEventIDs, event.EventID())
+		}
+		select {
+		case eventIDs := <-rsAPI.resynced:
+			assert.ElementsMatch(t, wantEventIDs, eventIDs)
+		case <-time.After(time.Second * 5):
+			t.Fatal("timed out waiting for the resync")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		assert.NoError(t, fedAPI.AwaitFullRoomState(ctx, room.ID))
+		assert.False(t, fedAPI.QueryRoomHasPartialState(context.Background(), room.ID))
+
+		rooms, err := testDB.GetPartialStateRooms(context.Background())
+		assert.NoError(t, err)
+		assert.Empty(t, rooms)
+	})
+
+	t.Run("incomplete state is not accepted", func(t *testing.T) {
+		processCtx := process.NewProcessContext()
+		rsAPI := &partialStateRoomserverAPI{roomVersion: room.Version, resynced: make(chan []string, 1)}
+		// Leave out an event that nothing else needs for auth.
+		fedClient := &partialStateFedClient{stateEvents: stateBeforeJoin, omitted: map[string]bool{}}
+		for _, event := range stateBeforeJoin {
+			if event.Type() == spec.MRoomHistoryVisibility {
+				fedClient.omitted[event.EventID()] = true
+			}
+		}
+		assert.Len(t, fedClient.omitted, 1)
+		fedAPI, _ := newPartialStateTestAPI(t, processCtx, fedClient, rsAPI)
+
+		fedAPI.startPartialStateResync(partialState, 0)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+		defer cancel()
+		assert.ErrorIs(t, fedAPI.AwaitFullRoomState(ctx, room.ID), context.DeadlineExceeded)
+		assert.True(t, fedAPI.QueryRoomHasPartialState(context.Background(), room.ID))
+		assert.Empty(t, rsAPI.resynced)
+
+		// Shutting down stops the retries.
+		processCtx.ShutdownDendrite()
+	})
+}
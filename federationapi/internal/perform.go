@@ -191,7 +191,13 @@ func (r *FederationInternalAPI) performJoinUsingServer(
 			return r.rsAPI.StoreUserRoomPublicKey(ctx, senderID, *storeUserID, roomID)
 		},
 	}
-	response, joinErr := gomatrixserverlib.PerformJoin(ctx, r, joinInput)
+	var joinClient gomatrixserverlib.FederatedJoinClient = r
+	var partialStateClient *partialStateJoinClient
+	if r.cfg.PartialStateJoins {
+		partialStateClient = &partialStateJoinClient{FederationInternalAPI: r}
+		joinClient = partialStateClient
+	}
+	response, joinErr := gomatrixserverlib.PerformJoin(ctx, joinClient, joinInput)
 
 	if joinErr != nil {
 		if !joinErr.Reachable {
@@ -217,6 +223,16 @@ func (r *FederationInternalAPI) performJoinUsingServer(
 		return fmt.Errorf("JoinedHostsFromEvents: failed to get joined hosts: %s", err)
 	}
 
+	// If the remote server omitted members from the state then remember that, so
+	// that we keep sending events to all servers in the room until we've resynced
+	// the full state.
+	partialState := partialStateClient.partialStateRoom(roomID, userID, response.JoinEvent.EventID(), serverName)
+	if partialState != nil {
+		if err = r.db.AddPartialStateRoom(context.Background(), partialState); err != nil {
+			return fmt.Errorf("AddPartialStateRoom: failed to store partial state room: %w", err)
+		}
+	}
+
 	logrus.WithField("room", roomID).Infof("Joined federated room with %d hosts", len(joinedHosts))
 	if _, err = r.db.UpdateRoom(context.Background(), roomID, joinedHosts, nil, true); err != nil {
 		return fmt.Errorf("UpdatedRoom: failed to update room with joined hosts: %s", err)
@@ -236,6 +252,9 @@ func (r *FederationInternalAPI) performJoinUsingServer(
 	); err != nil {
 		return fmt.Errorf("roomserverAPI.SendEventWithState: %w", err)
 	}
+	if partialState != nil {
+		r.startPartialStateResync(partialState, 0)
+	}
 	return nil
 }
 
@@ -71,10 +71,10 @@ func TestPerformWakeupServers(t *testing.T) {
 		testDB, process.NewProcessContext(),
 		false,
 		cfg.Matrix.ServerName, fedClient, &stats,
-		nil,
+		nil, queue.TransactionLimits{},
 	)
 	fedAPI := NewFederationInternalAPI(
-		testDB, &cfg, nil, fedClient, &stats, nil, queues, nil,
+		process.NewProcessContext(), testDB, &cfg, nil, fedClient, &stats, nil, queues, nil,
 	)
 
 	req := api.PerformWakeupServersRequest{
@@ -117,10 +117,10 @@ func TestQueryRelayServers(t *testing.T) {
 		testDB, process.NewProcessContext(),
 		false,
 		cfg.Matrix.ServerName, fedClient, &stats,
-		nil,
+		nil, queue.TransactionLimits{},
 	)
 	fedAPI := NewFederationInternalAPI(
-		testDB, &cfg, nil, fedClient, &stats, nil, queues, nil,
+		process.NewProcessContext(), testDB, &cfg, nil, fedClient, &stats, nil, queues, nil,
 	)
 
 	req := api.P2PQueryRelayServersRequest{
@@ -158,10 +158,10 @@ func TestRemoveRelayServers(t *testing.T) {
 		testDB, process.NewProcessContext(),
 		false,
 		cfg.Matrix.ServerName, fedClient, &stats,
-		nil,
+		nil, queue.TransactionLimits{},
 	)
 	fedAPI := NewFederationInternalAPI(
-		testDB, &cfg, nil, fedClient, &stats, nil, queues, nil,
+		process.NewProcessContext(), testDB, &cfg, nil, fedClient, &stats, nil, queues, nil,
 	)
 
 	req := api.P2PRemoveRelayServersRequest{
@@ -198,10 +198,10 @@ func TestPerformDirectoryLookup(t *testing.T) {
 		testDB, process.NewProcessContext(),
 		false,
 		cfg.Matrix.ServerName, fedClient, &stats,
-		nil,
+		nil, queue.TransactionLimits{},
 	)
 	fedAPI := NewFederationInternalAPI(
-		testDB, &cfg, nil, fedClient, &stats, nil, queues, nil,
+		process.NewProcessContext(), testDB, &cfg, nil, fedClient, &stats, nil, queues, nil,
 	)
 
 	req := api.PerformDirectoryLookupRequest{
@@ -237,10 +237,10 @@ func TestPerformDirectoryLookupRelaying(t *testing.T) {
 		testDB, process.NewProcessContext(),
 		false,
 		cfg.Matrix.ServerName, fedClient, &stats,
-		nil,
+		nil, queue.TransactionLimits{},
 	)
 	fedAPI := NewFederationInternalAPI(
-		testDB, &cfg, nil, fedClient, &stats, nil, queues, nil,
+		process.NewProcessContext(), testDB, &cfg, nil, fedClient, &stats, nil, queues, nil,
 	)
 
 	req := api.PerformDirectoryLookupRequest{
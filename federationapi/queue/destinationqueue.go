@@ -32,12 +32,13 @@ import (
 	"github.com/matrix-org/dendrite/federationapi/storage"
 	"github.com/matrix-org/dendrite/federationapi/storage/shared/receipt"
 	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/setup/process"
 )
 
 const (
-	maxPDUsPerTransaction = 50
-	maxEDUsPerTransaction = 100
+	maxPDUsPerTransaction = config.MaxPDUsPerTransaction
+	maxEDUsPerTransaction = config.MaxEDUsPerTransaction
 	maxPDUsInMemory       = 128
 	maxEDUsInMemory       = 128
 	queueIdleTimeout      = time.Second * 30
@@ -52,6 +53,7 @@ type destinationQueue struct {
 	db                 storage.Database
 	process            *process.ProcessContext
 	signing            map[spec.ServerName]*fclient.SigningIdentity
+	limits             TransactionLimits               // limits the size of transactions
 	client             fclient.FederationClient        // federation client
 	origin             spec.ServerName                 // origin of requests
 	destination        spec.ServerName                 // destination of requests
@@ -351,27 +353,18 @@ func (oq *destinationQueue) backgroundSend() {
 
 		// Work out which PDUs/EDUs to include in the next transaction.
 		oq.pendingMutex.RLock()
-		pduCount := len(oq.pendingPDUs)
-		eduCount := len(oq.pendingEDUs)
-		if pduCount > maxPDUsPerTransaction {
-			pduCount = maxPDUsPerTransaction
-		}
-		if eduCount > maxEDUsPerTransaction {
-			eduCount = maxEDUsPerTransaction
-		}
-		toSendPDUs := oq.pendingPDUs[:pduCount]
-		toSendEDUs := oq.pendingEDUs[:eduCount]
+		toSendPDUs, toSendEDUs, supersededEDUs := shapeTransaction(oq.pendingPDUs, oq.pendingEDUs, oq.limits)
 		oq.pendingMutex.RUnlock()
 
 		// If we didn't get anything from the database and there are no
 		// pending EDUs then there's nothing to do - stop here.
-		if pduCount == 0 && eduCount == 0 {
+		if len(toSendPDUs) == 0 && len(toSendEDUs) == 0 && len(supersededEDUs) == 0 {
 			continue
 		}
 
 		// If we have pending PDUs or EDUs then construct a transaction.
 		// Try sending the next transaction and see what happens.
-		terr, sendMethod := oq.nextTransaction(toSendPDUs, toSendEDUs)
+		terr, sendMethod := oq.nextTransaction(toSendPDUs, toSendEDUs, supersededEDUs)
 		if terr != nil {
 			// We failed to send the transaction. Mark it as a failure.
 			_, blacklisted := oq.statistics.Failure()
@@ -388,21 +381,26 @@ func (oq *destinationQueue) backgroundSend() {
 				return
 			}
 		} else {
-			oq.handleTransactionSuccess(pduCount, eduCount, sendMethod)
+			oq.handleTransactionSuccess(toSendPDUs, append(toSendEDUs, supersededEDUs...), sendMethod)
 		}
 	}
 }
 
 // nextTransaction creates a new transaction from the pending event
-// queue and sends it.
+// queue and sends it. The superseded EDUs aren't sent, but are cleaned
+// from the database if the transaction succeeds.
 // Returns an error if the transaction wasn't sent. And whether the success
 // was to a relay server or not.
 func (oq *destinationQueue) nextTransaction(
 	pdus []*queuedPDU,
 	edus []*queuedEDU,
+	supersededEDUs []*queuedEDU,
 ) (err error, sendMethod statistics.SendMethod) {
 	// Create the transaction.
 	t, pduReceipts, eduReceipts := oq.createTransaction(pdus, edus)
+	for _, edu := range supersededEDUs {
+		eduReceipts = append(eduReceipts, edu.dbReceipt)
+	}
 	logrus.WithField("server_name", oq.destination).Debugf("Sending transaction %q containing %d PDUs, %d EDUs", t.TransactionID, len(t.PDUs), len(t.EDUs))
 
 	// Try to send the transaction to the destination server.
@@ -576,7 +574,7 @@ func (oq *destinationQueue) blacklistDestination() {
 
 // handleTransactionSuccess updates the cached event queues as well as the success and
 // backoff information for this server.
-func (oq *destinationQueue) handleTransactionSuccess(pduCount int, eduCount int, sendMethod statistics.SendMethod) {
+func (oq *destinationQueue) handleTransactionSuccess(sentPDUs []*queuedPDU, sentEDUs []*queuedEDU, sendMethod statistics.SendMethod) {
 	// If we successfully sent the transaction then clear out
 	// the pending events and EDUs, and wipe our transaction ID.
 
@@ -584,14 +582,8 @@ func (oq *destinationQueue) handleTransactionSuccess(pduCount int, eduCount int,
 	oq.pendingMutex.Lock()
 	defer oq.pendingMutex.Unlock()
 
-	for i := range oq.pendingPDUs[:pduCount] {
-		oq.pendingPDUs[i] = nil
-	}
-	for i := range oq.pendingEDUs[:eduCount] {
-		oq.pendingEDUs[i] = nil
-	}
-	oq.pendingPDUs = oq.pendingPDUs[pduCount:]
-	oq.pendingEDUs = oq.pendingEDUs[eduCount:]
+	oq.pendingPDUs = removeSent(oq.pendingPDUs, sentPDUs)
+	oq.pendingEDUs = removeSent(oq.pendingEDUs, sentEDUs)
 
 	if len(oq.pendingPDUs) > 0 || len(oq.pendingEDUs) > 0 {
 		select {
@@ -600,3 +592,25 @@ func (oq *destinationQueue) handleTransactionSuccess(pduCount int, eduCount int,
 		}
 	}
 }
+
+// removeSent removes the sent PDUs or EDUs from the pending ones, keeping the
+// order of the rest.
+func removeSent[T any](pending []*T, sent []*T) []*T {
+	if len(sent) == 0 {
+		return pending
+	}
+	isSent := make(map[*T]struct{}, len(sent))
+	for _, s := range sent {
+		isSent[s] = struct{}{}
+	}
+	remaining := pending[:0]
+	for _, p := range pending {
+		if _, ok := isSent[p]; !ok {
+			remaining = append(remaining, p)
+		}
+	}
+	for i := len(remaining); i < len(pending); i++ {
+		pending[i] = nil
+	}
+	return remaining
+}
@@ -45,6 +45,7 @@ type OutgoingQueues struct {
 	client      fclient.FederationClient
 	statistics  *statistics.Statistics
 	signing     map[spec.ServerName]*fclient.SigningIdentity
+	limits      TransactionLimits
 	queuesMutex sync.Mutex // protects the below
 	queues      map[spec.ServerName]*destinationQueue
 }
@@ -89,6 +90,7 @@ func NewOutgoingQueues(
 	client fclient.FederationClient,
 	statistics *statistics.Statistics,
 	signing []*fclient.SigningIdentity,
+	limits TransactionLimits,
 ) *OutgoingQueues {
 	queues := &OutgoingQueues{
 		disabled:   disabled,
@@ -98,6 +100,7 @@ func NewOutgoingQueues(
 		client:     client,
 		statistics: statistics,
 		signing:    map[spec.ServerName]*fclient.SigningIdentity{},
+		limits:     limits,
 		queues:     map[spec.ServerName]*destinationQueue{},
 	}
 	for _, identity := range signing {
@@ -163,6 +166,7 @@ func (oqs *OutgoingQueues) getQueue(destination spec.ServerName) *destinationQue
 			statistics:  oqs.statistics.ForServer(destination),
 			notify:      make(chan struct{}, 1),
 			signing:     oqs.signing,
+			limits:      oqs.limits,
 		}
 		oq.statistics.AssignBackoffNotifier(oq.handleBackoffNotifier)
 		oqs.queues[destination] = oq
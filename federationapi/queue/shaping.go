@@ -0,0 +1,150 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/dendrite/federationapi/storage/shared/receipt"
+)
+
+// TransactionLimits limits the size of the transactions sent to remote servers.
+type TransactionLimits struct {
+	// The maximum number of PDUs in a transaction, or 0 for the maximum allowed by the spec.
+	MaxPDUs int
+	// The maximum number of EDUs in a transaction, or 0 for the maximum allowed by the spec.
+	MaxEDUs int
+}
+
+func (l TransactionLimits) maxPDUs() int {
+	if l.MaxPDUs <= 0 || l.MaxPDUs > maxPDUsPerTransaction {
+		return maxPDUsPerTransaction
+	}
+	return l.MaxPDUs
+}
+
+func (l TransactionLimits) maxEDUs() int {
+	if l.MaxEDUs <= 0 || l.MaxEDUs > maxEDUsPerTransaction {
+		return maxEDUsPerTransaction
+	}
+	return l.MaxEDUs
+}
+
+// shapeTransaction chooses which of the pending PDUs and EDUs go into the next
+// transaction, so that catching up with a server after an outage doesn't send
+// it bursts of stale data:
+//   - If there are more PDUs than fit, the newest ones are sent first. The
+//     remote server can fetch the events it missed in between, and the older
+//     events are sent in later transactions.
+//   - Typing and presence EDUs that have been superseded by a newer one for the
+//     same user are not sent at all, but are returned so that they are cleaned
+//     up along with the transaction.
+//   - Other EDUs, such as send-to-device messages, are sent oldest first, as
+//     their order matters.
+//
+// PDUs and EDUs are sent in the order they were queued in.
+func shapeTransaction(
+	pdus []*queuedPDU, edus []*queuedEDU, limits TransactionLimits,
+) (sendPDUs []*queuedPDU, sendEDUs []*queuedEDU, superseded []*queuedEDU) {
+	sendPDUs = make([]*queuedPDU, 0, len(pdus))
+	for _, pdu := range pdus {
+		if pdu != nil {
+			sendPDUs = append(sendPDUs, pdu)
+		}
+	}
+	sort.SliceStable(sendPDUs, func(i, j int) bool {
+		return receiptNID(sendPDUs[i].dbReceipt) < receiptNID(sendPDUs[j].dbReceipt)
+	})
+	if maxPDUs := limits.maxPDUs(); len(sendPDUs) > maxPDUs {
+		sendPDUs = sendPDUs[len(sendPDUs)-maxPDUs:]
+	}
+
+	ordered := make([]*queuedEDU, 0, len(edus))
+	for _, edu := range edus {
+		if edu != nil {
+			ordered = append(ordered, edu)
+		}
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return receiptNID(ordered[i].dbReceipt) < receiptNID(ordered[j].dbReceipt)
+	})
+	// Walk the EDUs from the newest, so that the newest update for each user wins.
+	latest := make(map[string]struct{}, len(ordered))
+	keep := make([]bool, len(ordered))
+	for i := len(ordered) - 1; i >= 0; i-- {
+		key, ok := collapseKey(ordered[i])
+		if !ok {
+			keep[i] = true
+			continue
+		}
+		if _, seen := latest[key]; seen {
+			superseded = append(superseded, ordered[i])
+			continue
+		}
+		latest[key] = struct{}{}
+		keep[i] = true
+	}
+	maxEDUs := limits.maxEDUs()
+	sendEDUs = make([]*queuedEDU, 0, maxEDUs)
+	for i, edu := range ordered {
+		if keep[i] && len(sendEDUs) < maxEDUs {
+			sendEDUs = append(sendEDUs, edu)
+		}
+	}
+	return sendPDUs, sendEDUs, superseded
+}
+
+// receiptNID returns the NID of a receipt, which orders the PDUs and EDUs by
+// when they were queued, or 0 if there is no receipt.
+func receiptNID(r *receipt.Receipt) int64 {
+	if r == nil {
+		return 0
+	}
+	return r.GetNID()
+}
+
+// collapseKey returns the key under which newer EDUs supersede older ones, or
+// false if the EDU must always be sent. Only typing notifications and presence
+// updates for a single user are collapsed.
+func collapseKey(edu *queuedEDU) (string, bool) {
+	if edu.edu == nil {
+		return "", false
+	}
+	switch edu.edu.Type {
+	case spec.MTyping:
+		var content struct {
+			RoomID string `json:"room_id"`
+			UserID string `json:"user_id"`
+		}
+		if err := json.Unmarshal(edu.edu.Content, &content); err != nil || content.RoomID == "" || content.UserID == "" {
+			return "", false
+		}
+		return spec.MTyping + "\x00" + content.RoomID + "\x00" + content.UserID, true
+	case spec.MPresence:
+		var content struct {
+			Push []struct {
+				UserID string `json:"user_id"`
+			} `json:"push"`
+		}
+		if err := json.Unmarshal(edu.edu.Content, &content); err != nil || len(content.Push) != 1 || content.Push[0].UserID == "" {
+			return "", false
+		}
+		return spec.MPresence + "\x00" + content.Push[0].UserID, true
+	}
+	return "", false
+}
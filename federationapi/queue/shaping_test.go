@@ -0,0 +1,64 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/matrix-org/dendrite/federationapi/storage/shared/receipt"
+)
+
+func queuedEDUWithNID(nid int64, eduType, content string) *queuedEDU {
+	r := receipt.NewReceipt(nid)
+	return &queuedEDU{dbReceipt: &r, edu: &gomatrixserverlib.EDU{Type: eduType, Content: []byte(content)}}
+}
+
+func TestShapeTransaction(t *testing.T) {
+	// The newest PDUs are sent first, in the order they were queued in.
+	var pdus []*queuedPDU
+	for nid := int64(5); nid > 0; nid-- {
+		r := receipt.NewReceipt(nid)
+		pdus = append(pdus, &queuedPDU{dbReceipt: &r, pdu: mustCreatePDU(t)})
+	}
+	sendPDUs, _, _ := shapeTransaction(pdus, nil, TransactionLimits{MaxPDUs: 2})
+	assert.Len(t, sendPDUs, 2)
+	assert.EqualValues(t, 4, sendPDUs[0].dbReceipt.GetNID())
+	assert.EqualValues(t, 5, sendPDUs[1].dbReceipt.GetNID())
+
+	// Superseded typing and presence updates aren't sent, other EDUs are sent oldest first.
+	edus := []*queuedEDU{
+		queuedEDUWithNID(6, spec.MTyping, `{"room_id":"!a:test","user_id":"@alice:test","typing":false}`),
+		queuedEDUWithNID(1, spec.MTyping, `{"room_id":"!a:test","user_id":"@alice:test","typing":true}`),
+		queuedEDUWithNID(2, spec.MTyping, `{"room_id":"!a:test","user_id":"@bob:test","typing":true}`),
+		queuedEDUWithNID(3, spec.MPresence, `{"push":[{"user_id":"@alice:test","presence":"online"}]}`),
+		queuedEDUWithNID(5, spec.MPresence, `{"push":[{"user_id":"@alice:test","presence":"offline"}]}`),
+		queuedEDUWithNID(4, spec.MDirectToDevice, `{}`),
+		queuedEDUWithNID(7, spec.MDirectToDevice, `{}`),
+	}
+	_, sendEDUs, superseded := shapeTransaction(nil, edus, TransactionLimits{MaxEDUs: 4})
+	var sent, dropped []int64
+	for _, edu := range sendEDUs {
+		sent = append(sent, edu.dbReceipt.GetNID())
+	}
+	for _, edu := range superseded {
+		dropped = append(dropped, edu.dbReceipt.GetNID())
+	}
+	assert.Equal(t, []int64{2, 4, 5, 6}, sent)
+	assert.ElementsMatch(t, []int64{1, 3}, dropped)
+}
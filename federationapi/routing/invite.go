@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/matrix-org/dendrite/internal/spamcheck"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -39,6 +40,7 @@ func InviteV3(
 	cfg *config.FederationAPI,
 	rsAPI api.FederationRoomserverAPI,
 	keys gomatrixserverlib.JSONVerifier,
+	spamCheckers *spamcheck.SpamCheckers,
 ) util.JSONResponse {
 	inviteReq := fclient.InviteV3Request{}
 	err := json.Unmarshal(request.Content(), &inviteReq)
@@ -87,7 +89,7 @@ func InviteV3(
 			return spec.SenderIDFromPseudoIDKey(key), key, nil
 		},
 	}
-	event, jsonErr := handleInviteV3(httpReq.Context(), input, rsAPI)
+	event, jsonErr := handleInviteV3(httpReq.Context(), input, rsAPI, spamCheckers)
 	if jsonErr != nil {
 		return *jsonErr
 	}
@@ -106,6 +108,7 @@ func InviteV2(
 	cfg *config.FederationAPI,
 	rsAPI api.FederationRoomserverAPI,
 	keys gomatrixserverlib.JSONVerifier,
+	spamCheckers *spamcheck.SpamCheckers,
 ) util.JSONResponse {
 	inviteReq := fclient.InviteV2Request{}
 	err := json.Unmarshal(request.Content(), &inviteReq)
@@ -167,7 +170,7 @@ func InviteV2(
 				return rsAPI.QueryUserIDForSender(httpReq.Context(), roomID, senderID)
 			},
 		}
-		event, jsonErr := handleInvite(httpReq.Context(), input, rsAPI)
+		event, jsonErr := handleInvite(httpReq.Context(), input, rsAPI, spamCheckers)
 		if jsonErr != nil {
 			return *jsonErr
 		}
@@ -192,6 +195,7 @@ func InviteV1(
 	cfg *config.FederationAPI,
 	rsAPI api.FederationRoomserverAPI,
 	keys gomatrixserverlib.JSONVerifier,
+	spamCheckers *spamcheck.SpamCheckers,
 ) util.JSONResponse {
 	roomVer := gomatrixserverlib.RoomVersionV1
 	body := request.Content()
@@ -260,7 +264,7 @@ func InviteV1(
 			return rsAPI.QueryUserIDForSender(httpReq.Context(), roomID, senderID)
 		},
 	}
-	event, jsonErr := handleInvite(httpReq.Context(), input, rsAPI)
+	event, jsonErr := handleInvite(httpReq.Context(), input, rsAPI, spamCheckers)
 	if jsonErr != nil {
 		return *jsonErr
 	}
@@ -270,17 +274,26 @@ func InviteV1(
 	}
 }
 
-func handleInvite(ctx context.Context, input gomatrixserverlib.HandleInviteInput, rsAPI api.FederationRoomserverAPI) (gomatrixserverlib.PDU, *util.JSONResponse) {
+func handleInvite(
+	ctx context.Context, input gomatrixserverlib.HandleInviteInput,
+	rsAPI api.FederationRoomserverAPI, spamCheckers *spamcheck.SpamCheckers,
+) (gomatrixserverlib.PDU, *util.JSONResponse) {
 	inviteEvent, err := gomatrixserverlib.HandleInvite(ctx, input)
-	return handleInviteResult(ctx, inviteEvent, err, rsAPI)
+	return handleInviteResult(ctx, input.InvitedUser, inviteEvent, err, rsAPI, spamCheckers)
 }
 
-func handleInviteV3(ctx context.Context, input gomatrixserverlib.HandleInviteV3Input, rsAPI api.FederationRoomserverAPI) (gomatrixserverlib.PDU, *util.JSONResponse) {
+func handleInviteV3(
+	ctx context.Context, input gomatrixserverlib.HandleInviteV3Input,
+	rsAPI api.FederationRoomserverAPI, spamCheckers *spamcheck.SpamCheckers,
+) (gomatrixserverlib.PDU, *util.JSONResponse) {
 	inviteEvent, err := gomatrixserverlib.HandleInviteV3(ctx, input)
-	return handleInviteResult(ctx, inviteEvent, err, rsAPI)
+	return handleInviteResult(ctx, input.InvitedUser, inviteEvent, err, rsAPI, spamCheckers)
 }
 
-func handleInviteResult(ctx context.Context, inviteEvent gomatrixserverlib.PDU, err error, rsAPI api.FederationRoomserverAPI) (gomatrixserverlib.PDU, *util.JSONResponse) {
+func handleInviteResult(
+	ctx context.Context, invitedUser spec.UserID, inviteEvent gomatrixserverlib.PDU, err error,
+	rsAPI api.FederationRoomserverAPI, spamCheckers *spamcheck.SpamCheckers,
+) (gomatrixserverlib.PDU, *util.JSONResponse) {
 	switch e := err.(type) {
 	case nil:
 	case spec.InternalServerError:
@@ -313,6 +326,17 @@ func handleInviteResult(ctx context.Context, inviteEvent gomatrixserverlib.PDU,
 		}
 	}
 
+	if spamCheckers != nil {
+		inviter := string(inviteEvent.SenderID())
+		if userID, queryErr := rsAPI.QueryUserIDForSender(ctx, inviteEvent.RoomID(), inviteEvent.SenderID()); queryErr == nil && userID != nil {
+			inviter = userID.String()
+		}
+		if err = spamCheckers.UserMayInvite(ctx, inviter, invitedUser.String(), inviteEvent.RoomID().String()); err != nil {
+			res := spamcheck.ErrorResponse(ctx, err)
+			return nil, &res
+		}
+	}
+
 	headeredInvite := &types.HeaderedEvent{PDU: inviteEvent}
 	if err = rsAPI.HandleInvite(ctx, headeredInvite); err != nil {
 		util.GetLogger(ctx).WithError(err).Error("HandleInvite failed")
@@ -0,0 +1,87 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/spamcheck"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/stretchr/testify/assert"
+)
+
+type inviteRoomserverAPI struct {
+	api.FederationRoomserverAPI
+	invites []*types.HeaderedEvent
+}
+
+func (r *inviteRoomserverAPI) QueryUserIDForSender(ctx context.Context, roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+	return spec.NewUserID(string(senderID), true)
+}
+
+func (r *inviteRoomserverAPI) HandleInvite(ctx context.Context, event *types.HeaderedEvent) error {
+	r.invites = append(r.invites, event)
+	return nil
+}
+
+// noInvitesSpamChecker rejects all invites from one user.
+type noInvitesSpamChecker struct {
+	spamcheck.AllowAll
+	inviter string
+}
+
+func (c noInvitesSpamChecker) UserMayInvite(ctx context.Context, inviter, invitee, roomID string) error {
+	if inviter == c.inviter {
+		return &spamcheck.Rejection{Reason: "no invites"}
+	}
+	return nil
+}
+
+func TestHandleInviteSpamChecker(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	invite := room.CreateEvent(t, alice, spec.MRoomMember, map[string]interface{}{
+		"membership": spec.Invite,
+	}, test.WithStateKey(bob.ID))
+	invitedUser, err := spec.NewUserID(bob.ID, true)
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	t.Run("invite rejected by spam checker", func(t *testing.T) {
+		rsAPI := &inviteRoomserverAPI{}
+		spamCheckers := spamcheck.NewSpamCheckers(noInvitesSpamChecker{inviter: alice.ID})
+		event, res := handleInviteResult(ctx, *invitedUser, invite.PDU, nil, rsAPI, spamCheckers)
+		assert.Nil(t, event)
+		if assert.NotNil(t, res) {
+			assert.Equal(t, http.StatusForbidden, res.Code)
+		}
+		assert.Empty(t, rsAPI.invites)
+	})
+
+	t.Run("invite allowed by spam checker", func(t *testing.T) {
+		rsAPI := &inviteRoomserverAPI{}
+		spamCheckers := spamcheck.NewSpamCheckers(noInvitesSpamChecker{inviter: bob.ID})
+		event, res := handleInviteResult(ctx, *invitedUser, invite.PDU, nil, rsAPI, spamCheckers)
+		assert.Nil(t, res)
+		assert.Equal(t, invite.EventID(), event.EventID())
+		assert.Len(t, rsAPI.invites, 1)
+	})
+}
@@ -323,10 +323,7 @@ func SendJoin(
 		if rsResponse.ErrMsg != "" {
 			util.GetLogger(httpReq.Context()).WithField(logrus.ErrorKey, rsResponse.ErrMsg).Error("SendEvents failed")
 			if rsResponse.NotAllowed {
-				return util.JSONResponse{
-					Code: http.StatusBadRequest,
-					JSON: spec.Forbidden(rsResponse.ErrMsg),
-				}
+				return notAllowedResponse(&rsResponse)
 			}
 			return util.JSONResponse{
 				Code: http.StatusInternalServerError,
@@ -364,3 +361,21 @@ func (e eventsByDepth) Swap(i, j int) {
 func (e eventsByDepth) Less(i, j int) bool {
 	return e[i].Depth() < e[j].Depth()
 }
+
+// notAllowedJSON is returned when the roomserver didn't allow an event sent
+// over federation. It includes why the event failed auth, if it did, so that
+// the remote server can work out why we disagree about the event.
+type notAllowedJSON struct {
+	spec.MatrixError
+	AuthError *types.EventAuthError `json:"org.matrix.dendrite.auth_error,omitempty"`
+}
+
+func notAllowedResponse(rsResponse *api.InputRoomEventsResponse) util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusBadRequest,
+		JSON: notAllowedJSON{
+			MatrixError: spec.Forbidden(rsResponse.ErrMsg),
+			AuthError:   rsResponse.AuthError,
+		},
+	}
+}
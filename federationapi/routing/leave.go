@@ -364,10 +364,7 @@ func SendLeave(
 	if response.ErrMsg != "" {
 		util.GetLogger(httpReq.Context()).WithField(logrus.ErrorKey, response.ErrMsg).WithField("not_allowed", response.NotAllowed).Error("producer.SendEvents failed")
 		if response.NotAllowed {
-			return util.JSONResponse{
-				Code: http.StatusBadRequest,
-				JSON: spec.Forbidden(response.ErrMsg),
-			}
+			return notAllowedResponse(&response)
 		}
 		return util.JSONResponse{
 			Code: http.StatusInternalServerError,
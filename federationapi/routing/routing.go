@@ -26,7 +26,9 @@ import (
 	fedInternal "github.com/matrix-org/dendrite/federationapi/internal"
 	"github.com/matrix-org/dendrite/federationapi/producers"
 	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/internal/spamcheck"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -62,7 +64,10 @@ func Setup(
 	federation fclient.FederationClient,
 	userAPI userapi.FederationUserAPI,
 	mscCfg *config.MSCs,
-	producer *producers.SyncAPIProducer, enableMetrics bool,
+	producer *producers.SyncAPIProducer,
+	caches caching.FederationTransactionCache,
+	spamCheckers *spamcheck.SpamCheckers,
+	enableMetrics bool,
 ) {
 	fedMux := routers.Federation
 	keyMux := routers.Keys
@@ -139,7 +144,7 @@ func Setup(
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			return Send(
 				httpReq, request, gomatrixserverlib.TransactionID(vars["txnID"]),
-				cfg, rsAPI, userAPI, keys, federation, mu, producer,
+				cfg, rsAPI, userAPI, keys, federation, mu, producer, caches, spamCheckers,
 			)
 		},
 	)).Methods(http.MethodPut, http.MethodOptions).Name(SendRouteName)
@@ -163,7 +168,7 @@ func Setup(
 			}
 			return InviteV1(
 				httpReq, request, *roomID, vars["eventID"],
-				cfg, rsAPI, keys,
+				cfg, rsAPI, keys, spamCheckers,
 			)
 		},
 	)).Methods(http.MethodPut, http.MethodOptions)
@@ -187,7 +192,7 @@ func Setup(
 			}
 			return InviteV2(
 				httpReq, request, *roomID, vars["eventID"],
-				cfg, rsAPI, keys,
+				cfg, rsAPI, keys, spamCheckers,
 			)
 		},
 	)).Methods(http.MethodPut, http.MethodOptions)
@@ -218,7 +223,7 @@ func Setup(
 			}
 			return InviteV3(
 				httpReq, request, *roomID, *userID,
-				cfg, rsAPI, keys,
+				cfg, rsAPI, keys, spamCheckers,
 			)
 		},
 	)).Methods(http.MethodPut, http.MethodOptions)
@@ -27,6 +27,8 @@ import (
 
 	"github.com/matrix-org/dendrite/federationapi/producers"
 	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/internal/spamcheck"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
 	userAPI "github.com/matrix-org/dendrite/userapi/api"
@@ -64,7 +66,22 @@ func Send(
 	federation fclient.FederationClient,
 	mu *internal.MutexByRoom,
 	producer *producers.SyncAPIProducer,
+	caches caching.FederationTransactionCache,
+	spamCheckers *spamcheck.SpamCheckers,
 ) util.JSONResponse {
+	// If we already processed this transaction then the origin is retrying,
+	// most likely because it timed out waiting for our response. Return the
+	// results from last time rather than processing the PDUs again.
+	if caches != nil {
+		if res, ok := caches.GetFederationTransaction(request.Origin(), request.Destination(), txnID); ok {
+			util.GetLogger(httpReq.Context()).Debugf("Returning cached result of transaction %q from %q", txnID, request.Origin())
+			return util.JSONResponse{
+				Code: http.StatusOK,
+				JSON: res,
+			}
+		}
+	}
+
 	// First we should check if this origin has already submitted this
 	// txn ID to us. If they have and the txnIDs map contains an entry,
 	// the transaction is still being worked on. The new client can wait
@@ -129,6 +146,7 @@ func Send(
 		request.Origin(),
 		txnID,
 		cfg.Matrix.ServerName)
+	t.SpamCheckers = spamCheckers
 
 	util.GetLogger(httpReq.Context()).Debugf("Received transaction %q from %q containing %d PDUs, %d EDUs", txnID, request.Origin(), len(t.PDUs), len(t.EDUs))
 
@@ -142,6 +160,9 @@ func Send(
 	// Status code 200:
 	// The result of processing the transaction. The server is to use this response
 	// even in the event of one or more PDUs failing to be processed.
+	if caches != nil {
+		caches.StoreFederationTransaction(request.Origin(), request.Destination(), txnID, *resp)
+	}
 	res := util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: resp,
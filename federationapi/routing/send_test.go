@@ -62,7 +62,7 @@ func TestHandleSend(t *testing.T) {
 		serverKeyAPI := &signing.YggdrasilKeys{}
 		keyRing := serverKeyAPI.KeyRing()
 
-		routing.Setup(routers, cfg, nil, fedapi, keyRing, nil, nil, &cfg.MSCs, nil, caching.DisableMetrics)
+		routing.Setup(routers, cfg, nil, fedapi, keyRing, nil, nil, &cfg.MSCs, nil, nil, nil, caching.DisableMetrics)
 
 		handler := fedMux.Get(routing.SendRouteName).GetHandler().ServeHTTP
 		_, sk, _ := ed25519.GenerateKey(nil)
@@ -89,3 +89,77 @@ func TestHandleSend(t *testing.T) {
 		assert.Equal(t, 200, res.StatusCode)
 	})
 }
+
+type fakeTransactionCache map[string]fclient.RespSend
+
+func (c fakeTransactionCache) GetFederationTransaction(origin, destination spec.ServerName, txnID gomatrixserverlib.TransactionID) (fclient.RespSend, bool) {
+	r, ok := c[string(origin)+"/"+string(destination)+"/"+string(txnID)]
+	return r, ok
+}
+
+func (c fakeTransactionCache) StoreFederationTransaction(origin, destination spec.ServerName, txnID gomatrixserverlib.TransactionID, r fclient.RespSend) {
+	c[string(origin)+"/"+string(destination)+"/"+string(txnID)] = r
+}
+
+func TestHandleSendCachedResult(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		routers := httputil.NewRouters()
+		defer close()
+
+		fedMux := mux.NewRouter().SkipClean(true).PathPrefix(httputil.PublicFederationPathPrefix).Subrouter().UseEncodedPath()
+		natsInstance := jetstream.NATSInstance{}
+		routers.Federation = fedMux
+		cfg.FederationAPI.Matrix.SigningIdentity.ServerName = testOrigin
+		cfg.FederationAPI.Matrix.Metrics.Enabled = false
+		fedapi := fedAPI.NewInternalAPI(processCtx, cfg, cm, &natsInstance, nil, nil, nil, nil, true)
+		serverKeyAPI := &signing.YggdrasilKeys{}
+		keyRing := serverKeyAPI.KeyRing()
+
+		caches := fakeTransactionCache{}
+		routing.Setup(routers, cfg, nil, fedapi, keyRing, nil, nil, &cfg.MSCs, nil, caches, nil, caching.DisableMetrics)
+
+		handler := fedMux.Get(routing.SendRouteName).GetHandler().ServeHTTP
+		_, sk, _ := ed25519.GenerateKey(nil)
+		pk := sk.Public().(ed25519.PublicKey)
+		serverName := spec.ServerName(hex.EncodeToString(pk))
+
+		send := func(txnID string) fclient.RespSend {
+			req := fclient.NewFederationRequest("PUT", serverName, testOrigin, "/send/"+txnID)
+			if err := req.SetContent(sendContent{}); err != nil {
+				t.Fatalf("Error: %s", err.Error())
+			}
+			req.Sign(serverName, gomatrixserverlib.KeyID(signing.KeyID), sk)
+			httpReq, err := req.HTTPRequest()
+			if err != nil {
+				t.Fatalf("Error: %s", err.Error())
+			}
+			httpReq = mux.SetURLVars(httpReq, map[string]string{"txnID": txnID})
+			w := httptest.NewRecorder()
+			handler(w, httpReq)
+			assert.Equal(t, 200, w.Code)
+			var res fclient.RespSend
+			if err = json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatalf("Error: %s", err.Error())
+			}
+			return res
+		}
+
+		// Processed transactions are stored in the cache.
+		send("1234")
+		_, ok := caches.GetFederationTransaction(serverName, testOrigin, "1234")
+		assert.True(t, ok)
+
+		// Retried transactions are answered from the cache.
+		cached := fclient.RespSend{PDUs: map[string]fclient.PDUResult{
+			"$event": {Error: "cached"},
+		}}
+		caches.StoreFederationTransaction(serverName, testOrigin, "5678", cached)
+		assert.Equal(t, cached, send("5678"))
+
+		// The same transaction ID sent to another destination isn't.
+		caches.StoreFederationTransaction(serverName, "other.server", "9012", cached)
+		assert.NotEqual(t, cached, send("9012"))
+	})
+}
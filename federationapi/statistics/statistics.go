@@ -34,6 +34,10 @@ type Statistics struct {
 	// mark the destination as offline. At this point we should attempt
 	// to send messages to the user's async relay servers if we know them.
 	FailuresUntilAssumedOffline uint32
+
+	// Should the backoff state of destinations be stored in the database
+	// so that it survives restarts?
+	PersistBackoff bool
 }
 
 func NewStatistics(
@@ -80,6 +84,10 @@ func (s *Statistics) ForServer(serverName spec.ServerName) *ServerStatistics {
 			server.assumedOffline.Store(assumedOffline)
 		}
 
+		if s.PersistBackoff && !server.blacklisted.Load() {
+			server.restoreBackoff()
+		}
+
 		knownRelayServers, err := s.DB.P2PGetRelayServersForServer(context.Background(), serverName)
 		if err != nil {
 			logrus.WithError(err).Errorf("Failed to get relay server list for %q", serverName)
@@ -92,6 +100,17 @@ func (s *Statistics) ForServer(serverName spec.ServerName) *ServerStatistics {
 	return server
 }
 
+// ServerNames returns the names of all servers that we have statistics for.
+func (s *Statistics) ServerNames() []spec.ServerName {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	serverNames := make([]spec.ServerName, 0, len(s.servers))
+	for serverName := range s.servers {
+		serverNames = append(serverNames, serverName)
+	}
+	return serverNames
+}
+
 type SendMethod uint8
 
 const (
@@ -154,7 +173,7 @@ func (s *ServerStatistics) AssignBackoffNotifier(notifier func()) {
 // or one of their relay servers.
 func (s *ServerStatistics) Success(method SendMethod) {
 	s.cancel()
-	s.backoffCount.Store(0)
+	s.resetBackoffCount()
 	// NOTE : Sending to the final destination vs. a relay server has
 	// slightly different semantics.
 	if method == SendDirect {
@@ -203,6 +222,9 @@ func (s *ServerStatistics) Failure() (time.Time, bool) {
 				}
 			}
 			s.ClearBackoff()
+			// The blacklist is persisted separately, so there is no point
+			// in keeping the backoff around.
+			s.removePersistedBackoff()
 			return time.Time{}, true
 		}
 
@@ -211,6 +233,7 @@ func (s *ServerStatistics) Failure() (time.Time, bool) {
 		count := s.backoffCount.Load()
 		until := time.Now().Add(s.duration(count))
 		s.backoffUntil.Store(until)
+		s.persistBackoff(count, until)
 
 		s.statistics.backoffMutex.Lock()
 		s.statistics.backoffTimers[s.serverName] = time.AfterFunc(time.Until(until), s.backoffFinished)
@@ -264,6 +287,11 @@ func (s *ServerStatistics) BackoffInfo() *time.Time {
 	return nil
 }
 
+// FailureCount returns the number of consecutive failures of the server.
+func (s *ServerStatistics) FailureCount() uint32 {
+	return s.backoffCount.Load()
+}
+
 // Blacklisted returns true if the server is blacklisted and false
 // otherwise.
 func (s *ServerStatistics) Blacklisted() bool {
@@ -286,11 +314,63 @@ func (s *ServerStatistics) removeBlacklist() bool {
 		_ = s.statistics.DB.RemoveServerFromBlacklist(s.serverName)
 	}
 	s.cancel()
-	s.backoffCount.Store(0)
+	s.resetBackoffCount()
 
 	return wasBlacklisted
 }
 
+// restoreBackoff loads the persisted backoff of the server, resuming the
+// backoff if it hasn't ended yet.
+func (s *ServerStatistics) restoreBackoff() {
+	backoff, err := s.statistics.DB.GetServerBackoff(context.Background(), s.serverName)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to get backoff entry %q", s.serverName)
+		return
+	}
+	if backoff == nil {
+		return
+	}
+	s.backoffCount.Store(backoff.FailureCount)
+	until := backoff.BackoffUntil.Time()
+	if !time.Now().Before(until) {
+		return
+	}
+	if s.backoffStarted.CompareAndSwap(false, true) {
+		s.backoffUntil.Store(until)
+		s.statistics.backoffMutex.Lock()
+		s.statistics.backoffTimers[s.serverName] = time.AfterFunc(time.Until(until), s.backoffFinished)
+		s.statistics.backoffMutex.Unlock()
+	}
+}
+
+// persistBackoff stores the backoff of the server, if enabled.
+func (s *ServerStatistics) persistBackoff(count uint32, until time.Time) {
+	if !s.statistics.PersistBackoff || s.statistics.DB == nil {
+		return
+	}
+	if err := s.statistics.DB.SetServerBackoff(context.Background(), s.serverName, count, spec.AsTimestamp(until)); err != nil {
+		logrus.WithError(err).Errorf("Failed to store backoff of %q", s.serverName)
+	}
+}
+
+// removePersistedBackoff removes the stored backoff of the server, if enabled.
+func (s *ServerStatistics) removePersistedBackoff() {
+	if !s.statistics.PersistBackoff || s.statistics.DB == nil {
+		return
+	}
+	if err := s.statistics.DB.RemoveServerBackoff(context.Background(), s.serverName); err != nil {
+		logrus.WithError(err).Errorf("Failed to remove backoff of %q", s.serverName)
+	}
+}
+
+// resetBackoffCount resets the failure counter, removing the stored backoff
+// if there was one. This avoids hitting the database after every success.
+func (s *ServerStatistics) resetBackoffCount() {
+	if s.backoffCount.Swap(0) > 0 {
+		s.removePersistedBackoff()
+	}
+}
+
 // removeAssumedOffline removes the assumed offline status from the server.
 func (s *ServerStatistics) removeAssumedOffline() {
 	if s.AssumedOffline() {
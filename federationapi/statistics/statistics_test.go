@@ -1,6 +1,7 @@
 package statistics
 
 import (
+	"context"
 	"math"
 	"testing"
 	"time"
@@ -115,3 +116,40 @@ func TestRelayServersListing(t *testing.T) {
 	relayServers = server.KnownRelayServers()
 	assert.Equal(t, []spec.ServerName{"relay1", "relay2"}, relayServers)
 }
+
+func TestBackoffPersisted(t *testing.T) {
+	db := test.NewInMemoryFederationDatabase()
+	stats := NewStatistics(db, FailuresUntilBlacklist, FailuresUntilAssumedOffline)
+	stats.PersistBackoff = true
+
+	// Failing to reach a server stores its backoff.
+	until, blacklisted := stats.ForServer("test.com").Failure()
+	assert.False(t, blacklisted)
+	backoff, err := db.GetServerBackoff(context.Background(), "test.com")
+	assert.Nil(t, err)
+	assert.NotNil(t, backoff)
+	assert.Equal(t, uint32(1), backoff.FailureCount)
+	assert.Equal(t, spec.AsTimestamp(until), backoff.BackoffUntil)
+
+	// The backoff is resumed after a restart.
+	restarted := NewStatistics(db, FailuresUntilBlacklist, FailuresUntilAssumedOffline)
+	restarted.PersistBackoff = true
+	server := restarted.ForServer("test.com")
+	assert.Equal(t, uint32(1), server.FailureCount())
+	assert.Equal(t, spec.AsTimestamp(until), spec.AsTimestamp(*server.BackoffInfo()))
+	assert.True(t, server.backoffStarted.Load())
+
+	// Succeeding removes the stored backoff.
+	server.Success(SendDirect)
+	backoff, err = db.GetServerBackoff(context.Background(), "test.com")
+	assert.Nil(t, err)
+	assert.Nil(t, backoff)
+	assert.Equal(t, uint32(0), server.FailureCount())
+
+	// Nothing is stored unless enabled.
+	notPersisted := NewStatistics(db, FailuresUntilBlacklist, FailuresUntilAssumedOffline)
+	notPersisted.ForServer("other.com").Failure()
+	backoff, err = db.GetServerBackoff(context.Background(), "other.com")
+	assert.Nil(t, err)
+	assert.Nil(t, backoff)
+}
@@ -56,6 +56,16 @@ type Database interface {
 	RemoveServerFromBlacklist(serverName spec.ServerName) error
 	RemoveAllServersFromBlacklist() error
 	IsServerBlacklisted(serverName spec.ServerName) (bool, error)
+	GetBlacklistedServers(ctx context.Context) ([]spec.ServerName, error)
+
+	// Persists how many times in a row we failed to reach the server and when
+	// the current backoff ends, so that backoffs survive restarts.
+	SetServerBackoff(ctx context.Context, serverName spec.ServerName, failureCount uint32, backoffUntil spec.Timestamp) error
+	RemoveServerBackoff(ctx context.Context, serverName spec.ServerName) error
+	RemoveAllServerBackoffs(ctx context.Context) error
+	// Gets the persisted backoff of the server, or nil if there is none.
+	GetServerBackoff(ctx context.Context, serverName spec.ServerName) (*types.ServerBackoff, error)
+	GetServerBackoffs(ctx context.Context) ([]types.ServerBackoff, error)
 
 	// Adds the server to the list of assumed offline servers.
 	// If the server already exists in the table, nothing happens and returns success.
@@ -69,6 +79,15 @@ type Database interface {
 	// If it is present, returns true. If not, returns false.
 	IsServerAssumedOffline(ctx context.Context, serverName spec.ServerName) (bool, error)
 
+	// Records that we joined the room using a partial state send_join response.
+	AddPartialStateRoom(ctx context.Context, room *types.PartialStateRoom) error
+	// Removes the partial state marker for the room once the full state is known.
+	RemovePartialStateRoom(ctx context.Context, roomID string) error
+	// Gets the partial state information for the room, or nil if we have the full state.
+	GetPartialStateRoom(ctx context.Context, roomID string) (*types.PartialStateRoom, error)
+	// Gets all rooms that still need their full state resynced.
+	GetPartialStateRooms(ctx context.Context) ([]types.PartialStateRoom, error)
+
 	AddOutboundPeek(ctx context.Context, serverName spec.ServerName, roomID, peekID string, renewalInterval int64) error
 	RenewOutboundPeek(ctx context.Context, serverName spec.ServerName, roomID, peekID string, renewalInterval int64) error
 	GetOutboundPeek(ctx context.Context, serverName spec.ServerName, roomID, peekID string) (*types.OutboundPeek, error)
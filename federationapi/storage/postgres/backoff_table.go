@@ -0,0 +1,135 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/federationapi/types"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+const backoffSchema = `
+CREATE TABLE IF NOT EXISTS federationsender_backoff (
+    -- The server name we failed to reach
+	server_name TEXT NOT NULL PRIMARY KEY,
+    -- How many times in a row we failed to reach the server
+	failure_count BIGINT NOT NULL,
+    -- When the current backoff ends, as a unix timestamp (ms resolution)
+	backoff_until BIGINT NOT NULL
+);
+`
+
+const upsertBackoffSQL = "" +
+	"INSERT INTO federationsender_backoff (server_name, failure_count, backoff_until) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (server_name) DO UPDATE SET failure_count = $2, backoff_until = $3"
+
+const selectBackoffSQL = "" +
+	"SELECT server_name, failure_count, backoff_until FROM federationsender_backoff WHERE server_name = $1"
+
+const selectAllBackoffsSQL = "" +
+	"SELECT server_name, failure_count, backoff_until FROM federationsender_backoff ORDER BY server_name"
+
+const deleteBackoffSQL = "" +
+	"DELETE FROM federationsender_backoff WHERE server_name = $1"
+
+const deleteAllBackoffsSQL = "" +
+	"TRUNCATE federationsender_backoff"
+
+type backoffStatements struct {
+	upsertBackoffStmt     *sql.Stmt
+	selectBackoffStmt     *sql.Stmt
+	selectAllBackoffsStmt *sql.Stmt
+	deleteBackoffStmt     *sql.Stmt
+	deleteAllBackoffsStmt *sql.Stmt
+}
+
+func NewPostgresBackoffTable(db *sql.DB) (s *backoffStatements, err error) {
+	s = &backoffStatements{}
+	_, err = db.Exec(backoffSchema)
+	if err != nil {
+		return
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.upsertBackoffStmt, upsertBackoffSQL},
+		{&s.selectBackoffStmt, selectBackoffSQL},
+		{&s.selectAllBackoffsStmt, selectAllBackoffsSQL},
+		{&s.deleteBackoffStmt, deleteBackoffSQL},
+		{&s.deleteAllBackoffsStmt, deleteAllBackoffsSQL},
+	}.Prepare(db)
+}
+
+func (s *backoffStatements) UpsertBackoff(
+	ctx context.Context, txn *sql.Tx, serverName spec.ServerName, failureCount uint32, backoffUntil spec.Timestamp,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.upsertBackoffStmt)
+	_, err := stmt.ExecContext(ctx, serverName, int64(failureCount), int64(backoffUntil))
+	return err
+}
+
+func (s *backoffStatements) SelectBackoff(
+	ctx context.Context, txn *sql.Tx, serverName spec.ServerName,
+) (*types.ServerBackoff, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectBackoffStmt)
+	var backoff types.ServerBackoff
+	err := stmt.QueryRowContext(ctx, serverName).Scan(&backoff.ServerName, &backoff.FailureCount, &backoff.BackoffUntil)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &backoff, nil
+}
+
+func (s *backoffStatements) SelectAllBackoffs(
+	ctx context.Context, txn *sql.Tx,
+) ([]types.ServerBackoff, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectAllBackoffsStmt)
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectAllBackoffs: rows.close() failed")
+	var backoffs []types.ServerBackoff
+	for rows.Next() {
+		var backoff types.ServerBackoff
+		if err = rows.Scan(&backoff.ServerName, &backoff.FailureCount, &backoff.BackoffUntil); err != nil {
+			return nil, err
+		}
+		backoffs = append(backoffs, backoff)
+	}
+	return backoffs, rows.Err()
+}
+
+func (s *backoffStatements) DeleteBackoff(
+	ctx context.Context, txn *sql.Tx, serverName spec.ServerName,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteBackoffStmt)
+	_, err := stmt.ExecContext(ctx, serverName)
+	return err
+}
+
+func (s *backoffStatements) DeleteAllBackoffs(
+	ctx context.Context, txn *sql.Tx,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteAllBackoffsStmt)
+	_, err := stmt.ExecContext(ctx)
+	return err
+}
@@ -0,0 +1,147 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/federationapi/types"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+const partialStateRoomsSchema = `
+CREATE TABLE IF NOT EXISTS federationsender_partial_state_rooms (
+	-- The room ID that we only have partial state for
+	room_id TEXT PRIMARY KEY NOT NULL,
+	-- The local user whose join resulted in the partial state
+	user_id TEXT NOT NULL,
+	-- The event ID of the join event
+	join_event_id TEXT NOT NULL,
+	-- The server that we joined the room through
+	joined_via TEXT NOT NULL,
+	-- A JSON array of the servers in the room as reported by the send_join response
+	servers_in_room TEXT NOT NULL
+);
+`
+
+const insertPartialStateRoomSQL = "" +
+	"INSERT INTO federationsender_partial_state_rooms (room_id, user_id, join_event_id, joined_via, servers_in_room)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT (room_id) DO UPDATE SET user_id = $2, join_event_id = $3, joined_via = $4, servers_in_room = $5"
+
+const selectPartialStateRoomSQL = "" +
+	"SELECT room_id, user_id, join_event_id, joined_via, servers_in_room FROM federationsender_partial_state_rooms WHERE room_id = $1"
+
+const selectPartialStateRoomsSQL = "" +
+	"SELECT room_id, user_id, join_event_id, joined_via, servers_in_room FROM federationsender_partial_state_rooms"
+
+const deletePartialStateRoomSQL = "" +
+	"DELETE FROM federationsender_partial_state_rooms WHERE room_id = $1"
+
+type partialStateRoomsStatements struct {
+	db                          *sql.DB
+	insertPartialStateRoomStmt  *sql.Stmt
+	selectPartialStateRoomStmt  *sql.Stmt
+	selectPartialStateRoomsStmt *sql.Stmt
+	deletePartialStateRoomStmt  *sql.Stmt
+}
+
+func NewPostgresPartialStateRoomsTable(db *sql.DB) (s *partialStateRoomsStatements, err error) {
+	s = &partialStateRoomsStatements{
+		db: db,
+	}
+	_, err = db.Exec(partialStateRoomsSchema)
+	if err != nil {
+		return
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.insertPartialStateRoomStmt, insertPartialStateRoomSQL},
+		{&s.selectPartialStateRoomStmt, selectPartialStateRoomSQL},
+		{&s.selectPartialStateRoomsStmt, selectPartialStateRoomsSQL},
+		{&s.deletePartialStateRoomStmt, deletePartialStateRoomSQL},
+	}.Prepare(db)
+}
+
+func (s *partialStateRoomsStatements) InsertPartialStateRoom(
+	ctx context.Context, txn *sql.Tx, room *types.PartialStateRoom,
+) error {
+	servers, err := json.Marshal(room.ServersInRoom)
+	if err != nil {
+		return err
+	}
+	stmt := sqlutil.TxStmt(txn, s.insertPartialStateRoomStmt)
+	_, err = stmt.ExecContext(ctx, room.RoomID, room.UserID, room.JoinEventID, room.JoinedVia, string(servers))
+	return err
+}
+
+func (s *partialStateRoomsStatements) SelectPartialStateRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) (*types.PartialStateRoom, error) {
+	var room types.PartialStateRoom
+	var servers string
+	stmt := sqlutil.TxStmt(txn, s.selectPartialStateRoomStmt)
+	err := stmt.QueryRowContext(ctx, roomID).Scan(
+		&room.RoomID, &room.UserID, &room.JoinEventID, &room.JoinedVia, &servers,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal([]byte(servers), &room.ServersInRoom); err != nil {
+		return nil, err
+	}
+	return &room, nil
+}
+
+func (s *partialStateRoomsStatements) SelectPartialStateRooms(
+	ctx context.Context, txn *sql.Tx,
+) ([]types.PartialStateRoom, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectPartialStateRoomsStmt)
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectPartialStateRooms: rows.close() failed")
+
+	var rooms []types.PartialStateRoom
+	for rows.Next() {
+		var room types.PartialStateRoom
+		var servers string
+		if err = rows.Scan(
+			&room.RoomID, &room.UserID, &room.JoinEventID, &room.JoinedVia, &servers,
+		); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(servers), &room.ServersInRoom); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
+
+func (s *partialStateRoomsStatements) DeletePartialStateRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deletePartialStateRoomStmt)
+	_, err := stmt.ExecContext(ctx, roomID)
+	return err
+}
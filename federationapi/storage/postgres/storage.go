@@ -46,6 +46,10 @@ func NewDatabase(ctx context.Context, conMan *sqlutil.Connections, dbProperties
 	if err != nil {
 		return nil, err
 	}
+	backoff, err := NewPostgresBackoffTable(d.db)
+	if err != nil {
+		return nil, err
+	}
 	joinedHosts, err := NewPostgresJoinedHostsTable(d.db)
 	if err != nil {
 		return nil, err
@@ -66,6 +70,10 @@ func NewDatabase(ctx context.Context, conMan *sqlutil.Connections, dbProperties
 	if err != nil {
 		return nil, err
 	}
+	partialStateRooms, err := NewPostgresPartialStateRoomsTable(d.db)
+	if err != nil {
+		return nil, err
+	}
 	relayServers, err := NewPostgresRelayServersTable(d.db)
 	if err != nil {
 		return nil, err
@@ -112,7 +120,9 @@ func NewDatabase(ctx context.Context, conMan *sqlutil.Connections, dbProperties
 		FederationQueueEDUs:      queueEDUs,
 		FederationQueueJSON:      queueJSON,
 		FederationBlacklist:      blacklist,
+		FederationBackoff:        backoff,
 		FederationAssumedOffline: assumedOffline,
+		FederationPartialState:   partialStateRooms,
 		FederationRelayServers:   relayServers,
 		FederationInboundPeeks:   inboundPeeks,
 		FederationOutboundPeeks:  outboundPeeks,
@@ -39,7 +39,9 @@ type Database struct {
 	FederationQueueJSON      tables.FederationQueueJSON
 	FederationJoinedHosts    tables.FederationJoinedHosts
 	FederationBlacklist      tables.FederationBlacklist
+	FederationBackoff        tables.FederationBackoff
 	FederationAssumedOffline tables.FederationAssumedOffline
+	FederationPartialState   tables.FederationPartialStateRooms
 	FederationRelayServers   tables.FederationRelayServers
 	FederationOutboundPeeks  tables.FederationOutboundPeeks
 	FederationInboundPeeks   tables.FederationInboundPeeks
@@ -176,6 +178,53 @@ func (d *Database) IsServerBlacklisted(
 	return d.FederationBlacklist.SelectBlacklist(context.TODO(), nil, serverName)
 }
 
+func (d *Database) GetBlacklistedServers(
+	ctx context.Context,
+) ([]spec.ServerName, error) {
+	return d.FederationBlacklist.SelectAllBlacklist(ctx, nil)
+}
+
+func (d *Database) SetServerBackoff(
+	ctx context.Context,
+	serverName spec.ServerName,
+	failureCount uint32,
+	backoffUntil spec.Timestamp,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.FederationBackoff.UpsertBackoff(ctx, txn, serverName, failureCount, backoffUntil)
+	})
+}
+
+func (d *Database) RemoveServerBackoff(
+	ctx context.Context,
+	serverName spec.ServerName,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.FederationBackoff.DeleteBackoff(ctx, txn, serverName)
+	})
+}
+
+func (d *Database) RemoveAllServerBackoffs(
+	ctx context.Context,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.FederationBackoff.DeleteAllBackoffs(ctx, txn)
+	})
+}
+
+func (d *Database) GetServerBackoff(
+	ctx context.Context,
+	serverName spec.ServerName,
+) (*types.ServerBackoff, error) {
+	return d.FederationBackoff.SelectBackoff(ctx, nil, serverName)
+}
+
+func (d *Database) GetServerBackoffs(
+	ctx context.Context,
+) ([]types.ServerBackoff, error) {
+	return d.FederationBackoff.SelectAllBackoffs(ctx, nil)
+}
+
 func (d *Database) SetServerAssumedOffline(
 	ctx context.Context,
 	serverName spec.ServerName,
@@ -209,6 +258,37 @@ func (d *Database) IsServerAssumedOffline(
 	return d.FederationAssumedOffline.SelectAssumedOffline(ctx, nil, serverName)
 }
 
+func (d *Database) AddPartialStateRoom(
+	ctx context.Context,
+	room *types.PartialStateRoom,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.FederationPartialState.InsertPartialStateRoom(ctx, txn, room)
+	})
+}
+
+func (d *Database) RemovePartialStateRoom(
+	ctx context.Context,
+	roomID string,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.FederationPartialState.DeletePartialStateRoom(ctx, txn, roomID)
+	})
+}
+
+func (d *Database) GetPartialStateRoom(
+	ctx context.Context,
+	roomID string,
+) (*types.PartialStateRoom, error) {
+	return d.FederationPartialState.SelectPartialStateRoom(ctx, nil, roomID)
+}
+
+func (d *Database) GetPartialStateRooms(
+	ctx context.Context,
+) ([]types.PartialStateRoom, error) {
+	return d.FederationPartialState.SelectPartialStateRooms(ctx, nil)
+}
+
 func (d *Database) P2PAddRelayServersForServer(
 	ctx context.Context,
 	serverName spec.ServerName,
@@ -386,6 +466,9 @@ func (d *Database) PurgeRoom(ctx context.Context, roomID string) error {
 		if err := d.FederationOutboundPeeks.DeleteOutboundPeeks(ctx, txn, roomID); err != nil {
 			return fmt.Errorf("failed to purge outbound peeks: %w", err)
 		}
+		if err := d.FederationPartialState.DeletePartialStateRoom(ctx, txn, roomID); err != nil {
+			return fmt.Errorf("failed to purge partial state: %w", err)
+		}
 		return nil
 	})
 }
@@ -37,6 +37,9 @@ const insertBlacklistSQL = "" +
 const selectBlacklistSQL = "" +
 	"SELECT server_name FROM federationsender_blacklist WHERE server_name = $1"
 
+const selectAllBlacklistSQL = "" +
+	"SELECT server_name FROM federationsender_blacklist ORDER BY server_name"
+
 const deleteBlacklistSQL = "" +
 	"DELETE FROM federationsender_blacklist WHERE server_name = $1"
 
@@ -47,6 +50,7 @@ type blacklistStatements struct {
 	db                     *sql.DB
 	insertBlacklistStmt    *sql.Stmt
 	selectBlacklistStmt    *sql.Stmt
+	selectAllBlacklistStmt *sql.Stmt
 	deleteBlacklistStmt    *sql.Stmt
 	deleteAllBlacklistStmt *sql.Stmt
 }
@@ -63,6 +67,7 @@ func NewSQLiteBlacklistTable(db *sql.DB) (s *blacklistStatements, err error) {
 	return s, sqlutil.StatementList{
 		{&s.insertBlacklistStmt, insertBlacklistSQL},
 		{&s.selectBlacklistStmt, selectBlacklistSQL},
+		{&s.selectAllBlacklistStmt, selectAllBlacklistSQL},
 		{&s.deleteBlacklistStmt, deleteBlacklistSQL},
 		{&s.deleteAllBlacklistStmt, deleteAllBlacklistSQL},
 	}.Prepare(db)
@@ -91,6 +96,26 @@ func (s *blacklistStatements) SelectBlacklist(
 	return res.Next(), nil
 }
 
+func (s *blacklistStatements) SelectAllBlacklist(
+	ctx context.Context, txn *sql.Tx,
+) ([]spec.ServerName, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectAllBlacklistStmt)
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint:errcheck
+	var serverNames []spec.ServerName
+	for rows.Next() {
+		var serverName spec.ServerName
+		if err = rows.Scan(&serverName); err != nil {
+			return nil, err
+		}
+		serverNames = append(serverNames, serverName)
+	}
+	return serverNames, rows.Err()
+}
+
 func (s *blacklistStatements) DeleteBlacklist(
 	ctx context.Context, txn *sql.Tx, serverName spec.ServerName,
 ) error {
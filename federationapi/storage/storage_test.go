@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/matrix-org/dendrite/federationapi/storage"
+	"github.com/matrix-org/dendrite/federationapi/types"
 	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -305,6 +306,56 @@ func TestServersAssumedOffline(t *testing.T) {
 	})
 }
 
+func TestServerBackoffs(t *testing.T) {
+	server1 := spec.ServerName("server1")
+	server2 := spec.ServerName("server2")
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, closeDB := mustCreateFederationDatabase(t, dbType)
+		defer closeDB()
+		ctx := context.Background()
+
+		// Unknown servers have no backoff.
+		backoff, err := db.GetServerBackoff(ctx, server1)
+		assert.Nil(t, err)
+		assert.Nil(t, backoff)
+
+		until := spec.AsTimestamp(time.Now().Add(time.Minute))
+		assert.Nil(t, db.SetServerBackoff(ctx, server1, 1, until))
+		assert.Nil(t, db.SetServerBackoff(ctx, server2, 3, until))
+		// Updating the backoff replaces the previous one.
+		assert.Nil(t, db.SetServerBackoff(ctx, server1, 2, until+1))
+
+		backoff, err = db.GetServerBackoff(ctx, server1)
+		assert.Nil(t, err)
+		assert.Equal(t, &types.ServerBackoff{ServerName: server1, FailureCount: 2, BackoffUntil: until + 1}, backoff)
+
+		backoffs, err := db.GetServerBackoffs(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, []types.ServerBackoff{
+			{ServerName: server1, FailureCount: 2, BackoffUntil: until + 1},
+			{ServerName: server2, FailureCount: 3, BackoffUntil: until},
+		}, backoffs)
+
+		assert.Nil(t, db.RemoveServerBackoff(ctx, server1))
+		backoff, err = db.GetServerBackoff(ctx, server1)
+		assert.Nil(t, err)
+		assert.Nil(t, backoff)
+
+		assert.Nil(t, db.RemoveAllServerBackoffs(ctx))
+		backoffs, err = db.GetServerBackoffs(ctx)
+		assert.Nil(t, err)
+		assert.Empty(t, backoffs)
+
+		// Blacklisted servers are listed in order.
+		assert.Nil(t, db.AddServerToBlacklist(server2))
+		assert.Nil(t, db.AddServerToBlacklist(server1))
+		blacklisted, err := db.GetBlacklistedServers(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, []spec.ServerName{server1, server2}, blacklisted)
+	})
+}
+
 func TestRelayServersStored(t *testing.T) {
 	server := spec.ServerName("server")
 	relayServer1 := spec.ServerName("relayserver1")
@@ -76,10 +76,19 @@ type FederationJoinedHosts interface {
 type FederationBlacklist interface {
 	InsertBlacklist(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) error
 	SelectBlacklist(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) (bool, error)
+	SelectAllBlacklist(ctx context.Context, txn *sql.Tx) ([]spec.ServerName, error)
 	DeleteBlacklist(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) error
 	DeleteAllBlacklist(ctx context.Context, txn *sql.Tx) error
 }
 
+type FederationBackoff interface {
+	UpsertBackoff(ctx context.Context, txn *sql.Tx, serverName spec.ServerName, failureCount uint32, backoffUntil spec.Timestamp) error
+	SelectBackoff(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) (*types.ServerBackoff, error)
+	SelectAllBackoffs(ctx context.Context, txn *sql.Tx) ([]types.ServerBackoff, error)
+	DeleteBackoff(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) error
+	DeleteAllBackoffs(ctx context.Context, txn *sql.Tx) error
+}
+
 type FederationAssumedOffline interface {
 	InsertAssumedOffline(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) error
 	SelectAssumedOffline(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) (bool, error)
@@ -87,6 +96,13 @@ type FederationAssumedOffline interface {
 	DeleteAllAssumedOffline(ctx context.Context, txn *sql.Tx) error
 }
 
+type FederationPartialStateRooms interface {
+	InsertPartialStateRoom(ctx context.Context, txn *sql.Tx, room *types.PartialStateRoom) error
+	SelectPartialStateRoom(ctx context.Context, txn *sql.Tx, roomID string) (*types.PartialStateRoom, error)
+	SelectPartialStateRooms(ctx context.Context, txn *sql.Tx) ([]types.PartialStateRoom, error)
+	DeletePartialStateRoom(ctx context.Context, txn *sql.Tx, roomID string) error
+}
+
 type FederationRelayServers interface {
 	InsertRelayServers(ctx context.Context, txn *sql.Tx, serverName spec.ServerName, relayServers []spec.ServerName) error
 	SelectRelayServers(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) ([]spec.ServerName, error)
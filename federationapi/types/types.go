@@ -52,6 +52,23 @@ type InboundPeek struct {
 	RenewalInterval   int64
 }
 
+// tracks rooms that we joined using a partial state send_join response
+// and for which we are still resyncing the full room state
+type PartialStateRoom struct {
+	RoomID        string
+	UserID        string
+	JoinEventID   string
+	JoinedVia     spec.ServerName
+	ServersInRoom []spec.ServerName
+}
+
+// the persisted backoff state of a destination we failed to reach
+type ServerBackoff struct {
+	ServerName   spec.ServerName
+	FailureCount uint32
+	BackoffUntil spec.Timestamp
+}
+
 type FederationReceiptMRead struct {
 	User map[string]FederationReceiptData `json:"m.read"`
 }
@@ -0,0 +1,43 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package caching
+
+import (
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+// FederationTransactionCache caches the results of inbound federation
+// transactions, so that retries of a transaction we already processed
+// can be answered without processing the PDUs again. Transaction IDs are
+// only unique for an origin and destination, and with virtual hosting the
+// same origin can send transactions to more than one destination.
+type FederationTransactionCache interface {
+	GetFederationTransaction(origin, destination spec.ServerName, txnID gomatrixserverlib.TransactionID) (r fclient.RespSend, ok bool)
+	StoreFederationTransaction(origin, destination spec.ServerName, txnID gomatrixserverlib.TransactionID, r fclient.RespSend)
+}
+
+func (c Caches) GetFederationTransaction(origin, destination spec.ServerName, txnID gomatrixserverlib.TransactionID) (fclient.RespSend, bool) {
+	return c.FederationTransactions.Get(federationTransactionKey(origin, destination, txnID))
+}
+
+func (c Caches) StoreFederationTransaction(origin, destination spec.ServerName, txnID gomatrixserverlib.TransactionID, r fclient.RespSend) {
+	c.FederationTransactions.Set(federationTransactionKey(origin, destination, txnID), r)
+}
+
+func federationTransactionKey(origin, destination spec.ServerName, txnID gomatrixserverlib.TransactionID) string {
+	return string(origin) + "\000" + string(destination) + "\000" + string(txnID)
+}
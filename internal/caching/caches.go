@@ -37,6 +37,7 @@ type Caches struct {
 	FederationEDUs          Cache[int64, *gomatrixserverlib.EDU]                   // queue NID -> EDU
 	RoomHierarchies         Cache[string, fclient.RoomHierarchyResponse]           // room ID -> space response
 	LazyLoading             Cache[lazyLoadingCacheKey, string]                     // composite key -> event ID
+	FederationTransactions  Cache[string, fclient.RespSend]                        // origin + destination + txn ID -> transaction result
 }
 
 // Cache is the interface that an implementation must satisfy.
@@ -45,6 +45,7 @@ const (
 	eventTypeCache
 	eventTypeNIDCache
 	eventStateKeyNIDCache
+	federationTransactionsCache
 )
 
 const (
@@ -159,6 +160,12 @@ func NewRistrettoCache(maxCost config.DataUnit, maxAge time.Duration, enableProm
 			Mutable: true,
 			MaxAge:  maxAge,
 		},
+		FederationTransactions: &RistrettoCachePartition[string, fclient.RespSend]{ // origin + destination + txn ID -> transaction result
+			cache:   cache,
+			Prefix:  federationTransactionsCache,
+			Mutable: true,
+			MaxAge:  lesserOf(time.Hour, maxAge),
+		},
 	}
 }
 
@@ -0,0 +1,171 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/util"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := map[string]bool{
+		"":                  false,
+		"gzip":              true,
+		"deflate, gzip;q=1": true,
+		"GZIP":              true,
+		"br, *":             true,
+		"gzip;q=0":          false,
+		"gzip; q=0.0":       false,
+		"identity":          false,
+		"*;q=0":             false,
+		"*;q=0, gzip":       true,
+		"*, gzip;q=0":       false,
+		"gzip;x=y;q=0":      false,
+	}
+	for header, want := range tests {
+		if got := acceptsGzip(header); got != want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
+
+func TestCompressResponse(t *testing.T) {
+	large := strings.Repeat("a", minCompressSize)
+	handler := MakeExternalAPI("test", func(req *http.Request) util.JSONResponse {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]string{"data": req.URL.Query().Get("data")},
+		}
+	})
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		data           string
+		wantGzip       bool
+	}{
+		{name: "large response is compressed", acceptEncoding: "gzip", data: large, wantGzip: true},
+		{name: "small response is not compressed", acceptEncoding: "gzip", data: "a"},
+		{name: "not compressed without accept-encoding", data: large},
+		{name: "not compressed if gzip is refused", acceptEncoding: "gzip;q=0", data: large},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/?data="+tt.data, nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got status %d", rec.Code)
+			}
+			if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("expected Vary: Accept-Encoding, got %q", got)
+			}
+
+			var body io.Reader = rec.Body
+			gotGzip := rec.Header().Get("Content-Encoding") == "gzip"
+			if gotGzip != tt.wantGzip {
+				t.Fatalf("got gzip %v, want %v", gotGzip, tt.wantGzip)
+			}
+			if gotGzip {
+				gz, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = gz
+			}
+			data, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := `{"data":"` + tt.data + `"}`; string(data) != want {
+				t.Errorf("got body %q, want %q", data, want)
+			}
+		})
+	}
+}
+
+func TestCompressResponseSkipsCompressedContent(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	w, finish := compressResponse(rec, req)
+	w.Header().Set("Content-Type", "image/png")
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write(make([]byte, 2*minCompressSize))
+	finish()
+
+	if rec.Code != http.StatusCreated {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusCreated)
+	}
+	if rec.Header().Get("Content-Encoding") != "" {
+		t.Errorf("expected images not to be compressed")
+	}
+	if rec.Body.Len() != 2*minCompressSize {
+		t.Errorf("got %d bytes, want %d", rec.Body.Len(), 2*minCompressSize)
+	}
+}
+
+func TestCompressResponseFlush(t *testing.T) {
+	t.Run("flushing before deciding sends the response uncompressed", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		w, finish := compressResponse(rec, req)
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: 1\n\n"))
+		w.(http.Flusher).Flush()
+		if !rec.Flushed || rec.Body.String() != "data: 1\n\n" {
+			t.Fatalf("expected the event to be flushed, got %q", rec.Body.String())
+		}
+		_, _ = w.Write([]byte(strings.Repeat("a", minCompressSize)))
+		finish()
+		if rec.Header().Get("Content-Encoding") != "" {
+			t.Errorf("expected the response not to be compressed")
+		}
+	})
+
+	t.Run("flushing a compressed response sends what was written", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		w, finish := compressResponse(rec, req)
+		w.Header().Set("Content-Type", "text/plain")
+		data := strings.Repeat("a", minCompressSize)
+		_, _ = w.Write([]byte(data))
+		w.(http.Flusher).Flush()
+		if !rec.Flushed || rec.Header().Get("Content-Encoding") != "gzip" {
+			t.Fatalf("expected the compressed response to be flushed")
+		}
+		gz, err := gzip.NewReader(bytes.NewReader(rec.Body.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(data))
+		if _, err = io.ReadFull(gz, got); err != nil || string(got) != data {
+			t.Fatalf("expected the flushed data to be readable, got %q: %v", got, err)
+		}
+		finish()
+	})
+}
@@ -0,0 +1,109 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+)
+
+// ConsentNotGivenError is returned when a user tries to write something
+// without having agreed to the current version of the privacy policy.
+type ConsentNotGivenError struct {
+	spec.MatrixError
+	ConsentURI string `json:"consent_uri"`
+}
+
+// QueryPolicyVersionAPI looks up which version of the privacy policy users
+// have agreed to.
+type QueryPolicyVersionAPI interface {
+	QueryPolicyVersion(ctx context.Context, req *userapi.QueryPolicyVersionRequest, res *userapi.QueryPolicyVersionResponse) error
+}
+
+// WithConsentRequired refuses requests from users who haven't agreed to the
+// current version of the privacy policy, if consent tracking is enabled.
+func WithConsentRequired(userAPI QueryPolicyVersionAPI, cfg *config.Global) AuthAPIOption {
+	return func(opts *AuthAPIOpts) {
+		opts.ConsentRequired = func(ctx context.Context, device *userapi.Device) *util.JSONResponse {
+			return CheckConsent(ctx, device, userAPI, cfg)
+		}
+	}
+}
+
+// CheckConsent returns an error response if consent tracking is enabled and
+// the user hasn't agreed to the current version of the privacy policy yet.
+// Appservice users, guests and the server notices user aren't required to agree.
+func CheckConsent(ctx context.Context, device *userapi.Device, userAPI QueryPolicyVersionAPI, cfg *config.Global) *util.JSONResponse {
+	consentCfg := &cfg.UserConsentOptions
+	if !consentCfg.Enabled || device.AppserviceID != "" || device.AccountType == userapi.AccountTypeGuest {
+		return nil
+	}
+	localpart, serverName, err := cfg.SplitLocalID('@', device.UserID)
+	if err != nil {
+		return nil
+	}
+	if localpart == cfg.ServerNotices.LocalPart {
+		return nil
+	}
+	res := &userapi.QueryPolicyVersionResponse{}
+	if err = userAPI.QueryPolicyVersion(ctx, &userapi.QueryPolicyVersionRequest{
+		Localpart:  localpart,
+		ServerName: serverName,
+	}, res); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.QueryPolicyVersion failed")
+		return &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if res.PolicyVersion == consentCfg.Version {
+		return nil
+	}
+
+	consentURL, err := consentCfg.ConsentURL(device.UserID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("unable to build consent URL")
+		return &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	msg := &strings.Builder{}
+	if err = consentCfg.TextTemplates.ExecuteTemplate(msg, "blockEventsError", map[string]string{
+		"ConsentURL": consentURL,
+	}); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("unable to execute block events error template")
+		return &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return &util.JSONResponse{
+		Code: http.StatusForbidden,
+		JSON: ConsentNotGivenError{
+			MatrixError: spec.MatrixError{
+				ErrCode: "M_CONSENT_NOT_GIVEN",
+				Err:     msg.String(),
+			},
+			ConsentURI: consentURL,
+		},
+	}
+}
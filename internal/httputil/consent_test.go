@@ -0,0 +1,85 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"text/template"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+type fakePolicyVersionAPI map[string]string
+
+func (f fakePolicyVersionAPI) QueryPolicyVersion(ctx context.Context, req *userapi.QueryPolicyVersionRequest, res *userapi.QueryPolicyVersionResponse) error {
+	res.PolicyVersion = f[req.Localpart]
+	return nil
+}
+
+func TestCheckConsent(t *testing.T) {
+	cfg := &config.Global{}
+	cfg.ServerName = "test"
+	cfg.ServerNotices.LocalPart = "notices"
+	cfg.UserConsentOptions = config.UserConsentOptions{
+		Enabled:    true,
+		BaseURL:    "https://test",
+		FormSecret: "secret",
+		Version:    "2.0",
+	}
+	cfg.UserConsentOptions.TextTemplates = template.Must(
+		template.New("blockEventsError").Parse("Agree to the policy at {{ .ConsentURL }}"),
+	)
+	userAPI := fakePolicyVersionAPI{"alice": "2.0", "bob": "1.0"}
+
+	tests := []struct {
+		name    string
+		device  *userapi.Device
+		refused bool
+	}{
+		{name: "agreed to the current version", device: &userapi.Device{UserID: "@alice:test"}},
+		{name: "agreed to an old version", device: &userapi.Device{UserID: "@bob:test"}, refused: true},
+		{name: "never agreed", device: &userapi.Device{UserID: "@charlie:test"}, refused: true},
+		{name: "guest", device: &userapi.Device{UserID: "@charlie:test", AccountType: userapi.AccountTypeGuest}},
+		{name: "appservice", device: &userapi.Device{UserID: "@charlie:test", AppserviceID: "bridge"}},
+		{name: "server notices user", device: &userapi.Device{UserID: "@notices:test"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resErr := CheckConsent(context.Background(), tt.device, userAPI, cfg)
+			if !tt.refused {
+				if resErr != nil {
+					t.Fatalf("expected the request to be allowed, got %+v", resErr)
+				}
+				return
+			}
+			if resErr == nil || resErr.Code != http.StatusForbidden {
+				t.Fatalf("expected the request to be refused, got %+v", resErr)
+			}
+			consentErr, ok := resErr.JSON.(ConsentNotGivenError)
+			if !ok || consentErr.ErrCode != "M_CONSENT_NOT_GIVEN" || consentErr.ConsentURI == "" {
+				t.Fatalf("unexpected error: %+v", resErr.JSON)
+			}
+		})
+	}
+
+	// Nothing is refused if consent isn't tracked.
+	cfg.UserConsentOptions.Enabled = false
+	if resErr := CheckConsent(context.Background(), &userapi.Device{UserID: "@bob:test"}, userAPI, cfg); resErr != nil {
+		t.Fatalf("expected the request to be allowed, got %+v", resErr)
+	}
+}
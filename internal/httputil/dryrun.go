@@ -0,0 +1,86 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"net/http"
+	"strconv"
+
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+)
+
+// DryRunParam is the query parameter asking a destructive admin endpoint to
+// only report what it would affect.
+const DryRunParam = "dry_run"
+
+type DryRunOpts struct {
+	Default bool
+}
+
+// DryRunOption is an option to MakeDestructiveAdminAPI.
+type DryRunOption func(opts *DryRunOpts)
+
+// WithDryRunDefault sets whether requests without the dry_run parameter are dry
+// runs, e.g. when the server is configured to only report what it would delete.
+func WithDryRunDefault(dryRun bool) DryRunOption {
+	return func(opts *DryRunOpts) {
+		opts.Default = dryRun
+	}
+}
+
+// MakeDestructiveAdminAPI is a wrapper around MakeAdminAPI for endpoints that
+// delete or irreversibly change data. It parses the dry_run query parameter and
+// passes it to f, which must not change anything in a dry run and should respond
+// with a summary of what would have been affected instead.
+func MakeDestructiveAdminAPI(
+	metricsName string, userAPI userapi.QueryAcccessTokenAPI,
+	f func(*http.Request, *userapi.Device, bool) util.JSONResponse,
+	options ...DryRunOption,
+) http.Handler {
+	opts := DryRunOpts{}
+	for _, opt := range options {
+		opt(&opts)
+	}
+	return MakeAdminAPI(metricsName, userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		dryRun, resErr := ParseDryRun(req, opts.Default)
+		if resErr != nil {
+			return *resErr
+		}
+		if dryRun {
+			logger := util.GetLogger(req.Context()).WithField("dry_run", true)
+			req = req.WithContext(util.ContextWithLogger(req.Context(), logger))
+		}
+		return f(req, device, dryRun)
+	})
+}
+
+// ParseDryRun returns whether the request asks for a dry run, or def if it
+// doesn't say.
+func ParseDryRun(req *http.Request, def bool) (bool, *util.JSONResponse) {
+	param := req.URL.Query().Get(DryRunParam)
+	if param == "" {
+		return def, nil
+	}
+	dryRun, err := strconv.ParseBool(param)
+	if err != nil {
+		return false, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam(DryRunParam + " must be true or false"),
+		}
+	}
+	return dryRun, nil
+}
@@ -0,0 +1,55 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseDryRun(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		def     bool
+		want    bool
+		wantErr bool
+	}{
+		{name: "missing", query: "", want: false},
+		{name: "missing with default", query: "", def: true, want: true},
+		{name: "true", query: "?dry_run=true", want: true},
+		{name: "false overrides default", query: "?dry_run=false", def: true, want: false},
+		{name: "invalid", query: "?dry_run=maybe", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/admin/purgeRoom/!a:test"+tt.query, nil)
+			got, resErr := ParseDryRun(req, tt.def)
+			if tt.wantErr {
+				if resErr == nil || resErr.Code != http.StatusBadRequest {
+					t.Fatalf("expected a bad request, got %+v", resErr)
+				}
+				return
+			}
+			if resErr != nil {
+				t.Fatalf("unexpected error response: %+v", resErr)
+			}
+			if got != tt.want {
+				t.Errorf("got dry run %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -15,6 +15,7 @@
 package httputil
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -44,6 +45,10 @@ type BasicAuth struct {
 
 type AuthAPIOpts struct {
 	GuestAccessAllowed bool
+	// Refuses requests from users who haven't agreed to the privacy policy, if set.
+	ConsentRequired func(ctx context.Context, device *userapi.Device) *util.JSONResponse
+	// Answers requests from shadow banned users without handling them, if set.
+	ShadowBanned func(req *http.Request, device *userapi.Device) *util.JSONResponse
 }
 
 // AuthAPIOption is an option to MakeAuthAPI to add additional checks (e.g. guest access) to verify
@@ -106,6 +111,16 @@ func MakeAuthAPI(
 				JSON: spec.GuestAccessForbidden("Guest access not allowed"),
 			}
 		}
+		if opts.ConsentRequired != nil {
+			if resErr := opts.ConsentRequired(req.Context(), device); resErr != nil {
+				return *resErr
+			}
+		}
+		if opts.ShadowBanned != nil {
+			if res := opts.ShadowBanned(req, device); res != nil {
+				return *res
+			}
+		}
 
 		jsonRes := f(req, device)
 		// do not log 4xx as errors as they are client fails, not server fails
@@ -146,6 +161,11 @@ func MakeExternalAPI(metricsName string, f func(*http.Request) util.JSONResponse
 	}
 	h := util.MakeJSONAPI(util.NewJSONRequestHandler(f))
 	withSpan := func(w http.ResponseWriter, req *http.Request) {
+		// Compress large JSON responses, such as /sync and /messages, for
+		// clients that accept it.
+		w, finishCompression := compressResponse(w, req)
+		defer finishCompression()
+
 		nextWriter := w
 		if verbose {
 			logger := logrus.NewEntry(logrus.StandardLogger())
@@ -187,7 +207,7 @@ func MakeExternalAPI(metricsName string, f func(*http.Request) util.JSONResponse
 			}
 		}
 
-		trace, ctx := internal.StartTask(req.Context(), metricsName)
+		trace, ctx := internal.StartTaskFromRequest(req, metricsName)
 		defer trace.EndTask()
 		req = req.WithContext(ctx)
 		h.ServeHTTP(nextWriter, req)
@@ -201,7 +221,7 @@ func MakeExternalAPI(metricsName string, f func(*http.Request) util.JSONResponse
 // This is used to serve HTML alongside JSON error messages
 func MakeHTMLAPI(metricsName string, enableMetrics bool, f func(http.ResponseWriter, *http.Request)) http.Handler {
 	withSpan := func(w http.ResponseWriter, req *http.Request) {
-		trace, ctx := internal.StartTask(req.Context(), metricsName)
+		trace, ctx := internal.StartTaskFromRequest(req, metricsName)
 		defer trace.EndTask()
 		req = req.WithContext(ctx)
 		f(w, req)
@@ -0,0 +1,149 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The labels of the endpoint metrics. The endpoint is the path template of the
+// route, e.g. /_matrix/client/v3/rooms/{roomID}/send/{eventType}/{txnID}, so
+// that the number of series stays bounded.
+var endpointLabels = []string{"component", "endpoint", "method", "code"}
+
+var (
+	endpointRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "dendrite",
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "How long requests took to be answered, by endpoint and status code",
+			// Long-polling endpoints such as /sync take up to 30 seconds by default.
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+		},
+		endpointLabels,
+	)
+	endpointRequestSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "dendrite",
+			Subsystem: "http",
+			Name:      "request_size_bytes",
+			Help:      "The size of request bodies, by endpoint and status code",
+			Buckets:   prometheus.ExponentialBuckets(100, 10, 7),
+		},
+		endpointLabels,
+	)
+	endpointResponseSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "dendrite",
+			Subsystem: "http",
+			Name:      "response_size_bytes",
+			Help:      "The size of response bodies, by endpoint and status code",
+			Buckets:   prometheus.ExponentialBuckets(100, 10, 7),
+		},
+		endpointLabels,
+	)
+)
+
+func init() {
+	prometheus.MustRegister(endpointRequestDuration, endpointRequestSize, endpointResponseSize)
+}
+
+// instrumentEndpoints returns middleware that records the latency and the
+// request and response sizes of the routes of a router, so that operators can
+// define SLOs per endpoint. Requests that don't match a route aren't recorded.
+func instrumentEndpoints(component string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+			endpoint := "unknown"
+			if route := mux.CurrentRoute(req); route != nil {
+				if template, err := route.GetPathTemplate(); err == nil {
+					endpoint = template
+				}
+			}
+			body := &countingBody{ReadCloser: req.Body}
+			if req.Body != nil && req.Body != http.NoBody {
+				req.Body = body
+			}
+			mw := &metricsResponseWriter{ResponseWriter: w, status: http.StatusOK}
+
+			next.ServeHTTP(mw, req)
+
+			labels := prometheus.Labels{
+				"component": component,
+				"endpoint":  endpoint,
+				"method":    req.Method,
+				"code":      strconv.Itoa(mw.status),
+			}
+			endpointRequestDuration.With(labels).Observe(time.Since(start).Seconds())
+			endpointRequestSize.With(labels).Observe(float64(body.read))
+			endpointResponseSize.With(labels).Observe(float64(mw.written))
+		})
+	}
+}
+
+// countingBody counts the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+	read int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	return n, err
+}
+
+// metricsResponseWriter records the status code and the size of a response.
+type metricsResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	written     int64
+	wroteHeader bool
+}
+
+func (w *metricsResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *metricsResponseWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// Flush lets streamed responses, such as remote media, be flushed as before.
+func (w *metricsResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying response writer.
+func (w *metricsResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
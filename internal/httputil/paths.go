@@ -19,6 +19,7 @@ const (
 	PublicFederationPathPrefix = "/_matrix/federation/"
 	PublicKeyPathPrefix        = "/_matrix/key/"
 	PublicMediaPathPrefix      = "/_matrix/media/"
+	PublicMediaProxyPathPrefix = "/_matrix/media_proxy/"
 	PublicStaticPath           = "/_matrix/static/"
 	PublicWellKnownPrefix      = "/.well-known/matrix/"
 	DendriteAdminPathPrefix    = "/_dendrite/"
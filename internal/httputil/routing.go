@@ -44,6 +44,7 @@ type Routers struct {
 	Federation    *mux.Router
 	Keys          *mux.Router
 	Media         *mux.Router
+	MediaProxy    *mux.Router
 	WellKnown     *mux.Router
 	Static        *mux.Router
 	DendriteAdmin *mux.Router
@@ -56,12 +57,14 @@ func NewRouters() Routers {
 		Federation:    mux.NewRouter().SkipClean(true).PathPrefix(PublicFederationPathPrefix).Subrouter().UseEncodedPath(),
 		Keys:          mux.NewRouter().SkipClean(true).PathPrefix(PublicKeyPathPrefix).Subrouter().UseEncodedPath(),
 		Media:         mux.NewRouter().SkipClean(true).PathPrefix(PublicMediaPathPrefix).Subrouter().UseEncodedPath(),
+		MediaProxy:    mux.NewRouter().SkipClean(true).PathPrefix(PublicMediaProxyPathPrefix).Subrouter().UseEncodedPath(),
 		WellKnown:     mux.NewRouter().SkipClean(true).PathPrefix(PublicWellKnownPrefix).Subrouter().UseEncodedPath(),
 		Static:        mux.NewRouter().SkipClean(true).PathPrefix(PublicStaticPath).Subrouter().UseEncodedPath(),
 		DendriteAdmin: mux.NewRouter().SkipClean(true).PathPrefix(DendriteAdminPathPrefix).Subrouter().UseEncodedPath(),
 		SynapseAdmin:  mux.NewRouter().SkipClean(true).PathPrefix(SynapseAdminPathPrefix).Subrouter().UseEncodedPath(),
 	}
 	r.configureHTTPErrors()
+	r.instrumentEndpoints()
 	return r
 }
 
@@ -82,10 +85,28 @@ var NotFoundCORSHandler = WrapHandlerInCORS(http.HandlerFunc(func(w http.Respons
 func (r *Routers) configureHTTPErrors() {
 	for _, router := range []*mux.Router{
 		r.Client, r.Federation, r.Keys,
-		r.Media, r.WellKnown, r.Static,
+		r.Media, r.MediaProxy, r.WellKnown, r.Static,
 		r.DendriteAdmin, r.SynapseAdmin,
 	} {
 		router.NotFoundHandler = NotFoundCORSHandler
 		router.MethodNotAllowedHandler = NotAllowedHandler
 	}
 }
+
+// instrumentEndpoints records metrics for the routes of every router, labelled
+// with the component the router serves.
+func (r *Routers) instrumentEndpoints() {
+	for component, router := range map[string]*mux.Router{
+		"client":         r.Client,
+		"federation":     r.Federation,
+		"keys":           r.Keys,
+		"media":          r.Media,
+		"media_proxy":    r.MediaProxy,
+		"well_known":     r.WellKnown,
+		"static":         r.Static,
+		"dendrite_admin": r.DendriteAdmin,
+		"synapse_admin":  r.SynapseAdmin,
+	} {
+		router.Use(instrumentEndpoints(component))
+	}
+}
@@ -1,10 +1,14 @@
 package httputil
 
 import (
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func TestRoutersError(t *testing.T) {
@@ -36,3 +40,58 @@ func TestRoutersError(t *testing.T) {
 		t.Fatalf("unexpected content-type: %s", ct)
 	}
 }
+
+func TestRoutersEndpointMetrics(t *testing.T) {
+	r := NewRouters()
+	r.Client.Handle("/metricstest/{id}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = io.ReadAll(req.Body)
+		w.WriteHeader(http.StatusTeapot)
+		_, _ = w.Write([]byte("hello"))
+	}))
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, PublicClientPathPrefix+"metricstest/1", strings.NewReader("request"))
+	r.Client.ServeHTTP(rec, req)
+	if rec.Code != http.StatusTeapot {
+		t.Fatalf("unexpected status code: %d", rec.Code)
+	}
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %s", err)
+	}
+	want := map[string]float64{
+		"dendrite_http_request_duration_seconds": -1,
+		"dendrite_http_request_size_bytes":       7,
+		"dendrite_http_response_size_bytes":      5,
+	}
+	for _, family := range families {
+		expected, ok := want[family.GetName()]
+		if !ok {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["endpoint"] != PublicClientPathPrefix+"metricstest/{id}" {
+				continue
+			}
+			if labels["component"] != "client" || labels["method"] != http.MethodPost || labels["code"] != "418" {
+				t.Fatalf("unexpected labels for %s: %v", family.GetName(), labels)
+			}
+			histogram := metric.GetHistogram()
+			if histogram.GetSampleCount() != 1 {
+				t.Fatalf("expected one sample for %s, got %d", family.GetName(), histogram.GetSampleCount())
+			}
+			if expected >= 0 && histogram.GetSampleSum() != expected {
+				t.Fatalf("expected %s to be %v, got %v", family.GetName(), expected, histogram.GetSampleSum())
+			}
+			delete(want, family.GetName())
+		}
+	}
+	if len(want) > 0 {
+		t.Fatalf("missing metrics: %v", want)
+	}
+}
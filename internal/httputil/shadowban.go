@@ -0,0 +1,68 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+)
+
+// QueryShadowBannedAPI looks up whether users are shadow banned.
+type QueryShadowBannedAPI interface {
+	QueryShadowBanned(ctx context.Context, localpart string, serverName spec.ServerName) (bool, error)
+}
+
+// WithShadowBanned answers requests from shadow banned users with the response
+// from fake instead of handling them, so that nothing they do reaches anyone
+// else but they can't tell.
+func WithShadowBanned(userAPI QueryShadowBannedAPI, cfg *config.Global, fake func(req *http.Request) util.JSONResponse) AuthAPIOption {
+	return func(opts *AuthAPIOpts) {
+		opts.ShadowBanned = func(req *http.Request, device *userapi.Device) *util.JSONResponse {
+			return CheckShadowBanned(req, device, userAPI, cfg, fake)
+		}
+	}
+}
+
+// CheckShadowBanned returns the fake response if the user is shadow banned.
+func CheckShadowBanned(
+	req *http.Request, device *userapi.Device, userAPI QueryShadowBannedAPI, cfg *config.Global,
+	fake func(req *http.Request) util.JSONResponse,
+) *util.JSONResponse {
+	if device.AppserviceID != "" {
+		return nil
+	}
+	localpart, serverName, err := cfg.SplitLocalID('@', device.UserID)
+	if err != nil {
+		return nil
+	}
+	shadowBanned, err := userAPI.QueryShadowBanned(req.Context(), localpart, serverName)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryShadowBanned failed")
+		return &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if !shadowBanned {
+		return nil
+	}
+	res := fake(req)
+	return &res
+}
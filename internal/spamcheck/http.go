@@ -0,0 +1,107 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spamcheck
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// The kinds of checks sent to the external spam checker.
+const (
+	checkEvent      = "event"
+	checkInvite     = "invite"
+	checkCreateRoom = "create_room"
+	checkMedia      = "media"
+)
+
+// httpCheckRequest is the body of the requests sent to the external spam checker.
+// Which fields are set depends on the kind of check.
+type httpCheckRequest struct {
+	Check   string `json:"check"`
+	UserID  string `json:"user_id,omitempty"`
+	Invitee string `json:"invitee,omitempty"`
+	RoomID  string `json:"room_id,omitempty"`
+	Event   *Event `json:"event,omitempty"`
+	Media   *Media `json:"media,omitempty"`
+}
+
+// httpCheckResponse is the answer of the external spam checker.
+type httpCheckResponse struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason"`
+}
+
+// httpChecker asks an external service over HTTP.
+type httpChecker struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPChecker(cfg *config.SpamCheckerHTTP) *httpChecker {
+	return &httpChecker{
+		url:    cfg.URL,
+		client: &http.Client{Timeout: cfg.Timeout},
+	}
+}
+
+func (c *httpChecker) CheckEventForSpam(ctx context.Context, event *Event) error {
+	return c.check(ctx, &httpCheckRequest{Check: checkEvent, UserID: event.Sender, RoomID: event.RoomID, Event: event})
+}
+
+func (c *httpChecker) UserMayInvite(ctx context.Context, inviter, invitee, roomID string) error {
+	return c.check(ctx, &httpCheckRequest{Check: checkInvite, UserID: inviter, Invitee: invitee, RoomID: roomID})
+}
+
+func (c *httpChecker) UserMayCreateRoom(ctx context.Context, userID string) error {
+	return c.check(ctx, &httpCheckRequest{Check: checkCreateRoom, UserID: userID})
+}
+
+func (c *httpChecker) CheckMediaForSpam(ctx context.Context, media *Media) error {
+	return c.check(ctx, &httpCheckRequest{Check: checkMedia, UserID: media.UserID, Media: media})
+}
+
+func (c *httpChecker) check(ctx context.Context, check *httpCheckRequest) error {
+	body, err := json.Marshal(check)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("external spam checker: %w", err)
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("external spam checker: unexpected status %d", resp.StatusCode)
+	}
+	var res httpCheckResponse
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return fmt.Errorf("external spam checker: %w", err)
+	}
+	if !res.Allow {
+		return &Rejection{Reason: res.Reason}
+	}
+	return nil
+}
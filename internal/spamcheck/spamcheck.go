@@ -0,0 +1,211 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package spamcheck lets operators implement their own anti-abuse policies, by
+// rejecting events, invites, room creation and media uploads by local users,
+// and events and invites received over federation.
+// Policies are implemented by spam checker modules, which are compiled into
+// Dendrite and registered with Register, or by an external HTTP service.
+package spamcheck
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+)
+
+// Event is an event that a local user is about to send, or that a remote server
+// has sent us.
+type Event struct {
+	EventID  string          `json:"event_id"`
+	RoomID   string          `json:"room_id"`
+	Sender   string          `json:"sender"`
+	Type     string          `json:"type"`
+	StateKey *string         `json:"state_key,omitempty"`
+	Content  json.RawMessage `json:"content"`
+}
+
+// Media is a file that a local user has uploaded, before it is stored.
+type Media struct {
+	UserID        string `json:"user_id"`
+	ContentType   string `json:"content_type"`
+	UploadName    string `json:"upload_name,omitempty"`
+	FileSizeBytes int64  `json:"file_size_bytes"`
+	Base64Hash    string `json:"base64hash"`
+}
+
+// SpamChecker is implemented by spam checker modules. Each check returns nil to
+// allow the action, or an error to prevent it: a *Rejection is reported to the
+// user with its reason, any other error as an internal server error.
+// Modules can embed AllowAll to only implement the checks they need.
+type SpamChecker interface {
+	// CheckEventForSpam is called before a local user sends an event, and
+	// before an event received over federation is accepted.
+	CheckEventForSpam(ctx context.Context, event *Event) error
+	// UserMayInvite is called before a local user invites another user to a
+	// room, and before an invite received over federation is accepted.
+	UserMayInvite(ctx context.Context, inviter, invitee, roomID string) error
+	// UserMayCreateRoom is called before a local user creates a room.
+	UserMayCreateRoom(ctx context.Context, userID string) error
+	// CheckMediaForSpam is called after a local user has uploaded a file, before it is stored.
+	CheckMediaForSpam(ctx context.Context, media *Media) error
+}
+
+// Rejection is returned by spam checkers to reject an action.
+type Rejection struct {
+	// The reason given to the user.
+	Reason string
+}
+
+func (r *Rejection) Error() string {
+	return fmt.Sprintf("rejected by spam checker: %s", r.Reason)
+}
+
+// AllowAll is a SpamChecker that allows everything.
+type AllowAll struct{}
+
+func (AllowAll) CheckEventForSpam(context.Context, *Event) error             { return nil }
+func (AllowAll) UserMayInvite(context.Context, string, string, string) error { return nil }
+func (AllowAll) UserMayCreateRoom(context.Context, string) error             { return nil }
+func (AllowAll) CheckMediaForSpam(context.Context, *Media) error             { return nil }
+
+// Factory creates a spam checker module from the options it was configured with.
+type Factory func(options map[string]interface{}) (SpamChecker, error)
+
+var (
+	modules   = map[string]Factory{}
+	modulesMu sync.Mutex
+)
+
+// Register makes a spam checker module available under the name, so that it
+// can be enabled in the config. It is meant to be called from the init function
+// of the package implementing the module, and panics if the name is taken.
+func Register(name string, factory Factory) {
+	modulesMu.Lock()
+	defer modulesMu.Unlock()
+	if _, ok := modules[name]; ok {
+		panic(fmt.Sprintf("spamcheck: module %q registered twice", name))
+	}
+	modules[name] = factory
+}
+
+// Modules returns the names of the registered spam checker modules.
+func Modules() []string {
+	modulesMu.Lock()
+	defer modulesMu.Unlock()
+	names := make([]string, 0, len(modules))
+	for name := range modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SpamCheckers asks the configured spam checkers in order, and rejects an
+// action as soon as one of them does. A nil *SpamCheckers allows everything.
+type SpamCheckers struct {
+	checkers []SpamChecker
+}
+
+// New creates the spam checkers configured in cfg, or returns nil if there are
+// none.
+func New(cfg *config.SpamChecker) (*SpamCheckers, error) {
+	s := &SpamCheckers{}
+	for _, module := range cfg.Modules {
+		modulesMu.Lock()
+		factory, ok := modules[module.Name]
+		modulesMu.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("spamcheck: unknown module %q, registered modules are %v", module.Name, Modules())
+		}
+		checker, err := factory(module.Config)
+		if err != nil {
+			return nil, fmt.Errorf("spamcheck: failed to create module %q: %w", module.Name, err)
+		}
+		s.checkers = append(s.checkers, checker)
+	}
+	if cfg.HTTP.URL != "" {
+		s.checkers = append(s.checkers, newHTTPChecker(&cfg.HTTP))
+	}
+	if len(s.checkers) == 0 {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// NewSpamCheckers returns SpamCheckers that ask the given spam checkers in order.
+func NewSpamCheckers(checkers ...SpamChecker) *SpamCheckers {
+	return &SpamCheckers{checkers: checkers}
+}
+
+func (s *SpamCheckers) CheckEventForSpam(ctx context.Context, event *Event) error {
+	return s.check(func(c SpamChecker) error {
+		return c.CheckEventForSpam(ctx, event)
+	})
+}
+
+func (s *SpamCheckers) UserMayInvite(ctx context.Context, inviter, invitee, roomID string) error {
+	return s.check(func(c SpamChecker) error {
+		return c.UserMayInvite(ctx, inviter, invitee, roomID)
+	})
+}
+
+func (s *SpamCheckers) UserMayCreateRoom(ctx context.Context, userID string) error {
+	return s.check(func(c SpamChecker) error {
+		return c.UserMayCreateRoom(ctx, userID)
+	})
+}
+
+func (s *SpamCheckers) CheckMediaForSpam(ctx context.Context, media *Media) error {
+	return s.check(func(c SpamChecker) error {
+		return c.CheckMediaForSpam(ctx, media)
+	})
+}
+
+func (s *SpamCheckers) check(fn func(c SpamChecker) error) error {
+	if s == nil {
+		return nil
+	}
+	for _, checker := range s.checkers {
+		if err := fn(checker); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ErrorResponse returns the response to send when a spam check failed with err:
+// M_FORBIDDEN if the action was rejected, or an internal server error otherwise.
+func ErrorResponse(ctx context.Context, err error) util.JSONResponse {
+	var rejection *Rejection
+	if errors.As(err, &rejection) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden(rejection.Reason),
+		}
+	}
+	util.GetLogger(ctx).WithError(err).Error("Spam check failed")
+	return util.JSONResponse{
+		Code: http.StatusInternalServerError,
+		JSON: spec.InternalServerError{},
+	}
+}
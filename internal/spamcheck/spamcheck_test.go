@@ -0,0 +1,96 @@
+package spamcheck
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// noRoomCreation is a module that doesn't let anyone create rooms.
+type noRoomCreation struct {
+	AllowAll
+	reason string
+}
+
+func (c noRoomCreation) UserMayCreateRoom(context.Context, string) error {
+	return &Rejection{Reason: c.reason}
+}
+
+func init() {
+	Register("test_no_room_creation", func(options map[string]interface{}) (SpamChecker, error) {
+		reason, _ := options["reason"].(string)
+		return noRoomCreation{reason: reason}, nil
+	})
+}
+
+func TestSpamCheckers(t *testing.T) {
+	ctx := context.Background()
+
+	// A nil *SpamCheckers allows everything.
+	var s *SpamCheckers
+	assert.NoError(t, s.UserMayCreateRoom(ctx, "@alice:test"))
+
+	s, err := New(&config.SpamChecker{})
+	assert.NoError(t, err)
+	assert.Nil(t, s)
+
+	_, err = New(&config.SpamChecker{Modules: []config.SpamCheckerModule{{Name: "unknown"}}})
+	assert.Error(t, err)
+
+	s, err = New(&config.SpamChecker{Modules: []config.SpamCheckerModule{{
+		Name:   "test_no_room_creation",
+		Config: map[string]interface{}{"reason": "no rooms"},
+	}}})
+	assert.NoError(t, err)
+	assert.NoError(t, s.UserMayInvite(ctx, "@alice:test", "@bob:test", "!room:test"))
+	err = s.UserMayCreateRoom(ctx, "@alice:test")
+	var rejection *Rejection
+	assert.True(t, errors.As(err, &rejection))
+	assert.Equal(t, "no rooms", rejection.Reason)
+	assert.Equal(t, http.StatusForbidden, ErrorResponse(ctx, err).Code)
+	assert.Equal(t, http.StatusInternalServerError, ErrorResponse(ctx, errors.New("broken")).Code)
+}
+
+func TestHTTPChecker(t *testing.T) {
+	ctx := context.Background()
+	var got httpCheckRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = httpCheckRequest{}
+		if err := json.NewDecoder(req.Body).Decode(&got); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch got.Check {
+		case checkMedia:
+			w.WriteHeader(http.StatusInternalServerError)
+		case checkEvent:
+			_ = json.NewEncoder(w).Encode(httpCheckResponse{Allow: false, Reason: "spam"})
+		default:
+			_ = json.NewEncoder(w).Encode(httpCheckResponse{Allow: true})
+		}
+	}))
+	defer srv.Close()
+
+	s, err := New(&config.SpamChecker{HTTP: config.SpamCheckerHTTP{URL: srv.URL, Timeout: time.Second}})
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.UserMayInvite(ctx, "@alice:test", "@bob:test", "!room:test"))
+	assert.Equal(t, httpCheckRequest{Check: checkInvite, UserID: "@alice:test", Invitee: "@bob:test", RoomID: "!room:test"}, got)
+
+	err = s.CheckEventForSpam(ctx, &Event{RoomID: "!room:test", Sender: "@alice:test", Type: "m.room.message", Content: json.RawMessage(`{}`)})
+	var rejection *Rejection
+	assert.True(t, errors.As(err, &rejection))
+	assert.Equal(t, "spam", rejection.Reason)
+
+	// Errors aren't rejections.
+	err = s.CheckMediaForSpam(ctx, &Media{UserID: "@alice:test"})
+	assert.Error(t, err)
+	assert.False(t, errors.As(err, &rejection))
+}
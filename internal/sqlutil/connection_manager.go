@@ -17,6 +17,7 @@ package sqlutil
 import (
 	"database/sql"
 	"fmt"
+	"sort"
 	"sync"
 
 	"github.com/matrix-org/dendrite/setup/config"
@@ -84,3 +85,31 @@ func (c *Connections) Connection(dbProperties *config.DatabaseOptions) (*sql.DB,
 	return db, writer, nil
 
 }
+
+// OpenedDatabase is a database that has been opened by the connection manager.
+type OpenedDatabase struct {
+	ConnectionString config.DataSource
+	DB               *sql.DB
+	Writer           Writer
+}
+
+// OpenedDatabases returns the databases that have been opened so far. In
+// monolith mode with a global database pool this is a single database.
+func (c *Connections) OpenedDatabases() []OpenedDatabase {
+	var databases []OpenedDatabase
+	c.existingConnections.Range(func(key, value any) bool {
+		ex := value.(*con)
+		if ex.db != nil {
+			databases = append(databases, OpenedDatabase{
+				ConnectionString: key.(config.DataSource),
+				DB:               ex.db,
+				Writer:           ex.writer,
+			})
+		}
+		return true
+	})
+	sort.Slice(databases, func(i, j int) bool {
+		return databases[i].ConnectionString < databases[j].ConnectionString
+	})
+	return databases
+}
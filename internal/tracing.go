@@ -16,6 +16,7 @@ package internal
 
 import (
 	"context"
+	"net/http"
 	"runtime/trace"
 
 	"github.com/opentracing/opentracing-go"
@@ -36,6 +37,25 @@ func StartTask(inCtx context.Context, name string) (Trace, context.Context) {
 	}, ctx
 }
 
+// StartTaskFromRequest starts a task for an incoming HTTP request. If the
+// request carries the trace context of the caller in its headers, the span is
+// a child of the caller's span, so that the request can be followed end-to-end.
+func StartTaskFromRequest(req *http.Request, name string) (Trace, context.Context) {
+	ctx, task := trace.NewTask(req.Context(), name)
+	var opts []opentracing.StartSpanOption
+	if opentracing.SpanFromContext(ctx) == nil {
+		carrier := opentracing.HTTPHeadersCarrier(req.Header)
+		if remote, err := opentracing.GlobalTracer().Extract(opentracing.HTTPHeaders, carrier); err == nil {
+			opts = append(opts, opentracing.ChildOf(remote))
+		}
+	}
+	span, ctx := opentracing.StartSpanFromContext(ctx, name, opts...)
+	return Trace{
+		span: span,
+		task: task,
+	}, ctx
+}
+
 func StartRegion(inCtx context.Context, name string) (Trace, context.Context) {
 	region := trace.StartRegion(inCtx, name)
 	span, ctx := opentracing.StartSpanFromContext(inCtx, name)
@@ -62,3 +82,12 @@ func (t Trace) EndTask() {
 func (t Trace) SetTag(key string, value any) {
 	t.span.SetTag(key, value)
 }
+
+// SetError marks the span as failed and logs the error on it, if err is not nil.
+func (t Trace) SetError(err error) {
+	if err == nil {
+		return
+	}
+	t.span.SetTag("error", true)
+	t.span.LogKV("event", "error", "message", err.Error())
+}
@@ -2,8 +2,13 @@ package internal
 
 import (
 	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -23,3 +28,30 @@ func TestTracing(t *testing.T) {
 	defer task.EndTask()
 	defer region.EndRegion()
 }
+
+func TestStartTaskFromRequest(t *testing.T) {
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+	// The caller's span context is propagated in the request headers.
+	parent := tracer.StartSpan("caller")
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	err := tracer.Inject(parent.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header))
+	assert.NoError(t, err)
+
+	task, ctx := StartTaskFromRequest(req, "testing")
+	region, _ := StartRegion(ctx, "child")
+	region.SetError(errors.New("failed"))
+	region.EndRegion()
+	task.EndTask()
+
+	spans := tracer.FinishedSpans()
+	if !assert.Len(t, spans, 2) {
+		return
+	}
+	callerID := parent.Context().(mocktracer.MockSpanContext).SpanID
+	assert.Equal(t, callerID, spans[1].ParentID)
+	assert.Equal(t, spans[1].SpanContext.SpanID, spans[0].ParentID)
+	assert.Equal(t, true, spans[0].Tag("error"))
+}
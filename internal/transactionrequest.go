@@ -17,12 +17,14 @@ package internal
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"sync"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/matrix-org/dendrite/federationapi/producers"
 	"github.com/matrix-org/dendrite/federationapi/types"
+	"github.com/matrix-org/dendrite/internal/spamcheck"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	rstypes "github.com/matrix-org/dendrite/roomserver/types"
 	syncTypes "github.com/matrix-org/dendrite/syncapi/types"
@@ -64,6 +66,9 @@ type TxnReq struct {
 	roomsMu                *MutexByRoom
 	producer               *producers.SyncAPIProducer
 	inboundPresenceEnabled bool
+	// SpamCheckers are asked about each PDU before it is sent to the
+	// roomserver. PDUs that they reject are returned with an error.
+	SpamCheckers *spamcheck.SpamCheckers
 }
 
 func NewTxnReq(
@@ -176,6 +181,18 @@ func (t *TxnReq) ProcessTransaction(ctx context.Context) (*fclient.RespSend, *ut
 			}
 			continue
 		}
+		if err = t.checkEventForSpam(ctx, event); err != nil {
+			var rejection *spamcheck.Rejection
+			if errors.As(err, &rejection) {
+				util.GetLogger(ctx).WithError(err).Debugf("Transaction: Spam checker rejected event %q", event.EventID())
+			} else {
+				util.GetLogger(ctx).WithError(err).Errorf("Transaction: Couldn't spam check event %q", event.EventID())
+			}
+			results[event.EventID()] = fclient.PDUResult{
+				Error: err.Error(),
+			}
+			continue
+		}
 
 		// pass the event to the roomserver which will do auth checks
 		// If the event fail auth checks, gmsl.NotAllowed error will be returned which we be silently
@@ -208,6 +225,24 @@ func (t *TxnReq) ProcessTransaction(ctx context.Context) (*fclient.RespSend, *ut
 	return &fclient.RespSend{PDUs: results}, nil
 }
 
+func (t *TxnReq) checkEventForSpam(ctx context.Context, event gomatrixserverlib.PDU) error {
+	if t.SpamCheckers == nil {
+		return nil
+	}
+	sender := string(event.SenderID())
+	if userID, err := t.rsAPI.QueryUserIDForSender(ctx, event.RoomID(), event.SenderID()); err == nil && userID != nil {
+		sender = userID.String()
+	}
+	return t.SpamCheckers.CheckEventForSpam(ctx, &spamcheck.Event{
+		EventID:  event.EventID(),
+		RoomID:   event.RoomID().String(),
+		Sender:   sender,
+		Type:     event.Type(),
+		StateKey: event.StateKey(),
+		Content:  event.Content(),
+	})
+}
+
 // nolint:gocyclo
 func (t *TxnReq) processEDUs(ctx context.Context) {
 	for _, e := range t.EDUs {
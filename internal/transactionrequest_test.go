@@ -30,6 +30,7 @@ import (
 	"gotest.tools/v3/poll"
 
 	"github.com/matrix-org/dendrite/federationapi/producers"
+	"github.com/matrix-org/dendrite/internal/spamcheck"
 	rsAPI "github.com/matrix-org/dendrite/roomserver/api"
 	rstypes "github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -807,3 +808,32 @@ func TestTransactionFailAuthChecks(t *testing.T) {
 	// expect message to be sent to the roomserver
 	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []*rstypes.HeaderedEvent{testEvents[len(testEvents)-1]})
 }
+
+// rejectSenderSpamChecker rejects all events sent by one user.
+type rejectSenderSpamChecker struct {
+	spamcheck.AllowAll
+	sender string
+}
+
+func (c rejectSenderSpamChecker) CheckEventForSpam(ctx context.Context, event *spamcheck.Event) error {
+	if event.Sender == c.sender {
+		return &spamcheck.Rejection{Reason: "no spam"}
+	}
+	return nil
+}
+
+// The purpose of this test is to check that events rejected by the spam checkers are returned with
+// an error and are not sent to the roomserver.
+func TestTransactionRejectedBySpamChecker(t *testing.T) {
+	rsAPI := &testRoomserverAPI{}
+	event := testEvents[len(testEvents)-1]
+	pdus := []json.RawMessage{
+		testData[len(testData)-1], // a message event
+	}
+	txn := mustCreateTransaction(rsAPI, pdus)
+	txn.SpamCheckers = spamcheck.NewSpamCheckers(rejectSenderSpamChecker{sender: string(event.SenderID())})
+	res, jsonRes := txn.ProcessTransaction(context.Background())
+	assert.Nil(t, jsonRes)
+	assert.Contains(t, res.PDUs[event.EventID()].Error, "no spam")
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, nil)
+}
@@ -19,6 +19,9 @@ import (
 	"fmt"
 	"net/http"
 	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/matrix-org/dendrite/clientapi/userutil"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -40,6 +43,7 @@ var (
 	ErrUsernameTooLong    = fmt.Errorf("username exceeds the maximum length of %d characters", maxUsernameLength)
 	ErrUsernameInvalid    = errors.New("username can only contain characters a-z, 0-9, or '_+-./='")
 	ErrUsernameUnderscore = errors.New("username cannot start with a '_'")
+	ErrLocalpartReserved  = errors.New("this name is reserved")
 	validUsernameRegex    = regexp.MustCompile(`^[0-9a-z_\-+=./]+$`)
 )
 
@@ -84,14 +88,97 @@ func ValidateUsername(localpart string, domain spec.ServerName) error {
 	return nil
 }
 
+// ValidateLocalpartPolicy returns an error if the localpart isn't allowed by the
+// configured policy. Reserved localparts are only allowed if allowReserved is
+// set, i.e. for application services within their own namespaces.
+func ValidateLocalpartPolicy(policy *config.LocalpartPolicy, localpart string, allowReserved bool) error {
+	if len(localpart) < policy.MinLength {
+		return LocalpartPolicyError(fmt.Sprintf("must be at least %d characters long", policy.MinLength))
+	}
+	if !policy.HasAllowedCharacters(localpart) {
+		return LocalpartPolicyError(fmt.Sprintf("can only contain the characters %s", policy.AllowedCharacters))
+	}
+	if !allowReserved && policy.IsReserved(localpart) {
+		return ErrLocalpartReserved
+	}
+	return nil
+}
+
+// LocalpartPolicyError is returned when a localpart doesn't satisfy the
+// configured localpart policy.
+type LocalpartPolicyError string
+
+func (e LocalpartPolicyError) Error() string {
+	return string(e)
+}
+
+// ProfilePolicyError is returned when a display name doesn't satisfy the
+// configured profile policy.
+type ProfilePolicyError string
+
+func (e ProfilePolicyError) Error() string {
+	return string(e)
+}
+
+// ValidateDisplayName returns a ProfilePolicyError if a local user isn't
+// allowed to use the display name.
+func ValidateDisplayName(policy *config.ProfilePolicy, displayName string) error {
+	if policy.MaxDisplayNameLength > 0 && utf8.RuneCountInString(displayName) > policy.MaxDisplayNameLength {
+		return ProfilePolicyError(fmt.Sprintf("displayname must be at most %d characters long", policy.MaxDisplayNameLength))
+	}
+	if strings.IndexFunc(displayName, unicode.IsControl) != -1 {
+		return ProfilePolicyError("displayname can't contain control characters")
+	}
+	if policy.IsDisplayNameDisallowed(displayName) {
+		return ProfilePolicyError("displayname is not allowed on this server")
+	}
+	return nil
+}
+
+// maxRemoteAvatarURLLength is the longest avatar URL of remote users that is
+// passed on to clients.
+const maxRemoteAvatarURLLength = 1024
+
+// ClampRemoteProfile makes the profile of a remote user safe to store or serve
+// to clients. Control characters are removed from the display name, which is
+// truncated to the maximum display name length, and avatar URLs that aren't
+// mxc:// URIs or are absurdly long are dropped.
+func ClampRemoteProfile(policy *config.ProfilePolicy, displayName, avatarURL string) (string, string) {
+	displayName = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, displayName)
+	if policy.MaxDisplayNameLength > 0 && utf8.RuneCountInString(displayName) > policy.MaxDisplayNameLength {
+		displayName = string([]rune(displayName)[:policy.MaxDisplayNameLength])
+	}
+	if !strings.HasPrefix(avatarURL, "mxc://") || len(avatarURL) > maxRemoteAvatarURLLength {
+		avatarURL = ""
+	}
+	return displayName, avatarURL
+}
+
 // UsernameResponse returns a util.JSONResponse for the given error, if any.
 func UsernameResponse(err error) *util.JSONResponse {
+	var policyErr LocalpartPolicyError
+	if errors.As(err, &policyErr) {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidUsername("username " + policyErr.Error()),
+		}
+	}
 	switch err {
 	case ErrUsernameTooLong:
 		return &util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: spec.BadJSON(err.Error()),
 		}
+	case ErrLocalpartReserved:
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.UserInUse("Desired user ID is reserved."),
+		}
 	case ErrUsernameInvalid, ErrUsernameUnderscore:
 		return &util.JSONResponse{
 			Code: http.StatusBadRequest,
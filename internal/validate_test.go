@@ -185,6 +185,112 @@ func Test_validateUsername(t *testing.T) {
 	}
 }
 
+func Test_validateLocalpartPolicy(t *testing.T) {
+	policy := config.LocalpartPolicy{
+		AllowedCharacters: "a-z0-9",
+		MinLength:         3,
+		Reserved:          []string{"Admin"},
+	}
+	configErrs := &config.ConfigErrors{}
+	policy.Verify(configErrs, "policy")
+	if len(*configErrs) > 0 {
+		t.Fatalf("unexpected config errors: %v", *configErrs)
+	}
+
+	tests := []struct {
+		name          string
+		localpart     string
+		allowReserved bool
+		wantErr       bool
+		wantJSON      *util.JSONResponse
+	}{
+		{
+			name:      "localpart OK",
+			localpart: "alice",
+		},
+		{
+			name:      "localpart too short",
+			localpart: "al",
+			wantErr:   true,
+			wantJSON:  &util.JSONResponse{Code: http.StatusBadRequest, JSON: spec.InvalidUsername("username must be at least 3 characters long")},
+		},
+		{
+			name:      "localpart with disallowed characters",
+			localpart: "alice.smith",
+			wantErr:   true,
+			wantJSON:  &util.JSONResponse{Code: http.StatusBadRequest, JSON: spec.InvalidUsername("username can only contain the characters a-z0-9")},
+		},
+		{
+			name:      "reserved localpart",
+			localpart: "admin",
+			wantErr:   true,
+			wantJSON:  &util.JSONResponse{Code: http.StatusBadRequest, JSON: spec.UserInUse("Desired user ID is reserved.")},
+		},
+		{
+			name:          "reserved localpart allowed",
+			localpart:     "admin",
+			allowReserved: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotErr := ValidateLocalpartPolicy(&policy, tt.localpart, tt.allowReserved)
+			if (gotErr != nil) != tt.wantErr {
+				t.Errorf("ValidateLocalpartPolicy() = %v, wantErr %v", gotErr, tt.wantErr)
+			}
+			if got := UsernameResponse(gotErr); !reflect.DeepEqual(got, tt.wantJSON) {
+				t.Errorf("UsernameResponse() = %v, wantJSON %v", got, tt.wantJSON)
+			}
+		})
+	}
+}
+
+func Test_validateDisplayName(t *testing.T) {
+	policy := config.ProfilePolicy{
+		MaxDisplayNameLength:   5,
+		DisallowedDisplayNames: []string{"^adm"},
+	}
+	configErrs := &config.ConfigErrors{}
+	policy.Verify(configErrs)
+	if len(*configErrs) > 0 {
+		t.Fatalf("unexpected config errors: %v", *configErrs)
+	}
+
+	tests := map[string]bool{
+		"":       false,
+		"alice":  false,
+		"ålîçé":  false,
+		"alice!": true,
+		"al\nce": true,
+		"Admin":  true,
+		"madam":  false,
+	}
+	for displayName, wantErr := range tests {
+		if err := ValidateDisplayName(&policy, displayName); (err != nil) != wantErr {
+			t.Errorf("ValidateDisplayName(%q) = %v, wantErr %v", displayName, err, wantErr)
+		}
+	}
+}
+
+func TestClampRemoteProfile(t *testing.T) {
+	policy := &config.ProfilePolicy{MaxDisplayNameLength: 5}
+	tests := []struct {
+		displayName, avatarURL         string
+		wantDisplayName, wantAvatarURL string
+	}{
+		{"alice", "mxc://example.com/abc", "alice", "mxc://example.com/abc"},
+		{"ålîçé smith", "mxc://example.com/abc", "ålîçé", "mxc://example.com/abc"},
+		{"a\u202e\x00b", "https://example.com/avatar.png", "a\u202eb", ""},
+		{"bob", "mxc://example.com/" + strings.Repeat("a", 2000), "bob", ""},
+	}
+	for _, tt := range tests {
+		displayName, avatarURL := ClampRemoteProfile(policy, tt.displayName, tt.avatarURL)
+		if displayName != tt.wantDisplayName || avatarURL != tt.wantAvatarURL {
+			t.Errorf("ClampRemoteProfile(%q, %q) = %q, %q, want %q, %q", tt.displayName, tt.avatarURL, displayName, avatarURL, tt.wantDisplayName, tt.wantAvatarURL)
+		}
+	}
+}
+
 // This method tests validation of the provided Application Service token and
 // username that they're registering
 func TestValidateApplicationServiceRequest(t *testing.T) {
@@ -0,0 +1,90 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileutils
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// PrepareBasePath checks that absBasePath can be used as the media store, and
+// creates it if it doesn't exist yet. It must be absolute and normalised, so
+// that checking whether paths are within it can't be subverted, and be a
+// writable directory. If other users can access it, they are denied access, as
+// the media store holds files that may not be public.
+func PrepareBasePath(absBasePath config.Path, logger *log.Entry) error {
+	path := string(absBasePath)
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("%q is not an absolute path", path)
+	}
+	if clean := filepath.Clean(path); clean != path {
+		return fmt.Errorf("%q is not a normalised path, use %q instead", path, clean)
+	}
+
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		logger.WithField("path", path).Info("Creating the media store")
+		if err = os.MkdirAll(path, 0770); err != nil {
+			return fmt.Errorf("failed to create %s: %w", path, err)
+		}
+		info, err = os.Stat(path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+
+	// File modes don't control access on Windows.
+	if perm := info.Mode().Perm(); runtime.GOOS != "windows" && perm&0o007 != 0 {
+		if err = os.Chmod(path, perm&^0o007); err != nil {
+			return fmt.Errorf("%s can be accessed by other users (mode %s), restrict it with `chmod o-rwx %s`: %w", path, perm, path, err)
+		}
+		logger.WithFields(log.Fields{
+			"path": path,
+			"mode": perm,
+		}).Warn("The media store could be accessed by other users, so their access has been removed")
+	}
+
+	if err = CheckWritable(absBasePath); err != nil {
+		return fmt.Errorf("%s is not writable: %w", path, err)
+	}
+	return nil
+}
+
+// CheckWritable checks that files can be written to dir, by creating and
+// removing a probe file in it.
+func CheckWritable(dir config.Path) error {
+	file, err := os.CreateTemp(string(dir), ".probe-")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write([]byte("ok"))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if removeErr := os.Remove(file.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
@@ -0,0 +1,46 @@
+package fileutils
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrepareBasePath(t *testing.T) {
+	logger := logrus.NewEntry(logrus.New())
+	root := t.TempDir()
+
+	// Relative and unnormalised paths are refused.
+	assert.Error(t, PrepareBasePath("media_store", logger))
+	assert.Error(t, PrepareBasePath(config.Path(root+"/media_store/"), logger))
+	assert.Error(t, PrepareBasePath(config.Path(root+"/x/../media_store"), logger))
+
+	// The media store is created if it doesn't exist.
+	base := filepath.Join(root, "media_store")
+	assert.NoError(t, PrepareBasePath(config.Path(base), logger))
+	info, err := os.Stat(base)
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir())
+	entries, err := os.ReadDir(base)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// Other users' access is removed.
+	if runtime.GOOS != "windows" {
+		assert.NoError(t, os.Chmod(base, 0755))
+		assert.NoError(t, PrepareBasePath(config.Path(base), logger))
+		info, err = os.Stat(base)
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0750), info.Mode().Perm())
+	}
+
+	// A file isn't a media store.
+	file := filepath.Join(root, "file")
+	assert.NoError(t, os.WriteFile(file, nil, 0600))
+	assert.Error(t, PrepareBasePath(config.Path(file), logger))
+}
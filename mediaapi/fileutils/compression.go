@@ -0,0 +1,325 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileutils
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/mediaapi/workers"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// Compressed files are stored with the suffix of their content coding, e.g.
+// "file.zst" rather than "file", so that the content coding of a file is known
+// from its name, whichever media refers to it. The files are standard zstd and
+// gzip streams, which record the size of their content: zstd in the frame
+// header and gzip in an extra field of the header.
+var compressedFileSuffixes = map[string]string{
+	config.MediaCompressionZstd: ".zst",
+	config.MediaCompressionGzip: ".gz",
+}
+
+// gzipSizeSubfield identifies the extra field of gzip headers holding the size
+// of the content, as a 64 bit little-endian number.
+var gzipSizeSubfield = [2]byte{'D', 'S'}
+
+// storedFileName is the name of media files in the media store, to which the
+// suffix of the content coding is added if they are compressed.
+const storedFileName = "file"
+
+// StoredEncoding returns the content coding a file in the media store was
+// compressed with, or "" if it isn't compressed.
+func StoredEncoding(path string) string {
+	for encoding, suffix := range compressedFileSuffixes {
+		if filepath.Base(path) == storedFileName+suffix {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// StoredFilePath returns the path of the media file in the directory, which
+// may be compressed. If there is no file, the path an uncompressed file would
+// have is returned.
+func StoredFilePath(dir string) string {
+	filePath, _ := findStoredFile(dir)
+	return filePath
+}
+
+// findStoredFile returns the path of the media file in the directory, and
+// whether it exists.
+func findStoredFile(dir string) (string, bool) {
+	filePath := filepath.Join(dir, storedFileName)
+	if _, err := os.Stat(filePath); err == nil {
+		return filePath, true
+	}
+	for _, suffix := range compressedFileSuffixes {
+		if _, err := os.Stat(filePath + suffix); err == nil {
+			return filePath + suffix, true
+		}
+	}
+	return filePath, false
+}
+
+// Compression compresses media files in the media store if their content type
+// is compressible. A nil *Compression doesn't compress files.
+type Compression struct {
+	encoding     string
+	contentTypes []string
+	workers      *workers.Pool
+}
+
+// NewCompression returns the compression configured for the media store, or
+// nil if files aren't compressed.
+func NewCompression(cfg *config.MediaCompression) *Compression {
+	if cfg.Algorithm == "" {
+		return nil
+	}
+	return &Compression{
+		encoding:     cfg.Algorithm,
+		contentTypes: cfg.ContentTypes,
+	}
+}
+
+// SetWorkers makes files be compressed on the workers, so that compressing
+// large files can't starve the server.
+func (c *Compression) SetWorkers(pool *workers.Pool) {
+	if c != nil {
+		c.workers = pool
+	}
+}
+
+// compresses returns whether files with the content type are compressed. The
+// configured content types may end with "*" to match any subtype.
+func (c *Compression) compresses(contentType types.ContentType) bool {
+	if c == nil {
+		return false
+	}
+	mediaType, _, _ := strings.Cut(string(contentType), ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	for _, pattern := range c.contentTypes {
+		pattern = strings.ToLower(pattern)
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(mediaType, prefix) {
+				return true
+			}
+		} else if mediaType == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// compressFile compresses the content of the file at src into a new file next
+// to it, returning its path. If the compressed file isn't smaller, it is
+// removed and src is returned. Compressing stops as soon as ctx is done.
+func (c *Compression) compressFile(ctx context.Context, src string, encryption *Encryption) (string, error) {
+	in, err := OpenStoredFile(src, encryption)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close() // nolint: errcheck
+
+	dst := src + compressedFileSuffixes[c.encoding]
+	out, err := CreateStoredFile(dst, encryption)
+	if err != nil {
+		return "", err
+	}
+	if err = compress(out, &contextReader{ctx: ctx, r: in}, in.Size(), c.encoding); err != nil {
+		_ = out.Close()
+		_ = os.Remove(dst)
+		return "", fmt.Errorf("failed to compress file: %w", err)
+	}
+	if err = out.Close(); err != nil {
+		_ = os.Remove(dst)
+		return "", err
+	}
+
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return "", err
+	}
+	dstInfo, err := os.Stat(dst)
+	if err != nil {
+		return "", err
+	}
+	if dstInfo.Size() >= srcInfo.Size() {
+		return src, os.Remove(dst)
+	}
+	return dst, os.Remove(src)
+}
+
+func compress(w io.Writer, r io.Reader, size int64, encoding string) error {
+	switch encoding {
+	case config.MediaCompressionZstd:
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		enc.ResetContentSize(w, size)
+		if _, err = io.Copy(enc, r); err != nil {
+			_ = enc.Close()
+			return err
+		}
+		return enc.Close()
+	case config.MediaCompressionGzip:
+		enc := gzip.NewWriter(w)
+		extra := make([]byte, 0, 12)
+		extra = append(extra, gzipSizeSubfield[:]...)
+		extra = binary.LittleEndian.AppendUint16(extra, 8)
+		enc.Header.Extra = binary.LittleEndian.AppendUint64(extra, uint64(size))
+		if _, err := io.Copy(enc, r); err != nil {
+			_ = enc.Close()
+			return err
+		}
+		return enc.Close()
+	default:
+		return fmt.Errorf("unknown content coding %q", encoding)
+	}
+}
+
+// decompressingReader decompresses the content of a compressed file. Seeking
+// backwards starts decompressing from the start again.
+type decompressingReader struct {
+	raw  io.ReadSeeker
+	gzip *gzip.Reader
+	zstd *zstd.Decoder
+	pos  int64
+	size int64
+}
+
+// newDecompressingReader returns a reader decompressing the raw content, which
+// must be positioned at its start.
+func newDecompressingReader(raw io.ReadSeeker, encoding string) (*decompressingReader, error) {
+	r := &decompressingReader{raw: raw}
+	var err error
+	switch encoding {
+	case config.MediaCompressionZstd:
+		if r.size, err = zstdContentSize(raw); err == nil {
+			r.zstd, err = zstd.NewReader(raw, zstd.WithDecoderConcurrency(1))
+		}
+	case config.MediaCompressionGzip:
+		if r.gzip, err = gzip.NewReader(raw); err != nil {
+			return nil, err
+		}
+		r.size, err = gzipContentSize(r.gzip.Header.Extra)
+	default:
+		err = fmt.Errorf("unknown content coding %q", encoding)
+	}
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// zstdContentSize reads the size of the content from the frame header, leaving
+// raw positioned at its start.
+func zstdContentSize(raw io.ReadSeeker) (int64, error) {
+	header := make([]byte, zstd.HeaderMaxSize)
+	n, err := io.ReadFull(raw, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+	var h zstd.Header
+	if err = h.Decode(header[:n]); err != nil {
+		return 0, err
+	}
+	if !h.HasFCS {
+		return 0, errors.New("zstd frame has no content size")
+	}
+	if _, err = raw.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return int64(h.FrameContentSize), nil
+}
+
+func gzipContentSize(extra []byte) (int64, error) {
+	for len(extra) >= 4 {
+		id := [2]byte{extra[0], extra[1]}
+		length := int(binary.LittleEndian.Uint16(extra[2:4]))
+		extra = extra[4:]
+		if length > len(extra) {
+			break
+		}
+		if id == gzipSizeSubfield && length == 8 {
+			return int64(binary.LittleEndian.Uint64(extra)), nil
+		}
+		extra = extra[length:]
+	}
+	return 0, errors.New("gzip header has no content size")
+}
+
+func (r *decompressingReader) Read(p []byte) (int, error) {
+	var n int
+	var err error
+	if r.zstd != nil {
+		n, err = r.zstd.Read(p)
+	} else {
+		n, err = r.gzip.Read(p)
+	}
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *decompressingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if offset < r.pos {
+		if _, err := r.raw.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		var err error
+		if r.zstd != nil {
+			err = r.zstd.Reset(r.raw)
+		} else {
+			err = r.gzip.Reset(r.raw)
+		}
+		if err != nil {
+			return 0, err
+		}
+		r.pos = 0
+	}
+	if _, err := io.CopyN(io.Discard, r, offset-r.pos); err != nil && err != io.EOF {
+		return 0, err
+	}
+	return offset, nil
+}
+
+func (r *decompressingReader) Close() {
+	if r.zstd != nil {
+		r.zstd.Close()
+	}
+}
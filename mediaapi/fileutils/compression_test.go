@@ -0,0 +1,138 @@
+package fileutils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressedStoredFile(t *testing.T) {
+	content := []byte(strings.Repeat(`{"level":"info","msg":"compress me"}`+"\n", 500))
+	for _, algorithm := range []string{config.MediaCompressionZstd, config.MediaCompressionGzip} {
+		for _, encrypted := range []bool{false, true} {
+			var encryption *Encryption
+			if encrypted {
+				encryption = newTestEncryption(t, true)
+			}
+			compression := NewCompression(&config.MediaCompression{
+				Algorithm:    algorithm,
+				ContentTypes: []string{"text/*", "application/json"},
+			})
+			base := config.Path(t.TempDir())
+
+			hash, size, tmpDir, err := WriteTempFile(context.Background(), bytes.NewReader(content), 0, base, nil, encryption)
+			assert.NoError(t, err)
+			metadata := &types.MediaMetadata{
+				Base64Hash:    hash,
+				FileSizeBytes: size,
+				ContentType:   "application/json; charset=utf-8",
+			}
+			finalPath, duplicate, err := MoveFileWithHashCheck(context.Background(), tmpDir, metadata, base, config.LegacyMediaStoreLayout, encryption, compression, false, logrus.NewEntry(logrus.New()))
+			assert.NoError(t, err)
+			assert.False(t, duplicate)
+			assert.Equal(t, algorithm, metadata.StoredEncoding)
+			assert.Equal(t, algorithm, StoredEncoding(string(finalPath)))
+
+			// The compressed file is found from the hash, and read decompressed.
+			path, err := GetPathFromBase64Hash(hash, base, config.LegacyMediaStoreLayout)
+			assert.NoError(t, err)
+			assert.Equal(t, string(finalPath), path)
+			info, err := os.Stat(path)
+			assert.NoError(t, err)
+			assert.Less(t, info.Size(), int64(len(content)))
+
+			f, err := OpenStoredFile(path, encryption)
+			assert.NoError(t, err)
+			assert.EqualValues(t, len(content), f.Size())
+			assert.Equal(t, algorithm, f.ContentEncoding())
+			read, err := io.ReadAll(f)
+			assert.NoError(t, err)
+			assert.Equal(t, content, read)
+
+			// Seeking backwards decompresses from the start again.
+			for _, offset := range []int64{1000, 10, int64(len(content)) - 5} {
+				pos, err := f.Seek(offset, io.SeekStart)
+				assert.NoError(t, err)
+				assert.Equal(t, offset, pos)
+				buf := make([]byte, 5)
+				_, err = io.ReadFull(f, buf)
+				assert.NoError(t, err)
+				assert.Equal(t, content[offset:offset+5], buf)
+			}
+
+			// The compressed content is a standard stream of its content coding.
+			compressed, compressedSize, err := f.CompressedReader()
+			assert.NoError(t, err)
+			raw, err := io.ReadAll(compressed)
+			assert.NoError(t, err)
+			assert.EqualValues(t, len(raw), compressedSize)
+			assert.Equal(t, content, decompressForTest(t, algorithm, raw))
+			assert.NoError(t, f.Close())
+
+			// Storing the same content again finds the compressed file.
+			_, _, tmpDir, err = WriteTempFile(context.Background(), bytes.NewReader(content), 0, base, nil, encryption)
+			assert.NoError(t, err)
+			metadata = &types.MediaMetadata{Base64Hash: hash, FileSizeBytes: size, ContentType: "application/octet-stream"}
+			duplicatePath, duplicate, err := MoveFileWithHashCheck(context.Background(), tmpDir, metadata, base, config.LegacyMediaStoreLayout, encryption, nil, false, logrus.NewEntry(logrus.New()))
+			assert.NoError(t, err)
+			assert.True(t, duplicate)
+			assert.Equal(t, finalPath, duplicatePath)
+			assert.Equal(t, algorithm, metadata.StoredEncoding)
+		}
+	}
+}
+
+func TestCompressionSkipsFiles(t *testing.T) {
+	base := config.Path(t.TempDir())
+	compression := NewCompression(&config.MediaCompression{
+		Algorithm:    config.MediaCompressionZstd,
+		ContentTypes: []string{"text/*"},
+	})
+	for name, tc := range map[string]struct {
+		content     []byte
+		contentType types.ContentType
+	}{
+		"not compressible type": {content: bytes.Repeat([]byte("a"), 1000), contentType: "image/png"},
+		"not smaller":           {content: []byte("a"), contentType: "text/plain"},
+	} {
+		hash, size, tmpDir, err := WriteTempFile(context.Background(), bytes.NewReader(tc.content), 0, base, nil, nil)
+		assert.NoError(t, err, name)
+		metadata := &types.MediaMetadata{Base64Hash: hash, FileSizeBytes: size, ContentType: tc.contentType}
+		finalPath, _, err := MoveFileWithHashCheck(context.Background(), tmpDir, metadata, base, config.LegacyMediaStoreLayout, nil, compression, false, logrus.NewEntry(logrus.New()))
+		assert.NoError(t, err, name)
+		assert.Equal(t, "file", filepath.Base(string(finalPath)), name)
+		assert.Equal(t, "", metadata.StoredEncoding, name)
+		read, err := ReadStoredFile(string(finalPath), nil)
+		assert.NoError(t, err, name)
+		assert.Equal(t, tc.content, read, name)
+	}
+}
+
+func decompressForTest(t *testing.T, algorithm string, raw []byte) []byte {
+	var r io.Reader
+	switch algorithm {
+	case config.MediaCompressionZstd:
+		dec, err := zstd.NewReader(bytes.NewReader(raw))
+		assert.NoError(t, err)
+		defer dec.Close()
+		r = dec
+	case config.MediaCompressionGzip:
+		dec, err := gzip.NewReader(bytes.NewReader(raw))
+		assert.NoError(t, err)
+		r = dec
+	}
+	content, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	return content
+}
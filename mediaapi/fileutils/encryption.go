@@ -0,0 +1,568 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileutils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// Encrypted files start with a header holding the key of the file, wrapped by
+// the master key, and a nonce prefix:
+//
+//	magic (8 bytes) | wrapped key length (2 bytes) | wrapped key | nonce prefix (12 bytes)
+//
+// followed by the content split into chunks of encryptedChunkSize bytes, each
+// sealed with AES-256-GCM. The nonce of a chunk is the prefix XORed with its
+// index, and the last chunk is marked in its additional data, so that chunks
+// can't be reordered or the file truncated. Every chunk is authenticated before
+// any of it is returned, while still allowing seeking, e.g. for range requests.
+const encryptedFileMagic = "DMEDIA\x00\x02"
+
+// encryptedFileMagicPrefix is shared by all versions of the header.
+const encryptedFileMagicPrefix = "DMEDIA\x00"
+
+const (
+	fileKeySize          = 32
+	maxWrappedKeySize    = 1024
+	encryptedNonceSize   = 12
+	encryptedHeaderFixed = len(encryptedFileMagic) + 2 + encryptedNonceSize
+	encryptedChunkSize   = 64 * 1024
+)
+
+// KeyWrapper wraps and unwraps the keys of encrypted files with a master key,
+// which may be held by a key management service.
+type KeyWrapper interface {
+	WrapKey(fileKey []byte) ([]byte, error)
+	UnwrapKey(wrappedKey []byte) ([]byte, error)
+}
+
+// masterKeyWrapper wraps keys with AES-256-GCM using a master key from the config.
+type masterKeyWrapper struct {
+	aead cipher.AEAD
+}
+
+// NewMasterKeyWrapper returns a KeyWrapper using the 32 byte master key.
+func NewMasterKeyWrapper(masterKey []byte) (KeyWrapper, error) {
+	if len(masterKey) != config.MediaMasterKeySize {
+		return nil, fmt.Errorf("the master key must be %d bytes", config.MediaMasterKeySize)
+	}
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &masterKeyWrapper{aead: aead}, nil
+}
+
+func (w *masterKeyWrapper) WrapKey(fileKey []byte) ([]byte, error) {
+	nonce := make([]byte, w.aead.NonceSize(), w.aead.NonceSize()+len(fileKey)+w.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return w.aead.Seal(nonce, nonce, fileKey, []byte(encryptedFileMagic)), nil
+}
+
+func (w *masterKeyWrapper) UnwrapKey(wrappedKey []byte) ([]byte, error) {
+	if len(wrappedKey) < w.aead.NonceSize() {
+		return nil, errors.New("wrapped key too short")
+	}
+	nonce, sealed := wrappedKey[:w.aead.NonceSize()], wrappedKey[w.aead.NonceSize():]
+	return w.aead.Open(nil, nonce, sealed, []byte(encryptedFileMagic))
+}
+
+// Encryption encrypts media files at rest. A nil *Encryption stores files in
+// plain text, and can only read files stored in plain text.
+type Encryption struct {
+	wrapper         KeyWrapper
+	encryptNewFiles bool
+}
+
+// NewEncryption returns the encryption configured for the media store, or nil
+// if there is no master key.
+func NewEncryption(cfg *config.MediaEncryption) (*Encryption, error) {
+	if len(cfg.MasterKey) == 0 {
+		return nil, nil
+	}
+	wrapper, err := NewMasterKeyWrapper(cfg.MasterKey)
+	if err != nil {
+		return nil, err
+	}
+	return NewEncryptionWithKeyWrapper(wrapper, cfg.Enabled), nil
+}
+
+// NewEncryptionWithKeyWrapper returns an encryption using the key wrapper. New
+// files are only encrypted if encryptNewFiles is set, files encrypted before
+// are always decrypted.
+func NewEncryptionWithKeyWrapper(wrapper KeyWrapper, encryptNewFiles bool) *Encryption {
+	return &Encryption{
+		wrapper:         wrapper,
+		encryptNewFiles: encryptNewFiles,
+	}
+}
+
+// newWriter returns a writer that encrypts what is written to it into w, after
+// writing the header of the file. It must be closed to write the last chunk,
+// which doesn't close w. If new files aren't encrypted, w is written to as it is.
+func (e *Encryption) newWriter(w io.Writer) (io.WriteCloser, error) {
+	if e == nil || !e.encryptNewFiles {
+		return nopWriteCloser{w}, nil
+	}
+	fileKey := make([]byte, fileKeySize)
+	noncePrefix := make([]byte, encryptedNonceSize)
+	if _, err := rand.Read(fileKey); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(noncePrefix); err != nil {
+		return nil, err
+	}
+	wrappedKey, err := e.wrapper.WrapKey(fileKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap file key: %w", err)
+	}
+	if len(wrappedKey) > maxWrappedKeySize {
+		return nil, fmt.Errorf("wrapped file key too long (%d bytes)", len(wrappedKey))
+	}
+	aead, err := newChunkAEAD(fileKey)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, encryptedHeaderFixed+len(wrappedKey))
+	header = append(header, encryptedFileMagic...)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(wrappedKey)))
+	header = append(header, wrappedKey...)
+	header = append(header, noncePrefix...)
+	if _, err = w.Write(header); err != nil {
+		return nil, err
+	}
+	return &chunkWriter{
+		w:           w,
+		aead:        aead,
+		noncePrefix: noncePrefix,
+		buf:         make([]byte, 0, encryptedChunkSize),
+	}, nil
+}
+
+// readHeader reads the header of an encrypted file, returning the file key,
+// the nonce prefix and the length of the header. If the file isn't encrypted,
+// a nil key is returned. The file must be positioned at its start.
+func (e *Encryption) readHeader(file io.Reader) (fileKey, noncePrefix []byte, headerLength int64, err error) {
+	fixed := make([]byte, len(encryptedFileMagic)+2)
+	if _, err = io.ReadFull(file, fixed); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, nil, 0, nil
+		}
+		return nil, nil, 0, err
+	}
+	if string(fixed[:len(encryptedFileMagicPrefix)]) != encryptedFileMagicPrefix {
+		return nil, nil, 0, nil
+	}
+	// From here on the file is taken to be encrypted, so it is never served as
+	// it is if it can't be decrypted.
+	if string(fixed[:len(encryptedFileMagic)]) != encryptedFileMagic {
+		return nil, nil, 0, errors.New("unsupported version of encrypted file")
+	}
+	wrappedKeyLength := int(binary.BigEndian.Uint16(fixed[len(encryptedFileMagic):]))
+	if wrappedKeyLength > maxWrappedKeySize {
+		return nil, nil, 0, fmt.Errorf("wrapped file key too long (%d bytes)", wrappedKeyLength)
+	}
+	rest := make([]byte, wrappedKeyLength+encryptedNonceSize)
+	if _, err = io.ReadFull(file, rest); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, nil, 0, errors.New("encrypted file header is truncated")
+		}
+		return nil, nil, 0, err
+	}
+	fileKey, err = e.wrapper.UnwrapKey(rest[:wrappedKeyLength])
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("failed to unwrap file key: %w", err)
+	}
+	if len(fileKey) != fileKeySize {
+		return nil, nil, 0, fmt.Errorf("unwrapped file key has the wrong size (%d bytes)", len(fileKey))
+	}
+	return fileKey, rest[wrappedKeyLength:], int64(encryptedHeaderFixed + wrappedKeyLength), nil
+}
+
+// StoredFile is a file in the media store, which is decrypted and decompressed
+// while it is read if it was encrypted or compressed.
+type StoredFile struct {
+	// The file in the media store, nil if the content was read from the file cache.
+	file   *os.File
+	reader io.ReadSeeker
+	size   int64
+	// The compressed content of compressed files, and its content coding.
+	compressed     io.ReadSeeker
+	compressedSize int64
+	encoding       string
+	decompressor   *decompressingReader
+}
+
+// OpenStoredFile opens a file in the media store for reading.
+func OpenStoredFile(path string, encryption *Encryption) (*StoredFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close() // nolint: errcheck
+		return nil, err
+	}
+	f := &StoredFile{
+		file:   file,
+		reader: file,
+		size:   stat.Size(),
+	}
+	if err = f.decrypt(encryption); err != nil {
+		file.Close() // nolint: errcheck
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if err = f.decompress(StoredEncoding(path)); err != nil {
+		file.Close() // nolint: errcheck
+		return nil, fmt.Errorf("failed to decompress %s: %w", path, err)
+	}
+	return f, nil
+}
+
+// decrypt makes the file decrypt its content while it is read, if it was
+// encrypted.
+func (f *StoredFile) decrypt(encryption *Encryption) error {
+	if encryption == nil {
+		return nil
+	}
+	fileKey, noncePrefix, headerLength, err := encryption.readHeader(f.file)
+	if err != nil {
+		return err
+	}
+	if fileKey == nil {
+		_, err = f.file.Seek(0, io.SeekStart)
+		return err
+	}
+	aead, err := newChunkAEAD(fileKey)
+	if err != nil {
+		return err
+	}
+	r, err := newChunkReader(f.file, headerLength, f.size-headerLength, aead, noncePrefix)
+	if err != nil {
+		return err
+	}
+	f.size, f.reader = r.size, r
+	return nil
+}
+
+// decompress makes the file decompress its content while it is read.
+func (f *StoredFile) decompress(encoding string) error {
+	if encoding == "" {
+		return nil
+	}
+	decompressor, err := newDecompressingReader(f.reader, encoding)
+	if err != nil {
+		return err
+	}
+	f.compressed, f.encoding = f.reader, encoding
+	f.compressedSize = f.size
+	f.reader, f.decompressor = decompressor, decompressor
+	f.size = decompressor.size
+	return nil
+}
+
+// Size returns the size of the content of the file.
+func (f *StoredFile) Size() int64 {
+	return f.size
+}
+
+func (f *StoredFile) Read(p []byte) (int, error) {
+	return f.reader.Read(p)
+}
+
+func (f *StoredFile) Seek(offset int64, whence int) (int64, error) {
+	return f.reader.Seek(offset, whence)
+}
+
+// WriteTo lets io.Copy send files stored in plain text with sendfile.
+func (f *StoredFile) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, f.reader)
+}
+
+// ContentEncoding returns the content coding the file was compressed with, or
+// "" if it isn't compressed.
+func (f *StoredFile) ContentEncoding() string {
+	return f.encoding
+}
+
+// CompressedReader returns a reader of the content as it was compressed, and
+// its size, so that it can be served with its content coding. The file must
+// not be read otherwise afterwards.
+func (f *StoredFile) CompressedReader() (io.Reader, int64, error) {
+	if f.encoding == "" {
+		return nil, 0, errors.New("file isn't compressed")
+	}
+	if _, err := f.compressed.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	return f.compressed, f.compressedSize, nil
+}
+
+func (f *StoredFile) Close() error {
+	if f.decompressor != nil {
+		f.decompressor.Close()
+	}
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
+
+// StoredFileSize returns the size of the content of a file in the media store.
+func StoredFileSize(path string, encryption *Encryption) (int64, error) {
+	f, err := OpenStoredFile(path, encryption)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close() // nolint: errcheck
+	return f.Size(), nil
+}
+
+// ReadStoredFile reads the content of a file in the media store.
+func ReadStoredFile(path string, encryption *Encryption) ([]byte, error) {
+	f, err := OpenStoredFile(path, encryption)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // nolint: errcheck
+	return io.ReadAll(f)
+}
+
+// CreateStoredFile creates a file in the media store, e.g. a thumbnail, which
+// is encrypted if encryption is enabled. The file must be closed to finish it.
+func CreateStoredFile(path string, encryption *Encryption) (io.WriteCloser, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w, err := encryption.newWriter(file)
+	if err != nil {
+		file.Close() // nolint: errcheck
+		return nil, err
+	}
+	return &storedFileWriter{WriteCloser: w, file: file}, nil
+}
+
+type storedFileWriter struct {
+	io.WriteCloser
+	file *os.File
+}
+
+func (w *storedFileWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		w.file.Close() // nolint: errcheck
+		return err
+	}
+	return w.file.Close()
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func newChunkAEAD(fileKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of the chunk with the given index.
+func chunkNonce(noncePrefix []byte, index uint64) []byte {
+	nonce := make([]byte, encryptedNonceSize)
+	copy(nonce, noncePrefix)
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], index)
+	for i := range counter {
+		nonce[encryptedNonceSize-8+i] ^= counter[i]
+	}
+	return nonce
+}
+
+// chunkAdditionalData marks the last chunk of a file.
+func chunkAdditionalData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// chunkWriter seals what is written to it in chunks. A full chunk is only
+// sealed once more is written, so that Close can mark the last chunk.
+type chunkWriter struct {
+	w           io.Writer
+	aead        cipher.AEAD
+	noncePrefix []byte
+	index       uint64
+	buf         []byte
+	sealed      []byte
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(w.buf) == encryptedChunkSize {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):encryptedChunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals the last chunk, which is empty if nothing was written.
+func (w *chunkWriter) Close() error {
+	return w.seal(true)
+}
+
+func (w *chunkWriter) seal(last bool) error {
+	w.sealed = w.aead.Seal(w.sealed[:0], chunkNonce(w.noncePrefix, w.index), w.buf, chunkAdditionalData(last))
+	if _, err := w.w.Write(w.sealed); err != nil {
+		return err
+	}
+	w.index++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// chunkReader opens the chunks of an encrypted file as they are read. Chunks
+// are read at their offset, so seeking doesn't touch the file.
+type chunkReader struct {
+	file        io.ReaderAt
+	start       int64 // where the first chunk starts in the file
+	size        int64 // the size of the content
+	chunks      int64
+	lastSize    int64 // the size of the last sealed chunk
+	aead        cipher.AEAD
+	noncePrefix []byte
+	pos         int64
+	index       int64 // the index of the chunk in buf, -1 if none
+	buf         []byte
+	sealed      []byte
+}
+
+func newChunkReader(file io.ReaderAt, start, sealedSize int64, aead cipher.AEAD, noncePrefix []byte) (*chunkReader, error) {
+	overhead := int64(aead.Overhead())
+	sealedChunkSize := int64(encryptedChunkSize) + overhead
+	chunks := (sealedSize + sealedChunkSize - 1) / sealedChunkSize
+	if chunks == 0 {
+		return nil, errors.New("encrypted file has no content")
+	}
+	lastSize := sealedSize - (chunks-1)*sealedChunkSize
+	if lastSize < overhead {
+		return nil, errors.New("encrypted file is truncated")
+	}
+	r := &chunkReader{
+		file:        file,
+		start:       start,
+		size:        sealedSize - chunks*overhead,
+		chunks:      chunks,
+		lastSize:    lastSize,
+		aead:        aead,
+		noncePrefix: noncePrefix,
+		index:       -1,
+	}
+	if r.size == 0 {
+		// Nothing will be read, but the file should still be authentic.
+		if err := r.open(0); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// open reads and authenticates the chunk with the given index into buf.
+func (r *chunkReader) open(index int64) error {
+	if index == r.index {
+		return nil
+	}
+	sealedChunkSize := int64(encryptedChunkSize) + int64(r.aead.Overhead())
+	size := sealedChunkSize
+	last := index == r.chunks-1
+	if last {
+		size = r.lastSize
+	}
+	if int64(cap(r.sealed)) < size {
+		r.sealed = make([]byte, sealedChunkSize)
+	}
+	r.sealed = r.sealed[:size]
+	if _, err := r.file.ReadAt(r.sealed, r.start+index*sealedChunkSize); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	r.index = -1
+	buf, err := r.aead.Open(r.buf[:0], chunkNonce(r.noncePrefix, uint64(index)), r.sealed, chunkAdditionalData(last))
+	if err != nil {
+		return fmt.Errorf("failed to authenticate chunk %d of encrypted file: %w", index, err)
+	}
+	r.buf, r.index = buf, index
+	return nil
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	index := r.pos / encryptedChunkSize
+	if err := r.open(index); err != nil {
+		return 0, err
+	}
+	n := copy(p, r.buf[r.pos-index*encryptedChunkSize:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
@@ -0,0 +1,152 @@
+package fileutils
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestEncryption(t *testing.T, enabled bool) *Encryption {
+	encryption, err := NewEncryption(&config.MediaEncryption{
+		Enabled:   enabled,
+		MasterKey: bytes.Repeat([]byte{1}, config.MediaMasterKeySize),
+	})
+	assert.NoError(t, err)
+	return encryption
+}
+
+func TestEncryptedStoredFile(t *testing.T) {
+	base := config.Path(t.TempDir())
+	encryption := newTestEncryption(t, true)
+	// Large enough to be split into several chunks.
+	content := []byte(strings.Repeat("The quick brown fox jumps over the lazy dog. ", 2000))
+
+	hash, size, tmpDir, err := WriteTempFile(context.Background(), bytes.NewReader(content), 0, base, nil, encryption)
+	assert.NoError(t, err)
+	sum := sha256.Sum256(content)
+	assert.Equal(t, types.Base64Hash(base64.RawURLEncoding.EncodeToString(sum[:])), hash, "hash must be of the plain text")
+	assert.EqualValues(t, len(content), size)
+
+	path := filepath.Join(string(tmpDir), "content")
+	onDisk, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.False(t, bytes.Contains(onDisk, content[:32]), "file must be encrypted on disk")
+
+	f, err := OpenStoredFile(path, encryption)
+	assert.NoError(t, err)
+	defer f.Close() // nolint: errcheck
+	assert.EqualValues(t, len(content), f.Size())
+	read, err := io.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, content, read)
+
+	// Seeking works within and across chunks.
+	for _, offset := range []int64{0, 5, 16, 17, 255, 1000, encryptedChunkSize - 20, encryptedChunkSize, 70000, int64(len(content)) - 1} {
+		pos, err := f.Seek(offset, io.SeekStart)
+		assert.NoError(t, err)
+		assert.Equal(t, offset, pos)
+		buf := make([]byte, 40)
+		n, err := io.ReadFull(f, buf)
+		if err != io.ErrUnexpectedEOF {
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, content[offset:offset+int64(n)], buf[:n], "offset %d", offset)
+	}
+	pos, err := f.Seek(-10, io.SeekEnd)
+	assert.NoError(t, err)
+	assert.EqualValues(t, len(content)-10, pos)
+	read, err = io.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, content[len(content)-10:], read)
+
+	// Without the master key the file can't be read as it was.
+	f2, err := OpenStoredFile(path, nil)
+	assert.NoError(t, err)
+	defer f2.Close() // nolint: errcheck
+	assert.NotEqual(t, int64(len(content)), f2.Size())
+
+	// Modified content is never returned.
+	tampered := bytes.Clone(onDisk)
+	tampered[len(tampered)-100] ^= 1
+	tamperedPath := filepath.Join(string(tmpDir), "tampered")
+	assert.NoError(t, os.WriteFile(tamperedPath, tampered, 0600))
+	f3, err := OpenStoredFile(tamperedPath, encryption)
+	assert.NoError(t, err)
+	defer f3.Close() // nolint: errcheck
+	read, err = io.ReadAll(f3)
+	assert.Error(t, err)
+	assert.Equal(t, content[:encryptedChunkSize], read, "only the authentic chunk is returned")
+
+	// Nor can the file be truncated at a chunk boundary.
+	sealedChunkSize := encryptedChunkSize + 16
+	truncatedPath := filepath.Join(string(tmpDir), "truncated")
+	assert.NoError(t, os.WriteFile(truncatedPath, onDisk[:len(onDisk)-(len(onDisk)-encryptedHeaderFixed)%sealedChunkSize], 0600))
+	_, err = ReadStoredFile(truncatedPath, encryption)
+	assert.Error(t, err)
+}
+
+func TestPlainStoredFile(t *testing.T) {
+	dir := t.TempDir()
+	encryption := newTestEncryption(t, true)
+
+	// Files stored before encryption was enabled are read as they are.
+	for name, content := range map[string][]byte{
+		"plain": []byte("hello world"),
+		"empty": {},
+	} {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.WriteFile(path, content, 0600))
+		read, err := ReadStoredFile(path, encryption)
+		assert.NoError(t, err, name)
+		assert.Equal(t, content, read, name)
+		size, err := StoredFileSize(path, encryption)
+		assert.NoError(t, err, name)
+		assert.EqualValues(t, len(content), size, name)
+	}
+
+	// Files that look encrypted but can't be decrypted are never served as
+	// they are.
+	for name, content := range map[string][]byte{
+		"magic":   append([]byte(encryptedFileMagic+"\x00\x04abcd"), bytes.Repeat([]byte("x"), 32)...),
+		"version": append([]byte(encryptedFileMagicPrefix+"\x01\x00\x04abcd"), bytes.Repeat([]byte("x"), 32)...),
+	} {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.WriteFile(path, content, 0600))
+		_, err := ReadStoredFile(path, encryption)
+		assert.Error(t, err, name)
+	}
+
+	// With encryption disabled, new files are stored in plain text but files
+	// that were encrypted are still decrypted.
+	encryptedPath := filepath.Join(dir, "encrypted")
+	w, err := CreateStoredFile(encryptedPath, encryption)
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("secret"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	disabled := newTestEncryption(t, false)
+	plainPath := filepath.Join(dir, "new")
+	w, err = CreateStoredFile(plainPath, disabled)
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("not secret"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	onDisk, err := os.ReadFile(plainPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "not secret", string(onDisk))
+
+	read, err := ReadStoredFile(encryptedPath, disabled)
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", string(read))
+}
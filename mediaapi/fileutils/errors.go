@@ -0,0 +1,85 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileutils
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// ErrHashBlocked is returned by WriteTempFile if the hash of the file is blocked.
+var ErrHashBlocked = errors.New("file is blocked")
+
+// FileTooLargeError is returned if a file is larger than the configured maximum size.
+type FileTooLargeError struct {
+	// The configured maximum size.
+	Limit config.FileSizeBytes
+	// The size of the file, if it is known, or 0.
+	Size int64
+}
+
+func (e *FileTooLargeError) Error() string {
+	if e.Size > 0 {
+		return fmt.Sprintf("file is too large (%d > %d bytes)", e.Size, e.Limit)
+	}
+	return fmt.Sprintf("file is larger than the maximum size of %d bytes", e.Limit)
+}
+
+// InvalidHashError is returned if a file can't be stored under its Base64Hash.
+type InvalidHashError struct {
+	Hash   types.Base64Hash
+	Reason string
+}
+
+func (e *InvalidHashError) Error() string {
+	return fmt.Sprintf("invalid filePath (%s): %q", e.Reason, e.Hash)
+}
+
+// PathEscapeError is returned if the path of a file would be outside of the media store.
+type PathEscapeError struct {
+	Path        string
+	AbsBasePath config.Path
+}
+
+func (e *PathEscapeError) Error() string {
+	return fmt.Sprintf("invalid filePath (not within absBasePath %v): %v", e.AbsBasePath, e.Path)
+}
+
+// HashCollisionError is returned by MoveFileWithHashCheck if a file is already
+// stored with the same hash but a different content.
+type HashCollisionError struct {
+	// The path of the stored file.
+	Path string
+	// The size of the new file.
+	Size types.FileSizeBytes
+	// The size of the stored file, if it could be read.
+	StoredSize int64
+	// Why the stored file couldn't be read, if it couldn't.
+	Err error
+}
+
+func (e *HashCollisionError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("downloaded file with hash collision but unreadable stored file (%v): %v", e.Path, e.Err)
+	}
+	return fmt.Sprintf("downloaded file with hash collision but different file size (%v: %d != %d bytes)", e.Path, e.StoredSize, e.Size)
+}
+
+func (e *HashCollisionError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,145 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileutils
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"sync"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	fileCacheLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "mediaapi",
+			Name:      "file_cache_lookups_total",
+			Help:      "The number of media files opened by whether they were read from the file cache",
+		},
+		[]string{"result"},
+	)
+	fileCacheSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "dendrite",
+			Subsystem: "mediaapi",
+			Name:      "file_cache_size_bytes",
+			Help:      "The total size of the media files in the file cache",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(fileCacheLookups, fileCacheSize)
+}
+
+// FileCache is a least recently used cache of the content of small files in
+// the media store, by path. As files are stored by their hash, the content of a
+// path never changes, so cached files are only ever evicted to make space.
+type FileCache struct {
+	maxFileSize int64
+	maxSize     int64
+
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+	// The entries, most recently used first.
+	order *list.List
+}
+
+type fileCacheEntry struct {
+	path string
+	data []byte
+}
+
+// NewFileCache returns a file cache as configured, or nil if it is disabled.
+func NewFileCache(cfg *config.MediaFileCache) *FileCache {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &FileCache{
+		maxFileSize: int64(cfg.MaxFileSizeBytes),
+		maxSize:     int64(cfg.MaxSizeBytes),
+		entries:     make(map[string]*list.Element),
+		order:       list.New(),
+	}
+}
+
+// OpenStoredFile returns the cached content of the file at the path, or else
+// opens it with open and caches its content if it is small enough. A nil
+// *FileCache just opens the file.
+func (c *FileCache) OpenStoredFile(path string, open func(path string) (*StoredFile, error)) (*StoredFile, error) {
+	if c == nil {
+		return open(path)
+	}
+	if data, ok := c.get(path); ok {
+		fileCacheLookups.WithLabelValues("hit").Inc()
+		return newCachedStoredFile(data), nil
+	}
+	fileCacheLookups.WithLabelValues("miss").Inc()
+
+	file, err := open(path)
+	if err != nil || file.Size() > c.maxFileSize {
+		return file, err
+	}
+	defer file.Close() // nolint: errcheck
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	c.set(path, data)
+	return newCachedStoredFile(data), nil
+}
+
+func (c *FileCache) get(path string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[path]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*fileCacheEntry).data, true
+}
+
+func (c *FileCache) set(path string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[path]; ok {
+		return
+	}
+	c.entries[path] = c.order.PushFront(&fileCacheEntry{path: path, data: data})
+	c.size += int64(len(data))
+	for c.size > c.maxSize {
+		element := c.order.Back()
+		entry := element.Value.(*fileCacheEntry)
+		c.order.Remove(element)
+		delete(c.entries, entry.path)
+		c.size -= int64(len(entry.data))
+	}
+	fileCacheSize.Set(float64(c.size))
+}
+
+// newCachedStoredFile returns a stored file reading the content of a file in
+// the file cache, which mustn't be changed.
+func newCachedStoredFile(data []byte) *StoredFile {
+	return &StoredFile{
+		reader: bytes.NewReader(data),
+		size:   int64(len(data)),
+	}
+}
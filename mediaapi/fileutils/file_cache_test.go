@@ -0,0 +1,61 @@
+package fileutils
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileCache(t *testing.T) {
+	dir := t.TempDir()
+	for name, size := range map[string]int{"a": 4, "b": 4, "c": 4, "large": 16} {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), make([]byte, size), 0660))
+	}
+	cache := NewFileCache(&config.MediaFileCache{Enabled: true, MaxFileSizeBytes: 8, MaxSizeBytes: 8})
+
+	opened := map[string]int{}
+	read := func(name string) {
+		t.Helper()
+		file, err := cache.OpenStoredFile(filepath.Join(dir, name), func(path string) (*StoredFile, error) {
+			opened[name]++
+			return OpenStoredFile(path, nil)
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer file.Close() // nolint: errcheck
+		content, err := io.ReadAll(file)
+		assert.NoError(t, err)
+		assert.Equal(t, file.Size(), int64(len(content)))
+	}
+
+	// Small files are only opened the first time they are read.
+	read("a")
+	read("a")
+	read("b")
+	assert.Equal(t, map[string]int{"a": 1, "b": 1}, opened)
+
+	// Large files aren't cached.
+	read("large")
+	read("large")
+	assert.Equal(t, 2, opened["large"])
+
+	// The least recently used files are evicted once the cache is full.
+	read("a")
+	read("c")
+	read("a")
+	read("b")
+	assert.Equal(t, map[string]int{"a": 1, "b": 2, "c": 1, "large": 2}, opened)
+	assert.Equal(t, int64(8), cache.size)
+
+	// Files that don't exist aren't cached.
+	file, err := cache.OpenStoredFile(filepath.Join(dir, "missing"), func(path string) (*StoredFile, error) {
+		return OpenStoredFile(path, nil)
+	})
+	assert.Nil(t, file)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
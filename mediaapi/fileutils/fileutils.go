@@ -19,78 +19,273 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"syscall"
 
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/mediaapi/workers"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/util"
 	log "github.com/sirupsen/logrus"
 )
 
 // GetPathFromBase64Hash evaluates the path to a media file from its Base64Hash
-// 3 subdirectories are created for more manageable browsing and use the remainder as the file name.
-// For example, if Base64Hash is 'qwerty', the path will be 'q/w/erty/file'.
-func GetPathFromBase64Hash(base64Hash types.Base64Hash, absBasePath config.Path) (string, error) {
-	if len(base64Hash) < 3 {
-		return "", fmt.Errorf("invalid filePath (Base64Hash too short - min 3 characters): %q", base64Hash)
+// The first characters of the hash are used as subdirectories for more manageable browsing, as
+// configured by the layout, and the remainder as the directory holding the file.
+// For example, if Base64Hash is 'qwerty', the path will be 'q/w/erty/file' with the version 1
+// layout, and 'qw/er/ty/file' with two levels of two characters.
+// Files that were stored under the version 1 layout before switching to another layout are still
+// found: their path is returned if the file doesn't exist under the configured layout.
+// The path of a compressed file has the suffix of its content coding, e.g. 'qw/er/ty/file.zst'.
+func GetPathFromBase64Hash(base64Hash types.Base64Hash, absBasePath config.Path, layout config.MediaStoreLayout) (string, error) {
+	filePath, err := layoutPath(base64Hash, absBasePath, layout)
+	if err != nil {
+		return "", err
+	}
+	if storedPath, ok := findStoredFile(filepath.Dir(filePath)); ok || layout.IsLegacy() {
+		return storedPath, nil
+	}
+	if legacyPath, legacyErr := layoutPath(base64Hash, absBasePath, config.LegacyMediaStoreLayout); legacyErr == nil {
+		if storedPath, ok := findStoredFile(filepath.Dir(legacyPath)); ok {
+			return storedPath, nil
+		}
+	}
+	return filePath, nil
+}
+
+// layoutPath returns the path to a media file under the given layout.
+func layoutPath(base64Hash types.Base64Hash, absBasePath config.Path, layout config.MediaStoreLayout) (string, error) {
+	depth, width := layout.Levels()
+	if minLength := depth*width + 1; len(base64Hash) < minLength {
+		return "", &InvalidHashError{Hash: base64Hash, Reason: fmt.Sprintf("Base64Hash too short - min %d characters", minLength)}
 	}
 	if len(base64Hash) > 255 {
-		return "", fmt.Errorf("invalid filePath (Base64Hash too long - max 255 characters): %q", base64Hash)
+		return "", &InvalidHashError{Hash: base64Hash, Reason: "Base64Hash too long - max 255 characters"}
 	}
 
-	filePath, err := filepath.Abs(filepath.Join(
-		string(absBasePath),
-		string(base64Hash[0:1]),
-		string(base64Hash[1:2]),
-		string(base64Hash[2:]),
-		"file",
-	))
+	elems := make([]string, 0, depth+3)
+	elems = append(elems, string(absBasePath))
+	for i := 0; i < depth; i++ {
+		elems = append(elems, string(base64Hash[i*width:(i+1)*width]))
+	}
+	elems = append(elems, string(base64Hash[depth*width:]), storedFileName)
+	filePath, err := filepath.Abs(filepath.Join(elems...))
 	if err != nil {
 		return "", fmt.Errorf("unable to construct filePath: %w", err)
 	}
 
-	// check if the absolute absBasePath is a prefix of the absolute filePath
-	// if so, no directory escape has occurred and the filePath is valid
+	// check that the filePath is within absBasePath, so that no directory
+	// escape has occurred and the filePath is valid
 	// Note: absBasePath is already absolute
-	if !strings.HasPrefix(filePath, string(absBasePath)) {
-		return "", fmt.Errorf("invalid filePath (not within absBasePath %v): %v", absBasePath, filePath)
+	if err = checkWithinBasePath(filePath, absBasePath); err != nil {
+		return "", err
 	}
 
 	return filePath, nil
 }
 
+// checkWithinBasePath returns a *PathEscapeError unless path is inside absBasePath,
+// both as it is and once the symbolic links in both have been resolved, so that a
+// symbolic link in the media store can't point outside of it. path doesn't need
+// to exist yet.
+func checkWithinBasePath(path string, absBasePath config.Path) error {
+	if !isWithin(string(absBasePath), path) {
+		return &PathEscapeError{Path: path, AbsBasePath: absBasePath}
+	}
+	base, err := filepath.EvalSymlinks(string(absBasePath))
+	if errors.Is(err, fs.ErrNotExist) {
+		// Nothing has been stored yet, so there can't be any symbolic links.
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to resolve absBasePath: %w", err)
+	}
+	resolved, err := evalExistingSymlinks(path)
+	if err != nil {
+		return fmt.Errorf("unable to resolve filePath: %w", err)
+	}
+	if !isWithin(base, resolved) {
+		return &PathEscapeError{Path: path, AbsBasePath: absBasePath}
+	}
+	return nil
+}
+
+// isWithin returns true if path is inside the directory dir. Both paths must be
+// absolute. Unlike a prefix check, "/base" doesn't contain "/basement".
+func isWithin(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || filepath.IsAbs(rel) {
+		return false
+	}
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// evalExistingSymlinks resolves the symbolic links in the part of path that
+// exists, and appends the rest of path to it.
+func evalExistingSymlinks(path string) (string, error) {
+	var rest []string
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, rest...)...), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return filepath.Join(append([]string{path}, rest...)...), nil
+		}
+		rest = append([]string{filepath.Base(path)}, rest...)
+		path = parent
+	}
+}
+
+// CheckBasePathNotSymlinked returns an error if absBasePath is a symbolic link,
+// or is in a directory that is one.
+func CheckBasePathNotSymlinked(absBasePath config.Path) error {
+	resolved, err := evalExistingSymlinks(string(absBasePath))
+	if err != nil {
+		return fmt.Errorf("unable to resolve absBasePath: %w", err)
+	}
+	if resolved != filepath.Clean(string(absBasePath)) {
+		return fmt.Errorf("%s resolves to %s through a symbolic link", absBasePath, resolved)
+	}
+	return nil
+}
+
+// WalkStoredFiles calls fn with the hash and directory of every file in the
+// media store, under both the configured layout and the version 1 layout. The
+// directory holds the file and its thumbnails.
+func WalkStoredFiles(absBasePath config.Path, layout config.MediaStoreLayout, fn func(hash types.Base64Hash, dir string) error) error {
+	layouts := []config.MediaStoreLayout{layout}
+	if !layout.IsLegacy() {
+		layouts = append(layouts, config.LegacyMediaStoreLayout)
+	}
+	for _, l := range layouts {
+		depth, width := l.Levels()
+		if err := walkLayoutLevel(string(absBasePath), "", depth, width, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkLayoutLevel(dir, prefix string, depth, width int, fn func(hash types.Base64Hash, dir string) error) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		name, path := entry.Name(), filepath.Join(dir, entry.Name())
+		if depth > 0 {
+			if len(name) != width {
+				continue
+			}
+			if err = walkLayoutLevel(path, prefix+name, depth-1, width, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		// The directories of files only hold the file and its thumbnails, so
+		// a directory with subdirectories belongs to another layout.
+		if hasSubdirectories(path) {
+			continue
+		}
+		if err = fn(types.Base64Hash(prefix+name), path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hasSubdirectories(dir string) bool {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
 // MoveFileWithHashCheck checks for hash collisions when moving a temporary file to its final path based on metadata
 // The final path is based on the hash of the file.
-// If the final path exists and the file size matches, the file does not need to be moved.
+// If the final path exists and the file size matches, the file does not need to be moved,
+// as media with the same content share the stored file, whatever their media ID. The
+// database counts the media referring to a file, so it is only removed with the last one.
+// Otherwise the file is compressed first if its content type is compressible.
+// The content coding of the stored file is recorded in the metadata.
+// If a file with the same hash but a different size is stored, a *HashCollisionError is returned.
 // In error cases where the file is not a duplicate, the caller may decide to remove the final path.
+// If durable is set, the file is on disk once it has been moved, see moveFile.
+// If ctx is done before the file has been moved, the temporary directory is
+// removed and the context's error is returned.
 // Returns the final path of the file, whether it is a duplicate and an error.
-func MoveFileWithHashCheck(tmpDir types.Path, mediaMetadata *types.MediaMetadata, absBasePath config.Path, logger *log.Entry) (types.Path, bool, error) {
+func MoveFileWithHashCheck(ctx context.Context, tmpDir types.Path, mediaMetadata *types.MediaMetadata, absBasePath config.Path, layout config.MediaStoreLayout, encryption *Encryption, compression *Compression, durable bool, logger *log.Entry) (types.Path, bool, error) {
+	trace, ctx := internal.StartRegion(ctx, "MoveFileWithHashCheck")
+	defer trace.EndRegion()
+	trace.SetTag("hash", string(mediaMetadata.Base64Hash))
 	// Note: in all error and success cases, we need to remove the temporary directory
 	defer RemoveDir(tmpDir, logger)
 	duplicate := false
-	finalPath, err := GetPathFromBase64Hash(mediaMetadata.Base64Hash, absBasePath)
+	finalPath, err := GetPathFromBase64Hash(mediaMetadata.Base64Hash, absBasePath, layout)
 	if err != nil {
 		return "", duplicate, fmt.Errorf("failed to get file path from metadata: %w", err)
 	}
 
-	var stat os.FileInfo
 	// Note: The double-negative is intentional as os.IsExist(err) != !os.IsNotExist(err).
 	// The functions are error checkers to be used in different cases.
-	if stat, err = os.Stat(finalPath); !os.IsNotExist(err) {
+	if _, err = os.Stat(finalPath); !os.IsNotExist(err) {
 		duplicate = true
-		if stat.Size() == int64(mediaMetadata.FileSizeBytes) {
+		trace.SetTag("duplicate", true)
+		// The existing file may be encrypted or not, regardless of the new one.
+		size, err := StoredFileSize(finalPath, encryption)
+		if err == nil && size == int64(mediaMetadata.FileSizeBytes) {
+			mediaMetadata.StoredEncoding = StoredEncoding(finalPath)
 			return types.Path(finalPath), duplicate, nil
 		}
-		return "", duplicate, fmt.Errorf("downloaded file with hash collision but different file size (%v)", finalPath)
+		return "", duplicate, &HashCollisionError{Path: finalPath, Size: mediaMetadata.FileSizeBytes, StoredSize: size, Err: err}
 	}
-	err = moveFile(
-		types.Path(filepath.Join(string(tmpDir), "content")),
-		types.Path(finalPath),
-	)
+	src := filepath.Join(string(tmpDir), "content")
+	if compression.compresses(mediaMetadata.ContentType) {
+		compressed := src
+		err = compression.workers.Do(ctx, "compress", func() (err error) {
+			compressed, err = compression.compressFile(ctx, src, encryption)
+			return err
+		})
+		if errors.Is(err, workers.ErrQueueTimeout) {
+			// Storing the file uncompressed is better than failing the request.
+			logger.Warn("All media workers are busy, storing the file uncompressed")
+			compressed, err = src, nil
+		}
+		if err != nil {
+			return "", duplicate, err
+		}
+		if compressed != src {
+			src = compressed
+			finalPath += compressedFileSuffixes[compression.encoding]
+		}
+	}
+	if err = ctx.Err(); err != nil {
+		return "", duplicate, err
+	}
+	mediaMetadata.StoredEncoding = StoredEncoding(finalPath)
+	err = moveFile(types.Path(src), types.Path(finalPath), durable)
 	if err != nil {
 		return "", duplicate, fmt.Errorf("failed to move file to final destination (%v): %w", finalPath, err)
 	}
@@ -105,21 +300,80 @@ func RemoveDir(dir types.Path, logger *log.Entry) {
 	}
 }
 
-// WriteTempFile writes to a new temporary file.
-// The file is deleted if there was an error while writing.
+// HashBlocklist decides whether files with a hash may be stored.
+type HashBlocklist interface {
+	IsHashBlocked(ctx context.Context, hash types.Base64Hash) (bool, error)
+	// IsAnyHashBlocked returns whether any hash is blocked at all, in which case
+	// files have to be hashed before they can be served.
+	IsAnyHashBlocked(ctx context.Context) (bool, error)
+}
+
+// WriteTempFile writes to a new temporary file, in a new directory within absTempPath.
+// Writing stops as soon as ctx is done, in which case the context's error is returned.
+// If maxFileSizeBytes is positive, one byte more than it is read so that larger files
+// are detected rather than truncated: they are deleted and a *FileTooLargeError is returned.
+// The file is deleted if there was an error while writing, or if its hash is
+// in the blocklist, in which case ErrHashBlocked is returned. The blocklist may be nil.
+// The file is encrypted if encryption is enabled, but the hash and size are of
+// the content before it was encrypted.
 func WriteTempFile(
-	ctx context.Context, reqReader io.Reader, absBasePath config.Path,
+	ctx context.Context, reqReader io.Reader, maxFileSizeBytes config.FileSizeBytes, absTempPath config.Path, blocklist HashBlocklist, encryption *Encryption,
 ) (hash types.Base64Hash, size types.FileSizeBytes, path types.Path, err error) {
+	hash, size, path, _, err = WriteTempFileWithHashes(ctx, reqReader, maxFileSizeBytes, absTempPath, blocklist, encryption, nil)
+	return
+}
+
+// WriteTempFileWithHashes is WriteTempFile, but also computes the given secondary
+// hashes of the file in the same pass, and returns them hex encoded by algorithm.
+// The algorithms must be from config.SecondaryHashAlgorithms.
+func WriteTempFileWithHashes(
+	ctx context.Context, reqReader io.Reader, maxFileSizeBytes config.FileSizeBytes, absTempPath config.Path, blocklist HashBlocklist, encryption *Encryption,
+	secondaryHashes []string,
+) (hash types.Base64Hash, size types.FileSizeBytes, path types.Path, secondary map[string]string, err error) {
+	return WriteTempFileWithProgress(ctx, reqReader, maxFileSizeBytes, absTempPath, blocklist, encryption, secondaryHashes, nil)
+}
+
+// TempFileProgress is told how much of a temp file has been written, so that
+// the file can be read while it is still being written.
+type TempFileProgress interface {
+	// TempFileWritten is called with the path of the file and the number of
+	// bytes written to it so far, each time more have been written.
+	TempFileWritten(path types.Path, size int64)
+}
+
+// WriteTempFileWithProgress is WriteTempFileWithHashes, but also tells progress,
+// which may be nil, about each part of the file once it has been written. It
+// isn't told about encrypted files, which can't be read until they are complete.
+func WriteTempFileWithProgress(
+	ctx context.Context, reqReader io.Reader, maxFileSizeBytes config.FileSizeBytes, absTempPath config.Path, blocklist HashBlocklist, encryption *Encryption,
+	secondaryHashes []string, progress TempFileProgress,
+) (hash types.Base64Hash, size types.FileSizeBytes, path types.Path, secondary map[string]string, err error) {
 	size = -1
+	trace, ctx := internal.StartRegion(ctx, "WriteTempFile")
+	defer func() {
+		trace.SetTag("size", int64(size))
+		trace.SetError(err)
+		trace.EndRegion()
+	}()
 	logger := util.GetLogger(ctx)
-	tmpFileWriter, tmpFile, tmpDir, err := createTempFileWriter(absBasePath)
+	// The limit is only checked if one more byte than it can be read.
+	if maxFileSizeBytes > 0 && maxFileSizeBytes+1 > 0 {
+		reqReader = io.LimitReader(reqReader, int64(maxFileSizeBytes)+1)
+	}
+	secondaryHashers, err := newSecondaryHashers(secondaryHashes)
+	if err != nil {
+		return
+	}
+	tmpFileWriter, tmpFile, tmpDir, err := createTempFileWriter(absTempPath, encryption)
 	if err != nil {
 		return
 	}
 	defer func() {
 		err2 := tmpFile.Close()
-		if err == nil {
+		if err == nil && err2 != nil {
 			err = err2
+			RemoveDir(tmpDir, logger)
+			hash, size, path, secondary = "", -1, "", nil
 		}
 	}()
 
@@ -127,55 +381,255 @@ func WriteTempFile(
 	// method of deduplicating files to save storage, as well as a way to conduct
 	// integrity checks on the file data in the repository.
 	hasher := sha256.New()
-	teeReader := io.TeeReader(reqReader, hasher)
-	bytesWritten, err := io.Copy(tmpFileWriter, teeReader)
+	hashWriters := []io.Writer{hasher}
+	for _, secondaryHasher := range secondaryHashers {
+		hashWriters = append(hashWriters, secondaryHasher)
+	}
+	// The file is hashed as it is written, so most of the time spent hashing is
+	// in this region rather than in computing the sums afterwards.
+	copyTrace, _ := internal.StartRegion(ctx, "HashAndCopyTempFile")
+	copyTrace.SetTag("secondary_hashes", strings.Join(secondaryHashes, ","))
+	teeReader := io.TeeReader(&contextReader{ctx: ctx, r: reqReader}, io.MultiWriter(hashWriters...))
+	var dst io.Writer = tmpFileWriter
+	if progress != nil && (encryption == nil || !encryption.encryptNewFiles) {
+		dst = &progressWriter{
+			w:        tmpFileWriter,
+			path:     types.Path(filepath.Join(string(tmpDir), "content")),
+			progress: progress,
+		}
+	}
+	bytesWritten, err := io.Copy(dst, teeReader)
+	copyTrace.EndRegion()
 	if err != nil && err != io.EOF {
 		RemoveDir(tmpDir, logger)
 		return
 	}
+	if maxFileSizeBytes > 0 && bytesWritten > int64(maxFileSizeBytes) {
+		RemoveDir(tmpDir, logger)
+		err = &FileTooLargeError{Limit: maxFileSizeBytes}
+		return
+	}
 
-	err = tmpFileWriter.Flush()
+	err = tmpFileWriter.Finish()
 	if err != nil {
 		RemoveDir(tmpDir, logger)
 		return
 	}
 
 	hash = types.Base64Hash(base64.RawURLEncoding.EncodeToString(hasher.Sum(nil)[:]))
+	if blocklist != nil {
+		var blocked bool
+		if blocked, err = blocklist.IsHashBlocked(ctx, hash); err != nil || blocked {
+			RemoveDir(tmpDir, logger)
+			if blocked {
+				err = ErrHashBlocked
+			}
+			return
+		}
+	}
 	size = types.FileSizeBytes(bytesWritten)
 	path = tmpDir
+	secondary = sumSecondaryHashes(secondaryHashers)
 	return
 }
 
-// moveFile attempts to move the file src to dst
-func moveFile(src types.Path, dst types.Path) error {
+// contextReader fails with the error of its context once it is done, so that
+// copying from it stops when the operation it is for has been cancelled or has
+// timed out.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// progressWriter flushes each write to the temp file, and then tells progress
+// how much of the file has been written.
+type progressWriter struct {
+	w        *fileWriter
+	path     types.Path
+	progress TempFileProgress
+	written  int64
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if err == nil {
+		err = w.w.Flush()
+	}
+	if err != nil {
+		return n, err
+	}
+	w.written += int64(n)
+	w.progress.TempFileWritten(w.path, w.written)
+	return n, nil
+}
+
+// rename is os.Rename, replaced in tests to simulate moving files across filesystems.
+var rename = os.Rename
+
+// moveFile attempts to move the file src to dst, creating the directories of dst
+// if needed. If src is on a different filesystem, it is copied instead, see
+// copyFile. If durable is set, the file is fsynced before it is moved and the
+// directories it was moved into are fsynced afterwards, so that the file can't
+// be lost or truncated by a crash once moveFile returns. If moving the file
+// fails, dst and the directories that were created for it are removed.
+func moveFile(src types.Path, dst types.Path, durable bool) (err error) {
 	dstDir := filepath.Dir(string(dst))
 
-	err := os.MkdirAll(dstDir, 0770)
+	createdDirs := missingDirs(dstDir)
+	defer func() {
+		if err != nil {
+			removeEmptyDirs(createdDirs)
+		}
+	}()
+	err = os.MkdirAll(dstDir, 0770)
 	if err != nil {
 		return fmt.Errorf("failed to make directory: %w", err)
 	}
-	err = os.Rename(string(src), string(dst))
+	if durable {
+		if err = syncPath(string(src)); err != nil {
+			return fmt.Errorf("failed to sync file: %w", err)
+		}
+	}
+	err = rename(string(src), string(dst))
+	if errors.Is(err, syscall.EXDEV) {
+		err = copyFile(string(src), string(dst))
+	}
 	if err != nil {
 		return fmt.Errorf("failed to move directory: %w", err)
 	}
+	if !durable {
+		return nil
+	}
+
+	// The entry of each directory that was created is in its parent.
+	syncDirs := []string{dstDir}
+	for _, dir := range createdDirs {
+		syncDirs = append(syncDirs, filepath.Dir(dir))
+	}
+	for _, dir := range syncDirs {
+		if err = syncDir(dir); err != nil {
+			_ = os.Remove(string(dst))
+			return fmt.Errorf("failed to sync directory: %w", err)
+		}
+	}
+	return nil
+}
+
+// copyFile copies src to a temporary file next to dst, fsyncs it and renames it
+// to dst, so that dst never holds a partial copy, and then removes src. This is
+// how files are moved when the temporary directory is on another filesystem.
+func copyFile(src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close() // nolint: errcheck
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+"-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = out.Close()
+			_ = os.Remove(out.Name())
+		}
+	}()
+	if err = out.Chmod(info.Mode().Perm()); err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		return fmt.Errorf("failed to copy file: %w", err)
+	}
+	if err = out.Sync(); err != nil {
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	if err = rename(out.Name(), dst); err != nil {
+		return err
+	}
+	_ = os.Remove(src)
 	return nil
 }
 
-func createTempFileWriter(absBasePath config.Path) (*bufio.Writer, *os.File, types.Path, error) {
-	tmpDir, err := createTempDir(absBasePath)
+// missingDirs returns dir and those of its parents that don't exist, from the
+// deepest up.
+func missingDirs(dir string) []string {
+	var dirs []string
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dirs
+		}
+		dirs = append(dirs, dir)
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dirs
+		}
+		dir = parent
+	}
+}
+
+// removeEmptyDirs removes the directories, from the deepest up, as long as
+// they are empty.
+func removeEmptyDirs(dirs []string) {
+	for _, dir := range dirs {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+// syncPath commits the file or directory at path to disk.
+func syncPath(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// syncDir commits the entries of the directory to disk. Directories can't be
+// synced on Windows, so this does nothing there.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	return syncPath(dir)
+}
+
+func createTempFileWriter(absTempPath config.Path, encryption *Encryption) (*fileWriter, *os.File, types.Path, error) {
+	tmpDir, err := createTempDir(absTempPath)
 	if err != nil {
 		return nil, nil, "", fmt.Errorf("failed to create temp dir: %w", err)
 	}
-	writer, tmpFile, err := createFileWriter(tmpDir)
+	writer, tmpFile, err := createFileWriter(tmpDir, encryption)
 	if err != nil {
+		_ = os.RemoveAll(string(tmpDir))
 		return nil, nil, "", fmt.Errorf("failed to create file writer: %w", err)
 	}
 	return writer, tmpFile, tmpDir, nil
 }
 
-// createTempDir creates a tmp/<random string> directory within baseDirectory and returns its path
-func createTempDir(baseDirectory config.Path) (types.Path, error) {
-	baseTmpDir := filepath.Join(string(baseDirectory), "tmp")
+// createTempDir creates a <random string> directory within absTempPath and returns its path
+func createTempDir(absTempPath config.Path) (types.Path, error) {
+	baseTmpDir := string(absTempPath)
 	if err := os.MkdirAll(baseTmpDir, 0770); err != nil {
 		return "", fmt.Errorf("failed to create base temp dir: %w", err)
 	}
@@ -186,15 +640,35 @@ func createTempDir(baseDirectory config.Path) (types.Path, error) {
 	return types.Path(tmpDir), nil
 }
 
-// createFileWriter creates a buffered file writer with a new file
-// The caller should flush the writer before closing the file.
+// createFileWriter creates a buffered file writer with a new file, which encrypts
+// what is written to it if encryption is enabled.
+// The caller should finish the writer before closing the file.
 // Returns the file handle as it needs to be closed when writing is complete
-func createFileWriter(directory types.Path) (*bufio.Writer, *os.File, error) {
+func createFileWriter(directory types.Path, encryption *Encryption) (*fileWriter, *os.File, error) {
 	filePath := filepath.Join(string(directory), "content")
 	file, err := os.Create(filePath)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to create file: %w", err)
 	}
+	w, err := encryption.newWriter(file)
+	if err != nil {
+		file.Close() // nolint: errcheck
+		return nil, nil, fmt.Errorf("failed to encrypt file: %w", err)
+	}
 
-	return bufio.NewWriter(file), file, nil
+	return &fileWriter{Writer: bufio.NewWriter(w), encrypter: w}, file, nil
+}
+
+// fileWriter buffers what is written to a new file before it is encrypted.
+type fileWriter struct {
+	*bufio.Writer
+	encrypter io.WriteCloser
+}
+
+// Finish flushes the buffer and writes the end of the encrypted content.
+func (w *fileWriter) Finish() error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return w.encrypter.Close()
 }
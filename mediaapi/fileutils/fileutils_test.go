@@ -0,0 +1,291 @@
+package fileutils
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/blake2b"
+)
+
+func TestGetPathFromBase64Hash(t *testing.T) {
+	base := config.Path(t.TempDir())
+	layout := config.MediaStoreLayout{Version: 2, Depth: 2, Width: 2}
+
+	path, err := GetPathFromBase64Hash("qwerty", base, config.LegacyMediaStoreLayout)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(string(base), "q", "w", "erty", "file"), path)
+
+	path, err = GetPathFromBase64Hash("qwerty", base, layout)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(string(base), "qw", "er", "ty", "file"), path)
+
+	path, err = GetPathFromBase64Hash("qwerty", base, config.MediaStoreLayout{Version: 2, Depth: 3, Width: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(string(base), "q", "w", "e", "rty", "file"), path)
+
+	var invalidHash *InvalidHashError
+	_, err = GetPathFromBase64Hash("qwer", base, layout)
+	assert.ErrorAs(t, err, &invalidHash, "hash too short for the layout")
+	_, err = GetPathFromBase64Hash("..", base, config.LegacyMediaStoreLayout)
+	assert.ErrorAs(t, err, &invalidHash)
+	var pathEscape *PathEscapeError
+	_, err = GetPathFromBase64Hash("../../x", base, config.LegacyMediaStoreLayout)
+	assert.ErrorAs(t, err, &pathEscape)
+
+	// Files stored under the version 1 layout are still found.
+	legacyPath := filepath.Join(string(base), "a", "s", "dfgh", "file")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(legacyPath), 0770))
+	assert.NoError(t, os.WriteFile(legacyPath, []byte("legacy"), 0660))
+	path, err = GetPathFromBase64Hash("asdfgh", base, layout)
+	assert.NoError(t, err)
+	assert.Equal(t, legacyPath, path)
+}
+
+func TestWalkStoredFiles(t *testing.T) {
+	base := config.Path(t.TempDir())
+	layout := config.MediaStoreLayout{Version: 2, Depth: 2, Width: 2}
+	for _, path := range []string{
+		filepath.Join("q", "w", "erty", "file"),
+		filepath.Join("as", "df", "gh", "file"),
+		filepath.Join("as", "df", "gh", "thumbnail-32x32-crop"),
+		filepath.Join("tmp", "abcdef", "content"),
+	} {
+		path = filepath.Join(string(base), path)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0770))
+		assert.NoError(t, os.WriteFile(path, nil, 0660))
+	}
+
+	var hashes []string
+	err := WalkStoredFiles(base, layout, func(hash types.Base64Hash, dir string) error {
+		hashes = append(hashes, string(hash))
+		path, err := GetPathFromBase64Hash(hash, base, layout)
+		assert.NoError(t, err)
+		assert.Equal(t, dir, filepath.Dir(path))
+		return nil
+	})
+	assert.NoError(t, err)
+	sort.Strings(hashes)
+	assert.Equal(t, []string{"asdfgh", "qwerty"}, hashes)
+}
+
+func TestMoveFile(t *testing.T) {
+	base := t.TempDir()
+	src := filepath.Join(base, "content")
+	assert.NoError(t, os.WriteFile(src, []byte("content"), 0660))
+
+	// The file is moved into newly created directories, which are synced.
+	dst := filepath.Join(base, "q", "w", "erty", "file")
+	assert.NoError(t, moveFile(types.Path(src), types.Path(dst), true))
+	content, err := os.ReadFile(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, "content", string(content))
+
+	// If the file can't be moved, the directories created for it are removed.
+	dst = filepath.Join(base, "a", "s", "dfgh", "file")
+	assert.Error(t, moveFile(types.Path(src), types.Path(dst), true))
+	_, err = os.Stat(filepath.Join(base, "a"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMoveFileAcrossFilesystems(t *testing.T) {
+	base := t.TempDir()
+	src := filepath.Join(base, "tmp", "abcdef", "content")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(src), 0770))
+	assert.NoError(t, os.WriteFile(src, []byte("content"), 0640))
+
+	// Simulate the temporary directory being on another filesystem.
+	defer func() { rename = os.Rename }()
+	rename = func(oldpath, newpath string) error {
+		if oldpath == src {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+		}
+		return os.Rename(oldpath, newpath)
+	}
+
+	dst := filepath.Join(base, "q", "w", "erty", "file")
+	assert.NoError(t, moveFile(types.Path(src), types.Path(dst), true))
+	content, err := os.ReadFile(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, "content", string(content))
+	info, err := os.Stat(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	_, err = os.Stat(src)
+	assert.True(t, os.IsNotExist(err))
+
+	// Only the file is left in the destination directory.
+	entries, err := os.ReadDir(filepath.Dir(dst))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestWriteTempFileCancelled(t *testing.T) {
+	base := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, _, err := WriteTempFile(ctx, strings.NewReader("content"), 0, config.Path(base), nil, nil)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// The temporary directory is removed straight away.
+	entries, err := os.ReadDir(base)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestWriteTempFileTooLarge(t *testing.T) {
+	base := t.TempDir()
+	ctx := context.Background()
+
+	_, size, tmpDir, err := WriteTempFile(ctx, strings.NewReader("content"), 7, config.Path(base), nil, nil)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 7, size)
+	RemoveDir(tmpDir, logrus.NewEntry(logrus.New()))
+
+	// Larger files aren't truncated to the limit.
+	_, _, _, err = WriteTempFile(ctx, strings.NewReader("content"), 6, config.Path(base), nil, nil)
+	var tooLarge *FileTooLargeError
+	assert.ErrorAs(t, err, &tooLarge)
+	assert.EqualValues(t, 6, tooLarge.Limit)
+	entries, err := os.ReadDir(base)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestWriteTempFileWithHashes(t *testing.T) {
+	base := t.TempDir()
+	ctx := context.Background()
+
+	content := []byte("content")
+	hash, _, tmpDir, secondary, err := WriteTempFileWithHashes(
+		ctx, bytes.NewReader(content), 0, config.Path(base), nil, nil,
+		[]string{config.HashBLAKE2b256, config.HashBLAKE2b512},
+	)
+	assert.NoError(t, err)
+	defer RemoveDir(tmpDir, logrus.NewEntry(logrus.New()))
+	sha := sha256.Sum256(content)
+	b2s256 := blake2b.Sum256(content)
+	b2s512 := blake2b.Sum512(content)
+	assert.Equal(t, types.Base64Hash(base64.RawURLEncoding.EncodeToString(sha[:])), hash)
+	assert.Equal(t, map[string]string{
+		config.HashBLAKE2b256: hex.EncodeToString(b2s256[:]),
+		config.HashBLAKE2b512: hex.EncodeToString(b2s512[:]),
+	}, secondary)
+	assert.True(t, IsSecondaryHash(config.HashBLAKE2b256, secondary[config.HashBLAKE2b256]))
+	assert.False(t, IsSecondaryHash(config.HashBLAKE2b512, secondary[config.HashBLAKE2b256]))
+
+	_, _, _, _, err = WriteTempFileWithHashes(ctx, bytes.NewReader(content), 0, config.Path(base), nil, nil, []string{"md5"})
+	assert.Error(t, err)
+}
+
+func TestWriteTempFileWithProgress(t *testing.T) {
+	base := t.TempDir()
+	ctx := context.Background()
+	metadata := &types.MediaMetadata{FileSizeBytes: 6}
+	partial := types.NewPartialFile(metadata)
+
+	pr, pw := io.Pipe()
+	written := make(chan types.Path)
+	go func() {
+		_, _, tmpDir, _, err := WriteTempFileWithProgress(ctx, pr, 0, config.Path(base), nil, nil, nil, partial)
+		assert.NoError(t, err)
+		written <- tmpDir
+	}()
+
+	// The first part of the file can be read before the rest is written.
+	_, err := pw.Write([]byte("abc"))
+	assert.NoError(t, err)
+	reader, err := partial.NewReader(ctx)
+	assert.NoError(t, err)
+	defer reader.Close() // nolint: errcheck
+	buf := make([]byte, 6)
+	n, err := io.ReadFull(reader, buf[:3])
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", string(buf[:n]))
+
+	_, err = pw.Write([]byte("def"))
+	assert.NoError(t, err)
+	assert.NoError(t, pw.Close())
+	tmpDir := <-written
+	defer RemoveDir(tmpDir, logrus.NewEntry(logrus.New()))
+	partial.Finish(nil)
+
+	rest, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "def", string(rest))
+
+	// Once the file is complete, it is read from the media store instead.
+	_, err = partial.NewReader(ctx)
+	assert.ErrorIs(t, err, types.ErrPartialFileUnavailable)
+}
+
+func TestGetPathFromBase64HashHostile(t *testing.T) {
+	root := t.TempDir()
+	base := config.Path(filepath.Join(root, "base"))
+	outside := filepath.Join(root, "outside")
+	assert.NoError(t, os.MkdirAll(string(base), 0770))
+	assert.NoError(t, os.MkdirAll(outside, 0770))
+	// A symbolic link in the media store that points outside of it.
+	assert.NoError(t, os.Symlink(outside, filepath.Join(string(base), "s")))
+	// A symbolic link in the media store that stays inside of it.
+	assert.NoError(t, os.MkdirAll(filepath.Join(string(base), "i", "n"), 0770))
+	assert.NoError(t, os.Symlink(filepath.Join(string(base), "i"), filepath.Join(string(base), "l")))
+
+	for _, tc := range []struct {
+		name   string
+		hash   types.Base64Hash
+		layout config.MediaStoreLayout
+		escape bool
+		valid  bool
+	}{
+		{name: "ordinary hash", hash: "qwerty", layout: config.LegacyMediaStoreLayout, valid: true},
+		{name: "parent directory", hash: "../../x", layout: config.LegacyMediaStoreLayout, escape: true},
+		{name: "sibling with the base path as prefix", hash: "./../basement", layout: config.LegacyMediaStoreLayout, escape: true},
+		{name: "sibling with the base path as prefix, version 2 layout", hash: "./../basement", layout: config.MediaStoreLayout{Version: 2, Depth: 1, Width: 2}, escape: true},
+		{name: "absolute path", hash: "//etc/passwd", layout: config.LegacyMediaStoreLayout, valid: true},
+		{name: "traversal within the store", hash: "ab/../cd", layout: config.LegacyMediaStoreLayout, valid: true},
+		{name: "deep traversal", hash: "a/" + types.Base64Hash(strings.Repeat("../", 20)) + "etc", layout: config.LegacyMediaStoreLayout, escape: true},
+		{name: "symbolic link out of the store", hash: "swerty", layout: config.LegacyMediaStoreLayout, escape: true},
+		{name: "symbolic link within the store", hash: "lnerty", layout: config.LegacyMediaStoreLayout, valid: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path, err := GetPathFromBase64Hash(tc.hash, base, tc.layout)
+			var pathEscape *PathEscapeError
+			switch {
+			case tc.escape:
+				assert.ErrorAs(t, err, &pathEscape)
+			case tc.valid:
+				assert.NoError(t, err)
+				assert.True(t, isWithin(string(base), path), "%s is not within %s", path, base)
+			}
+		})
+	}
+}
+
+func TestCheckBasePathNotSymlinked(t *testing.T) {
+	// The temporary directory may itself be in a symlinked directory.
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	assert.NoError(t, err)
+	target := filepath.Join(root, "target")
+	assert.NoError(t, os.MkdirAll(target, 0770))
+	assert.NoError(t, os.Symlink(target, filepath.Join(root, "link")))
+
+	assert.NoError(t, CheckBasePathNotSymlinked(config.Path(target)))
+	assert.NoError(t, CheckBasePathNotSymlinked(config.Path(filepath.Join(target, "not", "created", "yet"))))
+	assert.Error(t, CheckBasePathNotSymlinked(config.Path(filepath.Join(root, "link"))))
+	assert.Error(t, CheckBasePathNotSymlinked(config.Path(filepath.Join(root, "link", "media"))))
+}
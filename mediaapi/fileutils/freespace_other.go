@@ -0,0 +1,30 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package fileutils
+
+import (
+	"errors"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// FreeSpace returns the number of bytes available to unprivileged users on the
+// filesystem the path is on. It isn't supported on this platform.
+func FreeSpace(path config.Path) (uint64, error) {
+	return 0, errors.New("checking free space is not supported on this platform")
+}
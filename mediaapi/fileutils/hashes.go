@@ -0,0 +1,73 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileutils
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/blake2b"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// newSecondaryHasher returns a new hasher for the secondary hash algorithm.
+func newSecondaryHasher(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case config.HashBLAKE2b256:
+		return blake2b.New256(nil)
+	case config.HashBLAKE2b512:
+		return blake2b.New512(nil)
+	}
+	return nil, fmt.Errorf("unknown hash algorithm %q", algorithm)
+}
+
+// IsSecondaryHash returns whether the hash is hex encoded and of the right size
+// for the secondary hash algorithm.
+func IsSecondaryHash(algorithm, secondaryHash string) bool {
+	hasher, err := newSecondaryHasher(algorithm)
+	if err != nil {
+		return false
+	}
+	decoded, err := hex.DecodeString(secondaryHash)
+	return err == nil && len(decoded) == hasher.Size()
+}
+
+func newSecondaryHashers(algorithms []string) (map[string]hash.Hash, error) {
+	if len(algorithms) == 0 {
+		return nil, nil
+	}
+	hashers := make(map[string]hash.Hash, len(algorithms))
+	for _, algorithm := range algorithms {
+		hasher, err := newSecondaryHasher(algorithm)
+		if err != nil {
+			return nil, err
+		}
+		hashers[algorithm] = hasher
+	}
+	return hashers, nil
+}
+
+func sumSecondaryHashes(hashers map[string]hash.Hash) map[string]string {
+	if len(hashers) == 0 {
+		return nil
+	}
+	sums := make(map[string]string, len(hashers))
+	for algorithm, hasher := range hashers {
+		sums[algorithm] = hex.EncodeToString(hasher.Sum(nil))
+	}
+	return sums
+}
@@ -0,0 +1,169 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileutils
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	storageBackendHealthy = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "dendrite",
+			Subsystem: "mediaapi",
+			Name:      "storage_backend_healthy",
+			Help:      "Whether the media store or replica passed its last health check",
+		},
+		[]string{"path"},
+	)
+	readFailovers = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "mediaapi",
+			Name:      "read_failovers_total",
+			Help:      "The number of media files read from a replica because they couldn't be read from the media store",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(storageBackendHealthy, readFailovers)
+}
+
+// Backends are the media store and the replicas mirroring it, which files are
+// read from. Files are read from the media store unless it is unhealthy or fails
+// to read them, in which case they are read from the first replica that can.
+type Backends struct {
+	// The media store, followed by the replicas.
+	backends []*backend
+}
+
+type backend struct {
+	path    string
+	healthy atomic.Bool
+}
+
+// NewBackends returns the backends for the media store at absBasePath and the
+// replicas of it. All of them are considered healthy until they are checked.
+func NewBackends(absBasePath config.Path, replicas []config.Path) *Backends {
+	b := &Backends{}
+	for _, path := range append([]config.Path{absBasePath}, replicas...) {
+		be := &backend{path: string(path)}
+		be.healthy.Store(true)
+		b.backends = append(b.backends, be)
+	}
+	return b
+}
+
+// RunHealthChecks checks the health of the backends every interval, forever.
+func (b *Backends) RunHealthChecks(interval time.Duration) {
+	logger := log.WithField("component", "media_health_check")
+	for {
+		b.CheckHealth(logger)
+		time.Sleep(interval)
+	}
+}
+
+// CheckHealth checks whether each backend can be read, and logs when one
+// becomes unhealthy or recovers.
+func (b *Backends) CheckHealth(logger *log.Entry) {
+	for _, be := range b.backends {
+		err := checkBackend(be.path)
+		healthy := err == nil
+		if be.healthy.Swap(healthy) != healthy {
+			if healthy {
+				logger.WithField("path", be.path).Info("Media storage backend has recovered")
+			} else {
+				logger.WithError(err).WithField("path", be.path).Error("Media storage backend is unhealthy")
+			}
+		}
+		if healthy {
+			storageBackendHealthy.WithLabelValues(be.path).Set(1)
+		} else {
+			storageBackendHealthy.WithLabelValues(be.path).Set(0)
+		}
+	}
+}
+
+// checkBackend checks that the directory can be listed, which fails quickly on
+// a stale or disconnected network mount.
+func checkBackend(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close() // nolint: errcheck
+	if _, err = dir.Readdirnames(1); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// OpenStoredFile opens a file in the media store for reading, given its path in
+// the media store. The healthy backends are tried before the unhealthy ones. If
+// the file doesn't exist in a healthy media store, fs.ErrNotExist is returned
+// without trying the replicas, as they may not have caught up with its deletion.
+func (b *Backends) OpenStoredFile(path string, encryption *Encryption, logger *log.Entry) (*StoredFile, error) {
+	store := b.backends[0]
+	rel, err := filepath.Rel(store.path, path)
+	if err != nil || !filepath.IsLocal(rel) {
+		return OpenStoredFile(path, encryption)
+	}
+
+	candidates := make([]*backend, 0, len(b.backends))
+	for _, be := range b.backends {
+		if be.healthy.Load() {
+			candidates = append(candidates, be)
+		}
+	}
+	for _, be := range b.backends {
+		if !be.healthy.Load() {
+			candidates = append(candidates, be)
+		}
+	}
+
+	var firstErr error
+	for _, be := range candidates {
+		file, err := OpenStoredFile(filepath.Join(be.path, rel), encryption)
+		if err == nil {
+			if be != store {
+				readFailovers.Inc()
+				entry := logger.WithField("replica", be.path)
+				if firstErr != nil {
+					entry = entry.WithError(firstErr)
+				}
+				entry.Warn("Reading media file from a replica")
+			}
+			return file, nil
+		}
+		if be == store && store.healthy.Load() && errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,67 @@
+package fileutils
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendsOpenStoredFile(t *testing.T) {
+	logger := logrus.NewEntry(logrus.New())
+	store, replica := t.TempDir(), t.TempDir()
+	for _, dir := range []string{store, replica} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, "ab", "cd"), 0770))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "ab", "cd", "file"), []byte(dir), 0660))
+	}
+	assert.NoError(t, os.WriteFile(filepath.Join(replica, "ab", "replicated"), []byte(replica), 0660))
+	backends := NewBackends(config.Path(store), []config.Path{config.Path(replica)})
+
+	readFrom := func(path string) string {
+		t.Helper()
+		file, err := backends.OpenStoredFile(filepath.Join(store, path), nil, logger)
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		defer file.Close() // nolint: errcheck
+		content, err := io.ReadAll(file)
+		assert.NoError(t, err)
+		return string(content)
+	}
+
+	// Files are read from the media store while it is healthy.
+	assert.Equal(t, store, readFrom("ab/cd/file"))
+
+	// Files missing from the media store aren't read from replicas, as they may
+	// have been deleted.
+	_, err := backends.OpenStoredFile(filepath.Join(store, "ab", "replicated"), nil, logger)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	// Files the media store fails to read are read from the replica.
+	assert.NoError(t, os.RemoveAll(filepath.Join(store, "ab")))
+	assert.NoError(t, os.WriteFile(filepath.Join(store, "ab"), nil, 0660))
+	assert.Equal(t, replica, readFrom("ab/cd/file"))
+
+	// Replicas are read from first once the media store is unhealthy.
+	assert.NoError(t, os.RemoveAll(store))
+	backends.CheckHealth(logger)
+	assert.False(t, backends.backends[0].healthy.Load())
+	assert.True(t, backends.backends[1].healthy.Load())
+	assert.Equal(t, replica, readFrom("ab/replicated"))
+
+	// Errors are returned if no backend has the file.
+	_, err = backends.OpenStoredFile(filepath.Join(store, "ab", "missing"), nil, logger)
+	assert.Error(t, err)
+
+	// The media store is used again once it recovers.
+	assert.NoError(t, os.MkdirAll(filepath.Join(store, "ab", "cd"), 0770))
+	assert.NoError(t, os.WriteFile(filepath.Join(store, "ab", "cd", "file"), []byte(store), 0660))
+	backends.CheckHealth(logger)
+	assert.True(t, backends.backends[0].healthy.Load())
+	assert.Equal(t, store, readFrom("ab/cd/file"))
+}
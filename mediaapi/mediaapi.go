@@ -15,11 +15,17 @@
 package mediaapi
 
 import (
-	"github.com/gorilla/mux"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/internal/spamcheck"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
 	"github.com/matrix-org/dendrite/mediaapi/routing"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib/fclient"
 	"github.com/sirupsen/logrus"
@@ -27,18 +33,35 @@ import (
 
 // AddPublicRoutes sets up and registers HTTP handlers for the MediaAPI component.
 func AddPublicRoutes(
-	mediaRouter *mux.Router,
+	processCtx *process.ProcessContext,
+	routers httputil.Routers,
 	cm *sqlutil.Connections,
 	cfg *config.Dendrite,
 	userAPI userapi.MediaUserAPI,
+	rsAPI roomserverAPI.MediaRoomserverAPI,
 	client *fclient.Client,
-) {
+) error {
+	spamCheckers, err := spamcheck.New(&cfg.Global.SpamChecker)
+	if err != nil {
+		return fmt.Errorf("failed to set up spam checkers: %w", err)
+	}
+
 	mediaDB, err := storage.NewMediaAPIDatasource(cm, &cfg.MediaAPI.Database)
 	if err != nil {
-		logrus.WithError(err).Panicf("failed to connect to media db")
+		return fmt.Errorf("failed to connect to media db: %w", err)
+	}
+	mediaDB = storage.NewMetadataCachingDatabase(mediaDB, &cfg.MediaAPI.MetadataCache)
+
+	if err = fileutils.PrepareBasePath(cfg.MediaAPI.AbsBasePath, logrus.WithField("component", "mediaapi")); err != nil {
+		return fmt.Errorf("media_api.base_path can't be used as the media store: %w", err)
+	}
+	if cfg.MediaAPI.RejectSymlinkedBasePath {
+		if err = fileutils.CheckBasePathNotSymlinked(cfg.MediaAPI.AbsBasePath); err != nil {
+			return fmt.Errorf("media_api.base_path must not be a symbolic link: %w", err)
+		}
 	}
 
-	routing.Setup(
-		mediaRouter, cfg, mediaDB, userAPI, client,
+	return routing.Setup(
+		processCtx, routers, cfg, mediaDB, userAPI, rsAPI, client, spamCheckers,
 	)
 }
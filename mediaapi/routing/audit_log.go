@@ -0,0 +1,253 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// auditLogFlushInterval is how often the recorded actions are written to
+	// the database.
+	auditLogFlushInterval = time.Second * 10
+	// auditLogPruneInterval is how often old entries are redacted and deleted.
+	auditLogPruneInterval = time.Hour
+	// maxPendingAuditLogEntries is how many actions are kept in memory while
+	// they can't be written to the database, after which new ones are dropped.
+	maxPendingAuditLogEntries = 100000
+
+	defaultAuditLogLimit = 100
+	maxAuditLogLimit     = 1000
+)
+
+// mediaAuditLog records who uploaded, downloaded, deleted or quarantined which
+// media, and writes the entries to the database in batches, so that downloads
+// don't each wait for a write. Entries that haven't been written yet are lost
+// if the server stops.
+type mediaAuditLog struct {
+	cfg *config.MediaAuditLog
+	db  storage.Database
+
+	mu      sync.Mutex
+	pending []*types.AuditLogEntry
+	dropped int
+	// Held while entries are being written, so that forgetUser can wait for
+	// them.
+	flushing sync.Mutex
+}
+
+// newMediaAuditLog returns the audit log, or nil if it is disabled.
+func newMediaAuditLog(cfg *config.MediaAuditLog, db storage.Database) *mediaAuditLog {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &mediaAuditLog{cfg: cfg, db: db}
+}
+
+// record records the action taken by the request, with the time and IP address
+// it came from filled in. A nil *mediaAuditLog doesn't record anything.
+func (l *mediaAuditLog) record(req *http.Request, entry *types.AuditLogEntry) {
+	if l == nil {
+		return
+	}
+	if !l.cfg.Downloads && (entry.Action == types.AuditDownload || entry.Action == types.AuditThumbnail) {
+		return
+	}
+	entry.TS = spec.AsTimestamp(time.Now())
+	if !l.cfg.RedactIPAddresses {
+		entry.IPAddress = clientIP(req)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.pending) >= maxPendingAuditLogEntries {
+		l.dropped++
+		return
+	}
+	l.pending = append(l.pending, entry)
+}
+
+// forgetUser removes the user and IP addresses from the entries of the user
+// that haven't been written to the database yet. Entries that were being
+// written are in the database once it returns.
+func (l *mediaAuditLog) forgetUser(userID types.MatrixUserID) {
+	if l == nil {
+		return
+	}
+	l.flushing.Lock()
+	defer l.flushing.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, entry := range l.pending {
+		if entry.UserID == userID {
+			entry.UserID = ""
+			entry.IPAddress = ""
+		}
+	}
+}
+
+// run writes the recorded entries to the database and removes old ones,
+// forever.
+func (l *mediaAuditLog) run() {
+	logger := log.WithField("component", "media_audit_log")
+	var lastPruned time.Time
+	for {
+		time.Sleep(auditLogFlushInterval)
+		l.flush(context.Background(), logger)
+		if time.Since(lastPruned) >= auditLogPruneInterval {
+			lastPruned = time.Now()
+			l.prune(context.Background(), lastPruned, logger)
+		}
+	}
+}
+
+// flush writes the entries recorded since the last flush to the database. If
+// that fails, they are kept to be written by the next flush.
+func (l *mediaAuditLog) flush(ctx context.Context, logger *log.Entry) {
+	l.flushing.Lock()
+	defer l.flushing.Unlock()
+	l.mu.Lock()
+	pending, dropped := l.pending, l.dropped
+	l.pending, l.dropped = nil, 0
+	l.mu.Unlock()
+	if dropped > 0 {
+		logger.WithField("dropped", dropped).Warn("Dropped media audit log entries that couldn't be written in time")
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	if err := l.db.StoreAuditLogEntries(ctx, pending); err != nil {
+		logger.WithError(err).WithField("entries", len(pending)).Warn("Failed to write media audit log entries")
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if len(pending)+len(l.pending) > maxPendingAuditLogEntries {
+			l.dropped += len(pending)
+			return
+		}
+		l.pending = append(pending, l.pending...)
+	}
+}
+
+// prune removes the users and IP addresses from entries older than redact_after
+// and deletes entries older than max_age.
+func (l *mediaAuditLog) prune(ctx context.Context, now time.Time, logger *log.Entry) {
+	if l.cfg.RedactAfter > 0 {
+		if err := l.db.RedactAuditLogBefore(ctx, spec.AsTimestamp(now.Add(-l.cfg.RedactAfter))); err != nil {
+			logger.WithError(err).Warn("Failed to redact old media audit log entries")
+		}
+	}
+	if l.cfg.MaxAge > 0 {
+		deleted, err := l.db.DeleteAuditLogBefore(ctx, spec.AsTimestamp(now.Add(-l.cfg.MaxAge)))
+		if err != nil {
+			logger.WithError(err).Warn("Failed to delete old media audit log entries")
+		} else if deleted > 0 {
+			logger.WithField("deleted", deleted).Info("Deleted old media audit log entries")
+		}
+	}
+}
+
+// auditLogEntry is a single entry in the media audit log admin response.
+type auditLogEntry struct {
+	ID         int64              `json:"id"`
+	TS         spec.Timestamp     `json:"ts"`
+	Action     string             `json:"action"`
+	ServerName spec.ServerName    `json:"server_name,omitempty"`
+	MediaID    types.MediaID      `json:"media_id,omitempty"`
+	Base64Hash types.Base64Hash   `json:"base64hash,omitempty"`
+	UserID     types.MatrixUserID `json:"user_id,omitempty"`
+	IPAddress  string             `json:"ip_address,omitempty"`
+}
+
+type auditLogResponse struct {
+	Entries []auditLogEntry `json:"entries"`
+	// Passed as from to get the next, older, entries, omitted if there are no more.
+	NextBatch string `json:"next_batch,omitempty"`
+}
+
+// AdminMediaAuditLog implements GET /_dendrite/admin/mediaAuditLog, which lists
+// the media audit log newest first, optionally only for a user, server or media
+// ID. Entries are written to the database in batches, so the latest actions
+// may take a few seconds to show up.
+func AdminMediaAuditLog(req *http.Request, db storage.Database) util.JSONResponse {
+	query := req.URL.Query()
+	filter := &types.AuditLogFilter{
+		UserID:  types.MatrixUserID(query.Get("user_id")),
+		Origin:  spec.ServerName(query.Get("server_name")),
+		MediaID: types.MediaID(query.Get("media_id")),
+	}
+	var before int64
+	if from := query.Get("from"); from != "" {
+		var err error
+		if before, err = strconv.ParseInt(from, 10, 64); err != nil || before <= 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("from must be a next_batch token"),
+			}
+		}
+	}
+	limit := defaultAuditLogLimit
+	if l := query.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("limit must be a positive integer"),
+			}
+		}
+		if limit > maxAuditLogLimit {
+			limit = maxAuditLogLimit
+		}
+	}
+
+	entries, err := db.GetAuditLog(req.Context(), filter, before, limit)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to get media audit log")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	res := auditLogResponse{Entries: make([]auditLogEntry, 0, len(entries))}
+	for _, entry := range entries {
+		res.Entries = append(res.Entries, auditLogEntry{
+			ID:         entry.ID,
+			TS:         entry.TS,
+			Action:     entry.Action,
+			ServerName: entry.Origin,
+			MediaID:    entry.MediaID,
+			Base64Hash: entry.Base64Hash,
+			UserID:     entry.UserID,
+			IPAddress:  entry.IPAddress,
+		})
+	}
+	if len(entries) == limit {
+		res.NextBatch = strconv.FormatInt(entries[len(entries)-1].ID, 10)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
@@ -0,0 +1,89 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_mediaAuditLog(t *testing.T) {
+	cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
+	db, err := storage.NewMediaAPIDatasource(cm, &config.DatabaseOptions{
+		ConnectionString:       "file::memory:",
+		MaxOpenConnections:     1,
+		MaxIdleConnections:     1,
+		ConnMaxLifetimeSeconds: -1,
+	})
+	assert.NoError(t, err)
+	ctx := context.Background()
+	logger := logrus.WithField("test", t.Name())
+
+	// Nothing is recorded while the audit log is disabled.
+	assert.Nil(t, newMediaAuditLog(&config.MediaAuditLog{}, db))
+	var disabled *mediaAuditLog
+	disabled.record(httptest.NewRequest(http.MethodGet, "/", nil), &types.AuditLogEntry{Action: types.AuditUpload})
+
+	cfg := &config.MediaAuditLog{Enabled: true}
+	auditLog := newMediaAuditLog(cfg, db)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "203.0.113.5:1234"
+	auditLog.record(req, &types.AuditLogEntry{Action: types.AuditUpload, MediaID: "abcdef", Origin: "localhost", UserID: "@alice:localhost"})
+	// Downloads aren't recorded unless enabled.
+	auditLog.record(req, &types.AuditLogEntry{Action: types.AuditDownload, MediaID: "abcdef", Origin: "localhost"})
+	cfg.Downloads = true
+	auditLog.record(req, &types.AuditLogEntry{Action: types.AuditDownload, MediaID: "abcdef", Origin: "localhost"})
+	cfg.RedactIPAddresses = true
+	auditLog.record(req, &types.AuditLogEntry{Action: types.AuditDelete, MediaID: "ghijkl", Origin: "localhost", UserID: "@bob:localhost"})
+	auditLog.flush(ctx, logger)
+
+	getAuditLog := func(query string) auditLogResponse {
+		res := AdminMediaAuditLog(httptest.NewRequest(http.MethodGet, "/admin/mediaAuditLog?"+query, nil), db)
+		assert.Equal(t, http.StatusOK, res.Code)
+		return res.JSON.(auditLogResponse)
+	}
+	res := getAuditLog("")
+	if assert.Len(t, res.Entries, 3) {
+		assert.Equal(t, types.AuditDelete, res.Entries[0].Action)
+		assert.Empty(t, res.Entries[0].IPAddress)
+		assert.Equal(t, types.AuditDownload, res.Entries[1].Action)
+		assert.Equal(t, "203.0.113.5", res.Entries[1].IPAddress)
+		assert.Equal(t, types.AuditUpload, res.Entries[2].Action)
+	}
+	assert.Empty(t, res.NextBatch)
+
+	// Entries can be filtered and paginated.
+	res = getAuditLog("user_id=@alice:localhost")
+	if assert.Len(t, res.Entries, 1) {
+		assert.Equal(t, types.AuditUpload, res.Entries[0].Action)
+	}
+	res = getAuditLog("server_name=localhost&media_id=abcdef&limit=1")
+	if assert.Len(t, res.Entries, 1) {
+		assert.Equal(t, types.AuditDownload, res.Entries[0].Action)
+	}
+	res = getAuditLog("server_name=localhost&media_id=abcdef&limit=1&from=" + res.NextBatch)
+	if assert.Len(t, res.Entries, 1) {
+		assert.Equal(t, types.AuditUpload, res.Entries[0].Action)
+	}
+	assert.Equal(t, http.StatusBadRequest, AdminMediaAuditLog(httptest.NewRequest(http.MethodGet, "/admin/mediaAuditLog?limit=0", nil), db).Code)
+
+	// Old entries lose their users and IP addresses, and are then deleted.
+	cfg.RedactAfter = time.Hour
+	auditLog.prune(ctx, time.Now().Add(time.Hour*2), logger)
+	for _, entry := range getAuditLog("").Entries {
+		assert.Empty(t, entry.UserID)
+		assert.Empty(t, entry.IPAddress)
+		assert.Equal(t, "localhost", string(entry.ServerName))
+	}
+	cfg.MaxAge = time.Hour
+	auditLog.prune(ctx, time.Now().Add(time.Hour*2), logger)
+	assert.Empty(t, getAuditLog("").Entries)
+}
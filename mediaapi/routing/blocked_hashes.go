@@ -0,0 +1,196 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// hashBlocklist refuses files whose hash is either listed in the config file or
+// has been blocked by an admin.
+type hashBlocklist struct {
+	configured map[types.Base64Hash]struct{}
+	db         storage.Database
+}
+
+func newHashBlocklist(cfg *config.MediaAPI, db storage.Database) *hashBlocklist {
+	b := &hashBlocklist{
+		configured: make(map[types.Base64Hash]struct{}, len(cfg.BlockedHashes)),
+		db:         db,
+	}
+	for _, hash := range cfg.BlockedHashes {
+		// The config has already been verified, so this should never fail.
+		base64Hash, err := types.ParseBase64Hash(hash)
+		if err != nil {
+			logrus.WithError(err).Warn("Ignoring invalid blocked hash")
+			continue
+		}
+		b.configured[base64Hash] = struct{}{}
+	}
+	return b
+}
+
+func (b *hashBlocklist) isConfigured(hash types.Base64Hash) bool {
+	_, ok := b.configured[hash]
+	return ok
+}
+
+// IsHashBlocked implements fileutils.HashBlocklist.
+func (b *hashBlocklist) IsHashBlocked(ctx context.Context, hash types.Base64Hash) (bool, error) {
+	if b.isConfigured(hash) {
+		return true, nil
+	}
+	return b.db.IsHashBlocked(ctx, hash)
+}
+
+// IsAnyHashBlocked returns whether any hash is blocked, in the config or by an admin.
+func (b *hashBlocklist) IsAnyHashBlocked(ctx context.Context) (bool, error) {
+	if len(b.configured) > 0 {
+		return true, nil
+	}
+	return b.db.IsAnyHashBlocked(ctx)
+}
+
+// blockedHash is a single entry in the blocked hashes admin response.
+type blockedHash struct {
+	Base64Hash types.Base64Hash   `json:"base64hash"`
+	Reason     string             `json:"reason,omitempty"`
+	BlockedBy  types.MatrixUserID `json:"blocked_by,omitempty"`
+	BlockedTS  spec.Timestamp     `json:"blocked_ts,omitempty"`
+	// Whether the hash is listed in the config file, in which case it can't
+	// be unblocked with the admin API.
+	Configured bool `json:"configured"`
+}
+
+type blockedHashesResponse struct {
+	BlockedHashes []blockedHash `json:"blocked_hashes"`
+}
+
+type blockHashRequest struct {
+	Reason string `json:"reason"`
+}
+
+// AdminBlockedHashes implements GET /_dendrite/admin/blockedHashes, which lists
+// the hashes of files that may not be uploaded or downloaded.
+func AdminBlockedHashes(req *http.Request, blocklist *hashBlocklist) util.JSONResponse {
+	dbHashes, err := blocklist.db.GetBlockedHashes(req.Context())
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to get blocked hashes")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	res := blockedHashesResponse{
+		BlockedHashes: make([]blockedHash, 0, len(blocklist.configured)+len(dbHashes)),
+	}
+	configured := make([]types.Base64Hash, 0, len(blocklist.configured))
+	for hash := range blocklist.configured {
+		configured = append(configured, hash)
+	}
+	sort.Slice(configured, func(i, j int) bool { return configured[i] < configured[j] })
+	for _, hash := range configured {
+		res.BlockedHashes = append(res.BlockedHashes, blockedHash{Base64Hash: hash, Configured: true})
+	}
+	for _, hash := range dbHashes {
+		if blocklist.isConfigured(hash.Base64Hash) {
+			continue
+		}
+		res.BlockedHashes = append(res.BlockedHashes, blockedHash{
+			Base64Hash: hash.Base64Hash,
+			Reason:     hash.Reason,
+			BlockedBy:  hash.BlockedBy,
+			BlockedTS:  hash.BlockedTS,
+		})
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// AdminBlockHash implements PUT and DELETE /_dendrite/admin/blockedHashes/{hash}.
+// PUT stops files with the hash from being uploaded or downloaded, DELETE allows
+// them again. The hash may be hex or unpadded URL-safe base64 encoded.
+func AdminBlockHash(req *http.Request, device *userapi.Device, blocklist *hashBlocklist) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	hash, err := types.ParseBase64Hash(vars["hash"])
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("hash must be a hex or unpadded URL-safe base64 encoded SHA-256 hash"),
+		}
+	}
+	logger := util.GetLogger(req.Context()).WithField("Base64Hash", hash)
+
+	if req.Method == http.MethodDelete {
+		if blocklist.isConfigured(hash) {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.Unknown("The hash is blocked in the config file and can't be unblocked with the admin API"),
+			}
+		}
+		if err = blocklist.db.UnblockHash(req.Context(), hash); err != nil {
+			logger.WithError(err).Error("Failed to unblock hash")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+		logger.Info("Unblocked hash")
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	}
+
+	var body blockHashRequest
+	if req.Body != nil && req.ContentLength != 0 {
+		if err = json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.BadJSON("The request body could not be decoded into valid JSON: " + err.Error()),
+			}
+		}
+	}
+	if err = blocklist.db.BlockHash(req.Context(), hash, body.Reason, types.MatrixUserID(device.UserID)); err != nil {
+		logger.WithError(err).Error("Failed to block hash")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	logger.WithField("blockedBy", device.UserID).Info("Blocked hash")
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
@@ -0,0 +1,103 @@
+package routing
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_blockedHashes(t *testing.T) {
+	cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
+	db, err := storage.NewMediaAPIDatasource(cm, &config.DatabaseOptions{
+		ConnectionString:       "file::memory:",
+		MaxOpenConnections:     1,
+		MaxIdleConnections:     1,
+		ConnMaxLifetimeSeconds: -1,
+	})
+	assert.NoError(t, err)
+	ctx := context.Background()
+	logger := logrus.WithField("test", t.Name())
+
+	configuredHash := sha256.Sum256([]byte("blocked in config"))
+	cfg := &config.MediaAPI{
+		Matrix:        &config.Global{},
+		AbsBasePath:   config.Path(t.TempDir()),
+		BlockedHashes: []string{hex.EncodeToString(configuredHash[:])},
+	}
+	cfg.Matrix.ServerName = "localhost"
+	blocklist := newHashBlocklist(cfg, db)
+
+	upload := func(content string) (*uploadRequest, int) {
+		r := &uploadRequest{
+			MediaMetadata: &types.MediaMetadata{
+				Origin:        "localhost",
+				UserID:        "@alice:localhost",
+				FileSizeBytes: types.FileSizeBytes(len(content)),
+			},
+			Logger:    logger,
+			Blocklist: blocklist,
+		}
+		if resErr := r.doUpload(ctx, strings.NewReader(content), cfg, db, 0, nil); resErr != nil {
+			return r, resErr.Code
+		}
+		return r, http.StatusOK
+	}
+	download := func(mediaID types.MediaID) *types.MediaMetadata {
+		r := &downloadRequest{
+			MediaMetadata: &types.MediaMetadata{MediaID: mediaID, Origin: "localhost"},
+			Logger:        logger,
+			downloader:    downloader{DB: db, Blocklist: blocklist},
+		}
+		metadata, err := r.doDownload(ctx, httptest.NewRecorder(), cfg)
+		assert.NoError(t, err)
+		return metadata
+	}
+	blockHash := func(method, hash string) int {
+		req := httptest.NewRequest(method, "/admin/blockedHashes/"+hash, strings.NewReader(`{"reason":"abuse"}`))
+		req = mux.SetURLVars(req, map[string]string{"hash": hash})
+		return AdminBlockHash(req, &userapi.Device{UserID: "@admin:localhost"}, blocklist).Code
+	}
+
+	// Files blocked in the config can't be uploaded or unblocked.
+	_, code := upload("blocked in config")
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, http.StatusBadRequest, blockHash(http.MethodDelete, hex.EncodeToString(configuredHash[:])))
+
+	// Files blocked by an admin can't be downloaded or uploaded again.
+	r, code := upload("blocked by admin")
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotNil(t, download(r.MediaMetadata.MediaID))
+	assert.Equal(t, http.StatusOK, blockHash(http.MethodPut, string(r.MediaMetadata.Base64Hash)))
+	assert.Nil(t, download(r.MediaMetadata.MediaID))
+	_, code = upload("blocked by admin")
+	assert.Equal(t, http.StatusForbidden, code)
+
+	res := AdminBlockedHashes(httptest.NewRequest(http.MethodGet, "/admin/blockedHashes", nil), blocklist)
+	if assert.Equal(t, http.StatusOK, res.Code) {
+		blockedHashes := res.JSON.(blockedHashesResponse).BlockedHashes
+		if assert.Len(t, blockedHashes, 2) {
+			assert.True(t, blockedHashes[0].Configured)
+			assert.Equal(t, r.MediaMetadata.Base64Hash, blockedHashes[1].Base64Hash)
+			assert.Equal(t, "abuse", blockedHashes[1].Reason)
+		}
+	}
+
+	// Unblocked files can be downloaded again.
+	assert.Equal(t, http.StatusOK, blockHash(http.MethodDelete, string(r.MediaMetadata.Base64Hash)))
+	assert.NotNil(t, download(r.MediaMetadata.MediaID))
+
+	assert.Equal(t, http.StatusBadRequest, blockHash(http.MethodPut, "not-a-hash"))
+}
@@ -0,0 +1,193 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+)
+
+// originBlocklist refuses media from servers that are either listed in the
+// config file or have been blocked by an admin.
+type originBlocklist struct {
+	cfg        *config.MediaAPI
+	configured map[spec.ServerName]struct{}
+	db         storage.Database
+}
+
+func newOriginBlocklist(cfg *config.MediaAPI, db storage.Database) *originBlocklist {
+	b := &originBlocklist{
+		cfg:        cfg,
+		configured: make(map[spec.ServerName]struct{}, len(cfg.BlockedOrigins)),
+		db:         db,
+	}
+	for _, serverName := range cfg.BlockedOrigins {
+		b.configured[serverName] = struct{}{}
+	}
+	return b
+}
+
+func (b *originBlocklist) isConfigured(serverName spec.ServerName) bool {
+	_, ok := b.configured[serverName]
+	return ok
+}
+
+// isOriginBlocked returns whether media from the server may not be fetched or
+// downloaded. Media from this server is never blocked.
+func (b *originBlocklist) isOriginBlocked(ctx context.Context, serverName spec.ServerName) (bool, error) {
+	if b.cfg.Matrix.IsLocalServerName(serverName) {
+		return false, nil
+	}
+	if b.isConfigured(serverName) {
+		return true, nil
+	}
+	return b.db.IsOriginBlocked(ctx, serverName)
+}
+
+// blockedOrigin is a single entry in the blocked origins admin response.
+type blockedOrigin struct {
+	ServerName spec.ServerName    `json:"server_name"`
+	Reason     string             `json:"reason,omitempty"`
+	BlockedBy  types.MatrixUserID `json:"blocked_by,omitempty"`
+	BlockedTS  spec.Timestamp     `json:"blocked_ts,omitempty"`
+	// Whether the server is listed in the config file, in which case it can't
+	// be unblocked with the admin API.
+	Configured bool `json:"configured"`
+}
+
+type blockedOriginsResponse struct {
+	BlockedOrigins []blockedOrigin `json:"blocked_origins"`
+}
+
+type blockOriginRequest struct {
+	Reason string `json:"reason"`
+}
+
+// AdminBlockedOrigins implements GET /_dendrite/admin/blockedOrigins, which
+// lists the servers whose media may not be fetched or downloaded.
+func AdminBlockedOrigins(req *http.Request, blocklist *originBlocklist) util.JSONResponse {
+	dbOrigins, err := blocklist.db.GetBlockedOrigins(req.Context())
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to get blocked origins")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	res := blockedOriginsResponse{
+		BlockedOrigins: make([]blockedOrigin, 0, len(blocklist.configured)+len(dbOrigins)),
+	}
+	configured := make([]spec.ServerName, 0, len(blocklist.configured))
+	for serverName := range blocklist.configured {
+		configured = append(configured, serverName)
+	}
+	sort.Slice(configured, func(i, j int) bool { return configured[i] < configured[j] })
+	for _, serverName := range configured {
+		res.BlockedOrigins = append(res.BlockedOrigins, blockedOrigin{ServerName: serverName, Configured: true})
+	}
+	for _, origin := range dbOrigins {
+		if blocklist.isConfigured(origin.ServerName) {
+			continue
+		}
+		res.BlockedOrigins = append(res.BlockedOrigins, blockedOrigin{
+			ServerName: origin.ServerName,
+			Reason:     origin.Reason,
+			BlockedBy:  origin.BlockedBy,
+			BlockedTS:  origin.BlockedTS,
+		})
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// AdminBlockOrigin implements PUT and DELETE /_dendrite/admin/blockedOrigins/{serverName}.
+// PUT stops media from the server from being fetched or downloaded, DELETE allows
+// it again.
+func AdminBlockOrigin(req *http.Request, device *userapi.Device, blocklist *originBlocklist) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	serverName := spec.ServerName(vars["serverName"])
+	if _, _, valid := spec.ParseAndValidateServerName(serverName); !valid {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("serverName must be a valid server name"),
+		}
+	}
+	if blocklist.cfg.Matrix.IsLocalServerName(serverName) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Media from this server can't be blocked"),
+		}
+	}
+	logger := util.GetLogger(req.Context()).WithField("ServerName", serverName)
+
+	if req.Method == http.MethodDelete {
+		if blocklist.isConfigured(serverName) {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.Unknown("The server is blocked in the config file and can't be unblocked with the admin API"),
+			}
+		}
+		if err = blocklist.db.UnblockOrigin(req.Context(), serverName); err != nil {
+			logger.WithError(err).Error("Failed to unblock origin")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+		logger.Info("Unblocked origin")
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	}
+
+	var body blockOriginRequest
+	if req.Body != nil && req.ContentLength != 0 {
+		if err = json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.BadJSON("The request body could not be decoded into valid JSON: " + err.Error()),
+			}
+		}
+	}
+	if err = blocklist.db.BlockOrigin(req.Context(), serverName, body.Reason, types.MatrixUserID(device.UserID)); err != nil {
+		logger.WithError(err).Error("Failed to block origin")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	logger.WithField("blockedBy", device.UserID).Info("Blocked origin")
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
@@ -0,0 +1,88 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_blockedOrigins(t *testing.T) {
+	cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
+	db, err := storage.NewMediaAPIDatasource(cm, &config.DatabaseOptions{
+		ConnectionString:       "file::memory:",
+		MaxOpenConnections:     1,
+		MaxIdleConnections:     1,
+		ConnMaxLifetimeSeconds: -1,
+	})
+	assert.NoError(t, err)
+	ctx := context.Background()
+	logger := logrus.WithField("test", t.Name())
+
+	cfg := &config.MediaAPI{
+		Matrix:         &config.Global{},
+		AbsBasePath:    config.Path(t.TempDir()),
+		BlockedOrigins: []spec.ServerName{"configured.example"},
+	}
+	cfg.Matrix.ServerName = "localhost"
+	blocklist := newOriginBlocklist(cfg, db)
+
+	isBlocked := func(serverName spec.ServerName) bool {
+		blocked, err := blocklist.isOriginBlocked(ctx, serverName)
+		assert.NoError(t, err)
+		return blocked
+	}
+	blockOrigin := func(method, serverName string) int {
+		req := httptest.NewRequest(method, "/admin/blockedOrigins/"+serverName, strings.NewReader(`{"reason":"spam"}`))
+		req = mux.SetURLVars(req, map[string]string{"serverName": serverName})
+		return AdminBlockOrigin(req, &userapi.Device{UserID: "@admin:localhost"}, blocklist).Code
+	}
+
+	// Servers blocked in the config can't be unblocked.
+	assert.True(t, isBlocked("configured.example"))
+	assert.Equal(t, http.StatusBadRequest, blockOrigin(http.MethodDelete, "configured.example"))
+
+	// Media from servers blocked by an admin isn't downloaded, without even
+	// trying to fetch it.
+	assert.False(t, isBlocked("abuse.example"))
+	assert.Equal(t, http.StatusOK, blockOrigin(http.MethodPut, "abuse.example"))
+	assert.True(t, isBlocked("abuse.example"))
+	r := &downloadRequest{
+		MediaMetadata: &types.MediaMetadata{MediaID: "abcdef", Origin: "abuse.example"},
+		Logger:        logger,
+		downloader:    downloader{DB: db, OriginBlocklist: blocklist},
+	}
+	metadata, err := r.doDownload(ctx, httptest.NewRecorder(), cfg)
+	assert.NoError(t, err)
+	assert.Nil(t, metadata)
+
+	res := AdminBlockedOrigins(httptest.NewRequest(http.MethodGet, "/admin/blockedOrigins", nil), blocklist)
+	if assert.Equal(t, http.StatusOK, res.Code) {
+		blockedOrigins := res.JSON.(blockedOriginsResponse).BlockedOrigins
+		if assert.Len(t, blockedOrigins, 2) {
+			assert.True(t, blockedOrigins[0].Configured)
+			assert.Equal(t, spec.ServerName("abuse.example"), blockedOrigins[1].ServerName)
+			assert.Equal(t, "spam", blockedOrigins[1].Reason)
+		}
+	}
+
+	// Unblocked servers aren't blocked anymore.
+	assert.Equal(t, http.StatusOK, blockOrigin(http.MethodDelete, "abuse.example"))
+	assert.False(t, isBlocked("abuse.example"))
+
+	// This server and invalid server names can't be blocked.
+	assert.Equal(t, http.StatusBadRequest, blockOrigin(http.MethodPut, "localhost"))
+	assert.Equal(t, http.StatusBadRequest, blockOrigin(http.MethodPut, "not a server"))
+	assert.False(t, isBlocked("localhost"))
+}
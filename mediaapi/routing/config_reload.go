@@ -0,0 +1,127 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// reloadableConfig is the media API config that handlers use, which is swapped
+// for a new snapshot when the config file is reloaded. Only the size limits,
+// retention policies and rate limits are reloaded: the other options only
+// take effect once Dendrite is restarted.
+type reloadableConfig struct {
+	// The config file to reload, empty if the config wasn't loaded from one.
+	path    string
+	current atomic.Pointer[config.MediaAPI]
+	limits  atomic.Pointer[mediaRateLimits]
+	// Serialises reloads.
+	mu sync.Mutex
+}
+
+func newReloadableConfig(cfg *config.MediaAPI, path string) *reloadableConfig {
+	c := &reloadableConfig{path: path}
+	c.current.Store(cfg)
+	c.limits.Store(newMediaRateLimits(&cfg.RateLimiting))
+	return c
+}
+
+// load returns the current snapshot of the config, which must not be changed.
+func (c *reloadableConfig) load() *config.MediaAPI {
+	return c.current.Load()
+}
+
+// rateLimits returns the rate limits of the current config.
+func (c *reloadableConfig) rateLimits() *mediaRateLimits {
+	return c.limits.Load()
+}
+
+// reload loads the config file again, and swaps in a snapshot of the config
+// with its reloadable options. Nothing is changed if the file is invalid.
+func (c *reloadableConfig) reload() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.path == "" {
+		return errors.New("the config wasn't loaded from a file")
+	}
+	loaded, err := config.Load(c.path)
+	if err != nil {
+		return fmt.Errorf("failed to load %s: %w", c.path, err)
+	}
+	var configErrs config.ConfigErrors
+	loaded.Verify(&configErrs)
+	if len(configErrs) > 0 {
+		return fmt.Errorf("invalid config in %s: %w", c.path, configErrs)
+	}
+	c.apply(&loaded.MediaAPI)
+	return nil
+}
+
+// apply swaps in a copy of the current config with the reloadable options of
+// next. The rate limits start afresh only if they were changed.
+func (c *reloadableConfig) apply(next *config.MediaAPI) {
+	previous := c.load()
+	snapshot := *previous
+	snapshot.MaxFileSizeBytes = next.MaxFileSizeBytes
+	snapshot.UploadQuotaBytes = next.UploadQuotaBytes
+	snapshot.Retention = next.Retention
+	snapshot.RateLimiting = next.RateLimiting
+	if !reflect.DeepEqual(previous.RateLimiting, snapshot.RateLimiting) {
+		c.limits.Store(newMediaRateLimits(&snapshot.RateLimiting))
+	}
+	c.current.Store(&snapshot)
+}
+
+// reloadAndLog reloads the config file, logging the outcome.
+func (c *reloadableConfig) reloadAndLog(logger *log.Entry) error {
+	if err := c.reload(); err != nil {
+		logger.WithError(err).Error("Failed to reload the media API config")
+		return err
+	}
+	cfg := c.load()
+	logger.WithFields(log.Fields{
+		"max_file_size_bytes": cfg.MaxFileSizeBytes,
+		"upload_quota_bytes":  cfg.UploadQuotaBytes,
+		"retention":           cfg.Retention.Enabled(),
+		"rate_limiting":       cfg.RateLimiting.Enabled,
+	}).Info("Reloaded the media API config")
+	return nil
+}
+
+// AdminReloadMediaConfig implements POST /_dendrite/admin/reloadMediaConfig,
+// which reloads the reloadable media API options from the config file, as
+// sending Dendrite SIGHUP does.
+func AdminReloadMediaConfig(req *http.Request, cfg *reloadableConfig) util.JSONResponse {
+	if err := cfg.reloadAndLog(util.GetLogger(req.Context())); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.Unknown("Failed to reload the media API config: " + err.Error()),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
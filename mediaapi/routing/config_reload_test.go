@@ -0,0 +1,67 @@
+package routing
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloadableConfig(t *testing.T) {
+	cfg := &config.MediaAPI{
+		Matrix:           &config.Global{},
+		AbsBasePath:      "/media_store",
+		MaxFileSizeBytes: 1024,
+		RateLimiting: config.MediaRateLimiting{
+			Enabled: true,
+			Uploads: config.MediaRateLimit{Burst: 1, PerSecond: 1},
+		},
+	}
+	mediaCfg := newReloadableConfig(cfg, "")
+	limits := mediaCfg.rateLimits()
+	assert.Same(t, cfg, mediaCfg.load())
+
+	// Only the reloadable options are taken from the new config.
+	next := &config.MediaAPI{
+		AbsBasePath:      "/elsewhere",
+		MaxFileSizeBytes: 2048,
+		UploadQuotaBytes: 4096,
+		Retention: config.MediaRetention{
+			Local:    config.MediaRetentionPolicy{MaxAge: time.Hour},
+			Interval: time.Minute,
+		},
+		RateLimiting: cfg.RateLimiting,
+	}
+	mediaCfg.apply(next)
+	snapshot := mediaCfg.load()
+	assert.Equal(t, config.FileSizeBytes(2048), snapshot.MaxFileSizeBytes)
+	assert.Equal(t, config.FileSizeBytes(4096), snapshot.UploadQuotaBytes)
+	assert.True(t, snapshot.Retention.Enabled())
+	assert.Equal(t, config.Path("/media_store"), snapshot.AbsBasePath)
+	assert.Same(t, cfg.Matrix, snapshot.Matrix)
+	// The previous snapshot is left alone for the requests still using it.
+	assert.Equal(t, config.FileSizeBytes(1024), cfg.MaxFileSizeBytes)
+	// The rate limits weren't changed, so they carry on as they were.
+	assert.Same(t, limits, mediaCfg.rateLimits())
+
+	next.RateLimiting.Uploads.Burst = 10
+	mediaCfg.apply(next)
+	assert.NotSame(t, limits, mediaCfg.rateLimits())
+}
+
+func TestReloadableConfigInvalidFile(t *testing.T) {
+	cfg := &config.MediaAPI{Matrix: &config.Global{}, MaxFileSizeBytes: 1024}
+
+	// There is no file to reload.
+	assert.Error(t, newReloadableConfig(cfg, "").reload())
+
+	// The file is invalid, so nothing changes.
+	path := filepath.Join(t.TempDir(), "dendrite.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("media_api: [not, a, map]"), 0600))
+	mediaCfg := newReloadableConfig(cfg, path)
+	assert.Error(t, mediaCfg.reload())
+	assert.Same(t, cfg, mediaCfg.load())
+}
@@ -0,0 +1,409 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/mediaapi/types/mxc"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// The reasons the content scanner API gives for failing a request.
+// https://github.com/matrix-org/matrix-content-scanner-python/blob/main/docs/api.md
+const (
+	scannerMalformedJSON   = "MCS_MALFORMED_JSON"
+	scannerNotFound        = "M_NOT_FOUND"
+	scannerNotClean        = "MCS_MEDIA_NOT_CLEAN"
+	scannerFailedToDecrypt = "MCS_MEDIA_FAILED_TO_DECRYPT"
+	scannerRequestFailed   = "MCS_MEDIA_REQUEST_FAILED"
+	scannerBadDecryption   = "MCS_BAD_DECRYPTION"
+	scannerUnknownError    = "M_UNKNOWN"
+)
+
+// scannerError is the body of an error response from the content scanner API.
+type scannerError struct {
+	Reason string `json:"reason"`
+	Info   string `json:"info"`
+}
+
+func scannerErrorResponse(code int, reason, info string) *util.JSONResponse {
+	return &util.JSONResponse{
+		Code: code,
+		JSON: scannerError{Reason: reason, Info: info},
+	}
+}
+
+// scanResult is the response to a scan request.
+type scanResult struct {
+	Clean bool   `json:"clean"`
+	Info  string `json:"info"`
+}
+
+// encryptedFile is the EncryptedFile of an encrypted attachment, which holds
+// the key needed to decrypt it.
+// https://spec.matrix.org/v1.9/client-server-api/#extensions-to-mroommessage-msgtypes
+type encryptedFile struct {
+	URL string `json:"url"`
+	Key struct {
+		Alg string `json:"alg"`
+		K   string `json:"k"`
+	} `json:"key"`
+	IV     string            `json:"iv"`
+	Hashes map[string]string `json:"hashes"`
+	V      string            `json:"v"`
+}
+
+// encryptedRequest is the body of a request to scan or download an encrypted
+// file.
+type encryptedRequest struct {
+	File *encryptedFile `json:"file"`
+	// An Olm-encrypted version of the body, which isn't supported.
+	EncryptedBody json.RawMessage `json:"encrypted_body,omitempty"`
+}
+
+// mediaID returns the origin and media ID of the file's mxc:// URL.
+func (f *encryptedFile) mediaID() (spec.ServerName, types.MediaID, error) {
+	uri, err := mxc.Parse(f.URL)
+	if err != nil {
+		return "", "", err
+	}
+	return uri.ServerName, uri.MediaID, nil
+}
+
+// decrypt decrypts the file read from in, which is encrypted with AES-CTR, into
+// dst after checking that it matches the SHA-256 hash of the attachment.
+func (f *encryptedFile) decrypt(in io.ReadSeeker, dst string) error {
+	if f.Key.Alg != "A256CTR" {
+		return fmt.Errorf("unsupported algorithm %q", f.Key.Alg)
+	}
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(f.Key.K, "="))
+	if err != nil || len(key) != 32 {
+		return fmt.Errorf("invalid key")
+	}
+	iv, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(f.IV, "="))
+	if err != nil || len(iv) != aes.BlockSize {
+		return fmt.Errorf("invalid iv")
+	}
+	wantHash, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(f.Hashes["sha256"], "="))
+	if err != nil || len(wantHash) != sha256.Size {
+		return fmt.Errorf("invalid sha256 hash")
+	}
+
+	// Check the hash before decrypting anything, as it covers the ciphertext.
+	hasher := sha256.New()
+	if _, err = io.Copy(hasher, in); err != nil {
+		return err
+	}
+	if string(hasher.Sum(nil)) != string(wantHash) {
+		return fmt.Errorf("sha256 hash doesn't match")
+	}
+	if _, err = in.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close() // nolint: errcheck
+	writer := &cipher.StreamWriter{S: cipher.NewCTR(block, iv), W: out}
+	if _, err = io.Copy(writer, in); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// contentScanner implements the content scanner API, which scans media for
+// malware before serving it.
+type contentScanner struct {
+	cfg        *config.MediaAPI
+	downloader *downloader
+}
+
+// discardResponseWriter is used to fetch media into the media store without
+// sending it anywhere.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = http.Header{}
+	}
+	return w.header
+}
+
+func (w *discardResponseWriter) Write(p []byte) (int, error) { return len(p), nil }
+
+func (w *discardResponseWriter) WriteHeader(int) {}
+
+// mediaPath returns the path of the media in the media store, fetching it from
+// the remote server first if needed.
+func (s *contentScanner) mediaPath(
+	ctx context.Context, origin spec.ServerName, mediaID types.MediaID, logger *log.Entry,
+) (string, *util.JSONResponse) {
+	dReq := &downloadRequest{
+		MediaMetadata: &types.MediaMetadata{
+			MediaID: mediaID,
+			Origin:  origin,
+		},
+		Logger:          logger,
+		downloader:      *s.downloader,
+		Fsync:           s.cfg.Fsync,
+		TempPath:        s.cfg.TempDir(),
+		SecondaryHashes: s.cfg.SecondaryHashes,
+	}
+	if resErr := dReq.Validate(); resErr != nil {
+		return "", scannerErrorResponse(http.StatusNotFound, scannerNotFound, "Media not found")
+	}
+	metadata, err := dReq.doDownload(ctx, &discardResponseWriter{}, s.cfg)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to fetch media to scan")
+		return "", scannerErrorResponse(http.StatusBadGateway, scannerRequestFailed, "Failed to fetch media")
+	}
+	if metadata == nil {
+		return "", scannerErrorResponse(http.StatusNotFound, scannerNotFound, "Media not found")
+	}
+	filePath, err := fileutils.GetPathFromBase64Hash(dReq.MediaMetadata.Base64Hash, s.cfg.AbsBasePath, s.cfg.StoreLayout)
+	if err != nil {
+		logger.WithError(err).Error("Failed to get path of media to scan")
+		return "", scannerErrorResponse(http.StatusInternalServerError, scannerUnknownError, "Failed to scan media")
+	}
+	return filePath, nil
+}
+
+// scan scans the media, after decrypting it if file is given. It returns an
+// error response if the media couldn't be scanned or isn't clean. The scanner
+// needs the media in plain text, so media that are encrypted at rest or that
+// are encrypted attachments are decrypted into a temporary file first.
+func (s *contentScanner) scan(
+	ctx context.Context, origin spec.ServerName, mediaID types.MediaID, file *encryptedFile,
+) *util.JSONResponse {
+	logger := util.GetLogger(ctx).WithFields(log.Fields{
+		"Origin":    origin,
+		"MediaID":   mediaID,
+		"Encrypted": file != nil,
+	})
+	filePath, resErr := s.mediaPath(ctx, origin, mediaID, logger)
+	if resErr != nil {
+		return resErr
+	}
+
+	// The scanner needs the plain content, so files stored encrypted or
+	// compressed are decrypted and decompressed first.
+	if file != nil || s.downloader.Encryption != nil || fileutils.StoredEncoding(filePath) != "" {
+		tmpPath := string(s.cfg.TempDir())
+		if err := os.MkdirAll(tmpPath, 0770); err != nil {
+			logger.WithError(err).Error("Failed to create temporary directory")
+			return scannerErrorResponse(http.StatusInternalServerError, scannerUnknownError, "Failed to scan media")
+		}
+		tmpDir, err := os.MkdirTemp(tmpPath, "")
+		if err != nil {
+			logger.WithError(err).Error("Failed to create temporary directory")
+			return scannerErrorResponse(http.StatusInternalServerError, scannerUnknownError, "Failed to scan media")
+		}
+		defer fileutils.RemoveDir(types.Path(tmpDir), logger)
+		decryptedPath := filepath.Join(tmpDir, "content")
+		stored, err := fileutils.OpenStoredFile(filePath, s.downloader.Encryption)
+		if err != nil {
+			logger.WithError(err).Error("Failed to open media to scan")
+			return scannerErrorResponse(http.StatusInternalServerError, scannerUnknownError, "Failed to scan media")
+		}
+		defer stored.Close() // nolint: errcheck
+		if file != nil {
+			if err = file.decrypt(stored, decryptedPath); err != nil {
+				logger.WithError(err).Info("Failed to decrypt media to scan")
+				return scannerErrorResponse(http.StatusBadRequest, scannerFailedToDecrypt, "Failed to decrypt file")
+			}
+		} else if err = copyToFile(stored, decryptedPath); err != nil {
+			logger.WithError(err).Error("Failed to decrypt media to scan")
+			return scannerErrorResponse(http.StatusInternalServerError, scannerUnknownError, "Failed to scan media")
+		}
+		filePath = decryptedPath
+	}
+
+	clean, err := s.scanFile(ctx, filePath)
+	if err != nil {
+		logger.WithError(err).Error("Failed to scan media")
+		return scannerErrorResponse(http.StatusInternalServerError, scannerUnknownError, "Failed to scan media")
+	}
+	if !clean {
+		logger.Warn("Media failed content scan")
+		return scannerErrorResponse(http.StatusForbidden, scannerNotClean, "***VIRUS DETECTED***")
+	}
+	return nil
+}
+
+// copyToFile copies what is read from in into a new file at dst.
+func copyToFile(in io.Reader, dst string) error {
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close() // nolint: errcheck
+	if _, err = io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// scanFile runs the configured scanner on the file.
+func (s *contentScanner) scanFile(ctx context.Context, filePath string) (clean bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.ContentScanner.Timeout)
+	defer cancel()
+	command := s.cfg.ContentScanner.Command
+	args := append(append([]string{}, command[1:]...), filePath)
+	output, err := exec.CommandContext(ctx, command[0], args...).CombinedOutput()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+		return false, nil
+	default:
+		return false, fmt.Errorf("%s: %w: %s", command[0], err, strings.TrimSpace(string(output)))
+	}
+}
+
+// parseEncryptedRequest parses the body of a request to scan or download an
+// encrypted file.
+func parseEncryptedRequest(req *http.Request) (*encryptedFile, spec.ServerName, types.MediaID, *util.JSONResponse) {
+	var body encryptedRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return nil, "", "", scannerErrorResponse(http.StatusBadRequest, scannerMalformedJSON, "Malformed JSON: "+err.Error())
+	}
+	if len(body.EncryptedBody) > 0 {
+		return nil, "", "", scannerErrorResponse(http.StatusBadRequest, scannerBadDecryption, "encrypted_body is not supported")
+	}
+	if body.File == nil {
+		return nil, "", "", scannerErrorResponse(http.StatusBadRequest, scannerMalformedJSON, "Missing file")
+	}
+	origin, mediaID, err := body.File.mediaID()
+	if err != nil {
+		return nil, "", "", scannerErrorResponse(http.StatusBadRequest, scannerMalformedJSON, err.Error())
+	}
+	return body.File, origin, mediaID, nil
+}
+
+// setupContentScanner registers the content scanner API handlers.
+func setupContentScanner(
+	router *mux.Router,
+	scanner *contentScanner,
+	rateLimits *httputil.RateLimits,
+) {
+	unstableMux := router.PathPrefix("/unstable").Subrouter()
+
+	scanHandler := func(encrypted bool) http.Handler {
+		return httputil.MakeExternalAPI("content_scanner_scan", func(req *http.Request) util.JSONResponse {
+			if r := rateLimits.Limit(req, nil); r != nil {
+				return *r
+			}
+			var file *encryptedFile
+			var origin spec.ServerName
+			var mediaID types.MediaID
+			if encrypted {
+				var resErr *util.JSONResponse
+				if file, origin, mediaID, resErr = parseEncryptedRequest(req); resErr != nil {
+					return *resErr
+				}
+			} else {
+				vars, _ := httputil.URLDecodeMapValues(mux.Vars(req))
+				origin, mediaID = spec.ServerName(vars["serverName"]), types.MediaID(vars["mediaId"])
+			}
+			if resErr := scanner.scan(req.Context(), origin, mediaID, file); resErr != nil {
+				if info, ok := resErr.JSON.(scannerError); ok && info.Reason == scannerNotClean {
+					return util.JSONResponse{
+						Code: http.StatusOK,
+						JSON: scanResult{Clean: false, Info: info.Info},
+					}
+				}
+				return *resErr
+			}
+			return util.JSONResponse{
+				Code: http.StatusOK,
+				JSON: scanResult{Clean: true, Info: "File is clean"},
+			}
+		})
+	}
+
+	// Serves the media through the normal download handlers once it has been scanned.
+	downloadHandler := func(encrypted, thumbnail bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			req = withRequestLogger(util.RequestWithLogging(req))
+			util.SetCORSHeaders(w)
+			w.Header().Set("Cross-Origin-Resource-Policy", "cross-origin")
+			w.Header().Set("Content-Type", "application/json")
+			respondError := func(res util.JSONResponse) {
+				w.WriteHeader(res.Code)
+				_ = json.NewEncoder(w).Encode(res.JSON)
+			}
+			if r := rateLimits.Limit(req, nil); r != nil {
+				respondError(*r)
+				return
+			}
+
+			var file *encryptedFile
+			var origin spec.ServerName
+			var mediaID types.MediaID
+			if encrypted {
+				var resErr *util.JSONResponse
+				if file, origin, mediaID, resErr = parseEncryptedRequest(req); resErr != nil {
+					respondError(*resErr)
+					return
+				}
+			} else {
+				vars, _ := httputil.URLDecodeMapValues(mux.Vars(req))
+				origin, mediaID = spec.ServerName(vars["serverName"]), types.MediaID(vars["mediaId"])
+			}
+			if resErr := scanner.scan(req.Context(), origin, mediaID, file); resErr != nil {
+				respondError(*resErr)
+				return
+			}
+
+			Download(w, req, origin, mediaID, scanner.cfg, scanner.downloader, thumbnail, "")
+		}
+	}
+
+	unstableMux.Handle("/scan/{serverName}/{mediaId}", scanHandler(false)).Methods(http.MethodGet, http.MethodOptions)
+	unstableMux.Handle("/scan_encrypted", scanHandler(true)).Methods(http.MethodPost, http.MethodOptions)
+	unstableMux.Handle("/download/{serverName}/{mediaId}", downloadHandler(false, false)).Methods(http.MethodGet, http.MethodOptions)
+	unstableMux.Handle("/download_encrypted", downloadHandler(true, false)).Methods(http.MethodPost, http.MethodOptions)
+	unstableMux.Handle("/thumbnail/{serverName}/{mediaId}", downloadHandler(false, true)).Methods(http.MethodGet, http.MethodOptions)
+}
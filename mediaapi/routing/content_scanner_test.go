@@ -0,0 +1,135 @@
+package routing
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_contentScanner(t *testing.T) {
+	cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
+	db, err := storage.NewMediaAPIDatasource(cm, &config.DatabaseOptions{
+		ConnectionString:       "file::memory:",
+		MaxOpenConnections:     1,
+		MaxIdleConnections:     1,
+		ConnMaxLifetimeSeconds: -1,
+	})
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	// The scanner flags any file containing "EICAR".
+	script := filepath.Join(t.TempDir(), "scan.sh")
+	assert.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\n! grep -q EICAR \"$1\"\n"), 0700))
+	cfg := &config.MediaAPI{
+		Matrix:      &config.Global{},
+		AbsBasePath: config.Path(t.TempDir()),
+		ContentScanner: config.MediaContentScanner{
+			Enabled: true,
+			Command: []string{"sh", script},
+			Timeout: time.Minute,
+		},
+	}
+	cfg.Matrix.ServerName = "localhost"
+	scanner := &contentScanner{
+		cfg: cfg,
+		downloader: &downloader{
+			DB:                        db,
+			ActiveRemoteRequests:      &types.ActiveRemoteRequests{MXCToResult: map[string]*types.RemoteRequestResult{}},
+			ActiveThumbnailGeneration: &types.ActiveThumbnailGeneration{PathToResult: map[string]*types.ThumbnailGenerationResult{}},
+		},
+	}
+
+	storeMedia := func(mediaID types.MediaID, hash types.Base64Hash, content []byte) {
+		path, err := fileutils.GetPathFromBase64Hash(hash, cfg.AbsBasePath, cfg.StoreLayout)
+		assert.NoError(t, err)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0770))
+		assert.NoError(t, os.WriteFile(path, content, 0660))
+		assert.NoError(t, db.StoreMediaMetadata(ctx, &types.MediaMetadata{
+			MediaID: mediaID, Origin: "localhost", Base64Hash: hash, FileSizeBytes: types.FileSizeBytes(len(content)),
+		}))
+	}
+
+	// encrypt encrypts the content like a client would for an attachment.
+	key := make([]byte, 32)
+	iv := make([]byte, aes.BlockSize)
+	key[0], iv[0] = 1, 2
+	encrypt := func(mediaID types.MediaID, content []byte) *encryptedFile {
+		block, err := aes.NewCipher(key)
+		assert.NoError(t, err)
+		ciphertext := make([]byte, len(content))
+		cipher.NewCTR(block, iv).XORKeyStream(ciphertext, content)
+		hash := sha256.Sum256(ciphertext)
+		storeMedia(mediaID, types.Base64Hash(base64.RawURLEncoding.EncodeToString(hash[:])), ciphertext)
+		file := &encryptedFile{
+			URL:    "mxc://localhost/" + string(mediaID),
+			IV:     base64.RawStdEncoding.EncodeToString(iv),
+			Hashes: map[string]string{"sha256": base64.RawStdEncoding.EncodeToString(hash[:])},
+			V:      "v2",
+		}
+		file.Key.Alg = "A256CTR"
+		file.Key.K = base64.RawURLEncoding.EncodeToString(key)
+		return file
+	}
+
+	storeMedia("clean", "cleanhash", []byte("hello world"))
+	storeMedia("infected", "infectedhash", []byte("EICAR test file"))
+	cleanFile := encrypt("cleanencrypted", []byte("hello world"))
+	infectedFile := encrypt("infectedencrypted", []byte("EICAR test file"))
+
+	// scanReason returns the reason a scan failed, or "" if the media is clean.
+	scanReason := func(mediaID types.MediaID, file *encryptedFile) (int, string) {
+		resErr := scanner.scan(ctx, "localhost", mediaID, file)
+		if resErr == nil {
+			return http.StatusOK, ""
+		}
+		return resErr.Code, resErr.JSON.(scannerError).Reason
+	}
+
+	code, reason := scanReason("clean", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "", reason)
+
+	code, reason = scanReason("infected", nil)
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, scannerNotClean, reason)
+
+	code, reason = scanReason("unknown", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, scannerNotFound, reason)
+
+	// Encrypted media is scanned after decrypting it, as the ciphertext
+	// doesn't contain anything recognisable.
+	code, reason = scanReason("cleanencrypted", cleanFile)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "", reason)
+
+	code, reason = scanReason("infectedencrypted", infectedFile)
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, scannerNotClean, reason)
+
+	// The wrong hash fails to decrypt
+	wrongHash := *cleanFile
+	wrongHash.Hashes = infectedFile.Hashes
+	code, reason = scanReason("cleanencrypted", &wrongHash)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, scannerFailedToDecrypt, reason)
+
+	// Decrypted files are removed once scanned
+	entries, err := os.ReadDir(filepath.Join(string(cfg.AbsBasePath), "tmp"))
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
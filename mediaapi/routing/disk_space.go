@@ -0,0 +1,116 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var mediaStoreFreeBytes = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "mediaapi",
+		Name:      "store_free_bytes",
+		Help:      "The free space on the filesystem of the media store",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(mediaStoreFreeBytes)
+}
+
+// The states of the free space of the media store, from best to worst.
+const (
+	diskSpaceOK int32 = iota
+	diskSpaceWarning
+	diskSpaceLow
+)
+
+// diskSpaceMonitor checks the free space on the filesystem of the media store,
+// warns before it fills up and refuses uploads while it is low.
+type diskSpaceMonitor struct {
+	cfg   *config.MediaDiskSpace
+	path  config.Path
+	state atomic.Int32
+}
+
+func newDiskSpaceMonitor(cfg *config.MediaDiskSpace, path config.Path) *diskSpaceMonitor {
+	return &diskSpaceMonitor{cfg: cfg, path: path}
+}
+
+// run checks the free space every interval, forever.
+func (m *diskSpaceMonitor) run() {
+	logger := log.WithField("component", "media_disk_space")
+	for {
+		time.Sleep(m.cfg.CheckInterval)
+		m.check(logger)
+	}
+}
+
+// check checks the free space, and logs when it crosses either threshold. It
+// returns false if the free space couldn't be checked.
+func (m *diskSpaceMonitor) check(logger *log.Entry) bool {
+	free, err := fileutils.FreeSpace(m.path)
+	if err != nil {
+		logger.WithError(err).WithField("path", m.path).Error("Failed to check the free space of the media store")
+		return false
+	}
+	mediaStoreFreeBytes.Set(float64(free))
+
+	state := diskSpaceOK
+	switch {
+	case m.cfg.MinFreeBytes > 0 && free < uint64(m.cfg.MinFreeBytes):
+		state = diskSpaceLow
+	case m.cfg.WarnFreeBytes > 0 && free < uint64(m.cfg.WarnFreeBytes):
+		state = diskSpaceWarning
+	}
+	if m.state.Swap(state) == state {
+		return true
+	}
+	logger = logger.WithFields(log.Fields{
+		"path":       m.path,
+		"free_bytes": free,
+	})
+	switch state {
+	case diskSpaceLow:
+		logger.WithField("min_free_bytes", m.cfg.MinFreeBytes).Error("The media store is almost full, refusing uploads until space is freed")
+	case diskSpaceWarning:
+		logger.WithField("warn_free_bytes", m.cfg.WarnFreeBytes).Warn("The media store is filling up")
+	default:
+		logger.Info("The media store has enough free space again")
+	}
+	return true
+}
+
+// refuseUpload returns an error response if uploads are being refused because
+// the media store is almost full.
+func (m *diskSpaceMonitor) refuseUpload() *util.JSONResponse {
+	if m.state.Load() != diskSpaceLow {
+		return nil
+	}
+	return &util.JSONResponse{
+		Code: http.StatusInsufficientStorage,
+		JSON: spec.Unknown("The server is running out of storage space, so uploads are refused until it is freed. Try again later."),
+	}
+}
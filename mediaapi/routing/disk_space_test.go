@@ -0,0 +1,45 @@
+package routing
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskSpaceMonitor(t *testing.T) {
+	logger := logrus.NewEntry(logrus.New())
+	cfg := &config.MediaDiskSpace{}
+	monitor := newDiskSpaceMonitor(cfg, config.Path(t.TempDir()))
+
+	// No thresholds are set, so uploads are accepted.
+	assert.True(t, monitor.check(logger))
+	assert.Equal(t, diskSpaceOK, monitor.state.Load())
+	assert.Nil(t, monitor.refuseUpload())
+
+	// Uploads are still accepted while warning.
+	cfg.WarnFreeBytes = 1 << 60
+	assert.True(t, monitor.check(logger))
+	assert.Equal(t, diskSpaceWarning, monitor.state.Load())
+	assert.Nil(t, monitor.refuseUpload())
+
+	// Uploads are refused while there is less free space than the minimum.
+	cfg.MinFreeBytes = 1 << 59
+	assert.True(t, monitor.check(logger))
+	assert.Equal(t, diskSpaceLow, monitor.state.Load())
+	if res := monitor.refuseUpload(); assert.NotNil(t, res) {
+		assert.Equal(t, http.StatusInsufficientStorage, res.Code)
+	}
+
+	// Uploads are accepted again once there is enough space.
+	cfg.MinFreeBytes, cfg.WarnFreeBytes = 0, 0
+	assert.True(t, monitor.check(logger))
+	assert.Nil(t, monitor.refuseUpload())
+
+	// Failing to check the free space doesn't change the state.
+	monitor = newDiskSpaceMonitor(cfg, config.Path(t.TempDir()+"/missing"))
+	assert.False(t, monitor.check(logger))
+	assert.Nil(t, monitor.refuseUpload())
+}
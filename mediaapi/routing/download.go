@@ -20,22 +20,26 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"math"
 	"mime"
 	"net/http"
 	"net/url"
-	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 	"unicode"
 
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/mediaapi/fileutils"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/thumbnailer"
 	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/mediaapi/types/mxc"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/maintenance"
 	"github.com/matrix-org/gomatrixserverlib/fclient"
 	"github.com/matrix-org/gomatrixserverlib/spec"
 	"github.com/matrix-org/util"
@@ -43,15 +47,39 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-const mediaIDCharacters = "A-Za-z0-9_=-"
-
-// Note: unfortunately regex.MustCompile() cannot be assigned to a const
-var mediaIDRegex = regexp.MustCompile("^[" + mediaIDCharacters + "]+$")
-
 // Regular expressions to help us cope with Content-Disposition parsing
 var rfc2183 = regexp.MustCompile(`filename\=utf-8\"(.*)\"`)
 var rfc6266 = regexp.MustCompile(`filename\*\=utf-8\'\'(.*)`)
 
+// downloader holds what is needed to serve downloads and thumbnails, shared
+// by all requests. The media API config isn't part of it, as it can be reloaded
+// between requests.
+type downloader struct {
+	DB     storage.Database
+	Client *fclient.Client
+	// Fetches remote files from the authenticated federation media endpoint,
+	// nil to fetch them from the unauthenticated endpoint.
+	FederationMedia           *federationMediaFetcher
+	ActiveRemoteRequests      *types.ActiveRemoteRequests
+	ActiveThumbnailGeneration *types.ActiveThumbnailGeneration
+	// Files with blocked hashes are refused, nil if there is no blocklist.
+	Blocklist fileutils.HashBlocklist
+	// Media from blocked servers is refused, nil if there is no blocklist.
+	OriginBlocklist *originBlocklist
+	// Encrypts files in the media store, nil if there is no master key.
+	Encryption *fileutils.Encryption
+	// Compresses files of compressible content types, nil if files aren't compressed.
+	Compression *fileutils.Compression
+	// The media store and its replicas to read files from, nil to only read from the media store.
+	Backends *fileutils.Backends
+	// Caches the content of small files, nil if files aren't cached.
+	FileCache *fileutils.FileCache
+	// Records when media was last accessed, nil to not record it.
+	LastAccess *lastAccessRecorder
+	// Keeps the remote media cache within its limits, nil if it has none.
+	RemoteMediaJanitor *maintenance.Job
+}
+
 // downloadRequest metadata included in or derivable from a download or thumbnail request
 // https://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-media-r0-download-servername-mediaid
 // http://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-media-r0-thumbnail-servername-mediaid
@@ -61,6 +89,25 @@ type downloadRequest struct {
 	ThumbnailSize      types.ThumbnailSize
 	Logger             *log.Entry
 	DownloadFilename   string
+	downloader
+	// Fsyncs files when they are moved into the media store.
+	Fsync bool
+	// Where files are written before they are moved into the media store.
+	TempPath config.Path
+	// The hashes to compute for files in addition to SHA-256.
+	SecondaryHashes []string
+	// The Accept-Encoding header of the request, to send compressed files as they are stored if possible.
+	AcceptEncoding string
+	// Whether to respond without waiting for thumbnails that are being generated.
+	DeferredThumbnails *config.MediaDeferredThumbnails
+	// Set once the remote file has started streaming to the client, after
+	// which we can no longer send an error response.
+	streamed bool
+	// The active request this request is fetching the remote file for, if any.
+	activeRequest *types.RemoteRequestResult
+	// The cached copy of remote media that has expired and is being fetched
+	// again. It is only removed once the new copy has been stored.
+	expiredMedia *types.MediaMetadata
 }
 
 // Taken from: https://github.com/matrix-org/synapse/blob/c3627d0f99ed5a23479305dc2bd0e71ca25ce2b1/synapse/media/_base.py#L53C1-L84
@@ -109,10 +156,7 @@ func Download(
 	origin spec.ServerName,
 	mediaID types.MediaID,
 	cfg *config.MediaAPI,
-	db storage.Database,
-	client *fclient.Client,
-	activeRemoteRequests *types.ActiveRemoteRequests,
-	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	d *downloader,
 	isThumbnailRequest bool,
 	customFilename string,
 ) {
@@ -127,6 +171,14 @@ func Download(
 			"MediaID": mediaID,
 		}),
 		DownloadFilename: customFilename,
+		downloader:       *d,
+		Fsync:            cfg.Fsync,
+		TempPath:         cfg.TempDir(),
+		SecondaryHashes:  cfg.SecondaryHashes,
+		AcceptEncoding:   req.Header.Get("Accept-Encoding"),
+	}
+	if cfg.DeferredThumbnails.Enabled {
+		dReq.DeferredThumbnails = &cfg.DeferredThumbnails
 	}
 
 	if dReq.IsThumbnailRequest {
@@ -156,15 +208,30 @@ func Download(
 		return
 	}
 
-	metadata, err := dReq.doDownload(
-		req.Context(), w, cfg, db, client,
-		activeRemoteRequests, activeThumbnailGeneration,
-	)
+	metadata, err := dReq.doDownload(req.Context(), w, cfg)
+	if err != nil && dReq.streamed {
+		// The headers have already been sent, so all we can do is cut the
+		// response short. The client will notice that the body is shorter
+		// than the Content-Length.
+		dReq.Logger.WithError(err).Error("Failed to stream remote file")
+		return
+	}
+	if errors.Is(err, errThumbnailPending) {
+		dReq.respondThumbnailPending(w)
+		return
+	}
 	if err != nil {
+		var tooLarge *fileutils.FileTooLargeError
+		if errors.As(err, &tooLarge) {
+			dReq.Logger.WithError(err).Warn("Remote file is too large")
+			dReq.jsonErrorResponse(w, *requestEntityTooLargeJSONResponse(tooLarge.Limit))
+			return
+		}
 		// If we bubbled up a os.PathError, e.g. no such file or directory, don't send
-		// it to the client, be more generic.
+		// it to the client, be more generic. Blocked files are reported as not found,
+		// like quarantined ones.
 		var perr *fs.PathError
-		if errors.As(err, &perr) {
+		if errors.As(err, &perr) || errors.Is(err, fileutils.ErrHashBlocked) {
 			dReq.Logger.WithError(err).Error("failed to open file")
 			dReq.jsonErrorResponse(w, util.JSONResponse{
 				Code: http.StatusNotFound,
@@ -190,6 +257,34 @@ func Download(
 
 }
 
+// errThumbnailPending is returned when the requested thumbnail is being
+// generated and deferred thumbnails are enabled.
+var errThumbnailPending = errors.New("thumbnail is being generated")
+
+// respondThumbnailPending responds to a request for a thumbnail that is being
+// generated, with the placeholder image if there is one, or a 503 otherwise.
+// Either way, the client is told when to try again, and the response mustn't
+// be cached.
+func (r *downloadRequest) respondThumbnailPending(w http.ResponseWriter) {
+	r.Logger.Debug("Thumbnail is being generated, not waiting for it")
+	retryAfter := int64(math.Ceil(r.DeferredThumbnails.RetryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	if placeholder := r.DeferredThumbnails.Placeholder; len(placeholder) > 0 {
+		w.Header().Set("Content-Type", http.DetectContentType(placeholder))
+		w.Header().Set("Content-Length", strconv.Itoa(len(placeholder)))
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write(placeholder); err != nil {
+			r.Logger.WithError(err).Warn("Failed to write placeholder thumbnail")
+		}
+		return
+	}
+	r.jsonErrorResponse(w, util.JSONResponse{
+		Code: http.StatusServiceUnavailable,
+		JSON: spec.Unknown("The thumbnail is being generated, try again later"),
+	})
+}
+
 func (r *downloadRequest) jsonErrorResponse(w http.ResponseWriter, res util.JSONResponse) {
 	// Marshal JSON response into raw bytes to send as the HTTP body
 	resBytes, err := json.Marshal(res.JSON)
@@ -210,18 +305,18 @@ func (r *downloadRequest) jsonErrorResponse(w http.ResponseWriter, res util.JSON
 
 // Validate validates the downloadRequest fields
 func (r *downloadRequest) Validate() *util.JSONResponse {
-	if !mediaIDRegex.MatchString(string(r.MediaMetadata.MediaID)) {
+	if err := mxc.ValidateMediaID(r.MediaMetadata.MediaID); err != nil {
 		return &util.JSONResponse{
 			Code: http.StatusNotFound,
-			JSON: spec.NotFound(fmt.Sprintf("mediaId must be a non-empty string using only characters in %v", mediaIDCharacters)),
+			JSON: spec.NotFound(fmt.Sprintf("mediaId must be a non-empty string of at most %d characters in %v", mxc.MaxMediaIDLength, mxc.MediaIDCharacters)),
 		}
 	}
-	// Note: the origin will be validated either by comparison to the configured server name of this homeserver
+	// Note: the origin will be checked either by comparison to the configured server name of this homeserver
 	// or by a DNS SRV record lookup when creating a request for remote files
-	if r.MediaMetadata.Origin == "" {
+	if err := (mxc.URI{ServerName: r.MediaMetadata.Origin, MediaID: r.MediaMetadata.MediaID}).Validate(); err != nil {
 		return &util.JSONResponse{
 			Code: http.StatusNotFound,
-			JSON: spec.NotFound("serverName must be a non-empty string"),
+			JSON: spec.NotFound("serverName must be a valid server name"),
 		}
 	}
 
@@ -250,17 +345,38 @@ func (r *downloadRequest) doDownload(
 	ctx context.Context,
 	w http.ResponseWriter,
 	cfg *config.MediaAPI,
-	db storage.Database,
-	client *fclient.Client,
-	activeRemoteRequests *types.ActiveRemoteRequests,
-	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 ) (*types.MediaMetadata, error) {
+	// Media from blocked servers is reported as not found, even if it was
+	// cached before they were blocked.
+	if r.OriginBlocklist != nil {
+		blocked, err := r.OriginBlocklist.isOriginBlocked(ctx, r.MediaMetadata.Origin)
+		if err != nil {
+			return nil, fmt.Errorf("r.OriginBlocklist.isOriginBlocked: %w", err)
+		}
+		if blocked {
+			return nil, nil
+		}
+	}
+
+	// Quarantined media is reported as not found.
+	quarantined, err := r.DB.IsMediaQuarantined(ctx, r.MediaMetadata.MediaID, r.MediaMetadata.Origin)
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.IsMediaQuarantined: %w", err)
+	}
+	if quarantined {
+		return nil, nil
+	}
+
 	// check if we have a record of the media in our database
-	mediaMetadata, err := db.GetMediaMetadata(
+	mediaMetadata, err := r.DB.GetMediaMetadata(
 		ctx, r.MediaMetadata.MediaID, r.MediaMetadata.Origin,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("db.GetMediaMetadata: %w", err)
+		return nil, fmt.Errorf("r.DB.GetMediaMetadata: %w", err)
+	}
+	if mediaMetadata != nil && isRemoteMediaExpired(cfg, mediaMetadata) {
+		// The cached copy is too old, so fetch the media again from the remote server.
+		r.expiredMedia, mediaMetadata = mediaMetadata, nil
 	}
 	if mediaMetadata == nil {
 		if r.MediaMetadata.Origin == cfg.Matrix.ServerName {
@@ -269,62 +385,102 @@ func (r *downloadRequest) doDownload(
 		}
 		// If we do not have a record and the origin is remote, we need to fetch it and respond with that file
 		resErr := r.getRemoteFile(
-			ctx, client, cfg, db, activeRemoteRequests, activeThumbnailGeneration,
+			ctx, w, r.Client, cfg, r.DB, r.ActiveRemoteRequests, r.ActiveThumbnailGeneration,
 		)
+		if resErr != nil && r.expiredMedia != nil && !r.streamed {
+			r.Logger.WithError(resErr).Warn("Failed to fetch expired remote media again, serving the cached copy")
+			r.MediaMetadata, resErr = r.expiredMedia, nil
+		}
 		if resErr != nil {
 			return nil, resErr
 		}
+		if r.streamed {
+			// The file was sent to the client while it was being fetched,
+			// which is only done if no hashes are blocked or quarantined.
+			return r.MediaMetadata, nil
+		}
 	} else {
 		// If we have a record, we can respond from the local file
 		r.MediaMetadata = mediaMetadata
 	}
+
+	quarantined, err = r.DB.IsHashQuarantined(ctx, r.MediaMetadata.Base64Hash)
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.IsHashQuarantined: %w", err)
+	}
+	if quarantined {
+		return nil, nil
+	}
+	if r.Blocklist != nil {
+		blocked, err := r.Blocklist.IsHashBlocked(ctx, r.MediaMetadata.Base64Hash)
+		if err != nil {
+			return nil, fmt.Errorf("r.Blocklist.IsHashBlocked: %w", err)
+		}
+		if blocked {
+			return nil, nil
+		}
+	}
+
+	// Keep track of when the media was last used, so that the least recently
+	// used remote media can be evicted from the cache first.
+	r.LastAccess.record(r.MediaMetadata.MediaID, r.MediaMetadata.Origin)
+
 	return r.respondFromLocalFile(
-		ctx, w, cfg.AbsBasePath, activeThumbnailGeneration,
-		cfg.MaxThumbnailGenerators, db,
-		cfg.DynamicThumbnails, cfg.ThumbnailSizes,
+		ctx, w, cfg.AbsBasePath, cfg.StoreLayout, r.ActiveThumbnailGeneration,
+		cfg.MaxThumbnailGenerators, r.DB,
+		cfg.DynamicThumbnails, cfg.ThumbnailSizes, cfg.ThumbnailSelection,
 	)
 }
 
+// openStoredFile opens a file in the media store, or in a replica of it if the
+// media store fails, unless its content is in the file cache.
+func (r *downloadRequest) openStoredFile(path string) (*fileutils.StoredFile, error) {
+	return r.FileCache.OpenStoredFile(path, func(path string) (*fileutils.StoredFile, error) {
+		if r.Backends != nil {
+			return r.Backends.OpenStoredFile(path, r.Encryption, r.Logger)
+		}
+		return fileutils.OpenStoredFile(path, r.Encryption)
+	})
+}
+
 // respondFromLocalFile reads a file from local storage and writes it to the http.ResponseWriter
 // If no file was found then returns nil, nil
 func (r *downloadRequest) respondFromLocalFile(
 	ctx context.Context,
 	w http.ResponseWriter,
 	absBasePath config.Path,
+	layout config.MediaStoreLayout,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 	db storage.Database,
 	dynamicThumbnails bool,
 	thumbnailSizes []config.ThumbnailSize,
+	thumbnailSelection string,
 ) (*types.MediaMetadata, error) {
-	filePath, err := fileutils.GetPathFromBase64Hash(r.MediaMetadata.Base64Hash, absBasePath)
+	filePath, err := fileutils.GetPathFromBase64Hash(r.MediaMetadata.Base64Hash, absBasePath, layout)
 	if err != nil {
 		return nil, fmt.Errorf("fileutils.GetPathFromBase64Hash: %w", err)
 	}
-	file, err := os.Open(filePath)
-	defer file.Close() // nolint: errcheck, staticcheck, megacheck
-	if err != nil {
-		return nil, fmt.Errorf("os.Open: %w", err)
-	}
-	stat, err := file.Stat()
+	file, err := r.openStoredFile(filePath)
 	if err != nil {
-		return nil, fmt.Errorf("file.Stat: %w", err)
+		return nil, fmt.Errorf("fileutils.OpenStoredFile: %w", err)
 	}
+	defer file.Close() // nolint: errcheck
 
-	if r.MediaMetadata.FileSizeBytes > 0 && int64(r.MediaMetadata.FileSizeBytes) != stat.Size() {
+	if r.MediaMetadata.FileSizeBytes > 0 && int64(r.MediaMetadata.FileSizeBytes) != file.Size() {
 		r.Logger.WithFields(log.Fields{
 			"fileSizeDatabase": r.MediaMetadata.FileSizeBytes,
-			"fileSizeDisk":     stat.Size(),
+			"fileSizeDisk":     file.Size(),
 		}).Warn("File size in database and on-disk differ.")
 		return nil, errors.New("file size in database and on-disk differ")
 	}
 
-	var responseFile *os.File
+	var responseFile *fileutils.StoredFile
 	var responseMetadata *types.MediaMetadata
 	if r.IsThumbnailRequest {
 		thumbFile, thumbMetadata, resErr := r.getThumbnailFile(
 			ctx, types.Path(filePath), activeThumbnailGeneration, maxThumbnailGenerators,
-			db, dynamicThumbnails, thumbnailSizes,
+			db, dynamicThumbnails, thumbnailSizes, thumbnailSelection,
 		)
 		if thumbFile != nil {
 			defer thumbFile.Close() // nolint: errcheck
@@ -360,19 +516,95 @@ func (r *downloadRequest) respondFromLocalFile(
 		}
 	}
 
-	w.Header().Set("Content-Type", string(responseMetadata.ContentType))
-	w.Header().Set("Content-Length", strconv.FormatInt(int64(responseMetadata.FileSizeBytes), 10))
+	setMediaResponseHeaders(w, responseMetadata)
+
+	// Compressed files are sent as they are stored if the client accepts their
+	// content coding, rather than decompressing them.
+	var responseReader io.Reader = responseFile
+	if encoding := responseFile.ContentEncoding(); encoding != "" {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsEncoding(r.AcceptEncoding, encoding) {
+			compressed, size, err := responseFile.CompressedReader()
+			if err != nil {
+				return nil, fmt.Errorf("responseFile.CompressedReader: %w", err)
+			}
+			w.Header().Set("Content-Encoding", encoding)
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+			responseReader = compressed
+		}
+	}
+
+	if _, err := io.Copy(w, responseReader); err != nil {
+		return nil, fmt.Errorf("io.Copy: %w", err)
+	}
+	return responseMetadata, nil
+}
+
+// acceptsEncoding returns whether the Accept-Encoding header accepts the
+// content coding, either by name or with "*", with a non-zero quality value.
+func acceptsEncoding(acceptEncoding, encoding string) bool {
+	wildcard := false
+	for _, coding := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(coding, ";")
+		name = strings.TrimSpace(name)
+		ok := true
+		if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if quality, err := strconv.ParseFloat(q, 64); err == nil && quality == 0 {
+				ok = false
+			}
+		}
+		switch {
+		case strings.EqualFold(name, encoding):
+			return ok
+		case name == "*":
+			wildcard = ok
+		}
+	}
+	return wildcard
+}
+
+// setMediaResponseHeaders sets the headers for responding with the given file
+func setMediaResponseHeaders(w http.ResponseWriter, metadata *types.MediaMetadata) {
+	w.Header().Set("Content-Type", string(metadata.ContentType))
+	w.Header().Set("Content-Length", strconv.FormatInt(int64(metadata.FileSizeBytes), 10))
 	contentSecurityPolicy := "default-src 'none';" +
 		" script-src 'none';" +
 		" plugin-types application/pdf;" +
 		" style-src 'unsafe-inline';" +
 		" object-src 'self';"
 	w.Header().Set("Content-Security-Policy", contentSecurityPolicy)
+}
 
-	if _, err := io.Copy(w, responseFile); err != nil {
-		return nil, fmt.Errorf("io.Copy: %w", err)
+// streamingResponseWriter forwards a remote file to the client while it is being
+// cached. If the client goes away then we stop writing to it, but carry on caching
+// the file so that the fetch isn't wasted for everyone else.
+type streamingResponseWriter struct {
+	w   http.ResponseWriter
+	err error
+}
+
+func (s *streamingResponseWriter) Write(p []byte) (int, error) {
+	if s.err == nil {
+		_, s.err = s.w.Write(p)
 	}
-	return responseMetadata, nil
+	return len(p), nil
+}
+
+// mayStreamRemoteFile returns whether a remote file may be sent to the client
+// before it has been hashed. That is only the case if no hash is blocked or
+// quarantined, as otherwise the file may have to be refused once its hash is
+// known.
+func (r *downloadRequest) mayStreamRemoteFile(ctx context.Context, db storage.Database) (bool, error) {
+	if r.Blocklist != nil {
+		if blocked, err := r.Blocklist.IsAnyHashBlocked(ctx); err != nil || blocked {
+			return false, err
+		}
+	}
+	quarantined, err := db.IsAnyFileQuarantined(ctx)
+	if err != nil {
+		return false, fmt.Errorf("db.IsAnyFileQuarantined: %w", err)
+	}
+	return !quarantined, nil
 }
 
 func (r *downloadRequest) addDownloadFilenameToHeaders(
@@ -448,11 +680,15 @@ func (r *downloadRequest) getThumbnailFile(
 	db storage.Database,
 	dynamicThumbnails bool,
 	thumbnailSizes []config.ThumbnailSize,
-) (*os.File, *types.ThumbnailMetadata, error) {
+	thumbnailSelection string,
+) (*fileutils.StoredFile, *types.ThumbnailMetadata, error) {
 	var thumbnail *types.ThumbnailMetadata
 	var err error
 
 	if dynamicThumbnails {
+		if r.thumbnailPending(filePath, r.ThumbnailSize, activeThumbnailGeneration) {
+			return nil, nil, errThumbnailPending
+		}
 		thumbnail, err = r.generateThumbnail(
 			ctx, filePath, r.ThumbnailSize, activeThumbnailGeneration,
 			maxThumbnailGenerators, db,
@@ -475,7 +711,7 @@ func (r *downloadRequest) getThumbnailFile(
 		// If we get a thumbnailSize, a pre-generated thumbnail would be best but it is not yet generated.
 		// If we get a thumbnail, we're done.
 		var thumbnailSize *types.ThumbnailSize
-		thumbnail, thumbnailSize = thumbnailer.SelectThumbnail(r.ThumbnailSize, thumbnails, thumbnailSizes)
+		thumbnail, thumbnailSize = thumbnailer.SelectThumbnail(r.ThumbnailSize, thumbnails, thumbnailSizes, thumbnailSelection)
 		// If dynamicThumbnails is true and we are not over-loaded then we would have generated what was requested above.
 		// So we don't try to generate a pre-generated thumbnail here.
 		if thumbnailSize != nil && !dynamicThumbnails {
@@ -484,6 +720,9 @@ func (r *downloadRequest) getThumbnailFile(
 				"Height":       thumbnailSize.Height,
 				"ResizeMethod": thumbnailSize.ResizeMethod,
 			}).Debug("Pre-generating thumbnail for immediate response.")
+			if r.thumbnailPending(filePath, *thumbnailSize, activeThumbnailGeneration) {
+				return nil, nil, errThumbnailPending
+			}
 			thumbnail, err = r.generateThumbnail(
 				ctx, filePath, *thumbnailSize, activeThumbnailGeneration,
 				maxThumbnailGenerators, db,
@@ -504,23 +743,27 @@ func (r *downloadRequest) getThumbnailFile(
 		"ContentType":   thumbnail.MediaMetadata.ContentType,
 	})
 	thumbPath := string(thumbnailer.GetThumbnailPath(types.Path(filePath), thumbnail.ThumbnailSize))
-	thumbFile, err := os.Open(string(thumbPath))
-	if err != nil {
-		thumbFile.Close() // nolint: errcheck
-		return nil, nil, fmt.Errorf("os.Open: %w", err)
-	}
-	thumbStat, err := thumbFile.Stat()
+	thumbFile, err := r.openStoredFile(thumbPath)
 	if err != nil {
-		thumbFile.Close() // nolint: errcheck
-		return nil, nil, fmt.Errorf("thumbFile.Stat: %w", err)
+		return nil, nil, fmt.Errorf("fileutils.OpenStoredFile: %w", err)
 	}
-	if types.FileSizeBytes(thumbStat.Size()) != thumbnail.MediaMetadata.FileSizeBytes {
+	if types.FileSizeBytes(thumbFile.Size()) != thumbnail.MediaMetadata.FileSizeBytes {
 		thumbFile.Close() // nolint: errcheck
 		return nil, nil, errors.New("thumbnail file sizes on disk and in database differ")
 	}
 	return thumbFile, thumbnail, nil
 }
 
+// thumbnailPending returns true if the thumbnail is being generated and the
+// request shouldn't wait for it.
+func (r *downloadRequest) thumbnailPending(
+	filePath types.Path,
+	thumbnailSize types.ThumbnailSize,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+) bool {
+	return r.DeferredThumbnails != nil && thumbnailer.IsGenerating(filePath, thumbnailSize, activeThumbnailGeneration)
+}
+
 func (r *downloadRequest) generateThumbnail(
 	ctx context.Context,
 	filePath types.Path,
@@ -536,7 +779,7 @@ func (r *downloadRequest) generateThumbnail(
 	})
 	busy, err := thumbnailer.GenerateThumbnail(
 		ctx, filePath, thumbnailSize, r.MediaMetadata,
-		activeThumbnailGeneration, maxThumbnailGenerators, db, r.Logger,
+		activeThumbnailGeneration, maxThumbnailGenerators, db, r.Encryption, r.Logger,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("thumbnailer.GenerateThumbnail: %w", err)
@@ -558,17 +801,28 @@ func (r *downloadRequest) generateThumbnail(
 // getRemoteFile fetches the remote file and caches it locally
 // A hash map of active remote requests to a struct containing a sync.Cond is used to only download remote files once,
 // regardless of how many download requests are received.
+// If w is not nil then the file may be streamed to it while it is being fetched, in
+// which case r.streamed is set and the caller must not respond again.
 // Note: The named errorResponse return variable is used in a deferred broadcast of the metadata and error response to waiting goroutines.
 func (r *downloadRequest) getRemoteFile(
 	ctx context.Context,
+	w http.ResponseWriter,
 	client *fclient.Client,
 	cfg *config.MediaAPI,
 	db storage.Database,
 	activeRemoteRequests *types.ActiveRemoteRequests,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 ) (errorResponse error) {
+	if w != nil && !r.IsThumbnailRequest {
+		// If another goroutine is already fetching the file, send the client
+		// what it has fetched so far rather than waiting for all of it.
+		if streamed, err := r.streamFromActiveRequest(ctx, w, db, activeRemoteRequests); streamed || err != nil {
+			return err
+		}
+	}
+
 	// Note: getMediaMetadataFromActiveRequest uses mutexes and conditions from activeRemoteRequests
-	mediaMetadata, resErr := r.getMediaMetadataFromActiveRequest(activeRemoteRequests)
+	mediaMetadata, resErr := r.getMediaMetadataFromActiveRequest(ctx, activeRemoteRequests)
 	if resErr != nil {
 		return resErr
 	} else if mediaMetadata != nil {
@@ -586,6 +840,11 @@ func (r *downloadRequest) getRemoteFile(
 			r.broadcastMediaMetadata(activeRemoteRequests, errorResponse)
 		}()
 
+		// Other requests may be waiting for the file, so carry on fetching it
+		// if this request is cancelled.
+		ctx, cancel := context.WithTimeout(withoutCancel(ctx), remoteFetchTimeout)
+		defer cancel()
+
 		// check if we have a record of the media in our database
 		mediaMetadata, err := db.GetMediaMetadata(
 			ctx, r.MediaMetadata.MediaID, r.MediaMetadata.Origin,
@@ -594,18 +853,23 @@ func (r *downloadRequest) getRemoteFile(
 			return fmt.Errorf("db.GetMediaMetadata: %w", err)
 		}
 
+		if mediaMetadata != nil && r.expiredMedia != nil && isRemoteMediaExpired(cfg, mediaMetadata) {
+			// The record is the expired copy, which is replaced once the file
+			// has been fetched again.
+			mediaMetadata = nil
+		}
+
 		if mediaMetadata == nil {
 			// If we do not have a record, we need to fetch the remote file first and then respond from the local file
 			err := r.fetchRemoteFileAndStoreMetadata(
-				ctx, client,
-				cfg.AbsBasePath, cfg.MaxFileSizeBytes, db,
-				cfg.ThumbnailSizes, activeThumbnailGeneration,
-				cfg.MaxThumbnailGenerators,
+				ctx, w, client, cfg, db, activeThumbnailGeneration,
 			)
 			if err != nil {
 				r.Logger.WithError(err).Errorf("r.fetchRemoteFileAndStoreMetadata: failed to fetch remote file")
 				return err
 			}
+			// The cache has grown, so make sure it's still within the configured limit.
+			r.RemoteMediaJanitor.Trigger()
 		} else {
 			// If we have a record, we can respond from the local file
 			r.MediaMetadata = mediaMetadata
@@ -614,9 +878,31 @@ func (r *downloadRequest) getRemoteFile(
 	return nil
 }
 
-func (r *downloadRequest) getMediaMetadataFromActiveRequest(activeRemoteRequests *types.ActiveRemoteRequests) (*types.MediaMetadata, error) {
+// remoteFetchTimeout is how long fetching a remote file may take, regardless of
+// whether the requests waiting for it are cancelled.
+var remoteFetchTimeout = time.Minute * 10
+
+// withoutCancel returns a context with the values of ctx, which isn't done when
+// ctx is, like context.WithoutCancel in Go 1.21.
+func withoutCancel(ctx context.Context) context.Context {
+	return detachedContext{parent: ctx}
+}
+
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+// getMediaMetadataFromActiveRequest waits for another goroutine that is fetching
+// the file, if there is one, until it is done or ctx is. Otherwise it makes this
+// request the one fetching the file, and returns nil.
+func (r *downloadRequest) getMediaMetadataFromActiveRequest(ctx context.Context, activeRemoteRequests *types.ActiveRemoteRequests) (*types.MediaMetadata, error) {
 	// Check if there is an active remote request for the file
-	mxcURL := "mxc://" + string(r.MediaMetadata.Origin) + "/" + string(r.MediaMetadata.MediaID)
+	mxcURL := mxc.URI{ServerName: r.MediaMetadata.Origin, MediaID: r.MediaMetadata.MediaID}.String()
 
 	activeRemoteRequests.Lock()
 	defer activeRemoteRequests.Unlock()
@@ -624,8 +910,27 @@ func (r *downloadRequest) getMediaMetadataFromActiveRequest(activeRemoteRequests
 	if activeRemoteRequestResult, ok := activeRemoteRequests.MXCToResult[mxcURL]; ok {
 		r.Logger.Trace("Waiting for another goroutine to fetch the remote file.")
 
+		// Stop waiting if this request is cancelled, without affecting the
+		// fetch or the other requests waiting for it.
+		stopped := make(chan struct{})
+		defer close(stopped)
+		go func() {
+			select {
+			case <-ctx.Done():
+				activeRemoteRequests.Lock()
+				activeRemoteRequestResult.Cond.Broadcast()
+				activeRemoteRequests.Unlock()
+			case <-stopped:
+			}
+		}()
+
 		// NOTE: Wait unlocks and locks again internally. There is still a deferred Unlock() that will unlock this.
-		activeRemoteRequestResult.Cond.Wait()
+		for !activeRemoteRequestResult.Done {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			activeRemoteRequestResult.Cond.Wait()
+		}
 		if activeRemoteRequestResult.Error != nil {
 			return nil, activeRemoteRequestResult.Error
 		}
@@ -638,24 +943,77 @@ func (r *downloadRequest) getMediaMetadataFromActiveRequest(activeRemoteRequests
 	}
 
 	// No active remote request so create one
-	activeRemoteRequests.MXCToResult[mxcURL] = &types.RemoteRequestResult{
+	r.activeRequest = &types.RemoteRequestResult{
 		Cond: &sync.Cond{L: activeRemoteRequests},
 	}
+	activeRemoteRequests.MXCToResult[mxcURL] = r.activeRequest
 
 	return nil, nil
 }
 
+// streamFromActiveRequest sends the file to the client from the temp file that
+// another goroutine is fetching it into, waiting for each part of it to be
+// written. It returns false if there is no such file to read, or the file may
+// have to be refused once its hash is known, in which case nothing has been
+// sent to the client.
+func (r *downloadRequest) streamFromActiveRequest(
+	ctx context.Context,
+	w http.ResponseWriter,
+	db storage.Database,
+	activeRemoteRequests *types.ActiveRemoteRequests,
+) (bool, error) {
+	mxcURL := mxc.URI{ServerName: r.MediaMetadata.Origin, MediaID: r.MediaMetadata.MediaID}.String()
+
+	activeRemoteRequests.Lock()
+	var partial *types.PartialFile
+	if activeRemoteRequestResult, ok := activeRemoteRequests.MXCToResult[mxcURL]; ok {
+		partial = activeRemoteRequestResult.PartialFile
+	}
+	activeRemoteRequests.Unlock()
+	if partial == nil {
+		return false, nil
+	}
+	if mayStream, err := r.mayStreamRemoteFile(ctx, db); err != nil || !mayStream {
+		return false, err
+	}
+
+	reader, err := partial.NewReader(ctx)
+	if errors.Is(err, types.ErrPartialFileUnavailable) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer reader.Close() // nolint: errcheck
+
+	r.Logger.Trace("Streaming the remote file as another goroutine fetches it.")
+	metadata := partial.MediaMetadata
+	if err = r.addDownloadFilenameToHeaders(w, &metadata); err != nil {
+		return false, err
+	}
+	setMediaResponseHeaders(w, &metadata)
+	r.MediaMetadata = &metadata
+	r.streamed = true
+	if _, err = io.Copy(w, reader); err != nil {
+		return true, fmt.Errorf("failed to stream partially fetched file: %w", err)
+	}
+	return true, nil
+}
+
 // broadcastMediaMetadata broadcasts the media metadata and error response to waiting goroutines
 // Only the owner of the activeRemoteRequestResult for this origin and media ID should call this function.
 func (r *downloadRequest) broadcastMediaMetadata(activeRemoteRequests *types.ActiveRemoteRequests, err error) {
 	activeRemoteRequests.Lock()
 	defer activeRemoteRequests.Unlock()
-	mxcURL := "mxc://" + string(r.MediaMetadata.Origin) + "/" + string(r.MediaMetadata.MediaID)
+	mxcURL := mxc.URI{ServerName: r.MediaMetadata.Origin, MediaID: r.MediaMetadata.MediaID}.String()
 	if activeRemoteRequestResult, ok := activeRemoteRequests.MXCToResult[mxcURL]; ok {
 		r.Logger.Trace("Signalling other goroutines waiting for this goroutine to fetch the file.")
 		activeRemoteRequestResult.MediaMetadata = r.MediaMetadata
 		activeRemoteRequestResult.Error = err
+		activeRemoteRequestResult.Done = true
 		activeRemoteRequestResult.Cond.Broadcast()
+		if activeRemoteRequestResult.PartialFile != nil {
+			activeRemoteRequestResult.PartialFile.Finish(err)
+		}
 	}
 	delete(activeRemoteRequests.MXCToResult, mxcURL)
 }
@@ -663,16 +1021,24 @@ func (r *downloadRequest) broadcastMediaMetadata(activeRemoteRequests *types.Act
 // fetchRemoteFileAndStoreMetadata fetches the file from the remote server and stores its metadata in the database
 func (r *downloadRequest) fetchRemoteFileAndStoreMetadata(
 	ctx context.Context,
+	w http.ResponseWriter,
 	client *fclient.Client,
-	absBasePath config.Path,
-	maxFileSizeBytes config.FileSizeBytes,
+	cfg *config.MediaAPI,
 	db storage.Database,
-	thumbnailSizes []config.ThumbnailSize,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
-	maxThumbnailGenerators int,
 ) error {
+	if w != nil {
+		mayStream, err := r.mayStreamRemoteFile(ctx, db)
+		if err != nil {
+			return err
+		}
+		if !mayStream {
+			// Respond from the local file once its hash has been checked.
+			w = nil
+		}
+	}
 	finalPath, duplicate, err := r.fetchRemoteFile(
-		ctx, client, absBasePath, maxFileSizeBytes,
+		ctx, w, client, cfg.AbsBasePath, cfg.StoreLayout, cfg.MaxFileSizeBytes,
 	)
 	if err != nil {
 		return err
@@ -685,8 +1051,16 @@ func (r *downloadRequest) fetchRemoteFileAndStoreMetadata(
 		"ContentType":   r.MediaMetadata.ContentType,
 	}).Debug("Storing file metadata to media repository database")
 
+	// An expired copy of the media is replaced by the new one, and its file
+	// removed unless the new copy is stored in the same file.
+	replacedUnreferenced := false
 	// FIXME: timeout db request
-	if err := db.StoreMediaMetadata(ctx, r.MediaMetadata); err != nil {
+	if r.expiredMedia != nil {
+		replacedUnreferenced, err = db.ReplaceMediaMetadata(ctx, r.MediaMetadata)
+	} else {
+		err = db.StoreMediaMetadata(ctx, r.MediaMetadata)
+	}
+	if err != nil {
 		// If the file is a duplicate (has the same hash as an existing file) then
 		// there is valid metadata in the database for that file. As such we only
 		// remove the file if it is not a duplicate.
@@ -698,11 +1072,16 @@ func (r *downloadRequest) fetchRemoteFileAndStoreMetadata(
 		// there is no need to handle that separately
 		return errors.New("failed to store file metadata in DB")
 	}
+	if replacedUnreferenced {
+		if err = removeUnreferencedFile(ctx, cfg, db, r.expiredMedia.Base64Hash, r.Logger); err != nil {
+			r.Logger.WithError(err).Warn("Failed to remove the file of expired remote media")
+		}
+	}
 
 	go func() {
 		busy, err := thumbnailer.GenerateThumbnails(
-			context.Background(), finalPath, thumbnailSizes, r.MediaMetadata,
-			activeThumbnailGeneration, maxThumbnailGenerators, db, r.Logger,
+			context.Background(), finalPath, cfg.ThumbnailSizes, r.MediaMetadata,
+			activeThumbnailGeneration, cfg.MaxThumbnailGenerators, db, r.Encryption, r.Logger,
 		)
 		if err != nil {
 			r.Logger.WithError(err).Warn("Error generating thumbnails")
@@ -734,10 +1113,7 @@ func (r *downloadRequest) GetContentLengthAndReader(contentLengthHeader string,
 			return 0, nil, fmt.Errorf("strconv.ParseInt: %w", parseErr)
 		}
 		if maxFileSizeBytes > 0 && parsedLength > int64(maxFileSizeBytes) {
-			return 0, nil, fmt.Errorf(
-				"remote file size (%d bytes) exceeds locally configured max media size (%d bytes)",
-				parsedLength, maxFileSizeBytes,
-			)
+			return 0, nil, &fileutils.FileTooLargeError{Limit: maxFileSizeBytes, Size: parsedLength}
 		}
 
 		// We successfully parsed the Content-Length, so we'll return a limited
@@ -745,14 +1121,11 @@ func (r *downloadRequest) GetContentLengthAndReader(contentLengthHeader string,
 		reader = io.NopCloser(io.LimitReader(*body, parsedLength))
 		contentLength = parsedLength
 	} else {
-		// Content-Length header is missing. If we have a maximum file size
-		// configured then we'll just make sure that the reader is limited to
-		// that size. We'll return a zero content length, but that's OK, since
-		// ultimately it will get rewritten later when the temp file is written
-		// to disk.
-		if maxFileSizeBytes > 0 {
-			reader = io.NopCloser(io.LimitReader(*body, int64(maxFileSizeBytes)))
-		}
+		// Content-Length header is missing. The maximum file size is enforced
+		// when the temp file is written to disk, which rejects larger files
+		// rather than truncating them. We'll return a zero content length, but
+		// that's OK, since ultimately it will get rewritten later when the temp
+		// file is written to disk.
 		contentLength = 0
 	}
 
@@ -761,14 +1134,26 @@ func (r *downloadRequest) GetContentLengthAndReader(contentLengthHeader string,
 
 func (r *downloadRequest) fetchRemoteFile(
 	ctx context.Context,
+	w http.ResponseWriter,
 	client *fclient.Client,
 	absBasePath config.Path,
+	layout config.MediaStoreLayout,
 	maxFileSizeBytes config.FileSizeBytes,
 ) (types.Path, bool, error) {
+	trace, ctx := internal.StartRegion(ctx, "FetchRemoteFile")
+	defer trace.EndRegion()
+	trace.SetTag("origin", string(r.MediaMetadata.Origin))
+	trace.SetTag("media_id", string(r.MediaMetadata.MediaID))
 	r.Logger.Debug("Fetching remote file")
 
 	// create request for remote file
-	resp, err := client.CreateMediaDownloadRequest(ctx, r.MediaMetadata.Origin, string(r.MediaMetadata.MediaID))
+	requestTrace, requestCtx := internal.StartRegion(ctx, "CreateMediaDownloadRequest")
+	resp, err := r.requestRemoteFile(requestCtx, client)
+	requestTrace.SetError(err)
+	if resp != nil {
+		requestTrace.SetTag("http.status_code", resp.StatusCode)
+	}
+	requestTrace.EndRegion()
 	if err != nil || (resp != nil && resp.StatusCode != http.StatusOK) {
 		if resp != nil && resp.StatusCode == http.StatusNotFound {
 			return "", false, fmt.Errorf("File with media ID %q does not exist on %s", r.MediaMetadata.MediaID, r.MediaMetadata.Origin)
@@ -785,8 +1170,7 @@ func (r *downloadRequest) fetchRemoteFile(
 	}
 
 	if maxFileSizeBytes > 0 && contentLength > int64(maxFileSizeBytes) {
-		// TODO: Bubble up this as a 413
-		return "", false, fmt.Errorf("remote file is too large (%v > %v bytes)", contentLength, maxFileSizeBytes)
+		return "", false, &fileutils.FileTooLargeError{Limit: maxFileSizeBytes, Size: contentLength}
 	}
 
 	r.MediaMetadata.FileSizeBytes = types.FileSizeBytes(contentLength)
@@ -809,30 +1193,62 @@ func (r *downloadRequest) fetchRemoteFile(
 		}
 	}
 
+	// If the client wants the original file and we know how big it is, send it to
+	// them as it arrives rather than making them wait for the whole file first.
+	if w != nil && !r.IsThumbnailRequest && contentLength > 0 {
+		if err = r.addDownloadFilenameToHeaders(w, r.MediaMetadata); err != nil {
+			return "", false, err
+		}
+		setMediaResponseHeaders(w, r.MediaMetadata)
+		reader = io.TeeReader(reader, &streamingResponseWriter{w: w})
+		r.streamed = true
+	}
+
 	r.Logger.Trace("Transferring remote file")
 
+	// If we know how big the file is, let other requests for it read it from the
+	// temp file as it is written rather than waiting for all of it.
+	var progress fileutils.TempFileProgress
+	if r.activeRequest != nil && contentLength > 0 {
+		partial := types.NewPartialFile(r.MediaMetadata)
+		r.activeRequest.Cond.L.Lock()
+		r.activeRequest.PartialFile = partial
+		r.activeRequest.Cond.L.Unlock()
+		progress = partial
+	}
+
 	// The file data is hashed but is NOT used as the MediaID, unlike in Upload. The hash is useful as a
 	// method of deduplicating files to save storage, as well as a way to conduct
 	// integrity checks on the file data in the repository.
-	// Data is truncated to maxFileSizeBytes. Content-Length was reported as 0 < Content-Length <= maxFileSizeBytes so this is OK.
-	hash, bytesWritten, tmpDir, err := fileutils.WriteTempFile(ctx, reader, absBasePath)
+	// Files larger than maxFileSizeBytes are rejected rather than truncated.
+	hash, bytesWritten, tmpDir, secondaryHashes, err := fileutils.WriteTempFileWithProgress(
+		ctx, reader, maxFileSizeBytes, r.TempPath, r.Blocklist, r.Encryption, r.SecondaryHashes, progress,
+	)
 	if err != nil {
 		r.Logger.WithError(err).WithFields(log.Fields{
 			"MaxFileSizeBytes": maxFileSizeBytes,
 		}).Warn("Error while downloading file from remote server")
-		return "", false, errors.New("file could not be downloaded from remote server")
+		return "", false, fmt.Errorf("file could not be downloaded from remote server: %w", err)
 	}
 
 	r.Logger.Trace("Remote file transferred")
 
+	// We told the client how big the file was going to be, so don't cache it if the
+	// remote server closed the connection early.
+	if r.streamed && int64(bytesWritten) != contentLength {
+		fileutils.RemoveDir(tmpDir, r.Logger)
+		return "", false, fmt.Errorf("remote file was truncated (%d of %d bytes)", bytesWritten, contentLength)
+	}
+
 	// It's possible the bytesWritten to the temporary file is different to the reported Content-Length from the remote
 	// request's response. bytesWritten is therefore used as it is what would be sent to clients when reading from the local
 	// file.
 	r.MediaMetadata.FileSizeBytes = types.FileSizeBytes(bytesWritten)
 	r.MediaMetadata.Base64Hash = hash
+	r.MediaMetadata.SecondaryHashes = secondaryHashes
 
 	// The database is the source of truth so we need to have moved the file first
-	finalPath, duplicate, err := fileutils.MoveFileWithHashCheck(tmpDir, r.MediaMetadata, absBasePath, r.Logger)
+	finalPath, duplicate, err := fileutils.MoveFileWithHashCheck(ctx, tmpDir, r.MediaMetadata, absBasePath, layout, r.Encryption, r.Compression, r.Fsync, r.Logger)
 	if err != nil {
 		return "", false, fmt.Errorf("fileutils.MoveFileWithHashCheck: %w", err)
 	}
@@ -1,8 +1,21 @@
 package routing
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/thumbnailer"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -11,3 +24,257 @@ func Test_dispositionFor(t *testing.T) {
 	assert.Equal(t, "attachment", contentDispositionFor("image/svg"), "image/svg")
 	assert.Equal(t, "inline", contentDispositionFor("image/jpeg"), "image/jpg")
 }
+
+func Test_activeRemoteRequestsAreShared(t *testing.T) {
+	activeRemoteRequests := &types.ActiveRemoteRequests{
+		MXCToResult: map[string]*types.RemoteRequestResult{},
+	}
+	newRequest := func() *downloadRequest {
+		return &downloadRequest{
+			MediaMetadata: &types.MediaMetadata{
+				MediaID: "someMedia",
+				Origin:  "remote.server",
+			},
+			Logger: logrus.WithField("test", t.Name()),
+		}
+	}
+
+	// The first request for the file becomes the one that fetches it.
+	owner := newRequest()
+	metadata, err := owner.getMediaMetadataFromActiveRequest(context.Background(), activeRemoteRequests)
+	assert.NoError(t, err)
+	assert.Nil(t, metadata, "first request should not be given metadata")
+
+	// Every other request for the same file waits for the owner to finish and
+	// is then given the metadata of the fetched file.
+	fetch := func(r *downloadRequest) {
+		r.MediaMetadata.Base64Hash = "someHash"
+		r.broadcastMediaMetadata(activeRemoteRequests, nil)
+	}
+	const waiters = 50
+	var wg sync.WaitGroup
+	results := make([]*types.MediaMetadata, waiters)
+	for i := 0; i < waiters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := newRequest()
+			var fetchErr error
+			results[i], fetchErr = r.getMediaMetadataFromActiveRequest(context.Background(), activeRemoteRequests)
+			if results[i] == nil && fetchErr == nil {
+				// We arrived after the owner finished, so we are the owner now.
+				fetch(r)
+				results[i] = r.MediaMetadata
+			}
+		}(i)
+	}
+	fetch(owner)
+	wg.Wait()
+
+	for i := range results {
+		assert.Equal(t, types.Base64Hash("someHash"), results[i].Base64Hash)
+	}
+	assert.Len(t, activeRemoteRequests.MXCToResult, 0, "active request should have been removed")
+}
+
+func Test_cancelledWaiterLeavesActiveRemoteRequest(t *testing.T) {
+	activeRemoteRequests := &types.ActiveRemoteRequests{
+		MXCToResult: map[string]*types.RemoteRequestResult{},
+	}
+	newRequest := func() *downloadRequest {
+		return &downloadRequest{
+			MediaMetadata: &types.MediaMetadata{MediaID: "someMedia", Origin: "remote.server"},
+			Logger:        logrus.WithField("test", t.Name()),
+		}
+	}
+	owner := newRequest()
+	_, err := owner.getMediaMetadataFromActiveRequest(context.Background(), activeRemoteRequests)
+	assert.NoError(t, err)
+
+	// A waiter whose request is cancelled stops waiting...
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error)
+	go func() {
+		_, err := newRequest().getMediaMetadataFromActiveRequest(ctx, activeRemoteRequests)
+		cancelled <- err
+	}()
+	// ...while another one keeps waiting for the fetch.
+	waiting := make(chan *types.MediaMetadata)
+	go func() {
+		metadata, _ := newRequest().getMediaMetadataFromActiveRequest(context.Background(), activeRemoteRequests)
+		waiting <- metadata
+	}()
+	time.Sleep(time.Millisecond * 50)
+	cancel()
+	assert.ErrorIs(t, <-cancelled, context.Canceled)
+	select {
+	case <-waiting:
+		t.Fatal("waiter returned before the fetch finished")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	owner.MediaMetadata.Base64Hash = "someHash"
+	owner.broadcastMediaMetadata(activeRemoteRequests, nil)
+	assert.Equal(t, types.Base64Hash("someHash"), (<-waiting).Base64Hash)
+}
+
+func Test_mayStreamRemoteFile(t *testing.T) {
+	cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
+	db, err := storage.NewMediaAPIDatasource(cm, &config.DatabaseOptions{
+		ConnectionString:       "file::memory:",
+		MaxOpenConnections:     1,
+		MaxIdleConnections:     1,
+		ConnMaxLifetimeSeconds: -1,
+	})
+	assert.NoError(t, err)
+	ctx := context.Background()
+	cfg := &config.MediaAPI{}
+	r := &downloadRequest{downloader: downloader{Blocklist: newHashBlocklist(cfg, db)}}
+	mayStream := func() bool {
+		ok, err := r.mayStreamRemoteFile(ctx, db)
+		assert.NoError(t, err)
+		return ok
+	}
+
+	assert.True(t, mayStream(), "files can be streamed if no hashes are refused")
+
+	assert.NoError(t, db.QuarantineHash(ctx, "hash", "@admin:localhost"))
+	assert.False(t, mayStream(), "files can't be streamed if a hash is quarantined")
+	assert.NoError(t, db.UnquarantineHash(ctx, "hash"))
+	assert.True(t, mayStream())
+
+	assert.NoError(t, db.BlockHash(ctx, "hash", "abuse", "@admin:localhost"))
+	assert.False(t, mayStream(), "files can't be streamed if a hash is blocked")
+	assert.NoError(t, db.UnblockHash(ctx, "hash"))
+
+	cfg.BlockedHashes = []string{"0000000000000000000000000000000000000000000000000000000000000000"}
+	r.Blocklist = newHashBlocklist(cfg, db)
+	assert.False(t, mayStream(), "files can't be streamed if a hash is blocked in the config")
+}
+
+func Test_streamFromActiveRequest(t *testing.T) {
+	cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
+	db, err := storage.NewMediaAPIDatasource(cm, &config.DatabaseOptions{
+		ConnectionString:       "file::memory:",
+		MaxOpenConnections:     1,
+		MaxIdleConnections:     1,
+		ConnMaxLifetimeSeconds: -1,
+	})
+	assert.NoError(t, err)
+	ctx := context.Background()
+	metadata := &types.MediaMetadata{
+		MediaID:       "someMedia",
+		Origin:        "remote.server",
+		ContentType:   "text/plain",
+		FileSizeBytes: 11,
+	}
+	newRequest := func() *downloadRequest {
+		return &downloadRequest{
+			MediaMetadata: &types.MediaMetadata{MediaID: metadata.MediaID, Origin: metadata.Origin},
+			Logger:        logrus.WithField("test", t.Name()),
+			downloader:    downloader{Blocklist: newHashBlocklist(&config.MediaAPI{}, db)},
+		}
+	}
+	newActiveRequest := func() (*types.ActiveRemoteRequests, *types.PartialFile) {
+		activeRemoteRequests := &types.ActiveRemoteRequests{
+			MXCToResult: map[string]*types.RemoteRequestResult{},
+		}
+		partial := types.NewPartialFile(metadata)
+		activeRemoteRequests.MXCToResult["mxc://remote.server/someMedia"] = &types.RemoteRequestResult{
+			Cond:        &sync.Cond{L: activeRemoteRequests},
+			PartialFile: partial,
+		}
+		return activeRemoteRequests, partial
+	}
+
+	t.Run("streams the file as it is fetched", func(t *testing.T) {
+		activeRemoteRequests, partial := newActiveRequest()
+		path := filepath.Join(t.TempDir(), "content")
+		file, err := os.Create(path)
+		assert.NoError(t, err)
+		defer file.Close() // nolint: errcheck
+		_, err = file.WriteString("hello")
+		assert.NoError(t, err)
+		partial.TempFileWritten(types.Path(path), 5)
+
+		r := newRequest()
+		w := httptest.NewRecorder()
+		type result struct {
+			streamed bool
+			err      error
+		}
+		done := make(chan result)
+		go func() {
+			streamed, err := r.streamFromActiveRequest(ctx, w, db, activeRemoteRequests)
+			done <- result{streamed, err}
+		}()
+
+		_, err = file.WriteString(" world")
+		assert.NoError(t, err)
+		partial.TempFileWritten(types.Path(path), 11)
+		partial.Finish(nil)
+
+		select {
+		case res := <-done:
+			assert.NoError(t, res.err)
+			assert.True(t, res.streamed)
+		case <-time.After(time.Second * 5):
+			t.Fatal("timed out waiting for the file to be streamed")
+		}
+		assert.True(t, r.streamed)
+		assert.Equal(t, "hello world", w.Body.String())
+		assert.Equal(t, "text/plain", w.Header().Get("Content-Type"))
+	})
+
+	t.Run("doesn't stream the file if a hash is blocked", func(t *testing.T) {
+		activeRemoteRequests, partial := newActiveRequest()
+		partial.TempFileWritten(types.Path(filepath.Join(t.TempDir(), "content")), 0)
+		assert.NoError(t, db.BlockHash(ctx, "hash", "abuse", "@admin:localhost"))
+		defer db.UnblockHash(ctx, "hash") // nolint: errcheck
+
+		r := newRequest()
+		w := httptest.NewRecorder()
+		streamed, err := r.streamFromActiveRequest(ctx, w, db, activeRemoteRequests)
+		assert.NoError(t, err)
+		assert.False(t, streamed)
+		assert.False(t, r.streamed)
+		assert.Empty(t, w.Body.Bytes())
+		assert.Empty(t, w.Header())
+	})
+
+	t.Run("nothing is streamed if the file isn't being fetched", func(t *testing.T) {
+		r := newRequest()
+		streamed, err := r.streamFromActiveRequest(ctx, httptest.NewRecorder(), db, &types.ActiveRemoteRequests{
+			MXCToResult: map[string]*types.RemoteRequestResult{},
+		})
+		assert.NoError(t, err)
+		assert.False(t, streamed)
+	})
+}
+
+func Test_respondThumbnailPending(t *testing.T) {
+	size := types.ThumbnailSize{Width: 32, Height: 32, ResizeMethod: types.Crop}
+	active := &types.ActiveThumbnailGeneration{
+		PathToResult: map[string]*types.ThumbnailGenerationResult{
+			string(thumbnailer.GetThumbnailPath("/media/ab/cd/file", size)): {},
+		},
+	}
+	deferred := &config.MediaDeferredThumbnails{Enabled: true, RetryAfter: 1500 * time.Millisecond}
+	r := &downloadRequest{Logger: logrus.WithField("test", t.Name()), DeferredThumbnails: deferred}
+	assert.True(t, r.thumbnailPending("/media/ab/cd/file", size, active))
+	assert.False(t, r.thumbnailPending("/media/ef/gh/file", size, active))
+	assert.False(t, (&downloadRequest{}).thumbnailPending("/media/ab/cd/file", size, active), "requests wait if not enabled")
+
+	w := httptest.NewRecorder()
+	r.respondThumbnailPending(w)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+
+	deferred.Placeholder = []byte("\x89PNG\r\n\x1a\nplaceholder")
+	w = httptest.NewRecorder()
+	r.respondThumbnailPending(w)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	assert.Equal(t, deferred.Placeholder, w.Body.Bytes())
+}
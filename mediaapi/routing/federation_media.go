@@ -0,0 +1,196 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxFederationErrorBytes is how much of an error response from the
+// authenticated media endpoint is read to find out whether it is supported.
+const maxFederationErrorBytes = 64 * 1024
+
+// federationMediaFetcher fetches remote media from the authenticated federation
+// media endpoint, with requests signed by this server like other federation
+// requests, falling back to the unauthenticated endpoint for servers that don't
+// support it if allowed.
+// https://spec.matrix.org/v1.11/server-server-api/#get_matrixfederationv1mediadownloadmediaid
+type federationMediaFetcher struct {
+	cfg    *config.MediaAPI
+	client *fclient.Client
+	// Follows redirects to where the media is, which may be anywhere rather
+	// than on a Matrix server, so it refuses to connect to internal addresses.
+	redirectClient *http.Client
+}
+
+// newFederationMediaFetcher returns a fetcher for remote media, or nil if media
+// should be fetched from the unauthenticated endpoint.
+func newFederationMediaFetcher(cfg *config.MediaAPI, client *fclient.Client) *federationMediaFetcher {
+	if !cfg.Federation.Authenticated {
+		return nil
+	}
+	return &federationMediaFetcher{
+		cfg:    cfg,
+		client: client,
+		// Remote media may take longer to fetch than upload_from_url.timeout, so
+		// the request context is relied on instead.
+		redirectClient: newUploadFromURLClient(&config.MediaUploadFromURL{
+			AllowedNetworks: cfg.UploadFromURL.AllowedNetworks,
+		}),
+	}
+}
+
+// requestRemoteFile requests the remote file, over the authenticated media
+// endpoint if there is a fetcher for it.
+func (r *downloadRequest) requestRemoteFile(ctx context.Context, client *fclient.Client) (*http.Response, error) {
+	if r.FederationMedia == nil {
+		return client.CreateMediaDownloadRequest(ctx, r.MediaMetadata.Origin, string(r.MediaMetadata.MediaID))
+	}
+	return r.FederationMedia.download(ctx, r.MediaMetadata.Origin, r.MediaMetadata.MediaID, r.Logger)
+}
+
+// download requests the media from its origin. The response has the media as
+// its body, and its headers, as though it came from the unauthenticated
+// endpoint.
+func (f *federationMediaFetcher) download(
+	ctx context.Context, origin spec.ServerName, mediaID types.MediaID, logger *log.Entry,
+) (*http.Response, error) {
+	resp, err := f.authenticatedDownload(ctx, origin, mediaID)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return f.mediaFromMultipart(ctx, resp)
+	}
+	unsupported, err := isUnsupportedEndpoint(resp)
+	if err != nil {
+		return nil, err
+	}
+	if !unsupported {
+		return resp, nil
+	}
+	resp.Body.Close() // nolint: errcheck
+	if !f.cfg.Federation.UnauthenticatedFallback {
+		return nil, fmt.Errorf("%s doesn't support authenticated media", origin)
+	}
+	logger.Debug("Remote server doesn't support authenticated media, falling back to the unauthenticated endpoint")
+	return f.client.CreateMediaDownloadRequest(ctx, origin, string(mediaID))
+}
+
+// authenticatedDownload sends a signed request for the media to its origin.
+func (f *federationMediaFetcher) authenticatedDownload(
+	ctx context.Context, origin spec.ServerName, mediaID types.MediaID,
+) (*http.Response, error) {
+	identity, err := f.cfg.Matrix.SigningIdentityFor(f.cfg.Matrix.ServerName)
+	if err != nil {
+		return nil, fmt.Errorf("f.cfg.Matrix.SigningIdentityFor: %w", err)
+	}
+	fedReq := fclient.NewFederationRequest(
+		http.MethodGet, identity.ServerName, origin,
+		"/_matrix/federation/v1/media/download/"+url.PathEscape(string(mediaID)),
+	)
+	if err = fedReq.Sign(identity.ServerName, identity.KeyID, identity.PrivateKey); err != nil {
+		return nil, fmt.Errorf("fedReq.Sign: %w", err)
+	}
+	req, err := fedReq.HTTPRequest()
+	if err != nil {
+		return nil, fmt.Errorf("fedReq.HTTPRequest: %w", err)
+	}
+	return f.client.DoHTTPRequest(ctx, req)
+}
+
+// mediaFromMultipart takes the media from a response from the authenticated
+// media endpoint, which has a part with metadata followed by a part with either
+// the media or where to fetch it from.
+func (f *federationMediaFetcher) mediaFromMultipart(ctx context.Context, resp *http.Response) (*http.Response, error) {
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" || params["boundary"] == "" {
+		resp.Body.Close() // nolint: errcheck
+		return nil, fmt.Errorf("unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+	reader := multipart.NewReader(resp.Body, params["boundary"])
+	// The metadata is an empty object for now, so there's nothing to use in it.
+	if _, err = reader.NextPart(); err != nil {
+		resp.Body.Close() // nolint: errcheck
+		return nil, fmt.Errorf("failed to read the metadata part: %w", err)
+	}
+	part, err := reader.NextPart()
+	if err != nil {
+		resp.Body.Close() // nolint: errcheck
+		return nil, fmt.Errorf("failed to read the media part: %w", err)
+	}
+	if location := part.Header.Get("Location"); location != "" {
+		resp.Body.Close() // nolint: errcheck
+		return f.followRedirect(ctx, location)
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header(part.Header),
+		Body: struct {
+			io.Reader
+			io.Closer
+		}{part, resp.Body},
+	}, nil
+}
+
+// followRedirect fetches the media from where the origin said it is.
+func (f *federationMediaFetcher) followRedirect(ctx context.Context, location string) (*http.Response, error) {
+	u, err := url.Parse(location)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return nil, fmt.Errorf("invalid media location %q", location)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return f.redirectClient.Do(req)
+}
+
+// isUnsupportedEndpoint returns whether the error response means that the
+// server doesn't support the authenticated media endpoint. The body of the
+// response is replaced, so that it can still be read.
+func isUnsupportedEndpoint(resp *http.Response) (bool, error) {
+	if resp.StatusCode == http.StatusMethodNotAllowed {
+		return true, nil
+	}
+	if resp.StatusCode != http.StatusNotFound && resp.StatusCode != http.StatusBadRequest {
+		return false, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxFederationErrorBytes))
+	resp.Body.Close() // nolint: errcheck
+	if err != nil {
+		return false, fmt.Errorf("failed to read the error response: %w", err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	var matrixErr spec.MatrixError
+	if err = json.Unmarshal(body, &matrixErr); err != nil {
+		return false, nil
+	}
+	return matrixErr.ErrCode == spec.ErrorUnrecognized, nil
+}
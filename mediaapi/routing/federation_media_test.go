@@ -0,0 +1,104 @@
+package routing
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// multipartMediaResponse builds a response from the authenticated media
+// endpoint, with the headers and body of the media part.
+func multipartMediaResponse(t *testing.T, header textproto.MIMEHeader, body string) *http.Response {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	part, err := writer.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json"}})
+	assert.NoError(t, err)
+	_, err = part.Write([]byte("{}"))
+	assert.NoError(t, err)
+	part, err = writer.CreatePart(header)
+	assert.NoError(t, err)
+	_, err = part.Write([]byte(body))
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"multipart/mixed; boundary=" + writer.Boundary()}},
+		Body:       io.NopCloser(&buf),
+	}
+}
+
+func TestMediaFromMultipart(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("redirected"))
+	}))
+	defer server.Close()
+	f := &federationMediaFetcher{redirectClient: server.Client()}
+
+	// The media is in the response.
+	resp, err := f.mediaFromMultipart(context.Background(), multipartMediaResponse(t, textproto.MIMEHeader{
+		"Content-Type":        {"text/plain"},
+		"Content-Disposition": {`inline; filename="hello.txt"`},
+	}, "hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+	assert.Equal(t, `inline; filename="hello.txt"`, resp.Header.Get("Content-Disposition"))
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+
+	// The media is somewhere else.
+	resp, err = f.mediaFromMultipart(context.Background(), multipartMediaResponse(t, textproto.MIMEHeader{
+		"Location": {server.URL + "/media"},
+	}, ""))
+	assert.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "redirected", string(body))
+
+	// Only HTTP locations are followed.
+	_, err = f.mediaFromMultipart(context.Background(), multipartMediaResponse(t, textproto.MIMEHeader{
+		"Location": {"file:///etc/passwd"},
+	}, ""))
+	assert.Error(t, err)
+
+	// The response isn't multipart.
+	_, err = f.mediaFromMultipart(context.Background(), &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"text/plain"}},
+		Body:       io.NopCloser(strings.NewReader("hello")),
+	})
+	assert.Error(t, err)
+}
+
+func TestIsUnsupportedEndpoint(t *testing.T) {
+	for _, tc := range []struct {
+		code        int
+		body        string
+		unsupported bool
+	}{
+		{http.StatusNotFound, `{"errcode":"M_UNRECOGNIZED","error":"Unrecognized request"}`, true},
+		{http.StatusBadRequest, `{"errcode":"M_UNRECOGNIZED","error":"Unrecognized request"}`, true},
+		{http.StatusMethodNotAllowed, "", true},
+		{http.StatusNotFound, `{"errcode":"M_NOT_FOUND","error":"Not found"}`, false},
+		{http.StatusNotFound, "<html>Not found</html>", false},
+		{http.StatusForbidden, `{"errcode":"M_UNRECOGNIZED"}`, false},
+	} {
+		resp := &http.Response{StatusCode: tc.code, Body: io.NopCloser(strings.NewReader(tc.body))}
+		unsupported, err := isUnsupportedEndpoint(resp)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.unsupported, unsupported, "%d %s", tc.code, tc.body)
+		// The body can still be read.
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.body, string(body))
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/mediaapi/types/mxc"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// Files and directories that were modified more recently than this are never
+// garbage collected, as they may belong to an upload or download that is still
+// in progress and hasn't stored its metadata yet.
+const mediaGCMinAge = time.Hour
+
+// mediaGCReport describes what was removed by garbage collecting the media store.
+type mediaGCReport struct {
+	DryRun bool `json:"dry_run"`
+	// Temporary directories left behind by interrupted uploads and downloads
+	TempDirs int `json:"temp_dirs"`
+	// Files on disk that no media metadata refers to
+	OrphanedFiles int `json:"orphaned_files"`
+	// Media metadata whose file is missing from disk
+	DanglingMetadata int `json:"dangling_metadata"`
+	// How much disk space was freed, or would have been freed in a dry run
+	ReclaimedBytes types.FileSizeBytes `json:"reclaimed_bytes"`
+}
+
+// collectMediaGarbage removes temporary directories and files in the media
+// store that aren't referred to by the database, and metadata for media whose
+// file is missing. In a dry run, they are only reported.
+func collectMediaGarbage(
+	ctx context.Context,
+	cfg *config.MediaAPI,
+	db storage.Database,
+	dryRun bool,
+	logger *log.Entry,
+) (*mediaGCReport, error) {
+	remoteCacheEvictionMutex.Lock()
+	defer remoteCacheEvictionMutex.Unlock()
+
+	report := &mediaGCReport{DryRun: dryRun}
+	cutoff := time.Now().Add(-mediaGCMinAge)
+	if err := collectTempDirs(cfg, cutoff, report, logger); err != nil {
+		return report, err
+	}
+	if err := collectOrphanedFiles(ctx, cfg, db, cutoff, report, logger); err != nil {
+		return report, err
+	}
+	if err := collectDanglingMetadata(ctx, cfg, db, report, logger); err != nil {
+		return report, err
+	}
+
+	logger.WithFields(log.Fields{
+		"DryRun":           dryRun,
+		"TempDirs":         report.TempDirs,
+		"OrphanedFiles":    report.OrphanedFiles,
+		"DanglingMetadata": report.DanglingMetadata,
+		"ReclaimedBytes":   report.ReclaimedBytes,
+	}).Info("Garbage collected media store")
+	return report, nil
+}
+
+// collectTempDirs removes the temporary directories that WriteTempFile creates
+// for every upload and download, which are normally removed once the file has
+// been moved into place.
+func collectTempDirs(cfg *config.MediaAPI, cutoff time.Time, report *mediaGCReport, logger *log.Entry) error {
+	tmpPath := string(cfg.TempDir())
+	entries, err := os.ReadDir(tmpPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("os.ReadDir: %w", err)
+	}
+	for _, entry := range entries {
+		dir := filepath.Join(tmpPath, entry.Name())
+		size, modified, err := dirUsage(dir)
+		if err != nil {
+			return err
+		}
+		if modified.After(cutoff) {
+			continue
+		}
+		report.TempDirs++
+		report.ReclaimedBytes += size
+		logger.WithFields(log.Fields{
+			"DryRun": report.DryRun,
+			"Path":   dir,
+		}).Info("Removing orphaned temporary media directory")
+		if !report.DryRun {
+			fileutils.RemoveDir(types.Path(dir), logger)
+		}
+	}
+	return nil
+}
+
+// collectOrphanedFiles removes the directories of files, along with their
+// thumbnails, that no media refers to any more. The directories are laid out
+// as described in fileutils.GetPathFromBase64Hash.
+func collectOrphanedFiles(
+	ctx context.Context,
+	cfg *config.MediaAPI,
+	db storage.Database,
+	cutoff time.Time,
+	report *mediaGCReport,
+	logger *log.Entry,
+) error {
+	return fileutils.WalkStoredFiles(cfg.AbsBasePath, cfg.StoreLayout, func(hash types.Base64Hash, dir string) error {
+		size, modified, err := dirUsage(dir)
+		if err != nil {
+			return err
+		}
+		if modified.After(cutoff) {
+			return nil
+		}
+		count, err := db.GetMediaCountByHash(ctx, hash)
+		if err != nil {
+			return fmt.Errorf("db.GetMediaCountByHash: %w", err)
+		}
+		if count > 0 {
+			return nil
+		}
+		// Quarantined files are kept as evidence.
+		quarantined, err := db.IsFileQuarantined(ctx, hash)
+		if err != nil {
+			return fmt.Errorf("db.IsFileQuarantined: %w", err)
+		}
+		if quarantined {
+			return nil
+		}
+		report.OrphanedFiles++
+		report.ReclaimedBytes += size
+		logger.WithFields(log.Fields{
+			"DryRun":     report.DryRun,
+			"Base64Hash": hash,
+		}).Info("Removing orphaned media file")
+		if !report.DryRun {
+			fileutils.RemoveDir(types.Path(dir), logger)
+		}
+		return nil
+	})
+}
+
+// collectDanglingMetadata removes the metadata of local and remote media whose
+// file no longer exists, so that remote media is fetched again and local media
+// returns a 404 rather than failing to open the file.
+func collectDanglingMetadata(
+	ctx context.Context,
+	cfg *config.MediaAPI,
+	db storage.Database,
+	report *mediaGCReport,
+	logger *log.Entry,
+) error {
+	// Look at all media, however recent.
+	before := spec.Timestamp(math.MaxInt64)
+	for _, remote := range []bool{false, true} {
+		// Deleted media drops out of the results, but media that is kept doesn't,
+		// so skip past everything that is kept.
+		var offset int
+		for {
+			media, err := db.GetMediaCreatedBefore(ctx, cfg.Matrix.ServerName, remote, before, retentionBatchSize, offset)
+			if err != nil {
+				return fmt.Errorf("db.GetMediaCreatedBefore: %w", err)
+			}
+			for _, mediaMetadata := range media {
+				filePath, err := fileutils.GetPathFromBase64Hash(mediaMetadata.Base64Hash, cfg.AbsBasePath, cfg.StoreLayout)
+				if err != nil {
+					offset++
+					continue
+				}
+				if _, err = os.Stat(filePath); !errors.Is(err, os.ErrNotExist) {
+					offset++
+					continue
+				}
+				contentURI := mxc.URI{ServerName: mediaMetadata.Origin, MediaID: mediaMetadata.MediaID}.String()
+				report.DanglingMetadata++
+				logger.WithFields(log.Fields{
+					"DryRun":  report.DryRun,
+					"MediaID": contentURI,
+				}).Info("Removing metadata of media with missing file")
+				if report.DryRun {
+					offset++
+					continue
+				}
+				if _, err = db.DeleteMediaMetadata(ctx, mediaMetadata.MediaID, mediaMetadata.Origin); err != nil {
+					return fmt.Errorf("failed to delete %s: %w", contentURI, err)
+				}
+			}
+			if len(media) < retentionBatchSize {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// dirUsage returns the total size of the files in dir and when dir or any of
+// the files in it were last modified.
+func dirUsage(dir string) (size types.FileSizeBytes, modified time.Time, err error) {
+	err = filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += types.FileSizeBytes(info.Size())
+		}
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+		return nil
+	})
+	if err != nil {
+		err = fmt.Errorf("filepath.Walk: %w", err)
+	}
+	return
+}
+
+// AdminMediaGC implements POST /_dendrite/admin/mediaGC. It removes temporary
+// directories and files left behind by crashes, and metadata for media whose
+// file is missing, and returns what was removed. In a dry run, nothing is
+// removed and what would be is counted.
+func AdminMediaGC(req *http.Request, cfg *config.MediaAPI, db storage.Database, dryRun bool) util.JSONResponse {
+	logger := util.GetLogger(req.Context())
+	report, err := collectMediaGarbage(req.Context(), cfg, db, dryRun, logger)
+	if err != nil {
+		logger.WithError(err).Error("Failed to garbage collect media store")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: report,
+	}
+}
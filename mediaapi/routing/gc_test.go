@@ -0,0 +1,103 @@
+package routing
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_collectMediaGarbage(t *testing.T) {
+	cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
+	db, err := storage.NewMediaAPIDatasource(cm, &config.DatabaseOptions{
+		ConnectionString:       "file::memory:",
+		MaxOpenConnections:     1,
+		MaxIdleConnections:     1,
+		ConnMaxLifetimeSeconds: -1,
+	})
+	assert.NoError(t, err)
+	ctx := context.Background()
+	logger := logrus.WithField("test", t.Name())
+
+	cfg := &config.MediaAPI{
+		Matrix:      &config.Global{},
+		AbsBasePath: config.Path(t.TempDir()),
+	}
+	cfg.Matrix.ServerName = "localhost"
+
+	old := time.Now().Add(-2 * mediaGCMinAge)
+	writeFile := func(path string, size int, modified time.Time) {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0770))
+		assert.NoError(t, os.WriteFile(path, make([]byte, size), 0660))
+		assert.NoError(t, os.Chtimes(path, modified, modified))
+		assert.NoError(t, os.Chtimes(filepath.Dir(path), modified, modified))
+	}
+	mediaFile := func(hash types.Base64Hash, size int, modified time.Time) string {
+		path, err := fileutils.GetPathFromBase64Hash(hash, cfg.AbsBasePath, cfg.StoreLayout)
+		assert.NoError(t, err)
+		writeFile(path, size, modified)
+		return path
+	}
+
+	keptPath := mediaFile("keptfilehash", 1, old)
+	assert.NoError(t, db.StoreMediaMetadata(ctx, &types.MediaMetadata{
+		MediaID: "kept", Origin: "localhost", Base64Hash: "keptfilehash", FileSizeBytes: 1,
+	}))
+	quarantinedPath := mediaFile("quarantinedhash", 1, old)
+	assert.NoError(t, db.QuarantineHash(ctx, "quarantinedhash", "@admin:localhost"))
+	orphanPath := mediaFile("orphanhash", 2, old)
+	writeFile(filepath.Join(filepath.Dir(orphanPath), "thumbnail-32x32-crop"), 4, old)
+	// Files that were written recently may still be waiting for their metadata.
+	recentPath := mediaFile("recenthash", 8, time.Now())
+	tmpPath := filepath.Join(string(cfg.AbsBasePath), "tmp", "interrupted", "content")
+	writeFile(tmpPath, 16, old)
+	assert.NoError(t, db.StoreMediaMetadata(ctx, &types.MediaMetadata{
+		MediaID: "dangling", Origin: "remote", Base64Hash: "missinghash", FileSizeBytes: 32,
+	}))
+
+	// a dry run only reports what would be removed
+	report, err := collectMediaGarbage(ctx, cfg, db, true, logger)
+	assert.NoError(t, err)
+	want := &mediaGCReport{DryRun: true, TempDirs: 1, OrphanedFiles: 1, DanglingMetadata: 1, ReclaimedBytes: 22}
+	assert.Equal(t, want, report)
+	for _, path := range []string{keptPath, quarantinedPath, orphanPath, recentPath, tmpPath} {
+		_, err = os.Stat(path)
+		assert.NoError(t, err, "%s should not be removed in a dry run", path)
+	}
+
+	want.DryRun = false
+	report, err = collectMediaGarbage(ctx, cfg, db, false, logger)
+	assert.NoError(t, err)
+	assert.Equal(t, want, report)
+	for path, exists := range map[string]bool{
+		keptPath:                 true,
+		quarantinedPath:          true,
+		recentPath:               true,
+		orphanPath:               false,
+		filepath.Dir(orphanPath): false,
+		filepath.Dir(tmpPath):    false,
+	} {
+		_, err = os.Stat(path)
+		assert.Equal(t, exists, err == nil, "unexpected existence of %s", path)
+	}
+	metadata, err := db.GetMediaMetadata(ctx, "dangling", "remote")
+	assert.NoError(t, err)
+	assert.Nil(t, metadata)
+	metadata, err = db.GetMediaMetadata(ctx, "kept", "localhost")
+	assert.NoError(t, err)
+	assert.NotNil(t, metadata)
+
+	// nothing is left to collect
+	report, err = collectMediaGarbage(ctx, cfg, db, false, logger)
+	assert.NoError(t, err)
+	assert.Equal(t, &mediaGCReport{}, report)
+}
@@ -0,0 +1,126 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/setup/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// healthCheckTimeout is how long the checks of a health or readiness probe may
+// take altogether.
+const healthCheckTimeout = time.Second * 5
+
+// healthChecker checks whether the media API is working, for liveness and
+// readiness probes.
+type healthChecker struct {
+	cfg     *config.MediaAPI
+	db      storage.Database
+	drainer *transferDrainer
+}
+
+// healthResponse is the response to the health and readiness probes. Checks
+// has "ok" or the reason it failed for each check.
+type healthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// checkDatabase checks that the media database can be reached.
+func (h *healthChecker) checkDatabase(ctx context.Context) error {
+	return h.db.Ping(ctx)
+}
+
+// checkBasePath checks that files can be written to the media store.
+func (h *healthChecker) checkBasePath(_ context.Context) error {
+	return fileutils.CheckWritable(h.cfg.AbsBasePath)
+}
+
+// checkDiskSpace checks that the media store isn't so full that uploads are
+// refused.
+func (h *healthChecker) checkDiskSpace(_ context.Context) error {
+	free, err := fileutils.FreeSpace(h.cfg.AbsBasePath)
+	if err != nil {
+		return err
+	}
+	if minFree := h.cfg.DiskSpace.MinFreeBytes; minFree > 0 && free < uint64(minFree) {
+		return fmt.Errorf("%d bytes free, less than the minimum of %d", free, minFree)
+	}
+	return nil
+}
+
+// checkNotShuttingDown checks that Dendrite isn't shutting down, in which case
+// uploads are refused.
+func (h *healthChecker) checkNotShuttingDown(_ context.Context) error {
+	if h.drainer.shuttingDown() {
+		return errors.New("shutting down")
+	}
+	return nil
+}
+
+// liveness responds to liveness probes, which fail if the media API is broken
+// in a way that restarting it might fix.
+func (h *healthChecker) liveness(w http.ResponseWriter, req *http.Request) {
+	h.respond(w, req, map[string]func(context.Context) error{
+		"database":  h.checkDatabase,
+		"base_path": h.checkBasePath,
+	})
+}
+
+// readiness responds to readiness probes, which also fail while the media API
+// can't take uploads, because the media store is full or Dendrite is shutting
+// down.
+func (h *healthChecker) readiness(w http.ResponseWriter, req *http.Request) {
+	h.respond(w, req, map[string]func(context.Context) error{
+		"database":   h.checkDatabase,
+		"base_path":  h.checkBasePath,
+		"disk_space": h.checkDiskSpace,
+		"shutdown":   h.checkNotShuttingDown,
+	})
+}
+
+// respond runs the checks, and responds with 200 if they all passed or 503 if
+// any failed.
+func (h *healthChecker) respond(w http.ResponseWriter, req *http.Request, checks map[string]func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(req.Context(), healthCheckTimeout)
+	defer cancel()
+
+	res := healthResponse{Status: "ok", Checks: make(map[string]string, len(checks))}
+	code := http.StatusOK
+	for name, check := range checks {
+		if err := check(ctx); err != nil {
+			log.WithError(err).WithField("check", name).Warn("Media API health check failed")
+			res.Checks[name] = err.Error()
+			res.Status = "unavailable"
+			code = http.StatusServiceUnavailable
+			continue
+		}
+		res.Checks[name] = "ok"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,74 @@
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthChecker(t *testing.T) {
+	cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
+	db, err := storage.NewMediaAPIDatasource(cm, &config.DatabaseOptions{
+		ConnectionString:       "file::memory:",
+		MaxOpenConnections:     1,
+		MaxIdleConnections:     1,
+		ConnMaxLifetimeSeconds: -1,
+	})
+	assert.NoError(t, err)
+
+	cfg := &config.MediaAPI{
+		Matrix:      &config.Global{},
+		AbsBasePath: config.Path(t.TempDir()),
+	}
+	processCtx := process.NewProcessContext()
+	health := &healthChecker{cfg: cfg, db: db, drainer: newTransferDrainer(cfg, processCtx)}
+
+	probe := func(handler http.HandlerFunc) (int, healthResponse) {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/monitor/media/readyz", nil))
+		var res healthResponse
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+		return w.Code, res
+	}
+
+	code, res := probe(health.readiness)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", res.Status)
+	assert.Equal(t, map[string]string{
+		"database":   "ok",
+		"base_path":  "ok",
+		"disk_space": "ok",
+		"shutdown":   "ok",
+	}, res.Checks)
+	// The probe file is removed again.
+	entries, err := os.ReadDir(string(cfg.AbsBasePath))
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// The media store is too full to take uploads, which makes the server
+	// unready but not unhealthy.
+	cfg.DiskSpace.MinFreeBytes = config.FileSizeBytes(1 << 62)
+	code, res = probe(health.readiness)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "unavailable", res.Status)
+	assert.NotEqual(t, "ok", res.Checks["disk_space"])
+	code, _ = probe(health.liveness)
+	assert.Equal(t, http.StatusOK, code)
+	cfg.DiskSpace.MinFreeBytes = 0
+
+	// The media store can't be written to.
+	cfg.AbsBasePath = config.Path(filepath.Join(t.TempDir(), "missing"))
+	code, res = probe(health.liveness)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.NotEqual(t, "ok", res.Checks["base_path"])
+	assert.Equal(t, "ok", res.Checks["database"])
+}
@@ -0,0 +1,101 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	log "github.com/sirupsen/logrus"
+)
+
+// lastAccessFlushInterval is how often the recorded media accesses are written
+// to the database.
+const lastAccessFlushInterval = time.Second * 10
+
+type lastAccessKey struct {
+	mediaID types.MediaID
+	origin  spec.ServerName
+}
+
+// lastAccessRecorder keeps track of when media was last downloaded or
+// thumbnailed, and writes the accesses to the database in batches, so that
+// downloads don't each wait for a write. Accesses that haven't been written yet
+// are lost if the server stops.
+type lastAccessRecorder struct {
+	db storage.Database
+
+	mu      sync.Mutex
+	pending map[lastAccessKey]spec.Timestamp
+}
+
+func newLastAccessRecorder(db storage.Database) *lastAccessRecorder {
+	return &lastAccessRecorder{
+		db:      db,
+		pending: map[lastAccessKey]spec.Timestamp{},
+	}
+}
+
+// record records that the media was just accessed. A nil *lastAccessRecorder
+// doesn't record anything.
+func (r *lastAccessRecorder) record(mediaID types.MediaID, origin spec.ServerName) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending[lastAccessKey{mediaID, origin}] = spec.AsTimestamp(time.Now())
+}
+
+// run writes the recorded accesses to the database every interval, forever.
+func (r *lastAccessRecorder) run(interval time.Duration) {
+	logger := log.WithField("component", "media_last_access")
+	for {
+		time.Sleep(interval)
+		r.flush(context.Background(), logger)
+	}
+}
+
+// flush writes the accesses recorded since the last flush to the database. If
+// that fails, they are kept to be written by the next flush, unless the media
+// has been accessed again since.
+func (r *lastAccessRecorder) flush(ctx context.Context, logger *log.Entry) {
+	r.mu.Lock()
+	pending := r.pending
+	r.pending = map[lastAccessKey]spec.Timestamp{}
+	r.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	accesses := make([]types.MediaAccess, 0, len(pending))
+	for key, ts := range pending {
+		accesses = append(accesses, types.MediaAccess{MediaID: key.mediaID, Origin: key.origin, LastAccessTS: ts})
+	}
+	if err := r.db.UpdateMediaLastAccesses(ctx, accesses); err != nil {
+		logger.WithError(err).WithField("media", len(accesses)).Warn("Failed to update media last access times")
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		for key, ts := range pending {
+			if _, ok := r.pending[key]; !ok {
+				r.pending[key] = ts
+			}
+		}
+	}
+}
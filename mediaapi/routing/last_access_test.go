@@ -0,0 +1,61 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+type lastAccessDatabase struct {
+	storage.Database
+	err      error
+	accesses [][]types.MediaAccess
+}
+
+func (d *lastAccessDatabase) UpdateMediaLastAccesses(ctx context.Context, accesses []types.MediaAccess) error {
+	d.accesses = append(d.accesses, accesses)
+	return d.err
+}
+
+func TestLastAccessRecorder(t *testing.T) {
+	db := &lastAccessDatabase{}
+	recorder := newLastAccessRecorder(db)
+	logger := logrus.WithField("test", t.Name())
+	ctx := context.Background()
+
+	// Nothing is written if nothing was accessed.
+	recorder.flush(ctx, logger)
+	assert.Empty(t, db.accesses)
+
+	// Accesses to the same media are written once, in a single batch.
+	recorder.record("a", "localhost")
+	recorder.record("a", "localhost")
+	recorder.record("a", "remote")
+	recorder.flush(ctx, logger)
+	if assert.Len(t, db.accesses, 1) {
+		assert.Len(t, db.accesses[0], 2)
+	}
+	recorder.flush(ctx, logger)
+	assert.Len(t, db.accesses, 1)
+
+	// Accesses that fail to be written are written by the next flush.
+	db.err = errors.New("failed")
+	recorder.record("b", "localhost")
+	recorder.flush(ctx, logger)
+	db.err = nil
+	recorder.flush(ctx, logger)
+	if assert.Len(t, db.accesses, 3) {
+		assert.Equal(t, db.accesses[1], db.accesses[2])
+	}
+	recorder.flush(ctx, logger)
+	assert.Len(t, db.accesses, 3)
+
+	// A nil recorder doesn't record anything.
+	var nilRecorder *lastAccessRecorder
+	nilRecorder.record("c", "localhost")
+}
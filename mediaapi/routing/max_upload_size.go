@@ -0,0 +1,110 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+)
+
+// maxUploadSizeResponse is the response to the maximum upload size admin endpoint.
+type maxUploadSizeResponse struct {
+	UserID types.MatrixUserID `json:"user_id"`
+	// The maximum upload size that applies to the user, 0 for unlimited
+	MaxFileSizeBytes config.FileSizeBytes `json:"max_file_size_bytes"`
+	// Whether the limit was set for this user by an admin
+	Override bool `json:"override"`
+}
+
+// maxUploadSize returns the maximum size of a single upload by the user, and
+// whether it was set for the user by an admin rather than coming from the config.
+func maxUploadSize(ctx context.Context, cfg *config.MediaAPI, db storage.Database, userID types.MatrixUserID) (config.FileSizeBytes, bool, error) {
+	override, err := db.GetMaxUploadSize(ctx, userID)
+	if err != nil {
+		return 0, false, fmt.Errorf("db.GetMaxUploadSize: %w", err)
+	}
+	if override != nil {
+		return config.FileSizeBytes(*override), true, nil
+	}
+	return cfg.MaxFileSizeBytes, false, nil
+}
+
+// AdminMaxUploadSize implements GET, PUT and DELETE /_dendrite/admin/maxUploadSize/{userID}.
+// GET returns the maximum upload size of a local user, PUT sets a limit for the
+// user that overrides max_file_size_bytes and DELETE removes the override again.
+func AdminMaxUploadSize(req *http.Request, cfg *config.MediaAPI, db storage.Database) util.JSONResponse {
+	userID, resErr := adminLocalUserID(req, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	logger := util.GetLogger(req.Context()).WithField("userID", userID)
+
+	var err error
+	switch req.Method {
+	case http.MethodPut:
+		var request struct {
+			MaxFileSizeBytes *types.FileSizeBytes `json:"max_file_size_bytes"`
+		}
+		if err = json.NewDecoder(req.Body).Decode(&request); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.BadJSON("Failed to decode request body: " + err.Error()),
+			}
+		}
+		if request.MaxFileSizeBytes == nil || *request.MaxFileSizeBytes < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("max_file_size_bytes must be 0 or greater"),
+			}
+		}
+		if err = db.SetMaxUploadSize(req.Context(), userID, *request.MaxFileSizeBytes); err != nil {
+			logger.WithError(err).Error("Failed to set maximum upload size")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+	case http.MethodDelete:
+		if err = db.DeleteMaxUploadSize(req.Context(), userID); err != nil {
+			logger.WithError(err).Error("Failed to delete maximum upload size")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+	}
+
+	res := maxUploadSizeResponse{UserID: userID}
+	res.MaxFileSizeBytes, res.Override, err = maxUploadSize(req.Context(), cfg, db, userID)
+	if err != nil {
+		logger.WithError(err).Error("Failed to get maximum upload size")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/mediaapi/types/mxc"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+)
+
+// hashSHA256 is the algorithm to look files up by their Base64Hash with.
+const hashSHA256 = "sha256"
+
+// hashedFile is an entry in the response to the media hashes admin endpoint.
+type hashedFile struct {
+	Base64Hash types.Base64Hash `json:"base64hash"`
+	// The hex encoded hashes of the file other than SHA-256, by algorithm
+	SecondaryHashes map[string]string `json:"secondary_hashes"`
+	// The media, from any origin, referring to the file
+	ContentURIs []string `json:"content_uris"`
+}
+
+type mediaHashesResponse struct {
+	Files []hashedFile `json:"files"`
+}
+
+// AdminLookupMediaHash implements GET /_dendrite/admin/mediaHashes/{algorithm}/{hash}.
+// It returns the stored files with the hash, along with all of their hashes and
+// the media referring to them. The algorithm is either sha256, in which case the
+// hash may be hex or unpadded URL-safe base64 encoded, or one of the secondary
+// hash algorithms, in which case it must be hex encoded.
+func AdminLookupMediaHash(req *http.Request, db storage.Database) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	algorithm, hash := vars["algorithm"], vars["hash"]
+	ctx := req.Context()
+	logger := util.GetLogger(ctx).WithField("algorithm", algorithm).WithField("hash", hash)
+
+	var hashes []types.Base64Hash
+	if algorithm == hashSHA256 {
+		base64Hash, parseErr := types.ParseBase64Hash(hash)
+		if parseErr != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("hash must be a hex or unpadded URL-safe base64 encoded SHA-256 hash"),
+			}
+		}
+		count, countErr := db.GetMediaCountByHash(ctx, base64Hash)
+		if countErr != nil {
+			logger.WithError(countErr).Error("Failed to count media by hash")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+		if count > 0 {
+			hashes = append(hashes, base64Hash)
+		}
+	} else {
+		hash = strings.ToLower(hash)
+		if !fileutils.IsSecondaryHash(algorithm, hash) {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam(fmt.Sprintf("algorithm must be one of %v, and hash must be hex encoded", append([]string{hashSHA256}, config.SecondaryHashAlgorithms...))),
+			}
+		}
+		if hashes, err = db.GetHashesBySecondaryHash(ctx, algorithm, hash); err != nil {
+			logger.WithError(err).Error("Failed to look up secondary hash")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+	}
+
+	res := mediaHashesResponse{Files: make([]hashedFile, 0, len(hashes))}
+	for _, base64Hash := range hashes {
+		file := hashedFile{Base64Hash: base64Hash, ContentURIs: []string{}}
+		if file.SecondaryHashes, err = db.GetSecondaryHashes(ctx, base64Hash); err != nil {
+			logger.WithError(err).Error("Failed to get secondary hashes")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+		media, mediaErr := db.GetAllMediaByHash(ctx, base64Hash)
+		if mediaErr != nil {
+			logger.WithError(mediaErr).Error("Failed to get media by hash")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+		for _, mediaMetadata := range media {
+			file.ContentURIs = append(file.ContentURIs, mxc.URI{ServerName: mediaMetadata.Origin, MediaID: mediaMetadata.MediaID}.String())
+		}
+		res.Files = append(res.Files, file)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
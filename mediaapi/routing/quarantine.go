@@ -0,0 +1,154 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/mediaapi/types/mxc"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+)
+
+// quarantineMediaResponse is the response to the quarantine media admin endpoint.
+type quarantineMediaResponse struct {
+	// The hash of the file, which can be used to also quarantine copies of it,
+	// omitted if the file isn't stored on this server
+	Base64Hash types.Base64Hash `json:"base64hash,omitempty"`
+}
+
+// AdminQuarantineMedia implements POST and DELETE /_dendrite/admin/quarantineMedia/{serverName}/{mediaID}.
+// POST quarantines the media, so that it can no longer be downloaded but is kept
+// on disk, and DELETE releases it again.
+func AdminQuarantineMedia(req *http.Request, device *userapi.Device, db storage.Database, auditLog *mediaAuditLog) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	uri, err := mxc.New(spec.ServerName(vars["serverName"]), types.MediaID(vars["mediaID"]))
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Invalid media ID"),
+		}
+	}
+	origin, mediaID := uri.ServerName, uri.MediaID
+	logger := util.GetLogger(req.Context()).WithField("mediaID", uri.String())
+
+	if req.Method == http.MethodDelete {
+		if err = db.UnquarantineMedia(req.Context(), mediaID, origin); err != nil {
+			logger.WithError(err).Error("Failed to unquarantine media")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+		auditLog.record(req, &types.AuditLogEntry{
+			Action:  types.AuditUnquarantine,
+			MediaID: mediaID,
+			Origin:  origin,
+			UserID:  types.MatrixUserID(device.UserID),
+		})
+		logger.Info("Unquarantined media")
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	}
+
+	// Remote media may not have been fetched yet, in which case there is no
+	// file to keep, but the media still can't be fetched afterwards.
+	mediaMetadata, err := db.GetMediaMetadata(req.Context(), mediaID, origin)
+	if err != nil {
+		logger.WithError(err).Error("Failed to get media metadata")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	var res quarantineMediaResponse
+	if mediaMetadata != nil {
+		res.Base64Hash = mediaMetadata.Base64Hash
+	}
+	if err = db.QuarantineMedia(req.Context(), mediaID, origin, res.Base64Hash, types.MatrixUserID(device.UserID)); err != nil {
+		logger.WithError(err).Error("Failed to quarantine media")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	auditLog.record(req, &types.AuditLogEntry{
+		Action:     types.AuditQuarantine,
+		MediaID:    mediaID,
+		Origin:     origin,
+		Base64Hash: res.Base64Hash,
+		UserID:     types.MatrixUserID(device.UserID),
+	})
+	logger.WithField("quarantinedBy", device.UserID).Info("Quarantined media")
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// AdminQuarantineHash implements POST and DELETE /_dendrite/admin/quarantineHash/{hash}.
+// POST quarantines all media with the given file hash and stops the file from
+// being uploaded again, DELETE releases it again.
+func AdminQuarantineHash(req *http.Request, device *userapi.Device, db storage.Database, auditLog *mediaAuditLog) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	hash := types.Base64Hash(vars["hash"])
+	if decoded, decodeErr := base64.RawURLEncoding.DecodeString(string(hash)); decodeErr != nil || len(decoded) != sha256.Size {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("hash must be an unpadded URL-safe base64 encoded SHA-256 hash"),
+		}
+	}
+	logger := util.GetLogger(req.Context()).WithField("Base64Hash", hash)
+
+	action := types.AuditQuarantineHash
+	if req.Method == http.MethodDelete {
+		action = types.AuditUnquarantineHash
+		err = db.UnquarantineHash(req.Context(), hash)
+	} else {
+		err = db.QuarantineHash(req.Context(), hash, types.MatrixUserID(device.UserID))
+	}
+	if err != nil {
+		logger.WithError(err).Error("Failed to update quarantined hash")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	auditLog.record(req, &types.AuditLogEntry{
+		Action:     action,
+		Base64Hash: hash,
+		UserID:     types.MatrixUserID(device.UserID),
+	})
+	logger.WithField("method", req.Method).Info("Updated quarantined hash")
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
@@ -0,0 +1,97 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_quarantine(t *testing.T) {
+	cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
+	db, err := storage.NewMediaAPIDatasource(cm, &config.DatabaseOptions{
+		ConnectionString:       "file::memory:",
+		MaxOpenConnections:     1,
+		MaxIdleConnections:     1,
+		ConnMaxLifetimeSeconds: -1,
+	})
+	assert.NoError(t, err)
+	ctx := context.Background()
+	logger := logrus.WithField("test", t.Name())
+
+	cfg := &config.MediaAPI{
+		Matrix:      &config.Global{},
+		AbsBasePath: config.Path(t.TempDir()),
+	}
+	cfg.Matrix.ServerName = "localhost"
+
+	upload := func(content string) *uploadRequest {
+		r := &uploadRequest{
+			MediaMetadata: &types.MediaMetadata{
+				Origin:        "localhost",
+				UserID:        "@alice:localhost",
+				FileSizeBytes: types.FileSizeBytes(len(content)),
+			},
+			Logger: logger,
+		}
+		if resErr := r.doUpload(ctx, strings.NewReader(content), cfg, db, 0, nil); resErr != nil {
+			t.Fatalf("upload failed: %+v", resErr)
+		}
+		return r
+	}
+	download := func(mediaID types.MediaID) *types.MediaMetadata {
+		r := &downloadRequest{
+			MediaMetadata: &types.MediaMetadata{MediaID: mediaID, Origin: "localhost"},
+			Logger:        logger,
+			downloader:    downloader{DB: db},
+		}
+		metadata, err := r.doDownload(ctx, httptest.NewRecorder(), cfg)
+		assert.NoError(t, err)
+		return metadata
+	}
+
+	byID := upload("quarantined by ID").MediaMetadata
+	byHash := upload("quarantined by hash").MediaMetadata
+	assert.NotNil(t, download(byID.MediaID))
+	assert.NotNil(t, download(byHash.MediaID))
+
+	assert.NoError(t, db.QuarantineMedia(ctx, byID.MediaID, byID.Origin, byID.Base64Hash, "@admin:localhost"))
+	assert.NoError(t, db.QuarantineHash(ctx, byHash.Base64Hash, "@admin:localhost"))
+
+	// Quarantined media can't be downloaded.
+	assert.Nil(t, download(byID.MediaID))
+	assert.Nil(t, download(byHash.MediaID))
+
+	// Quarantined hashes can't be uploaded again, but other copies of media
+	// quarantined by ID can.
+	r := &uploadRequest{
+		MediaMetadata: &types.MediaMetadata{Origin: "localhost", UserID: "@alice:localhost"},
+		Logger:        logger,
+	}
+	resErr := r.doUpload(ctx, strings.NewReader("quarantined by hash"), cfg, db, 0, nil)
+	if assert.NotNil(t, resErr) {
+		assert.Equal(t, http.StatusForbidden, resErr.Code)
+	}
+	assert.NotNil(t, download(upload("quarantined by ID").MediaMetadata.MediaID))
+
+	// Quarantined files are kept on disk when the media is deleted.
+	assert.NoError(t, deleteMedia(ctx, cfg, db, byHash, logger))
+	path, err := fileutils.GetPathFromBase64Hash(byHash.Base64Hash, cfg.AbsBasePath, cfg.StoreLayout)
+	assert.NoError(t, err)
+	_, err = os.Stat(path)
+	assert.NoError(t, err, "quarantined file was removed")
+
+	// Unquarantined media can be downloaded again.
+	assert.NoError(t, db.UnquarantineMedia(ctx, byID.MediaID, byID.Origin))
+	assert.NotNil(t, download(byID.MediaID))
+}
@@ -0,0 +1,166 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+)
+
+// mediaRateLimits limits the rate of uploads per user and of downloads per IP
+// address with token buckets.
+type mediaRateLimits struct {
+	enabled       bool
+	uploads       *tokenBuckets
+	downloads     *tokenBuckets
+	exemptUserIDs map[string]struct{}
+}
+
+func newMediaRateLimits(cfg *config.MediaRateLimiting) *mediaRateLimits {
+	l := &mediaRateLimits{
+		enabled:       cfg.Enabled,
+		uploads:       newTokenBuckets(cfg.Uploads),
+		downloads:     newTokenBuckets(cfg.Downloads),
+		exemptUserIDs: make(map[string]struct{}, len(cfg.ExemptUserIDs)),
+	}
+	for _, userID := range cfg.ExemptUserIDs {
+		l.exemptUserIDs[userID] = struct{}{}
+	}
+	return l
+}
+
+// limitUpload returns an error response if the user has made too many uploads.
+func (l *mediaRateLimits) limitUpload(device *userapi.Device) *util.JSONResponse {
+	if !l.enabled {
+		return nil
+	}
+	switch device.AccountType {
+	case userapi.AccountTypeAdmin, userapi.AccountTypeAppService:
+		return nil
+	}
+	if _, ok := l.exemptUserIDs[device.UserID]; ok {
+		return nil
+	}
+	return limitExceeded(l.uploads.take(device.UserID, time.Now()))
+}
+
+// limitDownload returns an error response if the IP address the request is
+// from has made too many downloads.
+func (l *mediaRateLimits) limitDownload(req *http.Request) *util.JSONResponse {
+	if !l.enabled {
+		return nil
+	}
+	return limitExceeded(l.downloads.take(clientIP(req), time.Now()))
+}
+
+// limitExceeded returns an M_LIMIT_EXCEEDED response telling the client when
+// to try again, or nil if the request wasn't limited.
+func limitExceeded(retryAfter time.Duration) *util.JSONResponse {
+	if retryAfter <= 0 {
+		return nil
+	}
+	retryAfterMS := int64(math.Ceil(float64(retryAfter) / float64(time.Millisecond)))
+	return &util.JSONResponse{
+		Code: http.StatusTooManyRequests,
+		JSON: spec.LimitExceeded("You are sending too many media requests too quickly!", retryAfterMS),
+	}
+}
+
+// clientIP returns the IP address the request is from, which is the first
+// address in the X-Forwarded-For header if there is one, as set by reverse
+// proxies.
+func clientIP(req *http.Request) string {
+	if forwardedFor := req.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+		ip, _, _ := strings.Cut(forwardedFor, ",")
+		return strings.TrimSpace(ip)
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+// tokenBuckets are token buckets of the same size and refill rate, by key.
+type tokenBuckets struct {
+	burst     float64
+	perSecond float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	// When the tokens were last counted.
+	updated time.Time
+}
+
+func newTokenBuckets(limit config.MediaRateLimit) *tokenBuckets {
+	return &tokenBuckets{
+		burst:     float64(limit.Burst),
+		perSecond: limit.PerSecond,
+		buckets:   map[string]*tokenBucket{},
+	}
+}
+
+// take takes a token from the bucket of the key. If the bucket is empty, no
+// token is taken and how long it will be until there is one is returned.
+func (b *tokenBuckets) take(key string, now time.Time) (retryAfter time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sweep(now)
+
+	bucket, ok := b.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: b.burst, updated: now}
+		b.buckets[key] = bucket
+	}
+	bucket.tokens = b.refilled(bucket, now)
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		return time.Duration((1 - bucket.tokens) / b.perSecond * float64(time.Second))
+	}
+	bucket.tokens--
+	return 0
+}
+
+// refilled returns the number of tokens in the bucket at the given time.
+func (b *tokenBuckets) refilled(bucket *tokenBucket, now time.Time) float64 {
+	return math.Min(b.burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*b.perSecond)
+}
+
+// sweep forgets the buckets that have refilled, at most once a minute, as they
+// are the same as new ones.
+func (b *tokenBuckets) sweep(now time.Time) {
+	if now.Sub(b.lastSweep) < time.Minute {
+		return
+	}
+	b.lastSweep = now
+	for key, bucket := range b.buckets {
+		if b.refilled(bucket, now) >= b.burst {
+			delete(b.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package routing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBuckets(t *testing.T) {
+	buckets := newTokenBuckets(config.MediaRateLimit{Burst: 2, PerSecond: 4})
+	now := time.Now()
+
+	// The burst can be used straight away, after which a token is added every 250ms.
+	assert.Zero(t, buckets.take("a", now))
+	assert.Zero(t, buckets.take("a", now))
+	assert.Equal(t, 250*time.Millisecond, buckets.take("a", now))
+	assert.InDelta(t, 150*time.Millisecond, buckets.take("a", now.Add(100*time.Millisecond)), float64(time.Millisecond))
+	assert.Zero(t, buckets.take("a", now.Add(300*time.Millisecond)))
+
+	// Buckets are per key.
+	assert.Zero(t, buckets.take("b", now))
+
+	// Buckets don't fill beyond the burst.
+	later := now.Add(time.Hour)
+	assert.Zero(t, buckets.take("a", later))
+	assert.Zero(t, buckets.take("a", later))
+	assert.NotZero(t, buckets.take("a", later))
+
+	// Full buckets are forgotten.
+	assert.Zero(t, buckets.take("c", later.Add(time.Hour)))
+	assert.NotContains(t, buckets.buckets, "b")
+	assert.Contains(t, buckets.buckets, "c")
+}
+
+func TestMediaRateLimits(t *testing.T) {
+	limits := newMediaRateLimits(&config.MediaRateLimiting{
+		Enabled:       true,
+		Uploads:       config.MediaRateLimit{Burst: 1, PerSecond: 0.1},
+		Downloads:     config.MediaRateLimit{Burst: 1, PerSecond: 0.1},
+		ExemptUserIDs: []string{"@bot:test"},
+	})
+
+	user := &userapi.Device{UserID: "@alice:test", AccountType: userapi.AccountTypeUser}
+	assert.Nil(t, limits.limitUpload(user))
+	res := limits.limitUpload(user)
+	if assert.NotNil(t, res) {
+		assert.Equal(t, http.StatusTooManyRequests, res.Code)
+		limitErr, ok := res.JSON.(spec.LimitExceededError)
+		if assert.True(t, ok) {
+			assert.Equal(t, spec.ErrorLimitExceeded, limitErr.ErrCode)
+			assert.InDelta(t, 10000, limitErr.RetryAfterMS, 100)
+		}
+	}
+
+	for _, device := range []*userapi.Device{
+		{UserID: "@admin:test", AccountType: userapi.AccountTypeAdmin},
+		{UserID: "@bot:test", AccountType: userapi.AccountTypeUser},
+	} {
+		assert.Nil(t, limits.limitUpload(device))
+		assert.Nil(t, limits.limitUpload(device))
+	}
+
+	// Downloads are limited by IP address, whichever port they are from.
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	assert.Nil(t, limits.limitDownload(req))
+	req.RemoteAddr = "192.0.2.1:5678"
+	assert.NotNil(t, limits.limitDownload(req))
+	req.RemoteAddr = "192.0.2.2:1234"
+	assert.Nil(t, limits.limitDownload(req))
+	req.Header.Set("X-Forwarded-For", "198.51.100.1, 192.0.2.2")
+	assert.Nil(t, limits.limitDownload(req))
+	assert.NotNil(t, limits.limitDownload(req))
+
+	// Nothing is limited while rate limiting is disabled.
+	limits.enabled = false
+	assert.Nil(t, limits.limitUpload(user))
+	assert.Nil(t, limits.limitDownload(req))
+}
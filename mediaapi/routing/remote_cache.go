@@ -0,0 +1,206 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/maintenance"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	log "github.com/sirupsen/logrus"
+)
+
+// How many cached remote files to look at in one go when evicting.
+const remoteCacheEvictionBatchSize = 100
+
+// The janitor, retention, garbage collection and verification all delete
+// media, so only one of them runs at a time rather than racing each other for
+// the same files.
+var remoteCacheEvictionMutex sync.Mutex
+
+// startRemoteMediaJanitor schedules the janitor which purges expired remote
+// media, and evicts remote media while the cache is over its size limit. It runs
+// every janitor interval, and should be triggered whenever remote media has been
+// fetched. Returns nil if neither a maximum age nor size is configured.
+func startRemoteMediaJanitor(
+	processCtx *process.ProcessContext,
+	cfg *config.MediaAPI,
+	db storage.Database,
+) *maintenance.Job {
+	if cfg.RemoteMediaMaxAge <= 0 && cfg.MaxRemoteCacheSizeBytes <= 0 {
+		return nil
+	}
+	logger := log.WithField("component", "remote_media_janitor")
+	return maintenance.Every(processCtx, "remote_media_janitor", cfg.RemoteMediaJanitorInterval, func(ctx context.Context) error {
+		remoteCacheEvictionMutex.Lock()
+		defer remoteCacheEvictionMutex.Unlock()
+		if err := purgeExpiredRemoteMedia(ctx, cfg, db, logger); err != nil {
+			return fmt.Errorf("failed to purge expired remote media: %w", err)
+		}
+		if err := evictRemoteMedia(ctx, cfg, db, logger); err != nil {
+			return fmt.Errorf("failed to evict remote media: %w", err)
+		}
+		return nil
+	})
+}
+
+// evictRemoteMedia removes the least recently accessed media fetched from other
+// servers until the remote media cache is back under the configured size limit.
+// Media uploaded to this server is never evicted.
+func evictRemoteMedia(
+	ctx context.Context,
+	cfg *config.MediaAPI,
+	db storage.Database,
+	logger *log.Entry,
+) error {
+	if cfg.MaxRemoteCacheSizeBytes <= 0 {
+		return nil
+	}
+	size, err := db.GetRemoteMediaCacheSize(ctx, cfg.Matrix.ServerName)
+	if err != nil {
+		return fmt.Errorf("db.GetRemoteMediaCacheSize: %w", err)
+	}
+
+	var evicted int
+	for size > types.FileSizeBytes(cfg.MaxRemoteCacheSizeBytes) {
+		candidates, err := db.GetLeastRecentlyAccessedRemoteMedia(ctx, cfg.Matrix.ServerName, remoteCacheEvictionBatchSize)
+		if err != nil {
+			return fmt.Errorf("db.GetLeastRecentlyAccessedRemoteMedia: %w", err)
+		}
+		if len(candidates) == 0 {
+			break
+		}
+		for _, mediaMetadata := range candidates {
+			if size <= types.FileSizeBytes(cfg.MaxRemoteCacheSizeBytes) {
+				break
+			}
+			if err = deleteMedia(ctx, cfg, db, mediaMetadata, logger); err != nil {
+				return err
+			}
+			size -= mediaMetadata.FileSizeBytes
+			evicted++
+		}
+	}
+
+	if evicted > 0 {
+		logger.WithFields(log.Fields{
+			"Evicted":            evicted,
+			"RemoteCacheSize":    size,
+			"MaxRemoteCacheSize": cfg.MaxRemoteCacheSizeBytes,
+		}).Info("Evicted remote media from cache")
+	}
+	return nil
+}
+
+// isRemoteMediaExpired returns true if the media was fetched from another server
+// longer ago than the configured maximum age.
+func isRemoteMediaExpired(cfg *config.MediaAPI, mediaMetadata *types.MediaMetadata) bool {
+	if cfg.RemoteMediaMaxAge <= 0 || mediaMetadata.Origin == cfg.Matrix.ServerName {
+		return false
+	}
+	return time.Since(mediaMetadata.CreationTimestamp.Time()) > cfg.RemoteMediaMaxAge
+}
+
+// purgeExpiredRemoteMedia removes all remote media that was fetched longer ago
+// than the configured maximum age.
+func purgeExpiredRemoteMedia(
+	ctx context.Context,
+	cfg *config.MediaAPI,
+	db storage.Database,
+	logger *log.Entry,
+) error {
+	if cfg.RemoteMediaMaxAge <= 0 {
+		return nil
+	}
+	before := spec.AsTimestamp(time.Now().Add(-cfg.RemoteMediaMaxAge))
+	var purged int
+	for {
+		expired, err := db.GetRemoteMediaCachedBefore(ctx, cfg.Matrix.ServerName, before, remoteCacheEvictionBatchSize)
+		if err != nil {
+			return fmt.Errorf("db.GetRemoteMediaCachedBefore: %w", err)
+		}
+		for _, mediaMetadata := range expired {
+			if err = deleteMedia(ctx, cfg, db, mediaMetadata, logger); err != nil {
+				return err
+			}
+			purged++
+		}
+		if len(expired) < remoteCacheEvictionBatchSize {
+			break
+		}
+	}
+
+	if purged > 0 {
+		logger.WithFields(log.Fields{
+			"Purged": purged,
+			"MaxAge": cfg.RemoteMediaMaxAge,
+		}).Info("Purged expired remote media from cache")
+	}
+	return nil
+}
+
+// deleteMedia removes the metadata for the media and its thumbnails. The file
+// is only removed from disk once no other media refers to the same file.
+func deleteMedia(
+	ctx context.Context,
+	cfg *config.MediaAPI,
+	db storage.Database,
+	mediaMetadata *types.MediaMetadata,
+	logger *log.Entry,
+) error {
+	unreferenced, err := db.DeleteMediaMetadata(ctx, mediaMetadata.MediaID, mediaMetadata.Origin)
+	if err != nil {
+		return fmt.Errorf("db.DeleteMediaMetadata: %w", err)
+	}
+	if !unreferenced {
+		return nil
+	}
+	return removeUnreferencedFile(ctx, cfg, db, mediaMetadata.Base64Hash, logger)
+}
+
+// removeUnreferencedFile removes a file that no media refers to any more, and
+// its thumbnails, from disk.
+func removeUnreferencedFile(
+	ctx context.Context,
+	cfg *config.MediaAPI,
+	db storage.Database,
+	hash types.Base64Hash,
+	logger *log.Entry,
+) error {
+	filePath, err := fileutils.GetPathFromBase64Hash(hash, cfg.AbsBasePath, cfg.StoreLayout)
+	if err != nil {
+		return fmt.Errorf("fileutils.GetPathFromBase64Hash: %w", err)
+	}
+	// The same file may have been stored again since its last reference was
+	// deleted, so the database checks again before it is removed.
+	_, err = db.RemoveUnreferencedFile(ctx, hash, func() error {
+		// The thumbnails live in the same directory as the file.
+		fileutils.RemoveDir(types.Path(filepath.Dir(filePath)), logger)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("db.RemoveUnreferencedFile: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// requestIDHeader is the response header the request ID is returned in, so
+// that users can quote it when reporting problems.
+const requestIDHeader = "X-Request-Id"
+
+type requestIDContextKey struct{}
+
+// logRequests gives each request to the media API a request ID and logs a line
+// with its outcome once it has been answered.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		requestID := util.RandomString(12)
+		w.Header().Set(requestIDHeader, requestID)
+		req = req.WithContext(context.WithValue(req.Context(), requestIDContextKey{}, requestID))
+		lw := &accessLogResponseWriter{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(lw, req)
+
+		log.WithFields(log.Fields{
+			"req.id":      requestID,
+			"req.method":  req.Method,
+			"req.path":    req.URL.Path,
+			"status":      lw.status,
+			"bytes":       lw.written,
+			"duration_ms": time.Since(start).Milliseconds(),
+		}).Info("Media API request")
+	})
+}
+
+// withRequestLogger makes the logger of the request log the request ID given to
+// it by logRequests, so that everything logged while handling it, including by
+// fileutils, can be matched up with its access log line.
+func withRequestLogger(req *http.Request) *http.Request {
+	requestID, ok := req.Context().Value(requestIDContextKey{}).(string)
+	if !ok {
+		return req
+	}
+	logger := util.GetLogger(req.Context()).WithField("req.id", requestID)
+	return req.WithContext(util.ContextWithLogger(req.Context(), logger))
+}
+
+// accessLogResponseWriter records the status code and the size of a response.
+type accessLogResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	written     int64
+	wroteHeader bool
+}
+
+func (w *accessLogResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogResponseWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// Flush lets remote media be streamed to the client as it arrives.
+func (w *accessLogResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying response writer.
+func (w *accessLogResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
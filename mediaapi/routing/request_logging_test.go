@@ -0,0 +1,51 @@
+package routing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogRequests(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	var handlerRequestID any
+	router := mux.NewRouter()
+	router.Use(logRequests)
+	router.HandleFunc("/download/{mediaId}", func(w http.ResponseWriter, req *http.Request) {
+		req = withRequestLogger(util.RequestWithLogging(req))
+		handlerRequestID = util.GetLogger(req.Context()).Data["req.id"]
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("not found"))
+	})
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/download/abc", nil))
+
+	requestID := rec.Header().Get(requestIDHeader)
+	assert.NotEmpty(t, requestID)
+	assert.Equal(t, requestID, handlerRequestID)
+
+	var accessLog *logrus.Entry
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "Media API request" {
+			accessLog = entry
+		}
+	}
+	if !assert.NotNil(t, accessLog) {
+		return
+	}
+	assert.Equal(t, requestID, accessLog.Data["req.id"])
+	assert.Equal(t, http.MethodGet, accessLog.Data["req.method"])
+	assert.Equal(t, "/download/abc", accessLog.Data["req.path"])
+	assert.Equal(t, http.StatusNotFound, accessLog.Data["status"])
+	assert.Equal(t, int64(len("not found")), accessLog.Data["bytes"])
+	assert.Contains(t, accessLog.Data, "duration_ms")
+}
@@ -0,0 +1,173 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/mediaapi/types/mxc"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/maintenance"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// How many media entries to look at in one go when applying retention policies.
+const retentionBatchSize = 100
+
+// How often to check whether retention has been enabled by reloading the
+// config, while it is disabled.
+const retentionDisabledInterval = time.Hour
+
+// retentionReport describes the media deleted by applying the retention policies.
+type retentionReport struct {
+	DryRun bool `json:"dry_run"`
+	// How much media was deleted, or would have been deleted in a dry run
+	Deleted      int                 `json:"deleted"`
+	DeletedBytes types.FileSizeBytes `json:"deleted_bytes"`
+	// The media that would have been deleted, only listed in a dry run
+	Media []string `json:"media,omitempty"`
+}
+
+// startMediaRetention schedules applying the retention policies every retention
+// interval, if retention is enabled.
+func startMediaRetention(processCtx *process.ProcessContext, mediaCfg *reloadableConfig, db storage.Database) {
+	logger := log.WithField("component", "media_retention")
+	interval := func() time.Duration {
+		if interval := mediaCfg.load().Retention.Interval; interval > 0 {
+			return interval
+		}
+		// Retention is disabled, but may be enabled when the config is reloaded.
+		return retentionDisabledInterval
+	}
+	maintenance.Schedule(processCtx, "media_retention", interval, func(ctx context.Context) error {
+		cfg := mediaCfg.load()
+		if !cfg.Retention.Enabled() {
+			return nil
+		}
+		_, err := applyMediaRetention(ctx, cfg, db, cfg.Retention.DryRun, logger)
+		return err
+	})
+}
+
+// applyMediaRetention deletes all local and remote media that is older than
+// the retention policies allow. In a dry run, the media is only reported.
+func applyMediaRetention(
+	ctx context.Context,
+	cfg *config.MediaAPI,
+	db storage.Database,
+	dryRun bool,
+	logger *log.Entry,
+) (*retentionReport, error) {
+	remoteCacheEvictionMutex.Lock()
+	defer remoteCacheEvictionMutex.Unlock()
+
+	report := &retentionReport{DryRun: dryRun}
+	if err := applyRetentionPolicy(ctx, cfg, db, &cfg.Retention.Local, false, report, logger); err != nil {
+		return report, err
+	}
+	if err := applyRetentionPolicy(ctx, cfg, db, &cfg.Retention.Remote, true, report, logger); err != nil {
+		return report, err
+	}
+
+	if report.Deleted > 0 {
+		logger.WithFields(log.Fields{
+			"DryRun":       dryRun,
+			"Deleted":      report.Deleted,
+			"DeletedBytes": report.DeletedBytes,
+		}).Info("Applied media retention policies")
+	}
+	return report, nil
+}
+
+func applyRetentionPolicy(
+	ctx context.Context,
+	cfg *config.MediaAPI,
+	db storage.Database,
+	policy *config.MediaRetentionPolicy,
+	remote bool,
+	report *retentionReport,
+	logger *log.Entry,
+) error {
+	minAge := policy.MinMaxAge()
+	if minAge <= 0 {
+		return nil
+	}
+	now := time.Now()
+	before := spec.AsTimestamp(now.Add(-minAge))
+
+	// Deleted media drops out of the results, but media that is kept doesn't,
+	// so skip past everything that is kept.
+	var offset int
+	for {
+		media, err := db.GetMediaCreatedBefore(ctx, cfg.Matrix.ServerName, remote, before, retentionBatchSize, offset)
+		if err != nil {
+			return fmt.Errorf("db.GetMediaCreatedBefore: %w", err)
+		}
+		for _, mediaMetadata := range media {
+			maxAge := policy.MaxAgeFor(string(mediaMetadata.ContentType))
+			if maxAge <= 0 || now.Sub(mediaMetadata.CreationTimestamp.Time()) <= maxAge {
+				offset++
+				continue
+			}
+			contentURI := mxc.URI{ServerName: mediaMetadata.Origin, MediaID: mediaMetadata.MediaID}.String()
+			report.Deleted++
+			report.DeletedBytes += mediaMetadata.FileSizeBytes
+			if report.DryRun {
+				offset++
+				report.Media = append(report.Media, contentURI)
+				logger.WithFields(log.Fields{
+					"MediaID":       contentURI,
+					"ContentType":   mediaMetadata.ContentType,
+					"FileSizeBytes": mediaMetadata.FileSizeBytes,
+					"CreatedAt":     mediaMetadata.CreationTimestamp.Time(),
+				}).Info("Media retention dry run: would delete media")
+				continue
+			}
+			if err = deleteMedia(ctx, cfg, db, mediaMetadata, logger); err != nil {
+				return fmt.Errorf("failed to delete %s: %w", contentURI, err)
+			}
+		}
+		if len(media) < retentionBatchSize {
+			return nil
+		}
+	}
+}
+
+// AdminMediaRetention implements POST /_dendrite/admin/mediaRetention. It applies
+// the retention policies straight away and returns what was deleted. In a dry
+// run, nothing is deleted and the media that would be is listed.
+func AdminMediaRetention(req *http.Request, cfg *config.MediaAPI, db storage.Database, dryRun bool) util.JSONResponse {
+	logger := util.GetLogger(req.Context())
+	report, err := applyMediaRetention(req.Context(), cfg, db, dryRun, logger)
+	if err != nil {
+		logger.WithError(err).Error("Failed to apply media retention policies")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: report,
+	}
+}
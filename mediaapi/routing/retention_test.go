@@ -0,0 +1,67 @@
+package routing
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_applyMediaRetention(t *testing.T) {
+	cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
+	db, err := storage.NewMediaAPIDatasource(cm, &config.DatabaseOptions{
+		ConnectionString:       "file::memory:",
+		MaxOpenConnections:     1,
+		MaxIdleConnections:     1,
+		ConnMaxLifetimeSeconds: -1,
+	})
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	cfg := &config.MediaAPI{
+		Matrix:      &config.Global{},
+		AbsBasePath: config.Path(t.TempDir()),
+		Retention: config.MediaRetention{
+			Local: config.MediaRetentionPolicy{
+				MaxAge: time.Millisecond,
+				// keep avatars forever
+				ContentTypes: []config.ContentTypeRetention{{ContentType: "image/*"}},
+			},
+		},
+	}
+	cfg.Matrix.ServerName = "localhost"
+
+	media := []*types.MediaMetadata{
+		{MediaID: "avatar", Origin: "localhost", ContentType: "image/png", FileSizeBytes: 1, Base64Hash: "avatarhash"},
+		{MediaID: "log", Origin: "localhost", ContentType: "text/plain; charset=utf-8", FileSizeBytes: 2, Base64Hash: "loghash"},
+		{MediaID: "remote", Origin: "remote", ContentType: "text/plain", FileSizeBytes: 4, Base64Hash: "remotehash"},
+	}
+	for _, metadata := range media {
+		assert.NoError(t, db.StoreMediaMetadata(ctx, metadata))
+	}
+	time.Sleep(time.Millisecond * 5)
+	logger := logrus.WithField("test", t.Name())
+
+	// a dry run only reports the media
+	report, err := applyMediaRetention(ctx, cfg, db, true, logger)
+	assert.NoError(t, err)
+	assert.Equal(t, &retentionReport{DryRun: true, Deleted: 1, DeletedBytes: 2, Media: []string{"mxc://localhost/log"}}, report)
+	metadata, err := db.GetMediaMetadata(ctx, "log", "localhost")
+	assert.NoError(t, err)
+	assert.NotNil(t, metadata, "media should not be deleted in a dry run")
+
+	report, err = applyMediaRetention(ctx, cfg, db, false, logger)
+	assert.NoError(t, err)
+	assert.Equal(t, &retentionReport{Deleted: 1, DeletedBytes: 2}, report)
+	for _, m := range media {
+		metadata, err = db.GetMediaMetadata(ctx, m.MediaID, m.Origin)
+		assert.NoError(t, err)
+		assert.Equal(t, m.MediaID != "log", metadata != nil, "unexpected retention of %s", m.MediaID)
+	}
+}
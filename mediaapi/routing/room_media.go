@@ -0,0 +1,141 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/mediaapi/types/mxc"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+)
+
+type purgeRoomMediaResponse struct {
+	// The media that was deleted
+	Deleted []string `json:"deleted"`
+	// The media referenced by the room that wasn't stored on this server
+	NotFound []string `json:"not_found"`
+	// Whether the media was only listed rather than deleted
+	DryRun bool `json:"dry_run"`
+}
+
+// AdminPurgeRoomMedia implements POST /_dendrite/admin/purgeRoomMedia/{roomID}.
+// It deletes the local and cached remote media referenced by the events in a room.
+// In a dry run, nothing is deleted and the media that would be is listed.
+func AdminPurgeRoomMedia(
+	req *http.Request, cfg *config.MediaAPI, device *userapi.Device, db storage.Database,
+	rsAPI roomserverAPI.MediaRoomserverAPI, auditLog *mediaAuditLog, dryRun bool,
+) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	roomID, err := spec.NewRoomID(vars["roomID"])
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam(err.Error()),
+		}
+	}
+	logger := util.GetLogger(req.Context()).WithField("room_id", roomID.String())
+	uris, err := rsAPI.QueryMediaURIsInRoom(req.Context(), *roomID)
+	if err != nil {
+		logger.WithError(err).Error("Failed to find media in room")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if uris == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("Room is not known to this server."),
+		}
+	}
+	res, err := purgeMedia(req.Context(), cfg, db, uris, dryRun, logger, func(mediaMetadata *types.MediaMetadata) {
+		auditLog.record(req, &types.AuditLogEntry{
+			Action:     types.AuditDelete,
+			MediaID:    mediaMetadata.MediaID,
+			Origin:     mediaMetadata.Origin,
+			Base64Hash: mediaMetadata.Base64Hash,
+			UserID:     types.MatrixUserID(device.UserID),
+		})
+	})
+	if err != nil {
+		logger.WithError(err).Error("Failed to purge media of room")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if !dryRun {
+		logger.WithField("deleted", len(res.Deleted)).Info("Purged media of room")
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// purgeMedia deletes the media with the given mxc:// URIs, both local and cached
+// remote media, including their thumbnails. In a dry run, the media is only
+// listed. onDeleted, if not nil, is called for each media that was deleted.
+func purgeMedia(
+	ctx context.Context, cfg *config.MediaAPI, db storage.Database, uris []string, dryRun bool, logger *log.Entry,
+	onDeleted func(*types.MediaMetadata),
+) (*purgeRoomMediaResponse, error) {
+	res := &purgeRoomMediaResponse{
+		Deleted:  []string{},
+		NotFound: []string{},
+		DryRun:   dryRun,
+	}
+	for _, uri := range uris {
+		parsed, err := mxc.Parse(uri)
+		if err != nil {
+			res.NotFound = append(res.NotFound, uri)
+			continue
+		}
+		mediaMetadata, err := db.GetMediaMetadata(ctx, parsed.MediaID, parsed.ServerName)
+		if err != nil {
+			return nil, fmt.Errorf("db.GetMediaMetadata: %w", err)
+		}
+		if mediaMetadata == nil {
+			res.NotFound = append(res.NotFound, uri)
+			continue
+		}
+		if dryRun {
+			res.Deleted = append(res.Deleted, uri)
+			continue
+		}
+		if err = deleteMedia(ctx, cfg, db, mediaMetadata, logger); err != nil {
+			return nil, fmt.Errorf("failed to delete %s: %w", uri, err)
+		}
+		if onDeleted != nil {
+			onDeleted(mediaMetadata)
+		}
+		res.Deleted = append(res.Deleted, uri)
+	}
+	return res, nil
+}
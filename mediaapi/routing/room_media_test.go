@@ -0,0 +1,70 @@
+package routing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_purgeMedia(t *testing.T) {
+	cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
+	db, err := storage.NewMediaAPIDatasource(cm, &config.DatabaseOptions{
+		ConnectionString:       "file::memory:",
+		MaxOpenConnections:     1,
+		MaxIdleConnections:     1,
+		ConnMaxLifetimeSeconds: -1,
+	})
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	cfg := &config.MediaAPI{
+		Matrix:      &config.Global{},
+		AbsBasePath: config.Path(t.TempDir()),
+	}
+	cfg.Matrix.ServerName = "localhost"
+
+	media := []*types.MediaMetadata{
+		{MediaID: "local", Origin: "localhost", FileSizeBytes: 1, Base64Hash: "localhash"},
+		{MediaID: "remote", Origin: "remote", FileSizeBytes: 2, Base64Hash: "remotehash"},
+		{MediaID: "unreferenced", Origin: "localhost", FileSizeBytes: 4, Base64Hash: "otherhash"},
+	}
+	for _, metadata := range media {
+		assert.NoError(t, db.StoreMediaMetadata(ctx, metadata))
+	}
+
+	uris := []string{
+		"mxc://localhost/local", "mxc://remote/remote", "mxc://remote/unknown", "mxc://localhost/../invalid",
+	}
+
+	// a dry run only lists the media
+	res, err := purgeMedia(ctx, cfg, db, uris, true, logrus.WithField("test", t.Name()), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, &purgeRoomMediaResponse{
+		Deleted:  []string{"mxc://localhost/local", "mxc://remote/remote"},
+		NotFound: []string{"mxc://remote/unknown", "mxc://localhost/../invalid"},
+		DryRun:   true,
+	}, res)
+	for _, m := range media {
+		metadata, err := db.GetMediaMetadata(ctx, m.MediaID, m.Origin)
+		assert.NoError(t, err)
+		assert.NotNil(t, metadata, "media should not be deleted in a dry run")
+	}
+
+	res, err = purgeMedia(ctx, cfg, db, uris, false, logrus.WithField("test", t.Name()), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, &purgeRoomMediaResponse{
+		Deleted:  []string{"mxc://localhost/local", "mxc://remote/remote"},
+		NotFound: []string{"mxc://remote/unknown", "mxc://localhost/../invalid"},
+	}, res)
+	for _, m := range media {
+		metadata, err := db.GetMediaMetadata(ctx, m.MediaID, m.Origin)
+		assert.NoError(t, err)
+		assert.Equal(t, m.MediaID == "unreferenced", metadata != nil, "unexpected purge of %s", m.MediaID)
+	}
+}
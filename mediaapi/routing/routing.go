@@ -16,14 +16,21 @@ package routing
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"strings"
 
 	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/internal/spamcheck"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/mediaapi/workers"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib/fclient"
 	"github.com/matrix-org/gomatrixserverlib/spec"
@@ -31,6 +38,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
 )
 
 // configResponse is the response to GET /_matrix/media/r0/config
@@ -39,42 +47,115 @@ type configResponse struct {
 	UploadSize *config.FileSizeBytes `json:"m.upload.size,omitempty"`
 }
 
-// Setup registers the media API HTTP handlers
+// Setup registers the media API HTTP handlers. It returns an error if media
+// encryption can't be set up.
 //
 // Due to Setup being used to call many other functions, a gocyclo nolint is
 // applied:
 // nolint: gocyclo
 func Setup(
-	publicAPIMux *mux.Router,
+	processCtx *process.ProcessContext,
+	routers httputil.Routers,
 	cfg *config.Dendrite,
 	db storage.Database,
 	userAPI userapi.MediaUserAPI,
+	rsAPI roomserverAPI.MediaRoomserverAPI,
 	client *fclient.Client,
-) {
+	spamCheckers *spamcheck.SpamCheckers,
+) error {
+	encryption, err := fileutils.NewEncryption(&cfg.MediaAPI.Encryption)
+	if err != nil {
+		return fmt.Errorf("failed to set up media encryption: %w", err)
+	}
+
 	rateLimits := httputil.NewRateLimits(&cfg.ClientAPI.RateLimiting)
+	mediaCfg := newReloadableConfig(&cfg.MediaAPI, cfg.ConfigPath)
+	go mediaCfg.reloadOnSIGHUP()
 
+	publicAPIMux := routers.Media
+	dendriteAdminRouter := routers.DendriteAdmin
+	publicAPIMux.Use(logRequests)
+	routers.MediaProxy.Use(logRequests)
 	v3mux := publicAPIMux.PathPrefix("/{apiversion:(?:r0|v1|v3)}/").Subrouter()
 
+	mediaWorkers := workers.NewPool(cfg.MediaAPI.Workers.Concurrency, cfg.MediaAPI.Workers.QueueTimeout)
 	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
 		PathToResult: map[string]*types.ThumbnailGenerationResult{},
+		Workers:      mediaWorkers,
+	}
+
+	blocklist := newHashBlocklist(&cfg.MediaAPI, db)
+	originBlocklist := newOriginBlocklist(&cfg.MediaAPI, db)
+	compression := fileutils.NewCompression(&cfg.MediaAPI.Compression)
+	compression.SetWorkers(mediaWorkers)
+	var backends *fileutils.Backends
+	if len(cfg.MediaAPI.Replicas.AbsPaths) > 0 {
+		backends = fileutils.NewBackends(cfg.MediaAPI.AbsBasePath, cfg.MediaAPI.Replicas.AbsPaths)
+		go backends.RunHealthChecks(cfg.MediaAPI.Replicas.HealthCheckInterval)
+	}
+	fileCache := fileutils.NewFileCache(&cfg.MediaAPI.FileCache)
+	lastAccess := newLastAccessRecorder(db)
+	go lastAccess.run(lastAccessFlushInterval)
+	auditLog := newMediaAuditLog(&cfg.MediaAPI.AuditLog, db)
+	if auditLog != nil {
+		go auditLog.run()
 	}
 
+	remoteMediaJanitor := startRemoteMediaJanitor(processCtx, &cfg.MediaAPI, db)
+	// The free space is checked straight away, so that uploads aren't accepted
+	// at startup if the media store is already full.
+	diskSpace := newDiskSpaceMonitor(&cfg.MediaAPI.DiskSpace, cfg.MediaAPI.AbsBasePath)
+	if diskSpace.check(log.WithField("component", "media_disk_space")) {
+		go diskSpace.run()
+	}
+	startMediaRetention(processCtx, mediaCfg, db)
+
+	drainer := newTransferDrainer(&cfg.MediaAPI, processCtx)
+	processCtx.ComponentStarted()
+	go drainer.run(processCtx)
+
+	health := &healthChecker{cfg: &cfg.MediaAPI, db: db, drainer: drainer}
+	dendriteAdminRouter.HandleFunc("/monitor/media/healthz", health.liveness).Methods(http.MethodGet, http.MethodHead)
+	dendriteAdminRouter.HandleFunc("/monitor/media/readyz", health.readiness).Methods(http.MethodGet, http.MethodHead)
+
+	uploads := newActiveUploads()
 	uploadHandler := httputil.MakeAuthAPI(
 		"upload", userAPI,
 		func(req *http.Request, dev *userapi.Device) util.JSONResponse {
+			req = withRequestLogger(req)
 			if r := rateLimits.Limit(req, dev); r != nil {
 				return *r
 			}
-			return Upload(req, &cfg.MediaAPI, dev, db, activeThumbnailGeneration)
+			if r := mediaCfg.rateLimits().limitUpload(dev); r != nil {
+				return *r
+			}
+			if r := diskSpace.refuseUpload(); r != nil {
+				return *r
+			}
+			if r := drainer.refuseUpload(); r != nil {
+				return *r
+			}
+			return Upload(req, mediaCfg.load(), dev, db, activeThumbnailGeneration, blocklist, encryption, compression, spamCheckers, uploads, auditLog)
 		},
+		httputil.WithConsentRequired(userAPI, &cfg.Global),
 	)
 
 	configHandler := httputil.MakeAuthAPI("config", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 		if r := rateLimits.Limit(req, device); r != nil {
 			return *r
 		}
-		respondSize := &cfg.MediaAPI.MaxFileSizeBytes
-		if cfg.MediaAPI.MaxFileSizeBytes == 0 {
+		// Report the limit that applies to this user, so that clients can check
+		// the size of files before uploading them.
+		maxFileSizeBytes, _, err := maxUploadSize(req.Context(), mediaCfg.load(), db, types.MatrixUserID(device.UserID))
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("Failed to get maximum upload size")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+		respondSize := &maxFileSizeBytes
+		if maxFileSizeBytes == 0 {
 			respondSize = nil
 		}
 		return util.JSONResponse{
@@ -83,33 +164,211 @@ func Setup(
 		}
 	})
 
-	v3mux.Handle("/upload", uploadHandler).Methods(http.MethodPost, http.MethodOptions)
+	v3mux.Handle("/upload", drainer.track(uploadHandler)).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/config", configHandler).Methods(http.MethodGet, http.MethodOptions)
 
+	uploadFromURLClient := newUploadFromURLClient(&cfg.MediaAPI.UploadFromURL)
+	dendriteAdminRouter.Handle("/admin/uploadFromURL", drainer.track(
+		httputil.MakeAuthAPI("admin_upload_from_url", userAPI, func(req *http.Request, dev *userapi.Device) util.JSONResponse {
+			req = withRequestLogger(req)
+			if r := diskSpace.refuseUpload(); r != nil {
+				return *r
+			}
+			if r := drainer.refuseUpload(); r != nil {
+				return *r
+			}
+			return AdminUploadFromURL(req, mediaCfg.load(), dev, db, uploadFromURLClient, activeThumbnailGeneration, blocklist, encryption, compression, spamCheckers, uploads, auditLog)
+		}),
+	)).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/reloadMediaConfig",
+		httputil.MakeAdminAPI("admin_reload_media_config", userAPI, func(req *http.Request, _ *userapi.Device) util.JSONResponse {
+			return AdminReloadMediaConfig(req, mediaCfg)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/uploads",
+		httputil.MakeAdminAPI("admin_uploads", userAPI, func(req *http.Request, _ *userapi.Device) util.JSONResponse {
+			return AdminListUploads(req, uploads)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/uploadQuota/{userID}",
+		httputil.MakeAdminAPI("admin_upload_quota", userAPI, func(req *http.Request, _ *userapi.Device) util.JSONResponse {
+			return AdminUploadQuota(req, mediaCfg.load(), db)
+		}),
+	).Methods(http.MethodGet, http.MethodPut, http.MethodDelete, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/userMedia/{userID}",
+		httputil.MakeAdminAPI("admin_list_user_media", userAPI, func(req *http.Request, _ *userapi.Device) util.JSONResponse {
+			return AdminListUserMedia(req, &cfg.MediaAPI, db)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/deleteUserMedia/{userID}",
+		httputil.MakeDestructiveAdminAPI("admin_delete_user_media", userAPI, func(req *http.Request, device *userapi.Device, dryRun bool) util.JSONResponse {
+			return AdminDeleteUserMedia(req, &cfg.MediaAPI, device, db, auditLog, dryRun)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/purgeRoomMedia/{roomID}",
+		httputil.MakeDestructiveAdminAPI("admin_purge_room_media", userAPI, func(req *http.Request, device *userapi.Device, dryRun bool) util.JSONResponse {
+			return AdminPurgeRoomMedia(req, &cfg.MediaAPI, device, db, rsAPI, auditLog, dryRun)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/mediaRetention",
+		httputil.MakeDestructiveAdminAPI("admin_media_retention", userAPI, func(req *http.Request, _ *userapi.Device, dryRun bool) util.JSONResponse {
+			return AdminMediaRetention(req, mediaCfg.load(), db, dryRun)
+		}, httputil.WithDryRunDefault(cfg.MediaAPI.Retention.DryRun)),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/mediaGC",
+		httputil.MakeDestructiveAdminAPI("admin_media_gc", userAPI, func(req *http.Request, _ *userapi.Device, dryRun bool) util.JSONResponse {
+			return AdminMediaGC(req, &cfg.MediaAPI, db, dryRun)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	takeouts := newTakeouts(&cfg.MediaAPI, db, userAPI, encryption)
+	dendriteAdminRouter.Handle("/admin/eraseUserMedia/{userID}",
+		httputil.MakeDestructiveAdminAPI("admin_erase_user_media", userAPI, func(req *http.Request, device *userapi.Device, dryRun bool) util.JSONResponse {
+			return AdminEraseUserMedia(req, &cfg.MediaAPI, device, db, takeouts, auditLog, dryRun)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	unstableMux := publicAPIMux.PathPrefix("/unstable/org.matrix.dendrite").Subrouter()
+	unstableMux.Handle("/takeout",
+		httputil.MakeAuthAPI("takeout", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.Limit(req, device); r != nil {
+				return *r
+			}
+			return Takeout(takeouts, device)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+	unstableMux.Handle("/takeout/{exportID}",
+		httputil.MakeAuthAPI("takeout_status", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return TakeoutStatus(req, takeouts, device)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+	unstableMux.Handle("/takeout/{exportID}/archive",
+		makeTakeoutArchiveAPI(takeouts, userAPI, false),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/takeout/{userID}",
+		httputil.MakeAdminAPI("admin_takeout", userAPI, func(req *http.Request, _ *userapi.Device) util.JSONResponse {
+			return AdminTakeout(req, &cfg.MediaAPI, takeouts)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+	dendriteAdminRouter.Handle("/admin/takeout/{userID}/{exportID}",
+		httputil.MakeAdminAPI("admin_takeout_status", userAPI, func(req *http.Request, _ *userapi.Device) util.JSONResponse {
+			return AdminTakeoutStatus(req, &cfg.MediaAPI, takeouts)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+	dendriteAdminRouter.Handle("/admin/takeout/{userID}/{exportID}/archive",
+		makeTakeoutArchiveAPI(takeouts, userAPI, true),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/maxUploadSize/{userID}",
+		httputil.MakeAdminAPI("admin_max_upload_size", userAPI, func(req *http.Request, _ *userapi.Device) util.JSONResponse {
+			return AdminMaxUploadSize(req, mediaCfg.load(), db)
+		}),
+	).Methods(http.MethodGet, http.MethodPut, http.MethodDelete, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/quarantineMedia/{serverName}/{mediaID}",
+		httputil.MakeAdminAPI("admin_quarantine_media", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminQuarantineMedia(req, device, db, auditLog)
+		}),
+	).Methods(http.MethodPost, http.MethodDelete, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/quarantineHash/{hash}",
+		httputil.MakeAdminAPI("admin_quarantine_hash", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminQuarantineHash(req, device, db, auditLog)
+		}),
+	).Methods(http.MethodPost, http.MethodDelete, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/blockedHashes",
+		httputil.MakeAdminAPI("admin_blocked_hashes", userAPI, func(req *http.Request, _ *userapi.Device) util.JSONResponse {
+			return AdminBlockedHashes(req, blocklist)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/blockedHashes/{hash}",
+		httputil.MakeAdminAPI("admin_block_hash", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminBlockHash(req, device, blocklist)
+		}),
+	).Methods(http.MethodPut, http.MethodDelete, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/blockedOrigins",
+		httputil.MakeAdminAPI("admin_blocked_origins", userAPI, func(req *http.Request, _ *userapi.Device) util.JSONResponse {
+			return AdminBlockedOrigins(req, originBlocklist)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/blockedOrigins/{serverName}",
+		httputil.MakeAdminAPI("admin_block_origin", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminBlockOrigin(req, device, originBlocklist)
+		}),
+	).Methods(http.MethodPut, http.MethodDelete, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/mediaAuditLog",
+		httputil.MakeAdminAPI("admin_media_audit_log", userAPI, func(req *http.Request, _ *userapi.Device) util.JSONResponse {
+			return AdminMediaAuditLog(req, db)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/mediaHashes/{algorithm}/{hash}",
+		httputil.MakeAdminAPI("admin_lookup_media_hash", userAPI, func(req *http.Request, _ *userapi.Device) util.JSONResponse {
+			return AdminLookupMediaHash(req, db)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
 	activeRemoteRequests := &types.ActiveRemoteRequests{
 		MXCToResult: map[string]*types.RemoteRequestResult{},
 	}
+	federationMedia := newFederationMediaFetcher(&cfg.MediaAPI, client)
 
-	downloadHandler := makeDownloadAPI("download", &cfg.MediaAPI, rateLimits, db, client, activeRemoteRequests, activeThumbnailGeneration)
-	v3mux.Handle("/download/{serverName}/{mediaId}", downloadHandler).Methods(http.MethodGet, http.MethodOptions)
-	v3mux.Handle("/download/{serverName}/{mediaId}/{downloadName}", downloadHandler).Methods(http.MethodGet, http.MethodOptions)
+	downloads := &downloader{
+		DB:                        db,
+		Client:                    client,
+		FederationMedia:           federationMedia,
+		ActiveRemoteRequests:      activeRemoteRequests,
+		ActiveThumbnailGeneration: activeThumbnailGeneration,
+		Blocklist:                 blocklist,
+		OriginBlocklist:           originBlocklist,
+		Encryption:                encryption,
+		Compression:               compression,
+		Backends:                  backends,
+		FileCache:                 fileCache,
+		LastAccess:                lastAccess,
+		RemoteMediaJanitor:        remoteMediaJanitor,
+	}
 
-	v3mux.Handle("/thumbnail/{serverName}/{mediaId}",
-		makeDownloadAPI("thumbnail", &cfg.MediaAPI, rateLimits, db, client, activeRemoteRequests, activeThumbnailGeneration),
-	).Methods(http.MethodGet, http.MethodOptions)
+	downloadHandler := makeDownloadAPI("download", mediaCfg, rateLimits, auditLog, downloads)
+	v3mux.Handle("/download/{serverName}/{mediaId}", drainer.track(downloadHandler)).Methods(http.MethodGet, http.MethodOptions)
+	v3mux.Handle("/download/{serverName}/{mediaId}/{downloadName}", drainer.track(downloadHandler)).Methods(http.MethodGet, http.MethodOptions)
+
+	v3mux.Handle("/thumbnail/{serverName}/{mediaId}", drainer.track(
+		makeDownloadAPI("thumbnail", mediaCfg, rateLimits, auditLog, downloads),
+	)).Methods(http.MethodGet, http.MethodOptions)
+
+	if cfg.MediaAPI.ContentScanner.Enabled {
+		setupContentScanner(routers.MediaProxy, &contentScanner{
+			cfg:        &cfg.MediaAPI,
+			downloader: downloads,
+		}, rateLimits)
+	}
+	return nil
 }
 
 func makeDownloadAPI(
 	name string,
-	cfg *config.MediaAPI,
+	mediaCfg *reloadableConfig,
 	rateLimits *httputil.RateLimits,
-	db storage.Database,
-	client *fclient.Client,
-	activeRemoteRequests *types.ActiveRemoteRequests,
-	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	auditLog *mediaAuditLog,
+	downloads *downloader,
 ) http.HandlerFunc {
 	var counterVec *prometheus.CounterVec
-	if cfg.Matrix.Metrics.Enabled {
+	if mediaCfg.load().Matrix.Metrics.Enabled {
 		counterVec = promauto.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: name,
@@ -119,7 +378,11 @@ func makeDownloadAPI(
 		)
 	}
 	httpHandler := func(w http.ResponseWriter, req *http.Request) {
-		req = util.RequestWithLogging(req)
+		cfg := mediaCfg.load()
+		req = withRequestLogger(util.RequestWithLogging(req))
+		trace, ctx := internal.StartTaskFromRequest(req, name)
+		defer trace.EndTask()
+		req = req.WithContext(ctx)
 
 		// Set internal headers returned regardless of the outcome of the request
 		util.SetCORSHeaders(w)
@@ -139,6 +402,13 @@ func makeDownloadAPI(
 				return
 			}
 		}
+		if r := mediaCfg.rateLimits().limitDownload(req); r != nil {
+			w.WriteHeader(r.Code)
+			if err := json.NewEncoder(w).Encode(r.JSON); err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("Failed to write rate limit response")
+			}
+			return
+		}
 
 		vars, _ := httputil.URLDecodeMapValues(mux.Vars(req))
 		serverName := spec.ServerName(vars["serverName"])
@@ -156,19 +426,28 @@ func makeDownloadAPI(
 		// Cache media for at least one day.
 		w.Header().Set("Cache-Control", "public,max-age=86400,s-maxage=86400")
 
+		// The audit log needs to know whether the media was served.
+		if auditLog != nil {
+			w = &accessLogResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		}
+		mediaID := types.MediaID(vars["mediaId"])
 		Download(
 			w,
 			req,
 			serverName,
-			types.MediaID(vars["mediaId"]),
+			mediaID,
 			cfg,
-			db,
-			client,
-			activeRemoteRequests,
-			activeThumbnailGeneration,
+			downloads,
 			name == "thumbnail",
 			vars["downloadName"],
 		)
+		if lw, ok := w.(*accessLogResponseWriter); ok && lw.status < http.StatusMultipleChoices {
+			action := types.AuditDownload
+			if name == "thumbnail" {
+				action = types.AuditThumbnail
+			}
+			auditLog.record(req, &types.AuditLogEntry{Action: action, MediaID: mediaID, Origin: serverName})
+		}
 	}
 
 	var handlerFunc http.HandlerFunc
@@ -0,0 +1,198 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// abortedTransferTimeout is how long transfers that were aborted at the end of
+// the grace period have to clean up after themselves, before their temporary
+// files are removed regardless.
+const abortedTransferTimeout = time.Second * 5
+
+// transferDrainer lets the uploads and downloads in progress when Dendrite
+// shuts down finish within a grace period, rather than cutting them off and
+// leaving half-written files behind.
+type transferDrainer struct {
+	cfg *config.MediaAPI
+	// Closed once Dendrite starts shutting down.
+	shutdown <-chan struct{}
+	// Closed once the grace period has passed, to abort the transfers that
+	// are still in progress.
+	aborted chan struct{}
+
+	mu     sync.Mutex
+	active int
+	// Closed once no transfers are in progress, if anything is waiting for that.
+	idle chan struct{}
+}
+
+func newTransferDrainer(cfg *config.MediaAPI, processCtx *process.ProcessContext) *transferDrainer {
+	return &transferDrainer{
+		cfg:      cfg,
+		shutdown: processCtx.WaitForShutdown(),
+		aborted:  make(chan struct{}),
+	}
+}
+
+// run waits for Dendrite to shut down, and then for the transfers in progress
+// to finish. The process context must have been told that the component was
+// started, so that Dendrite doesn't exit until run returns.
+func (d *transferDrainer) run(processCtx *process.ProcessContext) {
+	defer processCtx.ComponentFinished()
+	<-d.shutdown
+
+	logger := log.WithField("component", "media_shutdown")
+	idle := d.waitIdle()
+	select {
+	case <-idle:
+		return
+	default:
+	}
+	logger.WithField("grace_period", d.cfg.Shutdown.GracePeriod).Info("Waiting for media uploads and downloads to finish")
+	timer := time.NewTimer(d.cfg.Shutdown.GracePeriod)
+	defer timer.Stop()
+	select {
+	case <-idle:
+		logger.Info("Media uploads and downloads finished")
+		return
+	case <-timer.C:
+	}
+
+	logger.Warn("Aborting media uploads and downloads that didn't finish within the grace period")
+	close(d.aborted)
+	select {
+	case <-idle:
+	case <-time.After(abortedTransferTimeout):
+	}
+	// Nothing will finish writing the temporary files that are left, so they
+	// can all be removed.
+	report := &mediaGCReport{}
+	if err := collectTempDirs(d.cfg, time.Now(), report, logger); err != nil {
+		logger.WithError(err).Error("Failed to remove the temporary files of aborted media uploads and downloads")
+	}
+}
+
+// waitIdle returns a channel that is closed once no transfers are in progress.
+func (d *transferDrainer) waitIdle() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	idle := make(chan struct{})
+	if d.active == 0 {
+		close(idle)
+	} else {
+		d.idle = idle
+	}
+	return idle
+}
+
+func (d *transferDrainer) begin() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.active++
+}
+
+func (d *transferDrainer) end() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.active--
+	if d.active == 0 && d.idle != nil {
+		close(d.idle)
+		d.idle = nil
+	}
+}
+
+// track wraps a handler of uploads or downloads, so that Dendrite waits for
+// them when it shuts down. The request context of the handler isn't done when
+// Dendrite starts shutting down, but only once the grace period has passed.
+func (d *transferDrainer) track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		d.begin()
+		defer d.end()
+		ctx, cancel := d.transferContext(req.Context())
+		defer cancel()
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// transferContext returns a context with the values of the request context,
+// which is done once the request context is, unless that is because Dendrite
+// is shutting down, in which case it is done once the grace period has passed.
+func (d *transferDrainer) transferContext(reqCtx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(valuesContext{reqCtx})
+	go func() {
+		select {
+		case <-reqCtx.Done():
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case <-d.shutdown:
+			select {
+			case <-d.aborted:
+			case <-ctx.Done():
+			}
+		default:
+			// The client went away.
+		}
+		cancel()
+	}()
+	return ctx, cancel
+}
+
+// shuttingDown returns whether Dendrite has started shutting down.
+func (d *transferDrainer) shuttingDown() bool {
+	select {
+	case <-d.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// refuseUpload returns an error response if uploads are being refused because
+// Dendrite is shutting down.
+func (d *transferDrainer) refuseUpload() *util.JSONResponse {
+	if !d.shuttingDown() {
+		return nil
+	}
+	return &util.JSONResponse{
+		Code: http.StatusServiceUnavailable,
+		JSON: spec.Unknown("The server is shutting down, so uploads are refused. Try again later."),
+	}
+}
+
+// valuesContext has the values of its parent context, but is never done.
+type valuesContext struct {
+	parent context.Context
+}
+
+func (valuesContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (valuesContext) Done() <-chan struct{}       { return nil }
+func (valuesContext) Err() error                  { return nil }
+
+func (c valuesContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
@@ -0,0 +1,99 @@
+package routing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/stretchr/testify/assert"
+)
+
+// startDrainer starts draining transfers for a process, whose context is used
+// as the base of requests as the HTTP server does.
+func startDrainer(t *testing.T, gracePeriod time.Duration) (*config.MediaAPI, *process.ProcessContext, *transferDrainer) {
+	cfg := &config.MediaAPI{
+		Matrix:      &config.Global{},
+		AbsBasePath: config.Path(t.TempDir()),
+		Shutdown:    config.MediaShutdown{GracePeriod: gracePeriod},
+	}
+	processCtx := process.NewProcessContext()
+	drainer := newTransferDrainer(cfg, processCtx)
+	processCtx.ComponentStarted()
+	go drainer.run(processCtx)
+	return cfg, processCtx, drainer
+}
+
+// serveTransfer serves a tracked request in the background, which runs until
+// its context is done or release is closed. It returns whether its context was
+// done.
+func serveTransfer(processCtx *process.ProcessContext, drainer *transferDrainer, started, release chan struct{}) <-chan bool {
+	result := make(chan bool, 1)
+	handler := drainer.track(http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+		close(started)
+		select {
+		case <-req.Context().Done():
+			result <- true
+		case <-release:
+			result <- false
+		}
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/download", nil).WithContext(processCtx.Context())
+	go handler.ServeHTTP(httptest.NewRecorder(), req)
+	return result
+}
+
+func TestTransferDrainerFinishes(t *testing.T) {
+	_, processCtx, drainer := startDrainer(t, time.Minute)
+	assert.Nil(t, drainer.refuseUpload())
+
+	started, release := make(chan struct{}), make(chan struct{})
+	result := serveTransfer(processCtx, drainer, started, release)
+	<-started
+
+	processCtx.ShutdownDendrite()
+	// New uploads are refused, but the transfer in progress isn't cut off.
+	r := drainer.refuseUpload()
+	assert.NotNil(t, r)
+	assert.Equal(t, http.StatusServiceUnavailable, r.Code)
+	exited := make(chan struct{})
+	go func() {
+		processCtx.WaitForComponentsToFinish()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+		t.Fatal("exited before the transfer finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	assert.False(t, <-result)
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatal("didn't exit once the transfer finished")
+	}
+}
+
+func TestTransferDrainerAborts(t *testing.T) {
+	cfg, processCtx, drainer := startDrainer(t, 50*time.Millisecond)
+	tmpDir := filepath.Join(string(cfg.TempDir()), "upload")
+	assert.NoError(t, os.MkdirAll(tmpDir, 0770))
+
+	started := make(chan struct{})
+	result := serveTransfer(processCtx, drainer, started, make(chan struct{}))
+	<-started
+
+	processCtx.ShutdownDendrite()
+	// The transfer is aborted once the grace period has passed, and the
+	// temporary files left behind are removed.
+	assert.True(t, <-result)
+	processCtx.WaitForComponentsToFinish()
+	_, err := os.Stat(tmpDir)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,506 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/mediaapi/types/mxc"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// How long the archive of a data export can be downloaded for once it has been
+// assembled. Archives are kept in the temporary directory, where the media
+// garbage collector would remove them after this anyway.
+const takeoutArchiveMaxAge = mediaGCMinAge
+
+// How many of the media of the user to list in one go.
+const takeoutMediaBatchSize = 100
+
+type takeoutState string
+
+const (
+	takeoutRunning  takeoutState = "running"
+	takeoutComplete takeoutState = "complete"
+	takeoutFailed   takeoutState = "failed"
+)
+
+// takeoutStatus is the response to the endpoints that start data exports and
+// report their progress.
+type takeoutStatus struct {
+	ExportID string       `json:"export_id"`
+	UserID   string       `json:"user_id"`
+	State    takeoutState `json:"state"`
+	// The number of parts of the export, i.e. the data of the account and each
+	// media file, that are done and that there are in total. The total is 0
+	// until it is known.
+	CompletedSteps int `json:"completed_steps"`
+	TotalSteps     int `json:"total_steps"`
+	// When the archive will be removed, once the export is complete
+	ExpiresTS spec.Timestamp `json:"expires_ts,omitempty"`
+}
+
+// takeoutExport is a data export that is being, or has been, assembled.
+type takeoutExport struct {
+	mutex   sync.Mutex
+	status  takeoutStatus
+	archive string // the path of the archive, once the export is complete
+}
+
+func (e *takeoutExport) currentStatus() takeoutStatus {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.status
+}
+
+func (e *takeoutExport) setTotalSteps(total int) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.status.TotalSteps = total
+}
+
+func (e *takeoutExport) completeStep() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.status.CompletedSteps++
+}
+
+// takeouts assembles archives of the data of local users, for data portability
+// requests. Exports only live in memory, so they are lost if the server restarts.
+type takeouts struct {
+	cfg        *config.MediaAPI
+	db         storage.Database
+	userAPI    userapi.MediaUserAPI
+	encryption *fileutils.Encryption
+
+	mutex   sync.Mutex
+	exports map[string]*takeoutExport // export ID -> export
+}
+
+func newTakeouts(
+	cfg *config.MediaAPI, db storage.Database, userAPI userapi.MediaUserAPI,
+	encryption *fileutils.Encryption,
+) *takeouts {
+	return &takeouts{
+		cfg:        cfg,
+		db:         db,
+		userAPI:    userAPI,
+		encryption: encryption,
+		exports:    map[string]*takeoutExport{},
+	}
+}
+
+// start starts assembling an archive of the data of the user in the background.
+// If an export is already running for the user, it is returned instead.
+func (t *takeouts) start(userID string) (takeoutStatus, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, export := range t.exports {
+		if status := export.currentStatus(); status.UserID == userID && status.State == takeoutRunning {
+			return status, nil
+		}
+	}
+	exportIDBytes := make([]byte, 16)
+	if _, err := rand.Read(exportIDBytes); err != nil {
+		return takeoutStatus{}, fmt.Errorf("rand.Read: %w", err)
+	}
+	export := &takeoutExport{
+		status: takeoutStatus{
+			ExportID: hex.EncodeToString(exportIDBytes),
+			UserID:   userID,
+			State:    takeoutRunning,
+		},
+	}
+	t.exports[export.status.ExportID] = export
+	go t.run(export)
+	return export.status, nil
+}
+
+// discard removes the exports of the user and their archives. It returns false,
+// without removing anything, if an export is still running for the user.
+func (t *takeouts) discard(userID string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var discarded []*takeoutExport
+	for _, export := range t.exports {
+		if status := export.currentStatus(); status.UserID == userID {
+			if status.State == takeoutRunning {
+				return false
+			}
+			discarded = append(discarded, export)
+		}
+	}
+	for _, export := range discarded {
+		delete(t.exports, export.status.ExportID)
+		export.mutex.Lock()
+		archive := export.archive
+		export.mutex.Unlock()
+		if archive != "" {
+			fileutils.RemoveDir(types.Path(filepath.Dir(archive)), log.WithField("user_id", userID))
+		}
+	}
+	return true
+}
+
+// get returns the export with the ID if it is of the user, or nil.
+func (t *takeouts) get(exportID, userID string) *takeoutExport {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	export, ok := t.exports[exportID]
+	if !ok || export.currentStatus().UserID != userID {
+		return nil
+	}
+	return export
+}
+
+// run assembles the archive of an export and then removes the export once the
+// archive has expired.
+func (t *takeouts) run(export *takeoutExport) {
+	status := export.currentStatus()
+	logger := log.WithFields(log.Fields{
+		"export_id": status.ExportID,
+		"user_id":   status.UserID,
+	})
+	var dir string
+	err := os.MkdirAll(string(t.cfg.TempDir()), 0770)
+	if err == nil {
+		dir, err = os.MkdirTemp(string(t.cfg.TempDir()), "takeout-")
+	}
+	if err == nil {
+		archive := filepath.Join(dir, "takeout.zip")
+		if err = t.assemble(context.Background(), export, archive, logger); err == nil {
+			export.mutex.Lock()
+			export.archive = archive
+			export.mutex.Unlock()
+		}
+	}
+
+	export.mutex.Lock()
+	if err != nil {
+		logger.WithError(err).Error("Failed to export user data")
+		export.status.State = takeoutFailed
+	} else {
+		logger.Info("Exported user data")
+		export.status.State = takeoutComplete
+	}
+	export.status.ExpiresTS = spec.AsTimestamp(time.Now().Add(takeoutArchiveMaxAge))
+	export.mutex.Unlock()
+
+	time.AfterFunc(takeoutArchiveMaxAge, func() {
+		t.mutex.Lock()
+		delete(t.exports, status.ExportID)
+		t.mutex.Unlock()
+		if dir != "" {
+			fileutils.RemoveDir(types.Path(dir), logger)
+		}
+	})
+}
+
+// assemble writes a zip archive of the data of the account of the user, which
+// the user API collects, and the media they uploaded.
+func (t *takeouts) assemble(ctx context.Context, export *takeoutExport, archive string, logger *log.Entry) error {
+	userID := export.currentStatus().UserID
+
+	// Find out how much there is to export first, so that progress can be reported.
+	var media []*types.MediaMetadata
+	for {
+		page, err := t.db.GetUserMedia(ctx, types.MatrixUserID(userID), t.cfg.Matrix.ServerName, takeoutMediaBatchSize, len(media))
+		if err != nil {
+			return fmt.Errorf("t.db.GetUserMedia: %w", err)
+		}
+		media = append(media, page...)
+		if len(page) < takeoutMediaBatchSize {
+			break
+		}
+	}
+	export.setTotalSteps(1 + len(media))
+
+	file, err := os.Create(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close() // nolint: errcheck
+	w := zip.NewWriter(file)
+
+	var userData userapi.QueryUserDataExportResponse
+	if err = t.userAPI.QueryUserDataExport(ctx, &userapi.QueryUserDataExportRequest{UserID: userID}, &userData); err != nil {
+		return fmt.Errorf("t.userAPI.QueryUserDataExport: %w", err)
+	}
+	if err = writeTakeoutJSON(w, "profile.json", userData.Profile); err != nil {
+		return err
+	}
+	if err = writeTakeoutJSON(w, "account_data.json", userData.AccountData); err != nil {
+		return err
+	}
+	if err = writeTakeoutJSON(w, "devices.json", userData.Devices); err != nil {
+		return err
+	}
+	for i, room := range userData.Rooms {
+		if err = writeTakeoutJSON(w, fmt.Sprintf("rooms/%d.json", i), room); err != nil {
+			return err
+		}
+	}
+	export.completeStep()
+
+	index := make([]userMedia, 0, len(media))
+	for _, mediaMetadata := range media {
+		index = append(index, userMedia{
+			MediaID:       mediaMetadata.MediaID,
+			ContentURI:    mxc.URI{ServerName: mediaMetadata.Origin, MediaID: mediaMetadata.MediaID}.String(),
+			ContentType:   mediaMetadata.ContentType,
+			FileSizeBytes: mediaMetadata.FileSizeBytes,
+			UploadName:    mediaMetadata.UploadName,
+			CreatedTS:     mediaMetadata.CreationTimestamp,
+			LastAccessTS:  mediaMetadata.LastAccessTimestamp,
+		})
+	}
+	if err = writeTakeoutJSON(w, "media.json", index); err != nil {
+		return err
+	}
+	for _, mediaMetadata := range media {
+		if err = t.writeMedia(w, mediaMetadata, logger); err != nil {
+			return err
+		}
+		export.completeStep()
+	}
+
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// writeMedia adds the content of a media file to the archive, decrypted and
+// decompressed. Files that are missing from the media store are skipped.
+func (t *takeouts) writeMedia(w *zip.Writer, mediaMetadata *types.MediaMetadata, logger *log.Entry) error {
+	filePath, err := fileutils.GetPathFromBase64Hash(mediaMetadata.Base64Hash, t.cfg.AbsBasePath, t.cfg.StoreLayout)
+	if err != nil {
+		return fmt.Errorf("fileutils.GetPathFromBase64Hash: %w", err)
+	}
+	file, err := fileutils.OpenStoredFile(filePath, t.encryption)
+	if errors.Is(err, os.ErrNotExist) {
+		logger.WithField("media_id", mediaMetadata.MediaID).Warn("Media file is missing, leaving it out of the export")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("fileutils.OpenStoredFile: %w", err)
+	}
+	defer file.Close() // nolint: errcheck
+	out, err := w.Create("media/" + string(mediaMetadata.MediaID))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, file)
+	return err
+}
+
+func writeTakeoutJSON(w *zip.Writer, name string, v interface{}) error {
+	out, err := w.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// serveArchive sends the archive of the export, which must be complete.
+func (t *takeouts) serveArchive(w http.ResponseWriter, req *http.Request, exportID, userID string) {
+	export := t.get(exportID, userID)
+	if export == nil {
+		writeTakeoutError(w, util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("Export not found."),
+		})
+		return
+	}
+	export.mutex.Lock()
+	archive := export.archive
+	export.mutex.Unlock()
+	if archive == "" {
+		writeTakeoutError(w, util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("The export is not complete."),
+		})
+		return
+	}
+	file, err := os.Open(archive)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to open export archive")
+		writeTakeoutError(w, util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("The export has expired."),
+		})
+		return
+	}
+	defer file.Close() // nolint: errcheck
+	stat, err := file.Stat()
+	if err != nil {
+		writeTakeoutError(w, util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="takeout.zip"`)
+	http.ServeContent(w, req, "takeout.zip", stat.ModTime(), file)
+}
+
+func writeTakeoutError(w http.ResponseWriter, res util.JSONResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.Code)
+	_ = json.NewEncoder(w).Encode(res.JSON)
+}
+
+// Takeout implements POST /_matrix/media/unstable/org.matrix.dendrite/takeout.
+// It starts exporting the data of the user, whose progress can then be followed
+// with TakeoutStatus.
+func Takeout(t *takeouts, device *userapi.Device) util.JSONResponse {
+	return startTakeout(t, device.UserID)
+}
+
+// TakeoutStatus implements GET /_matrix/media/unstable/org.matrix.dendrite/takeout/{exportID}.
+func TakeoutStatus(req *http.Request, t *takeouts, device *userapi.Device) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	return takeoutStatusResponse(t, vars["exportID"], device.UserID)
+}
+
+// AdminTakeout implements POST /_dendrite/admin/takeout/{userID}. It starts
+// exporting the data of a local user, like Takeout.
+func AdminTakeout(req *http.Request, cfg *config.MediaAPI, t *takeouts) util.JSONResponse {
+	userID, resErr := adminLocalUserID(req, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	var res userapi.QueryDevicesResponse
+	if err := t.userAPI.QueryDevices(req.Context(), &userapi.QueryDevicesRequest{UserID: string(userID)}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to query user")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if !res.UserExists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("User not found."),
+		}
+	}
+	return startTakeout(t, string(userID))
+}
+
+// AdminTakeoutStatus implements GET /_dendrite/admin/takeout/{userID}/{exportID}.
+func AdminTakeoutStatus(req *http.Request, cfg *config.MediaAPI, t *takeouts) util.JSONResponse {
+	userID, resErr := adminLocalUserID(req, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	return takeoutStatusResponse(t, vars["exportID"], string(userID))
+}
+
+func startTakeout(t *takeouts, userID string) util.JSONResponse {
+	status, err := t.start(userID)
+	if err != nil {
+		log.WithError(err).WithField("user_id", userID).Error("Failed to start export")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusAccepted,
+		JSON: status,
+	}
+}
+
+func takeoutStatusResponse(t *takeouts, exportID, userID string) util.JSONResponse {
+	export := t.get(exportID, userID)
+	if export == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("Export not found."),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: export.currentStatus(),
+	}
+}
+
+// makeTakeoutArchiveAPI serves the archives of exports to the users they are of,
+// or to admins for the user in the path if admin is set. The archives aren't JSON,
+// so the request is authenticated here rather than with httputil.MakeAuthAPI.
+func makeTakeoutArchiveAPI(t *takeouts, userAPI userapi.QueryAcccessTokenAPI, admin bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		req = util.RequestWithLogging(req)
+		util.SetCORSHeaders(w)
+		if req.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		device, resErr := auth.VerifyUserFromRequest(req, userAPI)
+		if resErr != nil {
+			writeTakeoutError(w, *resErr)
+			return
+		}
+		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			writeTakeoutError(w, util.ErrorResponse(err))
+			return
+		}
+		userID := device.UserID
+		if admin {
+			if device.AccountType != userapi.AccountTypeAdmin {
+				writeTakeoutError(w, util.JSONResponse{
+					Code: http.StatusForbidden,
+					JSON: spec.Forbidden("This API can only be used by admin users."),
+				})
+				return
+			}
+			userID = vars["userID"]
+		}
+		t.serveArchive(w, req, vars["exportID"], userID)
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/stretchr/testify/assert"
+)
+
+type takeoutUserAPI struct {
+	userapi.MediaUserAPI
+	devices  map[string]*userapi.Device // access token -> device
+	userData map[string]userapi.QueryUserDataExportResponse
+	// If set, exports wait for it to be closed before collecting the data of the account
+	block chan struct{}
+}
+
+func (u *takeoutUserAPI) QueryAccessToken(ctx context.Context, req *userapi.QueryAccessTokenRequest, res *userapi.QueryAccessTokenResponse) error {
+	res.Device = u.devices[req.AccessToken]
+	return nil
+}
+
+func (u *takeoutUserAPI) QueryDevices(ctx context.Context, req *userapi.QueryDevicesRequest, res *userapi.QueryDevicesResponse) error {
+	_, res.UserExists = u.userData[req.UserID]
+	return nil
+}
+
+func (u *takeoutUserAPI) QueryUserDataExport(ctx context.Context, req *userapi.QueryUserDataExportRequest, res *userapi.QueryUserDataExportResponse) error {
+	if u.block != nil {
+		<-u.block
+	}
+	userData, ok := u.userData[req.UserID]
+	if !ok {
+		return errors.New("no such user")
+	}
+	*res = userData
+	return nil
+}
+
+func TestTakeout(t *testing.T) {
+	cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
+	db, err := storage.NewMediaAPIDatasource(cm, &config.DatabaseOptions{
+		ConnectionString:       "file::memory:",
+		MaxOpenConnections:     1,
+		MaxIdleConnections:     1,
+		ConnMaxLifetimeSeconds: -1,
+	})
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	cfg := &config.MediaAPI{
+		Matrix:      &config.Global{},
+		AbsBasePath: config.Path(t.TempDir()),
+	}
+	cfg.Matrix.ServerName = "localhost"
+	const alice, bob = types.MatrixUserID("@alice:localhost"), types.MatrixUserID("@bob:localhost")
+	storeMedia := func(metadata *types.MediaMetadata, content []byte) {
+		assert.NoError(t, db.StoreMediaMetadata(ctx, metadata))
+		if content == nil {
+			return
+		}
+		path, err := fileutils.GetPathFromBase64Hash(metadata.Base64Hash, cfg.AbsBasePath, cfg.StoreLayout)
+		assert.NoError(t, err)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0770))
+		assert.NoError(t, os.WriteFile(path, content, 0660))
+	}
+	storeMedia(&types.MediaMetadata{MediaID: "alice1", Origin: "localhost", FileSizeBytes: 5, Base64Hash: "alicehash1", UserID: alice}, []byte("hello"))
+	// The file of this one has gone missing, so it is left out of the archive.
+	storeMedia(&types.MediaMetadata{MediaID: "alice2", Origin: "localhost", FileSizeBytes: 5, Base64Hash: "alicehash2", UserID: alice}, nil)
+	storeMedia(&types.MediaMetadata{MediaID: "bob1", Origin: "localhost", FileSizeBytes: 3, Base64Hash: "bobhash1", UserID: bob}, []byte("bob"))
+
+	aliceDevice := &userapi.Device{ID: "ALICE", UserID: string(alice), AccountType: userapi.AccountTypeUser}
+	bobDevice := &userapi.Device{ID: "BOB", UserID: string(bob), AccountType: userapi.AccountTypeUser}
+	adminDevice := &userapi.Device{ID: "ADMIN", UserID: "@admin:localhost", AccountType: userapi.AccountTypeAdmin}
+	userAPI := &takeoutUserAPI{
+		devices: map[string]*userapi.Device{
+			"alice_token": aliceDevice,
+			"bob_token":   bobDevice,
+			"admin_token": adminDevice,
+		},
+		userData: map[string]userapi.QueryUserDataExportResponse{
+			string(alice): {
+				Profile:     userapi.UserDataExportProfile{UserID: string(alice), DisplayName: "Alice"},
+				AccountData: map[string]json.RawMessage{"m.direct": json.RawMessage(`{}`)},
+				Devices:     []userapi.UserDataExportDevice{{DeviceID: "ALICE"}},
+				Rooms: []userapi.UserDataExportRoom{{
+					RoomID: "!room:localhost",
+					Events: []json.RawMessage{json.RawMessage(`{"type":"m.room.message"}`)},
+				}},
+			},
+		},
+		block: make(chan struct{}),
+	}
+	takeouts := newTakeouts(cfg, db, userAPI, nil)
+
+	statusOf := func(res interface{}) takeoutStatus {
+		status, ok := res.(takeoutStatus)
+		assert.True(t, ok, "response is %T, not a takeoutStatus", res)
+		return status
+	}
+	getStatus := func(exportID string, device *userapi.Device) (int, takeoutStatus) {
+		req := httptest.NewRequest(http.MethodGet, "/takeout/"+exportID, nil)
+		req = mux.SetURLVars(req, map[string]string{"exportID": exportID})
+		res := TakeoutStatus(req, takeouts, device)
+		if res.Code != http.StatusOK {
+			return res.Code, takeoutStatus{}
+		}
+		return res.Code, statusOf(res.JSON)
+	}
+	waitForExport := func(exportID string, userID types.MatrixUserID) takeoutStatus {
+		deadline := time.Now().Add(time.Second * 5)
+		for time.Now().Before(deadline) {
+			export := takeouts.get(exportID, string(userID))
+			if !assert.NotNil(t, export) {
+				break
+			}
+			if status := export.currentStatus(); status.State != takeoutRunning {
+				return status
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		t.Fatal("timed out waiting for the export")
+		return takeoutStatus{}
+	}
+	download := func(exportID, token string, admin bool, userID types.MatrixUserID) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/takeout/"+exportID+"/archive", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		req = mux.SetURLVars(req, map[string]string{"exportID": exportID, "userID": string(userID)})
+		rec := httptest.NewRecorder()
+		makeTakeoutArchiveAPI(takeouts, userAPI, admin).ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Starting an export while one is running returns the running one.
+	res := Takeout(takeouts, aliceDevice)
+	assert.Equal(t, http.StatusAccepted, res.Code)
+	status := statusOf(res.JSON)
+	assert.Equal(t, takeoutRunning, status.State)
+	res = Takeout(takeouts, aliceDevice)
+	assert.Equal(t, status.ExportID, statusOf(res.JSON).ExportID)
+	assert.False(t, takeouts.discard(string(alice)))
+
+	// The archive can't be downloaded until the export is complete.
+	assert.Equal(t, http.StatusNotFound, download(status.ExportID, "alice_token", false, "").Code)
+
+	close(userAPI.block)
+	status = waitForExport(status.ExportID, alice)
+	assert.Equal(t, takeoutComplete, status.State)
+	assert.Equal(t, 3, status.TotalSteps)
+	assert.Equal(t, 3, status.CompletedSteps)
+	code, got := getStatus(status.ExportID, aliceDevice)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, status, got)
+
+	t.Run("archive contents", func(t *testing.T) {
+		rec := download(status.ExportID, "alice_token", false, "")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "application/zip", rec.Header().Get("Content-Type"))
+		body := rec.Body.Bytes()
+		archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+		assert.NoError(t, err)
+		var names []string
+		files := map[string]string{}
+		for _, file := range archive.File {
+			names = append(names, file.Name)
+			r, err := file.Open()
+			assert.NoError(t, err)
+			content, err := io.ReadAll(r)
+			assert.NoError(t, err)
+			files[file.Name] = string(content)
+		}
+		assert.ElementsMatch(t, []string{
+			"profile.json", "account_data.json", "devices.json", "rooms/0.json", "media.json", "media/alice1",
+		}, names)
+		assert.JSONEq(t, `{"user_id":"@alice:localhost","displayname":"Alice"}`, files["profile.json"])
+		assert.JSONEq(t, `{"m.direct":{}}`, files["account_data.json"])
+		assert.JSONEq(t, `[{"device_id":"ALICE"}]`, files["devices.json"])
+		assert.JSONEq(t, `{"room_id":"!room:localhost","account_data":null,"events":[{"type":"m.room.message"}]}`, files["rooms/0.json"])
+		assert.Equal(t, "hello", files["media/alice1"])
+		var index []userMedia
+		assert.NoError(t, json.Unmarshal([]byte(files["media.json"]), &index))
+		if assert.Len(t, index, 2) {
+			assert.ElementsMatch(t, []types.MediaID{"alice1", "alice2"}, []types.MediaID{index[0].MediaID, index[1].MediaID})
+		}
+	})
+
+	t.Run("access checks", func(t *testing.T) {
+		// Only the user the export is of can see it.
+		code, _ := getStatus(status.ExportID, bobDevice)
+		assert.Equal(t, http.StatusNotFound, code)
+		assert.Equal(t, http.StatusNotFound, download(status.ExportID, "bob_token", false, "").Code)
+		assert.Equal(t, http.StatusUnauthorized, download(status.ExportID, "", false, "").Code)
+		assert.Equal(t, http.StatusUnauthorized, download(status.ExportID, "unknown_token", false, "").Code)
+
+		// Admins can download the export of any user, but other users can't use the admin endpoint.
+		assert.Equal(t, http.StatusForbidden, download(status.ExportID, "bob_token", true, alice).Code)
+		assert.Equal(t, http.StatusOK, download(status.ExportID, "admin_token", true, alice).Code)
+		assert.Equal(t, http.StatusNotFound, download(status.ExportID, "admin_token", true, bob).Code)
+
+		req := httptest.NewRequest(http.MethodGet, "/admin/takeout/@alice:localhost/"+status.ExportID, nil)
+		req = mux.SetURLVars(req, map[string]string{"userID": string(alice), "exportID": status.ExportID})
+		res := AdminTakeoutStatus(req, cfg, takeouts)
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, status, statusOf(res.JSON))
+
+		// Remote users don't have exports here.
+		req = httptest.NewRequest(http.MethodPost, "/admin/takeout/@alice:remote", nil)
+		req = mux.SetURLVars(req, map[string]string{"userID": "@alice:remote"})
+		assert.Equal(t, http.StatusBadRequest, AdminTakeout(req, cfg, takeouts).Code)
+	})
+
+	t.Run("failed export", func(t *testing.T) {
+		// The user API has no data for carol.
+		res := Takeout(takeouts, &userapi.Device{UserID: "@carol:localhost"})
+		assert.Equal(t, http.StatusAccepted, res.Code)
+		carolStatus := waitForExport(statusOf(res.JSON).ExportID, "@carol:localhost")
+		assert.Equal(t, takeoutFailed, carolStatus.State)
+		assert.NotZero(t, carolStatus.ExpiresTS)
+		assert.Empty(t, takeouts.get(carolStatus.ExportID, "@carol:localhost").archive)
+
+		// Admins can only start exports of users that exist.
+		req := httptest.NewRequest(http.MethodPost, "/admin/takeout/@carol:localhost", nil)
+		req = mux.SetURLVars(req, map[string]string{"userID": "@carol:localhost"})
+		assert.Equal(t, http.StatusNotFound, AdminTakeout(req, cfg, takeouts).Code)
+	})
+
+	t.Run("discarded export", func(t *testing.T) {
+		assert.True(t, takeouts.discard(string(alice)))
+		code, _ := getStatus(status.ExportID, aliceDevice)
+		assert.Equal(t, http.StatusNotFound, code)
+		assert.Equal(t, http.StatusNotFound, download(status.ExportID, "alice_token", false, "").Code)
+	})
+}
@@ -17,19 +17,23 @@ package routing
 import (
 	"context"
 	"crypto/rand"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/url"
-	"os"
 	"path"
 	"strings"
 
+	"github.com/matrix-org/dendrite/internal/spamcheck"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/mediaapi/fileutils"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/thumbnailer"
 	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/mediaapi/types/mxc"
 	"github.com/matrix-org/dendrite/setup/config"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -44,6 +48,18 @@ import (
 type uploadRequest struct {
 	MediaMetadata *types.MediaMetadata
 	Logger        *log.Entry
+	// Files with blocked hashes are refused, nil if there is no blocklist.
+	Blocklist fileutils.HashBlocklist
+	// Encrypts files in the media store, nil if there is no master key.
+	Encryption *fileutils.Encryption
+	// Compresses files of compressible content types, nil if files aren't compressed.
+	Compression *fileutils.Compression
+	// Fsyncs files when they are moved into the media store.
+	Fsync bool
+	// Asked whether the file may be stored, nil if there are no spam checkers.
+	SpamCheckers *spamcheck.SpamCheckers
+	// Tracks the progress of the upload while it is received, nil if it isn't tracked.
+	Uploads *activeUploads
 }
 
 // uploadResponse defines the format of the JSON response
@@ -57,28 +73,53 @@ type uploadResponse struct {
 // This implementation supports a configurable maximum file size limit in bytes. If a user tries to upload more than this, they will receive an error that their upload is too large.
 // Uploaded files are processed piece-wise to avoid DoS attacks which would starve the server of memory.
 // TODO: We should time out requests if they have not received any data within a configured timeout period.
-func Upload(req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database, activeThumbnailGeneration *types.ActiveThumbnailGeneration) util.JSONResponse {
-	r, resErr := parseAndValidateRequest(req, cfg, dev)
+func Upload(req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database, activeThumbnailGeneration *types.ActiveThumbnailGeneration, blocklist fileutils.HashBlocklist, encryption *fileutils.Encryption, compression *fileutils.Compression, spamCheckers *spamcheck.SpamCheckers, uploads *activeUploads, auditLog *mediaAuditLog) util.JSONResponse {
+	maxFileSizeBytes, _, err := maxUploadSize(req.Context(), cfg, db, types.MatrixUserID(dev.UserID))
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to get maximum upload size")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	r, body, resErr := parseAndValidateRequest(req, cfg, dev, maxFileSizeBytes)
 	if resErr != nil {
 		return *resErr
 	}
+	r.Blocklist = blocklist
+	r.Encryption = encryption
+	r.Compression = compression
+	r.Fsync = cfg.Fsync
+	r.SpamCheckers = spamCheckers
+	r.Uploads = uploads
 
-	if resErr = r.doUpload(req.Context(), req.Body, cfg, db, activeThumbnailGeneration); resErr != nil {
+	if resErr = r.doUpload(req.Context(), body, cfg, db, maxFileSizeBytes, activeThumbnailGeneration); resErr != nil {
 		return *resErr
 	}
+	auditLog.record(req, &types.AuditLogEntry{
+		Action:     types.AuditUpload,
+		MediaID:    r.MediaMetadata.MediaID,
+		Origin:     r.MediaMetadata.Origin,
+		Base64Hash: r.MediaMetadata.Base64Hash,
+		UserID:     types.MatrixUserID(dev.UserID),
+	})
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: uploadResponse{
-			ContentURI: fmt.Sprintf("mxc://%s/%s", cfg.Matrix.ServerName, r.MediaMetadata.MediaID),
+			ContentURI: mxc.URI{ServerName: cfg.Matrix.ServerName, MediaID: r.MediaMetadata.MediaID}.String(),
 		},
 	}
 }
 
 // parseAndValidateRequest parses the incoming upload request to validate and extract
-// all the metadata about the media being uploaded.
+// all the metadata about the media being uploaded, and returns the reader of the file,
+// which is either the request body or the file part of a multipart/form-data request.
 // Returns either an uploadRequest or an error formatted as a util.JSONResponse
-func parseAndValidateRequest(req *http.Request, cfg *config.MediaAPI, dev *userapi.Device) (*uploadRequest, *util.JSONResponse) {
+func parseAndValidateRequest(
+	req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, maxFileSizeBytes config.FileSizeBytes,
+) (*uploadRequest, io.Reader, *util.JSONResponse) {
 	r := &uploadRequest{
 		MediaMetadata: &types.MediaMetadata{
 			Origin:        cfg.Matrix.ServerName,
@@ -90,38 +131,106 @@ func parseAndValidateRequest(req *http.Request, cfg *config.MediaAPI, dev *usera
 		Logger: util.GetLogger(req.Context()).WithField("Origin", cfg.Matrix.ServerName),
 	}
 
-	if resErr := r.Validate(cfg.MaxFileSizeBytes); resErr != nil {
-		return nil, resErr
+	var body io.Reader = req.Body
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		part, err := multipartUploadFile(req)
+		if err != nil {
+			return nil, nil, &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.Unknown("Failed to read the file from the multipart form: " + err.Error()),
+			}
+		}
+		body = part
+		// The size of the file isn't known until it has been read, as the form
+		// may have other parts.
+		r.MediaMetadata.FileSizeBytes = 0
+		r.MediaMetadata.ContentType = types.ContentType(part.Header.Get("Content-Type"))
+		if r.MediaMetadata.UploadName == "" {
+			r.MediaMetadata.UploadName = types.Filename(url.PathEscape(part.FileName()))
+		}
+	}
+
+	if resErr := r.Validate(maxFileSizeBytes); resErr != nil {
+		return nil, nil, resErr
 	}
 
-	return r, nil
+	return r, body, nil
 }
 
-func (r *uploadRequest) generateMediaID(ctx context.Context, db storage.Database) (types.MediaID, error) {
+// multipartUploadFile returns the part of a multipart/form-data upload with the
+// file, which is the part named "file", or else the first part with a filename.
+func multipartUploadFile(req *http.Request) (*multipart.Part, error) {
+	reader, err := req.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
 	for {
-		// First try generating a meda ID. We'll do this by
-		// generating some random bytes and then hex-encoding.
-		mediaIDBytes := make([]byte, 32)
-		_, err := rand.Read(mediaIDBytes)
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, errors.New("no file part")
+		}
 		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "file" || part.FileName() != "" {
+			return part, nil
+		}
+	}
+}
+
+// maxMediaIDAttempts is how many media IDs are generated for an upload before
+// giving up on finding one that isn't used yet, which only happens if media IDs
+// are far too short.
+const maxMediaIDAttempts = 10
+
+// randomMediaID returns a media ID of characters picked at random from the
+// alphabet, using a cryptographically secure source. The defaults are used if
+// the config doesn't set the length or alphabet.
+func randomMediaID(cfg *config.MediaIDGeneration) (types.MediaID, error) {
+	length, alphabet := cfg.Length, cfg.Alphabet
+	if length == 0 || alphabet == "" {
+		length, alphabet = config.DefaultMediaIDLength, config.DefaultMediaIDAlphabet
+	}
+	// Random bytes at or above the largest multiple of the alphabet size are
+	// skipped, so that every character is as likely as the others.
+	limit := 256 - 256%len(alphabet)
+	mediaID := make([]byte, 0, length)
+	buf := make([]byte, length)
+	for len(mediaID) < length {
+		if _, err := rand.Read(buf); err != nil {
 			return "", fmt.Errorf("rand.Read: %w", err)
 		}
-		mediaID := types.MediaID(hex.EncodeToString(mediaIDBytes))
-		// Then we will check if this media ID already exists in
-		// our database. If it does then we had best generate a
-		// new one.
+		for _, b := range buf {
+			if int(b) >= limit {
+				continue
+			}
+			mediaID = append(mediaID, alphabet[int(b)%len(alphabet)])
+			if len(mediaID) == length {
+				break
+			}
+		}
+	}
+	return types.MediaID(mediaID), nil
+}
+
+// generateMediaID returns a random media ID that isn't used yet.
+func (r *uploadRequest) generateMediaID(ctx context.Context, cfg *config.MediaIDGeneration, db storage.Database) (types.MediaID, error) {
+	for attempt := 0; attempt < maxMediaIDAttempts; attempt++ {
+		mediaID, err := randomMediaID(cfg)
+		if err != nil {
+			return "", err
+		}
+		// If the media ID already exists in our database then we had best
+		// generate a new one.
 		existingMetadata, err := db.GetMediaMetadata(ctx, mediaID, r.MediaMetadata.Origin)
 		if err != nil {
 			return "", fmt.Errorf("db.GetMediaMetadata: %w", err)
 		}
-		if existingMetadata != nil {
-			// The media ID was already used - repeat the process
-			// and generate a new one instead.
-			continue
+		if existingMetadata == nil {
+			return mediaID, nil
 		}
-		// The media ID was not already used - let's return that.
-		return mediaID, nil
 	}
+	return "", fmt.Errorf("no unused media ID found after %d attempts", maxMediaIDAttempts)
 }
 
 func (r *uploadRequest) doUpload(
@@ -129,6 +238,7 @@ func (r *uploadRequest) doUpload(
 	reqReader io.Reader,
 	cfg *config.MediaAPI,
 	db storage.Database,
+	maxFileSizeBytes config.FileSizeBytes,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 ) *util.JSONResponse {
 	r.Logger.WithFields(log.Fields{
@@ -140,7 +250,7 @@ func (r *uploadRequest) doUpload(
 	// The file data is hashed and the hash is used as the MediaID. The hash is useful as a
 	// method of deduplicating files to save storage, as well as a way to conduct
 	// integrity checks on the file data in the repository.
-	// Data is truncated to maxFileSizeBytes. Content-Length was reported as 0 < Content-Length <= maxFileSizeBytes so this is OK.
+	// Files larger than maxFileSizeBytes are rejected, whatever their Content-Length was reported as.
 	//
 	// TODO: This has a bad API shape where you either need to call:
 	//   fileutils.RemoveDir(tmpDir, r.Logger)
@@ -148,31 +258,68 @@ func (r *uploadRequest) doUpload(
 	//   r.storeFileAndMetadata(ctx, tmpDir, ...)
 	// before you return from doUpload else we will leak a temp file. We could make this nicer with a `WithTransaction` style of
 	// nested function to guarantee either storage or cleanup.
-	if cfg.MaxFileSizeBytes > 0 {
-		if cfg.MaxFileSizeBytes+1 <= 0 {
-			r.Logger.WithFields(log.Fields{
-				"MaxFileSizeBytes": cfg.MaxFileSizeBytes,
-			}).Warnf("Configured MaxFileSizeBytes overflows int64, defaulting to %d bytes", config.DefaultMaxFileSizeBytes)
-			cfg.MaxFileSizeBytes = config.DefaultMaxFileSizeBytes
-		}
-		reqReader = io.LimitReader(reqReader, int64(cfg.MaxFileSizeBytes)+1)
+	if maxFileSizeBytes > 0 && maxFileSizeBytes+1 <= 0 {
+		r.Logger.WithFields(log.Fields{
+			"MaxFileSizeBytes": maxFileSizeBytes,
+		}).Warnf("Configured MaxFileSizeBytes overflows int64, defaulting to %d bytes", config.DefaultMaxFileSizeBytes)
+		maxFileSizeBytes = config.DefaultMaxFileSizeBytes
 	}
 
-	hash, bytesWritten, tmpDir, err := fileutils.WriteTempFile(ctx, reqReader, cfg.AbsBasePath)
+	if r.Uploads != nil {
+		progress := r.Uploads.start(r.MediaMetadata)
+		defer r.Uploads.finish(progress)
+		reqReader = progress.reader(reqReader)
+	}
+
+	hash, bytesWritten, tmpDir, secondaryHashes, err := fileutils.WriteTempFileWithHashes(
+		ctx, reqReader, maxFileSizeBytes, cfg.TempDir(), r.Blocklist, r.Encryption, cfg.SecondaryHashes,
+	)
+	if errors.Is(err, fileutils.ErrHashBlocked) {
+		r.Logger.WithField("Base64Hash", hash).Warn("Rejected upload of blocked file")
+		return fileErrorJSONResponse(err)
+	}
 	if err != nil {
 		r.Logger.WithError(err).WithFields(log.Fields{
-			"MaxFileSizeBytes": cfg.MaxFileSizeBytes,
+			"MaxFileSizeBytes": maxFileSizeBytes,
 		}).Warn("Error while transferring file")
+		return fileErrorJSONResponse(err)
+	}
+
+	// Don't allow quarantined files to be uploaded again.
+	quarantined, err := db.IsHashQuarantined(ctx, hash)
+	if err != nil {
+		fileutils.RemoveDir(tmpDir, r.Logger)
+		r.Logger.WithError(err).Error("Error checking whether the hash is quarantined.")
 		return &util.JSONResponse{
-			Code: http.StatusBadRequest,
-			JSON: spec.Unknown("Failed to upload"),
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if quarantined {
+		fileutils.RemoveDir(tmpDir, r.Logger)
+		r.Logger.WithField("Base64Hash", hash).Warn("Rejected upload of quarantined file")
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden("This file has been blocked by the server administrator"),
 		}
 	}
 
-	// Check if temp file size exceeds max file size configuration
-	if cfg.MaxFileSizeBytes > 0 && bytesWritten > types.FileSizeBytes(cfg.MaxFileSizeBytes) {
+	if err = r.SpamCheckers.CheckMediaForSpam(ctx, &spamcheck.Media{
+		UserID:        string(r.MediaMetadata.UserID),
+		ContentType:   string(r.MediaMetadata.ContentType),
+		UploadName:    string(r.MediaMetadata.UploadName),
+		FileSizeBytes: int64(bytesWritten),
+		Base64Hash:    string(hash),
+	}); err != nil {
+		fileutils.RemoveDir(tmpDir, r.Logger)
+		resErr := spamcheck.ErrorResponse(ctx, err)
+		return &resErr
+	}
+
+	// Check that the upload doesn't take the user over their upload quota
+	if resErr := r.checkUploadQuota(ctx, cfg, db, bytesWritten); resErr != nil {
 		fileutils.RemoveDir(tmpDir, r.Logger) // delete temp file
-		return requestEntityTooLargeJSONResponse(cfg.MaxFileSizeBytes)
+		return resErr
 	}
 
 	// Look up the media by the file hash. If we already have the file but under a
@@ -193,7 +340,7 @@ func (r *uploadRequest) doUpload(
 		// The file already exists, delete the uploaded temporary file.
 		defer fileutils.RemoveDir(tmpDir, r.Logger)
 		// The file already exists. Make a new media ID up for it.
-		mediaID, merr := r.generateMediaID(ctx, db)
+		mediaID, merr := r.generateMediaID(ctx, &cfg.MediaIDs, db)
 		if merr != nil {
 			r.Logger.WithError(merr).Error("Failed to generate media ID for existing file")
 			return &util.JSONResponse{
@@ -207,17 +354,19 @@ func (r *uploadRequest) doUpload(
 			MediaID:           mediaID,
 			Origin:            r.MediaMetadata.Origin,
 			ContentType:       r.MediaMetadata.ContentType,
-			FileSizeBytes:     r.MediaMetadata.FileSizeBytes,
+			FileSizeBytes:     bytesWritten,
 			CreationTimestamp: r.MediaMetadata.CreationTimestamp,
 			UploadName:        r.MediaMetadata.UploadName,
 			Base64Hash:        hash,
+			SecondaryHashes:   secondaryHashes,
 			UserID:            r.MediaMetadata.UserID,
 		}
 	} else {
 		// The file doesn't exist. Update the request metadata.
 		r.MediaMetadata.FileSizeBytes = bytesWritten
 		r.MediaMetadata.Base64Hash = hash
-		r.MediaMetadata.MediaID, err = r.generateMediaID(ctx, db)
+		r.MediaMetadata.SecondaryHashes = secondaryHashes
+		r.MediaMetadata.MediaID, err = r.generateMediaID(ctx, &cfg.MediaIDs, db)
 		if err != nil {
 			fileutils.RemoveDir(tmpDir, r.Logger)
 			r.Logger.WithError(err).Error("Failed to generate media ID for new upload")
@@ -237,15 +386,51 @@ func (r *uploadRequest) doUpload(
 	}).Info("File uploaded")
 
 	return r.storeFileAndMetadata(
-		ctx, tmpDir, cfg.AbsBasePath, db, cfg.ThumbnailSizes,
+		ctx, tmpDir, cfg.AbsBasePath, cfg.StoreLayout, db, &cfg.MediaIDs, cfg.ThumbnailSizes,
 		activeThumbnailGeneration, cfg.MaxThumbnailGenerators,
 	)
 }
 
+// errorTooLarge is the error code of requests that are too large, which
+// gomatrixserverlib doesn't define.
+const errorTooLarge spec.MatrixErrorCode = "M_TOO_LARGE"
+
 func requestEntityTooLargeJSONResponse(maxFileSizeBytes config.FileSizeBytes) *util.JSONResponse {
 	return &util.JSONResponse{
 		Code: http.StatusRequestEntityTooLarge,
-		JSON: spec.Unknown(fmt.Sprintf("HTTP Content-Length is greater than the maximum allowed upload size (%v).", maxFileSizeBytes)),
+		JSON: spec.MatrixError{
+			ErrCode: errorTooLarge,
+			Err:     fmt.Sprintf("The file is larger than the maximum allowed size (%v bytes).", maxFileSizeBytes),
+		},
+	}
+}
+
+// fileErrorJSONResponse returns the response to an upload that failed with an
+// error from fileutils. Errors that are the server's fault are reported as
+// internal server errors, other errors as a failed upload.
+func fileErrorJSONResponse(err error) *util.JSONResponse {
+	var tooLarge *fileutils.FileTooLargeError
+	var invalidHash *fileutils.InvalidHashError
+	var pathEscape *fileutils.PathEscapeError
+	var hashCollision *fileutils.HashCollisionError
+	switch {
+	case errors.As(err, &tooLarge):
+		return requestEntityTooLargeJSONResponse(tooLarge.Limit)
+	case errors.Is(err, fileutils.ErrHashBlocked):
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden("This file has been blocked by the server administrator"),
+		}
+	case errors.As(err, &invalidHash), errors.As(err, &pathEscape), errors.As(err, &hashCollision):
+		return &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	default:
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.Unknown("Failed to upload"),
+		}
 	}
 }
 
@@ -286,24 +471,35 @@ func (r *uploadRequest) storeFileAndMetadata(
 	ctx context.Context,
 	tmpDir types.Path,
 	absBasePath config.Path,
+	layout config.MediaStoreLayout,
 	db storage.Database,
+	mediaIDs *config.MediaIDGeneration,
 	thumbnailSizes []config.ThumbnailSize,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 ) *util.JSONResponse {
-	finalPath, duplicate, err := fileutils.MoveFileWithHashCheck(tmpDir, r.MediaMetadata, absBasePath, r.Logger)
+	finalPath, duplicate, err := fileutils.MoveFileWithHashCheck(ctx, tmpDir, r.MediaMetadata, absBasePath, layout, r.Encryption, r.Compression, r.Fsync, r.Logger)
 	if err != nil {
 		r.Logger.WithError(err).Error("Failed to move file.")
-		return &util.JSONResponse{
-			Code: http.StatusBadRequest,
-			JSON: spec.Unknown("Failed to upload"),
-		}
+		return fileErrorJSONResponse(err)
 	}
 	if duplicate {
 		r.Logger.WithField("dst", finalPath).Info("File was stored previously - discarding duplicate")
 	}
 
-	if err = db.StoreMediaMetadata(ctx, r.MediaMetadata); err != nil {
+	for attempt := 1; ; attempt++ {
+		err = db.StoreMediaMetadata(ctx, r.MediaMetadata)
+		// The media ID was unused when it was generated, but another upload may
+		// have been given the same one since, in which case it gets a new one.
+		if err == nil || !sqlutil.IsUniqueConstraintViolationErr(err) || attempt >= maxMediaIDAttempts {
+			break
+		}
+		if r.MediaMetadata.MediaID, err = r.generateMediaID(ctx, mediaIDs, db); err != nil {
+			break
+		}
+		r.Logger = r.Logger.WithField("media_id", r.MediaMetadata.MediaID)
+	}
+	if err != nil {
 		r.Logger.WithError(err).Warn("Failed to store metadata")
 		// If the file is a duplicate (has the same hash as an existing file) then
 		// there is valid metadata in the database for that file. As such we only
@@ -318,7 +514,7 @@ func (r *uploadRequest) storeFileAndMetadata(
 	}
 
 	go func() {
-		file, err := os.Open(string(finalPath))
+		file, err := fileutils.OpenStoredFile(string(finalPath), r.Encryption)
 		if err != nil {
 			r.Logger.WithError(err).Error("unable to open file")
 			return
@@ -340,7 +536,7 @@ func (r *uploadRequest) storeFileAndMetadata(
 
 		busy, err := thumbnailer.GenerateThumbnails(
 			context.Background(), finalPath, thumbnailSizes, r.MediaMetadata,
-			activeThumbnailGeneration, maxThumbnailGenerators, db, r.Logger,
+			activeThumbnailGeneration, maxThumbnailGenerators, db, r.Encryption, r.Logger,
 		)
 		if err != nil {
 			r.Logger.WithError(err).Warn("Error generating thumbnails")
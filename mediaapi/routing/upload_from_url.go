@@ -0,0 +1,267 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/spamcheck"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/mediaapi/types/mxc"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+)
+
+type uploadFromURLRequest struct {
+	URL         string `json:"url"`
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// AdminUploadFromURL implements POST /_dendrite/admin/uploadFromURL, which
+// fetches a URL and stores the file as media uploaded by the admin or
+// application service, e.g. for bridges and bots migrating media.
+func AdminUploadFromURL(
+	req *http.Request,
+	cfg *config.MediaAPI,
+	dev *userapi.Device,
+	db storage.Database,
+	client *http.Client,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	blocklist fileutils.HashBlocklist,
+	encryption *fileutils.Encryption,
+	compression *fileutils.Compression,
+	spamCheckers *spamcheck.SpamCheckers,
+	uploads *activeUploads,
+	auditLog *mediaAuditLog,
+) util.JSONResponse {
+	if dev.AccountType != userapi.AccountTypeAdmin && dev.AccountType != userapi.AccountTypeAppService {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden("This API can only be used by admin users and application services."),
+		}
+	}
+
+	var body uploadFromURLRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("The request body could not be decoded into valid JSON: " + err.Error()),
+		}
+	}
+	fileURL, err := url.Parse(body.URL)
+	if err != nil || (fileURL.Scheme != "http" && fileURL.Scheme != "https") || fileURL.Host == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("url must be an absolute http or https URL"),
+		}
+	}
+
+	maxFileSizeBytes, _, err := maxUploadSize(req.Context(), cfg, db, types.MatrixUserID(dev.UserID))
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to get maximum upload size")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	logger := util.GetLogger(req.Context()).WithField("url", fileURL.Redacted())
+	fetchReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, fileURL.String(), nil)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("url must be an absolute http or https URL"),
+		}
+	}
+	res, err := client.Do(fetchReq)
+	if err != nil {
+		var denied *deniedAddressError
+		if errors.As(err, &denied) {
+			logger.WithError(err).Warn("Refused to fetch URL from a denied address")
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: spec.Forbidden("The URL resolves to an address that media may not be fetched from."),
+			}
+		}
+		logger.WithError(err).Warn("Failed to fetch URL")
+		return util.JSONResponse{
+			Code: http.StatusBadGateway,
+			JSON: spec.Unknown("Failed to fetch the URL."),
+		}
+	}
+	defer res.Body.Close() // nolint: errcheck
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		logger.WithField("status", res.StatusCode).Warn("Fetching URL failed")
+		return util.JSONResponse{
+			Code: http.StatusBadGateway,
+			JSON: spec.Unknown(fmt.Sprintf("Fetching the URL failed with status %d.", res.StatusCode)),
+		}
+	}
+
+	filename := body.Filename
+	if filename == "" {
+		if base := path.Base(fileURL.Path); base != "/" && base != "." {
+			filename = base
+		}
+	}
+	contentType := body.ContentType
+	if contentType == "" {
+		contentType = res.Header.Get("Content-Type")
+	}
+	var fileSizeBytes types.FileSizeBytes
+	if res.ContentLength > 0 {
+		fileSizeBytes = types.FileSizeBytes(res.ContentLength)
+	}
+	r := &uploadRequest{
+		MediaMetadata: &types.MediaMetadata{
+			Origin:        cfg.Matrix.ServerName,
+			FileSizeBytes: fileSizeBytes,
+			ContentType:   types.ContentType(contentType),
+			UploadName:    types.Filename(url.PathEscape(filename)),
+			UserID:        types.MatrixUserID(dev.UserID),
+		},
+		Logger:       logger.WithField("Origin", cfg.Matrix.ServerName),
+		Blocklist:    blocklist,
+		Encryption:   encryption,
+		Compression:  compression,
+		Fsync:        cfg.Fsync,
+		SpamCheckers: spamCheckers,
+		Uploads:      uploads,
+	}
+	if resErr := r.Validate(maxFileSizeBytes); resErr != nil {
+		return *resErr
+	}
+	if resErr := r.doUpload(req.Context(), res.Body, cfg, db, maxFileSizeBytes, activeThumbnailGeneration); resErr != nil {
+		return *resErr
+	}
+	auditLog.record(req, &types.AuditLogEntry{
+		Action:     types.AuditUpload,
+		MediaID:    r.MediaMetadata.MediaID,
+		Origin:     r.MediaMetadata.Origin,
+		Base64Hash: r.MediaMetadata.Base64Hash,
+		UserID:     types.MatrixUserID(dev.UserID),
+	})
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: uploadResponse{
+			ContentURI: mxc.URI{ServerName: cfg.Matrix.ServerName, MediaID: r.MediaMetadata.MediaID}.String(),
+		},
+	}
+}
+
+// deniedNetworks are the special address ranges that URLs aren't fetched from,
+// other than those the net.IP methods check for.
+var deniedNetworks = mustParseCIDRs(
+	"0.0.0.0/8",      // "this" network
+	"100.64.0.0/10",  // carrier-grade NAT
+	"192.0.0.0/24",   // IETF protocol assignments
+	"198.18.0.0/15",  // benchmarking
+	"240.0.0.0/4",    // reserved
+	"64:ff9b::/96",   // NAT64, which may map to any IPv4 address
+	"64:ff9b:1::/48", // local-use NAT64
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// deniedAddressError is returned when a URL resolves to an address that URLs
+// may not be fetched from.
+type deniedAddressError struct {
+	ip net.IP
+}
+
+func (e *deniedAddressError) Error() string {
+	return fmt.Sprintf("%s is a denied address", e.ip)
+}
+
+// isDeniedIP returns whether URLs may not be fetched from the address, because
+// it is loopback, private, link-local or otherwise special, unless it is in one
+// of the allowed networks.
+func isDeniedIP(ip net.IP, allowed []*net.IPNet) bool {
+	for _, network := range allowed {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return true
+	}
+	for _, network := range deniedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// newUploadFromURLClient returns an HTTP client that refuses to connect to
+// denied addresses. The address is checked when connecting, after the host
+// name is resolved, so that neither DNS nor redirects can get around it.
+// Proxies aren't used, as they would connect on the client's behalf.
+func newUploadFromURLClient(cfg *config.MediaUploadFromURL) *http.Client {
+	var allowed []*net.IPNet
+	for _, cidr := range cfg.AllowedNetworks {
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			allowed = append(allowed, network)
+		}
+	}
+	dialer := &net.Dialer{
+		Timeout: time.Second * 30,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || isDeniedIP(ip, allowed) {
+				return &deniedAddressError{ip: ip}
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: cfg.Timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: time.Second * 10,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     time.Second * 90,
+		},
+	}
+}
@@ -0,0 +1,101 @@
+package routing
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsDeniedIP(t *testing.T) {
+	allowed := mustParseCIDRs("10.1.0.0/16")
+	for ip, denied := range map[string]bool{
+		"93.184.216.34":        false,
+		"2606:2800:220:1::248": false,
+		"127.0.0.1":            true,
+		"::1":                  true,
+		"10.0.0.1":             true,
+		"10.1.2.3":             false,
+		"192.168.1.1":          true,
+		"169.254.169.254":      true,
+		"fe80::1":              true,
+		"fd00::1":              true,
+		"100.64.0.1":           true,
+		"0.0.0.0":              true,
+		"::ffff:127.0.0.1":     true,
+		"64:ff9b::7f00:1":      true,
+	} {
+		assert.Equal(t, denied, isDeniedIP(net.ParseIP(ip), allowed), ip)
+	}
+}
+
+func TestAdminUploadFromURL(t *testing.T) {
+	cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
+	db, err := storage.NewMediaAPIDatasource(cm, &config.DatabaseOptions{
+		ConnectionString:       "file::memory:",
+		MaxOpenConnections:     1,
+		MaxIdleConnections:     1,
+		ConnMaxLifetimeSeconds: -1,
+	})
+	assert.NoError(t, err)
+
+	cfg := &config.MediaAPI{
+		Matrix:      &config.Global{},
+		AbsBasePath: config.Path(t.TempDir()),
+	}
+	cfg.Matrix.ServerName = "localhost"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/files/avatar.png" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write([]byte("not really a png"))
+	}))
+	defer server.Close()
+
+	admin := &userapi.Device{UserID: "@admin:localhost", AccountType: userapi.AccountTypeAdmin}
+	uploadFromURL := func(client *http.Client, dev *userapi.Device, body string) (int, interface{}) {
+		req := httptest.NewRequest(http.MethodPost, "/admin/uploadFromURL", strings.NewReader(body))
+		res := AdminUploadFromURL(req, cfg, dev, db, client, nil, nil, nil, nil, nil, nil, nil)
+		return res.Code, res.JSON
+	}
+
+	// The test server is on a loopback address, which is denied by default.
+	denyingClient := newUploadFromURLClient(&config.MediaUploadFromURL{})
+	code, _ := uploadFromURL(denyingClient, admin, `{"url":"`+server.URL+`/files/avatar.png"}`)
+	assert.Equal(t, http.StatusForbidden, code)
+
+	client := newUploadFromURLClient(&config.MediaUploadFromURL{AllowedNetworks: []string{"127.0.0.0/8", "::1/128"}})
+	code, res := uploadFromURL(client, admin, `{"url":"`+server.URL+`/files/avatar.png"}`)
+	if assert.Equal(t, http.StatusOK, code) {
+		contentURI := res.(uploadResponse).ContentURI
+		assert.True(t, strings.HasPrefix(contentURI, "mxc://localhost/"))
+		metadata, err := db.GetMediaMetadata(context.Background(), types.MediaID(strings.TrimPrefix(contentURI, "mxc://localhost/")), "localhost")
+		if assert.NoError(t, err) && assert.NotNil(t, metadata) {
+			assert.Equal(t, types.ContentType("image/png"), metadata.ContentType)
+			assert.Equal(t, types.Filename("avatar.png"), metadata.UploadName)
+			assert.Equal(t, types.MatrixUserID("@admin:localhost"), metadata.UserID)
+		}
+	}
+
+	code, _ = uploadFromURL(client, admin, `{"url":"`+server.URL+`/missing"}`)
+	assert.Equal(t, http.StatusBadGateway, code)
+	code, _ = uploadFromURL(client, admin, `{"url":"file:///etc/passwd"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// Only admins and application services may use the endpoint.
+	user := &userapi.Device{UserID: "@alice:localhost", AccountType: userapi.AccountTypeUser}
+	code, _ = uploadFromURL(client, user, `{"url":"`+server.URL+`/files/avatar.png"}`)
+	assert.Equal(t, http.StatusForbidden, code)
+}
@@ -0,0 +1,196 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	uploadsActive = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "dendrite",
+			Subsystem: "mediaapi",
+			Name:      "uploads_active",
+			Help:      "The number of uploads that are being received",
+		},
+	)
+	uploadBytesReceived = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "dendrite",
+			Subsystem: "mediaapi",
+			Name:      "upload_bytes_received",
+			Help:      "The number of bytes received so far by the uploads that are being received",
+		},
+	)
+	uploadBytesExpected = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "dendrite",
+			Subsystem: "mediaapi",
+			Name:      "upload_bytes_expected",
+			Help:      "The total Content-Length of the uploads that are being received, where it is known",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(uploadsActive, uploadBytesReceived, uploadBytesExpected)
+}
+
+// uploadProgress is an upload that is being received.
+type uploadProgress struct {
+	id            uint64
+	userID        types.MatrixUserID
+	uploadName    types.Filename
+	contentType   types.ContentType
+	contentLength int64
+	started       time.Time
+	received      atomic.Int64
+	// When the last bytes were received, in Unix nanoseconds.
+	lastActivity atomic.Int64
+}
+
+// activeUploads tracks the progress of the uploads that are being received, so
+// that operators can see uploads that are stuck.
+type activeUploads struct {
+	mu      sync.Mutex
+	nextID  uint64
+	uploads map[uint64]*uploadProgress
+}
+
+func newActiveUploads() *activeUploads {
+	return &activeUploads{uploads: map[uint64]*uploadProgress{}}
+}
+
+// start tracks a new upload. The Content-Length is taken from the file size of
+// the metadata, and is negative if it isn't known. finish must be called once
+// the upload has been received.
+func (a *activeUploads) start(metadata *types.MediaMetadata) *uploadProgress {
+	now := time.Now()
+	p := &uploadProgress{
+		userID:        metadata.UserID,
+		uploadName:    metadata.UploadName,
+		contentType:   metadata.ContentType,
+		contentLength: int64(metadata.FileSizeBytes),
+		started:       now,
+	}
+	p.lastActivity.Store(now.UnixNano())
+	a.mu.Lock()
+	a.nextID++
+	p.id = a.nextID
+	a.uploads[p.id] = p
+	a.mu.Unlock()
+	uploadsActive.Inc()
+	if p.contentLength > 0 {
+		uploadBytesExpected.Add(float64(p.contentLength))
+	}
+	return p
+}
+
+func (a *activeUploads) finish(p *uploadProgress) {
+	a.mu.Lock()
+	delete(a.uploads, p.id)
+	a.mu.Unlock()
+	uploadsActive.Dec()
+	uploadBytesReceived.Sub(float64(p.received.Load()))
+	if p.contentLength > 0 {
+		uploadBytesExpected.Sub(float64(p.contentLength))
+	}
+}
+
+// list returns the uploads that are being received, oldest first.
+func (a *activeUploads) list() []*uploadProgress {
+	a.mu.Lock()
+	uploads := make([]*uploadProgress, 0, len(a.uploads))
+	for _, p := range a.uploads {
+		uploads = append(uploads, p)
+	}
+	a.mu.Unlock()
+	sort.Slice(uploads, func(i, j int) bool { return uploads[i].id < uploads[j].id })
+	return uploads
+}
+
+// reader returns a reader that records the progress of the upload as r is read.
+func (p *uploadProgress) reader(r io.Reader) io.Reader {
+	return &progressReader{r: r, p: p}
+}
+
+type progressReader struct {
+	r io.Reader
+	p *uploadProgress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		r.p.received.Add(int64(n))
+		r.p.lastActivity.Store(time.Now().UnixNano())
+		uploadBytesReceived.Add(float64(n))
+	}
+	return n, err
+}
+
+// uploadProgressEntry is an entry in the response to the uploads admin endpoint.
+type uploadProgressEntry struct {
+	UserID      types.MatrixUserID `json:"user_id"`
+	UploadName  types.Filename     `json:"upload_name,omitempty"`
+	ContentType types.ContentType  `json:"content_type,omitempty"`
+	// The Content-Length of the upload, omitted if it isn't known
+	ContentLength *int64         `json:"content_length,omitempty"`
+	BytesReceived int64          `json:"bytes_received"`
+	StartedTS     spec.Timestamp `json:"started_ts"`
+	// When bytes of the upload were last received
+	LastActivityTS spec.Timestamp `json:"last_activity_ts"`
+}
+
+type uploadsResponse struct {
+	Uploads []uploadProgressEntry `json:"uploads"`
+}
+
+// AdminListUploads implements GET /_dendrite/admin/uploads, which lists the
+// uploads that are being received and how far along they are, oldest first.
+func AdminListUploads(_ *http.Request, uploads *activeUploads) util.JSONResponse {
+	active := uploads.list()
+	res := uploadsResponse{Uploads: make([]uploadProgressEntry, 0, len(active))}
+	for _, p := range active {
+		entry := uploadProgressEntry{
+			UserID:         p.userID,
+			UploadName:     p.uploadName,
+			ContentType:    p.contentType,
+			BytesReceived:  p.received.Load(),
+			StartedTS:      spec.AsTimestamp(p.started),
+			LastActivityTS: spec.AsTimestamp(time.Unix(0, p.lastActivity.Load())),
+		}
+		if p.contentLength >= 0 {
+			contentLength := p.contentLength
+			entry.ContentLength = &contentLength
+		}
+		res.Uploads = append(res.Uploads, entry)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
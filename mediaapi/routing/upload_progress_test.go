@@ -0,0 +1,32 @@
+package routing
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestActiveUploads(t *testing.T) {
+	uploads := newActiveUploads()
+	progress := uploads.start(&types.MediaMetadata{UserID: "@alice:test", FileSizeBytes: 10})
+	_, err := io.ReadAll(progress.reader(strings.NewReader("hello")))
+	assert.NoError(t, err)
+
+	res := AdminListUploads(nil, uploads)
+	assert.Equal(t, http.StatusOK, res.Code)
+	entries := res.JSON.(uploadsResponse).Uploads
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, types.MatrixUserID("@alice:test"), entries[0].UserID)
+		assert.EqualValues(t, 5, entries[0].BytesReceived)
+		if assert.NotNil(t, entries[0].ContentLength) {
+			assert.EqualValues(t, 10, *entries[0].ContentLength)
+		}
+	}
+
+	uploads.finish(progress)
+	assert.Empty(t, AdminListUploads(nil, uploads).JSON.(uploadsResponse).Uploads)
+}
@@ -0,0 +1,185 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+)
+
+// uploadQuotaResponse is the response to the upload quota admin endpoint.
+type uploadQuotaResponse struct {
+	UserID     types.MatrixUserID  `json:"user_id"`
+	UsageBytes types.FileSizeBytes `json:"usage_bytes"`
+	// The quota that applies to the user, 0 for unlimited
+	QuotaBytes types.FileSizeBytes `json:"quota_bytes"`
+	// Whether the quota was set for this user by an admin
+	Override bool `json:"override"`
+}
+
+// uploadQuota returns the upload quota that applies to the user, and whether it
+// was set for the user by an admin rather than coming from the config.
+func uploadQuota(ctx context.Context, cfg *config.MediaAPI, db storage.Database, userID types.MatrixUserID) (types.FileSizeBytes, bool, error) {
+	override, err := db.GetUploadQuota(ctx, userID)
+	if err != nil {
+		return 0, false, fmt.Errorf("db.GetUploadQuota: %w", err)
+	}
+	if override != nil {
+		return *override, true, nil
+	}
+	return types.FileSizeBytes(cfg.UploadQuotaBytes), false, nil
+}
+
+// checkUploadQuota returns an error response if storing the upload would take
+// the user over their upload quota.
+func (r *uploadRequest) checkUploadQuota(
+	ctx context.Context, cfg *config.MediaAPI, db storage.Database, uploadSize types.FileSizeBytes,
+) *util.JSONResponse {
+	if r.MediaMetadata.UserID == "" {
+		return nil
+	}
+	quota, _, err := uploadQuota(ctx, cfg, db, r.MediaMetadata.UserID)
+	if err != nil {
+		r.Logger.WithError(err).Error("Failed to get upload quota")
+		return &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if quota == 0 {
+		return nil
+	}
+	usage, err := db.GetUserUploadSize(ctx, r.MediaMetadata.UserID, r.MediaMetadata.Origin)
+	if err != nil {
+		r.Logger.WithError(err).Error("Failed to get upload usage")
+		return &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if usage+uploadSize > quota {
+		return uploadQuotaExceededJSONResponse(quota)
+	}
+	return nil
+}
+
+func uploadQuotaExceededJSONResponse(quota types.FileSizeBytes) *util.JSONResponse {
+	return &util.JSONResponse{
+		Code: http.StatusTooManyRequests,
+		JSON: spec.LimitExceeded(fmt.Sprintf("Upload would exceed your upload quota (%v bytes).", quota), 0),
+	}
+}
+
+// AdminUploadQuota implements GET, PUT and DELETE /_dendrite/admin/uploadQuota/{userID}.
+// GET returns the upload usage and quota of a local user, PUT sets a quota for
+// the user that overrides the configured one and DELETE removes the override again.
+func AdminUploadQuota(req *http.Request, cfg *config.MediaAPI, db storage.Database) util.JSONResponse {
+	userID, resErr := adminLocalUserID(req, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	logger := util.GetLogger(req.Context()).WithField("userID", userID)
+
+	var err error
+	switch req.Method {
+	case http.MethodPut:
+		var request struct {
+			QuotaBytes *types.FileSizeBytes `json:"quota_bytes"`
+		}
+		if err = json.NewDecoder(req.Body).Decode(&request); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.BadJSON("Failed to decode request body: " + err.Error()),
+			}
+		}
+		if request.QuotaBytes == nil || *request.QuotaBytes < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("quota_bytes must be 0 or greater"),
+			}
+		}
+		if err = db.SetUploadQuota(req.Context(), userID, *request.QuotaBytes); err != nil {
+			logger.WithError(err).Error("Failed to set upload quota")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+	case http.MethodDelete:
+		if err = db.DeleteUploadQuota(req.Context(), userID); err != nil {
+			logger.WithError(err).Error("Failed to delete upload quota")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+	}
+
+	res := uploadQuotaResponse{UserID: userID}
+	res.QuotaBytes, res.Override, err = uploadQuota(req.Context(), cfg, db, userID)
+	if err != nil {
+		logger.WithError(err).Error("Failed to get upload quota")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	res.UsageBytes, err = db.GetUserUploadSize(req.Context(), userID, cfg.Matrix.ServerName)
+	if err != nil {
+		logger.WithError(err).Error("Failed to get upload usage")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// adminLocalUserID returns the local user ID from the path of an admin request.
+func adminLocalUserID(req *http.Request, cfg *config.MediaAPI) (types.MatrixUserID, *util.JSONResponse) {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		resErr := util.ErrorResponse(err)
+		return "", &resErr
+	}
+	_, serverName, err := gomatrixserverlib.SplitID('@', vars["userID"])
+	if err != nil {
+		return "", &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam(err.Error()),
+		}
+	}
+	if !cfg.Matrix.IsLocalServerName(serverName) {
+		return "", &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("User ID must belong to this server."),
+		}
+	}
+	return types.MatrixUserID(vars["userID"]), nil
+}
@@ -1,27 +1,45 @@
 package routing
 
 import (
+	"bytes"
 	"context"
 	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
 	"os"
 	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
 
+	"github.com/matrix-org/dendrite/internal/spamcheck"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/mediaapi/fileutils"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib/spec"
 	"github.com/matrix-org/util"
 	log "github.com/sirupsen/logrus"
 )
 
+// noMediaSpamChecker is a spam checker module that rejects all uploads.
+type noMediaSpamChecker struct {
+	spamcheck.AllowAll
+}
+
+func (noMediaSpamChecker) CheckMediaForSpam(context.Context, *spamcheck.Media) error {
+	return &spamcheck.Rejection{Reason: "no media"}
+}
+
 func Test_uploadRequest_doUpload(t *testing.T) {
 	type fields struct {
 		MediaMetadata *types.MediaMetadata
 		Logger        *log.Entry
+		SpamCheckers  *spamcheck.SpamCheckers
 	}
 	type args struct {
 		ctx                       context.Context
@@ -47,6 +65,14 @@ func Test_uploadRequest_doUpload(t *testing.T) {
 		DynamicThumbnails: false,
 	}
 
+	quotaCfg := &config.MediaAPI{
+		MaxFileSizeBytes:  maxSize,
+		UploadQuotaBytes:  10,
+		BasePath:          config.Path(testdataPath),
+		AbsBasePath:       config.Path(testdataPath),
+		DynamicThumbnails: false,
+	}
+
 	// create testdata folder and remove when done
 	_ = os.Mkdir(testdataPath, os.ModePerm)
 	defer fileutils.RemoveDir(types.Path(testdataPath), nil)
@@ -139,16 +165,231 @@ func Test_uploadRequest_doUpload(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "upload ok within quota",
+			args: args{
+				ctx:       context.Background(),
+				reqReader: strings.NewReader("quotaquo"),
+				cfg:       quotaCfg,
+				db:        db,
+			},
+			fields: fields{
+				Logger: logger,
+				MediaMetadata: &types.MediaMetadata{
+					UploadName: "test quota ok",
+					UserID:     "@quota:test",
+				},
+			},
+		},
+		{
+			name: "upload not ok over quota",
+			args: args{
+				ctx:       context.Background(),
+				reqReader: strings.NewReader("quot"),
+				cfg:       quotaCfg,
+				db:        db,
+			},
+			fields: fields{
+				Logger: logger,
+				MediaMetadata: &types.MediaMetadata{
+					UploadName: "test quota fail",
+					UserID:     "@quota:test",
+				},
+			},
+			want: uploadQuotaExceededJSONResponse(10),
+		},
+		{
+			name: "upload ok for other user",
+			args: args{
+				ctx:       context.Background(),
+				reqReader: strings.NewReader("quot"),
+				cfg:       quotaCfg,
+				db:        db,
+			},
+			fields: fields{
+				Logger: logger,
+				MediaMetadata: &types.MediaMetadata{
+					UploadName: "test quota other user",
+					UserID:     "@other:test",
+				},
+			},
+		},
+		{
+			name: "upload not ok rejected by spam checker",
+			args: args{
+				ctx:       context.Background(),
+				reqReader: strings.NewReader("spam"),
+				cfg:       cfg,
+				db:        db,
+			},
+			fields: fields{
+				Logger: logger,
+				MediaMetadata: &types.MediaMetadata{
+					UploadName: "test spam",
+					UserID:     "@spammer:test",
+				},
+				SpamCheckers: spamcheck.NewSpamCheckers(noMediaSpamChecker{}),
+			},
+			want: &util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: spec.Forbidden("no media"),
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			r := &uploadRequest{
 				MediaMetadata: tt.fields.MediaMetadata,
 				Logger:        tt.fields.Logger,
+				SpamCheckers:  tt.fields.SpamCheckers,
 			}
-			if got := r.doUpload(tt.args.ctx, tt.args.reqReader, tt.args.cfg, tt.args.db, tt.args.activeThumbnailGeneration); !reflect.DeepEqual(got, tt.want) {
+			if got := r.doUpload(tt.args.ctx, tt.args.reqReader, tt.args.cfg, tt.args.db, tt.args.cfg.MaxFileSizeBytes, tt.args.activeThumbnailGeneration); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("doUpload() = %+v, want %+v", got, tt.want)
 			}
 		})
 	}
 }
+
+func Test_maxUploadSize(t *testing.T) {
+	cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
+	db, err := storage.NewMediaAPIDatasource(cm, &config.DatabaseOptions{
+		ConnectionString:       "file::memory:",
+		MaxOpenConnections:     1,
+		MaxIdleConnections:     1,
+		ConnMaxLifetimeSeconds: -1,
+	})
+	if err != nil {
+		t.Fatalf("error opening mediaapi database: %v", err)
+	}
+	cfg := &config.MediaAPI{MaxFileSizeBytes: 8}
+	ctx := context.Background()
+
+	if err = db.SetMaxUploadSize(ctx, "@bot:test", 1024); err != nil {
+		t.Fatalf("failed to set max upload size: %v", err)
+	}
+	tests := []struct {
+		userID       types.MatrixUserID
+		want         config.FileSizeBytes
+		wantOverride bool
+	}{
+		{userID: "@alice:test", want: 8},
+		{userID: "@bot:test", want: 1024, wantOverride: true},
+	}
+	for _, tt := range tests {
+		got, override, err := maxUploadSize(ctx, cfg, db, tt.userID)
+		if err != nil {
+			t.Fatalf("maxUploadSize() error = %v", err)
+		}
+		if got != tt.want || override != tt.wantOverride {
+			t.Errorf("maxUploadSize(%s) = %d, %v, want %d, %v", tt.userID, got, override, tt.want, tt.wantOverride)
+		}
+	}
+}
+
+func Test_parseAndValidateRequest_multipart(t *testing.T) {
+	cfg := &config.MediaAPI{Matrix: &config.Global{}, MaxFileSizeBytes: 8}
+	cfg.Matrix.ServerName = "test"
+	dev := &userapi.Device{UserID: "@alice:test"}
+
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	if err := writer.WriteField("caption", "a cat"); err != nil {
+		t.Fatal(err)
+	}
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="file"; filename="cat.png"`)
+	header.Set("Content-Type", "image/png")
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The form is larger than the maximum file size, but the file isn't.
+	if _, err = part.Write([]byte("meow")); err != nil {
+		t.Fatal(err)
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", &form)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	r, body, resErr := parseAndValidateRequest(req, cfg, dev, cfg.MaxFileSizeBytes)
+	if resErr != nil {
+		t.Fatalf("parseAndValidateRequest() error = %+v", resErr)
+	}
+	if r.MediaMetadata.ContentType != "image/png" || r.MediaMetadata.UploadName != "cat.png" {
+		t.Errorf("unexpected metadata %+v", r.MediaMetadata)
+	}
+	content, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "meow" {
+		t.Errorf("read file %q, want %q", content, "meow")
+	}
+
+	// Forms without a file part are refused.
+	form.Reset()
+	writer = multipart.NewWriter(&form)
+	if err = writer.WriteField("caption", "a cat"); err != nil {
+		t.Fatal(err)
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	req = httptest.NewRequest(http.MethodPost, "/upload", &form)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	if _, _, resErr = parseAndValidateRequest(req, cfg, dev, cfg.MaxFileSizeBytes); resErr == nil || resErr.Code != http.StatusBadRequest {
+		t.Errorf("expected a bad request for a form without a file, got %+v", resErr)
+	}
+}
+
+func Test_randomMediaID(t *testing.T) {
+	cfg := &config.MediaIDGeneration{Length: 24, Alphabet: "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-"}
+	var configErrs config.ConfigErrors
+	cfg.Verify(&configErrs)
+	if len(configErrs) != 0 {
+		t.Fatalf("unexpected config errors: %v", configErrs)
+	}
+	seen := map[types.MediaID]bool{}
+	for i := 0; i < 100; i++ {
+		mediaID, err := randomMediaID(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(mediaID) != cfg.Length {
+			t.Errorf("media ID %q has length %d, want %d", mediaID, len(mediaID), cfg.Length)
+		}
+		if strings.Trim(string(mediaID), cfg.Alphabet) != "" {
+			t.Errorf("media ID %q has characters outside of the alphabet", mediaID)
+		}
+		if seen[mediaID] {
+			t.Errorf("media ID %q generated twice", mediaID)
+		}
+		seen[mediaID] = true
+	}
+
+	// An unset config generates the default media IDs.
+	mediaID, err := randomMediaID(&config.MediaIDGeneration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mediaID) != config.DefaultMediaIDLength || strings.Trim(string(mediaID), config.DefaultMediaIDAlphabet) != "" {
+		t.Errorf("unexpected default media ID %q", mediaID)
+	}
+
+	for _, invalid := range []config.MediaIDGeneration{
+		{Length: 0, Alphabet: "0123456789abcdef"},
+		{Length: 256, Alphabet: "0123456789abcdef"},
+		{Length: 64, Alphabet: "0123456789abcdef/"},
+		{Length: 64, Alphabet: "0123456789abcdea"},
+		{Length: 64, Alphabet: "a"},
+		{Length: 8, Alphabet: "0123456789abcdef"},
+	} {
+		configErrs = nil
+		invalid.Verify(&configErrs)
+		if len(configErrs) == 0 {
+			t.Errorf("expected config %+v to be invalid", invalid)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/mediaapi/types/mxc"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultUserMediaLimit = 100
+	maxUserMediaLimit     = 1000
+)
+
+// userMedia is an entry in the response to the user media admin endpoint.
+type userMedia struct {
+	MediaID       types.MediaID       `json:"media_id"`
+	ContentURI    string              `json:"content_uri"`
+	ContentType   types.ContentType   `json:"content_type"`
+	FileSizeBytes types.FileSizeBytes `json:"file_size_bytes"`
+	UploadName    types.Filename      `json:"upload_name,omitempty"`
+	CreatedTS     spec.Timestamp      `json:"created_ts"`
+	LastAccessTS  spec.Timestamp      `json:"last_access_ts"`
+	// The content coding the file is compressed with on disk, if any
+	StoredEncoding string `json:"stored_encoding,omitempty"`
+}
+
+type userMediaResponse struct {
+	Media []userMedia `json:"media"`
+	// The from parameter for the next page, omitted on the last page
+	NextFrom *int `json:"next_from,omitempty"`
+}
+
+// AdminListUserMedia implements GET /_dendrite/admin/userMedia/{userID}?from=0&limit=100.
+// It returns the media uploaded by a local user, newest first.
+func AdminListUserMedia(req *http.Request, cfg *config.MediaAPI, db storage.Database) util.JSONResponse {
+	userID, resErr := adminLocalUserID(req, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	from, limit := 0, defaultUserMediaLimit
+	query := req.URL.Query()
+	if param := query.Get("from"); param != "" {
+		var err error
+		if from, err = strconv.Atoi(param); err != nil || from < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("from must be a positive number"),
+			}
+		}
+	}
+	if param := query.Get("limit"); param != "" {
+		var err error
+		if limit, err = strconv.Atoi(param); err != nil || limit <= 0 || limit > maxUserMediaLimit {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam(fmt.Sprintf("limit must be between 1 and %d", maxUserMediaLimit)),
+			}
+		}
+	}
+
+	// Ask for one more than the limit to find out if there is another page.
+	media, err := db.GetUserMedia(req.Context(), userID, cfg.Matrix.ServerName, limit+1, from)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).WithField("userID", userID).Error("Failed to get user media")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	res := userMediaResponse{Media: make([]userMedia, 0, len(media))}
+	if len(media) > limit {
+		media = media[:limit]
+		nextFrom := from + limit
+		res.NextFrom = &nextFrom
+	}
+	for _, mediaMetadata := range media {
+		res.Media = append(res.Media, userMedia{
+			MediaID:        mediaMetadata.MediaID,
+			ContentURI:     mxc.URI{ServerName: mediaMetadata.Origin, MediaID: mediaMetadata.MediaID}.String(),
+			ContentType:    mediaMetadata.ContentType,
+			FileSizeBytes:  mediaMetadata.FileSizeBytes,
+			UploadName:     mediaMetadata.UploadName,
+			CreatedTS:      mediaMetadata.CreationTimestamp,
+			LastAccessTS:   mediaMetadata.LastAccessTimestamp,
+			StoredEncoding: mediaMetadata.StoredEncoding,
+		})
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+type deleteUserMediaResponse struct {
+	Deleted  []types.MediaID `json:"deleted"`
+	NotFound []types.MediaID `json:"not_found"`
+	DryRun   bool            `json:"dry_run"`
+}
+
+// AdminDeleteUserMedia implements POST /_dendrite/admin/deleteUserMedia/{userID}.
+// It deletes the given media uploaded by a local user. Files are only removed
+// from disk once no other media refers to them. In a dry run, nothing is deleted
+// and the media that would be is listed.
+func AdminDeleteUserMedia(
+	req *http.Request, cfg *config.MediaAPI, device *userapi.Device, db storage.Database, auditLog *mediaAuditLog, dryRun bool,
+) util.JSONResponse {
+	userID, resErr := adminLocalUserID(req, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	var request struct {
+		MediaIDs []types.MediaID `json:"media_ids"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("Failed to decode request body: " + err.Error()),
+		}
+	}
+	if len(request.MediaIDs) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("media_ids must not be empty"),
+		}
+	}
+	for _, mediaID := range request.MediaIDs {
+		if err := mxc.ValidateMediaID(mediaID); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam(fmt.Sprintf("media_ids: %q: %s", mediaID, err)),
+			}
+		}
+	}
+
+	logger := util.GetLogger(req.Context()).WithField("userID", userID)
+	res := deleteUserMediaResponse{
+		Deleted:  []types.MediaID{},
+		NotFound: []types.MediaID{},
+		DryRun:   dryRun,
+	}
+	for _, mediaID := range request.MediaIDs {
+		mediaMetadata, err := db.GetMediaMetadata(req.Context(), mediaID, cfg.Matrix.ServerName)
+		if err != nil {
+			logger.WithError(err).Error("Failed to get media metadata")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+		// Only delete media that was uploaded by the user.
+		if mediaMetadata == nil || mediaMetadata.UserID != userID {
+			res.NotFound = append(res.NotFound, mediaID)
+			continue
+		}
+		if dryRun {
+			res.Deleted = append(res.Deleted, mediaID)
+			continue
+		}
+		if err = deleteMedia(req.Context(), cfg, db, mediaMetadata, logger); err != nil {
+			logger.WithError(err).WithField("mediaID", mediaID).Error("Failed to delete media")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+		auditLog.record(req, &types.AuditLogEntry{
+			Action:     types.AuditDelete,
+			MediaID:    mediaID,
+			Origin:     mediaMetadata.Origin,
+			Base64Hash: mediaMetadata.Base64Hash,
+			UserID:     types.MatrixUserID(device.UserID),
+		})
+		res.Deleted = append(res.Deleted, mediaID)
+	}
+	if !dryRun {
+		logger.WithField("deleted", len(res.Deleted)).Info("Deleted media of user")
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// eraseUserMediaBatchSize is how much media of the user is deleted at a time.
+const eraseUserMediaBatchSize = 100
+
+type eraseUserMediaResponse struct {
+	Deleted []types.MediaID `json:"deleted"`
+	DryRun  bool            `json:"dry_run"`
+}
+
+// AdminEraseUserMedia implements POST /_dendrite/admin/eraseUserMedia/{userID}.
+// It deletes all media uploaded by a local user who has been deactivated, and
+// removes their personal data left in the media database: the user and upload
+// names of their media, their users and IP addresses in the audit log, their
+// upload limits and their takeout archives. Files are only removed from disk
+// once no other media refers to them. In a dry run, nothing is deleted and the
+// media that would be is listed.
+func AdminEraseUserMedia(
+	req *http.Request, cfg *config.MediaAPI, device *userapi.Device, db storage.Database,
+	t *takeouts, auditLog *mediaAuditLog, dryRun bool,
+) util.JSONResponse {
+	userID, resErr := adminLocalUserID(req, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	logger := util.GetLogger(req.Context()).WithField("userID", userID)
+
+	// Deactivating the user signs them out of all of their devices, so that
+	// they can't upload anything more while their media is being erased.
+	var devices userapi.QueryDevicesResponse
+	if err := t.userAPI.QueryDevices(req.Context(), &userapi.QueryDevicesRequest{UserID: string(userID)}, &devices); err != nil {
+		logger.WithError(err).Error("Failed to query user")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if len(devices.Devices) > 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.Unknown("The user must be deactivated before their media can be erased."),
+		}
+	}
+
+	res := eraseUserMediaResponse{
+		Deleted: []types.MediaID{},
+		DryRun:  dryRun,
+	}
+	if dryRun {
+		for {
+			media, err := db.GetUserMedia(req.Context(), userID, cfg.Matrix.ServerName, eraseUserMediaBatchSize, len(res.Deleted))
+			if err != nil {
+				logger.WithError(err).Error("Failed to get user media")
+				return util.JSONResponse{
+					Code: http.StatusInternalServerError,
+					JSON: spec.InternalServerError{},
+				}
+			}
+			for _, mediaMetadata := range media {
+				res.Deleted = append(res.Deleted, mediaMetadata.MediaID)
+			}
+			if len(media) < eraseUserMediaBatchSize {
+				return util.JSONResponse{
+					Code: http.StatusOK,
+					JSON: res,
+				}
+			}
+		}
+	}
+
+	if !t.discard(string(userID)) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.Unknown("An export of the user's data is still running."),
+		}
+	}
+	// Deleted media is no longer returned, so the first batch is always asked for.
+	for {
+		media, err := db.GetUserMedia(req.Context(), userID, cfg.Matrix.ServerName, eraseUserMediaBatchSize, 0)
+		if err != nil {
+			logger.WithError(err).Error("Failed to get user media")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+		for _, mediaMetadata := range media {
+			if err = deleteMedia(req.Context(), cfg, db, mediaMetadata, logger); err != nil {
+				logger.WithError(err).WithField("mediaID", mediaMetadata.MediaID).Error("Failed to delete media")
+				return util.JSONResponse{
+					Code: http.StatusInternalServerError,
+					JSON: spec.InternalServerError{},
+				}
+			}
+			auditLog.record(req, &types.AuditLogEntry{
+				Action:     types.AuditDelete,
+				MediaID:    mediaMetadata.MediaID,
+				Origin:     mediaMetadata.Origin,
+				Base64Hash: mediaMetadata.Base64Hash,
+				UserID:     types.MatrixUserID(device.UserID),
+			})
+			res.Deleted = append(res.Deleted, mediaMetadata.MediaID)
+		}
+		if len(media) < eraseUserMediaBatchSize {
+			break
+		}
+	}
+
+	auditLog.forgetUser(userID)
+	if err := db.ScrubUserData(req.Context(), userID); err != nil {
+		logger.WithError(err).Error("Failed to scrub user data")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	// The erasure itself is recorded without the user, whose ID is personal
+	// data too.
+	auditLog.record(req, &types.AuditLogEntry{
+		Action: types.AuditErase,
+		UserID: types.MatrixUserID(device.UserID),
+	})
+	logger.WithFields(log.Fields{
+		"deleted":  len(res.Deleted),
+		"erasedBy": device.UserID,
+	}).Info("Erased media of user")
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
@@ -0,0 +1,111 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+type devicesUserAPI struct {
+	userapi.MediaUserAPI
+	devices []userapi.Device
+}
+
+func (u *devicesUserAPI) QueryDevices(ctx context.Context, req *userapi.QueryDevicesRequest, res *userapi.QueryDevicesResponse) error {
+	res.UserExists = true
+	res.Devices = u.devices
+	return nil
+}
+
+func TestAdminEraseUserMedia(t *testing.T) {
+	cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
+	db, err := storage.NewMediaAPIDatasource(cm, &config.DatabaseOptions{
+		ConnectionString:       "file::memory:",
+		MaxOpenConnections:     1,
+		MaxIdleConnections:     1,
+		ConnMaxLifetimeSeconds: -1,
+	})
+	assert.NoError(t, err)
+	ctx := context.Background()
+	logger := logrus.WithField("test", t.Name())
+
+	cfg := &config.MediaAPI{
+		Matrix:      &config.Global{},
+		AbsBasePath: config.Path(t.TempDir()),
+	}
+	cfg.Matrix.ServerName = "localhost"
+	const alice, bob = types.MatrixUserID("@alice:localhost"), types.MatrixUserID("@bob:localhost")
+	for _, metadata := range []*types.MediaMetadata{
+		{MediaID: "alice1", Origin: "localhost", FileSizeBytes: 1, Base64Hash: "sharedhash", UserID: alice, UploadName: "holiday.jpg"},
+		{MediaID: "alice2", Origin: "localhost", FileSizeBytes: 2, Base64Hash: "alicehash", UserID: alice},
+		{MediaID: "bob1", Origin: "localhost", FileSizeBytes: 1, Base64Hash: "sharedhash", UserID: bob},
+	} {
+		assert.NoError(t, db.StoreMediaMetadata(ctx, metadata))
+	}
+	assert.NoError(t, db.SetUploadQuota(ctx, alice, 1024))
+	auditLog := newMediaAuditLog(&config.MediaAuditLog{Enabled: true}, db)
+	auditLog.record(httptest.NewRequest(http.MethodPost, "/", nil), &types.AuditLogEntry{Action: types.AuditUpload, MediaID: "alice1", Origin: "localhost", UserID: alice})
+	auditLog.flush(ctx, logger)
+
+	userAPI := &devicesUserAPI{devices: []userapi.Device{{ID: "ALICE", UserID: string(alice)}}}
+	takeouts := newTakeouts(cfg, db, userAPI, nil)
+	admin := &userapi.Device{UserID: "@admin:localhost"}
+	erase := func(dryRun bool) (int, eraseUserMediaResponse) {
+		req := httptest.NewRequest(http.MethodPost, "/admin/eraseUserMedia/"+string(alice), nil)
+		req = mux.SetURLVars(req, map[string]string{"userID": string(alice)})
+		res := AdminEraseUserMedia(req, cfg, admin, db, takeouts, auditLog, dryRun)
+		if res.Code != http.StatusOK {
+			return res.Code, eraseUserMediaResponse{}
+		}
+		return res.Code, res.JSON.(eraseUserMediaResponse)
+	}
+
+	// The user hasn't been deactivated yet.
+	code, _ := erase(false)
+	assert.Equal(t, http.StatusBadRequest, code)
+	userAPI.devices = nil
+
+	// A dry run only lists the media.
+	code, res := erase(true)
+	assert.Equal(t, http.StatusOK, code)
+	assert.ElementsMatch(t, []types.MediaID{"alice1", "alice2"}, res.Deleted)
+	media, err := db.GetUserMedia(ctx, alice, "localhost", 10, 0)
+	assert.NoError(t, err)
+	assert.Len(t, media, 2)
+
+	code, res = erase(false)
+	assert.Equal(t, http.StatusOK, code)
+	assert.ElementsMatch(t, []types.MediaID{"alice1", "alice2"}, res.Deleted)
+	media, err = db.GetUserMedia(ctx, alice, "localhost", 10, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, media)
+	// Media uploaded by others with the same content is left alone.
+	metadata, err := db.GetMediaMetadata(ctx, "bob1", "localhost")
+	assert.NoError(t, err)
+	assert.NotNil(t, metadata)
+	quota, err := db.GetUploadQuota(ctx, alice)
+	assert.NoError(t, err)
+	assert.Nil(t, quota)
+
+	// The audit log no longer mentions the user, but records the erasure.
+	auditLog.flush(ctx, logger)
+	entries, err := db.GetAuditLog(ctx, &types.AuditLogFilter{UserID: alice}, 0, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+	entries, err = db.GetAuditLog(ctx, &types.AuditLogFilter{}, 0, 10)
+	assert.NoError(t, err)
+	if assert.NotEmpty(t, entries) {
+		assert.Equal(t, types.AuditErase, entries[0].Action)
+		assert.Equal(t, admin.UserID, string(entries[0].UserID))
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// MediaVerifyReport describes the problems found by verifying the media store.
+type MediaVerifyReport struct {
+	Repair bool `json:"repair"`
+	// How many files were checked
+	Checked int `json:"checked"`
+	// Files whose content doesn't match the hash in their path
+	Corrupted []types.Base64Hash `json:"corrupted"`
+	// Directories that contain thumbnails but not the file itself
+	MissingFiles []types.Base64Hash `json:"missing_files"`
+	// Files whose size doesn't match the size stored in their metadata
+	SizeMismatches []types.Base64Hash `json:"size_mismatches"`
+	// Files that no media metadata refers to, which are left for the media
+	// garbage collection to remove
+	Unreferenced []types.Base64Hash `json:"unreferenced"`
+}
+
+// VerifyMediaStore walks the media store, re-computes the SHA-256 hash of every
+// file and compares it to the hash the file is stored under and to the media
+// metadata referring to it. If repair is set, the metadata and directories of
+// corrupted and missing files are removed, so that remote media is fetched again
+// and local media returns a 404 rather than corrupted content.
+func VerifyMediaStore(
+	ctx context.Context,
+	cfg *config.MediaAPI,
+	db storage.Database,
+	repair bool,
+	logger *log.Entry,
+) (*MediaVerifyReport, error) {
+	remoteCacheEvictionMutex.Lock()
+	defer remoteCacheEvictionMutex.Unlock()
+
+	encryption, err := fileutils.NewEncryption(&cfg.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	report := &MediaVerifyReport{
+		Repair:         repair,
+		Corrupted:      []types.Base64Hash{},
+		MissingFiles:   []types.Base64Hash{},
+		SizeMismatches: []types.Base64Hash{},
+		Unreferenced:   []types.Base64Hash{},
+	}
+	// Skip directories that may belong to an upload or download that is still
+	// being moved into place.
+	cutoff := time.Now().Add(-mediaGCMinAge)
+	err = fileutils.WalkStoredFiles(cfg.AbsBasePath, cfg.StoreLayout, func(hash types.Base64Hash, dir string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		info, err := os.Stat(dir)
+		if err != nil {
+			return fmt.Errorf("os.Stat: %w", err)
+		}
+		if info.ModTime().After(cutoff) {
+			return nil
+		}
+		return verifyMediaFile(ctx, cfg, db, encryption, hash, dir, report, logger)
+	})
+	if err != nil {
+		return report, err
+	}
+
+	logger.WithFields(log.Fields{
+		"Repair":         repair,
+		"Checked":        report.Checked,
+		"Corrupted":      len(report.Corrupted),
+		"MissingFiles":   len(report.MissingFiles),
+		"SizeMismatches": len(report.SizeMismatches),
+		"Unreferenced":   len(report.Unreferenced),
+	}).Info("Verified media store")
+	return report, nil
+}
+
+// verifyMediaFile checks the file stored in dir under the given hash.
+func verifyMediaFile(
+	ctx context.Context,
+	cfg *config.MediaAPI,
+	db storage.Database,
+	encryption *fileutils.Encryption,
+	hash types.Base64Hash,
+	dir string,
+	report *MediaVerifyReport,
+	logger *log.Entry,
+) error {
+	logger = logger.WithField("Base64Hash", hash)
+	media, err := db.GetAllMediaByHash(ctx, hash)
+	if err != nil {
+		return fmt.Errorf("db.GetAllMediaByHash: %w", err)
+	}
+
+	actualHash, size, err := hashFile(fileutils.StoredFilePath(dir), encryption)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		report.MissingFiles = append(report.MissingFiles, hash)
+		logger.Warn("Media file is missing")
+		return repairMediaFile(ctx, cfg, db, hash, dir, media, report.Repair, logger)
+	case err != nil:
+		return err
+	}
+	report.Checked++
+
+	if actualHash != hash {
+		report.Corrupted = append(report.Corrupted, hash)
+		logger.WithField("ActualHash", actualHash).Warn("Media file is corrupted")
+		return repairMediaFile(ctx, cfg, db, hash, dir, media, report.Repair, logger)
+	}
+	if len(media) == 0 {
+		report.Unreferenced = append(report.Unreferenced, hash)
+		return nil
+	}
+	for _, mediaMetadata := range media {
+		if mediaMetadata.FileSizeBytes != size {
+			report.SizeMismatches = append(report.SizeMismatches, hash)
+			logger.WithFields(log.Fields{
+				"MediaID":       mediaMetadata.MediaID,
+				"Origin":        mediaMetadata.Origin,
+				"FileSizeBytes": mediaMetadata.FileSizeBytes,
+				"ActualSize":    size,
+			}).Warn("Media file size doesn't match its metadata")
+			break
+		}
+	}
+	return nil
+}
+
+// repairMediaFile removes the metadata referring to a corrupted or missing file,
+// and the directory it is stored in, unless the file is quarantined.
+func repairMediaFile(
+	ctx context.Context,
+	cfg *config.MediaAPI,
+	db storage.Database,
+	hash types.Base64Hash,
+	dir string,
+	media []*types.MediaMetadata,
+	repair bool,
+	logger *log.Entry,
+) error {
+	if !repair {
+		return nil
+	}
+	for _, mediaMetadata := range media {
+		if _, err := db.DeleteMediaMetadata(ctx, mediaMetadata.MediaID, mediaMetadata.Origin); err != nil {
+			return fmt.Errorf("db.DeleteMediaMetadata: %w", err)
+		}
+		logger.WithFields(log.Fields{
+			"MediaID": mediaMetadata.MediaID,
+			"Origin":  mediaMetadata.Origin,
+			"Remote":  mediaMetadata.Origin != cfg.Matrix.ServerName,
+		}).Info("Removed metadata of corrupted media")
+	}
+	// Quarantined files are kept as evidence.
+	quarantined, err := db.IsFileQuarantined(ctx, hash)
+	if err != nil {
+		return fmt.Errorf("db.IsFileQuarantined: %w", err)
+	}
+	if !quarantined {
+		fileutils.RemoveDir(types.Path(dir), logger)
+	}
+	return nil
+}
+
+// hashFile returns the Base64Hash and size of the content of the file.
+func hashFile(path string, encryption *fileutils.Encryption) (types.Base64Hash, types.FileSizeBytes, error) {
+	file, err := fileutils.OpenStoredFile(path, encryption)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close() // nolint: errcheck
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, file)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return types.Base64Hash(base64.RawURLEncoding.EncodeToString(hasher.Sum(nil))), types.FileSizeBytes(size), nil
+}
@@ -0,0 +1,112 @@
+package routing
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyMediaStore(t *testing.T) {
+	cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
+	db, err := storage.NewMediaAPIDatasource(cm, &config.DatabaseOptions{
+		ConnectionString:       "file::memory:",
+		MaxOpenConnections:     1,
+		MaxIdleConnections:     1,
+		ConnMaxLifetimeSeconds: -1,
+	})
+	assert.NoError(t, err)
+	ctx := context.Background()
+	logger := logrus.WithField("test", t.Name())
+
+	cfg := &config.MediaAPI{
+		Matrix:      &config.Global{},
+		AbsBasePath: config.Path(t.TempDir()),
+	}
+	cfg.Matrix.ServerName = "localhost"
+
+	old := time.Now().Add(-2 * mediaGCMinAge)
+	hashOf := func(content string) types.Base64Hash {
+		sum := sha256.Sum256([]byte(content))
+		return types.Base64Hash(base64.RawURLEncoding.EncodeToString(sum[:]))
+	}
+	// storeFile stores the content under the hash, along with metadata for it
+	// unless mediaID is empty.
+	storeFile := func(mediaID types.MediaID, hash types.Base64Hash, content string, size types.FileSizeBytes) string {
+		path, err := fileutils.GetPathFromBase64Hash(hash, cfg.AbsBasePath, cfg.StoreLayout)
+		assert.NoError(t, err)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0770))
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0660))
+		assert.NoError(t, os.Chtimes(filepath.Dir(path), old, old))
+		if mediaID != "" {
+			assert.NoError(t, db.StoreMediaMetadata(ctx, &types.MediaMetadata{
+				MediaID: mediaID, Origin: "localhost", Base64Hash: hash, FileSizeBytes: size,
+			}))
+		}
+		return path
+	}
+
+	goodHash := hashOf("good")
+	goodPath := storeFile("good", goodHash, "good", 4)
+	corruptedHash := hashOf("original")
+	corruptedPath := storeFile("corrupted", corruptedHash, "bitrot", 8)
+	wrongSizeHash := hashOf("wrongsize")
+	storeFile("wrongsize", wrongSizeHash, "wrongsize", 1)
+	unreferencedHash := hashOf("unreferenced")
+	unreferencedPath := storeFile("", unreferencedHash, "unreferenced", 0)
+	missingHash := hashOf("missing")
+	missingPath := storeFile("missing", missingHash, "missing", 7)
+	assert.NoError(t, os.Remove(missingPath))
+	assert.NoError(t, os.WriteFile(filepath.Join(filepath.Dir(missingPath), "thumbnail-32x32-crop"), nil, 0660))
+	assert.NoError(t, os.Chtimes(filepath.Dir(missingPath), old, old))
+
+	want := &MediaVerifyReport{
+		Checked:        4,
+		Corrupted:      []types.Base64Hash{corruptedHash},
+		MissingFiles:   []types.Base64Hash{missingHash},
+		SizeMismatches: []types.Base64Hash{wrongSizeHash},
+		Unreferenced:   []types.Base64Hash{unreferencedHash},
+	}
+
+	// without repairing, only problems are reported
+	report, err := VerifyMediaStore(ctx, cfg, db, false, logger)
+	assert.NoError(t, err)
+	assert.Equal(t, want, report)
+	_, err = os.Stat(corruptedPath)
+	assert.NoError(t, err)
+
+	want.Repair = true
+	report, err = VerifyMediaStore(ctx, cfg, db, true, logger)
+	assert.NoError(t, err)
+	assert.Equal(t, want, report)
+	for path, exists := range map[string]bool{
+		goodPath:                    true,
+		unreferencedPath:            true,
+		filepath.Dir(corruptedPath): false,
+		filepath.Dir(missingPath):   false,
+	} {
+		_, err = os.Stat(path)
+		assert.Equal(t, exists, err == nil, "unexpected existence of %s", path)
+	}
+	for mediaID, exists := range map[types.MediaID]bool{
+		"good":      true,
+		"wrongsize": true,
+		"corrupted": false,
+		"missing":   false,
+	} {
+		metadata, err := db.GetMediaMetadata(ctx, mediaID, "localhost")
+		assert.NoError(t, err)
+		assert.Equal(t, exists, metadata != nil, "unexpected existence of metadata for %s", mediaID)
+	}
+}
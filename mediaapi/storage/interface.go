@@ -24,12 +24,35 @@ import (
 type Database interface {
 	MediaRepository
 	Thumbnails
+	UploadQuotas
+	MaxUploadSizes
+	Quarantine
+	BlockedHashes
+	BlockedOrigins
+	SecondaryHashes
+	AuditLog
+	// Ping checks that the database can be reached.
+	Ping(ctx context.Context) error
 }
 
 type MediaRepository interface {
 	StoreMediaMetadata(ctx context.Context, mediaMetadata *types.MediaMetadata) error
 	GetMediaMetadata(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName) (*types.MediaMetadata, error)
 	GetMediaMetadataByHash(ctx context.Context, mediaHash types.Base64Hash, mediaOrigin spec.ServerName) (*types.MediaMetadata, error)
+	UpdateMediaLastAccess(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName) error
+	UpdateMediaLastAccesses(ctx context.Context, accesses []types.MediaAccess) error
+	GetRemoteMediaCacheSize(ctx context.Context, localOrigin spec.ServerName) (types.FileSizeBytes, error)
+	GetLeastRecentlyAccessedRemoteMedia(ctx context.Context, localOrigin spec.ServerName, limit int) ([]*types.MediaMetadata, error)
+	GetRemoteMediaCachedBefore(ctx context.Context, localOrigin spec.ServerName, before spec.Timestamp, limit int) ([]*types.MediaMetadata, error)
+	GetMediaCreatedBefore(ctx context.Context, localOrigin spec.ServerName, remote bool, before spec.Timestamp, limit, offset int) ([]*types.MediaMetadata, error)
+	GetUserMedia(ctx context.Context, userID types.MatrixUserID, mediaOrigin spec.ServerName, limit, offset int) ([]*types.MediaMetadata, error)
+	GetAllMediaByHash(ctx context.Context, mediaHash types.Base64Hash) ([]*types.MediaMetadata, error)
+	GetMediaCountByHash(ctx context.Context, mediaHash types.Base64Hash) (int, error)
+	DeleteMediaMetadata(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName) (unreferenced bool, err error)
+	ReplaceMediaMetadata(ctx context.Context, mediaMetadata *types.MediaMetadata) (unreferenced bool, err error)
+	// RemoveUnreferencedFile calls remove if no media refers to the file with the hash and it isn't quarantined.
+	RemoveUnreferencedFile(ctx context.Context, mediaHash types.Base64Hash, remove func() error) (removed bool, err error)
+	ScrubUserData(ctx context.Context, userID types.MatrixUserID) error
 }
 
 type Thumbnails interface {
@@ -37,3 +60,54 @@ type Thumbnails interface {
 	GetThumbnail(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName, width, height int, resizeMethod string) (*types.ThumbnailMetadata, error)
 	GetThumbnails(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName) ([]*types.ThumbnailMetadata, error)
 }
+
+type UploadQuotas interface {
+	GetUserUploadSize(ctx context.Context, userID types.MatrixUserID, mediaOrigin spec.ServerName) (types.FileSizeBytes, error)
+	GetUploadQuota(ctx context.Context, userID types.MatrixUserID) (*types.FileSizeBytes, error)
+	SetUploadQuota(ctx context.Context, userID types.MatrixUserID, quotaBytes types.FileSizeBytes) error
+	DeleteUploadQuota(ctx context.Context, userID types.MatrixUserID) error
+}
+
+type MaxUploadSizes interface {
+	GetMaxUploadSize(ctx context.Context, userID types.MatrixUserID) (*types.FileSizeBytes, error)
+	SetMaxUploadSize(ctx context.Context, userID types.MatrixUserID, maxFileSizeBytes types.FileSizeBytes) error
+	DeleteMaxUploadSize(ctx context.Context, userID types.MatrixUserID) error
+}
+
+type Quarantine interface {
+	QuarantineMedia(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName, mediaHash types.Base64Hash, quarantinedBy types.MatrixUserID) error
+	UnquarantineMedia(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName) error
+	IsMediaQuarantined(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName) (bool, error)
+	QuarantineHash(ctx context.Context, mediaHash types.Base64Hash, quarantinedBy types.MatrixUserID) error
+	UnquarantineHash(ctx context.Context, mediaHash types.Base64Hash) error
+	IsHashQuarantined(ctx context.Context, mediaHash types.Base64Hash) (bool, error)
+	IsFileQuarantined(ctx context.Context, mediaHash types.Base64Hash) (bool, error)
+	IsAnyFileQuarantined(ctx context.Context) (bool, error)
+}
+
+type BlockedHashes interface {
+	BlockHash(ctx context.Context, mediaHash types.Base64Hash, reason string, blockedBy types.MatrixUserID) error
+	UnblockHash(ctx context.Context, mediaHash types.Base64Hash) error
+	IsHashBlocked(ctx context.Context, mediaHash types.Base64Hash) (bool, error)
+	IsAnyHashBlocked(ctx context.Context) (bool, error)
+	GetBlockedHashes(ctx context.Context) ([]*types.BlockedHash, error)
+}
+
+type BlockedOrigins interface {
+	BlockOrigin(ctx context.Context, serverName spec.ServerName, reason string, blockedBy types.MatrixUserID) error
+	UnblockOrigin(ctx context.Context, serverName spec.ServerName) error
+	IsOriginBlocked(ctx context.Context, serverName spec.ServerName) (bool, error)
+	GetBlockedOrigins(ctx context.Context) ([]*types.BlockedOrigin, error)
+}
+
+type AuditLog interface {
+	StoreAuditLogEntries(ctx context.Context, entries []*types.AuditLogEntry) error
+	GetAuditLog(ctx context.Context, filter *types.AuditLogFilter, before int64, limit int) ([]*types.AuditLogEntry, error)
+	RedactAuditLogBefore(ctx context.Context, ts spec.Timestamp) error
+	DeleteAuditLogBefore(ctx context.Context, ts spec.Timestamp) (int64, error)
+}
+
+type SecondaryHashes interface {
+	GetSecondaryHashes(ctx context.Context, mediaHash types.Base64Hash) (map[string]string, error)
+	GetHashesBySecondaryHash(ctx context.Context, algorithm, secondaryHash string) ([]types.Base64Hash, error)
+}
@@ -0,0 +1,197 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var metadataCacheLookups = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "mediaapi",
+		Name:      "metadata_cache_lookups_total",
+		Help:      "The number of media metadata lookups by whether they were answered from the cache",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(metadataCacheLookups)
+}
+
+// NewMetadataCachingDatabase returns the database with media metadata lookups
+// cached as configured, or the database itself if the cache is disabled.
+func NewMetadataCachingDatabase(db Database, cfg *config.MediaMetadataCache) Database {
+	if !cfg.Enabled {
+		return db
+	}
+	return &metadataCachingDatabase{
+		Database: db,
+		cache:    newMetadataCache(cfg.MaxEntries, cfg.MaxAge),
+	}
+}
+
+// metadataCachingDatabase answers GetMediaMetadata from a cache, and
+// invalidates the entry of media whenever it is stored, deleted, replaced,
+// quarantined or unquarantined.
+type metadataCachingDatabase struct {
+	Database
+	cache *metadataCache
+}
+
+func (d *metadataCachingDatabase) GetMediaMetadata(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName) (*types.MediaMetadata, error) {
+	key := metadataCacheKey{mediaOrigin, mediaID}
+	if metadata, ok := d.cache.get(key, time.Now()); ok {
+		metadataCacheLookups.WithLabelValues("hit").Inc()
+		return metadata, nil
+	}
+	metadataCacheLookups.WithLabelValues("miss").Inc()
+	generation := d.cache.generation()
+	metadata, err := d.Database.GetMediaMetadata(ctx, mediaID, mediaOrigin)
+	if err == nil && metadata != nil {
+		d.cache.set(key, metadata, generation, time.Now())
+	}
+	return metadata, err
+}
+
+func (d *metadataCachingDatabase) StoreMediaMetadata(ctx context.Context, mediaMetadata *types.MediaMetadata) error {
+	defer d.cache.invalidate(metadataCacheKey{mediaMetadata.Origin, mediaMetadata.MediaID})
+	return d.Database.StoreMediaMetadata(ctx, mediaMetadata)
+}
+
+func (d *metadataCachingDatabase) DeleteMediaMetadata(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName) (bool, error) {
+	defer d.cache.invalidate(metadataCacheKey{mediaOrigin, mediaID})
+	return d.Database.DeleteMediaMetadata(ctx, mediaID, mediaOrigin)
+}
+
+func (d *metadataCachingDatabase) ReplaceMediaMetadata(ctx context.Context, mediaMetadata *types.MediaMetadata) (bool, error) {
+	defer d.cache.invalidate(metadataCacheKey{mediaMetadata.Origin, mediaMetadata.MediaID})
+	return d.Database.ReplaceMediaMetadata(ctx, mediaMetadata)
+}
+
+func (d *metadataCachingDatabase) QuarantineMedia(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName, mediaHash types.Base64Hash, quarantinedBy types.MatrixUserID,
+) error {
+	defer d.cache.invalidate(metadataCacheKey{mediaOrigin, mediaID})
+	return d.Database.QuarantineMedia(ctx, mediaID, mediaOrigin, mediaHash, quarantinedBy)
+}
+
+func (d *metadataCachingDatabase) UnquarantineMedia(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName) error {
+	defer d.cache.invalidate(metadataCacheKey{mediaOrigin, mediaID})
+	return d.Database.UnquarantineMedia(ctx, mediaID, mediaOrigin)
+}
+
+type metadataCacheKey struct {
+	origin  spec.ServerName
+	mediaID types.MediaID
+}
+
+type metadataCacheEntry struct {
+	key      metadataCacheKey
+	metadata types.MediaMetadata
+	expires  time.Time
+}
+
+// metadataCache is a least recently used cache of media metadata with a
+// maximum age.
+type metadataCache struct {
+	maxEntries int
+	maxAge     time.Duration
+
+	mu      sync.Mutex
+	entries map[metadataCacheKey]*list.Element
+	// The entries, most recently used first.
+	order *list.List
+	// Incremented by every invalidation, so that metadata looked up before one
+	// isn't cached after it.
+	invalidations uint64
+}
+
+func newMetadataCache(maxEntries int, maxAge time.Duration) *metadataCache {
+	return &metadataCache{
+		maxEntries: maxEntries,
+		maxAge:     maxAge,
+		entries:    make(map[metadataCacheKey]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// get returns a copy of the cached metadata, so that callers can't change it.
+func (c *metadataCache) get(key metadataCacheKey, now time.Time) (*types.MediaMetadata, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*metadataCacheEntry)
+	if now.After(entry.expires) {
+		c.remove(element)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	metadata := entry.metadata
+	return &metadata, true
+}
+
+// generation returns the number of invalidations so far, to pass to set.
+func (c *metadataCache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.invalidations
+}
+
+// set caches a copy of the metadata, unless the cache has been invalidated
+// since the given generation, in which case the metadata may be stale.
+func (c *metadataCache) set(key metadataCacheKey, metadata *types.MediaMetadata, generation uint64, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.invalidations != generation {
+		return
+	}
+	entry := &metadataCacheEntry{key: key, metadata: *metadata, expires: now.Add(c.maxAge)}
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.maxEntries {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *metadataCache) invalidate(key metadataCacheKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidations++
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+}
+
+func (c *metadataCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*metadataCacheEntry).key)
+}
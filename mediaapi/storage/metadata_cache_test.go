@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetadataCache(t *testing.T) {
+	cache := newMetadataCache(2, time.Minute)
+	now := time.Now()
+	keyA := metadataCacheKey{"localhost", "a"}
+	keyB := metadataCacheKey{"localhost", "b"}
+	keyC := metadataCacheKey{"remote", "a"}
+
+	cache.set(keyA, &types.MediaMetadata{MediaID: "a"}, cache.generation(), now)
+	cache.set(keyB, &types.MediaMetadata{MediaID: "b"}, cache.generation(), now)
+	metadata, ok := cache.get(keyA, now)
+	if assert.True(t, ok) {
+		assert.Equal(t, types.MediaID("a"), metadata.MediaID)
+	}
+
+	// The least recently used entry is evicted once the cache is full.
+	cache.set(keyC, &types.MediaMetadata{MediaID: "a", Origin: "remote"}, cache.generation(), now)
+	_, ok = cache.get(keyB, now)
+	assert.False(t, ok)
+	_, ok = cache.get(keyA, now)
+	assert.True(t, ok)
+
+	// Entries expire after the maximum age.
+	_, ok = cache.get(keyC, now.Add(2*time.Minute))
+	assert.False(t, ok)
+
+	// Metadata looked up before an invalidation isn't cached.
+	generation := cache.generation()
+	cache.invalidate(keyA)
+	_, ok = cache.get(keyA, now)
+	assert.False(t, ok)
+	cache.set(keyA, &types.MediaMetadata{MediaID: "a"}, generation, now)
+	_, ok = cache.get(keyA, now)
+	assert.False(t, ok)
+}
@@ -0,0 +1,155 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/storage/tables"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+const auditLogSchema = `
+-- The mediaapi_audit_log table records who uploaded, downloaded, deleted or
+-- quarantined which media, and when.
+CREATE TABLE IF NOT EXISTS mediaapi_audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    -- When the action was taken.
+    ts BIGINT NOT NULL,
+    -- What was done, e.g. "upload" or "quarantine".
+    action TEXT NOT NULL,
+    -- The media the action was taken on, empty for actions on a file hash.
+    media_id TEXT NOT NULL,
+    media_origin TEXT NOT NULL,
+    -- The file hash the action was taken on, if known.
+    base64hash TEXT NOT NULL,
+    -- The user who took the action, empty if not known or redacted.
+    user_id TEXT NOT NULL,
+    -- The IP address the action was taken from, empty if not known or redacted.
+    ip_address TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS mediaapi_audit_log_ts_idx ON mediaapi_audit_log(ts);
+CREATE INDEX IF NOT EXISTS mediaapi_audit_log_media_idx ON mediaapi_audit_log(media_origin, media_id);
+CREATE INDEX IF NOT EXISTS mediaapi_audit_log_user_idx ON mediaapi_audit_log(user_id);
+`
+
+const insertAuditLogEntrySQL = `
+INSERT INTO mediaapi_audit_log (ts, action, media_id, media_origin, base64hash, user_id, ip_address)
+    VALUES ($1, $2, $3, $4, $5, $6, $7)
+`
+
+const selectAuditLogSQL = `
+SELECT id, ts, action, media_id, media_origin, base64hash, user_id, ip_address FROM mediaapi_audit_log
+    WHERE ($1 = '' OR user_id = $1) AND ($2 = '' OR media_origin = $2) AND ($3 = '' OR media_id = $3)
+    AND ($4::BIGINT = 0 OR id < $4::BIGINT)
+    ORDER BY id DESC LIMIT $5
+`
+
+const redactAuditLogBeforeSQL = `
+UPDATE mediaapi_audit_log SET user_id = '', ip_address = '' WHERE ts < $1 AND (user_id != '' OR ip_address != '')
+`
+
+const redactAuditLogUserSQL = `
+UPDATE mediaapi_audit_log SET user_id = '', ip_address = '' WHERE user_id = $1
+`
+
+const deleteAuditLogBeforeSQL = `
+DELETE FROM mediaapi_audit_log WHERE ts < $1
+`
+
+type auditLogStatements struct {
+	insertAuditLogEntryStmt  *sql.Stmt
+	selectAuditLogStmt       *sql.Stmt
+	redactAuditLogBeforeStmt *sql.Stmt
+	redactAuditLogUserStmt   *sql.Stmt
+	deleteAuditLogBeforeStmt *sql.Stmt
+}
+
+func NewPostgresAuditLogTable(db *sql.DB) (tables.AuditLog, error) {
+	s := &auditLogStatements{}
+	_, err := db.Exec(auditLogSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.insertAuditLogEntryStmt, insertAuditLogEntrySQL},
+		{&s.selectAuditLogStmt, selectAuditLogSQL},
+		{&s.redactAuditLogBeforeStmt, redactAuditLogBeforeSQL},
+		{&s.redactAuditLogUserStmt, redactAuditLogUserSQL},
+		{&s.deleteAuditLogBeforeStmt, deleteAuditLogBeforeSQL},
+	}.Prepare(db)
+}
+
+func (s *auditLogStatements) InsertAuditLogEntry(
+	ctx context.Context, txn *sql.Tx, entry *types.AuditLogEntry,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.insertAuditLogEntryStmt).ExecContext(
+		ctx, entry.TS, entry.Action, entry.MediaID, entry.Origin, entry.Base64Hash, entry.UserID, entry.IPAddress,
+	)
+	return err
+}
+
+func (s *auditLogStatements) SelectAuditLog(
+	ctx context.Context, txn *sql.Tx, filter *types.AuditLogFilter, before int64, limit int,
+) ([]*types.AuditLogEntry, error) {
+	rows, err := sqlutil.TxStmtContext(ctx, txn, s.selectAuditLogStmt).QueryContext(
+		ctx, filter.UserID, filter.Origin, filter.MediaID, before, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectAuditLog: failed to close rows")
+	var entries []*types.AuditLogEntry
+	for rows.Next() {
+		entry := &types.AuditLogEntry{}
+		if err = rows.Scan(
+			&entry.ID, &entry.TS, &entry.Action, &entry.MediaID, &entry.Origin,
+			&entry.Base64Hash, &entry.UserID, &entry.IPAddress,
+		); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (s *auditLogStatements) RedactAuditLogBefore(
+	ctx context.Context, txn *sql.Tx, ts spec.Timestamp,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.redactAuditLogBeforeStmt).ExecContext(ctx, ts)
+	return err
+}
+
+func (s *auditLogStatements) RedactAuditLogUser(
+	ctx context.Context, txn *sql.Tx, userID types.MatrixUserID,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.redactAuditLogUserStmt).ExecContext(ctx, userID)
+	return err
+}
+
+func (s *auditLogStatements) DeleteAuditLogBefore(
+	ctx context.Context, txn *sql.Tx, ts spec.Timestamp,
+) (int64, error) {
+	res, err := sqlutil.TxStmtContext(ctx, txn, s.deleteAuditLogBeforeStmt).ExecContext(ctx, ts)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
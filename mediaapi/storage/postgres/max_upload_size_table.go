@@ -0,0 +1,89 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/storage/tables"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+const maxUploadSizeSchema = `
+-- The mediaapi_max_upload_size table holds the maximum upload sizes set by
+-- admins for individual users, overriding max_file_size_bytes.
+CREATE TABLE IF NOT EXISTS mediaapi_max_upload_size (
+    -- The local user the limit applies to.
+    user_id TEXT NOT NULL PRIMARY KEY,
+    -- The maximum size of a single file the user may upload, 0 for unlimited.
+    max_file_size_bytes BIGINT NOT NULL
+);
+`
+
+const upsertMaxUploadSizeSQL = `
+INSERT INTO mediaapi_max_upload_size (user_id, max_file_size_bytes) VALUES ($1, $2)
+    ON CONFLICT (user_id) DO UPDATE SET max_file_size_bytes = $2
+`
+
+const selectMaxUploadSizeSQL = `
+SELECT max_file_size_bytes FROM mediaapi_max_upload_size WHERE user_id = $1
+`
+
+const deleteMaxUploadSizeSQL = `
+DELETE FROM mediaapi_max_upload_size WHERE user_id = $1
+`
+
+type maxUploadSizeStatements struct {
+	upsertMaxUploadSizeStmt *sql.Stmt
+	selectMaxUploadSizeStmt *sql.Stmt
+	deleteMaxUploadSizeStmt *sql.Stmt
+}
+
+func NewPostgresMaxUploadSizesTable(db *sql.DB) (tables.MaxUploadSizes, error) {
+	s := &maxUploadSizeStatements{}
+	_, err := db.Exec(maxUploadSizeSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.upsertMaxUploadSizeStmt, upsertMaxUploadSizeSQL},
+		{&s.selectMaxUploadSizeStmt, selectMaxUploadSizeSQL},
+		{&s.deleteMaxUploadSizeStmt, deleteMaxUploadSizeSQL},
+	}.Prepare(db)
+}
+
+func (s *maxUploadSizeStatements) UpsertMaxUploadSize(
+	ctx context.Context, txn *sql.Tx, userID types.MatrixUserID, maxFileSizeBytes types.FileSizeBytes,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.upsertMaxUploadSizeStmt).ExecContext(ctx, userID, maxFileSizeBytes)
+	return err
+}
+
+func (s *maxUploadSizeStatements) SelectMaxUploadSize(
+	ctx context.Context, txn *sql.Tx, userID types.MatrixUserID,
+) (maxFileSizeBytes types.FileSizeBytes, err error) {
+	err = sqlutil.TxStmtContext(ctx, txn, s.selectMaxUploadSizeStmt).QueryRowContext(ctx, userID).Scan(&maxFileSizeBytes)
+	return
+}
+
+func (s *maxUploadSizeStatements) DeleteMaxUploadSize(
+	ctx context.Context, txn *sql.Tx, userID types.MatrixUserID,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.deleteMaxUploadSizeStmt).ExecContext(ctx, userID)
+	return err
+}
@@ -20,7 +20,9 @@ import (
 	"database/sql"
 	"time"
 
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/storage/postgres/deltas"
 	"github.com/matrix-org/dendrite/mediaapi/storage/tables"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/gomatrixserverlib/spec"
@@ -47,28 +49,95 @@ CREATE TABLE IF NOT EXISTS mediaapi_media_repository (
     -- Alternate RFC 4648 unpadded base64 encoding string representation of a SHA-256 hash sum of the file data.
     base64hash TEXT NOT NULL,
     -- The user who uploaded the file. Should be a Matrix user ID.
-    user_id TEXT NOT NULL
+    user_id TEXT NOT NULL,
+    -- When the media was last downloaded or thumbnailed in UNIX epoch ms.
+    last_access_ts BIGINT NOT NULL DEFAULT 0,
+    -- The content coding the file is compressed with in the media store, or empty if it isn't compressed.
+    stored_encoding TEXT NOT NULL DEFAULT ''
 );
 CREATE UNIQUE INDEX IF NOT EXISTS mediaapi_media_repository_index ON mediaapi_media_repository (media_id, media_origin);
 `
 
 const insertMediaSQL = `
-INSERT INTO mediaapi_media_repository (media_id, media_origin, content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id)
-    VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+INSERT INTO mediaapi_media_repository (media_id, media_origin, content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id, last_access_ts, stored_encoding)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $5, $9)
 `
 
 const selectMediaSQL = `
-SELECT content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id FROM mediaapi_media_repository WHERE media_id = $1 AND media_origin = $2
+SELECT content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id, stored_encoding FROM mediaapi_media_repository WHERE media_id = $1 AND media_origin = $2
 `
 
 const selectMediaByHashSQL = `
-SELECT content_type, file_size_bytes, creation_ts, upload_name, media_id, user_id FROM mediaapi_media_repository WHERE base64hash = $1 AND media_origin = $2
+SELECT content_type, file_size_bytes, creation_ts, upload_name, media_id, user_id, stored_encoding FROM mediaapi_media_repository WHERE base64hash = $1 AND media_origin = $2
+`
+
+const updateMediaLastAccessSQL = `
+UPDATE mediaapi_media_repository SET last_access_ts = $3 WHERE media_id = $1 AND media_origin = $2
+`
+
+const selectRemoteMediaSizeSQL = `
+SELECT COALESCE(SUM(file_size_bytes), 0) FROM mediaapi_media_repository WHERE media_origin <> $1
+`
+
+// Note: this only selects media from other servers, as local media is never evicted
+const selectRemoteMediaByLastAccessSQL = `
+SELECT media_id, media_origin, content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id FROM mediaapi_media_repository
+    WHERE media_origin <> $1 ORDER BY last_access_ts ASC LIMIT $2
+`
+
+// Note: this only selects media from other servers, as local media never expires
+const selectRemoteMediaCreatedBeforeSQL = `
+SELECT media_id, media_origin, content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id FROM mediaapi_media_repository
+    WHERE media_origin <> $1 AND creation_ts < $2 ORDER BY creation_ts ASC LIMIT $3
+`
+
+const selectLocalMediaCreatedBeforeSQL = `
+SELECT media_id, media_origin, content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id FROM mediaapi_media_repository
+    WHERE media_origin = $1 AND creation_ts < $2 ORDER BY creation_ts ASC, media_id ASC LIMIT $3 OFFSET $4
+`
+
+const selectRemoteMediaCreatedBeforeWithOffsetSQL = `
+SELECT media_id, media_origin, content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id FROM mediaapi_media_repository
+    WHERE media_origin <> $1 AND creation_ts < $2 ORDER BY creation_ts ASC, media_origin ASC, media_id ASC LIMIT $3 OFFSET $4
+`
+
+const selectUserMediaSQL = `
+SELECT media_id, media_origin, content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id, last_access_ts, stored_encoding FROM mediaapi_media_repository
+    WHERE user_id = $1 AND media_origin = $2 ORDER BY creation_ts DESC, media_id ASC LIMIT $3 OFFSET $4
+`
+
+const selectUserMediaSizeSQL = `
+SELECT COALESCE(SUM(file_size_bytes), 0) FROM mediaapi_media_repository WHERE user_id = $1 AND media_origin = $2
+`
+
+const selectAllMediaByHashSQL = `
+SELECT media_id, media_origin, content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id FROM mediaapi_media_repository
+    WHERE base64hash = $1
+`
+
+const scrubUserMediaSQL = `
+UPDATE mediaapi_media_repository SET user_id = '', upload_name = '' WHERE user_id = $1
+`
+
+const deleteMediaSQL = `
+DELETE FROM mediaapi_media_repository WHERE media_id = $1 AND media_origin = $2
 `
 
 type mediaStatements struct {
-	insertMediaStmt       *sql.Stmt
-	selectMediaStmt       *sql.Stmt
-	selectMediaByHashStmt *sql.Stmt
+	insertMediaStmt                    *sql.Stmt
+	selectMediaStmt                    *sql.Stmt
+	selectMediaByHashStmt              *sql.Stmt
+	updateMediaLastAccessStmt          *sql.Stmt
+	selectRemoteMediaSizeStmt          *sql.Stmt
+	selectRemoteMediaByLastAccessStmt  *sql.Stmt
+	selectRemoteMediaCreatedBeforeStmt *sql.Stmt
+	selectLocalMediaCreatedBeforeStmt  *sql.Stmt
+	selectRemoteMediaWithOffsetStmt    *sql.Stmt
+	selectUserMediaStmt                *sql.Stmt
+	selectUserMediaSizeStmt            *sql.Stmt
+	selectAllMediaByHashStmt           *sql.Stmt
+	scrubUserMediaStmt                 *sql.Stmt
+	deleteMediaStmt                    *sql.Stmt
 }
 
 func NewPostgresMediaRepositoryTable(db *sql.DB) (tables.MediaRepository, error) {
@@ -78,17 +147,43 @@ func NewPostgresMediaRepositoryTable(db *sql.DB) (tables.MediaRepository, error)
 		return nil, err
 	}
 
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(sqlutil.Migration{
+		Version: "mediaapi: add last access timestamp",
+		Up:      deltas.UpAddLastAccessTS,
+	}, sqlutil.Migration{
+		Version: "mediaapi: add stored encoding",
+		Up:      deltas.UpAddStoredEncoding,
+	})
+	if err = m.Up(context.Background()); err != nil {
+		return nil, err
+	}
+
 	return s, sqlutil.StatementList{
 		{&s.insertMediaStmt, insertMediaSQL},
 		{&s.selectMediaStmt, selectMediaSQL},
 		{&s.selectMediaByHashStmt, selectMediaByHashSQL},
+		{&s.updateMediaLastAccessStmt, updateMediaLastAccessSQL},
+		{&s.selectRemoteMediaSizeStmt, selectRemoteMediaSizeSQL},
+		{&s.selectRemoteMediaByLastAccessStmt, selectRemoteMediaByLastAccessSQL},
+		{&s.selectRemoteMediaCreatedBeforeStmt, selectRemoteMediaCreatedBeforeSQL},
+		{&s.selectLocalMediaCreatedBeforeStmt, selectLocalMediaCreatedBeforeSQL},
+		{&s.selectRemoteMediaWithOffsetStmt, selectRemoteMediaCreatedBeforeWithOffsetSQL},
+		{&s.selectUserMediaStmt, selectUserMediaSQL},
+		{&s.selectUserMediaSizeStmt, selectUserMediaSizeSQL},
+		{&s.selectAllMediaByHashStmt, selectAllMediaByHashSQL},
+		{&s.scrubUserMediaStmt, scrubUserMediaSQL},
+		{&s.deleteMediaStmt, deleteMediaSQL},
 	}.Prepare(db)
 }
 
 func (s *mediaStatements) InsertMedia(
 	ctx context.Context, txn *sql.Tx, mediaMetadata *types.MediaMetadata,
 ) error {
-	mediaMetadata.CreationTimestamp = spec.AsTimestamp(time.Now())
+	// Imported media keeps the time it was originally created.
+	if mediaMetadata.CreationTimestamp == 0 {
+		mediaMetadata.CreationTimestamp = spec.AsTimestamp(time.Now())
+	}
 	_, err := sqlutil.TxStmtContext(ctx, txn, s.insertMediaStmt).ExecContext(
 		ctx,
 		mediaMetadata.MediaID,
@@ -99,6 +194,7 @@ func (s *mediaStatements) InsertMedia(
 		mediaMetadata.UploadName,
 		mediaMetadata.Base64Hash,
 		mediaMetadata.UserID,
+		mediaMetadata.StoredEncoding,
 	)
 	return err
 }
@@ -119,6 +215,7 @@ func (s *mediaStatements) SelectMedia(
 		&mediaMetadata.UploadName,
 		&mediaMetadata.Base64Hash,
 		&mediaMetadata.UserID,
+		&mediaMetadata.StoredEncoding,
 	)
 	return &mediaMetadata, err
 }
@@ -139,6 +236,157 @@ func (s *mediaStatements) SelectMediaByHash(
 		&mediaMetadata.UploadName,
 		&mediaMetadata.MediaID,
 		&mediaMetadata.UserID,
+		&mediaMetadata.StoredEncoding,
 	)
 	return &mediaMetadata, err
 }
+
+func (s *mediaStatements) UpdateMediaLastAccess(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName, lastAccessTS spec.Timestamp,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.updateMediaLastAccessStmt).ExecContext(
+		ctx, mediaID, mediaOrigin, lastAccessTS,
+	)
+	return err
+}
+
+func (s *mediaStatements) SelectRemoteMediaSize(
+	ctx context.Context, txn *sql.Tx, localOrigin spec.ServerName,
+) (size types.FileSizeBytes, err error) {
+	err = sqlutil.TxStmtContext(ctx, txn, s.selectRemoteMediaSizeStmt).QueryRowContext(
+		ctx, localOrigin,
+	).Scan(&size)
+	return
+}
+
+func (s *mediaStatements) SelectRemoteMediaByLastAccess(
+	ctx context.Context, txn *sql.Tx, localOrigin spec.ServerName, limit int,
+) ([]*types.MediaMetadata, error) {
+	rows, err := sqlutil.TxStmtContext(ctx, txn, s.selectRemoteMediaByLastAccessStmt).QueryContext(
+		ctx, localOrigin, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectRemoteMediaByLastAccess: failed to close rows")
+	return scanMedia(rows)
+}
+
+func (s *mediaStatements) SelectRemoteMediaCreatedBefore(
+	ctx context.Context, txn *sql.Tx, localOrigin spec.ServerName, before spec.Timestamp, limit int,
+) ([]*types.MediaMetadata, error) {
+	rows, err := sqlutil.TxStmtContext(ctx, txn, s.selectRemoteMediaCreatedBeforeStmt).QueryContext(
+		ctx, localOrigin, before, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectRemoteMediaCreatedBefore: failed to close rows")
+	return scanMedia(rows)
+}
+
+func (s *mediaStatements) SelectMediaCreatedBefore(
+	ctx context.Context, txn *sql.Tx, localOrigin spec.ServerName, remote bool, before spec.Timestamp, limit, offset int,
+) ([]*types.MediaMetadata, error) {
+	stmt := s.selectLocalMediaCreatedBeforeStmt
+	if remote {
+		stmt = s.selectRemoteMediaWithOffsetStmt
+	}
+	rows, err := sqlutil.TxStmtContext(ctx, txn, stmt).QueryContext(
+		ctx, localOrigin, before, limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectMediaCreatedBefore: failed to close rows")
+	return scanMedia(rows)
+}
+
+func (s *mediaStatements) SelectUserMedia(
+	ctx context.Context, txn *sql.Tx, userID types.MatrixUserID, mediaOrigin spec.ServerName, limit, offset int,
+) ([]*types.MediaMetadata, error) {
+	rows, err := sqlutil.TxStmtContext(ctx, txn, s.selectUserMediaStmt).QueryContext(
+		ctx, userID, mediaOrigin, limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectUserMedia: failed to close rows")
+	var media []*types.MediaMetadata
+	for rows.Next() {
+		mediaMetadata := &types.MediaMetadata{}
+		if err = rows.Scan(
+			&mediaMetadata.MediaID,
+			&mediaMetadata.Origin,
+			&mediaMetadata.ContentType,
+			&mediaMetadata.FileSizeBytes,
+			&mediaMetadata.CreationTimestamp,
+			&mediaMetadata.UploadName,
+			&mediaMetadata.Base64Hash,
+			&mediaMetadata.UserID,
+			&mediaMetadata.LastAccessTimestamp,
+			&mediaMetadata.StoredEncoding,
+		); err != nil {
+			return nil, err
+		}
+		media = append(media, mediaMetadata)
+	}
+	return media, rows.Err()
+}
+
+func scanMedia(rows *sql.Rows) ([]*types.MediaMetadata, error) {
+	var media []*types.MediaMetadata
+	for rows.Next() {
+		mediaMetadata := &types.MediaMetadata{}
+		if err := rows.Scan(
+			&mediaMetadata.MediaID,
+			&mediaMetadata.Origin,
+			&mediaMetadata.ContentType,
+			&mediaMetadata.FileSizeBytes,
+			&mediaMetadata.CreationTimestamp,
+			&mediaMetadata.UploadName,
+			&mediaMetadata.Base64Hash,
+			&mediaMetadata.UserID,
+		); err != nil {
+			return nil, err
+		}
+		media = append(media, mediaMetadata)
+	}
+	return media, rows.Err()
+}
+
+func (s *mediaStatements) SelectUserMediaSize(
+	ctx context.Context, txn *sql.Tx, userID types.MatrixUserID, mediaOrigin spec.ServerName,
+) (size types.FileSizeBytes, err error) {
+	err = sqlutil.TxStmtContext(ctx, txn, s.selectUserMediaSizeStmt).QueryRowContext(
+		ctx, userID, mediaOrigin,
+	).Scan(&size)
+	return
+}
+
+func (s *mediaStatements) SelectAllMediaByHash(
+	ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash,
+) ([]*types.MediaMetadata, error) {
+	rows, err := sqlutil.TxStmtContext(ctx, txn, s.selectAllMediaByHashStmt).QueryContext(ctx, mediaHash)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectAllMediaByHash: failed to close rows")
+	return scanMedia(rows)
+}
+
+func (s *mediaStatements) DeleteMedia(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.deleteMediaStmt).ExecContext(
+		ctx, mediaID, mediaOrigin,
+	)
+	return err
+}
+
+func (s *mediaStatements) ScrubUserMedia(
+	ctx context.Context, txn *sql.Tx, userID types.MatrixUserID,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.scrubUserMediaStmt).ExecContext(ctx, userID)
+	return err
+}
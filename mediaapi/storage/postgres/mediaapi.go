@@ -33,13 +33,53 @@ func NewDatabase(conMan *sqlutil.Connections, dbProperties *config.DatabaseOptio
 	if err != nil {
 		return nil, err
 	}
+	storedFiles, err := NewPostgresStoredFilesTable(db)
+	if err != nil {
+		return nil, err
+	}
 	thumbnails, err := NewPostgresThumbnailsTable(db)
 	if err != nil {
 		return nil, err
 	}
+	uploadQuotas, err := NewPostgresUploadQuotasTable(db)
+	if err != nil {
+		return nil, err
+	}
+	maxUploadSizes, err := NewPostgresMaxUploadSizesTable(db)
+	if err != nil {
+		return nil, err
+	}
+	quarantine, err := NewPostgresQuarantineTable(db)
+	if err != nil {
+		return nil, err
+	}
+	blockedHashes, err := NewPostgresBlockedHashesTable(db)
+	if err != nil {
+		return nil, err
+	}
+	blockedOrigins, err := NewPostgresBlockedOriginsTable(db)
+	if err != nil {
+		return nil, err
+	}
+	secondaryHashes, err := NewPostgresSecondaryHashesTable(db)
+	if err != nil {
+		return nil, err
+	}
+	auditLog, err := NewPostgresAuditLogTable(db)
+	if err != nil {
+		return nil, err
+	}
 	return &shared.Database{
 		MediaRepository: mediaRepo,
+		StoredFiles:     storedFiles,
 		Thumbnails:      thumbnails,
+		UploadQuotas:    uploadQuotas,
+		MaxUploadSizes:  maxUploadSizes,
+		Quarantine:      quarantine,
+		BlockedHashes:   blockedHashes,
+		BlockedOrigins:  blockedOrigins,
+		SecondaryHashes: secondaryHashes,
+		AuditLog:        auditLog,
 		DB:              db,
 		Writer:          writer,
 	}, nil
@@ -0,0 +1,131 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/storage/tables"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+const secondaryHashesSchema = `
+-- The mediaapi_secondary_hashes table holds the hashes of files in the media
+-- store other than SHA-256, e.g. to look them up in external deduplication systems.
+CREATE TABLE IF NOT EXISTS mediaapi_secondary_hashes (
+    -- The SHA-256 hash of the file.
+    base64hash TEXT NOT NULL,
+    -- The hash algorithm, e.g. blake2b-256.
+    algorithm TEXT NOT NULL,
+    -- The hex encoded hash of the file.
+    secondary_hash TEXT NOT NULL,
+    PRIMARY KEY (base64hash, algorithm)
+);
+CREATE INDEX IF NOT EXISTS mediaapi_secondary_hashes_secondary_hash_idx ON mediaapi_secondary_hashes (algorithm, secondary_hash);
+`
+
+const insertSecondaryHashSQL = `
+INSERT INTO mediaapi_secondary_hashes (base64hash, algorithm, secondary_hash) VALUES ($1, $2, $3)
+    ON CONFLICT (base64hash, algorithm) DO NOTHING
+`
+
+const selectSecondaryHashesSQL = `
+SELECT algorithm, secondary_hash FROM mediaapi_secondary_hashes WHERE base64hash = $1
+`
+
+const selectHashesBySecondaryHashSQL = `
+SELECT base64hash FROM mediaapi_secondary_hashes WHERE algorithm = $1 AND secondary_hash = $2 ORDER BY base64hash
+`
+
+const deleteSecondaryHashesSQL = `
+DELETE FROM mediaapi_secondary_hashes WHERE base64hash = $1
+`
+
+type secondaryHashesStatements struct {
+	insertSecondaryHashStmt         *sql.Stmt
+	selectSecondaryHashesStmt       *sql.Stmt
+	selectHashesBySecondaryHashStmt *sql.Stmt
+	deleteSecondaryHashesStmt       *sql.Stmt
+}
+
+func NewPostgresSecondaryHashesTable(db *sql.DB) (tables.SecondaryHashes, error) {
+	s := &secondaryHashesStatements{}
+	_, err := db.Exec(secondaryHashesSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.insertSecondaryHashStmt, insertSecondaryHashSQL},
+		{&s.selectSecondaryHashesStmt, selectSecondaryHashesSQL},
+		{&s.selectHashesBySecondaryHashStmt, selectHashesBySecondaryHashSQL},
+		{&s.deleteSecondaryHashesStmt, deleteSecondaryHashesSQL},
+	}.Prepare(db)
+}
+
+func (s *secondaryHashesStatements) InsertSecondaryHash(
+	ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash, algorithm, secondaryHash string,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.insertSecondaryHashStmt).ExecContext(ctx, mediaHash, algorithm, secondaryHash)
+	return err
+}
+
+func (s *secondaryHashesStatements) SelectSecondaryHashes(
+	ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash,
+) (map[string]string, error) {
+	rows, err := sqlutil.TxStmtContext(ctx, txn, s.selectSecondaryHashesStmt).QueryContext(ctx, mediaHash)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectSecondaryHashes: failed to close rows")
+	secondaryHashes := map[string]string{}
+	for rows.Next() {
+		var algorithm, secondaryHash string
+		if err = rows.Scan(&algorithm, &secondaryHash); err != nil {
+			return nil, err
+		}
+		secondaryHashes[algorithm] = secondaryHash
+	}
+	return secondaryHashes, rows.Err()
+}
+
+func (s *secondaryHashesStatements) SelectHashesBySecondaryHash(
+	ctx context.Context, txn *sql.Tx, algorithm, secondaryHash string,
+) ([]types.Base64Hash, error) {
+	rows, err := sqlutil.TxStmtContext(ctx, txn, s.selectHashesBySecondaryHashStmt).QueryContext(ctx, algorithm, secondaryHash)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectHashesBySecondaryHash: failed to close rows")
+	var hashes []types.Base64Hash
+	for rows.Next() {
+		var hash types.Base64Hash
+		if err = rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, rows.Err()
+}
+
+func (s *secondaryHashesStatements) DeleteSecondaryHashes(
+	ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.deleteSecondaryHashesStmt).ExecContext(ctx, mediaHash)
+	return err
+}
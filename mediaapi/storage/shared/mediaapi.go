@@ -17,7 +17,9 @@ package shared
 import (
 	"context"
 	"database/sql"
+	"time"
 
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/mediaapi/storage/tables"
 	"github.com/matrix-org/dendrite/mediaapi/types"
@@ -28,21 +30,52 @@ type Database struct {
 	DB              *sql.DB
 	Writer          sqlutil.Writer
 	MediaRepository tables.MediaRepository
+	StoredFiles     tables.StoredFiles
 	Thumbnails      tables.Thumbnails
+	UploadQuotas    tables.UploadQuotas
+	MaxUploadSizes  tables.MaxUploadSizes
+	Quarantine      tables.Quarantine
+	BlockedHashes   tables.BlockedHashes
+	BlockedOrigins  tables.BlockedOrigins
+	SecondaryHashes tables.SecondaryHashes
+	AuditLog        tables.AuditLog
 }
 
-// StoreMediaMetadata inserts the metadata about the uploaded media into the database.
+// Ping checks that the database can be reached.
+func (d Database) Ping(ctx context.Context) error {
+	return d.DB.PingContext(ctx)
+}
+
+// StoreMediaMetadata inserts the metadata about the uploaded media into the database,
+// and counts it as a reference to the stored file with its hash. The secondary hashes
+// of the file are stored too, if it didn't have them already.
 // Returns an error if the combination of MediaID and Origin are not unique in the table.
 func (d Database) StoreMediaMetadata(ctx context.Context, mediaMetadata *types.MediaMetadata) error {
+	trace, ctx := internal.StartRegion(ctx, "StoreMediaMetadata")
+	defer trace.EndRegion()
 	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		return d.MediaRepository.InsertMedia(ctx, txn, mediaMetadata)
+		return d.storeMediaMetadata(ctx, txn, mediaMetadata)
 	})
 }
 
+func (d Database) storeMediaMetadata(ctx context.Context, txn *sql.Tx, mediaMetadata *types.MediaMetadata) error {
+	if err := d.MediaRepository.InsertMedia(ctx, txn, mediaMetadata); err != nil {
+		return err
+	}
+	for algorithm, secondaryHash := range mediaMetadata.SecondaryHashes {
+		if err := d.SecondaryHashes.InsertSecondaryHash(ctx, txn, mediaMetadata.Base64Hash, algorithm, secondaryHash); err != nil {
+			return err
+		}
+	}
+	return d.StoredFiles.InsertStoredFileReference(ctx, txn, mediaMetadata.Base64Hash)
+}
+
 // GetMediaMetadata returns metadata about media stored on this server.
 // The media could have been uploaded to this server or fetched from another server and cached here.
 // Returns nil metadata if there is no metadata associated with this media.
 func (d Database) GetMediaMetadata(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName) (*types.MediaMetadata, error) {
+	trace, ctx := internal.StartRegion(ctx, "GetMediaMetadata")
+	defer trace.EndRegion()
 	mediaMetadata, err := d.MediaRepository.SelectMedia(ctx, nil, mediaID, mediaOrigin)
 	if err != nil && err == sql.ErrNoRows {
 		return nil, nil
@@ -54,6 +87,8 @@ func (d Database) GetMediaMetadata(ctx context.Context, mediaID types.MediaID, m
 // The media could have been uploaded to this server or fetched from another server and cached here.
 // Returns nil metadata if there is no metadata associated with this media.
 func (d Database) GetMediaMetadataByHash(ctx context.Context, mediaHash types.Base64Hash, mediaOrigin spec.ServerName) (*types.MediaMetadata, error) {
+	trace, ctx := internal.StartRegion(ctx, "GetMediaMetadataByHash")
+	defer trace.EndRegion()
 	mediaMetadata, err := d.MediaRepository.SelectMediaByHash(ctx, nil, mediaHash, mediaOrigin)
 	if err != nil && err == sql.ErrNoRows {
 		return nil, nil
@@ -61,9 +96,417 @@ func (d Database) GetMediaMetadataByHash(ctx context.Context, mediaHash types.Ba
 	return mediaMetadata, err
 }
 
+// UpdateMediaLastAccess records that the media was just downloaded or thumbnailed.
+func (d Database) UpdateMediaLastAccess(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName) error {
+	trace, ctx := internal.StartRegion(ctx, "UpdateMediaLastAccess")
+	defer trace.EndRegion()
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.MediaRepository.UpdateMediaLastAccess(ctx, txn, mediaID, mediaOrigin, spec.AsTimestamp(time.Now()))
+	})
+}
+
+// UpdateMediaLastAccesses records when each of the media was last downloaded or
+// thumbnailed, in a single transaction.
+func (d Database) UpdateMediaLastAccesses(ctx context.Context, accesses []types.MediaAccess) error {
+	trace, ctx := internal.StartRegion(ctx, "UpdateMediaLastAccesses")
+	defer trace.EndRegion()
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		for _, access := range accesses {
+			if err := d.MediaRepository.UpdateMediaLastAccess(ctx, txn, access.MediaID, access.Origin, access.LastAccessTS); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetRemoteMediaCacheSize returns the total size of the media that has been
+// fetched from other servers and cached here.
+func (d Database) GetRemoteMediaCacheSize(ctx context.Context, localOrigin spec.ServerName) (types.FileSizeBytes, error) {
+	return d.MediaRepository.SelectRemoteMediaSize(ctx, nil, localOrigin)
+}
+
+// GetLeastRecentlyAccessedRemoteMedia returns up to limit cached remote media,
+// least recently accessed first. Media from localOrigin is never returned.
+func (d Database) GetLeastRecentlyAccessedRemoteMedia(ctx context.Context, localOrigin spec.ServerName, limit int) ([]*types.MediaMetadata, error) {
+	return d.MediaRepository.SelectRemoteMediaByLastAccess(ctx, nil, localOrigin, limit)
+}
+
+// GetRemoteMediaCachedBefore returns up to limit remote media that was fetched
+// before the given time, oldest first. Media from localOrigin is never returned.
+func (d Database) GetRemoteMediaCachedBefore(ctx context.Context, localOrigin spec.ServerName, before spec.Timestamp, limit int) ([]*types.MediaMetadata, error) {
+	return d.MediaRepository.SelectRemoteMediaCreatedBefore(ctx, nil, localOrigin, before, limit)
+}
+
+// GetMediaCreatedBefore returns up to limit media that was stored before the
+// given time, oldest first, skipping the first offset results. If remote is set
+// only media from other servers is returned, otherwise only media from localOrigin.
+func (d Database) GetMediaCreatedBefore(
+	ctx context.Context, localOrigin spec.ServerName, remote bool, before spec.Timestamp, limit, offset int,
+) ([]*types.MediaMetadata, error) {
+	return d.MediaRepository.SelectMediaCreatedBefore(ctx, nil, localOrigin, remote, before, limit, offset)
+}
+
+// GetUserMedia returns up to limit media the user has uploaded to mediaOrigin,
+// newest first, skipping the first offset results.
+func (d Database) GetUserMedia(
+	ctx context.Context, userID types.MatrixUserID, mediaOrigin spec.ServerName, limit, offset int,
+) ([]*types.MediaMetadata, error) {
+	return d.MediaRepository.SelectUserMedia(ctx, nil, userID, mediaOrigin, limit, offset)
+}
+
+// GetAllMediaByHash returns the media entries, from any origin, that refer to
+// the file with the given hash.
+func (d Database) GetAllMediaByHash(ctx context.Context, mediaHash types.Base64Hash) ([]*types.MediaMetadata, error) {
+	return d.MediaRepository.SelectAllMediaByHash(ctx, nil, mediaHash)
+}
+
+// GetMediaCountByHash returns how many media entries, from any origin, refer to
+// the file with the given hash.
+func (d Database) GetMediaCountByHash(ctx context.Context, mediaHash types.Base64Hash) (int, error) {
+	return d.StoredFiles.SelectStoredFileReferences(ctx, nil, mediaHash)
+}
+
+// GetUserUploadSize returns the total size of the media the user has uploaded to mediaOrigin.
+func (d Database) GetUserUploadSize(ctx context.Context, userID types.MatrixUserID, mediaOrigin spec.ServerName) (types.FileSizeBytes, error) {
+	return d.MediaRepository.SelectUserMediaSize(ctx, nil, userID, mediaOrigin)
+}
+
+// GetUploadQuota returns the upload quota an admin has set for the user.
+// Returns nil if no quota has been set, in which case the configured default applies.
+func (d Database) GetUploadQuota(ctx context.Context, userID types.MatrixUserID) (*types.FileSizeBytes, error) {
+	quotaBytes, err := d.UploadQuotas.SelectUploadQuota(ctx, nil, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &quotaBytes, nil
+}
+
+// SetUploadQuota overrides the configured default upload quota for the user.
+func (d Database) SetUploadQuota(ctx context.Context, userID types.MatrixUserID, quotaBytes types.FileSizeBytes) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.UploadQuotas.UpsertUploadQuota(ctx, txn, userID, quotaBytes)
+	})
+}
+
+// DeleteUploadQuota removes the upload quota set for the user, so the configured default applies again.
+func (d Database) DeleteUploadQuota(ctx context.Context, userID types.MatrixUserID) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.UploadQuotas.DeleteUploadQuota(ctx, txn, userID)
+	})
+}
+
+// GetMaxUploadSize returns the maximum upload size an admin has set for the user.
+// Returns nil if no limit has been set, in which case max_file_size_bytes applies.
+func (d Database) GetMaxUploadSize(ctx context.Context, userID types.MatrixUserID) (*types.FileSizeBytes, error) {
+	maxFileSizeBytes, err := d.MaxUploadSizes.SelectMaxUploadSize(ctx, nil, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &maxFileSizeBytes, nil
+}
+
+// SetMaxUploadSize overrides the configured maximum upload size for the user.
+func (d Database) SetMaxUploadSize(ctx context.Context, userID types.MatrixUserID, maxFileSizeBytes types.FileSizeBytes) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.MaxUploadSizes.UpsertMaxUploadSize(ctx, txn, userID, maxFileSizeBytes)
+	})
+}
+
+// DeleteMaxUploadSize removes the maximum upload size set for the user.
+func (d Database) DeleteMaxUploadSize(ctx context.Context, userID types.MatrixUserID) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.MaxUploadSizes.DeleteMaxUploadSize(ctx, txn, userID)
+	})
+}
+
+// QuarantineMedia stops the media from being downloaded. The hash of the file is
+// recorded so that the file is kept on disk, or empty if we don't have the file.
+func (d Database) QuarantineMedia(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName, mediaHash types.Base64Hash, quarantinedBy types.MatrixUserID,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.Quarantine.InsertQuarantinedMedia(ctx, txn, mediaID, mediaOrigin, mediaHash, quarantinedBy, spec.AsTimestamp(time.Now()))
+	})
+}
+
+// UnquarantineMedia allows the media to be downloaded again.
+func (d Database) UnquarantineMedia(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.Quarantine.DeleteQuarantinedMedia(ctx, txn, mediaID, mediaOrigin)
+	})
+}
+
+// IsMediaQuarantined returns whether the media has been quarantined by its media ID.
+func (d Database) IsMediaQuarantined(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName) (bool, error) {
+	trace, ctx := internal.StartRegion(ctx, "IsMediaQuarantined")
+	defer trace.EndRegion()
+	return d.Quarantine.SelectMediaQuarantined(ctx, nil, mediaID, mediaOrigin)
+}
+
+// QuarantineHash stops any media with the given hash from being downloaded or uploaded.
+func (d Database) QuarantineHash(ctx context.Context, mediaHash types.Base64Hash, quarantinedBy types.MatrixUserID) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.Quarantine.InsertQuarantinedHash(ctx, txn, mediaHash, quarantinedBy, spec.AsTimestamp(time.Now()))
+	})
+}
+
+// UnquarantineHash allows media with the given hash to be downloaded and uploaded again.
+func (d Database) UnquarantineHash(ctx context.Context, mediaHash types.Base64Hash) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.Quarantine.DeleteQuarantinedHash(ctx, txn, mediaHash)
+	})
+}
+
+// IsHashQuarantined returns whether the hash has been quarantined.
+func (d Database) IsHashQuarantined(ctx context.Context, mediaHash types.Base64Hash) (bool, error) {
+	trace, ctx := internal.StartRegion(ctx, "IsHashQuarantined")
+	defer trace.EndRegion()
+	return d.Quarantine.SelectHashQuarantined(ctx, nil, mediaHash)
+}
+
+// IsFileQuarantined returns whether the file with the given hash must be kept
+// on disk, because either the hash or media referring to it is quarantined.
+func (d Database) IsFileQuarantined(ctx context.Context, mediaHash types.Base64Hash) (bool, error) {
+	return d.Quarantine.SelectFileQuarantined(ctx, nil, mediaHash)
+}
+
+// IsAnyFileQuarantined returns whether any hash, or any media with a known
+// hash, is quarantined.
+func (d Database) IsAnyFileQuarantined(ctx context.Context) (bool, error) {
+	return d.Quarantine.SelectAnyFileQuarantined(ctx, nil)
+}
+
+// BlockHash stops files with the hash from being uploaded or downloaded. Blocking
+// a hash again updates the reason.
+func (d Database) BlockHash(ctx context.Context, mediaHash types.Base64Hash, reason string, blockedBy types.MatrixUserID) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.BlockedHashes.UpsertBlockedHash(ctx, txn, &types.BlockedHash{
+			Base64Hash: mediaHash,
+			Reason:     reason,
+			BlockedBy:  blockedBy,
+			BlockedTS:  spec.AsTimestamp(time.Now()),
+		})
+	})
+}
+
+// UnblockHash allows files with the hash to be uploaded and downloaded again.
+func (d Database) UnblockHash(ctx context.Context, mediaHash types.Base64Hash) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.BlockedHashes.DeleteBlockedHash(ctx, txn, mediaHash)
+	})
+}
+
+// IsHashBlocked returns whether an admin has blocked the hash.
+func (d Database) IsHashBlocked(ctx context.Context, mediaHash types.Base64Hash) (bool, error) {
+	trace, ctx := internal.StartRegion(ctx, "IsHashBlocked")
+	defer trace.EndRegion()
+	return d.BlockedHashes.SelectHashBlocked(ctx, nil, mediaHash)
+}
+
+// IsAnyHashBlocked returns whether an admin has blocked any hash.
+func (d Database) IsAnyHashBlocked(ctx context.Context) (bool, error) {
+	return d.BlockedHashes.SelectAnyHashBlocked(ctx, nil)
+}
+
+// GetBlockedHashes returns all hashes blocked by admins, oldest first.
+func (d Database) GetBlockedHashes(ctx context.Context) ([]*types.BlockedHash, error) {
+	return d.BlockedHashes.SelectBlockedHashes(ctx, nil)
+}
+
+// StoreAuditLogEntries adds the entries to the media audit log.
+func (d Database) StoreAuditLogEntries(ctx context.Context, entries []*types.AuditLogEntry) error {
+	trace, ctx := internal.StartRegion(ctx, "StoreAuditLogEntries")
+	defer trace.EndRegion()
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		for _, entry := range entries {
+			if err := d.AuditLog.InsertAuditLogEntry(ctx, txn, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetAuditLog returns up to limit entries of the media audit log matching the
+// filter, newest first, starting below the entry with the ID before unless it
+// is 0.
+func (d Database) GetAuditLog(ctx context.Context, filter *types.AuditLogFilter, before int64, limit int) ([]*types.AuditLogEntry, error) {
+	return d.AuditLog.SelectAuditLog(ctx, nil, filter, before, limit)
+}
+
+// RedactAuditLogBefore removes the users and IP addresses from the audit log
+// entries older than ts.
+func (d Database) RedactAuditLogBefore(ctx context.Context, ts spec.Timestamp) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.AuditLog.RedactAuditLogBefore(ctx, txn, ts)
+	})
+}
+
+// DeleteAuditLogBefore removes the audit log entries older than ts, and returns
+// how many were removed.
+func (d Database) DeleteAuditLogBefore(ctx context.Context, ts spec.Timestamp) (deleted int64, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		deleted, err = d.AuditLog.DeleteAuditLogBefore(ctx, txn, ts)
+		return err
+	})
+	return deleted, err
+}
+
+// BlockOrigin stops media from the server from being fetched or downloaded.
+// Blocking a server again updates the reason.
+func (d Database) BlockOrigin(ctx context.Context, serverName spec.ServerName, reason string, blockedBy types.MatrixUserID) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.BlockedOrigins.UpsertBlockedOrigin(ctx, txn, &types.BlockedOrigin{
+			ServerName: serverName,
+			Reason:     reason,
+			BlockedBy:  blockedBy,
+			BlockedTS:  spec.AsTimestamp(time.Now()),
+		})
+	})
+}
+
+// UnblockOrigin allows media from the server to be fetched and downloaded again.
+func (d Database) UnblockOrigin(ctx context.Context, serverName spec.ServerName) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.BlockedOrigins.DeleteBlockedOrigin(ctx, txn, serverName)
+	})
+}
+
+// IsOriginBlocked returns whether an admin has blocked media from the server.
+func (d Database) IsOriginBlocked(ctx context.Context, serverName spec.ServerName) (bool, error) {
+	trace, ctx := internal.StartRegion(ctx, "IsOriginBlocked")
+	defer trace.EndRegion()
+	return d.BlockedOrigins.SelectOriginBlocked(ctx, nil, serverName)
+}
+
+// GetBlockedOrigins returns all servers blocked by admins, oldest first.
+func (d Database) GetBlockedOrigins(ctx context.Context) ([]*types.BlockedOrigin, error) {
+	return d.BlockedOrigins.SelectBlockedOrigins(ctx, nil)
+}
+
+// DeleteMediaMetadata removes the metadata for the media and all of its thumbnails,
+// and returns whether that removed the last reference to the stored file, which
+// must then be removed separately. Returns false if the media didn't exist.
+func (d Database) DeleteMediaMetadata(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName) (unreferenced bool, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		_, unreferenced, err = d.deleteMediaMetadata(ctx, txn, mediaID, mediaOrigin)
+		return err
+	})
+	return unreferenced, err
+}
+
+// ReplaceMediaMetadata replaces the metadata of the media with the same ID and
+// origin, e.g. with that of a newer copy of remote media, and returns whether
+// that removed the last reference to the stored file of the replaced media,
+// which must then be removed separately.
+func (d Database) ReplaceMediaMetadata(ctx context.Context, mediaMetadata *types.MediaMetadata) (unreferenced bool, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		var replaced *types.MediaMetadata
+		replaced, unreferenced, err = d.deleteMediaMetadata(ctx, txn, mediaMetadata.MediaID, mediaMetadata.Origin)
+		if err != nil {
+			return err
+		}
+		if replaced != nil && replaced.Base64Hash == mediaMetadata.Base64Hash {
+			// The new copy is stored in the same file.
+			unreferenced = false
+		}
+		return d.storeMediaMetadata(ctx, txn, mediaMetadata)
+	})
+	return unreferenced, err
+}
+
+// RemoveUnreferencedFile calls remove to remove the stored file with the hash,
+// unless media refers to it again, e.g. because the same file was uploaded
+// since its last reference was deleted, or it is quarantined. The references
+// are checked in the same writer transaction that remove is called in, so no
+// media can start referring to the file before it is gone.
+func (d Database) RemoveUnreferencedFile(ctx context.Context, mediaHash types.Base64Hash, remove func() error) (removed bool, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		references, err := d.StoredFiles.SelectStoredFileReferences(ctx, txn, mediaHash)
+		if err != nil || references > 0 {
+			return err
+		}
+		// Quarantined files are kept as evidence.
+		quarantined, err := d.Quarantine.SelectFileQuarantined(ctx, txn, mediaHash)
+		if err != nil || quarantined {
+			return err
+		}
+		removed = true
+		return remove()
+	})
+	return removed, err
+}
+
+// deleteMediaMetadata returns the deleted metadata, nil if the media didn't exist.
+func (d Database) deleteMediaMetadata(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName,
+) (*types.MediaMetadata, bool, error) {
+	mediaMetadata, err := d.MediaRepository.SelectMedia(ctx, txn, mediaID, mediaOrigin)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if err = d.Thumbnails.DeleteThumbnails(ctx, txn, mediaID, mediaOrigin); err != nil {
+		return nil, false, err
+	}
+	if err = d.MediaRepository.DeleteMedia(ctx, txn, mediaID, mediaOrigin); err != nil {
+		return nil, false, err
+	}
+	references, err := d.StoredFiles.DeleteStoredFileReference(ctx, txn, mediaMetadata.Base64Hash)
+	if err != nil {
+		return nil, false, err
+	}
+	if references > 0 {
+		return mediaMetadata, false, nil
+	}
+	return mediaMetadata, true, d.SecondaryHashes.DeleteSecondaryHashes(ctx, txn, mediaMetadata.Base64Hash)
+}
+
+// ScrubUserData removes the personal data of the user left in the database once
+// their media has been deleted: the user and upload names of any media they
+// uploaded, their users and IP addresses in the audit log, and their upload
+// quota and maximum upload size.
+func (d Database) ScrubUserData(ctx context.Context, userID types.MatrixUserID) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if err := d.MediaRepository.ScrubUserMedia(ctx, txn, userID); err != nil {
+			return err
+		}
+		if err := d.AuditLog.RedactAuditLogUser(ctx, txn, userID); err != nil {
+			return err
+		}
+		if err := d.UploadQuotas.DeleteUploadQuota(ctx, txn, userID); err != nil {
+			return err
+		}
+		return d.MaxUploadSizes.DeleteMaxUploadSize(ctx, txn, userID)
+	})
+}
+
+// GetSecondaryHashes returns the secondary hashes of the stored file with the
+// given hash, by algorithm.
+func (d Database) GetSecondaryHashes(ctx context.Context, mediaHash types.Base64Hash) (map[string]string, error) {
+	return d.SecondaryHashes.SelectSecondaryHashes(ctx, nil, mediaHash)
+}
+
+// GetHashesBySecondaryHash returns the hashes of the stored files with the
+// given secondary hash.
+func (d Database) GetHashesBySecondaryHash(ctx context.Context, algorithm, secondaryHash string) ([]types.Base64Hash, error) {
+	return d.SecondaryHashes.SelectHashesBySecondaryHash(ctx, nil, algorithm, secondaryHash)
+}
+
 // StoreThumbnail inserts the metadata about the thumbnail into the database.
 // Returns an error if the combination of MediaID and Origin are not unique in the table.
 func (d Database) StoreThumbnail(ctx context.Context, thumbnailMetadata *types.ThumbnailMetadata) error {
+	trace, ctx := internal.StartRegion(ctx, "StoreThumbnail")
+	defer trace.EndRegion()
 	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
 		return d.Thumbnails.InsertThumbnail(ctx, txn, thumbnailMetadata)
 	})
@@ -73,6 +516,8 @@ func (d Database) StoreThumbnail(ctx context.Context, thumbnailMetadata *types.T
 // The media could have been uploaded to this server or fetched from another server and cached here.
 // Returns nil metadata if there is no metadata associated with this thumbnail.
 func (d Database) GetThumbnail(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName, width, height int, resizeMethod string) (*types.ThumbnailMetadata, error) {
+	trace, ctx := internal.StartRegion(ctx, "GetThumbnail")
+	defer trace.EndRegion()
 	metadata, err := d.Thumbnails.SelectThumbnail(ctx, nil, mediaID, mediaOrigin, width, height, resizeMethod)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -87,6 +532,8 @@ func (d Database) GetThumbnail(ctx context.Context, mediaID types.MediaID, media
 // The media could have been uploaded to this server or fetched from another server and cached here.
 // Returns nil metadata if there are no thumbnails associated with this media.
 func (d Database) GetThumbnails(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName) ([]*types.ThumbnailMetadata, error) {
+	trace, ctx := internal.StartRegion(ctx, "GetThumbnails")
+	defer trace.EndRegion()
 	metadatas, err := d.Thumbnails.SelectThumbnails(ctx, nil, mediaID, mediaOrigin)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -0,0 +1,136 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/storage/tables"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+const blockedHashesSchema = `
+-- The mediaapi_blocked_hashes table holds the hashes of files that admins have
+-- blocked from being uploaded or downloaded.
+CREATE TABLE IF NOT EXISTS mediaapi_blocked_hashes (
+    -- The hash of the file.
+    base64hash TEXT NOT NULL PRIMARY KEY,
+    -- Why the file was blocked.
+    reason TEXT NOT NULL,
+    -- The admin who blocked the file.
+    blocked_by TEXT NOT NULL,
+    -- When the file was blocked.
+    blocked_ts INTEGER NOT NULL
+);
+`
+
+const upsertBlockedHashSQL = `
+INSERT INTO mediaapi_blocked_hashes (base64hash, reason, blocked_by, blocked_ts) VALUES ($1, $2, $3, $4)
+    ON CONFLICT (base64hash) DO UPDATE SET reason = $2, blocked_by = $3, blocked_ts = $4
+`
+
+const selectHashBlockedSQL = `
+SELECT COUNT(*) FROM mediaapi_blocked_hashes WHERE base64hash = $1
+`
+
+const selectAnyHashBlockedSQL = `
+SELECT COUNT(*) FROM (SELECT 1 FROM mediaapi_blocked_hashes LIMIT 1) AS blocked
+`
+
+const selectBlockedHashesSQL = `
+SELECT base64hash, reason, blocked_by, blocked_ts FROM mediaapi_blocked_hashes ORDER BY blocked_ts, base64hash
+`
+
+const deleteBlockedHashSQL = `
+DELETE FROM mediaapi_blocked_hashes WHERE base64hash = $1
+`
+
+type blockedHashesStatements struct {
+	upsertBlockedHashStmt    *sql.Stmt
+	selectHashBlockedStmt    *sql.Stmt
+	selectAnyHashBlockedStmt *sql.Stmt
+	selectBlockedHashesStmt  *sql.Stmt
+	deleteBlockedHashStmt    *sql.Stmt
+}
+
+func NewSQLiteBlockedHashesTable(db *sql.DB) (tables.BlockedHashes, error) {
+	s := &blockedHashesStatements{}
+	_, err := db.Exec(blockedHashesSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.upsertBlockedHashStmt, upsertBlockedHashSQL},
+		{&s.selectHashBlockedStmt, selectHashBlockedSQL},
+		{&s.selectAnyHashBlockedStmt, selectAnyHashBlockedSQL},
+		{&s.selectBlockedHashesStmt, selectBlockedHashesSQL},
+		{&s.deleteBlockedHashStmt, deleteBlockedHashSQL},
+	}.Prepare(db)
+}
+
+func (s *blockedHashesStatements) UpsertBlockedHash(
+	ctx context.Context, txn *sql.Tx, blockedHash *types.BlockedHash,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.upsertBlockedHashStmt).ExecContext(
+		ctx, blockedHash.Base64Hash, blockedHash.Reason, blockedHash.BlockedBy, blockedHash.BlockedTS,
+	)
+	return err
+}
+
+func (s *blockedHashesStatements) SelectHashBlocked(
+	ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash,
+) (bool, error) {
+	var count int
+	err := sqlutil.TxStmtContext(ctx, txn, s.selectHashBlockedStmt).QueryRowContext(ctx, mediaHash).Scan(&count)
+	return count > 0, err
+}
+
+func (s *blockedHashesStatements) SelectAnyHashBlocked(
+	ctx context.Context, txn *sql.Tx,
+) (bool, error) {
+	var count int
+	err := sqlutil.TxStmtContext(ctx, txn, s.selectAnyHashBlockedStmt).QueryRowContext(ctx).Scan(&count)
+	return count > 0, err
+}
+
+func (s *blockedHashesStatements) SelectBlockedHashes(
+	ctx context.Context, txn *sql.Tx,
+) ([]*types.BlockedHash, error) {
+	rows, err := sqlutil.TxStmtContext(ctx, txn, s.selectBlockedHashesStmt).QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectBlockedHashes: failed to close rows")
+	var blockedHashes []*types.BlockedHash
+	for rows.Next() {
+		blockedHash := &types.BlockedHash{}
+		if err = rows.Scan(&blockedHash.Base64Hash, &blockedHash.Reason, &blockedHash.BlockedBy, &blockedHash.BlockedTS); err != nil {
+			return nil, err
+		}
+		blockedHashes = append(blockedHashes, blockedHash)
+	}
+	return blockedHashes, rows.Err()
+}
+
+func (s *blockedHashesStatements) DeleteBlockedHash(
+	ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.deleteBlockedHashStmt).ExecContext(ctx, mediaHash)
+	return err
+}
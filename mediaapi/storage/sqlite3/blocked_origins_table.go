@@ -0,0 +1,123 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/storage/tables"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+const blockedOriginsSchema = `
+-- The mediaapi_blocked_origins table holds the servers whose media admins have
+-- blocked from being fetched or downloaded.
+CREATE TABLE IF NOT EXISTS mediaapi_blocked_origins (
+    -- The server name of the origin.
+    server_name TEXT NOT NULL PRIMARY KEY,
+    -- Why the server was blocked.
+    reason TEXT NOT NULL,
+    -- The admin who blocked the server.
+    blocked_by TEXT NOT NULL,
+    -- When the server was blocked.
+    blocked_ts INTEGER NOT NULL
+);
+`
+
+const upsertBlockedOriginSQL = `
+INSERT INTO mediaapi_blocked_origins (server_name, reason, blocked_by, blocked_ts) VALUES ($1, $2, $3, $4)
+    ON CONFLICT (server_name) DO UPDATE SET reason = $2, blocked_by = $3, blocked_ts = $4
+`
+
+const selectOriginBlockedSQL = `
+SELECT COUNT(*) FROM mediaapi_blocked_origins WHERE server_name = $1
+`
+
+const selectBlockedOriginsSQL = `
+SELECT server_name, reason, blocked_by, blocked_ts FROM mediaapi_blocked_origins ORDER BY blocked_ts, server_name
+`
+
+const deleteBlockedOriginSQL = `
+DELETE FROM mediaapi_blocked_origins WHERE server_name = $1
+`
+
+type blockedOriginsStatements struct {
+	upsertBlockedOriginStmt  *sql.Stmt
+	selectOriginBlockedStmt  *sql.Stmt
+	selectBlockedOriginsStmt *sql.Stmt
+	deleteBlockedOriginStmt  *sql.Stmt
+}
+
+func NewSQLiteBlockedOriginsTable(db *sql.DB) (tables.BlockedOrigins, error) {
+	s := &blockedOriginsStatements{}
+	_, err := db.Exec(blockedOriginsSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.upsertBlockedOriginStmt, upsertBlockedOriginSQL},
+		{&s.selectOriginBlockedStmt, selectOriginBlockedSQL},
+		{&s.selectBlockedOriginsStmt, selectBlockedOriginsSQL},
+		{&s.deleteBlockedOriginStmt, deleteBlockedOriginSQL},
+	}.Prepare(db)
+}
+
+func (s *blockedOriginsStatements) UpsertBlockedOrigin(
+	ctx context.Context, txn *sql.Tx, blockedOrigin *types.BlockedOrigin,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.upsertBlockedOriginStmt).ExecContext(
+		ctx, blockedOrigin.ServerName, blockedOrigin.Reason, blockedOrigin.BlockedBy, blockedOrigin.BlockedTS,
+	)
+	return err
+}
+
+func (s *blockedOriginsStatements) SelectOriginBlocked(
+	ctx context.Context, txn *sql.Tx, serverName spec.ServerName,
+) (bool, error) {
+	var count int
+	err := sqlutil.TxStmtContext(ctx, txn, s.selectOriginBlockedStmt).QueryRowContext(ctx, serverName).Scan(&count)
+	return count > 0, err
+}
+
+func (s *blockedOriginsStatements) SelectBlockedOrigins(
+	ctx context.Context, txn *sql.Tx,
+) ([]*types.BlockedOrigin, error) {
+	rows, err := sqlutil.TxStmtContext(ctx, txn, s.selectBlockedOriginsStmt).QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectBlockedOrigins: failed to close rows")
+	var blockedOrigins []*types.BlockedOrigin
+	for rows.Next() {
+		blockedOrigin := &types.BlockedOrigin{}
+		if err = rows.Scan(&blockedOrigin.ServerName, &blockedOrigin.Reason, &blockedOrigin.BlockedBy, &blockedOrigin.BlockedTS); err != nil {
+			return nil, err
+		}
+		blockedOrigins = append(blockedOrigins, blockedOrigin)
+	}
+	return blockedOrigins, rows.Err()
+}
+
+func (s *blockedOriginsStatements) DeleteBlockedOrigin(
+	ctx context.Context, txn *sql.Tx, serverName spec.ServerName,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.deleteBlockedOriginStmt).ExecContext(ctx, serverName)
+	return err
+}
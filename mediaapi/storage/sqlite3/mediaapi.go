@@ -32,13 +32,53 @@ func NewDatabase(conMan *sqlutil.Connections, dbProperties *config.DatabaseOptio
 	if err != nil {
 		return nil, err
 	}
+	storedFiles, err := NewSQLiteStoredFilesTable(db)
+	if err != nil {
+		return nil, err
+	}
 	thumbnails, err := NewSQLiteThumbnailsTable(db)
 	if err != nil {
 		return nil, err
 	}
+	uploadQuotas, err := NewSQLiteUploadQuotasTable(db)
+	if err != nil {
+		return nil, err
+	}
+	maxUploadSizes, err := NewSQLiteMaxUploadSizesTable(db)
+	if err != nil {
+		return nil, err
+	}
+	quarantine, err := NewSQLiteQuarantineTable(db)
+	if err != nil {
+		return nil, err
+	}
+	blockedHashes, err := NewSQLiteBlockedHashesTable(db)
+	if err != nil {
+		return nil, err
+	}
+	blockedOrigins, err := NewSQLiteBlockedOriginsTable(db)
+	if err != nil {
+		return nil, err
+	}
+	secondaryHashes, err := NewSQLiteSecondaryHashesTable(db)
+	if err != nil {
+		return nil, err
+	}
+	auditLog, err := NewSQLiteAuditLogTable(db)
+	if err != nil {
+		return nil, err
+	}
 	return &shared.Database{
 		MediaRepository: mediaRepo,
+		StoredFiles:     storedFiles,
 		Thumbnails:      thumbnails,
+		UploadQuotas:    uploadQuotas,
+		MaxUploadSizes:  maxUploadSizes,
+		Quarantine:      quarantine,
+		BlockedHashes:   blockedHashes,
+		BlockedOrigins:  blockedOrigins,
+		SecondaryHashes: secondaryHashes,
+		AuditLog:        auditLog,
 		DB:              db,
 		Writer:          writer,
 	}, nil
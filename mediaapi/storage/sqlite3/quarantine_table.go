@@ -0,0 +1,187 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/storage/tables"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+const quarantineSchema = `
+-- The mediaapi_quarantined_media table holds the media that admins have
+-- quarantined. Quarantined media can't be downloaded, but is kept on disk.
+CREATE TABLE IF NOT EXISTS mediaapi_quarantined_media (
+    -- The id used to refer to the media.
+    media_id TEXT NOT NULL,
+    -- The origin of the media as requested by the client.
+    media_origin TEXT NOT NULL,
+    -- The hash of the file at the time it was quarantined, empty if we didn't have it.
+    base64hash TEXT NOT NULL,
+    -- The admin who quarantined the media.
+    quarantined_by TEXT NOT NULL,
+    -- When the media was quarantined.
+    quarantined_ts INTEGER NOT NULL,
+    PRIMARY KEY (media_id, media_origin)
+);
+CREATE INDEX IF NOT EXISTS mediaapi_quarantined_media_hash_idx ON mediaapi_quarantined_media(base64hash);
+
+-- The mediaapi_quarantined_hashes table holds the file hashes that admins have
+-- quarantined. Any media with these hashes can't be downloaded or uploaded again.
+CREATE TABLE IF NOT EXISTS mediaapi_quarantined_hashes (
+    -- The hash of the file.
+    base64hash TEXT NOT NULL PRIMARY KEY,
+    -- The admin who quarantined the hash.
+    quarantined_by TEXT NOT NULL,
+    -- When the hash was quarantined.
+    quarantined_ts INTEGER NOT NULL
+);
+`
+
+const insertQuarantinedMediaSQL = `
+INSERT INTO mediaapi_quarantined_media (media_id, media_origin, base64hash, quarantined_by, quarantined_ts)
+    VALUES ($1, $2, $3, $4, $5)
+    ON CONFLICT (media_id, media_origin) DO NOTHING
+`
+
+const selectMediaQuarantinedSQL = `
+SELECT COUNT(*) FROM mediaapi_quarantined_media WHERE media_id = $1 AND media_origin = $2
+`
+
+const deleteQuarantinedMediaSQL = `
+DELETE FROM mediaapi_quarantined_media WHERE media_id = $1 AND media_origin = $2
+`
+
+const insertQuarantinedHashSQL = `
+INSERT INTO mediaapi_quarantined_hashes (base64hash, quarantined_by, quarantined_ts)
+    VALUES ($1, $2, $3)
+    ON CONFLICT (base64hash) DO NOTHING
+`
+
+const selectHashQuarantinedSQL = `
+SELECT COUNT(*) FROM mediaapi_quarantined_hashes WHERE base64hash = $1
+`
+
+const selectFileQuarantinedSQL = `
+SELECT (SELECT COUNT(*) FROM mediaapi_quarantined_hashes WHERE base64hash = $1) +
+    (SELECT COUNT(*) FROM mediaapi_quarantined_media WHERE base64hash = $1)
+`
+
+const selectAnyFileQuarantinedSQL = `
+SELECT (SELECT COUNT(*) FROM (SELECT 1 FROM mediaapi_quarantined_hashes LIMIT 1) AS hashes) +
+    (SELECT COUNT(*) FROM (SELECT 1 FROM mediaapi_quarantined_media WHERE base64hash <> '' LIMIT 1) AS media)
+`
+
+const deleteQuarantinedHashSQL = `
+DELETE FROM mediaapi_quarantined_hashes WHERE base64hash = $1
+`
+
+type quarantineStatements struct {
+	insertQuarantinedMediaStmt   *sql.Stmt
+	selectMediaQuarantinedStmt   *sql.Stmt
+	deleteQuarantinedMediaStmt   *sql.Stmt
+	insertQuarantinedHashStmt    *sql.Stmt
+	selectHashQuarantinedStmt    *sql.Stmt
+	selectFileQuarantinedStmt    *sql.Stmt
+	selectAnyFileQuarantinedStmt *sql.Stmt
+	deleteQuarantinedHashStmt    *sql.Stmt
+}
+
+func NewSQLiteQuarantineTable(db *sql.DB) (tables.Quarantine, error) {
+	s := &quarantineStatements{}
+	_, err := db.Exec(quarantineSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.insertQuarantinedMediaStmt, insertQuarantinedMediaSQL},
+		{&s.selectMediaQuarantinedStmt, selectMediaQuarantinedSQL},
+		{&s.deleteQuarantinedMediaStmt, deleteQuarantinedMediaSQL},
+		{&s.insertQuarantinedHashStmt, insertQuarantinedHashSQL},
+		{&s.selectHashQuarantinedStmt, selectHashQuarantinedSQL},
+		{&s.selectFileQuarantinedStmt, selectFileQuarantinedSQL},
+		{&s.selectAnyFileQuarantinedStmt, selectAnyFileQuarantinedSQL},
+		{&s.deleteQuarantinedHashStmt, deleteQuarantinedHashSQL},
+	}.Prepare(db)
+}
+
+func (s *quarantineStatements) InsertQuarantinedMedia(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName,
+	mediaHash types.Base64Hash, quarantinedBy types.MatrixUserID, quarantinedTS spec.Timestamp,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.insertQuarantinedMediaStmt).ExecContext(
+		ctx, mediaID, mediaOrigin, mediaHash, quarantinedBy, quarantinedTS,
+	)
+	return err
+}
+
+func (s *quarantineStatements) SelectMediaQuarantined(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName,
+) (quarantined bool, err error) {
+	var count int
+	err = sqlutil.TxStmtContext(ctx, txn, s.selectMediaQuarantinedStmt).QueryRowContext(ctx, mediaID, mediaOrigin).Scan(&count)
+	return count > 0, err
+}
+
+func (s *quarantineStatements) DeleteQuarantinedMedia(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.deleteQuarantinedMediaStmt).ExecContext(ctx, mediaID, mediaOrigin)
+	return err
+}
+
+func (s *quarantineStatements) InsertQuarantinedHash(
+	ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash,
+	quarantinedBy types.MatrixUserID, quarantinedTS spec.Timestamp,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.insertQuarantinedHashStmt).ExecContext(ctx, mediaHash, quarantinedBy, quarantinedTS)
+	return err
+}
+
+func (s *quarantineStatements) SelectHashQuarantined(
+	ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash,
+) (quarantined bool, err error) {
+	var count int
+	err = sqlutil.TxStmtContext(ctx, txn, s.selectHashQuarantinedStmt).QueryRowContext(ctx, mediaHash).Scan(&count)
+	return count > 0, err
+}
+
+func (s *quarantineStatements) SelectFileQuarantined(
+	ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash,
+) (quarantined bool, err error) {
+	var count int
+	err = sqlutil.TxStmtContext(ctx, txn, s.selectFileQuarantinedStmt).QueryRowContext(ctx, mediaHash).Scan(&count)
+	return count > 0, err
+}
+
+func (s *quarantineStatements) SelectAnyFileQuarantined(
+	ctx context.Context, txn *sql.Tx,
+) (quarantined bool, err error) {
+	var count int
+	err = sqlutil.TxStmtContext(ctx, txn, s.selectAnyFileQuarantinedStmt).QueryRowContext(ctx).Scan(&count)
+	return count > 0, err
+}
+
+func (s *quarantineStatements) DeleteQuarantinedHash(
+	ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.deleteQuarantinedHashStmt).ExecContext(ctx, mediaHash)
+	return err
+}
@@ -0,0 +1,121 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/storage/sqlite3/deltas"
+	"github.com/matrix-org/dendrite/mediaapi/storage/tables"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+const storedFilesSchema = `
+-- The mediaapi_stored_files table counts the media referring to each file in
+-- the media store. Media with the same content share a file, which may only be
+-- removed once no media refers to it anymore.
+CREATE TABLE IF NOT EXISTS mediaapi_stored_files (
+    -- The hash of the file.
+    base64hash TEXT NOT NULL PRIMARY KEY,
+    -- How many media refer to the file.
+    reference_count INTEGER NOT NULL
+);
+`
+
+const insertStoredFileReferenceSQL = `
+INSERT INTO mediaapi_stored_files (base64hash, reference_count) VALUES ($1, 1)
+    ON CONFLICT (base64hash) DO UPDATE SET reference_count = mediaapi_stored_files.reference_count + 1
+`
+
+const decrementStoredFileReferencesSQL = `
+UPDATE mediaapi_stored_files SET reference_count = reference_count - 1 WHERE base64hash = $1
+    RETURNING reference_count
+`
+
+const deleteUnreferencedStoredFileSQL = `
+DELETE FROM mediaapi_stored_files WHERE base64hash = $1 AND reference_count <= 0
+`
+
+const selectStoredFileReferencesSQL = `
+SELECT reference_count FROM mediaapi_stored_files WHERE base64hash = $1
+`
+
+type storedFilesStatements struct {
+	insertStoredFileReferenceStmt     *sql.Stmt
+	decrementStoredFileReferencesStmt *sql.Stmt
+	deleteUnreferencedStoredFileStmt  *sql.Stmt
+	selectStoredFileReferencesStmt    *sql.Stmt
+}
+
+func NewSQLiteStoredFilesTable(db *sql.DB) (tables.StoredFiles, error) {
+	s := &storedFilesStatements{}
+	_, err := db.Exec(storedFilesSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(sqlutil.Migration{
+		Version: "mediaapi: count stored file references",
+		Up:      deltas.UpCountStoredFileReferences,
+	})
+	if err = m.Up(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.insertStoredFileReferenceStmt, insertStoredFileReferenceSQL},
+		{&s.decrementStoredFileReferencesStmt, decrementStoredFileReferencesSQL},
+		{&s.deleteUnreferencedStoredFileStmt, deleteUnreferencedStoredFileSQL},
+		{&s.selectStoredFileReferencesStmt, selectStoredFileReferencesSQL},
+	}.Prepare(db)
+}
+
+func (s *storedFilesStatements) InsertStoredFileReference(
+	ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.insertStoredFileReferenceStmt).ExecContext(ctx, mediaHash)
+	return err
+}
+
+func (s *storedFilesStatements) DeleteStoredFileReference(
+	ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash,
+) (int, error) {
+	var count int
+	err := sqlutil.TxStmtContext(ctx, txn, s.decrementStoredFileReferencesStmt).QueryRowContext(ctx, mediaHash).Scan(&count)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if count <= 0 {
+		_, err = sqlutil.TxStmtContext(ctx, txn, s.deleteUnreferencedStoredFileStmt).ExecContext(ctx, mediaHash)
+	}
+	return count, err
+}
+
+func (s *storedFilesStatements) SelectStoredFileReferences(
+	ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash,
+) (int, error) {
+	var count int
+	err := sqlutil.TxStmtContext(ctx, txn, s.selectStoredFileReferencesStmt).QueryRowContext(ctx, mediaHash).Scan(&count)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return count, err
+}
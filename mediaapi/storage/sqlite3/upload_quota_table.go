@@ -0,0 +1,89 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/storage/tables"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+const uploadQuotaSchema = `
+-- The mediaapi_upload_quota table holds the upload quotas set by admins for
+-- individual users, overriding the configured default quota.
+CREATE TABLE IF NOT EXISTS mediaapi_upload_quota (
+    -- The local user the quota applies to.
+    user_id TEXT NOT NULL PRIMARY KEY,
+    -- The maximum total size of media the user may upload, 0 for unlimited.
+    quota_bytes INTEGER NOT NULL
+);
+`
+
+const upsertUploadQuotaSQL = `
+INSERT INTO mediaapi_upload_quota (user_id, quota_bytes) VALUES ($1, $2)
+    ON CONFLICT (user_id) DO UPDATE SET quota_bytes = $2
+`
+
+const selectUploadQuotaSQL = `
+SELECT quota_bytes FROM mediaapi_upload_quota WHERE user_id = $1
+`
+
+const deleteUploadQuotaSQL = `
+DELETE FROM mediaapi_upload_quota WHERE user_id = $1
+`
+
+type uploadQuotaStatements struct {
+	upsertUploadQuotaStmt *sql.Stmt
+	selectUploadQuotaStmt *sql.Stmt
+	deleteUploadQuotaStmt *sql.Stmt
+}
+
+func NewSQLiteUploadQuotasTable(db *sql.DB) (tables.UploadQuotas, error) {
+	s := &uploadQuotaStatements{}
+	_, err := db.Exec(uploadQuotaSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.upsertUploadQuotaStmt, upsertUploadQuotaSQL},
+		{&s.selectUploadQuotaStmt, selectUploadQuotaSQL},
+		{&s.deleteUploadQuotaStmt, deleteUploadQuotaSQL},
+	}.Prepare(db)
+}
+
+func (s *uploadQuotaStatements) UpsertUploadQuota(
+	ctx context.Context, txn *sql.Tx, userID types.MatrixUserID, quotaBytes types.FileSizeBytes,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.upsertUploadQuotaStmt).ExecContext(ctx, userID, quotaBytes)
+	return err
+}
+
+func (s *uploadQuotaStatements) SelectUploadQuota(
+	ctx context.Context, txn *sql.Tx, userID types.MatrixUserID,
+) (quotaBytes types.FileSizeBytes, err error) {
+	err = sqlutil.TxStmtContext(ctx, txn, s.selectUploadQuotaStmt).QueryRowContext(ctx, userID).Scan(&quotaBytes)
+	return
+}
+
+func (s *uploadQuotaStatements) DeleteUploadQuota(
+	ctx context.Context, txn *sql.Tx, userID types.MatrixUserID,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.deleteUploadQuotaStmt).ExecContext(ctx, userID)
+	return err
+}
@@ -4,12 +4,14 @@ import (
 	"context"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/gomatrixserverlib/spec"
 )
 
 func mustCreateDatabase(t *testing.T, dbType test.DBType) (storage.Database, func()) {
@@ -143,3 +145,505 @@ func TestThumbnailsStorage(t *testing.T) {
 		})
 	})
 }
+
+func TestRemoteMediaCache(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+		ctx := context.Background()
+
+		media := []*types.MediaMetadata{
+			{MediaID: "local", Origin: "localhost", FileSizeBytes: 1, Base64Hash: "local"},
+			{MediaID: "remote1", Origin: "remote", FileSizeBytes: 10, Base64Hash: "shared"},
+			{MediaID: "remote2", Origin: "remote", FileSizeBytes: 20, Base64Hash: "shared"},
+		}
+		for _, metadata := range media {
+			if err := db.StoreMediaMetadata(ctx, metadata); err != nil {
+				t.Fatalf("unable to store media metadata: %v", err)
+			}
+			time.Sleep(time.Millisecond * 2)
+		}
+
+		size, err := db.GetRemoteMediaCacheSize(ctx, "localhost")
+		if err != nil {
+			t.Fatalf("unable to get remote media cache size: %v", err)
+		}
+		if size != 30 {
+			t.Fatalf("expected remote media cache size 30, got %d", size)
+		}
+
+		// only remote1 was fetched before remote2
+		expired, err := db.GetRemoteMediaCachedBefore(ctx, "localhost", media[2].CreationTimestamp, 10)
+		if err != nil {
+			t.Fatalf("unable to get remote media cached before: %v", err)
+		}
+		if len(expired) != 1 || expired[0].MediaID != "remote1" {
+			t.Fatalf("unexpected expired remote media: %+v", expired)
+		}
+
+		// accessing remote1 makes remote2 the least recently accessed
+		if err = db.UpdateMediaLastAccess(ctx, "remote1", "remote"); err != nil {
+			t.Fatalf("unable to update last access: %v", err)
+		}
+		candidates, err := db.GetLeastRecentlyAccessedRemoteMedia(ctx, "localhost", 10)
+		if err != nil {
+			t.Fatalf("unable to get least recently accessed remote media: %v", err)
+		}
+		if len(candidates) != 2 || candidates[0].MediaID != "remote2" || candidates[1].MediaID != "remote1" {
+			t.Fatalf("unexpected eviction candidates: %+v", candidates)
+		}
+
+		// accesses recorded in a batch make remote1 the least recently accessed again
+		now := spec.AsTimestamp(time.Now())
+		if err = db.UpdateMediaLastAccesses(ctx, []types.MediaAccess{
+			{MediaID: "remote1", Origin: "remote", LastAccessTS: now},
+			{MediaID: "remote2", Origin: "remote", LastAccessTS: now + 1},
+		}); err != nil {
+			t.Fatalf("unable to update last accesses: %v", err)
+		}
+		candidates, err = db.GetLeastRecentlyAccessedRemoteMedia(ctx, "localhost", 10)
+		if err != nil {
+			t.Fatalf("unable to get least recently accessed remote media: %v", err)
+		}
+		if len(candidates) != 2 || candidates[0].MediaID != "remote1" || candidates[1].MediaID != "remote2" {
+			t.Fatalf("unexpected eviction candidates after batched accesses: %+v", candidates)
+		}
+
+		unreferenced, err := db.DeleteMediaMetadata(ctx, "remote2", "remote")
+		if err != nil {
+			t.Fatalf("unable to delete media metadata: %v", err)
+		}
+		if unreferenced {
+			t.Fatalf("expected the file to still be referenced by remote1")
+		}
+		count, err := db.GetMediaCountByHash(ctx, "shared")
+		if err != nil {
+			t.Fatalf("unable to count media by hash: %v", err)
+		}
+		if count != 1 {
+			t.Fatalf("expected 1 media with hash, got %d", count)
+		}
+		byHash, err := db.GetAllMediaByHash(ctx, "shared")
+		if err != nil {
+			t.Fatalf("unable to get media by hash: %v", err)
+		}
+		if len(byHash) != 1 || byHash[0].MediaID != "remote1" {
+			t.Fatalf("unexpected media with hash: %+v", byHash)
+		}
+		gotMetadata, err := db.GetMediaMetadata(ctx, "remote2", "remote")
+		if err != nil {
+			t.Fatalf("unable to query media metadata: %v", err)
+		}
+		if gotMetadata != nil {
+			t.Fatalf("expected media metadata to be deleted, got %+v", gotMetadata)
+		}
+
+		// deleting media that doesn't exist anymore doesn't drop a reference
+		if unreferenced, err = db.DeleteMediaMetadata(ctx, "remote2", "remote"); err != nil || unreferenced {
+			t.Fatalf("expected deleting missing media to leave the file referenced: %v", err)
+		}
+		// deleting the last media referring to the file leaves it unreferenced
+		if unreferenced, err = db.DeleteMediaMetadata(ctx, "remote1", "remote"); err != nil || !unreferenced {
+			t.Fatalf("expected the file to be unreferenced: %v", err)
+		}
+		if count, err = db.GetMediaCountByHash(ctx, "shared"); err != nil || count != 0 {
+			t.Fatalf("expected no media with hash, got %d: %v", count, err)
+		}
+
+		// the file is only removed if it is still unreferenced when it is removed
+		if err = db.StoreMediaMetadata(ctx, &types.MediaMetadata{
+			MediaID: "remote3", Origin: "remote", FileSizeBytes: 4, Base64Hash: "shared",
+		}); err != nil {
+			t.Fatalf("unable to store media metadata: %v", err)
+		}
+		removeFile := func() error {
+			t.Fatalf("expected the file not to be removed")
+			return nil
+		}
+		if removed, err := db.RemoveUnreferencedFile(ctx, "shared", removeFile); err != nil || removed {
+			t.Fatalf("expected the file to be kept as it was stored again: %v", err)
+		}
+		if unreferenced, err = db.DeleteMediaMetadata(ctx, "remote3", "remote"); err != nil || !unreferenced {
+			t.Fatalf("expected the file to be unreferenced: %v", err)
+		}
+		if err = db.QuarantineHash(ctx, "shared", "@admin:localhost"); err != nil {
+			t.Fatalf("unable to quarantine hash: %v", err)
+		}
+		if removed, err := db.RemoveUnreferencedFile(ctx, "shared", removeFile); err != nil || removed {
+			t.Fatalf("expected the file to be kept as it is quarantined: %v", err)
+		}
+		if err = db.UnquarantineHash(ctx, "shared"); err != nil {
+			t.Fatalf("unable to unquarantine hash: %v", err)
+		}
+		fileRemoved := false
+		removed, err := db.RemoveUnreferencedFile(ctx, "shared", func() error {
+			fileRemoved = true
+			return nil
+		})
+		if err != nil || !removed || !fileRemoved {
+			t.Fatalf("expected the file to be removed: %v", err)
+		}
+
+		// replacing media with a copy in the same file keeps the file referenced
+		if unreferenced, err = db.ReplaceMediaMetadata(ctx, &types.MediaMetadata{
+			MediaID: "local", Origin: "localhost", FileSizeBytes: 2, Base64Hash: "local",
+		}); err != nil || unreferenced {
+			t.Fatalf("expected the file to still be referenced: %v", err)
+		}
+		// replacing media with a copy in another file leaves the old file unreferenced
+		if unreferenced, err = db.ReplaceMediaMetadata(ctx, &types.MediaMetadata{
+			MediaID: "local", Origin: "localhost", FileSizeBytes: 3, Base64Hash: "replaced",
+		}); err != nil || !unreferenced {
+			t.Fatalf("expected the old file to be unreferenced: %v", err)
+		}
+		if count, err = db.GetMediaCountByHash(ctx, "local"); err != nil || count != 0 {
+			t.Fatalf("expected no media with the old hash, got %d: %v", count, err)
+		}
+		gotMetadata, err = db.GetMediaMetadata(ctx, "local", "localhost")
+		if err != nil {
+			t.Fatalf("unable to query media metadata: %v", err)
+		}
+		if gotMetadata == nil || gotMetadata.Base64Hash != "replaced" || gotMetadata.FileSizeBytes != 3 {
+			t.Fatalf("expected the replaced media metadata, got %+v", gotMetadata)
+		}
+	})
+}
+
+func TestUploadQuotas(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+		ctx := context.Background()
+
+		media := []*types.MediaMetadata{
+			{MediaID: "1", Origin: "localhost", FileSizeBytes: 10, Base64Hash: "1", UserID: "@alice:localhost"},
+			{MediaID: "2", Origin: "localhost", FileSizeBytes: 20, Base64Hash: "2", UserID: "@alice:localhost"},
+			{MediaID: "3", Origin: "localhost", FileSizeBytes: 40, Base64Hash: "3", UserID: "@bob:localhost"},
+		}
+		for _, metadata := range media {
+			if err := db.StoreMediaMetadata(ctx, metadata); err != nil {
+				t.Fatalf("unable to store media metadata: %v", err)
+			}
+		}
+		usage, err := db.GetUserUploadSize(ctx, "@alice:localhost", "localhost")
+		if err != nil {
+			t.Fatalf("unable to get upload size: %v", err)
+		}
+		if usage != 30 {
+			t.Fatalf("expected upload size 30, got %d", usage)
+		}
+
+		quota, err := db.GetUploadQuota(ctx, "@alice:localhost")
+		if err != nil {
+			t.Fatalf("unable to get upload quota: %v", err)
+		}
+		if quota != nil {
+			t.Fatalf("expected no upload quota, got %d", *quota)
+		}
+		for _, want := range []types.FileSizeBytes{100, 200} {
+			if err = db.SetUploadQuota(ctx, "@alice:localhost", want); err != nil {
+				t.Fatalf("unable to set upload quota: %v", err)
+			}
+			quota, err = db.GetUploadQuota(ctx, "@alice:localhost")
+			if err != nil {
+				t.Fatalf("unable to get upload quota: %v", err)
+			}
+			if quota == nil || *quota != want {
+				t.Fatalf("expected upload quota %d, got %v", want, quota)
+			}
+		}
+		if err = db.DeleteUploadQuota(ctx, "@alice:localhost"); err != nil {
+			t.Fatalf("unable to delete upload quota: %v", err)
+		}
+		quota, err = db.GetUploadQuota(ctx, "@alice:localhost")
+		if err != nil {
+			t.Fatalf("unable to get upload quota: %v", err)
+		}
+		if quota != nil {
+			t.Fatalf("expected no upload quota after deleting it, got %d", *quota)
+		}
+	})
+}
+
+func TestMaxUploadSizes(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+		ctx := context.Background()
+
+		maxSize, err := db.GetMaxUploadSize(ctx, "@alice:localhost")
+		if err != nil {
+			t.Fatalf("unable to get max upload size: %v", err)
+		}
+		if maxSize != nil {
+			t.Fatalf("expected no max upload size, got %d", *maxSize)
+		}
+		for _, want := range []types.FileSizeBytes{100, 0} {
+			if err = db.SetMaxUploadSize(ctx, "@alice:localhost", want); err != nil {
+				t.Fatalf("unable to set max upload size: %v", err)
+			}
+			maxSize, err = db.GetMaxUploadSize(ctx, "@alice:localhost")
+			if err != nil {
+				t.Fatalf("unable to get max upload size: %v", err)
+			}
+			if maxSize == nil || *maxSize != want {
+				t.Fatalf("expected max upload size %d, got %v", want, maxSize)
+			}
+		}
+		if err = db.DeleteMaxUploadSize(ctx, "@alice:localhost"); err != nil {
+			t.Fatalf("unable to delete max upload size: %v", err)
+		}
+		if maxSize, err = db.GetMaxUploadSize(ctx, "@alice:localhost"); err != nil || maxSize != nil {
+			t.Fatalf("expected no max upload size after deleting it, got %v (err %v)", maxSize, err)
+		}
+	})
+}
+
+func TestUserMedia(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+		ctx := context.Background()
+
+		media := []*types.MediaMetadata{
+			{MediaID: "1", Origin: "localhost", FileSizeBytes: 10, Base64Hash: "1", UserID: "@alice:localhost"},
+			{MediaID: "2", Origin: "localhost", FileSizeBytes: 20, Base64Hash: "2", UserID: "@alice:localhost"},
+			{MediaID: "3", Origin: "localhost", FileSizeBytes: 40, Base64Hash: "3", UserID: "@bob:localhost"},
+			{MediaID: "4", Origin: "remote", FileSizeBytes: 80, Base64Hash: "4", UserID: "@alice:localhost"},
+		}
+		for _, metadata := range media {
+			if err := db.StoreMediaMetadata(ctx, metadata); err != nil {
+				t.Fatalf("unable to store media metadata: %v", err)
+			}
+			// the creation timestamp is set when storing the media, make sure they differ
+			time.Sleep(time.Millisecond * 2)
+		}
+		gotMedia, err := db.GetUserMedia(ctx, "@alice:localhost", "localhost", 10, 0)
+		if err != nil {
+			t.Fatalf("unable to get user media: %v", err)
+		}
+		if len(gotMedia) != 2 || gotMedia[0].MediaID != "2" || gotMedia[1].MediaID != "1" {
+			t.Fatalf("expected media 2 and 1, got %+v", gotMedia)
+		}
+		if gotMedia[0].FileSizeBytes != 20 || gotMedia[0].LastAccessTimestamp == 0 {
+			t.Fatalf("unexpected media metadata %+v", gotMedia[0])
+		}
+		gotMedia, err = db.GetUserMedia(ctx, "@alice:localhost", "localhost", 1, 1)
+		if err != nil {
+			t.Fatalf("unable to get user media: %v", err)
+		}
+		if len(gotMedia) != 1 || gotMedia[0].MediaID != "1" {
+			t.Fatalf("expected media 1, got %+v", gotMedia)
+		}
+	})
+}
+
+func TestQuarantine(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+		ctx := context.Background()
+
+		if quarantined, err := db.IsAnyFileQuarantined(ctx); err != nil || quarantined {
+			t.Fatalf("expected no file to be quarantined, got %v (err %v)", quarantined, err)
+		}
+		if err := db.QuarantineMedia(ctx, "media", "localhost", "mediahash", "@admin:localhost"); err != nil {
+			t.Fatalf("unable to quarantine media: %v", err)
+		}
+		if quarantined, err := db.IsAnyFileQuarantined(ctx); err != nil || !quarantined {
+			t.Fatalf("expected a file to be quarantined, got %v (err %v)", quarantined, err)
+		}
+		// quarantining twice is fine
+		if err := db.QuarantineMedia(ctx, "media", "localhost", "mediahash", "@admin:localhost"); err != nil {
+			t.Fatalf("unable to quarantine media again: %v", err)
+		}
+		if err := db.QuarantineHash(ctx, "hash", "@admin:localhost"); err != nil {
+			t.Fatalf("unable to quarantine hash: %v", err)
+		}
+
+		if quarantined, err := db.IsMediaQuarantined(ctx, "media", "localhost"); err != nil || !quarantined {
+			t.Fatalf("expected media to be quarantined, got %v (err %v)", quarantined, err)
+		}
+		if quarantined, err := db.IsMediaQuarantined(ctx, "media", "remote"); err != nil || quarantined {
+			t.Fatalf("expected media from other origin not to be quarantined, got %v (err %v)", quarantined, err)
+		}
+		if quarantined, err := db.IsHashQuarantined(ctx, "hash"); err != nil || !quarantined {
+			t.Fatalf("expected hash to be quarantined, got %v (err %v)", quarantined, err)
+		}
+		// quarantining media by ID doesn't block other copies of the file
+		if quarantined, err := db.IsHashQuarantined(ctx, "mediahash"); err != nil || quarantined {
+			t.Fatalf("expected media hash not to be quarantined, got %v (err %v)", quarantined, err)
+		}
+		for _, hash := range []types.Base64Hash{"hash", "mediahash"} {
+			if quarantined, err := db.IsFileQuarantined(ctx, hash); err != nil || !quarantined {
+				t.Fatalf("expected file %s to be quarantined, got %v (err %v)", hash, quarantined, err)
+			}
+		}
+
+		if err := db.UnquarantineMedia(ctx, "media", "localhost"); err != nil {
+			t.Fatalf("unable to unquarantine media: %v", err)
+		}
+		if err := db.UnquarantineHash(ctx, "hash"); err != nil {
+			t.Fatalf("unable to unquarantine hash: %v", err)
+		}
+		if quarantined, err := db.IsMediaQuarantined(ctx, "media", "localhost"); err != nil || quarantined {
+			t.Fatalf("expected media not to be quarantined, got %v (err %v)", quarantined, err)
+		}
+		for _, hash := range []types.Base64Hash{"hash", "mediahash"} {
+			if quarantined, err := db.IsFileQuarantined(ctx, hash); err != nil || quarantined {
+				t.Fatalf("expected file %s not to be quarantined, got %v (err %v)", hash, quarantined, err)
+			}
+		}
+		if quarantined, err := db.IsAnyFileQuarantined(ctx); err != nil || quarantined {
+			t.Fatalf("expected no file to be quarantined, got %v (err %v)", quarantined, err)
+		}
+	})
+}
+
+func TestBlockedHashes(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+		ctx := context.Background()
+
+		if blocked, err := db.IsAnyHashBlocked(ctx); err != nil || blocked {
+			t.Fatalf("expected no hash to be blocked, got %v (err %v)", blocked, err)
+		}
+		if err := db.BlockHash(ctx, "hash1", "spam", "@admin:localhost"); err != nil {
+			t.Fatalf("unable to block hash: %v", err)
+		}
+		if blocked, err := db.IsAnyHashBlocked(ctx); err != nil || !blocked {
+			t.Fatalf("expected a hash to be blocked, got %v (err %v)", blocked, err)
+		}
+		// blocking again updates the reason
+		if err := db.BlockHash(ctx, "hash1", "abuse", "@admin:localhost"); err != nil {
+			t.Fatalf("unable to block hash again: %v", err)
+		}
+		if err := db.BlockHash(ctx, "hash2", "", "@admin:localhost"); err != nil {
+			t.Fatalf("unable to block hash: %v", err)
+		}
+
+		if blocked, err := db.IsHashBlocked(ctx, "hash1"); err != nil || !blocked {
+			t.Fatalf("expected hash to be blocked, got %v (err %v)", blocked, err)
+		}
+		if blocked, err := db.IsHashBlocked(ctx, "hash3"); err != nil || blocked {
+			t.Fatalf("expected hash not to be blocked, got %v (err %v)", blocked, err)
+		}
+		blockedHashes, err := db.GetBlockedHashes(ctx)
+		if err != nil {
+			t.Fatalf("unable to get blocked hashes: %v", err)
+		}
+		if len(blockedHashes) != 2 {
+			t.Fatalf("expected 2 blocked hashes, got %d", len(blockedHashes))
+		}
+		for _, blockedHash := range blockedHashes {
+			if blockedHash.Base64Hash == "hash1" && blockedHash.Reason != "abuse" {
+				t.Fatalf("expected reason to be updated, got %q", blockedHash.Reason)
+			}
+		}
+
+		if err = db.UnblockHash(ctx, "hash1"); err != nil {
+			t.Fatalf("unable to unblock hash: %v", err)
+		}
+		if blocked, err := db.IsHashBlocked(ctx, "hash1"); err != nil || blocked {
+			t.Fatalf("expected hash not to be blocked, got %v (err %v)", blocked, err)
+		}
+	})
+}
+
+func TestSecondaryHashes(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+		ctx := context.Background()
+
+		metadata := &types.MediaMetadata{
+			MediaID:         "first",
+			Origin:          "localhost",
+			Base64Hash:      "hash1",
+			SecondaryHashes: map[string]string{"blake2b-256": "abcd"},
+		}
+		if err := db.StoreMediaMetadata(ctx, metadata); err != nil {
+			t.Fatalf("unable to store media metadata: %v", err)
+		}
+		// storing another copy of the file doesn't change its hashes
+		metadata.MediaID = "second"
+		metadata.SecondaryHashes = map[string]string{"blake2b-256": "ef01"}
+		if err := db.StoreMediaMetadata(ctx, metadata); err != nil {
+			t.Fatalf("unable to store media metadata: %v", err)
+		}
+
+		secondaryHashes, err := db.GetSecondaryHashes(ctx, "hash1")
+		if err != nil {
+			t.Fatalf("unable to get secondary hashes: %v", err)
+		}
+		if !reflect.DeepEqual(map[string]string{"blake2b-256": "abcd"}, secondaryHashes) {
+			t.Fatalf("unexpected secondary hashes %v", secondaryHashes)
+		}
+		hashes, err := db.GetHashesBySecondaryHash(ctx, "blake2b-256", "abcd")
+		if err != nil {
+			t.Fatalf("unable to look up secondary hash: %v", err)
+		}
+		if !reflect.DeepEqual([]types.Base64Hash{"hash1"}, hashes) {
+			t.Fatalf("unexpected hashes %v", hashes)
+		}
+
+		// the hashes are removed along with the last reference to the file
+		for _, mediaID := range []types.MediaID{"first", "second"} {
+			if _, err = db.DeleteMediaMetadata(ctx, mediaID, "localhost"); err != nil {
+				t.Fatalf("unable to delete media metadata: %v", err)
+			}
+		}
+		if hashes, err = db.GetHashesBySecondaryHash(ctx, "blake2b-256", "abcd"); err != nil || len(hashes) != 0 {
+			t.Fatalf("expected no hashes, got %v (err %v)", hashes, err)
+		}
+	})
+}
+
+func TestMetadataCachingDatabase(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+		ctx := context.Background()
+		db = storage.NewMetadataCachingDatabase(db, &config.MediaMetadataCache{
+			Enabled:    true,
+			MaxEntries: 10,
+			MaxAge:     time.Minute,
+		})
+
+		metadata := &types.MediaMetadata{
+			MediaID:       "cached",
+			Origin:        "localhost",
+			ContentType:   "image/png",
+			FileSizeBytes: 10,
+			Base64Hash:    "Y2FjaGVk",
+			UserID:        "@alice:localhost",
+		}
+		if err := db.StoreMediaMetadata(ctx, metadata); err != nil {
+			t.Fatalf("unable to store media metadata: %v", err)
+		}
+		for i := 0; i < 2; i++ {
+			gotMetadata, err := db.GetMediaMetadata(ctx, metadata.MediaID, metadata.Origin)
+			if err != nil {
+				t.Fatalf("unable to query media metadata: %v", err)
+			}
+			if !reflect.DeepEqual(metadata, gotMetadata) {
+				t.Fatalf("expected metadata %+v, got %v", metadata, gotMetadata)
+			}
+			// changing the result doesn't change the cached metadata
+			gotMetadata.ContentType = "text/plain"
+		}
+
+		// deleting the media invalidates the cached metadata
+		if _, err := db.DeleteMediaMetadata(ctx, metadata.MediaID, metadata.Origin); err != nil {
+			t.Fatalf("unable to delete media metadata: %v", err)
+		}
+		gotMetadata, err := db.GetMediaMetadata(ctx, metadata.MediaID, metadata.Origin)
+		if err != nil {
+			t.Fatalf("unable to query media metadata: %v", err)
+		}
+		if gotMetadata != nil {
+			t.Fatalf("expected no metadata after deleting the media, got %v", gotMetadata)
+		}
+	})
+}
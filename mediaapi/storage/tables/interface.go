@@ -34,6 +34,7 @@ type Thumbnails interface {
 		ctx context.Context, txn *sql.Tx, mediaID types.MediaID,
 		mediaOrigin spec.ServerName,
 	) ([]*types.ThumbnailMetadata, error)
+	DeleteThumbnails(ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName) error
 }
 
 type MediaRepository interface {
@@ -43,4 +44,95 @@ type MediaRepository interface {
 		ctx context.Context, txn *sql.Tx,
 		mediaHash types.Base64Hash, mediaOrigin spec.ServerName,
 	) (*types.MediaMetadata, error)
+	UpdateMediaLastAccess(ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName, lastAccessTS spec.Timestamp) error
+	// SelectRemoteMediaSize returns the total size of all media not from the given origin.
+	SelectRemoteMediaSize(ctx context.Context, txn *sql.Tx, localOrigin spec.ServerName) (types.FileSizeBytes, error)
+	// SelectRemoteMediaByLastAccess returns media not from the given origin, least recently accessed first.
+	SelectRemoteMediaByLastAccess(ctx context.Context, txn *sql.Tx, localOrigin spec.ServerName, limit int) ([]*types.MediaMetadata, error)
+	// SelectRemoteMediaCreatedBefore returns media not from the given origin that was stored before the given time, oldest first.
+	SelectRemoteMediaCreatedBefore(ctx context.Context, txn *sql.Tx, localOrigin spec.ServerName, before spec.Timestamp, limit int) ([]*types.MediaMetadata, error)
+	// SelectMediaCreatedBefore returns media from the given origin, or from any other origin if remote is set,
+	// that was stored before the given time, oldest first, skipping the first offset results.
+	SelectMediaCreatedBefore(ctx context.Context, txn *sql.Tx, localOrigin spec.ServerName, remote bool, before spec.Timestamp, limit, offset int) ([]*types.MediaMetadata, error)
+	// SelectUserMediaSize returns the total size of all media uploaded by the given user to the given origin.
+	SelectUserMedia(ctx context.Context, txn *sql.Tx, userID types.MatrixUserID, mediaOrigin spec.ServerName, limit, offset int) ([]*types.MediaMetadata, error)
+	SelectUserMediaSize(ctx context.Context, txn *sql.Tx, userID types.MatrixUserID, mediaOrigin spec.ServerName) (types.FileSizeBytes, error)
+	SelectAllMediaByHash(ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash) ([]*types.MediaMetadata, error)
+	// ScrubUserMedia removes the user and the upload names from the media uploaded by the user.
+	ScrubUserMedia(ctx context.Context, txn *sql.Tx, userID types.MatrixUserID) error
+	DeleteMedia(ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName) error
+}
+
+// StoredFiles counts the media referring to each file in the media store.
+type StoredFiles interface {
+	InsertStoredFileReference(ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash) error
+	// DeleteStoredFileReference removes a reference to the file and returns how many are left.
+	DeleteStoredFileReference(ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash) (int, error)
+	SelectStoredFileReferences(ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash) (int, error)
+}
+
+// SecondaryHashes holds the hashes of files in the media store in addition to
+// their SHA-256 hash.
+type SecondaryHashes interface {
+	// InsertSecondaryHash stores a secondary hash of the file, unless one is already stored for the algorithm.
+	InsertSecondaryHash(ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash, algorithm, secondaryHash string) error
+	// SelectSecondaryHashes returns the secondary hashes of the file by algorithm.
+	SelectSecondaryHashes(ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash) (map[string]string, error)
+	// SelectHashesBySecondaryHash returns the hashes of the files with the given secondary hash.
+	SelectHashesBySecondaryHash(ctx context.Context, txn *sql.Tx, algorithm, secondaryHash string) ([]types.Base64Hash, error)
+	DeleteSecondaryHashes(ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash) error
+}
+
+type UploadQuotas interface {
+	UpsertUploadQuota(ctx context.Context, txn *sql.Tx, userID types.MatrixUserID, quotaBytes types.FileSizeBytes) error
+	SelectUploadQuota(ctx context.Context, txn *sql.Tx, userID types.MatrixUserID) (types.FileSizeBytes, error)
+	DeleteUploadQuota(ctx context.Context, txn *sql.Tx, userID types.MatrixUserID) error
+}
+
+type MaxUploadSizes interface {
+	UpsertMaxUploadSize(ctx context.Context, txn *sql.Tx, userID types.MatrixUserID, maxFileSizeBytes types.FileSizeBytes) error
+	SelectMaxUploadSize(ctx context.Context, txn *sql.Tx, userID types.MatrixUserID) (types.FileSizeBytes, error)
+	DeleteMaxUploadSize(ctx context.Context, txn *sql.Tx, userID types.MatrixUserID) error
+}
+
+type Quarantine interface {
+	InsertQuarantinedMedia(
+		ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName,
+		mediaHash types.Base64Hash, quarantinedBy types.MatrixUserID, quarantinedTS spec.Timestamp,
+	) error
+	SelectMediaQuarantined(ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName) (bool, error)
+	DeleteQuarantinedMedia(ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName) error
+	InsertQuarantinedHash(ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash, quarantinedBy types.MatrixUserID, quarantinedTS spec.Timestamp) error
+	SelectHashQuarantined(ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash) (bool, error)
+	// SelectFileQuarantined returns whether the hash, or any media with the hash, is quarantined.
+	SelectFileQuarantined(ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash) (bool, error)
+	// SelectAnyFileQuarantined returns whether any hash, or any media with a known hash, is quarantined.
+	SelectAnyFileQuarantined(ctx context.Context, txn *sql.Tx) (bool, error)
+	DeleteQuarantinedHash(ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash) error
+}
+
+type BlockedHashes interface {
+	UpsertBlockedHash(ctx context.Context, txn *sql.Tx, blockedHash *types.BlockedHash) error
+	SelectHashBlocked(ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash) (bool, error)
+	SelectAnyHashBlocked(ctx context.Context, txn *sql.Tx) (bool, error)
+	SelectBlockedHashes(ctx context.Context, txn *sql.Tx) ([]*types.BlockedHash, error)
+	DeleteBlockedHash(ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash) error
+}
+
+type AuditLog interface {
+	InsertAuditLogEntry(ctx context.Context, txn *sql.Tx, entry *types.AuditLogEntry) error
+	// SelectAuditLog returns the entries matching the filter, newest first,
+	// with IDs below before unless it is 0.
+	SelectAuditLog(ctx context.Context, txn *sql.Tx, filter *types.AuditLogFilter, before int64, limit int) ([]*types.AuditLogEntry, error)
+	RedactAuditLogBefore(ctx context.Context, txn *sql.Tx, ts spec.Timestamp) error
+	// RedactAuditLogUser removes the user and IP addresses from the entries of the user.
+	RedactAuditLogUser(ctx context.Context, txn *sql.Tx, userID types.MatrixUserID) error
+	DeleteAuditLogBefore(ctx context.Context, txn *sql.Tx, ts spec.Timestamp) (int64, error)
+}
+
+type BlockedOrigins interface {
+	UpsertBlockedOrigin(ctx context.Context, txn *sql.Tx, blockedOrigin *types.BlockedOrigin) error
+	SelectOriginBlocked(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) (bool, error)
+	SelectBlockedOrigins(ctx context.Context, txn *sql.Tx) ([]*types.BlockedOrigin, error)
+	DeleteBlockedOrigin(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) error
 }
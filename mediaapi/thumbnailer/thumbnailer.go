@@ -25,9 +25,45 @@ import (
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
 
+func init() {
+	prometheus.MustRegister(
+		thumbnailGeneratorsActive, thumbnailGenerationWaiting,
+		thumbnailGeneratorsBusy,
+	)
+}
+
+// The metrics of the thumbnail generators, so that operators can size max_thumbnail_generators.
+var thumbnailGeneratorsActive = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "mediaapi",
+		Name:      "thumbnail_generators_active",
+		Help:      "Number of thumbnails being generated",
+	},
+)
+
+var thumbnailGenerationWaiting = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "mediaapi",
+		Name:      "thumbnail_generation_waiting",
+		Help:      "Number of requests waiting for a thumbnail to be generated",
+	},
+)
+
+var thumbnailGeneratorsBusy = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "mediaapi",
+		Name:      "thumbnail_generators_busy_total",
+		Help:      "Number of thumbnails that weren't generated because all generators were busy",
+	},
+)
+
 type thumbnailFitness struct {
 	isSmaller      int
 	aspect         float64
@@ -36,6 +72,9 @@ type thumbnailFitness struct {
 	fileSize       types.FileSizeBytes
 }
 
+// workerOperation names thumbnail generation in the metrics of the media workers.
+const workerOperation = "thumbnail"
+
 // thumbnailTemplate is the filename template for thumbnails
 const thumbnailTemplate = "thumbnail-%vx%v-%v"
 
@@ -56,9 +95,10 @@ func GetThumbnailPath(src types.Path, config types.ThumbnailSize) types.Path {
 // * has a size close to requested
 // * if a cropped image is desired, prefer the same method, if scaled is desired, absolutely require scaled
 // * has a small file size
+// With the at_least selection, thumbnails smaller than requested are never chosen.
 // If a pre-generated thumbnail size is the best match, but it has not been generated yet, the caller can use the returned size to generate it.
 // Returns nil if no thumbnail matches the criteria
-func SelectThumbnail(desired types.ThumbnailSize, thumbnails []*types.ThumbnailMetadata, thumbnailSizes []config.ThumbnailSize) (*types.ThumbnailMetadata, *types.ThumbnailSize) {
+func SelectThumbnail(desired types.ThumbnailSize, thumbnails []*types.ThumbnailMetadata, thumbnailSizes []config.ThumbnailSize, selection string) (*types.ThumbnailMetadata, *types.ThumbnailSize) {
 	var chosenThumbnail *types.ThumbnailMetadata
 	var chosenThumbnailSize *types.ThumbnailSize
 	bestFit := newThumbnailFitness()
@@ -68,6 +108,9 @@ func SelectThumbnail(desired types.ThumbnailSize, thumbnails []*types.ThumbnailM
 			continue
 		}
 		fitness := calcThumbnailFitness(thumbnail.ThumbnailSize, thumbnail.MediaMetadata, desired)
+		if selection == config.ThumbnailSelectionAtLeast && fitness.isSmaller == 1 {
+			continue
+		}
 		if isBetter := fitness.betterThan(bestFit, desired.ResizeMethod == types.Crop); isBetter {
 			bestFit = fitness
 			chosenThumbnail = thumbnail
@@ -79,6 +122,9 @@ func SelectThumbnail(desired types.ThumbnailSize, thumbnails []*types.ThumbnailM
 			continue
 		}
 		fitness := calcThumbnailFitness(types.ThumbnailSize(thumbnailSize), nil, desired)
+		if selection == config.ThumbnailSelectionAtLeast && fitness.isSmaller == 1 {
+			continue
+		}
 		if isBetter := fitness.betterThan(bestFit, desired.ResizeMethod == types.Crop); isBetter {
 			bestFit = fitness
 			chosenThumbnailSize = (*types.ThumbnailSize)(&thumbnailSize)
@@ -97,7 +143,9 @@ func getActiveThumbnailGeneration(dst types.Path, _ types.ThumbnailSize, activeT
 		logger.Info("Waiting for another goroutine to generate the thumbnail.")
 
 		// NOTE: Wait unlocks and locks again internally. There is still a deferred Unlock() that will unlock this.
+		thumbnailGenerationWaiting.Inc()
 		activeThumbnailGenerationResult.Cond.Wait()
+		thumbnailGenerationWaiting.Dec()
 		// Note: either there is an error or it is nil, either way returning it is correct
 		return false, false, activeThumbnailGenerationResult.Err
 	}
@@ -106,6 +154,7 @@ func getActiveThumbnailGeneration(dst types.Path, _ types.ThumbnailSize, activeT
 	// original. Or in the case of pre-generation, they maybe get generated on the first request for a thumbnail if
 	// load has subsided.
 	if len(activeThumbnailGeneration.PathToResult) >= maxThumbnailGenerators {
+		thumbnailGeneratorsBusy.Inc()
 		return false, true, nil
 	}
 
@@ -113,6 +162,7 @@ func getActiveThumbnailGeneration(dst types.Path, _ types.ThumbnailSize, activeT
 	activeThumbnailGeneration.PathToResult[string(dst)] = &types.ThumbnailGenerationResult{
 		Cond: &sync.Cond{L: activeThumbnailGeneration},
 	}
+	thumbnailGeneratorsActive.Inc()
 
 	return true, false, nil
 }
@@ -127,10 +177,20 @@ func broadcastGeneration(dst types.Path, activeThumbnailGeneration *types.Active
 		// Note: errorReturn is a named return value error that is signalled from here to waiting goroutines
 		activeThumbnailGenerationResult.Err = errorReturn
 		activeThumbnailGenerationResult.Cond.Broadcast()
+		thumbnailGeneratorsActive.Dec()
 	}
 	delete(activeThumbnailGeneration.PathToResult, string(dst))
 }
 
+// IsGenerating returns true if the thumbnail of the given size of the file at src
+// is being generated, in which case GenerateThumbnail would wait for it.
+func IsGenerating(src types.Path, size types.ThumbnailSize, activeThumbnailGeneration *types.ActiveThumbnailGeneration) bool {
+	activeThumbnailGeneration.Lock()
+	defer activeThumbnailGeneration.Unlock()
+	_, ok := activeThumbnailGeneration.PathToResult[string(GetThumbnailPath(src, size))]
+	return ok
+}
+
 func isThumbnailExists(
 	ctx context.Context,
 	dst types.Path,
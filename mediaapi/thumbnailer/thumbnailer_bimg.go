@@ -19,11 +19,13 @@ package thumbnailer
 
 import (
 	"context"
-	"os"
+	"errors"
 	"time"
 
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/mediaapi/workers"
 	"github.com/matrix-org/dendrite/setup/config"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/h2non/bimg.v1"
@@ -38,9 +40,10 @@ func GenerateThumbnails(
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 	db storage.Database,
+	encryption *fileutils.Encryption,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
-	buffer, err := bimg.Read(string(src))
+	buffer, err := fileutils.ReadStoredFile(string(src), encryption)
 	if err != nil {
 		logger.WithError(err).WithField("src", src).Error("Failed to read src file")
 		return false, err
@@ -50,7 +53,7 @@ func GenerateThumbnails(
 		// Note: createThumbnail does locking based on activeThumbnailGeneration
 		busy, err = createThumbnail(
 			ctx, src, img, types.ThumbnailSize(config), mediaMetadata, activeThumbnailGeneration,
-			maxThumbnailGenerators, db, logger,
+			maxThumbnailGenerators, db, encryption, logger,
 		)
 		if err != nil {
 			logger.WithError(err).WithField("src", src).Error("Failed to generate thumbnails")
@@ -72,9 +75,10 @@ func GenerateThumbnail(
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 	db storage.Database,
+	encryption *fileutils.Encryption,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
-	buffer, err := bimg.Read(string(src))
+	buffer, err := fileutils.ReadStoredFile(string(src), encryption)
 	if err != nil {
 		logger.WithError(err).WithFields(log.Fields{
 			"src": src,
@@ -85,7 +89,7 @@ func GenerateThumbnail(
 	// Note: createThumbnail does locking based on activeThumbnailGeneration
 	busy, err = createThumbnail(
 		ctx, src, img, config, mediaMetadata, activeThumbnailGeneration,
-		maxThumbnailGenerators, db, logger,
+		maxThumbnailGenerators, db, encryption, logger,
 	)
 	if err != nil {
 		logger.WithError(err).WithFields(log.Fields{
@@ -110,6 +114,7 @@ func createThumbnail(
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 	db storage.Database,
+	encryption *fileutils.Encryption,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
 	logger = logger.WithFields(log.Fields{
@@ -153,7 +158,15 @@ func createThumbnail(
 	}
 
 	start := time.Now()
-	width, height, err := resize(dst, img, config.Width, config.Height, config.ResizeMethod == "crop", logger)
+	var width, height int
+	err = activeThumbnailGeneration.Workers.Do(ctx, workerOperation, func() (err error) {
+		width, height, err = resize(dst, img, config.Width, config.Height, config.ResizeMethod == "crop", encryption, logger)
+		return err
+	})
+	if errors.Is(err, workers.ErrQueueTimeout) {
+		thumbnailGeneratorsBusy.Inc()
+		return true, nil
+	}
 	if err != nil {
 		return false, err
 	}
@@ -163,7 +176,7 @@ func createThumbnail(
 		"processTime":  time.Now().Sub(start),
 	}).Info("Generated thumbnail")
 
-	stat, err := os.Stat(string(dst))
+	size, err := fileutils.StoredFileSize(string(dst), encryption)
 	if err != nil {
 		return false, err
 	}
@@ -174,7 +187,7 @@ func createThumbnail(
 			Origin:  mediaMetadata.Origin,
 			// Note: the code currently always creates a JPEG thumbnail
 			ContentType:   types.ContentType("image/jpeg"),
-			FileSizeBytes: types.FileSizeBytes(stat.Size()),
+			FileSizeBytes: types.FileSizeBytes(size),
 		},
 		ThumbnailSize: types.ThumbnailSize{
 			Width:        config.Width,
@@ -206,7 +219,7 @@ func isLargerThanOriginal(config types.ThumbnailSize, img *bimg.Image) bool {
 // resize scales an image to fit within the provided width and height
 // If the source aspect ratio is different to the target dimensions, one edge will be smaller than requested
 // If crop is set to true, the image will be scaled to fill the width and height with any excess being cropped off
-func resize(dst types.Path, inImage *bimg.Image, w, h int, crop bool, logger *log.Entry) (int, int, error) {
+func resize(dst types.Path, inImage *bimg.Image, w, h int, crop bool, encryption *fileutils.Encryption, logger *log.Entry) (int, int, error) {
 	inSize, err := inImage.Size()
 	if err != nil {
 		return -1, -1, err
@@ -240,10 +253,24 @@ func resize(dst types.Path, inImage *bimg.Image, w, h int, crop bool, logger *lo
 		return -1, -1, err
 	}
 
-	if err = bimg.Write(string(dst), newImage); err != nil {
+	if err = writeFile(newImage, string(dst), encryption); err != nil {
 		logger.WithError(err).Error("Failed to resize image")
 		return -1, -1, err
 	}
 
 	return options.Width, options.Height, nil
 }
+
+func writeFile(buf []byte, dst string, encryption *fileutils.Encryption) (err error) {
+	out, err := fileutils.CreateStoredFile(dst, encryption)
+	if err != nil {
+		return err
+	}
+	defer (func() {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	})()
+	_, err = out.Write(buf)
+	return err
+}
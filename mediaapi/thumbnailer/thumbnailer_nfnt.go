@@ -19,6 +19,7 @@ package thumbnailer
 
 import (
 	"context"
+	"errors"
 	"image"
 	"image/draw"
 
@@ -32,11 +33,12 @@ import (
 	// Imported for webp codec
 	_ "golang.org/x/image/webp"
 
-	"os"
 	"time"
 
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/mediaapi/workers"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/nfnt/resize"
 	log "github.com/sirupsen/logrus"
@@ -51,9 +53,18 @@ func GenerateThumbnails(
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 	db storage.Database,
+	encryption *fileutils.Encryption,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
-	img, err := readFile(string(src))
+	var img image.Image
+	err := activeThumbnailGeneration.Workers.Do(ctx, workerOperation, func() (err error) {
+		img, err = readFile(string(src), encryption)
+		return err
+	})
+	if errors.Is(err, workers.ErrQueueTimeout) {
+		thumbnailGeneratorsBusy.Inc()
+		return true, nil
+	}
 	if err != nil {
 		logger.WithError(err).WithField("src", src).Error("Failed to read src file")
 		return false, err
@@ -62,7 +73,7 @@ func GenerateThumbnails(
 		// Note: createThumbnail does locking based on activeThumbnailGeneration
 		busy, err = createThumbnail(
 			ctx, src, img, types.ThumbnailSize(singleConfig), mediaMetadata,
-			activeThumbnailGeneration, maxThumbnailGenerators, db, logger,
+			activeThumbnailGeneration, maxThumbnailGenerators, db, encryption, logger,
 		)
 		if err != nil {
 			logger.WithError(err).WithField("src", src).Error("Failed to generate thumbnails")
@@ -84,9 +95,18 @@ func GenerateThumbnail(
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 	db storage.Database,
+	encryption *fileutils.Encryption,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
-	img, err := readFile(string(src))
+	var img image.Image
+	err := activeThumbnailGeneration.Workers.Do(ctx, workerOperation, func() (err error) {
+		img, err = readFile(string(src), encryption)
+		return err
+	})
+	if errors.Is(err, workers.ErrQueueTimeout) {
+		thumbnailGeneratorsBusy.Inc()
+		return true, nil
+	}
 	if err != nil {
 		logger.WithError(err).WithFields(log.Fields{
 			"src": src,
@@ -96,7 +116,7 @@ func GenerateThumbnail(
 	// Note: createThumbnail does locking based on activeThumbnailGeneration
 	busy, err = createThumbnail(
 		ctx, src, img, config, mediaMetadata, activeThumbnailGeneration,
-		maxThumbnailGenerators, db, logger,
+		maxThumbnailGenerators, db, encryption, logger,
 	)
 	if err != nil {
 		logger.WithError(err).WithFields(log.Fields{
@@ -110,8 +130,8 @@ func GenerateThumbnail(
 	return false, nil
 }
 
-func readFile(src string) (image.Image, error) {
-	file, err := os.Open(src)
+func readFile(src string, encryption *fileutils.Encryption) (image.Image, error) {
+	file, err := fileutils.OpenStoredFile(src, encryption)
 	if err != nil {
 		return nil, err
 	}
@@ -125,8 +145,8 @@ func readFile(src string) (image.Image, error) {
 	return img, nil
 }
 
-func writeFile(img image.Image, dst string) (err error) {
-	out, err := os.Create(dst)
+func writeFile(img image.Image, dst string, encryption *fileutils.Encryption) (err error) {
+	out, err := fileutils.CreateStoredFile(dst, encryption)
 	if err != nil {
 		return err
 	}
@@ -148,6 +168,7 @@ func createThumbnail(
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 	db storage.Database,
+	encryption *fileutils.Encryption,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
 	logger = logger.WithFields(log.Fields{
@@ -191,7 +212,15 @@ func createThumbnail(
 	}
 
 	start := time.Now()
-	width, height, err := adjustSize(dst, img, config.Width, config.Height, config.ResizeMethod == types.Crop, logger)
+	var width, height int
+	err = activeThumbnailGeneration.Workers.Do(ctx, workerOperation, func() (err error) {
+		width, height, err = adjustSize(dst, img, config.Width, config.Height, config.ResizeMethod == types.Crop, encryption, logger)
+		return err
+	})
+	if errors.Is(err, workers.ErrQueueTimeout) {
+		thumbnailGeneratorsBusy.Inc()
+		return true, nil
+	}
 	if err != nil {
 		return false, err
 	}
@@ -201,7 +230,7 @@ func createThumbnail(
 		"processTime":  time.Since(start),
 	}).Info("Generated thumbnail")
 
-	stat, err := os.Stat(string(dst))
+	size, err := fileutils.StoredFileSize(string(dst), encryption)
 	if err != nil {
 		return false, err
 	}
@@ -212,7 +241,7 @@ func createThumbnail(
 			Origin:  mediaMetadata.Origin,
 			// Note: the code currently always creates a JPEG thumbnail
 			ContentType:   types.ContentType("image/jpeg"),
-			FileSizeBytes: types.FileSizeBytes(stat.Size()),
+			FileSizeBytes: types.FileSizeBytes(size),
 		},
 		ThumbnailSize: types.ThumbnailSize{
 			Width:        config.Width,
@@ -236,7 +265,7 @@ func createThumbnail(
 // adjustSize scales an image to fit within the provided width and height
 // If the source aspect ratio is different to the target dimensions, one edge will be smaller than requested
 // If crop is set to true, the image will be scaled to fill the width and height with any excess being cropped off
-func adjustSize(dst types.Path, img image.Image, w, h int, crop bool, logger *log.Entry) (int, int, error) {
+func adjustSize(dst types.Path, img image.Image, w, h int, crop bool, encryption *fileutils.Encryption, logger *log.Entry) (int, int, error) {
 	var out image.Image
 	var err error
 	if crop {
@@ -267,7 +296,7 @@ func adjustSize(dst types.Path, img image.Image, w, h int, crop bool, logger *lo
 		out = resize.Thumbnail(uint(w), uint(h), img, resize.Lanczos3)
 	}
 
-	if err = writeFile(out, string(dst)); err != nil {
+	if err = writeFile(out, string(dst), encryption); err != nil {
 		logger.WithError(err).Error("Failed to encode and write image")
 		return -1, -1, err
 	}
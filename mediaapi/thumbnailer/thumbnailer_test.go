@@ -0,0 +1,44 @@
+package thumbnailer
+
+import (
+	"testing"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectThumbnail(t *testing.T) {
+	thumbnailSizes := []config.ThumbnailSize{
+		{Width: 32, Height: 32, ResizeMethod: types.Crop},
+		{Width: 96, Height: 96, ResizeMethod: types.Crop},
+		{Width: 640, Height: 480, ResizeMethod: types.Scale},
+	}
+	generated := &types.ThumbnailMetadata{
+		MediaMetadata: &types.MediaMetadata{FileSizeBytes: 1024},
+		ThumbnailSize: types.ThumbnailSize(thumbnailSizes[1]),
+	}
+
+	// The closest size at least as large as requested is chosen.
+	thumbnail, size := SelectThumbnail(types.ThumbnailSize{Width: 64, Height: 64, ResizeMethod: types.Crop}, nil, thumbnailSizes, config.ThumbnailSelectionClosest)
+	assert.Nil(t, thumbnail)
+	assert.Equal(t, &types.ThumbnailSize{Width: 96, Height: 96, ResizeMethod: types.Crop}, size)
+
+	// A generated thumbnail is chosen over generating the same size again.
+	thumbnail, size = SelectThumbnail(types.ThumbnailSize{Width: 64, Height: 64, ResizeMethod: types.Crop}, []*types.ThumbnailMetadata{generated}, thumbnailSizes, config.ThumbnailSelectionClosest)
+	assert.Same(t, generated, thumbnail)
+	assert.Nil(t, size)
+
+	// Scaled thumbnails are only chosen from scaled sizes.
+	_, size = SelectThumbnail(types.ThumbnailSize{Width: 64, Height: 64, ResizeMethod: types.Scale}, nil, thumbnailSizes, config.ThumbnailSelectionClosest)
+	assert.Equal(t, &types.ThumbnailSize{Width: 640, Height: 480, ResizeMethod: types.Scale}, size)
+
+	// If none is large enough, the largest is chosen, unless only thumbnails
+	// at least as large as requested may be chosen.
+	desired := types.ThumbnailSize{Width: 1024, Height: 1024, ResizeMethod: types.Scale}
+	_, size = SelectThumbnail(desired, nil, thumbnailSizes, config.ThumbnailSelectionClosest)
+	assert.Equal(t, &types.ThumbnailSize{Width: 640, Height: 480, ResizeMethod: types.Scale}, size)
+	thumbnail, size = SelectThumbnail(desired, nil, thumbnailSizes, config.ThumbnailSelectionAtLeast)
+	assert.Nil(t, thumbnail)
+	assert.Nil(t, size)
+}
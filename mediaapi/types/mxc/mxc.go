@@ -0,0 +1,134 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mxc parses, validates and builds mxc://<server-name>/<media-id>
+// content URIs.
+// https://spec.matrix.org/v1.11/client-server-api/#matrix-content-mxc-uris
+package mxc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+// Scheme is the prefix of every content URI.
+const Scheme = "mxc://"
+
+const (
+	// MaxMediaIDLength is the longest media ID accepted.
+	MaxMediaIDLength = 255
+	// MaxServerNameLength is the longest server name accepted, the longest a
+	// DNS name can be plus a port.
+	MaxServerNameLength = 255 + len(":65535")
+)
+
+// MediaIDCharacters are the characters a media ID may be made of, as a regular
+// expression character class.
+const MediaIDCharacters = "A-Za-z0-9_=-"
+
+var (
+	// ErrInvalidScheme is returned for URIs that don't start with mxc://.
+	ErrInvalidScheme = errors.New("must start with " + Scheme)
+	// ErrInvalidServerName is returned for URIs whose server name is missing,
+	// too long or not a valid server name.
+	ErrInvalidServerName = errors.New("invalid server name")
+	// ErrInvalidMediaID is returned for URIs whose media ID is missing, too long
+	// or has characters other than MediaIDCharacters.
+	ErrInvalidMediaID = fmt.Errorf("media ID must be a non-empty string of at most %d characters in %s", MaxMediaIDLength, MediaIDCharacters)
+)
+
+// Error is returned when a content URI is invalid. It wraps one of the Err
+// variables, so that the reason can be checked with errors.Is.
+type Error struct {
+	URI string
+	Err error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("invalid content URI %q: %s", e.URI, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// URI is a parsed content URI.
+type URI struct {
+	ServerName spec.ServerName
+	MediaID    types.MediaID
+}
+
+// Parse parses and validates a content URI.
+func Parse(s string) (URI, error) {
+	rest, ok := strings.CutPrefix(s, Scheme)
+	if !ok {
+		return URI{}, &Error{URI: s, Err: ErrInvalidScheme}
+	}
+	serverName, mediaID, _ := strings.Cut(rest, "/")
+	uri := URI{ServerName: spec.ServerName(serverName), MediaID: types.MediaID(mediaID)}
+	if err := uri.Validate(); err != nil {
+		return URI{}, &Error{URI: s, Err: err}
+	}
+	return uri, nil
+}
+
+// New returns the content URI of the media, if the server name and media ID are
+// valid.
+func New(serverName spec.ServerName, mediaID types.MediaID) (URI, error) {
+	uri := URI{ServerName: serverName, MediaID: mediaID}
+	if err := uri.Validate(); err != nil {
+		return URI{}, &Error{URI: uri.String(), Err: err}
+	}
+	return uri, nil
+}
+
+// Validate returns ErrInvalidServerName or ErrInvalidMediaID if either part of
+// the URI is invalid.
+func (u URI) Validate() error {
+	if len(u.ServerName) > MaxServerNameLength {
+		return ErrInvalidServerName
+	}
+	if _, _, valid := spec.ParseAndValidateServerName(u.ServerName); !valid {
+		return ErrInvalidServerName
+	}
+	return ValidateMediaID(u.MediaID)
+}
+
+// String returns the mxc:// form of the URI. The URI isn't validated.
+func (u URI) String() string {
+	return Scheme + string(u.ServerName) + "/" + string(u.MediaID)
+}
+
+// ValidateMediaID returns ErrInvalidMediaID if the media ID is empty, too long
+// or has characters other than MediaIDCharacters.
+func ValidateMediaID(mediaID types.MediaID) error {
+	if len(mediaID) == 0 || len(mediaID) > MaxMediaIDLength {
+		return ErrInvalidMediaID
+	}
+	for _, c := range []byte(mediaID) {
+		if !isMediaIDCharacter(c) {
+			return ErrInvalidMediaID
+		}
+	}
+	return nil
+}
+
+func isMediaIDCharacter(c byte) bool {
+	return (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+		c == '_' || c == '=' || c == '-'
+}
@@ -0,0 +1,56 @@
+package mxc
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		uri string
+		err error
+	}{
+		{"mxc://example.com/abcDEF123_-=", nil},
+		{"mxc://example.com:8448/abc", nil},
+		{"mxc://127.0.0.1/abc", nil},
+		{"mxc://[::1]:8448/abc", nil},
+		{"https://example.com/abc", ErrInvalidScheme},
+		{"MXC://example.com/abc", ErrInvalidScheme},
+		{"mxc:///abc", ErrInvalidServerName},
+		{"mxc://exa mple.com/abc", ErrInvalidServerName},
+		{"mxc://example.com:port/abc", ErrInvalidServerName},
+		{"mxc://" + strings.Repeat("a", 300) + "/abc", ErrInvalidServerName},
+		{"mxc://example.com", ErrInvalidMediaID},
+		{"mxc://example.com/", ErrInvalidMediaID},
+		{"mxc://example.com/../etc/passwd", ErrInvalidMediaID},
+		{"mxc://example.com/abc/def", ErrInvalidMediaID},
+		{"mxc://example.com/" + strings.Repeat("a", 256), ErrInvalidMediaID},
+	} {
+		uri, err := Parse(tc.uri)
+		if tc.err == nil {
+			assert.NoError(t, err, tc.uri)
+			assert.Equal(t, tc.uri, uri.String())
+			continue
+		}
+		assert.True(t, errors.Is(err, tc.err), "%s: %v", tc.uri, err)
+		var mxcErr *Error
+		if assert.True(t, errors.As(err, &mxcErr), tc.uri) {
+			assert.Equal(t, tc.uri, mxcErr.URI)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	uri, err := New("example.com", "abc")
+	assert.NoError(t, err)
+	assert.Equal(t, "mxc://example.com/abc", uri.String())
+
+	_, err = New("example.com", types.MediaID("a/b"))
+	assert.True(t, errors.Is(err, ErrInvalidMediaID))
+	_, err = New("", "abc")
+	assert.True(t, errors.Is(err, ErrInvalidServerName))
+}
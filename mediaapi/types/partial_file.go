@@ -0,0 +1,151 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// ErrPartialFileUnavailable is returned by PartialFile.NewReader if the file
+// can't be read while it is being written, e.g. because it is encrypted or
+// writing it has already finished.
+var ErrPartialFileUnavailable = errors.New("partially written file is unavailable")
+
+// PartialFile is a remote file that is being written to a temp file, which
+// other requests for the file can read as it is written rather than waiting
+// for all of it.
+type PartialFile struct {
+	// MediaMetadata of the file, with the size it will have once complete.
+	MediaMetadata MediaMetadata
+
+	mu   sync.Mutex
+	path Path
+	size int64
+	done bool
+	err  error
+	// Closed and replaced whenever more of the file has been written, or
+	// writing it has finished.
+	changed chan struct{}
+}
+
+// NewPartialFile returns a partial file with a copy of the metadata.
+func NewPartialFile(metadata *MediaMetadata) *PartialFile {
+	return &PartialFile{
+		MediaMetadata: *metadata,
+		changed:       make(chan struct{}),
+	}
+}
+
+// TempFileWritten records that size bytes of the temp file at path have been
+// written.
+func (f *PartialFile) TempFileWritten(path Path, size int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.path = path
+	f.size = size
+	f.notify()
+}
+
+// Finish records that writing the file has finished, unsuccessfully if err
+// isn't nil. Readers fail with err once they have read what was written.
+func (f *PartialFile) Finish(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.done {
+		return
+	}
+	f.done = true
+	f.err = err
+	f.notify()
+}
+
+func (f *PartialFile) notify() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// NewReader waits until the first part of the file has been written, and
+// returns a reader of the file which waits for more of it to be written until
+// writing it has finished. Reading fails once ctx is done. If writing the file
+// finishes before any of it was read, ErrPartialFileUnavailable is returned, as
+// the temp file may no longer exist.
+func (f *PartialFile) NewReader(ctx context.Context) (io.ReadCloser, error) {
+	for {
+		f.mu.Lock()
+		path, done, changed := f.path, f.done, f.changed
+		f.mu.Unlock()
+		if done {
+			return nil, ErrPartialFileUnavailable
+		}
+		if path != "" {
+			file, err := os.Open(string(path))
+			if err != nil {
+				// The temp file was moved into the media store after all.
+				return nil, ErrPartialFileUnavailable
+			}
+			return &partialFileReader{ctx: ctx, f: f, file: file}, nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+type partialFileReader struct {
+	ctx    context.Context
+	f      *PartialFile
+	file   *os.File
+	offset int64
+}
+
+func (r *partialFileReader) Read(p []byte) (int, error) {
+	for {
+		r.f.mu.Lock()
+		size, done, err, changed := r.f.size, r.f.done, r.f.err, r.f.changed
+		r.f.mu.Unlock()
+		if available := size - r.offset; available > 0 {
+			if int64(len(p)) > available {
+				p = p[:available]
+			}
+			n, err := r.file.Read(p)
+			r.offset += int64(n)
+			if err == io.EOF {
+				err = nil
+			}
+			return n, err
+		}
+		if done {
+			if err != nil {
+				return 0, err
+			}
+			return 0, io.EOF
+		}
+		select {
+		case <-changed:
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		}
+	}
+}
+
+func (r *partialFileReader) Close() error {
+	return r.file.Close()
+}
@@ -15,8 +15,13 @@
 package types
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
 	"sync"
 
+	"github.com/matrix-org/dendrite/mediaapi/workers"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/gomatrixserverlib/spec"
 )
@@ -33,6 +38,34 @@ type Filename string
 // Base64Hash is a base64 URLEncoding string representation of a SHA-256 hash sum
 type Base64Hash string
 
+// ParseBase64Hash parses a hex or unpadded URL-safe base64 encoded SHA-256 hash sum.
+func ParseBase64Hash(hash string) (Base64Hash, error) {
+	decoded, err := hex.DecodeString(hash)
+	if err != nil {
+		decoded, err = base64.RawURLEncoding.DecodeString(hash)
+	}
+	if err != nil || len(decoded) != sha256.Size {
+		return "", fmt.Errorf("invalid SHA-256 hash %q", hash)
+	}
+	return Base64Hash(base64.RawURLEncoding.EncodeToString(decoded)), nil
+}
+
+// BlockedHash is a file hash that may not be uploaded or downloaded.
+type BlockedHash struct {
+	Base64Hash Base64Hash
+	Reason     string
+	BlockedBy  MatrixUserID
+	BlockedTS  spec.Timestamp
+}
+
+// BlockedOrigin is a server whose media may not be fetched or downloaded.
+type BlockedOrigin struct {
+	ServerName spec.ServerName
+	Reason     string
+	BlockedBy  MatrixUserID
+	BlockedTS  spec.Timestamp
+}
+
 // Path is an absolute or relative UNIX filesystem path
 type Path string
 
@@ -54,7 +87,56 @@ type MediaMetadata struct {
 	CreationTimestamp spec.Timestamp
 	UploadName        Filename
 	Base64Hash        Base64Hash
-	UserID            MatrixUserID
+	// Hex encoded hashes of the file in addition to Base64Hash, by algorithm.
+	// Only set when the media is stored.
+	SecondaryHashes map[string]string
+	UserID          MatrixUserID
+	// The content coding the file is compressed with in the media store, or
+	// empty if it isn't compressed.
+	StoredEncoding string
+	// Only set when listing the media of a user
+	LastAccessTimestamp spec.Timestamp
+}
+
+// The actions recorded in the media audit log.
+const (
+	AuditUpload           = "upload"
+	AuditDownload         = "download"
+	AuditThumbnail        = "thumbnail"
+	AuditDelete           = "delete"
+	AuditQuarantine       = "quarantine"
+	AuditUnquarantine     = "unquarantine"
+	AuditQuarantineHash   = "quarantine_hash"
+	AuditUnquarantineHash = "unquarantine_hash"
+	AuditErase            = "erase"
+)
+
+// AuditLogEntry records who did what to which media, and when. Actions on all
+// media with a file hash have a hash but no media ID. The user and IP address
+// are empty if they aren't known or have been redacted.
+type AuditLogEntry struct {
+	ID         int64
+	TS         spec.Timestamp
+	Action     string
+	MediaID    MediaID
+	Origin     spec.ServerName
+	Base64Hash Base64Hash
+	UserID     MatrixUserID
+	IPAddress  string
+}
+
+// AuditLogFilter selects audit log entries. Empty fields match all entries.
+type AuditLogFilter struct {
+	UserID  MatrixUserID
+	Origin  spec.ServerName
+	MediaID MediaID
+}
+
+// MediaAccess is when media was downloaded or thumbnailed.
+type MediaAccess struct {
+	MediaID      MediaID
+	Origin       spec.ServerName
+	LastAccessTS spec.Timestamp
 }
 
 // RemoteRequestResult is used for broadcasting the result of a request for a remote file to routines waiting on the condition
@@ -65,6 +147,11 @@ type RemoteRequestResult struct {
 	MediaMetadata *MediaMetadata
 	// An error, nil in case of no error.
 	Error error
+	// Set once the result has been signalled.
+	Done bool
+	// The file as it is being fetched, for other requests to read from before
+	// it is complete. Nil until the fetch has started writing it.
+	PartialFile *PartialFile
 }
 
 // ActiveRemoteRequests is a lockable map of media URIs requested from remote homeservers
@@ -98,6 +185,8 @@ type ActiveThumbnailGeneration struct {
 	sync.Mutex
 	// The string key is a thumbnail file path
 	PathToResult map[string]*ThumbnailGenerationResult
+	// The workers thumbnails are generated on, nil to generate them straight away.
+	Workers *workers.Pool
 }
 
 // Crop indicates we should crop the thumbnail on resize
@@ -0,0 +1,133 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package workers limits how many CPU-heavy media operations, such as
+// generating thumbnails and compressing files, run at once, so that they can't
+// starve the rest of the server.
+package workers
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	queueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "dendrite",
+			Subsystem: "mediaapi",
+			Name:      "worker_queue_depth",
+			Help:      "The number of media operations waiting for a worker",
+		},
+		[]string{"operation"},
+	)
+	workersBusy = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "dendrite",
+			Subsystem: "mediaapi",
+			Name:      "workers_busy",
+			Help:      "The number of media workers running an operation",
+		},
+		[]string{"operation"},
+	)
+	queueWait = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "dendrite",
+			Subsystem: "mediaapi",
+			Name:      "worker_queue_wait_seconds",
+			Help:      "How long media operations waited for a worker",
+			Buckets:   []float64{.001, .01, .1, .5, 1, 2.5, 5, 10, 30, 60},
+		},
+		[]string{"operation"},
+	)
+	queueTimeouts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "mediaapi",
+			Name:      "worker_queue_timeouts_total",
+			Help:      "The number of media operations given up on because no worker was free in time",
+		},
+		[]string{"operation"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(queueDepth, workersBusy, queueWait, queueTimeouts)
+}
+
+// ErrQueueTimeout is returned by Do if no worker was free before the queue
+// timeout.
+var ErrQueueTimeout = errors.New("timed out waiting for a free media worker")
+
+// Pool is a bounded number of workers that operations queue for. A nil *Pool
+// runs operations straight away.
+type Pool struct {
+	slots        chan struct{}
+	queueTimeout time.Duration
+}
+
+// NewPool returns a pool of the given number of workers, or of one per CPU if
+// it isn't positive. Operations wait for a worker for up to the queue timeout,
+// or indefinitely if it isn't positive.
+func NewPool(concurrency int, queueTimeout time.Duration) *Pool {
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+	return &Pool{
+		slots:        make(chan struct{}, concurrency),
+		queueTimeout: queueTimeout,
+	}
+}
+
+// Do runs f on the calling goroutine once a worker is free, and returns its
+// error. If ctx is done or the queue timeout passes before then, f isn't run,
+// and ctx's error or ErrQueueTimeout is returned. The operation names the kind
+// of work in the metrics.
+func (p *Pool) Do(ctx context.Context, operation string, f func() error) error {
+	if p == nil {
+		return f()
+	}
+
+	start := time.Now()
+	var timeout <-chan time.Time
+	if p.queueTimeout > 0 {
+		timer := time.NewTimer(p.queueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	queueDepth.WithLabelValues(operation).Inc()
+	select {
+	case p.slots <- struct{}{}:
+		queueDepth.WithLabelValues(operation).Dec()
+	case <-ctx.Done():
+		queueDepth.WithLabelValues(operation).Dec()
+		return ctx.Err()
+	case <-timeout:
+		queueDepth.WithLabelValues(operation).Dec()
+		queueTimeouts.WithLabelValues(operation).Inc()
+		return ErrQueueTimeout
+	}
+	queueWait.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+
+	workersBusy.WithLabelValues(operation).Inc()
+	defer func() {
+		workersBusy.WithLabelValues(operation).Dec()
+		<-p.slots
+	}()
+	return f()
+}
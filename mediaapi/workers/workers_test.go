@@ -0,0 +1,87 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPoolLimitsConcurrency(t *testing.T) {
+	pool := NewPool(2, 0)
+	var running, maxRunning atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := pool.Do(context.Background(), "test", func() error {
+				n := running.Add(1)
+				for {
+					highest := maxRunning.Load()
+					if n <= highest || maxRunning.CompareAndSwap(highest, n) {
+						break
+					}
+				}
+				time.Sleep(10 * time.Millisecond)
+				running.Add(-1)
+				return nil
+			})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), maxRunning.Load())
+}
+
+func TestPoolQueue(t *testing.T) {
+	pool := NewPool(1, 50*time.Millisecond)
+	errFailed := errors.New("failed")
+	assert.ErrorIs(t, pool.Do(context.Background(), "test", func() error { return errFailed }), errFailed)
+
+	// Occupy the only worker.
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go func() {
+		_ = pool.Do(context.Background(), "test", func() error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+
+	ran := false
+	run := func() error {
+		ran = true
+		return nil
+	}
+
+	// Operations are given up on once the queue timeout passes.
+	assert.ErrorIs(t, pool.Do(context.Background(), "test", run), ErrQueueTimeout)
+
+	// Or once their context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, pool.Do(ctx, "test", run), context.DeadlineExceeded)
+	assert.False(t, ran)
+
+	// Queued operations run once the worker is free.
+	time.AfterFunc(10*time.Millisecond, func() { close(release) })
+	assert.NoError(t, pool.Do(context.Background(), "test", run))
+	assert.True(t, ran)
+}
+
+func TestNilPool(t *testing.T) {
+	var pool *Pool
+	ran := false
+	assert.NoError(t, pool.Do(context.Background(), "test", func() error {
+		ran = true
+		return nil
+	}))
+	assert.True(t, ran)
+}
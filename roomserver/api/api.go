@@ -67,6 +67,7 @@ type RoomserverInternalAPI interface {
 	ClientRoomserverAPI
 	UserRoomserverAPI
 	FederationRoomserverAPI
+	MediaRoomserverAPI
 	QuerySenderIDAPI
 	UserRoomPrivateKeyCreator
 	DefaultRoomVersionAPI
@@ -235,10 +236,21 @@ type ClientRoomserverAPI interface {
 	PerformCreateRoom(ctx context.Context, userID spec.UserID, roomID spec.RoomID, createRequest *PerformCreateRoomRequest) (string, *util.JSONResponse)
 	// PerformRoomUpgrade upgrades a room to a newer version
 	PerformRoomUpgrade(ctx context.Context, roomID string, userID spec.UserID, roomVersion gomatrixserverlib.RoomVersion) (newRoomID string, err error)
-	PerformAdminEvacuateRoom(ctx context.Context, roomID string) (affected []string, err error)
-	PerformAdminEvacuateUser(ctx context.Context, userID string) (affected []string, err error)
-	PerformAdminPurgeRoom(ctx context.Context, roomID string) error
+	// The destructive admin operations only return what they would affect if dryRun is set.
+	PerformAdminEvacuateRoom(ctx context.Context, roomID string, dryRun bool) (affected []string, err error)
+	PerformAdminEvacuateUser(ctx context.Context, userID string, dryRun bool) (affected []string, err error)
+	PerformAdminPurgeRoom(ctx context.Context, roomID string, dryRun bool) (affected []string, err error)
 	PerformAdminDownloadState(ctx context.Context, roomID, userID string, serverName spec.ServerName) error
+	PerformAdminRedactUserEvents(ctx context.Context, userID string, limit int, reason string, dryRun bool) (redacted []string, err error)
+	// QueryAdminRoomUpgrades returns the rooms local users are joined to that aren't on the given room version
+	// and haven't been upgraded already.
+	QueryAdminRoomUpgrades(ctx context.Context, roomVersion gomatrixserverlib.RoomVersion) ([]AdminRoomUpgrade, error)
+	// PerformAdminUpgradeRoom upgrades a room as the given local user, or any local user that is allowed to if
+	// userID is empty, after sending the notice to the room. A dry run changes nothing and returns no new room.
+	PerformAdminUpgradeRoom(ctx context.Context, roomID, userID string, roomVersion gomatrixserverlib.RoomVersion, notice string, dryRun bool) (newRoomID string, err error)
+	// QueryAdminRedactedEvent returns the original event with its content if the event has been redacted
+	// but the content hasn't been pruned yet, or nil otherwise.
+	QueryAdminRedactedEvent(ctx context.Context, eventID string) (gomatrixserverlib.PDU, error)
 	PerformPeek(ctx context.Context, req *PerformPeekRequest) (roomID string, err error)
 	PerformUnpeek(ctx context.Context, roomID, userID, deviceID string) error
 	PerformInvite(ctx context.Context, req *PerformInviteRequest) error
@@ -269,9 +281,20 @@ type UserRoomserverAPI interface {
 	KeyserverRoomserverAPI
 	QueryCurrentState(ctx context.Context, req *QueryCurrentStateRequest, res *QueryCurrentStateResponse) error
 	QueryMembershipsForRoom(ctx context.Context, req *QueryMembershipsForRoomRequest, res *QueryMembershipsForRoomResponse) error
-	PerformAdminEvacuateUser(ctx context.Context, userID string) (affected []string, err error)
+	PerformAdminEvacuateUser(ctx context.Context, userID string, dryRun bool) (affected []string, err error)
 	PerformJoin(ctx context.Context, req *PerformJoinRequest) (roomID string, joinedVia spec.ServerName, err error)
 	JoinedUserCount(ctx context.Context, roomID string) (int, error)
+	// QueryRoomsForUser retrieves a list of room IDs matching the given query.
+	QueryRoomsForUser(ctx context.Context, userID spec.UserID, desiredMembership string) ([]spec.RoomID, error)
+	// QueryUserEventsInRoom returns the events that the user sent in the room, or
+	// nil if the room isn't known to this server.
+	QueryUserEventsInRoom(ctx context.Context, roomID spec.RoomID, userID spec.UserID) ([]*types.HeaderedEvent, error)
+}
+
+type MediaRoomserverAPI interface {
+	// QueryMediaURIsInRoom returns the distinct mxc:// URIs referenced by the events in
+	// the room, or nil if the room isn't known to this server.
+	QueryMediaURIsInRoom(ctx context.Context, roomID spec.RoomID) ([]string, error)
 }
 
 type FederationRoomserverAPI interface {
@@ -311,6 +334,9 @@ type FederationRoomserverAPI interface {
 
 	IsKnownRoom(ctx context.Context, roomID spec.RoomID) (bool, error)
 	StateQuerier() gomatrixserverlib.StateQuerier
+	// PerformResyncPartialState replaces the partial state of a room that was joined
+	// with a partial state send_join with the full state before the join event.
+	PerformResyncPartialState(ctx context.Context, roomID, joinEventID string, stateEvents, authEvents []*types.HeaderedEvent) error
 }
 
 type KeyserverRoomserverAPI interface {
@@ -105,6 +105,8 @@ type InputRoomEventsRequest struct {
 type InputRoomEventsResponse struct {
 	ErrMsg     string // set if there was any error
 	NotAllowed bool   // true if an event in the input was not allowed.
+	// Why the event was not allowed, if it failed the auth rules.
+	AuthError *types.EventAuthError
 }
 
 func (r *InputRoomEventsResponse) Err() error {
@@ -555,3 +555,18 @@ func (s RoomSet) Copy() RoomSet {
 	}
 	return copied
 }
+
+// AdminRoomUpgrade describes a room that local users are joined to, to help
+// admins decide whether to upgrade it to a newer room version.
+type AdminRoomUpgrade struct {
+	RoomID      string
+	RoomVersion gomatrixserverlib.RoomVersion
+	// The user IDs of all joined members.
+	JoinedMembers []string
+	// The other servers that have joined members.
+	RemoteServers []spec.ServerName
+	// Local joined users with enough power to upgrade the room.
+	UpgradableBy []string
+	// The state keys of bridge state events (m.bridge and uk.half-shot.bridge).
+	Bridges []string
+}
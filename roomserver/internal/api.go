@@ -25,6 +25,7 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/setup/maintenance"
 	"github.com/matrix-org/dendrite/setup/process"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 )
@@ -96,6 +97,11 @@ func NewRoomserverAPI(
 		defaultRoomVersion:     dendriteCfg.RoomServer.DefaultRoomVersion,
 		// perform-er structs + queryer struct get initialised when we have a federation sender to use
 	}
+
+	roomserverDB.SetRedactionRetention(dendriteCfg.RoomServer.RedactionRetention)
+	if interval := dendriteCfg.RoomServer.RedactionPruneInterval; interval > 0 {
+		maintenance.Every(processContext, "redaction_pruning", interval, a.PruneRedactedEvents)
+	}
 	return a
 }
 
@@ -194,11 +200,12 @@ func (r *RoomserverInternalAPI) SetFederationAPI(fsAPI fsAPI.RoomserverFederatio
 		URSAPI: r,
 	}
 	r.Admin = &perform.Admin{
-		DB:      r.DB,
-		Cfg:     &r.Cfg.RoomServer,
-		Inputer: r.Inputer,
-		Queryer: r.Queryer,
-		Leaver:  r.Leaver,
+		DB:       r.DB,
+		Cfg:      &r.Cfg.RoomServer,
+		Inputer:  r.Inputer,
+		Queryer:  r.Queryer,
+		Leaver:   r.Leaver,
+		Upgrader: r.Upgrader,
 	}
 	r.Creator = &perform.Creator{
 		DB:    r.DB,
@@ -16,6 +16,7 @@ package helpers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sort"
 
@@ -81,12 +82,64 @@ func CheckForSoftFail(
 	if err = gomatrixserverlib.Allowed(event.PDU, &authEvents, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
 		return querier.QueryUserIDForSender(ctx, roomID, senderID)
 	}); err != nil {
-		// return true, nil
-		return true, err
+		return true, NewEventAuthError(event.PDU, &authEvents, types.AuthCheckCurrentState, err)
 	}
 	return false, nil
 }
 
+// NewEventAuthError describes why the event failed the auth rules when it was
+// checked against the auth events.
+func NewEventAuthError(
+	event gomatrixserverlib.PDU,
+	authEvents gomatrixserverlib.AuthEventProvider,
+	checkedAgainst string,
+	err error,
+) *types.EventAuthError {
+	authErr := &types.EventAuthError{
+		EventID:        event.EventID(),
+		Rule:           "default",
+		CheckedAgainst: checkedAgainst,
+		AuthEvents:     []types.AuthEventRef{},
+		Reason:         err.Error(),
+	}
+	var notAllowed *gomatrixserverlib.NotAllowed
+	if errors.As(err, &notAllowed) {
+		authErr.Reason = notAllowed.Message
+	}
+	// These are the event types that gomatrixserverlib.Allowed has specific
+	// rules for, all other events use the default rules.
+	switch event.Type() {
+	case spec.MRoomCreate, spec.MRoomAliases, spec.MRoomMember, spec.MRoomPowerLevels, spec.MRoomRedaction:
+		authErr.Rule = event.Type()
+	}
+
+	stateNeeded := gomatrixserverlib.StateNeededForAuth([]gomatrixserverlib.PDU{event})
+	for _, tuple := range stateNeeded.Tuples() {
+		ref := types.AuthEventRef{
+			Type:     tuple.EventType,
+			StateKey: tuple.StateKey,
+		}
+		var authEvent gomatrixserverlib.PDU
+		switch tuple.EventType {
+		case spec.MRoomCreate:
+			authEvent, _ = authEvents.Create()
+		case spec.MRoomJoinRules:
+			authEvent, _ = authEvents.JoinRules()
+		case spec.MRoomPowerLevels:
+			authEvent, _ = authEvents.PowerLevels()
+		case spec.MRoomMember:
+			authEvent, _ = authEvents.Member(spec.SenderID(tuple.StateKey))
+		case spec.MRoomThirdPartyInvite:
+			authEvent, _ = authEvents.ThirdPartyInvite(tuple.StateKey)
+		}
+		if authEvent != nil {
+			ref.EventID = authEvent.EventID()
+		}
+		authErr.AuthEvents = append(authErr.AuthEvents, ref)
+	}
+	return authErr
+}
+
 // GetAuthEvents returns the numeric IDs for the auth events.
 func GetAuthEvents(
 	ctx context.Context,
@@ -17,7 +17,11 @@ package helpers
 import (
 	"testing"
 
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
 	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/test"
 )
 
 func benchmarkStateEntryMapLookup(entries, lookups int64, b *testing.B) {
@@ -134,3 +138,65 @@ func TestEventMap(t *testing.T) {
 	}
 
 }
+
+func TestNewEventAuthError(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	ev := room.CreateEvent(t, alice, "m.room.message", map[string]interface{}{"body": "hello"})
+
+	// Check the event against auth events that don't include the sender's
+	// membership, so that it fails auth.
+	var createEventID string
+	authEvents := gomatrixserverlib.NewAuthEvents(nil)
+	for _, stateEvent := range room.CurrentState() {
+		if stateEvent.Type() == spec.MRoomMember {
+			continue
+		}
+		if stateEvent.Type() == spec.MRoomCreate {
+			createEventID = stateEvent.EventID()
+		}
+		if err := authEvents.AddEvent(stateEvent.PDU); err != nil {
+			t.Fatalf("failed to add auth event: %v", err)
+		}
+	}
+	err := gomatrixserverlib.Allowed(ev.PDU, &authEvents, test.UserIDForSender)
+	if err == nil {
+		t.Fatalf("expected event to fail auth")
+	}
+
+	authErr := NewEventAuthError(ev.PDU, &authEvents, types.AuthCheckAuthEvents, err)
+	if authErr.EventID != ev.EventID() {
+		t.Errorf("expected event ID %s, got %s", ev.EventID(), authErr.EventID)
+	}
+	if authErr.Rule != "default" {
+		t.Errorf("expected default rule, got %q", authErr.Rule)
+	}
+	if authErr.CheckedAgainst != types.AuthCheckAuthEvents {
+		t.Errorf("expected to be checked against %q, got %q", types.AuthCheckAuthEvents, authErr.CheckedAgainst)
+	}
+	if authErr.Reason == "" {
+		t.Errorf("expected a reason")
+	}
+
+	var foundCreate, foundMember bool
+	for _, ref := range authErr.AuthEvents {
+		switch ref.Type {
+		case spec.MRoomCreate:
+			foundCreate = true
+			if ref.EventID != createEventID {
+				t.Errorf("expected create event %s, got %s", createEventID, ref.EventID)
+			}
+		case spec.MRoomMember:
+			foundMember = true
+			if ref.StateKey != string(ev.SenderID()) || ref.EventID != "" {
+				t.Errorf("expected missing membership of the sender, got %+v", ref)
+			}
+		}
+	}
+	if !foundCreate || !foundMember {
+		t.Errorf("expected create and member auth events, got %+v", authErr.AuthEvents)
+	}
+	if !types.IsRejected(authErr) {
+		t.Errorf("expected auth error to count as rejected")
+	}
+}
@@ -334,12 +334,24 @@ func (w *worker) _next() {
 	// a string, because we might want to return that to the caller if
 	// it was a synchronous request.
 	var errString string
+	var authErr *types.EventAuthError
 	if err = w.r.processRoomEvent(
 		w.r.ProcessContext.Context(),
 		spec.ServerName(msg.Header.Get("virtual_host")),
 		&inputRoomEvent,
 	); err != nil {
-		switch err.(type) {
+		switch e := err.(type) {
+		case *types.EventAuthError:
+			authErr = e
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"room_id":         w.roomID,
+				"event_id":        inputRoomEvent.Event.EventID(),
+				"type":            inputRoomEvent.Event.Type(),
+				"rule":            e.Rule,
+				"checked_against": e.CheckedAgainst,
+				"auth_events":     e.AuthEvents,
+				"reason":          e.Reason,
+			}).Warn("Roomserver rejected event")
 		case types.RejectedError:
 			// Don't send events that were rejected to Sentry
 			logrus.WithError(err).WithFields(logrus.Fields{
@@ -375,7 +387,19 @@ func (w *worker) _next() {
 	// was no error then we'll return a blank message, which means
 	// that everything was OK.
 	if replyTo := msg.Header.Get("sync"); replyTo != "" {
-		if err = w.r.NATSClient.Publish(replyTo, []byte(errString)); err != nil {
+		reply := &nats.Msg{
+			Subject: replyTo,
+			Header:  nats.Header{},
+			Data:    []byte(errString),
+		}
+		// If the event failed auth then also send back the details, so that
+		// they can be returned to the server that sent the event.
+		if authErr != nil {
+			if authErrJSON, jsonErr := json.Marshal(authErr); jsonErr == nil {
+				reply.Header.Set(authErrorHeader, string(authErrJSON))
+			}
+		}
+		if err = w.r.NATSClient.PublishMsg(reply); err != nil {
 			logrus.WithError(err).WithFields(logrus.Fields{
 				"room_id":  w.roomID,
 				"event_id": inputRoomEvent.Event.EventID(),
@@ -443,6 +467,10 @@ func (r *Inputer) queueInputRoomEvents(
 	return
 }
 
+// authErrorHeader is the header of synchronous input responses that contains
+// the details of why an event failed auth.
+const authErrorHeader = "auth_error"
+
 // InputRoomEvents implements api.RoomserverInternalAPI
 func (r *Inputer) InputRoomEvents(
 	ctx context.Context,
@@ -475,6 +503,15 @@ func (r *Inputer) InputRoomEvents(
 		}
 		if len(msg.Data) > 0 {
 			response.ErrMsg = string(msg.Data)
+			response.NotAllowed = false
+			response.AuthError = nil
+			if authErrJSON := msg.Header.Get(authErrorHeader); authErrJSON != "" {
+				response.NotAllowed = true
+				response.AuthError = &types.EventAuthError{}
+				if err = json.Unmarshal([]byte(authErrJSON), response.AuthError); err != nil {
+					response.AuthError = nil
+				}
+			}
 		}
 	}
 }
@@ -304,7 +304,7 @@ func (r *Inputer) processRoomEvent(
 		return r.Queryer.QueryUserIDForSender(ctx, roomID, senderID)
 	}); err != nil {
 		isRejected = true
-		rejectionErr = err
+		rejectionErr = helpers.NewEventAuthError(event, &authEvents, types.AuthCheckAuthEvents, err)
 		logger.WithError(rejectionErr).Warnf("Event %s not allowed by auth events", event.EventID())
 	}
 
@@ -336,7 +336,11 @@ func (r *Inputer) processRoomEvent(
 	}
 
 	var softfail bool
-	if input.Kind == api.KindNew && !isCreateEvent {
+	// If we only have partial state for the room then the current state may be
+	// missing the memberships that the event is authed against, so we can't
+	// reliably soft-fail events until the full state has been resynced.
+	partialState := r.FSAPI != nil && r.FSAPI.QueryRoomHasPartialState(ctx, event.RoomID().String())
+	if input.Kind == api.KindNew && !isCreateEvent && !partialState {
 		// Check that the event passes authentication checks based on the
 		// current room state.
 		softfail, err = helpers.CheckForSoftFail(ctx, r.DB, roomInfo, headered, input.StateEventIDs, r.Queryer)
@@ -434,17 +438,11 @@ func (r *Inputer) processRoomEvent(
 	switch {
 	case isRejected:
 		logger.WithError(rejectionErr).Warn("Stored rejected event")
-		if rejectionErr != nil {
-			return types.RejectedError(rejectionErr.Error())
-		}
-		return nil
+		return rejectedError(rejectionErr)
 
 	case softfail:
 		logger.WithError(rejectionErr).Warn("Stored soft-failed event")
-		if rejectionErr != nil {
-			return types.RejectedError(rejectionErr.Error())
-		}
-		return nil
+		return rejectedError(rejectionErr)
 	}
 
 	// TODO: Revist this to ensure we don't replace a current state mxid_mapping with an older one.
@@ -561,6 +559,19 @@ func (r *Inputer) handleRemoteRoomUpgrade(ctx context.Context, event gomatrixser
 	return r.DB.UpgradeRoom(ctx, oldRoomID, newRoomID, string(event.SenderID()))
 }
 
+// rejectedError returns the error to return for an event that was stored as
+// rejected, keeping the details of auth failures.
+func rejectedError(rejectionErr error) error {
+	if rejectionErr == nil {
+		return nil
+	}
+	var authErr *types.EventAuthError
+	if errors.As(rejectionErr, &authErr) {
+		return authErr
+	}
+	return types.RejectedError(rejectionErr.Error())
+}
+
 // processStateBefore works out what the state is before the event and
 // then checks the event auths against the state at the time. It also
 // tries to determine what the history visibility was of the event at
@@ -647,7 +658,7 @@ func (r *Inputer) processStateBefore(
 	if rejectionErr = gomatrixserverlib.Allowed(event, &stateBeforeAuth, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
 		return r.Queryer.QueryUserIDForSender(ctx, roomID, senderID)
 	}); rejectionErr != nil {
-		rejectionErr = fmt.Errorf("Allowed() failed for stateBeforeEvent: %w", rejectionErr)
+		rejectionErr = helpers.NewEventAuthError(event, &stateBeforeAuth, types.AuthCheckStateBefore, rejectionErr)
 		return
 	}
 	// Work out what the history visibility was at the time of the
@@ -112,7 +112,7 @@ func (t *missingStateReq) processEventWithMissingState(
 				SendAsServer: api.DoNotSendToOtherServers,
 			})
 			if err != nil {
-				if _, ok := err.(types.RejectedError); !ok {
+				if !types.IsRejected(err) {
 					return nil, fmt.Errorf("t.inputer.processRoomEvent (filling gap): %w", err)
 				}
 			}
@@ -162,7 +162,7 @@ func (t *missingStateReq) processEventWithMissingState(
 		}
 		for _, ire := range outlierRoomEvents {
 			if err = t.inputer.processRoomEvent(ctx, t.virtualHost, &ire); err != nil {
-				if _, ok := err.(types.RejectedError); !ok {
+				if !types.IsRejected(err) {
 					return fmt.Errorf("t.inputer.processRoomEvent (outlier): %w", err)
 				}
 			}
@@ -193,7 +193,7 @@ func (t *missingStateReq) processEventWithMissingState(
 		SendAsServer:  api.DoNotSendToOtherServers,
 	})
 	if err != nil {
-		if _, ok := err.(types.RejectedError); !ok {
+		if !types.IsRejected(err) {
 			return nil, fmt.Errorf("t.inputer.processRoomEvent (backward extremity): %w", err)
 		}
 	}
@@ -210,7 +210,7 @@ func (t *missingStateReq) processEventWithMissingState(
 			SendAsServer: api.DoNotSendToOtherServers,
 		})
 		if err != nil {
-			if _, ok := err.(types.RejectedError); !ok {
+			if !types.IsRejected(err) {
 				return nil, fmt.Errorf("t.inputer.processRoomEvent (fast forward): %w", err)
 			}
 		}
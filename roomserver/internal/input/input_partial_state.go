@@ -0,0 +1,188 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/state"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+// PerformResyncPartialState replaces the partial state that we stored for a
+// room joined with a partial state send_join (MSC3706) with the full state
+// before the join event, and fills in the current state of the room with the
+// state that was missing from it. No events are sent into the room. The
+// signatures and auth of the given state and auth events must already have
+// been checked.
+func (r *Inputer) PerformResyncPartialState(
+	ctx context.Context, roomID, joinEventID string,
+	stateEvents, authEvents []*types.HeaderedEvent,
+) (err error) {
+	roomInfo, err := r.DB.RoomInfo(ctx, roomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if roomInfo == nil || roomInfo.IsStub() {
+		return eventutil.ErrRoomNoExists{}
+	}
+
+	// Store the full state as outliers first, so that we have state entries
+	// for all of it.
+	inputReq := &api.InputRoomEventsRequest{}
+	for _, event := range append(authEvents, stateEvents...) {
+		inputReq.InputRoomEvents = append(inputReq.InputRoomEvents, api.InputRoomEvent{
+			Kind:  api.KindOutlier,
+			Event: event,
+		})
+	}
+	inputRes := &api.InputRoomEventsResponse{}
+	r.InputRoomEvents(ctx, inputReq, inputRes)
+	if inputRes.ErrMsg != "" {
+		return inputRes.Err()
+	}
+
+	historyVisibility := gomatrixserverlib.HistoryVisibilityShared
+	stateEventIDs := make([]string, 0, len(stateEvents))
+	for _, event := range stateEvents {
+		stateEventIDs = append(stateEventIDs, event.EventID())
+		if event.Type() == spec.MRoomHistoryVisibility && event.StateKeyEquals("") {
+			if hisVis, hisVisErr := event.HistoryVisibility(); hisVisErr == nil {
+				historyVisibility = hisVis
+			}
+		}
+	}
+	fullState, err := r.DB.StateEntriesForEventIDs(ctx, stateEventIDs, true)
+	if err != nil {
+		return fmt.Errorf("r.DB.StateEntriesForEventIDs: %w", err)
+	}
+
+	var succeeded bool
+	updater, err := r.DB.GetRoomUpdater(ctx, roomInfo)
+	if err != nil {
+		return fmt.Errorf("r.DB.GetRoomUpdater: %w", err)
+	}
+	defer sqlutil.EndTransactionWithCheck(updater, &succeeded, &err)
+
+	lastEventIDSent := updater.LastEventIDSent()
+	eventNIDs, err := r.DB.EventNIDs(ctx, []string{joinEventID, lastEventIDSent})
+	if err != nil {
+		return fmt.Errorf("r.DB.EventNIDs: %w", err)
+	}
+	joinEventNID := eventNIDs[joinEventID].EventNID
+	if joinEventNID == 0 {
+		return fmt.Errorf("join event %q not found", joinEventID)
+	}
+
+	// The state before the join event is now the full state.
+	fullStateNID, err := updater.AddState(ctx, roomInfo.RoomNID, nil, fullState)
+	if err != nil {
+		return fmt.Errorf("updater.AddState: %w", err)
+	}
+	if err = updater.SetState(ctx, joinEventNID, fullStateNID); err != nil {
+		return fmt.Errorf("updater.SetState: %w", err)
+	}
+
+	// Anything that has happened in the room since the join is already in
+	// the current state, so only add the state that we didn't know about.
+	roomState := state.NewStateResolution(updater, roomInfo, r.Queryer)
+	oldStateNID := updater.CurrentStateSnapshotNID()
+	currentState, err := roomState.LoadStateAtSnapshot(ctx, oldStateNID)
+	if err != nil {
+		return fmt.Errorf("roomState.LoadStateAtSnapshot: %w", err)
+	}
+	merged := make(map[types.StateKeyTuple]types.StateEntry, len(fullState)+len(currentState))
+	for _, entry := range fullState {
+		merged[entry.StateKeyTuple] = entry
+	}
+	for _, entry := range currentState {
+		merged[entry.StateKeyTuple] = entry
+	}
+	newState := make([]types.StateEntry, 0, len(merged))
+	for _, entry := range merged {
+		newState = append(newState, entry)
+	}
+	sort.Slice(newState, func(i, j int) bool {
+		return newState[i].LessThan(newState[j])
+	})
+	newStateNID, err := updater.AddState(ctx, roomInfo.RoomNID, nil, newState)
+	if err != nil {
+		return fmt.Errorf("updater.AddState: %w", err)
+	}
+	removed, added, err := roomState.DifferenceBetweeenStateSnapshots(ctx, oldStateNID, newStateNID)
+	if err != nil {
+		return fmt.Errorf("roomState.DifferenceBetweeenStateSnapshots: %w", err)
+	}
+
+	updates, err := r.updateMemberships(ctx, updater, removed, added)
+	if err != nil {
+		return fmt.Errorf("r.updateMemberships: %w", err)
+	}
+	latest := updater.LatestEvents()
+	if err = updater.SetLatestEvents(roomInfo.RoomNID, latest, eventNIDs[lastEventIDSent].EventNID, newStateNID); err != nil {
+		return fmt.Errorf("updater.SetLatestEvents: %w", err)
+	}
+
+	// Tell the other components about the new current state as if it came
+	// with the join event, which they already have. The join event mustn't
+	// go out over federation again.
+	events, err := updater.Events(ctx, roomInfo.RoomVersion, []types.EventNID{joinEventNID})
+	if err != nil {
+		return fmt.Errorf("updater.Events: %w", err)
+	}
+	if len(events) == 0 {
+		return fmt.Errorf("join event %q not found", joinEventID)
+	}
+	addedNIDs := make([]types.EventNID, 0, len(added))
+	for _, entry := range added {
+		addedNIDs = append(addedNIDs, entry.EventNID)
+	}
+	addedIDs, err := updater.EventIDs(ctx, addedNIDs)
+	if err != nil {
+		return fmt.Errorf("updater.EventIDs: %w", err)
+	}
+	latestEventIDs := make([]string, len(latest))
+	for i := range latest {
+		latestEventIDs[i] = latest[i].EventID
+	}
+	ore := api.OutputNewRoomEvent{
+		Event:             &types.HeaderedEvent{PDU: events[0].PDU},
+		LastSentEventID:   lastEventIDSent,
+		LatestEventIDs:    latestEventIDs,
+		SendAsServer:      api.DoNotSendToOtherServers,
+		HistoryVisibility: historyVisibility,
+	}
+	for _, nid := range addedNIDs {
+		ore.AddsStateEventIDs = append(ore.AddsStateEventIDs, addedIDs[nid])
+	}
+	updates = append(updates, api.OutputEvent{
+		Type:         api.OutputTypeNewRoomEvent,
+		NewRoomEvent: &ore,
+	})
+	if err = r.OutputProducer.ProduceRoomEvents(roomID, updates); err != nil {
+		return fmt.Errorf("r.OutputProducer.ProduceRoomEvents: %w", err)
+	}
+
+	succeeded = true
+	return nil
+}
@@ -19,6 +19,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/matrix-org/dendrite/internal/eventutil"
@@ -35,17 +36,19 @@ import (
 )
 
 type Admin struct {
-	DB      storage.Database
-	Cfg     *config.RoomServer
-	Queryer *query.Queryer
-	Inputer *input.Inputer
-	Leaver  *Leaver
+	DB       storage.Database
+	Cfg      *config.RoomServer
+	Queryer  *query.Queryer
+	Inputer  *input.Inputer
+	Leaver   *Leaver
+	Upgrader *Upgrader
 }
 
-// PerformAdminEvacuateRoom will remove all local users from the given room.
+// PerformAdminEvacuateRoom will remove all local users from the given room. In a
+// dry run, the users are only returned.
 func (r *Admin) PerformAdminEvacuateRoom(
 	ctx context.Context,
-	roomID string,
+	roomID string, dryRun bool,
 ) (affected []string, err error) {
 	roomInfo, err := r.DB.RoomInfo(ctx, roomID)
 	if err != nil {
@@ -123,6 +126,10 @@ func (r *Admin) PerformAdminEvacuateRoom(
 		if err != nil {
 			continue
 		}
+		if dryRun {
+			affected = append(affected, stateKey)
+			continue
+		}
 
 		event, err = eventutil.BuildEvent(ctx, fledglingEvent, identity, time.Now(), &eventsNeeded, latestRes)
 		if err != nil {
@@ -138,6 +145,9 @@ func (r *Admin) PerformAdminEvacuateRoom(
 		affected = append(affected, stateKey)
 		prevEvents = []string{event.EventID()}
 	}
+	if dryRun {
+		return affected, nil
+	}
 
 	inputReq := &api.InputRoomEventsRequest{
 		InputRoomEvents: inputEvents,
@@ -148,10 +158,11 @@ func (r *Admin) PerformAdminEvacuateRoom(
 	return affected, nil
 }
 
-// PerformAdminEvacuateUser will remove the given user from all rooms.
+// PerformAdminEvacuateUser will remove the given user from all rooms. In a dry
+// run, the rooms are only returned.
 func (r *Admin) PerformAdminEvacuateUser(
 	ctx context.Context,
-	userID string,
+	userID string, dryRun bool,
 ) (affected []string, err error) {
 	fullUserID, err := spec.NewUserID(userID, true)
 	if err != nil {
@@ -172,6 +183,9 @@ func (r *Admin) PerformAdminEvacuateUser(
 	}
 
 	allRooms := append(roomIDs, inviteRoomIDs...)
+	if dryRun {
+		return allRooms, nil
+	}
 	affected = make([]string, 0, len(allRooms))
 	for _, roomID := range allRooms {
 		leaveReq := &api.PerformLeaveRequest{
@@ -194,25 +208,405 @@ func (r *Admin) PerformAdminEvacuateUser(
 	return affected, nil
 }
 
-// PerformAdminPurgeRoom removes all traces for the given room from the database.
+// PerformAdminRedactUserEvents redacts up to limit of the most recent events
+// sent by the given local user across all of the rooms they are joined to. The
+// redactions are sent as the user themselves, so this must happen before the
+// user is removed from the rooms. In a dry run, the events are only returned.
+func (r *Admin) PerformAdminRedactUserEvents(
+	ctx context.Context,
+	userID string, limit int, reason string, dryRun bool,
+) (redacted []string, err error) {
+	fullUserID, err := spec.NewUserID(userID, true)
+	if err != nil {
+		return nil, err
+	}
+	if !r.Cfg.Matrix.IsLocalServerName(fullUserID.Domain()) {
+		return nil, fmt.Errorf("can only redact events of local users using this endpoint")
+	}
+	identity, err := r.Cfg.Matrix.SigningIdentityFor(fullUserID.Domain())
+	if err != nil {
+		return nil, err
+	}
+
+	roomIDs, err := r.DB.GetRoomsByMembership(ctx, *fullUserID, spec.Join)
+	if err != nil {
+		return nil, err
+	}
+	senderID := spec.SenderID(userID)
+
+	// The most recent events overall are amongst the most recent events in
+	// each room, so gather those first.
+	candidates := make(map[string][]string, len(roomIDs))
+	allEventIDs := []string{}
+	for _, roomID := range roomIDs {
+		roomInfo, err := r.DB.RoomInfo(ctx, roomID)
+		if err != nil {
+			return nil, err
+		}
+		if roomInfo == nil || roomInfo.IsStub() {
+			continue
+		}
+		if roomInfo.RoomVersion == gomatrixserverlib.RoomVersionPseudoIDs {
+			// We'd need the user's room key to sign the redactions.
+			logrus.WithField("room_id", roomID).Warn("Not redacting events in room with pseudo IDs")
+			continue
+		}
+		eventIDs, err := r.DB.GetRecentEventIDsBySender(ctx, roomInfo.RoomNID, senderID, limit)
+		if err != nil {
+			return nil, err
+		}
+		candidates[roomID] = eventIDs
+		allEventIDs = append(allEventIDs, eventIDs...)
+	}
+
+	// Event NIDs are allocated in the order that events arrive, so they tell
+	// us which of the candidates are the most recent across all of the rooms.
+	if len(allEventIDs) > limit {
+		eventNIDs, err := r.DB.EventNIDs(ctx, allEventIDs)
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(allEventIDs, func(i, j int) bool {
+			return eventNIDs[allEventIDs[i]].EventNID > eventNIDs[allEventIDs[j]].EventNID
+		})
+		allEventIDs = allEventIDs[:limit]
+	}
+	if dryRun {
+		return allEventIDs, nil
+	}
+	selected := make(map[string]struct{}, len(allEventIDs))
+	for _, eventID := range allEventIDs {
+		selected[eventID] = struct{}{}
+	}
+
+	redacted = []string{}
+	for _, roomID := range roomIDs {
+		logger := logrus.WithFields(logrus.Fields{
+			"room_id": roomID,
+			"user_id": userID,
+		})
+		eventIDs := make([]string, 0, len(candidates[roomID]))
+		for _, eventID := range candidates[roomID] {
+			if _, ok := selected[eventID]; ok {
+				eventIDs = append(eventIDs, eventID)
+			}
+		}
+		if len(eventIDs) == 0 {
+			continue
+		}
+
+		// All of the redactions need the same auth events, so only ask for them once.
+		eventsNeeded, err := gomatrixserverlib.StateNeededForProtoEvent(&gomatrixserverlib.ProtoEvent{
+			Type:     spec.MRoomRedaction,
+			SenderID: string(senderID),
+		})
+		if err != nil {
+			return nil, err
+		}
+		latestRes := &api.QueryLatestEventsAndStateResponse{}
+		if err = r.Queryer.QueryLatestEventsAndState(ctx, &api.QueryLatestEventsAndStateRequest{
+			RoomID:       roomID,
+			StateToFetch: eventsNeeded.Tuples(),
+		}, latestRes); err != nil {
+			return nil, err
+		}
+
+		inputEvents := make([]api.InputRoomEvent, 0, len(eventIDs))
+		redactedInRoom := make([]string, 0, len(eventIDs))
+		for _, eventID := range eventIDs {
+			proto := &gomatrixserverlib.ProtoEvent{
+				SenderID: string(senderID),
+				RoomID:   roomID,
+				Type:     spec.MRoomRedaction,
+				Redacts:  eventID,
+			}
+			// Room version 11 expects the "redacts" field on the content as well
+			content := map[string]string{"redacts": eventID}
+			if reason != "" {
+				content["reason"] = reason
+			}
+			if err = proto.SetContent(content); err != nil {
+				return nil, err
+			}
+			event, err := eventutil.BuildEvent(ctx, proto, identity, time.Now(), &eventsNeeded, latestRes)
+			if err != nil {
+				logger.WithError(err).WithField("event_id", eventID).Warn("Failed to build redaction")
+				continue
+			}
+			inputEvents = append(inputEvents, api.InputRoomEvent{
+				Kind:         api.KindNew,
+				Event:        event,
+				Origin:       fullUserID.Domain(),
+				SendAsServer: string(fullUserID.Domain()),
+			})
+			redactedInRoom = append(redactedInRoom, eventID)
+		}
+
+		inputRes := &api.InputRoomEventsResponse{}
+		r.Inputer.InputRoomEvents(ctx, &api.InputRoomEventsRequest{
+			InputRoomEvents: inputEvents,
+			Asynchronous:    false,
+		}, inputRes)
+		if err = inputRes.Err(); err != nil {
+			logger.WithError(err).Warn("Failed to send redactions")
+			continue
+		}
+		redacted = append(redacted, redactedInRoom...)
+	}
+	return redacted, nil
+}
+
+// QueryAdminRoomUpgrades returns the rooms that local users are joined to that
+// aren't on the given room version and haven't been upgraded already.
+func (r *Admin) QueryAdminRoomUpgrades(
+	ctx context.Context,
+	roomVersion gomatrixserverlib.RoomVersion,
+) ([]api.AdminRoomUpgrade, error) {
+	roomIDs, err := r.DB.GetKnownRooms(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rooms := []api.AdminRoomUpgrade{}
+	for _, roomID := range roomIDs {
+		room, err := r.roomUpgrade(ctx, roomID)
+		if err != nil {
+			return nil, fmt.Errorf("room %s: %w", roomID, err)
+		}
+		if room == nil || room.RoomVersion == roomVersion {
+			continue
+		}
+		rooms = append(rooms, *room)
+	}
+	return rooms, nil
+}
+
+// PerformAdminUpgradeRoom upgrades the room to the given room version as the
+// given local user, or as any local user that is allowed to upgrade the room if
+// userID is empty. If notice is set, it is sent to the room before upgrading it.
+// A dry run only checks that the room can be upgraded, and returns no new room.
+func (r *Admin) PerformAdminUpgradeRoom(
+	ctx context.Context,
+	roomID, userID string,
+	roomVersion gomatrixserverlib.RoomVersion,
+	notice string,
+	dryRun bool,
+) (newRoomID string, err error) {
+	room, err := r.roomUpgrade(ctx, roomID)
+	if err != nil {
+		return "", err
+	}
+	if room == nil {
+		return "", eventutil.ErrRoomNoExists{}
+	}
+	if userID == "" {
+		if len(room.UpgradableBy) == 0 {
+			return "", api.ErrNotAllowed{Err: fmt.Errorf("no local user is allowed to upgrade the room")}
+		}
+		userID = room.UpgradableBy[0]
+	}
+	fullUserID, err := spec.NewUserID(userID, true)
+	if err != nil {
+		return "", err
+	}
+	if !r.Cfg.Matrix.IsLocalServerName(fullUserID.Domain()) {
+		return "", fmt.Errorf("can only upgrade rooms as local users")
+	}
+
+	logger := logrus.WithFields(logrus.Fields{
+		"room_id":      roomID,
+		"user_id":      userID,
+		"room_version": roomVersion,
+	})
+	if dryRun {
+		logger.Info("Would upgrade room")
+		return "", nil
+	}
+	if notice != "" {
+		if err = r.sendNotice(ctx, roomID, *fullUserID, notice); err != nil {
+			return "", fmt.Errorf("failed to send upgrade notice: %w", err)
+		}
+	}
+	newRoomID, err = r.Upgrader.PerformRoomUpgrade(ctx, roomID, *fullUserID, roomVersion)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to upgrade room")
+		return "", err
+	}
+	logger.WithField("new_room_id", newRoomID).Info("Upgraded room")
+	return newRoomID, nil
+}
+
+// roomUpgrade describes the room, or returns nil if no local users are joined to
+// it or it has already been upgraded.
+func (r *Admin) roomUpgrade(ctx context.Context, roomID string) (*api.AdminRoomUpgrade, error) {
+	roomInfo, err := r.DB.RoomInfo(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	if roomInfo == nil || roomInfo.IsStub() {
+		return nil, nil
+	}
+	tombstone, err := r.DB.GetStateEvent(ctx, roomID, "m.room.tombstone", "")
+	if err != nil {
+		return nil, err
+	}
+	if tombstone != nil {
+		return nil, nil
+	}
+	validRoomID, err := spec.NewRoomID(roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	room := &api.AdminRoomUpgrade{
+		RoomID:        roomID,
+		RoomVersion:   roomInfo.RoomVersion,
+		JoinedMembers: []string{},
+		RemoteServers: []spec.ServerName{},
+		UpgradableBy:  []string{},
+		Bridges:       []string{},
+	}
+	var powerLevels *gomatrixserverlib.PowerLevelContent
+	plEvent, err := r.DB.GetStateEvent(ctx, roomID, spec.MRoomPowerLevels, "")
+	if err != nil {
+		return nil, err
+	}
+	if plEvent != nil {
+		if powerLevels, err = plEvent.PowerLevels(); err != nil {
+			return nil, err
+		}
+	}
+
+	memberNIDs, err := r.DB.GetMembershipEventNIDsForRoom(ctx, roomInfo.RoomNID, true, false)
+	if err != nil {
+		return nil, err
+	}
+	memberEvents, err := r.DB.Events(ctx, roomInfo.RoomVersion, memberNIDs)
+	if err != nil {
+		return nil, err
+	}
+	servers := map[spec.ServerName]struct{}{}
+	localMembers := 0
+	for _, memberEvent := range memberEvents {
+		if memberEvent.StateKey() == nil {
+			continue
+		}
+		senderID := spec.SenderID(*memberEvent.StateKey())
+		memberUserID, err := r.Queryer.QueryUserIDForSender(ctx, *validRoomID, senderID)
+		if err != nil || memberUserID == nil {
+			continue
+		}
+		room.JoinedMembers = append(room.JoinedMembers, memberUserID.String())
+		if !r.Cfg.Matrix.IsLocalServerName(memberUserID.Domain()) {
+			if _, ok := servers[memberUserID.Domain()]; !ok {
+				servers[memberUserID.Domain()] = struct{}{}
+				room.RemoteServers = append(room.RemoteServers, memberUserID.Domain())
+			}
+			continue
+		}
+		localMembers++
+		// Upgrading the room needs permission to send the tombstone event.
+		if powerLevels != nil && powerLevels.UserLevel(senderID) >= powerLevels.EventLevel("m.room.tombstone", true) {
+			room.UpgradableBy = append(room.UpgradableBy, memberUserID.String())
+		}
+	}
+	if localMembers == 0 {
+		return nil, nil
+	}
+	for _, bridgeType := range []string{"m.bridge", "uk.half-shot.bridge"} {
+		bridgeEvents, err := r.DB.GetStateEventsWithEventType(ctx, roomID, bridgeType)
+		if err != nil {
+			return nil, err
+		}
+		for _, bridgeEvent := range bridgeEvents {
+			if bridgeEvent.StateKey() != nil && len(bridgeEvent.Content()) > 2 {
+				room.Bridges = append(room.Bridges, *bridgeEvent.StateKey())
+			}
+		}
+	}
+	return room, nil
+}
+
+// sendNotice sends a m.notice message to the room as the given local user.
+func (r *Admin) sendNotice(ctx context.Context, roomID string, userID spec.UserID, notice string) error {
+	validRoomID, err := spec.NewRoomID(roomID)
+	if err != nil {
+		return err
+	}
+	senderID, err := r.Queryer.QuerySenderIDForUser(ctx, *validRoomID, userID)
+	if err != nil {
+		return err
+	}
+	if senderID == nil {
+		return fmt.Errorf("no sender ID for %s in %s", userID.String(), roomID)
+	}
+	identity, err := r.Cfg.Matrix.SigningIdentityFor(userID.Domain())
+	if err != nil {
+		return err
+	}
+	proto := &gomatrixserverlib.ProtoEvent{
+		SenderID: string(*senderID),
+		RoomID:   roomID,
+		Type:     "m.room.message",
+	}
+	if err = proto.SetContent(map[string]string{
+		"msgtype": "m.notice",
+		"body":    notice,
+	}); err != nil {
+		return err
+	}
+	event, err := eventutil.QueryAndBuildEvent(ctx, proto, identity, time.Now(), r.Queryer, nil)
+	if err != nil {
+		return err
+	}
+	inputRes := &api.InputRoomEventsResponse{}
+	r.Inputer.InputRoomEvents(ctx, &api.InputRoomEventsRequest{
+		InputRoomEvents: []api.InputRoomEvent{
+			{
+				Kind:         api.KindNew,
+				Event:        event,
+				Origin:       userID.Domain(),
+				SendAsServer: string(userID.Domain()),
+			},
+		},
+	}, inputRes)
+	return inputRes.Err()
+}
+
+// PerformAdminPurgeRoom removes all traces for the given room from the database,
+// and returns the users that were joined to it. In a dry run, the users are only
+// returned.
 func (r *Admin) PerformAdminPurgeRoom(
 	ctx context.Context,
-	roomID string,
-) error {
+	roomID string, dryRun bool,
+) (affected []string, err error) {
 	// Validate we actually got a room ID and nothing else
-	if _, _, err := gomatrixserverlib.SplitID('!', roomID); err != nil {
-		return err
+	if _, _, err = gomatrixserverlib.SplitID('!', roomID); err != nil {
+		return nil, err
+	}
+
+	affected = []string{}
+	roomInfo, err := r.DB.RoomInfo(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	if roomInfo != nil && !roomInfo.IsStub() {
+		if affected, err = r.joinedMembers(ctx, roomID, roomInfo); err != nil {
+			return nil, err
+		}
+	}
+	if dryRun {
+		return affected, nil
 	}
 
 	logrus.WithField("room_id", roomID).Warn("Purging room from roomserver")
-	if err := r.DB.PurgeRoom(ctx, roomID); err != nil {
+	if err = r.DB.PurgeRoom(ctx, roomID); err != nil {
 		logrus.WithField("room_id", roomID).WithError(err).Warn("Failed to purge room from roomserver")
-		return err
+		return nil, err
 	}
 
 	logrus.WithField("room_id", roomID).Warn("Room purged from roomserver, informing other components")
 
-	return r.Inputer.OutputProducer.ProduceRoomEvents(roomID, []api.OutputEvent{
+	return affected, r.Inputer.OutputProducer.ProduceRoomEvents(roomID, []api.OutputEvent{
 		{
 			Type: api.OutputTypePurgeRoom,
 			PurgeRoom: &api.OutputPurgeRoom{
@@ -222,6 +616,44 @@ func (r *Admin) PerformAdminPurgeRoom(
 	})
 }
 
+// QueryAdminRedactedEvent returns the original event with its content if the
+// event has been redacted but the content hasn't been pruned yet, so that it
+// can be reviewed by moderators, or nil otherwise.
+func (r *Admin) QueryAdminRedactedEvent(
+	ctx context.Context,
+	eventID string,
+) (gomatrixserverlib.PDU, error) {
+	return r.DB.RedactedEvent(ctx, eventID)
+}
+
+// joinedMembers returns the user IDs of the members joined to the room.
+func (r *Admin) joinedMembers(ctx context.Context, roomID string, roomInfo *types.RoomInfo) ([]string, error) {
+	validRoomID, err := spec.NewRoomID(roomID)
+	if err != nil {
+		return nil, err
+	}
+	memberNIDs, err := r.DB.GetMembershipEventNIDsForRoom(ctx, roomInfo.RoomNID, true, false)
+	if err != nil {
+		return nil, err
+	}
+	memberEvents, err := r.DB.Events(ctx, roomInfo.RoomVersion, memberNIDs)
+	if err != nil {
+		return nil, err
+	}
+	members := make([]string, 0, len(memberEvents))
+	for _, memberEvent := range memberEvents {
+		if memberEvent.StateKey() == nil {
+			continue
+		}
+		userID, err := r.Queryer.QueryUserIDForSender(ctx, *validRoomID, spec.SenderID(*memberEvent.StateKey()))
+		if err != nil || userID == nil {
+			continue
+		}
+		members = append(members, userID.String())
+	}
+	return members, nil
+}
+
 func (r *Admin) PerformAdminDownloadState(
 	ctx context.Context,
 	roomID, userID string, serverName spec.ServerName,
@@ -0,0 +1,99 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+// How many events to look at in one go when searching a room for media.
+const mediaURIsBatchSize = 1000
+
+// QueryMediaURIsInRoom returns the distinct mxc:// URIs referenced by the content of
+// the events in the room that we know about, e.g. attachments, thumbnails and avatars.
+// The content of encrypted events can't be inspected, so their media isn't included.
+func (r *Queryer) QueryMediaURIsInRoom(ctx context.Context, roomID spec.RoomID) ([]string, error) {
+	roomInfo, err := r.DB.RoomInfo(ctx, roomID.String())
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if roomInfo == nil || roomInfo.IsStub() {
+		return nil, nil
+	}
+
+	seen := map[string]struct{}{}
+	uris := []string{}
+	var afterNID types.EventNID
+	for {
+		page, err := r.DB.RoomEventNIDs(ctx, roomInfo.RoomNID, afterNID, mediaURIsBatchSize)
+		if err != nil {
+			return nil, fmt.Errorf("r.DB.RoomEventNIDs: %w", err)
+		}
+		if len(page) == 0 {
+			return uris, nil
+		}
+		eventNIDs := make([]types.EventNID, 0, len(page))
+		for eventNID := range page {
+			eventNIDs = append(eventNIDs, eventNID)
+			if eventNID > afterNID {
+				afterNID = eventNID
+			}
+		}
+		events, err := r.DB.Events(ctx, roomInfo.RoomVersion, eventNIDs)
+		if err != nil {
+			return nil, fmt.Errorf("r.DB.Events: %w", err)
+		}
+		for _, event := range events {
+			findMediaURIs(gjson.ParseBytes(event.Content()), func(uri string) {
+				if _, ok := seen[uri]; !ok {
+					seen[uri] = struct{}{}
+					uris = append(uris, uri)
+				}
+			})
+		}
+	}
+}
+
+// findMediaURIs calls fn with every string in the JSON value that is an mxc:// URI.
+func findMediaURIs(value gjson.Result, fn func(uri string)) {
+	switch {
+	case value.Type == gjson.String:
+		if isMediaURI(value.Str) {
+			fn(value.Str)
+		}
+	case value.IsObject(), value.IsArray():
+		value.ForEach(func(_, v gjson.Result) bool {
+			findMediaURIs(v, fn)
+			return true
+		})
+	}
+}
+
+// isMediaURI returns true if the string looks like mxc://<server-name>/<media-id>.
+func isMediaURI(s string) bool {
+	rest, ok := strings.CutPrefix(s, "mxc://")
+	if !ok || strings.ContainsAny(rest, " \t\r\n") {
+		return false
+	}
+	serverName, mediaID, ok := strings.Cut(rest, "/")
+	return ok && serverName != "" && mediaID != ""
+}
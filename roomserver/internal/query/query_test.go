@@ -28,6 +28,7 @@ import (
 	"github.com/matrix-org/dendrite/test"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/tidwall/gjson"
 )
 
 // used to implement RoomserverInternalAPIEventDB to test getAuthChain
@@ -186,3 +187,27 @@ func TestCurrentEventIsNil(t *testing.T) {
 		}
 	})
 }
+
+func TestFindMediaURIs(t *testing.T) {
+	content := `{
+		"msgtype": "m.image",
+		"url": "mxc://example.com/image",
+		"info": {"thumbnail_url": "mxc://example.com/thumb", "mimetype": "image/png"},
+		"file": {"url": "mxc://example.com/encrypted"},
+		"avatars": ["mxc://other.com/avatar", "https://example.com/not-media"],
+		"body": "mxc:// is only media if it is the whole string, like mxc://example.com/image"
+	}`
+	var got []string
+	findMediaURIs(gjson.Parse(content), func(uri string) {
+		got = append(got, uri)
+	})
+	want := []string{"mxc://example.com/image", "mxc://example.com/thumb", "mxc://example.com/encrypted", "mxc://other.com/avatar"}
+	if len(got) != len(want) {
+		t.Fatalf("findMediaURIs() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("findMediaURIs() = %v, want %v", got, want)
+		}
+	}
+}
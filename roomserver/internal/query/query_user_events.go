@@ -0,0 +1,71 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+// How many of the events of a user to load in one go.
+const userEventsBatchSize = 1000
+
+// QueryUserEventsInRoom returns the events that the user sent in the room, in the
+// order that we stored them, or nil if the room isn't known to this server.
+// Rejected events are left out.
+func (r *Queryer) QueryUserEventsInRoom(ctx context.Context, roomID spec.RoomID, userID spec.UserID) ([]*types.HeaderedEvent, error) {
+	roomInfo, err := r.DB.RoomInfo(ctx, roomID.String())
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if roomInfo == nil || roomInfo.IsStub() {
+		return nil, nil
+	}
+	senderID, err := r.QuerySenderIDForUser(ctx, roomID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("r.QuerySenderIDForUser: %w", err)
+	}
+	if senderID == nil {
+		return []*types.HeaderedEvent{}, nil
+	}
+
+	result := []*types.HeaderedEvent{}
+	var afterNID types.EventNID
+	for {
+		eventNIDs, err := r.DB.EventNIDsBySender(ctx, roomInfo.RoomNID, *senderID, afterNID, userEventsBatchSize)
+		if err != nil {
+			return nil, fmt.Errorf("r.DB.EventNIDsBySender: %w", err)
+		}
+		if len(eventNIDs) == 0 {
+			return result, nil
+		}
+		afterNID = eventNIDs[len(eventNIDs)-1]
+		events, err := r.DB.Events(ctx, roomInfo.RoomVersion, eventNIDs)
+		if err != nil {
+			return nil, fmt.Errorf("r.DB.Events: %w", err)
+		}
+		sort.Slice(events, func(i, j int) bool {
+			return events[i].EventNID < events[j].EventNID
+		})
+		for _, event := range events {
+			result = append(result, &types.HeaderedEvent{PDU: event.PDU})
+		}
+	}
+}
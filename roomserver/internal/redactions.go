@@ -0,0 +1,48 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The number of redacted events to prune in one go.
+const redactionPruneBatchSize = 100
+
+// PruneRedactedEvents removes the original content of all redacted events
+// whose redactions were validated longer ago than the retention window. It is
+// run every redaction prune interval, which also catches up on events that were
+// kept under a longer retention window than is configured now.
+func (r *RoomserverInternalAPI) PruneRedactedEvents(ctx context.Context) error {
+	validatedBefore := time.Now().Add(-r.Cfg.RoomServer.RedactionRetention)
+	total := 0
+	for {
+		pruned, err := r.DB.PruneRedactedEvents(ctx, validatedBefore, redactionPruneBatchSize)
+		total += pruned
+		if err != nil {
+			return err
+		}
+		if pruned < redactionPruneBatchSize {
+			break
+		}
+	}
+	if total > 0 {
+		logrus.WithField("pruned", total).Info("Pruned the content of redacted events")
+	}
+	return nil
+}
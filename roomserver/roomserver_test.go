@@ -342,8 +342,20 @@ func TestPurgeRoom(t *testing.T) {
 			t.Fatalf("expected invite event ID %s, got %s", inviteEvent.EventID(), inviteEventIDs[0])
 		}
 
+		// a dry run only reports the joined members
+		affected, err := rsAPI.PerformAdminPurgeRoom(ctx, room.ID, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(affected, []string{alice.ID}) {
+			t.Fatalf("expected %s to be affected, got %v", alice.ID, affected)
+		}
+		if roomInfo, err = db.RoomInfo(ctx, room.ID); err != nil || roomInfo == nil {
+			t.Fatalf("expected room to still exist after a dry run: %v", err)
+		}
+
 		// purge the room from the database
-		if err = rsAPI.PerformAdminPurgeRoom(ctx, room.ID); err != nil {
+		if _, err = rsAPI.PerformAdminPurgeRoom(ctx, room.ID, false); err != nil {
 			t.Fatal(err)
 		}
 
@@ -462,6 +474,8 @@ func TestRedaction(t *testing.T) {
 		name             string
 		additionalEvents func(t *testing.T, room *test.Room)
 		wantRedacted     bool
+		// the original content is pruned straight away
+		noRetention bool
 	}{
 		{
 			name:         "can redact own message",
@@ -514,6 +528,24 @@ func TestRedaction(t *testing.T) {
 				room.InsertEvent(t, builderEv)
 			},
 		},
+		{
+			name:         "content is pruned straight away without a retention window",
+			wantRedacted: true,
+			noRetention:  true,
+			additionalEvents: func(t *testing.T, room *test.Room) {
+				redactedEvent := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "hello world"})
+
+				builderEv := mustCreateEvent(t, fledglingEvent{
+					Type:       spec.MRoomRedaction,
+					SenderID:   alice.ID,
+					RoomID:     room.ID,
+					Redacts:    redactedEvent.EventID(),
+					Depth:      redactedEvent.Depth() + 1,
+					PrevEvents: []interface{}{redactedEvent.EventID()},
+				})
+				room.InsertEvent(t, builderEv)
+			},
+		},
 		{
 			name: "can not redact others message, missing PL",
 			additionalEvents: func(t *testing.T, room *test.Room) {
@@ -548,6 +580,10 @@ func TestRedaction(t *testing.T) {
 
 		for _, tc := range testCases {
 			t.Run(tc.name, func(t *testing.T) {
+				db.SetRedactionRetention(time.Hour)
+				if tc.noRetention {
+					db.SetRedactionRetention(0)
+				}
 				authEvents := []types.EventNID{}
 				var roomInfo *types.RoomInfo
 				var err error
@@ -605,6 +641,26 @@ func TestRedaction(t *testing.T) {
 						assert.NoError(t, err)
 						assert.Equal(t, 1, len(evs))
 						assert.Equal(t, tc.wantRedacted, evs[0].Redacted())
+
+						// the original content is kept during the retention window
+						original, err := db.RedactedEvent(ctx, ev.Redacts())
+						assert.NoError(t, err)
+						if !tc.wantRedacted || tc.noRetention {
+							assert.Nil(t, original)
+							continue
+						}
+						assert.NotNil(t, original)
+						assert.Equal(t, "hello world", gjson.GetBytes(original.Content(), "body").Str)
+
+						// and pruned afterwards
+						_, err = db.PruneRedactedEvents(ctx, time.Now().Add(time.Hour), 100)
+						assert.NoError(t, err)
+						original, err = db.RedactedEvent(ctx, ev.Redacts())
+						assert.NoError(t, err)
+						assert.Nil(t, original)
+						evs, err = db.Events(ctx, roomInfo.RoomVersion, []types.EventNID{nids[ev.Redacts()].EventNID})
+						assert.NoError(t, err)
+						assert.True(t, evs[0].Redacted())
 					}
 				}
 			})
@@ -1094,6 +1150,99 @@ func TestUpgrade(t *testing.T) {
 	})
 }
 
+func TestAdminRoomUpgrades(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	ctx := context.Background()
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		natsInstance := jetstream.NATSInstance{}
+		defer close()
+
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
+		rsAPI.SetUserAPI(userAPI)
+
+		oldRoom := test.NewRoom(t, alice, test.RoomVersion(gomatrixserverlib.RoomVersionV9))
+		oldRoom.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{
+			"membership": spec.Join,
+		}, test.WithStateKey(bob.ID))
+		oldRoom.CreateAndInsert(t, alice, "m.bridge", map[string]interface{}{
+			"protocol": map[string]interface{}{"id": "irc"},
+		}, test.WithStateKey("irc-bridge"))
+		currentRoom := test.NewRoom(t, alice, test.RoomVersion(rsAPI.DefaultRoomVersion()))
+		for _, room := range []*test.Room{oldRoom, currentRoom} {
+			if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+				t.Fatalf("failed to send events: %v", err)
+			}
+		}
+
+		rooms, err := rsAPI.QueryAdminRoomUpgrades(ctx, rsAPI.DefaultRoomVersion())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rooms) != 1 || rooms[0].RoomID != oldRoom.ID {
+			t.Fatalf("expected only room %s to need upgrading, got %+v", oldRoom.ID, rooms)
+		}
+		room := rooms[0]
+		if room.RoomVersion != gomatrixserverlib.RoomVersionV9 {
+			t.Errorf("expected room version %s, got %s", gomatrixserverlib.RoomVersionV9, room.RoomVersion)
+		}
+		if len(room.JoinedMembers) != 2 {
+			t.Errorf("expected 2 joined members, got %v", room.JoinedMembers)
+		}
+		if !reflect.DeepEqual(room.UpgradableBy, []string{alice.ID}) {
+			t.Errorf("expected only %s to be able to upgrade the room, got %v", alice.ID, room.UpgradableBy)
+		}
+		if !reflect.DeepEqual(room.Bridges, []string{"irc-bridge"}) {
+			t.Errorf("expected bridge irc-bridge, got %v", room.Bridges)
+		}
+
+		// bob isn't allowed to upgrade the room
+		if _, err = rsAPI.PerformAdminUpgradeRoom(ctx, oldRoom.ID, bob.ID, rsAPI.DefaultRoomVersion(), "", false); err == nil {
+			t.Fatalf("expected upgrading as %s to fail", bob.ID)
+		}
+
+		// a dry run doesn't upgrade the room
+		newRoomID, err := rsAPI.PerformAdminUpgradeRoom(ctx, oldRoom.ID, "", rsAPI.DefaultRoomVersion(), "Upgrading", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if newRoomID != "" {
+			t.Fatalf("expected no new room from a dry run, got %s", newRoomID)
+		}
+		rooms, err = rsAPI.QueryAdminRoomUpgrades(ctx, rsAPI.DefaultRoomVersion())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rooms) != 1 {
+			t.Fatalf("expected room %s to still need upgrading, got %+v", oldRoom.ID, rooms)
+		}
+
+		newRoomID, err = rsAPI.PerformAdminUpgradeRoom(ctx, oldRoom.ID, "", rsAPI.DefaultRoomVersion(), "Upgrading", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if newRoomID == "" {
+			t.Fatalf("expected a new room")
+		}
+
+		// the upgraded room is no longer reported
+		rooms, err = rsAPI.QueryAdminRoomUpgrades(ctx, rsAPI.DefaultRoomVersion())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rooms) != 0 {
+			t.Fatalf("expected no rooms to need upgrading, got %+v", rooms)
+		}
+	})
+}
+
 func TestStateReset(t *testing.T) {
 	alice := test.NewUser(t)
 	bob := test.NewUser(t)
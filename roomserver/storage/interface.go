@@ -17,6 +17,7 @@ package storage
 import (
 	"context"
 	"crypto/ed25519"
+	"time"
 
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -159,6 +160,15 @@ type Database interface {
 	GetStateEventsWithEventType(ctx context.Context, roomID, evType string) ([]*types.HeaderedEvent, error)
 	// GetRoomsByMembership returns a list of room IDs matching the provided membership and user ID (as state_key).
 	GetRoomsByMembership(ctx context.Context, userID spec.UserID, membership string) ([]string, error)
+	// GetRecentEventIDsBySender returns the IDs of up to limit of the most recent unredacted
+	// non-state events sent by the given sender in the room, newest first.
+	GetRecentEventIDsBySender(ctx context.Context, roomNID types.RoomNID, senderID spec.SenderID, limit int) ([]string, error)
+	// EventNIDsBySender returns up to limit of the unrejected events sent by the given sender in the
+	// room, with event NIDs greater than afterEventNID, oldest first. Used to export the data of a user.
+	EventNIDsBySender(ctx context.Context, roomNID types.RoomNID, senderID spec.SenderID, afterEventNID types.EventNID, limit int) ([]types.EventNID, error)
+	// RoomEventNIDs returns up to limit of the events in the room, with event NIDs greater than
+	// afterEventNID, mapped to whether the event was rejected. Used to export whole rooms.
+	RoomEventNIDs(ctx context.Context, roomNID types.RoomNID, afterEventNID types.EventNID, limit int) (map[types.EventNID]bool, error)
 	// GetBulkStateContent returns all state events which match a given room ID and a given state key tuple. Both must be satisfied for a match.
 	// If a tuple has the StateKey of '*' and allowWildcards=true then all state events with the EventType should be returned.
 	GetBulkStateContent(ctx context.Context, roomIDs []string, tuples []gomatrixserverlib.StateKeyTuple, allowWildcards bool) ([]tables.StrippedEvent, error)
@@ -179,6 +189,14 @@ type Database interface {
 	GetLeftUsers(ctx context.Context, userIDs []string) ([]string, error)
 	PurgeRoom(ctx context.Context, roomID string) error
 	UpgradeRoom(ctx context.Context, oldRoomID, newRoomID, eventSender string) error
+	// SetRedactionRetention sets how long the original content of redacted events is kept before it is pruned.
+	SetRedactionRetention(retention time.Duration)
+	// RedactedEvent returns the original event with its content if the event has been redacted but the content
+	// hasn't been pruned yet, or nil otherwise.
+	RedactedEvent(ctx context.Context, eventID string) (gomatrixserverlib.PDU, error)
+	// PruneRedactedEvents removes the original content of up to limit redacted events whose redactions were
+	// validated before the given time, returning the number of redactions that were pruned.
+	PruneRedactedEvents(ctx context.Context, validatedBefore time.Time, limit int) (int, error)
 
 	// GetMembershipForHistoryVisibility queries the membership events for the given eventIDs.
 	// Returns a map from (input) eventID -> membership event. If no membership event is found, returns an empty event, resulting in
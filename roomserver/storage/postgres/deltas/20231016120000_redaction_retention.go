@@ -0,0 +1,44 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// UpAddRedactionRetention adds the columns needed to keep the content of redacted events
+// for a while. Redactions validated before this migration have already been pruned.
+func UpAddRedactionRetention(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `ALTER TABLE roomserver_redactions ADD COLUMN IF NOT EXISTS validated_ts BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE roomserver_redactions ADD COLUMN IF NOT EXISTS pruned BOOLEAN NOT NULL DEFAULT FALSE;
+UPDATE roomserver_redactions SET pruned = validated;
+CREATE INDEX IF NOT EXISTS roomserver_redactions_to_prune ON roomserver_redactions(validated_ts) WHERE validated = TRUE AND pruned = FALSE;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownAddRedactionRetention(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `DROP INDEX IF EXISTS roomserver_redactions_to_prune;
+ALTER TABLE roomserver_redactions DROP COLUMN IF EXISTS validated_ts;
+ALTER TABLE roomserver_redactions DROP COLUMN IF EXISTS pruned;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
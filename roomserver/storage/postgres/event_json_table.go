@@ -23,6 +23,7 @@ import (
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/storage/tables"
 	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib/spec"
 )
 
 const eventJSONSchema = `
@@ -54,9 +55,30 @@ const bulkSelectEventJSONSQL = "" +
 	" WHERE event_nid = ANY($1)" +
 	" ORDER BY event_nid ASC"
 
+// Select the most recent non-state events sent by the given sender in a room,
+// skipping redactions and events that have already been redacted.
+const selectEventIDsBySenderSQL = "" +
+	"SELECT e.event_id FROM roomserver_events e" +
+	" JOIN roomserver_event_json j ON e.event_nid = j.event_nid" +
+	" WHERE e.room_nid = $1 AND e.event_state_key_nid = 0 AND e.event_type_nid <> 6 AND e.is_rejected = FALSE" +
+	" AND j.event_json::jsonb->>'sender' = $2" +
+	" AND NOT EXISTS (SELECT 1 FROM roomserver_redactions r WHERE r.redacts_event_id = e.event_id)" +
+	" ORDER BY e.event_nid DESC LIMIT $3"
+
+// Select the events sent by the given sender in a room in the order they were
+// stored, for exporting the data of a user. Paginated by event NID.
+const selectEventNIDsBySenderSQL = "" +
+	"SELECT e.event_nid FROM roomserver_events e" +
+	" JOIN roomserver_event_json j ON e.event_nid = j.event_nid" +
+	" WHERE e.room_nid = $1 AND e.event_nid > $2 AND e.is_rejected = FALSE" +
+	" AND j.event_json::jsonb->>'sender' = $3" +
+	" ORDER BY e.event_nid ASC LIMIT $4"
+
 type eventJSONStatements struct {
-	insertEventJSONStmt     *sql.Stmt
-	bulkSelectEventJSONStmt *sql.Stmt
+	insertEventJSONStmt         *sql.Stmt
+	bulkSelectEventJSONStmt     *sql.Stmt
+	selectEventIDsBySenderStmt  *sql.Stmt
+	selectEventNIDsBySenderStmt *sql.Stmt
 }
 
 func CreateEventJSONTable(db *sql.DB) error {
@@ -70,6 +92,8 @@ func PrepareEventJSONTable(db *sql.DB) (tables.EventJSON, error) {
 	return s, sqlutil.StatementList{
 		{&s.insertEventJSONStmt, insertEventJSONSQL},
 		{&s.bulkSelectEventJSONStmt, bulkSelectEventJSONSQL},
+		{&s.selectEventIDsBySenderStmt, selectEventIDsBySenderSQL},
+		{&s.selectEventNIDsBySenderStmt, selectEventNIDsBySenderSQL},
 	}.Prepare(db)
 }
 
@@ -107,3 +131,46 @@ func (s *eventJSONStatements) BulkSelectEventJSON(
 	}
 	return results[:i], rows.Err()
 }
+
+func (s *eventJSONStatements) SelectEventIDsBySender(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, senderID spec.SenderID, limit int,
+) ([]string, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectEventIDsBySenderStmt)
+	rows, err := stmt.QueryContext(ctx, int64(roomNID), string(senderID), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectEventIDsBySender: rows.close() failed")
+
+	var eventIDs []string
+	var eventID string
+	for rows.Next() {
+		if err = rows.Scan(&eventID); err != nil {
+			return nil, err
+		}
+		eventIDs = append(eventIDs, eventID)
+	}
+	return eventIDs, rows.Err()
+}
+
+func (s *eventJSONStatements) SelectEventNIDsBySender(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, senderID spec.SenderID,
+	afterEventNID types.EventNID, limit int,
+) ([]types.EventNID, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectEventNIDsBySenderStmt)
+	rows, err := stmt.QueryContext(ctx, int64(roomNID), int64(afterEventNID), string(senderID), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectEventNIDsBySender: rows.close() failed")
+
+	var eventNIDs []types.EventNID
+	var eventNID int64
+	for rows.Next() {
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		eventNIDs = append(eventNIDs, types.EventNID(eventNID))
+	}
+	return eventNIDs, rows.Err()
+}
@@ -25,6 +25,7 @@ import (
 	"github.com/matrix-org/util"
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
 	"github.com/matrix-org/dendrite/roomserver/types"
 )
 
@@ -236,7 +237,8 @@ func (s *stateSnapshotStatements) BulkSelectMembershipForHistoryVisibility(
 			result[eventID] = ev
 			continue
 		}
-		event, err := verImpl.NewEventFromTrustedJSON(evJson, false)
+		// The membership event may have been redacted, but not pruned yet.
+		event, err := tables.EventFromJSON(verImpl, membershipEventID, evJson)
 		if err != nil {
 			result[eventID] = &types.HeaderedEvent{}
 			// not fatal
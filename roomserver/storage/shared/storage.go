@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"sort"
+	"time"
 
 	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/roomserver/api"
@@ -15,7 +16,6 @@ import (
 	"github.com/matrix-org/gomatrixserverlib/spec"
 	"github.com/matrix-org/util"
 	"github.com/sirupsen/logrus"
-	"github.com/tidwall/gjson"
 
 	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
@@ -24,15 +24,6 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/types"
 )
 
-// Ideally, when we have both events we should redact the event JSON and forget about the redaction, but we currently
-// don't because the redaction code is brand new. When we are more certain that redactions don't misbehave or are
-// vulnerable to attacks from remote servers (e.g a server bypassing event auth rules shouldn't redact our data)
-// then we should flip this to true. This will mean redactions /actually delete information irretrievably/ which
-// will be necessary for compliance with the law. Note that downstream components (syncapi) WILL delete information
-// in their database on receipt of a redaction. Also note that we still modify the event JSON to set the field
-// unsigned.redacted_because - we just don't clear out the content fields yet.
-const redactionsArePermanent = true
-
 type Database struct {
 	DB *sql.DB
 	EventDatabase
@@ -61,6 +52,11 @@ type EventDatabase struct {
 	EventStateKeysTable tables.EventStateKeys
 	PrevEventsTable     tables.PreviousEvents
 	RedactionsTable     tables.Redactions
+	// How long to keep the original content of redacted events in the event JSON
+	// before pruning it. If zero, the content is pruned as soon as the redaction
+	// is validated. Note that downstream components (syncapi) delete the content
+	// in their database on receipt of a redaction regardless.
+	RedactionRetention time.Duration
 }
 
 func (d *Database) SupportsConcurrentRoomInputs() bool {
@@ -571,9 +567,6 @@ func (d *EventDatabase) events(
 				PDU:      event,
 			})
 		}
-		if !redactionsArePermanent {
-			d.applyRedactions(results)
-		}
 		return results, nil
 	}
 	eventJSONs, err := d.EventJSONTable.BulkSelectEventJSON(ctx, txn, eventNIDs)
@@ -591,9 +584,8 @@ func (d *EventDatabase) events(
 	}
 
 	for _, eventJSON := range eventJSONs {
-		redacted := gjson.GetBytes(eventJSON.EventJSON, "unsigned.redacted_because").Exists()
-		events[eventJSON.EventNID], err = verImpl.NewEventFromTrustedJSONWithEventID(
-			eventIDs[eventJSON.EventNID], eventJSON.EventJSON, redacted,
+		events[eventJSON.EventNID], err = tables.EventFromJSON(
+			verImpl, eventIDs[eventJSON.EventNID], eventJSON.EventJSON,
 		)
 		if err != nil {
 			return nil, err
@@ -613,9 +605,6 @@ func (d *EventDatabase) events(
 			PDU:      event,
 		})
 	}
-	if !redactionsArePermanent {
-		d.applyRedactions(results)
-	}
 	return results, nil
 }
 
@@ -1061,8 +1050,9 @@ func (d *EventDatabase) MaybeRedactEvent(
 			return nil
 		}
 
-		// mark the event as redacted
-		if redactionsArePermanent {
+		// mark the event as redacted, keeping the original content in the event JSON
+		// for moderation review if there is a retention window
+		if d.RedactionRetention == 0 {
 			redactedEvent.Redact()
 		}
 
@@ -1085,6 +1075,15 @@ func (d *EventDatabase) MaybeRedactEvent(
 		if err != nil {
 			return fmt.Errorf("d.RedactionsTable.MarkRedactionValidated: %w", err)
 		}
+		if d.RedactionRetention == 0 {
+			err = d.RedactionsTable.MarkRedactionPruned(ctx, txn, redactionEvent.EventID())
+			if err != nil {
+				return fmt.Errorf("d.RedactionsTable.MarkRedactionPruned: %w", err)
+			}
+		} else if err = tables.RedactEvent(redactedEvent.PDU); err != nil {
+			// the callers only ever get to see the redacted event
+			return fmt.Errorf("redactEvent: %w", err)
+		}
 
 		// We remove the entry from the cache, as if we just "StoreRoomServerEvent", we can't be
 		// certain that the cached entry actually is updated, since ristretto is eventual-persistent.
@@ -1143,13 +1142,94 @@ func (d *EventDatabase) loadRedactionPair(
 	return redactionEvent, redactedEvent, info.Validated, nil
 }
 
-// applyRedactions will redact events that have an `unsigned.redacted_because` field.
-func (d *EventDatabase) applyRedactions(events []types.Event) {
-	for i := range events {
-		if result := gjson.GetBytes(events[i].Unsigned(), "redacted_because"); result.Exists() {
-			events[i].Redact()
+// SetRedactionRetention sets how long the original content of redacted events is
+// kept before it is pruned.
+func (d *EventDatabase) SetRedactionRetention(retention time.Duration) {
+	d.RedactionRetention = retention
+}
+
+// RedactedEvent returns the original event with its content if the event has been
+// redacted but the content hasn't been pruned yet, or nil otherwise.
+func (d *Database) RedactedEvent(ctx context.Context, eventID string) (gomatrixserverlib.PDU, error) {
+	info, err := d.RedactionsTable.SelectRedactionInfoByEventBeingRedacted(ctx, nil, eventID)
+	if err != nil {
+		return nil, fmt.Errorf("d.RedactionsTable.SelectRedactionInfoByEventBeingRedacted: %w", err)
+	}
+	if info == nil || !info.Validated || info.Pruned {
+		return nil, nil
+	}
+	_, event, err := d.unredactedEvent(ctx, nil, eventID)
+	return event, err
+}
+
+// PruneRedactedEvents removes the original content of up to limit redacted events
+// whose redactions were validated before the given time, returning the number of
+// redactions that were pruned.
+func (d *Database) PruneRedactedEvents(ctx context.Context, validatedBefore time.Time, limit int) (int, error) {
+	infos, err := d.RedactionsTable.SelectRedactionsToPrune(ctx, nil, spec.AsTimestamp(validatedBefore), limit)
+	if err != nil {
+		return 0, fmt.Errorf("d.RedactionsTable.SelectRedactionsToPrune: %w", err)
+	}
+	for i, info := range infos {
+		var eventNID types.EventNID
+		err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+			var event gomatrixserverlib.PDU
+			eventNID, event, err = d.unredactedEvent(ctx, txn, info.RedactsEventID)
+			if err != nil {
+				return err
+			}
+			if event != nil {
+				if err = tables.RedactEvent(event); err != nil {
+					return fmt.Errorf("redactEvent: %w", err)
+				}
+				if err = d.EventJSONTable.InsertEventJSON(ctx, txn, eventNID, event.JSON()); err != nil {
+					return fmt.Errorf("d.EventJSONTable.InsertEventJSON: %w", err)
+				}
+			}
+			return d.RedactionsTable.MarkRedactionPruned(ctx, txn, info.RedactionEventID)
+		})
+		if err != nil {
+			return i, fmt.Errorf("failed to prune redacted event %s: %w", info.RedactsEventID, err)
+		}
+		if eventNID != 0 {
+			d.Cache.InvalidateRoomServerEvent(eventNID)
 		}
 	}
+	return len(infos), nil
+}
+
+// unredactedEvent loads the event as it is stored in the event JSON, without removing
+// the content of redacted events which haven't been pruned yet. Returns a nil event if
+// the event isn't known.
+func (d *Database) unredactedEvent(ctx context.Context, txn *sql.Tx, eventID string) (types.EventNID, gomatrixserverlib.PDU, error) {
+	nids, err := d.EventsTable.BulkSelectEventNID(ctx, txn, []string{eventID})
+	if err != nil {
+		return 0, nil, fmt.Errorf("d.EventsTable.BulkSelectEventNID: %w", err)
+	}
+	metadata, ok := nids[eventID]
+	if !ok {
+		return 0, nil, nil
+	}
+	roomVersions, err := d.RoomsTable.SelectRoomVersionsForRoomNIDs(ctx, txn, []types.RoomNID{metadata.RoomNID})
+	if err != nil {
+		return 0, nil, fmt.Errorf("d.RoomsTable.SelectRoomVersionsForRoomNIDs: %w", err)
+	}
+	verImpl, err := gomatrixserverlib.GetRoomVersion(roomVersions[metadata.RoomNID])
+	if err != nil {
+		return 0, nil, err
+	}
+	eventJSONs, err := d.EventJSONTable.BulkSelectEventJSON(ctx, txn, []types.EventNID{metadata.EventNID})
+	if err != nil {
+		return 0, nil, fmt.Errorf("d.EventJSONTable.BulkSelectEventJSON: %w", err)
+	}
+	if len(eventJSONs) == 0 {
+		return 0, nil, nil
+	}
+	event, err := verImpl.NewEventFromTrustedJSONWithEventID(eventID, eventJSONs[0].EventJSON, false)
+	if err != nil {
+		return 0, nil, err
+	}
+	return metadata.EventNID, event, nil
 }
 
 // loadEvent loads a single event or returns nil on any problems/missing event
@@ -1201,7 +1281,7 @@ func (d *Database) GetHistoryVisibilityState(ctx context.Context, roomInfo *type
 		if err != nil {
 			return nil, err
 		}
-		ev, err := verImpl.NewEventFromTrustedJSONWithEventID(eventIDs[eventNID], data[0].EventJSON, false)
+		ev, err := tables.EventFromJSON(verImpl, eventIDs[eventNID], data[0].EventJSON)
 		if err != nil {
 			return nil, err
 		}
@@ -1273,7 +1353,7 @@ func (d *Database) GetStateEvent(ctx context.Context, roomID, evType, stateKey s
 			if len(data) == 0 {
 				return nil, fmt.Errorf("GetStateEvent: no json for event nid %d", e.EventNID)
 			}
-			ev, err := verImpl.NewEventFromTrustedJSONWithEventID(eventIDs[e.EventNID], data[0].EventJSON, false)
+			ev, err := tables.EventFromJSON(verImpl, eventIDs[e.EventNID], data[0].EventJSON)
 			if err != nil {
 				return nil, err
 			}
@@ -1334,7 +1414,7 @@ func (d *Database) GetStateEventsWithEventType(ctx context.Context, roomID, evTy
 	}
 	var result []*types.HeaderedEvent
 	for _, pair := range eventPairs {
-		ev, err := verImpl.NewEventFromTrustedJSONWithEventID(eventIDs[pair.EventNID], pair.EventJSON, false)
+		ev, err := tables.EventFromJSON(verImpl, eventIDs[pair.EventNID], pair.EventJSON)
 		if err != nil {
 			return nil, err
 		}
@@ -1344,6 +1424,23 @@ func (d *Database) GetStateEventsWithEventType(ctx context.Context, roomID, evTy
 	return result, nil
 }
 
+// GetRecentEventIDsBySender returns the IDs of the most recent unredacted non-state events sent by the sender in the room.
+func (d *Database) GetRecentEventIDsBySender(ctx context.Context, roomNID types.RoomNID, senderID spec.SenderID, limit int) ([]string, error) {
+	return d.EventJSONTable.SelectEventIDsBySender(ctx, nil, roomNID, senderID, limit)
+}
+
+// EventNIDsBySender returns up to limit of the unrejected events sent by the sender in the room, with
+// event NIDs greater than afterEventNID, oldest first.
+func (d *Database) EventNIDsBySender(ctx context.Context, roomNID types.RoomNID, senderID spec.SenderID, afterEventNID types.EventNID, limit int) ([]types.EventNID, error) {
+	return d.EventJSONTable.SelectEventNIDsBySender(ctx, nil, roomNID, senderID, afterEventNID, limit)
+}
+
+// RoomEventNIDs returns up to limit of the events in the room, with event NIDs greater than
+// afterEventNID, mapped to whether the event was rejected.
+func (d *Database) RoomEventNIDs(ctx context.Context, roomNID types.RoomNID, afterEventNID types.EventNID, limit int) (map[types.EventNID]bool, error) {
+	return d.EventsTable.SelectRoomEventNIDs(ctx, nil, roomNID, afterEventNID, limit)
+}
+
 // GetRoomsByMembership returns a list of room IDs matching the provided membership and user ID (as state_key).
 func (d *Database) GetRoomsByMembership(ctx context.Context, userID spec.UserID, membership string) ([]string, error) {
 	var membershipState tables.MembershipState
@@ -1514,7 +1611,7 @@ func (d *Database) GetBulkStateContent(ctx context.Context, roomIDs []string, tu
 		if err != nil {
 			return nil, err
 		}
-		ev, err := verImpl.NewEventFromTrustedJSONWithEventID(eventIDs[events[i].EventNID], events[i].EventJSON, false)
+		ev, err := tables.EventFromJSON(verImpl, eventIDs[events[i].EventNID], events[i].EventJSON)
 		if err != nil {
 			return nil, fmt.Errorf("GetBulkStateContent: failed to load event JSON for event NID %v : %w", events[i].EventNID, err)
 		}
@@ -120,6 +120,12 @@ const selectRoomNIDsForEventNIDsSQL = "" +
 const selectEventRejectedSQL = "" +
 	"SELECT is_rejected FROM roomserver_events WHERE room_nid = $1 AND event_id = $2"
 
+// Selects the events in a room in the order they were stored, for exporting
+// the room. Paginated by event NID.
+const selectRoomEventNIDsSQL = "" +
+	"SELECT event_nid, is_rejected FROM roomserver_events WHERE room_nid = $1 AND event_nid > $2" +
+	" ORDER BY event_nid ASC LIMIT $3"
+
 type eventStatements struct {
 	db                                            *sql.DB
 	insertEventStmt                               *sql.Stmt
@@ -135,6 +141,7 @@ type eventStatements struct {
 	bulkSelectStateAtEventAndReferenceStmt        *sql.Stmt
 	bulkSelectEventIDStmt                         *sql.Stmt
 	selectEventRejectedStmt                       *sql.Stmt
+	selectRoomEventNIDsStmt                       *sql.Stmt
 	//bulkSelectEventNIDStmt               *sql.Stmt
 	//bulkSelectUnsentEventNIDStmt         *sql.Stmt
 	//selectRoomNIDsForEventNIDsStmt       *sql.Stmt
@@ -192,6 +199,7 @@ func PrepareEventsTable(db *sql.DB) (tables.Events, error) {
 		//{&s.bulkSelectUnsentEventNIDStmt, bulkSelectUnsentEventNIDSQL},
 		//{&s.selectRoomNIDForEventNIDStmt, selectRoomNIDForEventNIDSQL},
 		{&s.selectEventRejectedStmt, selectEventRejectedSQL},
+		{&s.selectRoomEventNIDsStmt, selectRoomEventNIDsSQL},
 	}.Prepare(db)
 }
 
@@ -682,3 +690,24 @@ func (s *eventStatements) SelectEventRejected(
 	err = stmt.QueryRowContext(ctx, roomNID, eventID).Scan(&rejected)
 	return
 }
+
+func (s *eventStatements) SelectRoomEventNIDs(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, afterEventNID types.EventNID, limit int,
+) (map[types.EventNID]bool, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectRoomEventNIDsStmt)
+	rows, err := stmt.QueryContext(ctx, roomNID, afterEventNID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectRoomEventNIDs: rows.close() failed")
+	result := make(map[types.EventNID]bool)
+	var eventNID types.EventNID
+	var rejected bool
+	for rows.Next() {
+		if err = rows.Scan(&eventNID, &rejected); err != nil {
+			return nil, err
+		}
+		result[eventNID] = rejected
+	}
+	return result, rows.Err()
+}
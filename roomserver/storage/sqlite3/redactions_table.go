@@ -17,9 +17,13 @@ package sqlite3
 import (
 	"context"
 	"database/sql"
+	"time"
 
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/sqlite3/deltas"
 	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/gomatrixserverlib/spec"
 )
 
 const redactionsSchema = `
@@ -31,24 +35,36 @@ CREATE TABLE IF NOT EXISTS roomserver_redactions (
 	redacts_event_id TEXT NOT NULL,
 	-- Initially FALSE, set to TRUE when the redaction has been validated according to rooms v3+ spec
 	-- https://matrix.org/docs/spec/rooms/v3#authorization-rules-for-events
-	validated BOOLEAN NOT NULL
+	validated BOOLEAN NOT NULL,
+	-- When the redaction was validated, used to find redacted events whose retention window has passed
+	validated_ts BIGINT NOT NULL DEFAULT 0,
+	-- Set to TRUE once the original content of the redacted event has been removed from the event JSON
+	pruned BOOLEAN NOT NULL DEFAULT FALSE
 );
 `
 
 const insertRedactionSQL = "" +
-	"INSERT OR IGNORE INTO roomserver_redactions (redaction_event_id, redacts_event_id, validated)" +
-	" VALUES ($1, $2, $3)"
+	"INSERT OR IGNORE INTO roomserver_redactions (redaction_event_id, redacts_event_id, validated, pruned)" +
+	" VALUES ($1, $2, $3, $4)"
 
 const selectRedactionInfoByRedactionEventIDSQL = "" +
-	"SELECT redaction_event_id, redacts_event_id, validated FROM roomserver_redactions" +
+	"SELECT redaction_event_id, redacts_event_id, validated, pruned FROM roomserver_redactions" +
 	" WHERE redaction_event_id = $1"
 
 const selectRedactionInfoByEventBeingRedactedSQL = "" +
-	"SELECT redaction_event_id, redacts_event_id, validated FROM roomserver_redactions" +
+	"SELECT redaction_event_id, redacts_event_id, validated, pruned FROM roomserver_redactions" +
 	" WHERE redacts_event_id = $1"
 
 const markRedactionValidatedSQL = "" +
-	" UPDATE roomserver_redactions SET validated = $1 WHERE redaction_event_id = $2"
+	" UPDATE roomserver_redactions SET validated = $1, validated_ts = $2 WHERE redaction_event_id = $3"
+
+const markRedactionPrunedSQL = "" +
+	" UPDATE roomserver_redactions SET pruned = TRUE WHERE redaction_event_id = $1"
+
+const selectRedactionsToPruneSQL = "" +
+	"SELECT redaction_event_id, redacts_event_id, validated, pruned FROM roomserver_redactions" +
+	" WHERE validated = TRUE AND pruned = FALSE AND validated_ts < $1" +
+	" ORDER BY validated_ts ASC LIMIT $2"
 
 type redactionStatements struct {
 	db                                          *sql.DB
@@ -56,11 +72,21 @@ type redactionStatements struct {
 	selectRedactionInfoByRedactionEventIDStmt   *sql.Stmt
 	selectRedactionInfoByEventBeingRedactedStmt *sql.Stmt
 	markRedactionValidatedStmt                  *sql.Stmt
+	markRedactionPrunedStmt                     *sql.Stmt
+	selectRedactionsToPruneStmt                 *sql.Stmt
 }
 
 func CreateRedactionsTable(db *sql.DB) error {
 	_, err := db.Exec(redactionsSchema)
-	return err
+	if err != nil {
+		return err
+	}
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(sqlutil.Migration{
+		Version: "roomserver: add redaction retention columns",
+		Up:      deltas.UpAddRedactionRetention,
+	})
+	return m.Up(context.Background())
 }
 
 func PrepareRedactionsTable(db *sql.DB) (tables.Redactions, error) {
@@ -73,6 +99,8 @@ func PrepareRedactionsTable(db *sql.DB) (tables.Redactions, error) {
 		{&s.selectRedactionInfoByRedactionEventIDStmt, selectRedactionInfoByRedactionEventIDSQL},
 		{&s.selectRedactionInfoByEventBeingRedactedStmt, selectRedactionInfoByEventBeingRedactedSQL},
 		{&s.markRedactionValidatedStmt, markRedactionValidatedSQL},
+		{&s.markRedactionPrunedStmt, markRedactionPrunedSQL},
+		{&s.selectRedactionsToPruneStmt, selectRedactionsToPruneSQL},
 	}.Prepare(db)
 }
 
@@ -80,7 +108,7 @@ func (s *redactionStatements) InsertRedaction(
 	ctx context.Context, txn *sql.Tx, info tables.RedactionInfo,
 ) error {
 	stmt := sqlutil.TxStmt(txn, s.insertRedactionStmt)
-	_, err := stmt.ExecContext(ctx, info.RedactionEventID, info.RedactsEventID, info.Validated)
+	_, err := stmt.ExecContext(ctx, info.RedactionEventID, info.RedactsEventID, info.Validated, info.Pruned)
 	return err
 }
 
@@ -90,7 +118,7 @@ func (s *redactionStatements) SelectRedactionInfoByRedactionEventID(
 	info = &tables.RedactionInfo{}
 	stmt := sqlutil.TxStmt(txn, s.selectRedactionInfoByRedactionEventIDStmt)
 	err = stmt.QueryRowContext(ctx, redactionEventID).Scan(
-		&info.RedactionEventID, &info.RedactsEventID, &info.Validated,
+		&info.RedactionEventID, &info.RedactsEventID, &info.Validated, &info.Pruned,
 	)
 	if err == sql.ErrNoRows {
 		info = nil
@@ -105,7 +133,7 @@ func (s *redactionStatements) SelectRedactionInfoByEventBeingRedacted(
 	info = &tables.RedactionInfo{}
 	stmt := sqlutil.TxStmt(txn, s.selectRedactionInfoByEventBeingRedactedStmt)
 	err = stmt.QueryRowContext(ctx, eventID).Scan(
-		&info.RedactionEventID, &info.RedactsEventID, &info.Validated,
+		&info.RedactionEventID, &info.RedactsEventID, &info.Validated, &info.Pruned,
 	)
 	if err == sql.ErrNoRows {
 		info = nil
@@ -118,6 +146,34 @@ func (s *redactionStatements) MarkRedactionValidated(
 	ctx context.Context, txn *sql.Tx, redactionEventID string, validated bool,
 ) error {
 	stmt := sqlutil.TxStmt(txn, s.markRedactionValidatedStmt)
-	_, err := stmt.ExecContext(ctx, validated, redactionEventID)
+	_, err := stmt.ExecContext(ctx, validated, spec.AsTimestamp(time.Now()), redactionEventID)
 	return err
 }
+
+func (s *redactionStatements) MarkRedactionPruned(
+	ctx context.Context, txn *sql.Tx, redactionEventID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.markRedactionPrunedStmt)
+	_, err := stmt.ExecContext(ctx, redactionEventID)
+	return err
+}
+
+func (s *redactionStatements) SelectRedactionsToPrune(
+	ctx context.Context, txn *sql.Tx, validatedBefore spec.Timestamp, limit int,
+) ([]tables.RedactionInfo, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectRedactionsToPruneStmt)
+	rows, err := stmt.QueryContext(ctx, validatedBefore, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectRedactionsToPrune: rows.close() failed")
+	var infos []tables.RedactionInfo
+	for rows.Next() {
+		var info tables.RedactionInfo
+		if err = rows.Scan(&info.RedactionEventID, &info.RedactsEventID, &info.Validated, &info.Pruned); err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, rows.Err()
+}
@@ -12,10 +12,17 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/gomatrixserverlib/spec"
 	"github.com/stretchr/testify/assert"
 )
 
 func mustCreateEventJSONTable(t *testing.T, dbType test.DBType) (tables.EventJSON, func()) {
+	t.Helper()
+	tab, _, close := mustCreateEventJSONAndEventsTables(t, dbType)
+	return tab, close
+}
+
+func mustCreateEventJSONAndEventsTables(t *testing.T, dbType test.DBType) (tables.EventJSON, tables.Events, func()) {
 	t.Helper()
 	connStr, close := test.PrepareDBConnectionString(t, dbType)
 	db, err := sqlutil.Open(&config.DatabaseOptions{
@@ -23,19 +30,32 @@ func mustCreateEventJSONTable(t *testing.T, dbType test.DBType) (tables.EventJSO
 	}, sqlutil.NewExclusiveWriter())
 	assert.NoError(t, err)
 	var tab tables.EventJSON
+	var eventsTab tables.Events
 	switch dbType {
 	case test.DBTypePostgres:
+		err = postgres.CreateEventsTable(db)
+		assert.NoError(t, err)
+		err = postgres.CreateRedactionsTable(db)
+		assert.NoError(t, err)
 		err = postgres.CreateEventJSONTable(db)
 		assert.NoError(t, err)
+		eventsTab, err = postgres.PrepareEventsTable(db)
+		assert.NoError(t, err)
 		tab, err = postgres.PrepareEventJSONTable(db)
 	case test.DBTypeSQLite:
+		err = sqlite3.CreateEventsTable(db)
+		assert.NoError(t, err)
+		err = sqlite3.CreateRedactionsTable(db)
+		assert.NoError(t, err)
 		err = sqlite3.CreateEventJSONTable(db)
 		assert.NoError(t, err)
+		eventsTab, err = sqlite3.PrepareEventsTable(db)
+		assert.NoError(t, err)
 		tab, err = sqlite3.PrepareEventJSONTable(db)
 	}
 	assert.NoError(t, err)
 
-	return tab, close
+	return tab, eventsTab, close
 }
 
 func Test_EventJSONTable(t *testing.T) {
@@ -93,3 +113,53 @@ func Test_EventJSONTable(t *testing.T) {
 		}
 	})
 }
+
+func Test_EventJSONTableSelectEventNIDsBySender(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{
+		"membership": spec.Join,
+	}, test.WithStateKey(bob.ID))
+	for i := 0; i < 3; i++ {
+		room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "hello alice"})
+		room.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "hello bob"})
+	}
+	ctx := context.Background()
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		tab, eventsTab, close := mustCreateEventJSONAndEventsTables(t, dbType)
+		defer close()
+
+		var wantNIDs []types.EventNID
+		for i, ev := range room.Events() {
+			// Reject one of bob's events, which mustn't be returned.
+			rejected := i == len(room.Events())-1
+			eventNID, _, err := eventsTab.InsertEvent(ctx, nil, 1, 1, 1, ev.EventID(), nil, ev.Depth(), rejected)
+			assert.NoError(t, err)
+			assert.NoError(t, tab.InsertEventJSON(ctx, nil, eventNID, ev.JSON()))
+			if string(ev.SenderID()) == bob.ID && !rejected {
+				wantNIDs = append(wantNIDs, eventNID)
+			}
+		}
+		assert.Len(t, wantNIDs, 3)
+
+		// page through bob's events
+		var gotNIDs []types.EventNID
+		var afterNID types.EventNID
+		for {
+			page, err := tab.SelectEventNIDsBySender(ctx, nil, 1, spec.SenderID(bob.ID), afterNID, 2)
+			assert.NoError(t, err)
+			if len(page) == 0 {
+				break
+			}
+			gotNIDs = append(gotNIDs, page...)
+			afterNID = page[len(page)-1]
+		}
+		assert.Equal(t, wantNIDs, gotNIDs)
+
+		page, err := tab.SelectEventNIDsBySender(ctx, nil, 2, spec.SenderID(bob.ID), 0, 10)
+		assert.NoError(t, err)
+		assert.Empty(t, page)
+	})
+}
@@ -145,5 +145,27 @@ func Test_EventsTable(t *testing.T) {
 		maxDepth, err := tab.SelectMaxEventDepth(ctx, nil, nids)
 		assert.NoError(t, err)
 		assert.Equal(t, int64(len(room.Events())+1), maxDepth)
+
+		// page through all events in the room
+		var afterNID types.EventNID
+		var roomEventNIDs []types.EventNID
+		for {
+			page, err := tab.SelectRoomEventNIDs(ctx, nil, 1, afterNID, 2)
+			assert.NoError(t, err)
+			if len(page) == 0 {
+				break
+			}
+			for eventNID, rejected := range page {
+				assert.False(t, rejected)
+				roomEventNIDs = append(roomEventNIDs, eventNID)
+				if eventNID > afterNID {
+					afterNID = eventNID
+				}
+			}
+		}
+		assert.ElementsMatch(t, nids, roomEventNIDs)
+		page, err := tab.SelectRoomEventNIDs(ctx, nil, 2, 0, 10)
+		assert.NoError(t, err)
+		assert.Empty(t, page)
 	})
 }
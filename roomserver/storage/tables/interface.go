@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/ed25519"
 	"database/sql"
+	"encoding/json"
 	"errors"
 
 	"github.com/matrix-org/gomatrixserverlib"
@@ -24,6 +25,11 @@ type EventJSON interface {
 	// Insert the event JSON. On conflict, replace the event JSON with the new value (for redactions).
 	InsertEventJSON(ctx context.Context, tx *sql.Tx, eventNID types.EventNID, eventJSON []byte) error
 	BulkSelectEventJSON(ctx context.Context, tx *sql.Tx, eventNIDs []types.EventNID) ([]EventJSONPair, error)
+	// SelectEventIDsBySender returns the IDs of the most recent unredacted non-state events sent by the sender in the room.
+	SelectEventIDsBySender(ctx context.Context, tx *sql.Tx, roomNID types.RoomNID, senderID spec.SenderID, limit int) ([]string, error)
+	// SelectEventNIDsBySender returns up to limit of the NIDs of the unrejected events sent by the sender in the room,
+	// that are greater than afterEventNID, in ascending order.
+	SelectEventNIDsBySender(ctx context.Context, tx *sql.Tx, roomNID types.RoomNID, senderID spec.SenderID, afterEventNID types.EventNID, limit int) ([]types.EventNID, error)
 }
 
 type EventTypes interface {
@@ -69,6 +75,9 @@ type Events interface {
 	SelectMaxEventDepth(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) (int64, error)
 	SelectRoomNIDsForEventNIDs(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) (roomNIDs map[types.EventNID]types.RoomNID, err error)
 	SelectEventRejected(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, eventID string) (rejected bool, err error)
+	// SelectRoomEventNIDs returns up to limit event NIDs in the room that are greater than afterEventNID,
+	// mapped to whether the event was rejected.
+	SelectRoomEventNIDs(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, afterEventNID types.EventNID, limit int) (map[types.EventNID]bool, error)
 }
 
 type Rooms interface {
@@ -166,6 +175,8 @@ type RedactionInfo struct {
 	RedactsEventID string
 	// the ID of the redaction event
 	RedactionEventID string
+	// whether the content of the redacted event has been pruned
+	Pruned bool
 }
 
 type Redactions interface {
@@ -177,6 +188,11 @@ type Redactions interface {
 	// Mark this redaction event as having been validated. This means we have both sides of the redaction and have
 	// successfully redacted the event JSON.
 	MarkRedactionValidated(ctx context.Context, txn *sql.Tx, redactionEventID string, validated bool) error
+	// MarkRedactionPruned marks the content of the event redacted by this redaction event as having been pruned.
+	MarkRedactionPruned(ctx context.Context, txn *sql.Tx, redactionEventID string) error
+	// SelectRedactionsToPrune returns up to limit validated redactions, validated before the given time, whose
+	// redacted event still has its original content.
+	SelectRedactionsToPrune(ctx context.Context, txn *sql.Tx, validatedBefore spec.Timestamp, limit int) ([]RedactionInfo, error)
 }
 
 type Purge interface {
@@ -243,3 +259,38 @@ func ExtractContentValue(ev *types.HeaderedEvent) string {
 	// this returns the empty string if this is not a string type
 	return result.Str
 }
+
+// EventFromJSON parses the event JSON as stored in the database. The event JSON of a
+// redacted event keeps its original content until the redaction is pruned, so redacted
+// events are always redacted again before handing them out.
+func EventFromJSON(verImpl gomatrixserverlib.IRoomVersion, eventID string, eventJSON []byte) (gomatrixserverlib.PDU, error) {
+	event, err := verImpl.NewEventFromTrustedJSONWithEventID(eventID, eventJSON, false)
+	if err != nil {
+		return nil, err
+	}
+	if gjson.GetBytes(eventJSON, "unsigned.redacted_because").Exists() {
+		if err = RedactEvent(event); err != nil {
+			return nil, err
+		}
+	}
+	return event, nil
+}
+
+// RedactEvent removes the content of the event, keeping the unsigned fields which
+// say what the event was redacted by.
+func RedactEvent(event gomatrixserverlib.PDU) error {
+	redactedBecause := gjson.GetBytes(event.Unsigned(), "redacted_because")
+	redactedBy := gjson.GetBytes(event.Unsigned(), "redacted_by")
+	event.Redact()
+	if redactedBecause.Exists() {
+		if err := event.SetUnsignedField("redacted_because", json.RawMessage(redactedBecause.Raw)); err != nil {
+			return err
+		}
+	}
+	if redactedBy.Exists() {
+		if err := event.SetUnsignedField("redacted_by", redactedBy.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
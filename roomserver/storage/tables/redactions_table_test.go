@@ -3,6 +3,7 @@ package tables_test
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/storage/postgres"
@@ -10,6 +11,7 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/storage/tables"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/gomatrixserverlib/spec"
 	"github.com/matrix-org/util"
 	"github.com/stretchr/testify/assert"
 )
@@ -73,12 +75,32 @@ func TestRedactionsTable(t *testing.T) {
 			assert.Equal(t, &wantRedactionInfo, redactionInfo)
 		}
 
+		// all the validated redactions are waiting to be pruned
+		toPrune, err := tab.SelectRedactionsToPrune(ctx, nil, spec.AsTimestamp(time.Now().Add(time.Minute)), 100)
+		assert.NoError(t, err)
+		assert.Equal(t, 10, len(toPrune))
+
+		// but not if they were validated after the given time
+		notYet, err := tab.SelectRedactionsToPrune(ctx, nil, spec.AsTimestamp(time.Now().Add(-time.Minute)), 100)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(notYet))
+
+		// pruned redactions aren't returned again
+		err = tab.MarkRedactionPruned(ctx, nil, toPrune[0].RedactionEventID)
+		assert.NoError(t, err)
+		redactionInfo, err := tab.SelectRedactionInfoByRedactionEventID(ctx, nil, toPrune[0].RedactionEventID)
+		assert.NoError(t, err)
+		assert.True(t, redactionInfo.Pruned)
+		toPrune, err = tab.SelectRedactionsToPrune(ctx, nil, spec.AsTimestamp(time.Now().Add(time.Minute)), 100)
+		assert.NoError(t, err)
+		assert.Equal(t, 9, len(toPrune))
+
 		// Should not fail, it just updates 0 rows
-		err := tab.MarkRedactionValidated(ctx, nil, "iDontExist", true)
+		err = tab.MarkRedactionValidated(ctx, nil, "iDontExist", true)
 		assert.NoError(t, err)
 
 		// Should also not fail, but return a nil redactionInfo
-		redactionInfo, err := tab.SelectRedactionInfoByRedactionEventID(ctx, nil, "iDontExist")
+		redactionInfo, err = tab.SelectRedactionInfoByRedactionEventID(ctx, nil, "iDontExist")
 		assert.NoError(t, err)
 		assert.Nil(t, redactionInfo)
 
@@ -291,6 +291,53 @@ type RejectedError string
 
 func (e RejectedError) Error() string { return string(e) }
 
+// The state that an event can be checked against when it fails auth.
+const (
+	// The auth events listed in the event itself.
+	AuthCheckAuthEvents = "auth_events"
+	// The state of the room before the event, calculated from its prev events.
+	AuthCheckStateBefore = "state_before"
+	// The current state of the room, used to decide whether to soft-fail the event.
+	AuthCheckCurrentState = "current_state"
+)
+
+// An EventAuthError is returned when an event is stored as rejected because it
+// failed the auth rules. Unlike a RejectedError it says which rule failed and
+// which auth events the event was checked against, to make it easier to work
+// out why servers disagree about an event.
+type EventAuthError struct {
+	EventID string `json:"event_id"`
+	// The auth rule that failed: the event type for event types with their own
+	// auth rules, otherwise "default".
+	Rule string `json:"rule"`
+	// The state that the event was checked against, one of the AuthCheck constants.
+	CheckedAgainst string `json:"checked_against"`
+	// The auth events needed by the rule. Auth events that were missing have no event ID.
+	AuthEvents []AuthEventRef `json:"auth_events"`
+	// The reason given by the auth rules.
+	Reason string `json:"reason"`
+}
+
+// An AuthEventRef is a state event that an event was authed against.
+type AuthEventRef struct {
+	Type     string `json:"type"`
+	StateKey string `json:"state_key"`
+	EventID  string `json:"event_id,omitempty"`
+}
+
+func (e *EventAuthError) Error() string {
+	return fmt.Sprintf("event %s failed auth rule %q against %s: %s", e.EventID, e.Rule, e.CheckedAgainst, e.Reason)
+}
+
+// IsRejected returns true if the error means that the event was stored as rejected.
+func IsRejected(err error) bool {
+	switch err.(type) {
+	case RejectedError, *EventAuthError:
+		return true
+	}
+	return false
+}
+
 // RoomInfo contains metadata about a room
 type RoomInfo struct {
 	mu               sync.RWMutex
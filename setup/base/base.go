@@ -55,9 +55,26 @@ var loginFallback embed.FS
 
 const HTTPServerTimeout = time.Minute * 5
 
+// configureOutboundProxy makes the proxy from the config apply to all outbound
+// HTTP requests. The HTTP clients, including the ones from gomatrixserverlib,
+// use http.ProxyFromEnvironment, which reads the environment on first use, so
+// this must be called before any request is made.
+func configureOutboundProxy(cfg *config.Dendrite) {
+	proxy := &cfg.Global.OutboundProxy
+	if !proxy.Enabled() {
+		return
+	}
+	for key, value := range proxy.Environment() {
+		if err := os.Setenv(key, value); err != nil {
+			logrus.WithError(err).Panicf("failed to configure the outbound proxy")
+		}
+	}
+}
+
 // CreateClient creates a new client (normally used for media fetch requests).
 // Should only be called once per component.
 func CreateClient(cfg *config.Dendrite, dnsCache *fclient.DNSCache) *fclient.Client {
+	configureOutboundProxy(cfg)
 	if cfg.Global.DisableFederation {
 		return fclient.NewClient(
 			fclient.WithTransport(noOpHTTPTransport),
@@ -78,6 +95,7 @@ func CreateClient(cfg *config.Dendrite, dnsCache *fclient.DNSCache) *fclient.Cli
 // CreateFederationClient creates a new federation client. Should only be called
 // once per component.
 func CreateFederationClient(cfg *config.Dendrite, dnsCache *fclient.DNSCache) fclient.FederationClient {
+	configureOutboundProxy(cfg)
 	identities := cfg.Global.SigningIdentities()
 	if cfg.Global.DisableFederation {
 		return fclient.NewFederationClient(
@@ -118,7 +136,10 @@ func ConfigureAdminEndpoints(processContext *process.ProcessContext, routers htt
 }
 
 // SetupAndServeHTTP sets up the HTTP server to serve client & federation APIs
-// and adds a prometheus handler under /_dendrite/metrics.
+// and adds a prometheus handler under /_dendrite/metrics. The admin APIs and
+// metrics are left to SetupAndServeInternalHTTP if an internal listener is
+// configured, and the media APIs to SetupAndServeMediaHTTP if a media listener
+// is.
 func SetupAndServeHTTP(
 	processContext *process.ProcessContext,
 	cfg *config.Dendrite,
@@ -126,28 +147,39 @@ func SetupAndServeHTTP(
 	externalHTTPAddr config.ServerAddress,
 	certFile, keyFile *string,
 ) {
-	externalRouter := mux.NewRouter().SkipClean(true).UseEncodedPath()
-
 	externalServ := &http.Server{
 		Addr:         externalHTTPAddr.Address,
 		WriteTimeout: HTTPServerTimeout,
-		Handler:      externalRouter,
+		Handler:      ExternalHandler(processContext, cfg, routers),
 		BaseContext: func(_ net.Listener) context.Context {
 			return processContext.Context()
 		},
 	}
 
+	serveHTTP(processContext, externalServ, externalHTTPAddr, certFile, keyFile, "external")
+}
+
+// ExternalHandler returns the handler for the external listeners, which serves
+// the public Matrix APIs from the routers, and also the admin APIs and metrics
+// if there is no internal listener and the media APIs if there is no media
+// listener.
+func ExternalHandler(
+	processContext *process.ProcessContext,
+	cfg *config.Dendrite,
+	routers httputil.Routers,
+) http.Handler {
+	externalRouter := mux.NewRouter().SkipClean(true).UseEncodedPath()
+
 	//Redirect for Landing Page
 	externalRouter.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, httputil.PublicStaticPath, http.StatusFound)
 	})
 
-	if cfg.Global.Metrics.Enabled {
-		externalRouter.Handle("/metrics", httputil.WrapHandlerInBasicAuth(promhttp.Handler(), cfg.Global.Metrics.BasicAuth))
+	internalListener := cfg.Global.Listeners.Internal.Enabled()
+	if !internalListener {
+		configureInternalRoutes(processContext, cfg, routers, externalRouter)
 	}
 
-	ConfigureAdminEndpoints(processContext, routers)
-
 	// Parse and execute the landing page template
 	tmpl := template.Must(template.ParseFS(staticContent, "static/*.gotmpl"))
 	landingPage := &bytes.Buffer{}
@@ -185,75 +217,179 @@ func SetupAndServeHTTP(
 		})
 		federationHandler = sentryHandler.Handle(routers.Federation)
 	}
-	externalRouter.PathPrefix(httputil.DendriteAdminPathPrefix).Handler(routers.DendriteAdmin)
 	externalRouter.PathPrefix(httputil.PublicClientPathPrefix).Handler(clientHandler)
 	if !cfg.Global.DisableFederation {
 		externalRouter.PathPrefix(httputil.PublicKeyPathPrefix).Handler(routers.Keys)
 		externalRouter.PathPrefix(httputil.PublicFederationPathPrefix).Handler(federationHandler)
 	}
-	externalRouter.PathPrefix(httputil.SynapseAdminPathPrefix).Handler(routers.SynapseAdmin)
-	externalRouter.PathPrefix(httputil.PublicMediaPathPrefix).Handler(routers.Media)
+	if !cfg.Global.Listeners.Media.Enabled() {
+		configureMediaRoutes(routers, externalRouter)
+	}
 	externalRouter.PathPrefix(httputil.PublicWellKnownPrefix).Handler(routers.WellKnown)
 	externalRouter.PathPrefix(httputil.PublicStaticPath).Handler(routers.Static)
 
 	externalRouter.NotFoundHandler = httputil.NotFoundCORSHandler
 	externalRouter.MethodNotAllowedHandler = httputil.NotAllowedHandler
 
-	if externalHTTPAddr.Enabled() {
+	return externalRouter
+}
+
+// SetupAndServeInternalHTTP serves the admin APIs and metrics on the internal
+// listener from the config, so that they can be kept off the public interface.
+func SetupAndServeInternalHTTP(
+	processContext *process.ProcessContext,
+	cfg *config.Dendrite,
+	routers httputil.Routers,
+) {
+	listener := cfg.Global.Listeners.Internal
+	internalHTTPAddr, err := listener.ServerAddress()
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to parse internal listener address")
+	}
+
+	internalRouter := mux.NewRouter().SkipClean(true).UseEncodedPath()
+	internalServ := &http.Server{
+		Addr:         internalHTTPAddr.Address,
+		WriteTimeout: HTTPServerTimeout,
+		Handler:      internalRouter,
+		BaseContext: func(_ net.Listener) context.Context {
+			return processContext.Context()
+		},
+	}
+
+	configureInternalRoutes(processContext, cfg, routers, internalRouter)
+	internalRouter.NotFoundHandler = httputil.NotFoundCORSHandler
+	internalRouter.MethodNotAllowedHandler = httputil.NotAllowedHandler
+
+	var certFile, keyFile *string
+	if listener.TLS() {
+		cert, key := string(listener.TLSCert), string(listener.TLSKey)
+		certFile, keyFile = &cert, &key
+	}
+	serveHTTP(processContext, internalServ, internalHTTPAddr, certFile, keyFile, "internal")
+}
+
+// SetupAndServeMediaHTTP serves the media APIs on the media listener, so that
+// media traffic can be proxied, limited and timed out separately from the
+// other APIs.
+func SetupAndServeMediaHTTP(
+	processContext *process.ProcessContext,
+	cfg *config.Dendrite,
+	routers httputil.Routers,
+) {
+	listener := cfg.Global.Listeners.Media
+	mediaHTTPAddr, err := listener.ServerAddress()
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to parse media listener address")
+	}
+
+	mediaRouter := mux.NewRouter().SkipClean(true).UseEncodedPath()
+	mediaServ := &http.Server{
+		Addr:         mediaHTTPAddr.Address,
+		WriteTimeout: HTTPServerTimeout,
+		Handler:      mediaRouter,
+		BaseContext: func(_ net.Listener) context.Context {
+			return processContext.Context()
+		},
+	}
+
+	configureMediaRoutes(routers, mediaRouter)
+	mediaRouter.NotFoundHandler = httputil.NotFoundCORSHandler
+	mediaRouter.MethodNotAllowedHandler = httputil.NotAllowedHandler
+
+	var certFile, keyFile *string
+	if listener.TLS() {
+		cert, key := string(listener.TLSCert), string(listener.TLSKey)
+		certFile, keyFile = &cert, &key
+	}
+	serveHTTP(processContext, mediaServ, mediaHTTPAddr, certFile, keyFile, "media")
+}
+
+// configureMediaRoutes adds the media APIs to the router.
+func configureMediaRoutes(routers httputil.Routers, router *mux.Router) {
+	router.PathPrefix(httputil.PublicMediaPathPrefix).Handler(routers.Media)
+	router.PathPrefix(httputil.PublicMediaProxyPathPrefix).Handler(routers.MediaProxy)
+}
+
+// configureInternalRoutes adds the admin APIs and metrics to the router.
+func configureInternalRoutes(
+	processContext *process.ProcessContext,
+	cfg *config.Dendrite,
+	routers httputil.Routers,
+	router *mux.Router,
+) {
+	if cfg.Global.Metrics.Enabled {
+		router.Handle("/metrics", httputil.WrapHandlerInBasicAuth(promhttp.Handler(), cfg.Global.Metrics.BasicAuth))
+	}
+
+	ConfigureAdminEndpoints(processContext, routers)
+
+	router.PathPrefix(httputil.DendriteAdminPathPrefix).Handler(routers.DendriteAdmin)
+	router.PathPrefix(httputil.SynapseAdminPathPrefix).Handler(routers.SynapseAdmin)
+}
+
+// serveHTTP serves the server on the address until Dendrite shuts down.
+func serveHTTP(
+	processContext *process.ProcessContext,
+	serv *http.Server,
+	addr config.ServerAddress,
+	certFile, keyFile *string,
+	name string,
+) {
+	if addr.Enabled() {
 		go func() {
-			var externalShutdown atomic.Bool // RegisterOnShutdown can be called more than once
-			logrus.Infof("Starting external listener on %s", externalServ.Addr)
+			var shutdown atomic.Bool // RegisterOnShutdown can be called more than once
+			logrus.Infof("Starting %s listener on %s", name, serv.Addr)
 			processContext.ComponentStarted()
-			externalServ.RegisterOnShutdown(func() {
-				if externalShutdown.CompareAndSwap(false, true) {
+			serv.RegisterOnShutdown(func() {
+				if shutdown.CompareAndSwap(false, true) {
 					processContext.ComponentFinished()
-					logrus.Infof("Stopped external HTTP listener")
+					logrus.Infof("Stopped %s HTTP listener", name)
 				}
 			})
 			if certFile != nil && keyFile != nil {
-				if err := externalServ.ListenAndServeTLS(*certFile, *keyFile); err != nil {
+				if err := serv.ListenAndServeTLS(*certFile, *keyFile); err != nil {
 					if err != http.ErrServerClosed {
 						logrus.WithError(err).Fatal("failed to serve HTTPS")
 					}
 				}
 			} else {
-				if externalHTTPAddr.IsUnixSocket() {
-					err := os.Remove(externalHTTPAddr.Address)
+				if addr.IsUnixSocket() {
+					err := os.Remove(addr.Address)
 					if err != nil && !errors.Is(err, fs.ErrNotExist) {
 						logrus.WithError(err).Fatal("failed to remove existing unix socket")
 					}
-					listener, err := net.Listen(externalHTTPAddr.Network(), externalHTTPAddr.Address)
+					listener, err := net.Listen(addr.Network(), addr.Address)
 					if err != nil {
 						logrus.WithError(err).Fatal("failed to serve unix socket")
 					}
-					err = os.Chmod(externalHTTPAddr.Address, externalHTTPAddr.UnixSocketPermission)
+					err = os.Chmod(addr.Address, addr.UnixSocketPermission)
 					if err != nil {
 						logrus.WithError(err).Fatal("failed to set unix socket permissions")
 					}
-					if err := externalServ.Serve(listener); err != nil {
+					if err := serv.Serve(listener); err != nil {
 						if err != http.ErrServerClosed {
 							logrus.WithError(err).Fatal("failed to serve unix socket")
 						}
 					}
 
 				} else {
-					if err := externalServ.ListenAndServe(); err != nil {
+					if err := serv.ListenAndServe(); err != nil {
 						if err != http.ErrServerClosed {
 							logrus.WithError(err).Fatal("failed to serve HTTP")
 						}
 					}
 				}
 			}
-			logrus.Infof("Stopped external listener on %s", externalServ.Addr)
+			logrus.Infof("Stopped %s listener on %s", name, serv.Addr)
 		}()
 	}
 
 	minwinsvc.SetOnExit(processContext.ShutdownDendrite)
 	<-processContext.WaitForShutdown()
 
-	logrus.Infof("Stopping HTTP listeners")
-	_ = externalServ.Shutdown(context.Background())
-	logrus.Infof("Stopped HTTP listeners")
+	logrus.Infof("Stopping %s HTTP listener", name)
+	_ = serv.Shutdown(context.Background())
 }
 
 func WaitForShutdown(processCtx *process.ProcessContext) {
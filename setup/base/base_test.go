@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"path"
+	"strings"
 	"testing"
 	"time"
 
@@ -106,3 +107,80 @@ func TestLandingPage_UnixSocket(t *testing.T) {
 	// Using .String() for user friendly output
 	assert.Equal(t, expectedRes.String(), buf.String(), "response mismatch")
 }
+
+func TestInternalListener(t *testing.T) {
+	processCtx := process.NewProcessContext()
+	routers := httputil.NewRouters()
+	cfg := config.Dendrite{}
+	cfg.Defaults(config.DefaultOpts{Generate: true, SingleDatabase: true})
+
+	// hack: create servers and close them immediately, just to get random ports assigned
+	external := httptest.NewServer(nil)
+	external.Close()
+	internalServer := httptest.NewServer(nil)
+	internalServer.Close()
+	cfg.Global.Listeners.Internal.Address = strings.TrimPrefix(internalServer.URL, "http://")
+
+	address, err := config.HTTPAddress(external.URL)
+	assert.NoError(t, err)
+	go basepkg.SetupAndServeHTTP(processCtx, &cfg, routers, address, nil, nil)
+	go basepkg.SetupAndServeInternalHTTP(processCtx, &cfg, routers)
+	time.Sleep(time.Millisecond * 10)
+	defer processCtx.ShutdownDendrite()
+
+	// The admin APIs are only served on the internal listener.
+	resp, err := http.Get(internalServer.URL + "/_dendrite/monitor/up")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, err = http.Get(external.URL + "/_dendrite/monitor/up")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// The public APIs are only served on the external listener.
+	resp, err = http.Get(external.URL + "/_matrix/static/")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, err = http.Get(internalServer.URL + "/_matrix/static/")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestMediaListener(t *testing.T) {
+	processCtx := process.NewProcessContext()
+	routers := httputil.NewRouters()
+	routers.Media.HandleFunc("/v3/config", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	cfg := config.Dendrite{}
+	cfg.Defaults(config.DefaultOpts{Generate: true, SingleDatabase: true})
+
+	// hack: create servers and close them immediately, just to get random ports assigned
+	external := httptest.NewServer(nil)
+	external.Close()
+	mediaServer := httptest.NewServer(nil)
+	mediaServer.Close()
+	cfg.Global.Listeners.Media.Address = strings.TrimPrefix(mediaServer.URL, "http://")
+
+	address, err := config.HTTPAddress(external.URL)
+	assert.NoError(t, err)
+	go basepkg.SetupAndServeHTTP(processCtx, &cfg, routers, address, nil, nil)
+	go basepkg.SetupAndServeMediaHTTP(processCtx, &cfg, routers)
+	time.Sleep(time.Millisecond * 10)
+	defer processCtx.ShutdownDendrite()
+
+	// The media APIs are only served on the media listener.
+	resp, err := http.Get(mediaServer.URL + "/_matrix/media/v3/config")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, err = http.Get(external.URL + "/_matrix/media/v3/config")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// The other APIs are only served on the external listener.
+	resp, err = http.Get(external.URL + "/_matrix/static/")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, err = http.Get(mediaServer.URL + "/_matrix/static/")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
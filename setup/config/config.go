@@ -79,6 +79,10 @@ type Dendrite struct {
 
 	// Any information derived from the configuration options for later use.
 	Derived Derived `yaml:"-"`
+
+	// The path of the file the config was loaded from, so that it can be
+	// reloaded. Empty if the config wasn't loaded from a file.
+	ConfigPath string `yaml:"-"`
 }
 
 // TODO: Kill Derived
@@ -177,7 +181,12 @@ func Load(configPath string) (*Dendrite, error) {
 	}
 	// Pass the current working directory and os.ReadFile so that they can
 	// be mocked in the tests
-	return loadConfig(basePath, configData, os.ReadFile)
+	c, err := loadConfig(basePath, configData, os.ReadFile)
+	if err != nil {
+		return nil, err
+	}
+	c.ConfigPath = configPath
+	return c, nil
 }
 
 func loadConfig(
@@ -257,6 +266,23 @@ func loadConfig(
 	}
 
 	c.MediaAPI.AbsBasePath = Path(absPath(basePath, c.MediaAPI.BasePath))
+	if c.MediaAPI.TempPath != "" {
+		c.MediaAPI.AbsTempPath = Path(absPath(basePath, c.MediaAPI.TempPath))
+	}
+	c.MediaAPI.defaultThumbnailSizes()
+	c.MediaAPI.Replicas.AbsPaths = make([]Path, 0, len(c.MediaAPI.Replicas.Paths))
+	for _, path := range c.MediaAPI.Replicas.Paths {
+		c.MediaAPI.Replicas.AbsPaths = append(c.MediaAPI.Replicas.AbsPaths, Path(absPath(basePath, path)))
+	}
+	if err = c.MediaAPI.Encryption.loadMasterKey(basePath, readFile); err != nil {
+		return nil, fmt.Errorf("failed to load the media encryption master key: %w", err)
+	}
+	if err = c.MediaAPI.DeferredThumbnails.loadPlaceholder(basePath, readFile); err != nil {
+		return nil, fmt.Errorf("failed to load the placeholder thumbnail: %w", err)
+	}
+	if err = c.UserAPI.NewDeviceAlerts.loadEmailTemplate(basePath, readFile); err != nil {
+		return nil, fmt.Errorf("failed to load the new device alert email template: %w", err)
+	}
 
 	// Generate data from config options
 	err = c.Derive()
@@ -297,6 +323,24 @@ func (config *Dendrite) Derive() error {
 		}
 	}
 
+	// Require users to agree to the privacy policy when registering
+	if consent := &config.Global.UserConsentOptions; consent.Enabled && consent.RequireAtRegistration {
+		config.Derived.Registration.Params[authtypes.LoginTypeTerms] = map[string]interface{}{
+			"policies": map[string]interface{}{
+				"privacy_policy": map[string]interface{}{
+					"version": consent.Version,
+					"en": map[string]string{
+						"name": consent.PolicyName,
+						"url":  consent.PolicyURL(),
+					},
+				},
+			},
+		}
+		for i := range config.Derived.Registration.Flows {
+			config.Derived.Registration.Flows[i].Stages = append(config.Derived.Registration.Flows[i].Stages, authtypes.LoginTypeTerms)
+		}
+	}
+
 	// Load application service configuration files
 	if err := loadAppServices(&config.AppServiceAPI, &config.Derived); err != nil {
 		return err
@@ -2,6 +2,8 @@ package config
 
 import (
 	"fmt"
+	"regexp"
+	"strings"
 	"time"
 )
 
@@ -55,6 +57,15 @@ type ClientAPI struct {
 	// Rate-limiting options
 	RateLimiting RateLimiting `yaml:"rate_limiting"`
 
+	// Restrictions on the localparts of user IDs that can be registered
+	UserLocalpartPolicy LocalpartPolicy `yaml:"user_localpart_policy"`
+
+	// Restrictions on the localparts of room aliases that can be created
+	RoomAliasLocalpartPolicy LocalpartPolicy `yaml:"room_alias_localpart_policy"`
+
+	// Restrictions on the display names and avatars of users
+	ProfilePolicy ProfilePolicy `yaml:"profile_policy"`
+
 	MSCs *MSCs `yaml:"-"`
 }
 
@@ -69,11 +80,15 @@ func (c *ClientAPI) Defaults(opts DefaultOpts) {
 	c.RegistrationDisabled = true
 	c.OpenRegistrationWithoutVerificationEnabled = false
 	c.RateLimiting.Defaults()
+	c.ProfilePolicy.Defaults()
 }
 
 func (c *ClientAPI) Verify(configErrs *ConfigErrors) {
 	c.TURN.Verify(configErrs)
 	c.RateLimiting.Verify(configErrs)
+	c.UserLocalpartPolicy.Verify(configErrs, "client_api.user_localpart_policy")
+	c.RoomAliasLocalpartPolicy.Verify(configErrs, "client_api.room_alias_localpart_policy")
+	c.ProfilePolicy.Verify(configErrs)
 	if c.RecaptchaEnabled {
 		if c.RecaptchaSiteVerifyAPI == "" {
 			c.RecaptchaSiteVerifyAPI = "https://www.google.com/recaptcha/api/siteverify"
@@ -162,3 +177,103 @@ func (r *RateLimiting) Defaults() {
 	r.Threshold = 5
 	r.CooloffMS = 500
 }
+
+// LocalpartPolicy restricts which localparts can be used, on top of what the
+// spec allows. Application services may still use reserved localparts that
+// fall within their namespaces.
+type LocalpartPolicy struct {
+	// The characters allowed in localparts, in regular expression character
+	// class syntax, e.g. "a-z0-9_". Any character allowed by the spec if empty.
+	AllowedCharacters string `yaml:"allowed_characters"`
+
+	// The minimum length of localparts
+	MinLength int `yaml:"min_length"`
+
+	// Localparts that can't be used, compared case insensitively
+	Reserved []string `yaml:"reserved"`
+
+	allowedCharactersRegexp *regexp.Regexp
+}
+
+func (p *LocalpartPolicy) Verify(configErrs *ConfigErrors, key string) {
+	checkPositive(configErrs, key+".min_length", int64(p.MinLength))
+	if p.AllowedCharacters == "" {
+		return
+	}
+	var err error
+	if p.allowedCharactersRegexp, err = regexp.Compile("^[" + p.AllowedCharacters + "]*$"); err != nil {
+		configErrs.Add(fmt.Sprintf("invalid character class for config key %q: %s", key+".allowed_characters", err))
+	}
+}
+
+// HasAllowedCharacters returns true if the localpart only contains allowed characters.
+func (p *LocalpartPolicy) HasAllowedCharacters(localpart string) bool {
+	return p.allowedCharactersRegexp == nil || p.allowedCharactersRegexp.MatchString(localpart)
+}
+
+// IsReserved returns true if the localpart is one of the reserved localparts.
+func (p *LocalpartPolicy) IsReserved(localpart string) bool {
+	for _, reserved := range p.Reserved {
+		if strings.EqualFold(reserved, localpart) {
+			return true
+		}
+	}
+	return false
+}
+
+// ProfilePolicy restricts the display names and avatars that local users can
+// set. The display name length is also enforced on the profiles of remote
+// users, which are truncated rather than rejected.
+type ProfilePolicy struct {
+	// The maximum length of display names in characters, or 0 for no limit
+	MaxDisplayNameLength int `yaml:"max_displayname_length"`
+
+	// Regular expressions matching display names that can't be used, e.g. to
+	// stop users from impersonating staff. Matched case insensitively.
+	DisallowedDisplayNames []string `yaml:"disallowed_displaynames"`
+
+	// The maximum size in bytes of avatars uploaded to this server, or 0 for
+	// no limit
+	MaxAvatarSizeBytes FileSizeBytes `yaml:"max_avatar_size_bytes"`
+
+	// The maximum width and height in pixels of avatars uploaded to this
+	// server, or 0 for no limit
+	MaxAvatarDimensions int `yaml:"max_avatar_dimensions"`
+
+	disallowedDisplayNameRegexps []*regexp.Regexp
+}
+
+func (p *ProfilePolicy) Defaults() {
+	p.MaxDisplayNameLength = 256
+}
+
+func (p *ProfilePolicy) Verify(configErrs *ConfigErrors) {
+	checkPositive(configErrs, "client_api.profile_policy.max_displayname_length", int64(p.MaxDisplayNameLength))
+	checkPositive(configErrs, "client_api.profile_policy.max_avatar_size_bytes", int64(p.MaxAvatarSizeBytes))
+	checkPositive(configErrs, "client_api.profile_policy.max_avatar_dimensions", int64(p.MaxAvatarDimensions))
+	p.disallowedDisplayNameRegexps = p.disallowedDisplayNameRegexps[:0]
+	for _, expr := range p.DisallowedDisplayNames {
+		re, err := regexp.Compile("(?i)" + expr)
+		if err != nil {
+			configErrs.Add(fmt.Sprintf("invalid regular expression for config key %q: %s", "client_api.profile_policy.disallowed_displaynames", err))
+			continue
+		}
+		p.disallowedDisplayNameRegexps = append(p.disallowedDisplayNameRegexps, re)
+	}
+}
+
+// IsDisplayNameDisallowed returns true if the display name matches one of the
+// disallowed display names.
+func (p *ProfilePolicy) IsDisplayNameDisallowed(displayName string) bool {
+	for _, re := range p.disallowedDisplayNameRegexps {
+		if re.MatchString(displayName) {
+			return true
+		}
+	}
+	return false
+}
+
+// LimitsAvatars returns true if avatars are restricted by size or dimensions.
+func (p *ProfilePolicy) LimitsAvatars() bool {
+	return p.MaxAvatarSizeBytes > 0 || p.MaxAvatarDimensions > 0
+}
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"fmt"
+
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/gomatrixserverlib/spec"
 )
@@ -24,6 +26,16 @@ type FederationAPI struct {
 	// messages to their relay server if we know of one that is appropriate.
 	P2PFederationRetriesUntilAssumedOffline uint32 `yaml:"p2p_retries_until_assumed_offline"`
 
+	// Should the backoff state of federation destinations be stored in the
+	// database, so that destinations we are backing off from are not retried
+	// straight away after a restart?
+	PersistBackoff bool `yaml:"persist_backoff"`
+
+	// The maximum number of PDUs and EDUs to send to a server in a single
+	// transaction. The spec doesn't allow more than 50 PDUs and 100 EDUs.
+	MaxPDUsPerTransaction int `yaml:"max_pdus_per_transaction"`
+	MaxEDUsPerTransaction int `yaml:"max_edus_per_transaction"`
+
 	// FederationDisableTLSValidation disables the validation of X.509 TLS certs
 	// on remote federation endpoints. This is not recommended in production!
 	DisableTLSValidation bool `yaml:"disable_tls_validation"`
@@ -39,11 +51,20 @@ type FederationAPI struct {
 
 	// Should we prefer direct key fetches over perspective ones?
 	PreferDirectFetch bool `yaml:"prefer_direct_fetch"`
+
+	// Should we request partial state when joining rooms over federation (MSC3706)?
+	// The room is usable straight away and the full state is resynced in the
+	// background. Operations that need the full room state will wait for the
+	// resync to complete.
+	PartialStateJoins bool `yaml:"partial_state_joins"`
 }
 
 func (c *FederationAPI) Defaults(opts DefaultOpts) {
 	c.FederationMaxRetries = 16
 	c.P2PFederationRetriesUntilAssumedOffline = 1
+	c.PersistBackoff = true
+	c.MaxPDUsPerTransaction = MaxPDUsPerTransaction
+	c.MaxEDUsPerTransaction = MaxEDUsPerTransaction
 	c.DisableTLSValidation = false
 	c.DisableHTTPKeepalives = false
 	if opts.Generate {
@@ -72,8 +93,20 @@ func (c *FederationAPI) Verify(configErrs *ConfigErrors) {
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "federation_api.database.connection_string", string(c.Database.ConnectionString))
 	}
+	if c.MaxPDUsPerTransaction < 1 || c.MaxPDUsPerTransaction > MaxPDUsPerTransaction {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d, must be between 1 and %d", "federation_api.max_pdus_per_transaction", c.MaxPDUsPerTransaction, MaxPDUsPerTransaction))
+	}
+	if c.MaxEDUsPerTransaction < 1 || c.MaxEDUsPerTransaction > MaxEDUsPerTransaction {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d, must be between 1 and %d", "federation_api.max_edus_per_transaction", c.MaxEDUsPerTransaction, MaxEDUsPerTransaction))
+	}
 }
 
+// The maximum number of PDUs and EDUs that the spec allows in a transaction.
+const (
+	MaxPDUsPerTransaction = 50
+	MaxEDUsPerTransaction = 100
+)
+
 // The config for setting a proxy to use for server->server requests
 type Proxy struct {
 	// Is the proxy enabled?
@@ -1,10 +1,17 @@
 package config
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"html/template"
 	"math/rand"
+	"net/url"
+	"path/filepath"
 	"strconv"
 	"strings"
+	textTemplate "text/template"
 	"time"
 
 	"github.com/matrix-org/gomatrixserverlib"
@@ -56,6 +63,11 @@ type Global struct {
 	// to other servers and the federation API will not be exposed.
 	DisableFederation bool `yaml:"disable_federation"`
 
+	// An HTTP header set by a reverse proxy with the approximate location of
+	// the client, e.g. CF-IPCountry. Included in new device alerts and the
+	// session history of devices if set.
+	LocationHeader string `yaml:"location_header"`
+
 	// Configures the handling of presence events.
 	Presence PresenceOptions `yaml:"presence"`
 
@@ -70,20 +82,36 @@ type Global struct {
 	// Metrics configuration
 	Metrics Metrics `yaml:"metrics"`
 
+	// Addresses to serve the external, internal and media APIs on
+	Listeners Listeners `yaml:"listeners"`
+
 	// Sentry configuration
 	Sentry Sentry `yaml:"sentry"`
 
 	// DNS caching options for all outbound HTTP requests
 	DNSCache DNSCacheOptions `yaml:"dns_cache"`
 
+	// The proxy for all outbound HTTP requests
+	OutboundProxy OutboundProxy `yaml:"outbound_proxy"`
+
+	// Database maintenance configuration
+	DatabaseMaintenance DatabaseMaintenance `yaml:"database_maintenance"`
+
 	// ServerNotices configuration used for sending server notices
 	ServerNotices ServerNotices `yaml:"server_notices"`
 
+	// Consent tracking configuration
+	UserConsentOptions UserConsentOptions `yaml:"user_consent"`
+
 	// ReportStats configures opt-in phone-home statistics reporting.
 	ReportStats ReportStats `yaml:"report_stats"`
 
 	// Configuration for the caches.
 	Cache Cache `yaml:"cache"`
+
+	// Spam checkers that can reject events, invites, room creation and media
+	// uploads by local users, and events and invites received over federation.
+	SpamChecker SpamChecker `yaml:"spam_checker"`
 }
 
 func (c *Global) Defaults(opts DefaultOpts) {
@@ -104,10 +132,13 @@ func (c *Global) Defaults(opts DefaultOpts) {
 	c.JetStream.Defaults(opts)
 	c.Metrics.Defaults(opts)
 	c.DNSCache.Defaults()
+	c.DatabaseMaintenance.Defaults()
 	c.Sentry.Defaults()
 	c.ServerNotices.Defaults(opts)
+	c.UserConsentOptions.Defaults()
 	c.ReportStats.Defaults()
 	c.Cache.Defaults()
+	c.SpamChecker.Defaults()
 }
 
 func (c *Global) Verify(configErrs *ConfigErrors) {
@@ -125,11 +156,16 @@ func (c *Global) Verify(configErrs *ConfigErrors) {
 
 	c.JetStream.Verify(configErrs)
 	c.Metrics.Verify(configErrs)
+	c.Listeners.Verify(configErrs)
 	c.Sentry.Verify(configErrs)
 	c.DNSCache.Verify(configErrs)
+	c.OutboundProxy.Verify(configErrs)
+	c.DatabaseMaintenance.Verify(configErrs)
 	c.ServerNotices.Verify(configErrs)
+	c.UserConsentOptions.Verify(configErrs)
 	c.ReportStats.Verify(configErrs)
 	c.Cache.Verify(configErrs)
+	c.SpamChecker.Verify(configErrs)
 }
 
 func (c *Global) IsLocalServerName(serverName spec.ServerName) bool {
@@ -280,6 +316,76 @@ func (c *Metrics) Defaults(opts DefaultOpts) {
 func (c *Metrics) Verify(configErrs *ConfigErrors) {
 }
 
+// Listeners defines the addresses the APIs are served on. The external APIs
+// (client, federation, media and static) are served on the external listeners,
+// or on the addresses given on the command line if there are none. The internal
+// APIs (the admin APIs and metrics) are served on the internal listener if one
+// is configured, otherwise alongside the external APIs. The media APIs are
+// served on the media listener instead of the external listeners if one is
+// configured.
+type Listeners struct {
+	External []Listener `yaml:"external"`
+	Internal Listener   `yaml:"internal"`
+	Media    Listener   `yaml:"media"`
+}
+
+func (c *Listeners) Verify(configErrs *ConfigErrors) {
+	for i := range c.External {
+		c.External[i].Verify(configErrs, fmt.Sprintf("global.listeners.external.%d", i))
+	}
+	c.Internal.Verify(configErrs, "global.listeners.internal")
+	c.Media.Verify(configErrs, "global.listeners.media")
+}
+
+// Listener is an address to serve HTTP on, optionally with TLS.
+type Listener struct {
+	// The address to listen on, e.g. "127.0.0.1:8009", or "unix:" followed by
+	// the path of a unix socket
+	Address string `yaml:"address"`
+	// The permissions of the unix socket, in chmod format
+	UnixSocketPermission string `yaml:"unix_socket_permission"`
+	// The PEM formatted X509 certificate and private key to use for TLS
+	TLSCert Path `yaml:"tls_cert"`
+	TLSKey  Path `yaml:"tls_key"`
+}
+
+func (c *Listener) Enabled() bool {
+	return c.Address != ""
+}
+
+// TLS returns whether the listener serves HTTPS.
+func (c *Listener) TLS() bool {
+	return c.TLSCert != "" && c.TLSKey != ""
+}
+
+// ServerAddress returns the address to listen on.
+func (c *Listener) ServerAddress() (ServerAddress, error) {
+	if path, ok := strings.CutPrefix(c.Address, "unix:"); ok {
+		perm := c.UnixSocketPermission
+		if perm == "" {
+			perm = "755"
+		}
+		return UnixSocketAddress(path, perm)
+	}
+	scheme := "http"
+	if c.TLS() {
+		scheme = "https"
+	}
+	return HTTPAddress(scheme + "://" + c.Address)
+}
+
+func (c *Listener) Verify(configErrs *ConfigErrors, key string) {
+	if !c.Enabled() {
+		return
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		configErrs.Add(fmt.Sprintf("config keys %q and %q must be set together", key+".tls_cert", key+".tls_key"))
+	}
+	if _, err := c.ServerAddress(); err != nil {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", key+".address", err))
+	}
+}
+
 // ServerNotices defines the configuration used for sending server notices
 type ServerNotices struct {
 	Enabled bool `yaml:"enabled"`
@@ -305,6 +411,103 @@ func (c *ServerNotices) Defaults(opts DefaultOpts) {
 
 func (c *ServerNotices) Verify(errors *ConfigErrors) {}
 
+// UserConsentOptions defines the configuration used for tracking whether users
+// have agreed to the terms of service / privacy policy of this server.
+type UserConsentOptions struct {
+	Enabled bool `yaml:"enabled"`
+	// The base URL this homeserver is reachable on, used to build the consent URL
+	BaseURL string `yaml:"base_url"`
+	// Randomly generated string used to calculate the HMAC for the consent URL
+	FormSecret string `yaml:"form_secret"`
+	// Require consent when a user registers for the first time
+	RequireAtRegistration bool `yaml:"require_at_registration"`
+	// The name of the policy, shown to the user at registration
+	PolicyName string `yaml:"policy_name"`
+	// The directory containing the policy documents. Each version of the
+	// policy is a HTML template named <version>.gohtml
+	TemplateDir Path `yaml:"template_dir"`
+	// The current version of the policy
+	Version string `yaml:"version"`
+	// The server notice to send to users who haven't agreed to the current
+	// version of the policy. {{ .ConsentURL }} is replaced with their consent URL.
+	ServerNoticeContent struct {
+		MsgType string `yaml:"msg_type"`
+		Body    string `yaml:"body"`
+	} `yaml:"server_notice_content"`
+	// The error to return when a user who hasn't agreed to the current version of
+	// the policy tries to send an event, join or create a room, invite someone or
+	// upload media. {{ .ConsentURL }} is replaced with their consent URL.
+	BlockEventsError string `yaml:"block_events_error"`
+
+	// The policy documents, loaded from TemplateDir
+	Templates *template.Template `yaml:"-"`
+	// The templates for the server notice and error messages
+	TextTemplates *textTemplate.Template `yaml:"-"`
+}
+
+func (c *UserConsentOptions) Defaults() {
+	c.Enabled = false
+	c.RequireAtRegistration = false
+	c.PolicyName = "Privacy Policy"
+	c.Version = "1.0"
+	c.TemplateDir = "./templates/privacy"
+}
+
+func (c *UserConsentOptions) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	checkNotEmpty(configErrs, "global.user_consent.base_url", c.BaseURL)
+	checkNotEmpty(configErrs, "global.user_consent.form_secret", c.FormSecret)
+	checkNotEmpty(configErrs, "global.user_consent.version", c.Version)
+	checkNotEmpty(configErrs, "global.user_consent.template_dir", string(c.TemplateDir))
+	if len(*configErrs) > 0 {
+		return
+	}
+
+	var err error
+	c.Templates, err = template.ParseGlob(filepath.Join(string(c.TemplateDir), "*.gohtml"))
+	if err != nil {
+		configErrs.Add(fmt.Sprintf("unable to load policy templates from %q: %s", c.TemplateDir, err))
+		return
+	}
+	if c.Templates.Lookup(c.Version+".gohtml") == nil {
+		configErrs.Add(fmt.Sprintf("policy template for version %q not found in %q", c.Version, c.TemplateDir))
+		return
+	}
+
+	c.TextTemplates = textTemplate.New("consent")
+	if _, err = c.TextTemplates.New("serverNoticeTemplate").Parse(c.ServerNoticeContent.Body); err != nil {
+		configErrs.Add(fmt.Sprintf("unable to parse global.user_consent.server_notice_content.body: %s", err))
+	}
+	if _, err = c.TextTemplates.New("blockEventsError").Parse(c.BlockEventsError); err != nil {
+		configErrs.Add(fmt.Sprintf("unable to parse global.user_consent.block_events_error: %s", err))
+	}
+}
+
+// PolicyURL returns the public URL of the current version of the policy.
+func (c *UserConsentOptions) PolicyURL() string {
+	return fmt.Sprintf("%s/_matrix/client/consent?v=%s", strings.TrimSuffix(c.BaseURL, "/"), url.QueryEscape(c.Version))
+}
+
+// ConsentURL returns the URL that the given user can visit to agree to the
+// current version of the policy.
+func (c *UserConsentOptions) ConsentURL(userID string) (string, error) {
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, []byte(c.FormSecret))
+	if _, err = mac.Write([]byte(userID)); err != nil {
+		return "", err
+	}
+	query := url.Values{}
+	query.Set("u", localpart)
+	query.Set("h", hex.EncodeToString(mac.Sum(nil)))
+	query.Set("v", c.Version)
+	return fmt.Sprintf("%s/_matrix/client/consent?%s", strings.TrimSuffix(c.BaseURL, "/"), query.Encode()), nil
+}
+
 type Cache struct {
 	EstimatedMaxSize DataUnit      `yaml:"max_size_estimated"`
 	MaxAge           time.Duration `yaml:"max_age"`
@@ -344,6 +547,54 @@ func (c *ReportStats) Verify(configErrs *ConfigErrors) {
 	}
 }
 
+// SpamChecker configures the spam checkers, which are asked before local users
+// send events, invite users, create rooms or upload media, and before events and
+// invites received over federation are accepted, and can reject them.
+type SpamChecker struct {
+	// Spam checker modules compiled into Dendrite, which are asked in order.
+	Modules []SpamCheckerModule `yaml:"modules"`
+
+	// An external spam checker, which is asked after the modules.
+	HTTP SpamCheckerHTTP `yaml:"http"`
+}
+
+// SpamCheckerModule configures a compiled-in spam checker module.
+type SpamCheckerModule struct {
+	// The name the module was registered with.
+	Name string `yaml:"name"`
+
+	// Options for the module, which are passed to it as they are.
+	Config map[string]interface{} `yaml:"config"`
+}
+
+// SpamCheckerHTTP configures an external spam checker, which is sent a POST
+// request for every check.
+type SpamCheckerHTTP struct {
+	// The URL to send checks to. The external spam checker is disabled if empty.
+	URL string `yaml:"url"`
+
+	// How long to wait for the external spam checker to answer.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (c *SpamChecker) Defaults() {
+	c.HTTP.Timeout = time.Second * 5
+}
+
+func (c *SpamChecker) Verify(configErrs *ConfigErrors) {
+	for _, module := range c.Modules {
+		checkNotEmpty(configErrs, "global.spam_checker.modules.name", module.Name)
+	}
+	if c.HTTP.URL != "" {
+		if u, err := url.Parse(c.HTTP.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			configErrs.Add(fmt.Sprintf("invalid URL for config key %q: %s", "global.spam_checker.http.url", c.HTTP.URL))
+		}
+		if c.HTTP.Timeout <= 0 {
+			configErrs.Add(fmt.Sprintf("invalid duration for config key %q: %s", "global.spam_checker.http.timeout", c.HTTP.Timeout))
+		}
+	}
+}
+
 // The configuration to use for Sentry error reporting
 type Sentry struct {
 	Enabled bool `yaml:"enabled"`
@@ -416,6 +667,81 @@ func (c *DNSCacheOptions) Verify(configErrs *ConfigErrors) {
 	checkPositive(configErrs, "cache_lifetime", int64(c.CacheLifetime))
 }
 
+// OutboundProxy configures the proxy for outbound HTTP requests, such as
+// federation, remote media, push gateways and identity servers. If it is empty
+// the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables are honoured.
+type OutboundProxy struct {
+	// The proxy for plain HTTP requests
+	HTTPProxy string `yaml:"http_proxy"`
+	// The proxy for HTTPS requests, which includes all federation requests
+	HTTPSProxy string `yaml:"https_proxy"`
+	// Comma separated hosts, domains and IP ranges that are not proxied
+	NoProxy string `yaml:"no_proxy"`
+}
+
+// Enabled returns whether a proxy is configured, rather than taken from the environment.
+func (c *OutboundProxy) Enabled() bool {
+	return c.HTTPProxy != "" || c.HTTPSProxy != ""
+}
+
+// Environment returns the environment variables that configure the proxy, for
+// http.ProxyFromEnvironment.
+func (c *OutboundProxy) Environment() map[string]string {
+	return map[string]string{
+		"HTTP_PROXY":  c.HTTPProxy,
+		"HTTPS_PROXY": c.HTTPSProxy,
+		"NO_PROXY":    c.NoProxy,
+	}
+}
+
+func (c *OutboundProxy) Verify(configErrs *ConfigErrors) {
+	for _, proxy := range []struct{ key, url string }{
+		{"global.outbound_proxy.http_proxy", c.HTTPProxy},
+		{"global.outbound_proxy.https_proxy", c.HTTPSProxy},
+	} {
+		if proxy.url == "" {
+			continue
+		}
+		if u, err := url.Parse(proxy.url); err != nil || u.Host == "" {
+			configErrs.Add(fmt.Sprintf("invalid URL for config key %q: %s", proxy.key, proxy.url))
+		}
+	}
+}
+
+type DatabaseMaintenance struct {
+	// How often to run VACUUM and ANALYZE on PostgreSQL databases, or an
+	// incremental vacuum and ANALYZE on SQLite databases. 0 disables the
+	// scheduled maintenance.
+	Interval time.Duration `yaml:"interval"`
+	// The maximum number of free pages to reclaim from a SQLite database in
+	// each incremental vacuum, 0 reclaims all of them.
+	SQLiteIncrementalVacuumPages int `yaml:"sqlite_incremental_vacuum_pages"`
+	// How often to check the size of the tables against the thresholds.
+	SizeCheckInterval time.Duration `yaml:"size_check_interval"`
+	// Warn when a table grows beyond the given size, by table name.
+	TableSizeWarnings map[string]FileSizeBytes `yaml:"table_size_warnings"`
+}
+
+func (c *DatabaseMaintenance) Defaults() {
+	c.Interval = time.Hour * 24
+	c.SQLiteIncrementalVacuumPages = 0
+	c.SizeCheckInterval = time.Hour
+	c.TableSizeWarnings = map[string]FileSizeBytes{
+		"syncapi_send_to_device":     1 << 30,
+		"roomserver_state_block":     10 << 30,
+		"roomserver_state_snapshots": 10 << 30,
+	}
+}
+
+func (c *DatabaseMaintenance) Verify(configErrs *ConfigErrors) {
+	checkPositive(configErrs, "global.database_maintenance.interval", int64(c.Interval))
+	checkPositive(configErrs, "global.database_maintenance.sqlite_incremental_vacuum_pages", int64(c.SQLiteIncrementalVacuumPages))
+	checkPositive(configErrs, "global.database_maintenance.size_check_interval", int64(c.SizeCheckInterval))
+	for table, size := range c.TableSizeWarnings {
+		checkPositive(configErrs, fmt.Sprintf("global.database_maintenance.table_size_warnings.%s", table), int64(size))
+	}
+}
+
 // PresenceOptions defines possible configurations for presence events.
 type PresenceOptions struct {
 	// Whether inbound presence events are allowed
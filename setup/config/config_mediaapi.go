@@ -1,7 +1,19 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"math"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
 )
 
 type MediaAPI struct {
@@ -17,11 +29,31 @@ type MediaAPI struct {
 	// The absolute base path to where media files will be stored.
 	AbsBasePath Path `yaml:"-"`
 
+	// Whether to refuse to start if base_path is a symbolic link, or is in a
+	// directory that is one. Symbolic links within base_path are never followed
+	// outside of it.
+	RejectSymlinkedBasePath bool `yaml:"reject_symlinked_base_path"`
+
+	// The path to where media files are written while they are being uploaded or
+	// downloaded, before they are moved into base_path. May be relative or absolute,
+	// and may be on a different filesystem than base_path, e.g. a tmpfs.
+	// Note: if temp_path is not set, the tmp directory in base_path is used.
+	TempPath Path `yaml:"temp_path,omitempty"`
+
+	// The absolute path to where media files are written before they are stored,
+	// if temp_path is set.
+	AbsTempPath Path `yaml:"-"`
+
 	// The maximum file size in bytes that is allowed to be stored on this server.
 	// Note: if max_file_size_bytes is set to 0, the size is unlimited.
 	// Note: if max_file_size_bytes is not set, it will default to 10485760 (10MB)
 	MaxFileSizeBytes FileSizeBytes `yaml:"max_file_size_bytes,omitempty"`
 
+	// The maximum total size in bytes of media that each local user may upload. Admins
+	// can override this for individual users with the admin API.
+	// Note: if upload_quota_bytes is 0 or not set, the total size is unlimited.
+	UploadQuotaBytes FileSizeBytes `yaml:"upload_quota_bytes,omitempty"`
+
 	// Whether to dynamically generate thumbnails on-the-fly if the requested resolution is not already generated
 	DynamicThumbnails bool `yaml:"dynamic_thumbnails"`
 
@@ -30,6 +62,666 @@ type MediaAPI struct {
 
 	// A list of thumbnail sizes to be pre-generated for downloaded remote / uploaded content
 	ThumbnailSizes []ThumbnailSize `yaml:"thumbnail_sizes"`
+
+	// How a thumbnail is chosen for a requested size that hasn't been generated,
+	// either "closest" or "at_least". default: closest
+	ThumbnailSelection string `yaml:"thumbnail_selection"`
+
+	// Responding to requests for thumbnails that are being generated without waiting for them.
+	DeferredThumbnails MediaDeferredThumbnails `yaml:"deferred_thumbnails"`
+
+	// The maximum total size in bytes of media cached from remote servers. When it is
+	// exceeded, the least recently accessed remote media is evicted. Media uploaded
+	// to this server is never evicted.
+	// Note: if max_remote_cache_size_bytes is 0 or not set, the cache size is unlimited.
+	MaxRemoteCacheSizeBytes FileSizeBytes `yaml:"max_remote_cache_size_bytes,omitempty"`
+
+	// How long media fetched from remote servers is cached for. Expired media is purged
+	// by a background janitor, and fetched again from the remote server when requested.
+	// Note: if remote_media_max_age is 0 or not set, remote media never expires.
+	RemoteMediaMaxAge time.Duration `yaml:"remote_media_max_age,omitempty"`
+
+	// How often the janitor looks for expired remote media. default: 1h
+	RemoteMediaJanitorInterval time.Duration `yaml:"remote_media_janitor_interval,omitempty"`
+
+	// Policies for deleting old media, applied periodically in the background.
+	Retention MediaRetention `yaml:"retention"`
+
+	// SHA-256 hashes of files that may never be uploaded or downloaded, either hex
+	// or unpadded URL-safe base64 encoded. Admins can block more hashes with the admin API.
+	BlockedHashes []string `yaml:"blocked_hashes,omitempty"`
+
+	// Servers whose media may never be fetched or downloaded, e.g. known sources
+	// of abuse. Admins can block more servers with the admin API.
+	BlockedOrigins []spec.ServerName `yaml:"blocked_origins,omitempty"`
+
+	// Hashes to compute for files in addition to SHA-256, e.g. to look files up
+	// in external deduplication systems. See SecondaryHashAlgorithms.
+	SecondaryHashes []string `yaml:"secondary_hashes,omitempty"`
+
+	// Scanning media for malware at the request of clients.
+	ContentScanner MediaContentScanner `yaml:"content_scanner"`
+
+	// How media files are sharded into directories in base_path.
+	StoreLayout MediaStoreLayout `yaml:"store_layout"`
+
+	// Encrypting media files before they are written to disk.
+	Encryption MediaEncryption `yaml:"encryption"`
+
+	// Compressing media files of compressible content types before they are written to disk.
+	Compression MediaCompression `yaml:"compression"`
+
+	// Whether to fsync media files, and the directories they are moved into, before
+	// uploads and downloads complete, so that stored media can't be lost or truncated
+	// by a crash. This makes storing media slower.
+	Fsync bool `yaml:"fsync"`
+
+	// How the IDs of uploaded media are generated.
+	MediaIDs MediaIDGeneration `yaml:"media_ids"`
+
+	// Replicas of the media store to read media from when it fails.
+	Replicas MediaReplicas `yaml:"replicas"`
+
+	// Token bucket rate limits for uploads and downloads, on top of the client
+	// API rate limits.
+	RateLimiting MediaRateLimiting `yaml:"rate_limiting"`
+
+	// Checks of the free space on the filesystem of the media store.
+	DiskSpace MediaDiskSpace `yaml:"disk_space"`
+
+	// Limits on how many CPU-heavy media operations run at once.
+	Workers MediaWorkers `yaml:"workers"`
+
+	// An in-memory cache of media metadata, to save looking it up in the database
+	// on every download.
+	MetadataCache MediaMetadataCache `yaml:"metadata_cache"`
+
+	// An in-memory cache of the content of small files, e.g. avatars, to save
+	// reading them from the media store on every download.
+	FileCache MediaFileCache `yaml:"file_cache"`
+
+	// The admin endpoint that fetches a URL and stores it as local media.
+	UploadFromURL MediaUploadFromURL `yaml:"upload_from_url"`
+
+	// How uploads and downloads are drained when Dendrite shuts down.
+	Shutdown MediaShutdown `yaml:"shutdown"`
+
+	// How media is fetched from other servers.
+	Federation MediaFederation `yaml:"federation"`
+
+	// Recording who uploaded, downloaded, deleted or quarantined which media.
+	AuditLog MediaAuditLog `yaml:"audit_log"`
+}
+
+// MediaShutdown configures how Dendrite shuts down the media API. New uploads
+// are refused, and uploads and downloads in progress are given a grace period
+// to finish before they are aborted.
+type MediaShutdown struct {
+	// How long uploads and downloads in progress may take to finish, or 0 to
+	// abort them straight away.
+	GracePeriod time.Duration `yaml:"grace_period"`
+}
+
+func (c *MediaShutdown) Verify(configErrs *ConfigErrors) {
+	if c.GracePeriod < 0 {
+		configErrs.Add(fmt.Sprintf("invalid duration for config key %q: %s", "media_api.shutdown.grace_period", c.GracePeriod))
+	}
+}
+
+// MediaIDCharacters are the characters media IDs may be made of.
+const MediaIDCharacters = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789_-="
+
+// The media IDs generated by default are 64 hex characters, 256 bits.
+const (
+	DefaultMediaIDLength   = 64
+	DefaultMediaIDAlphabet = "0123456789abcdef"
+)
+
+// minMediaIDEntropyBits is how many bits of randomness generated media IDs must
+// have at least, so that they can't be guessed.
+const minMediaIDEntropyBits = 64
+
+// MediaIDGeneration configures how the IDs of uploaded media are generated.
+// Media IDs are made of characters picked from the alphabet at random.
+type MediaIDGeneration struct {
+	// How many characters media IDs have. default: 64
+	Length int `yaml:"length"`
+
+	// The characters media IDs are made of, from A-Z, a-z, 0-9, "_", "-" and
+	// "=". default: 0123456789abcdef
+	Alphabet string `yaml:"alphabet"`
+}
+
+func (c *MediaIDGeneration) Verify(configErrs *ConfigErrors) {
+	if c.Length <= 0 || c.Length > 255 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d, must be between 1 and 255", "media_api.media_ids.length", c.Length))
+	}
+	seen := map[rune]bool{}
+	for _, r := range c.Alphabet {
+		if !strings.ContainsRune(MediaIDCharacters, r) || seen[r] {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %q, must be distinct characters from %s", "media_api.media_ids.alphabet", c.Alphabet, MediaIDCharacters))
+			return
+		}
+		seen[r] = true
+	}
+	if len(c.Alphabet) < 2 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %q, must have at least 2 characters", "media_api.media_ids.alphabet", c.Alphabet))
+		return
+	}
+	if bits := float64(c.Length) * math.Log2(float64(len(c.Alphabet))); bits < minMediaIDEntropyBits {
+		configErrs.Add(fmt.Sprintf(
+			"media IDs of %d characters from %q are too easy to guess, they must have at least %d bits of randomness",
+			c.Length, c.Alphabet, minMediaIDEntropyBits,
+		))
+	}
+}
+
+// MediaAuditLog configures the audit log of media, which records who uploaded,
+// downloaded, deleted or quarantined which media and when, in the database.
+type MediaAuditLog struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Whether to record downloads and thumbnails as well, which are far more
+	// frequent than the other actions. default: true
+	Downloads bool `yaml:"downloads"`
+
+	// Don't record the IP addresses actions were taken from.
+	RedactIPAddresses bool `yaml:"redact_ip_addresses"`
+
+	// How long entries are kept before their users and IP addresses are removed,
+	// or 0 to keep them for as long as the entries.
+	RedactAfter time.Duration `yaml:"redact_after"`
+
+	// How long entries are kept, or 0 to keep them forever. default: 2160h (90 days)
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+func (c *MediaAuditLog) Verify(configErrs *ConfigErrors) {
+	if c.RedactAfter < 0 {
+		configErrs.Add(fmt.Sprintf("invalid duration for config key %q: %s", "media_api.audit_log.redact_after", c.RedactAfter))
+	}
+	if c.MaxAge < 0 {
+		configErrs.Add(fmt.Sprintf("invalid duration for config key %q: %s", "media_api.audit_log.max_age", c.MaxAge))
+	}
+}
+
+// MediaFederation configures how media is fetched from other servers.
+type MediaFederation struct {
+	// Fetch media with requests signed by this server, from the authenticated
+	// federation media endpoint. default: true
+	Authenticated bool `yaml:"authenticated"`
+
+	// Fetch media from the unauthenticated endpoint instead, from servers that
+	// don't support the authenticated one. default: true
+	UnauthenticatedFallback bool `yaml:"unauthenticated_fallback"`
+}
+
+// MediaUploadFromURL configures the admin endpoint that fetches a URL and stores
+// it as local media. URLs are never fetched from loopback, private, link-local
+// or other special addresses unless they are in one of the allowed networks, so
+// that the endpoint can't be used to reach internal services.
+type MediaUploadFromURL struct {
+	// How long fetching a URL may take.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Networks in CIDR notation that URLs may be fetched from even though their
+	// addresses are special, e.g. an internal server that media is migrated from.
+	AllowedNetworks []string `yaml:"allowed_networks,omitempty"`
+}
+
+func (c *MediaUploadFromURL) Verify(configErrs *ConfigErrors) {
+	if c.Timeout <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid duration for config key %q: %s", "media_api.upload_from_url.timeout", c.Timeout))
+	}
+	for i, network := range c.AllowedNetworks {
+		if _, _, err := net.ParseCIDR(network); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", fmt.Sprintf("media_api.upload_from_url.allowed_networks[%d]", i), network))
+		}
+	}
+}
+
+// MediaFileCache configures caching the content of small files in memory,
+// evicting the least recently used files once the cache is full.
+type MediaFileCache struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Files larger than this aren't cached.
+	MaxFileSizeBytes FileSizeBytes `yaml:"max_file_size_bytes"`
+
+	// The most memory the cached files may take up in total.
+	MaxSizeBytes FileSizeBytes `yaml:"max_size_bytes"`
+}
+
+func (c *MediaFileCache) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	if c.MaxFileSizeBytes <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "media_api.file_cache.max_file_size_bytes", c.MaxFileSizeBytes))
+	}
+	if c.MaxSizeBytes < c.MaxFileSizeBytes {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d (must be at least max_file_size_bytes)", "media_api.file_cache.max_size_bytes", c.MaxSizeBytes))
+	}
+}
+
+// MediaMetadataCache configures caching the metadata of media in memory, by
+// origin and media ID. Entries are invalidated when the media is stored again,
+// deleted or quarantined by this server, but not by other processes sharing the
+// database, e.g. the media CLI tools, so max_age bounds how stale they can get.
+type MediaMetadataCache struct {
+	Enabled bool `yaml:"enabled"`
+
+	// How many entries to keep, evicting the least recently used.
+	MaxEntries int `yaml:"max_entries"`
+
+	// How long an entry is kept for.
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+func (c *MediaMetadataCache) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	if c.MaxEntries <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "media_api.metadata_cache.max_entries", c.MaxEntries))
+	}
+	if c.MaxAge <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid duration for config key %q: %s", "media_api.metadata_cache.max_age", c.MaxAge))
+	}
+}
+
+// MediaWorkers limits how many CPU-heavy media operations, i.e. generating
+// thumbnails and compressing files, run at once. The others wait in a queue.
+type MediaWorkers struct {
+	// How many operations may run at once, or 0 for one per CPU.
+	Concurrency int `yaml:"concurrency"`
+
+	// How long an operation may wait for a worker before it is given up on, in
+	// which case the thumbnail isn't generated or the file isn't compressed.
+	QueueTimeout time.Duration `yaml:"queue_timeout"`
+}
+
+func (c *MediaWorkers) Verify(configErrs *ConfigErrors) {
+	checkPositive(configErrs, "media_api.workers.concurrency", int64(c.Concurrency))
+	if c.QueueTimeout <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid duration for config key %q: %s", "media_api.workers.queue_timeout", c.QueueTimeout))
+	}
+}
+
+// MediaDiskSpace configures checking the free space on the filesystem of the
+// media store, so that it doesn't fill up.
+type MediaDiskSpace struct {
+	// Uploads are refused while there is less free space than this, or 0 to
+	// never refuse them.
+	MinFreeBytes FileSizeBytes `yaml:"min_free_bytes,omitempty"`
+
+	// A warning is logged once there is less free space than this, or 0 to
+	// not warn.
+	WarnFreeBytes FileSizeBytes `yaml:"warn_free_bytes,omitempty"`
+
+	// How often to check the free space.
+	CheckInterval time.Duration `yaml:"check_interval,omitempty"`
+}
+
+func (c *MediaDiskSpace) Verify(configErrs *ConfigErrors) {
+	checkPositive(configErrs, "media_api.disk_space.min_free_bytes", int64(c.MinFreeBytes))
+	checkPositive(configErrs, "media_api.disk_space.warn_free_bytes", int64(c.WarnFreeBytes))
+	if c.CheckInterval <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid duration for config key %q: %s", "media_api.disk_space.check_interval", c.CheckInterval))
+	}
+}
+
+// MediaRateLimiting configures token bucket rate limits for uploads, keyed by
+// user, and downloads and thumbnails, keyed by IP address. Server admins,
+// application services and the exempt users aren't limited.
+type MediaRateLimiting struct {
+	Enabled bool `yaml:"enabled"`
+
+	Uploads   MediaRateLimit `yaml:"uploads"`
+	Downloads MediaRateLimit `yaml:"downloads"`
+
+	// Users that are exempt from the limits, i.e. bots.
+	ExemptUserIDs []string `yaml:"exempt_user_ids,omitempty"`
+}
+
+// MediaRateLimit is the size and refill rate of a token bucket. Each request
+// takes a token from the bucket of its user or IP address, and is refused if
+// the bucket is empty.
+type MediaRateLimit struct {
+	// How many requests can be made in a burst, i.e. the size of the bucket.
+	Burst int `yaml:"burst"`
+
+	// How many tokens are added to the bucket per second.
+	PerSecond float64 `yaml:"per_second"`
+}
+
+func (c *MediaRateLimiting) Defaults() {
+	c.Uploads = MediaRateLimit{Burst: 10, PerSecond: 1}
+	c.Downloads = MediaRateLimit{Burst: 200, PerSecond: 20}
+}
+
+func (c *MediaRateLimiting) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	c.Uploads.Verify(configErrs, "media_api.rate_limiting.uploads")
+	c.Downloads.Verify(configErrs, "media_api.rate_limiting.downloads")
+}
+
+func (c *MediaRateLimit) Verify(configErrs *ConfigErrors, key string) {
+	if c.Burst <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", key+".burst", c.Burst))
+	}
+	if c.PerSecond <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %v", key+".per_second", c.PerSecond))
+	}
+}
+
+// MediaReplicas configures directories mirroring base_path, e.g. kept up to date
+// by replicated storage, to read media from when base_path is unhealthy or fails
+// to read a file, so that a flaky network mount doesn't stop media downloads.
+// Media is only ever written to base_path.
+type MediaReplicas struct {
+	// The directories, in the order they are tried in.
+	Paths []Path `yaml:"paths,omitempty"`
+
+	// The absolute paths of the directories.
+	AbsPaths []Path `yaml:"-"`
+
+	// How often to check whether base_path and each replica can be read.
+	HealthCheckInterval time.Duration `yaml:"health_check_interval,omitempty"`
+}
+
+func (c *MediaReplicas) Verify(configErrs *ConfigErrors) {
+	for i, path := range c.Paths {
+		checkNotEmpty(configErrs, fmt.Sprintf("media_api.replicas.paths[%d]", i), string(path))
+	}
+	if len(c.Paths) > 0 && c.HealthCheckInterval <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid duration for config key %q: %s", "media_api.replicas.health_check_interval", c.HealthCheckInterval))
+	}
+}
+
+// The content codings media files can be compressed with.
+const (
+	MediaCompressionZstd = "zstd"
+	MediaCompressionGzip = "gzip"
+)
+
+// MediaCompression configures compressing media files at rest. Files are
+// decompressed when they are downloaded, unless the client accepts their
+// content coding, in which case they are sent as they are stored.
+type MediaCompression struct {
+	// The content coding to compress new files with, "zstd" or "gzip", or empty
+	// to not compress files. Files that were compressed before are still
+	// decompressed when this is disabled.
+	Algorithm string `yaml:"algorithm"`
+
+	// The content types of the files to compress. A content type may end with
+	// "*" to match any subtype, e.g. "text/*".
+	ContentTypes []string `yaml:"content_types"`
+}
+
+func (c *MediaCompression) Defaults() {
+	c.ContentTypes = []string{
+		"text/*",
+		"application/json",
+		"application/xml",
+		"application/javascript",
+		"image/svg+xml",
+	}
+}
+
+func (c *MediaCompression) Verify(configErrs *ConfigErrors) {
+	switch c.Algorithm {
+	case "", MediaCompressionZstd, MediaCompressionGzip:
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "media_api.compression.algorithm", c.Algorithm))
+	}
+}
+
+// MediaEncryption configures encrypting media files at rest. Each file is
+// encrypted with its own key, which is stored with the file wrapped by the
+// master key. Files are still hashed before they are encrypted, so media are
+// deduplicated as before.
+type MediaEncryption struct {
+	// Whether new files are encrypted. Files that were encrypted before are still
+	// decrypted when this is disabled, as long as the master key is configured.
+	Enabled bool `yaml:"enabled"`
+
+	// The path to a file holding the 32 byte master key, either raw or base64 encoded.
+	MasterKeyPath Path `yaml:"master_key_path,omitempty"`
+
+	// A command that prints the base64 encoded master key, e.g. to fetch it from a
+	// key management service, as an alternative to master_key_path.
+	MasterKeyCommand []string `yaml:"master_key_command,omitempty"`
+
+	// The master key, loaded from master_key_path or master_key_command.
+	MasterKey []byte `yaml:"-"`
+}
+
+// MediaMasterKeySize is the size of the master key for media encryption.
+const MediaMasterKeySize = 32
+
+func (c *MediaEncryption) Verify(configErrs *ConfigErrors) {
+	if c.MasterKeyPath != "" && len(c.MasterKeyCommand) > 0 {
+		configErrs.Add(fmt.Sprintf("only one of config keys %q and %q may be set", "media_api.encryption.master_key_path", "media_api.encryption.master_key_command"))
+	}
+	if c.Enabled && c.MasterKeyPath == "" && len(c.MasterKeyCommand) == 0 {
+		configErrs.Add(fmt.Sprintf("missing config key %q", "media_api.encryption.master_key_path"))
+	}
+}
+
+// loadMasterKey loads the master key from the configured file or command.
+func (c *MediaEncryption) loadMasterKey(basePath string, readFile func(string) ([]byte, error)) error {
+	var data []byte
+	var err error
+	switch {
+	case c.MasterKeyPath != "":
+		if data, err = readFile(absPath(basePath, c.MasterKeyPath)); err != nil {
+			return err
+		}
+	case len(c.MasterKeyCommand) > 0:
+		cmd := exec.Command(c.MasterKeyCommand[0], c.MasterKeyCommand[1:]...)
+		cmd.Stderr = os.Stderr
+		if data, err = cmd.Output(); err != nil {
+			return fmt.Errorf("%s: %w", c.MasterKeyCommand[0], err)
+		}
+	default:
+		return nil
+	}
+	if len(data) == MediaMasterKeySize {
+		c.MasterKey = data
+		return nil
+	}
+	encoded := strings.TrimRight(strings.TrimSpace(string(data)), "=")
+	key, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil {
+		key, err = base64.RawURLEncoding.DecodeString(encoded)
+	}
+	if err != nil || len(key) != MediaMasterKeySize {
+		return fmt.Errorf("the master key must be %d bytes, either raw or base64 encoded", MediaMasterKeySize)
+	}
+	c.MasterKey = key
+	return nil
+}
+
+// MediaDeferredThumbnails configures what happens when a thumbnail is requested
+// while it is being generated. By default, the request waits until it has been
+// generated.
+type MediaDeferredThumbnails struct {
+	// Whether to respond straight away, with a 503 and a Retry-After header or
+	// with the placeholder image.
+	Enabled bool `yaml:"enabled"`
+
+	// How long clients are asked to wait before retrying. default: 2s
+	RetryAfter time.Duration `yaml:"retry_after,omitempty"`
+
+	// The path of an image to respond with instead of a 503, e.g. a blurred or
+	// generic image. Its content type is detected from its content.
+	PlaceholderPath Path `yaml:"placeholder_path,omitempty"`
+
+	// The placeholder image, loaded from placeholder_path.
+	Placeholder []byte `yaml:"-"`
+}
+
+// loadPlaceholder loads the placeholder image from the configured file.
+func (c *MediaDeferredThumbnails) loadPlaceholder(basePath string, readFile func(string) ([]byte, error)) error {
+	if !c.Enabled || c.PlaceholderPath == "" {
+		return nil
+	}
+	data, err := readFile(absPath(basePath, c.PlaceholderPath))
+	if err != nil {
+		return err
+	}
+	c.Placeholder = data
+	return nil
+}
+
+// MediaStoreLayout is how media files are sharded into directories in the
+// media store by the first characters of their hash, e.g. with two levels of
+// two characters, the file with hash "qwerty" is stored in "qw/er/ty/file".
+type MediaStoreLayout struct {
+	// The version of the layout. Version 1 is the original layout of two levels
+	// of one character, version 2 uses the depth and width below. Files stored
+	// under the version 1 layout are still found after switching to version 2.
+	Version int `yaml:"version"`
+
+	// The number of levels of directories in version 2.
+	Depth int `yaml:"depth"`
+
+	// The number of characters of the hash used for each level in version 2.
+	Width int `yaml:"width"`
+}
+
+// LegacyMediaStoreLayout is the version 1 layout, which files may still be stored under.
+var LegacyMediaStoreLayout = MediaStoreLayout{Version: 1}
+
+// Levels returns the depth and width of the layout.
+func (l MediaStoreLayout) Levels() (depth, width int) {
+	if l.Version != 2 {
+		return 2, 1
+	}
+	return l.Depth, l.Width
+}
+
+// IsLegacy returns true if files are stored as in the version 1 layout.
+func (l MediaStoreLayout) IsLegacy() bool {
+	depth, width := l.Levels()
+	return depth == 2 && width == 1
+}
+
+func (l *MediaStoreLayout) Verify(configErrs *ConfigErrors) {
+	switch l.Version {
+	case 0, 1:
+	case 2:
+		if l.Depth < 1 || l.Depth > 4 {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d (must be between 1 and 4)", "media_api.store_layout.depth", l.Depth))
+		}
+		// Wider levels could clash with the tmp directory in base_path.
+		if l.Width < 1 || l.Width > 2 {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d (must be 1 or 2)", "media_api.store_layout.width", l.Width))
+		}
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d (must be 1 or 2)", "media_api.store_layout.version", l.Version))
+	}
+}
+
+// MediaContentScanner configures the content scanner API, which lets clients ask
+// for media to be scanned before downloading it, including encrypted attachments
+// which they provide the key for.
+type MediaContentScanner struct {
+	// Whether to serve the content scanner API at /_matrix/media_proxy/unstable.
+	Enabled bool `yaml:"enabled"`
+
+	// The command that scans a file, which is given the path of the file as its last
+	// argument. An exit status of 0 means the file is clean, 1 means that it isn't and
+	// anything else that the scan failed.
+	Command []string `yaml:"command,omitempty"`
+
+	// How long a scan may take before it is considered failed. default: 1m
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// MediaRetention configures how long media is kept before it is deleted.
+type MediaRetention struct {
+	// The policy for media uploaded to this server.
+	Local MediaRetentionPolicy `yaml:"local"`
+
+	// The policy for media fetched from other servers.
+	Remote MediaRetentionPolicy `yaml:"remote"`
+
+	// How often the retention policies are applied. default: 24h
+	Interval time.Duration `yaml:"interval,omitempty"`
+
+	// Only log the media that would be deleted, without deleting anything.
+	DryRun bool `yaml:"dry_run"`
+}
+
+// Enabled returns true if any media would ever be deleted by the policies.
+func (c *MediaRetention) Enabled() bool {
+	return c.Local.enabled() || c.Remote.enabled()
+}
+
+// MediaRetentionPolicy deletes media older than a maximum age.
+type MediaRetentionPolicy struct {
+	// How long media is kept for. 0 keeps media forever.
+	MaxAge time.Duration `yaml:"max_age,omitempty"`
+
+	// Maximum ages for specific content types, overriding max_age. The first
+	// matching entry applies.
+	ContentTypes []ContentTypeRetention `yaml:"content_types,omitempty"`
+}
+
+// ContentTypeRetention sets the maximum age of media with a content type.
+type ContentTypeRetention struct {
+	// A content type like "image/png", or "image/*" for all images.
+	ContentType string `yaml:"content_type"`
+
+	// How long media of this type is kept for. 0 keeps it forever.
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+// MaxAgeFor returns the maximum age of media with the content type, 0 if it
+// should be kept forever.
+func (c *MediaRetentionPolicy) MaxAgeFor(contentType string) time.Duration {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	for _, rule := range c.ContentTypes {
+		pattern := strings.ToLower(rule.ContentType)
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return rule.MaxAge
+			}
+		} else if mediaType == pattern {
+			return rule.MaxAge
+		}
+	}
+	return c.MaxAge
+}
+
+// MinMaxAge returns the shortest maximum age of any media under the policy, 0
+// if all media is kept forever.
+func (c *MediaRetentionPolicy) MinMaxAge() time.Duration {
+	minAge := c.MaxAge
+	for _, rule := range c.ContentTypes {
+		if rule.MaxAge > 0 && (minAge == 0 || rule.MaxAge < minAge) {
+			minAge = rule.MaxAge
+		}
+	}
+	return minAge
+}
+
+func (c *MediaRetentionPolicy) enabled() bool {
+	return c.MinMaxAge() > 0
+}
+
+func (c *MediaRetentionPolicy) Verify(configErrs *ConfigErrors, key string) {
+	checkPositive(configErrs, key+".max_age", int64(c.MaxAge))
+	for i, rule := range c.ContentTypes {
+		ruleKey := fmt.Sprintf("%s.content_types[%d]", key, i)
+		checkNotEmpty(configErrs, ruleKey+".content_type", rule.ContentType)
+		checkPositive(configErrs, ruleKey+".max_age", int64(rule.MaxAge))
+	}
 }
 
 // DefaultMaxFileSizeBytes defines the default file size allowed in transfers
@@ -38,6 +730,29 @@ var DefaultMaxFileSizeBytes = FileSizeBytes(10485760)
 func (c *MediaAPI) Defaults(opts DefaultOpts) {
 	c.MaxFileSizeBytes = DefaultMaxFileSizeBytes
 	c.MaxThumbnailGenerators = 10
+	c.DeferredThumbnails.RetryAfter = time.Second * 2
+	c.RemoteMediaJanitorInterval = time.Hour
+	c.Retention.Interval = time.Hour * 24
+	c.ContentScanner.Timeout = time.Minute
+	c.StoreLayout = MediaStoreLayout{Version: 1, Depth: 2, Width: 2}
+	c.Compression.Defaults()
+	c.Replicas.HealthCheckInterval = time.Second * 30
+	c.RateLimiting.Defaults()
+	c.DiskSpace.CheckInterval = time.Minute
+	c.Workers.QueueTimeout = time.Second * 30
+	c.MetadataCache.MaxEntries = 10000
+	c.MetadataCache.MaxAge = time.Minute * 5
+	c.FileCache.MaxFileSizeBytes = 256 * 1024
+	c.FileCache.MaxSizeBytes = 64 * 1024 * 1024
+	c.UploadFromURL.Timeout = time.Minute
+	c.Shutdown.GracePeriod = time.Second * 30
+	c.Federation.Authenticated = true
+	c.Federation.UnauthenticatedFallback = true
+	c.AuditLog.Downloads = true
+	c.AuditLog.MaxAge = time.Hour * 24 * 90
+	c.MediaIDs.Length = DefaultMediaIDLength
+	c.MediaIDs.Alphabet = DefaultMediaIDAlphabet
+	c.ThumbnailSelection = ThumbnailSelectionClosest
 	if opts.Generate {
 		c.ThumbnailSizes = []ThumbnailSize{
 			{
@@ -63,17 +778,148 @@ func (c *MediaAPI) Defaults(opts DefaultOpts) {
 	}
 }
 
+// defaultThumbnailSizes fills in the resize method of the configured thumbnail
+// sizes that don't have one. Thumbnails are scaled unless cropping is asked
+// for, as in thumbnail requests.
+func (c *MediaAPI) defaultThumbnailSizes() {
+	for i := range c.ThumbnailSizes {
+		if c.ThumbnailSizes[i].ResizeMethod == "" {
+			c.ThumbnailSizes[i].ResizeMethod = "scale"
+		}
+	}
+}
+
+// TempDir returns the absolute path of the directory that media files are
+// written to before they are moved into the media store.
+func (c *MediaAPI) TempDir() Path {
+	if c.AbsTempPath != "" {
+		return c.AbsTempPath
+	}
+	return Path(filepath.Join(string(c.AbsBasePath), "tmp"))
+}
+
 func (c *MediaAPI) Verify(configErrs *ConfigErrors) {
 	checkNotEmpty(configErrs, "media_api.base_path", string(c.BasePath))
 	checkPositive(configErrs, "media_api.max_file_size_bytes", int64(c.MaxFileSizeBytes))
+	checkPositive(configErrs, "media_api.upload_quota_bytes", int64(c.UploadQuotaBytes))
 	checkPositive(configErrs, "media_api.max_thumbnail_generators", int64(c.MaxThumbnailGenerators))
+	checkPositive(configErrs, "media_api.max_remote_cache_size_bytes", int64(c.MaxRemoteCacheSizeBytes))
+	checkPositive(configErrs, "media_api.remote_media_max_age", int64(c.RemoteMediaMaxAge))
+	if (c.RemoteMediaMaxAge > 0 || c.MaxRemoteCacheSizeBytes > 0) && c.RemoteMediaJanitorInterval <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid duration for config key %q: %s", "media_api.remote_media_janitor_interval", c.RemoteMediaJanitorInterval))
+	}
+
+	c.Retention.Local.Verify(configErrs, "media_api.retention.local")
+	c.Retention.Remote.Verify(configErrs, "media_api.retention.remote")
+	if c.Retention.Enabled() && c.Retention.Interval <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid duration for config key %q: %s", "media_api.retention.interval", c.Retention.Interval))
+	}
+
+	for i, hash := range c.BlockedHashes {
+		if !isSHA256Hash(hash) {
+			configErrs.Add(fmt.Sprintf("invalid SHA-256 hash for config key %q: %s", fmt.Sprintf("media_api.blocked_hashes[%d]", i), hash))
+		}
+	}
+
+	for i, serverName := range c.BlockedOrigins {
+		if _, _, valid := spec.ParseAndValidateServerName(serverName); !valid {
+			configErrs.Add(fmt.Sprintf("invalid server name for config key %q: %s", fmt.Sprintf("media_api.blocked_origins[%d]", i), serverName))
+		}
+	}
+
+	seenSecondaryHashes := make(map[string]bool, len(c.SecondaryHashes))
+	for i, algorithm := range c.SecondaryHashes {
+		key := fmt.Sprintf("media_api.secondary_hashes[%d]", i)
+		switch {
+		case !isSecondaryHashAlgorithm(algorithm):
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %q is not one of %v", key, algorithm, SecondaryHashAlgorithms))
+		case seenSecondaryHashes[algorithm]:
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %q is listed more than once", key, algorithm))
+		}
+		seenSecondaryHashes[algorithm] = true
+	}
+
+	if c.ContentScanner.Enabled {
+		if len(c.ContentScanner.Command) == 0 {
+			configErrs.Add(fmt.Sprintf("missing config key %q", "media_api.content_scanner.command"))
+		}
+		if c.ContentScanner.Timeout <= 0 {
+			configErrs.Add(fmt.Sprintf("invalid duration for config key %q: %s", "media_api.content_scanner.timeout", c.ContentScanner.Timeout))
+		}
+	}
+
+	c.StoreLayout.Verify(configErrs)
+	c.Encryption.Verify(configErrs)
+	c.Compression.Verify(configErrs)
+	c.Replicas.Verify(configErrs)
+	c.RateLimiting.Verify(configErrs)
+	c.DiskSpace.Verify(configErrs)
+	c.Workers.Verify(configErrs)
+	c.MetadataCache.Verify(configErrs)
+	c.FileCache.Verify(configErrs)
+	c.UploadFromURL.Verify(configErrs)
+	c.Shutdown.Verify(configErrs)
+	c.AuditLog.Verify(configErrs)
+	c.MediaIDs.Verify(configErrs)
 
 	for i, size := range c.ThumbnailSizes {
 		checkPositive(configErrs, fmt.Sprintf("media_api.thumbnail_sizes[%d].width", i), int64(size.Width))
 		checkPositive(configErrs, fmt.Sprintf("media_api.thumbnail_sizes[%d].height", i), int64(size.Height))
+		switch size.ResizeMethod {
+		case "crop", "scale":
+		default:
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s, must be crop or scale", fmt.Sprintf("media_api.thumbnail_sizes[%d].method", i), size.ResizeMethod))
+		}
+	}
+	switch c.ThumbnailSelection {
+	case ThumbnailSelectionClosest, ThumbnailSelectionAtLeast:
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s, must be %s or %s", "media_api.thumbnail_selection", c.ThumbnailSelection, ThumbnailSelectionClosest, ThumbnailSelectionAtLeast))
+	}
+	if c.DeferredThumbnails.Enabled && c.DeferredThumbnails.RetryAfter <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid duration for config key %q: %s", "media_api.deferred_thumbnails.retry_after", c.DeferredThumbnails.RetryAfter))
 	}
 
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "media_api.database.connection_string", string(c.Database.ConnectionString))
 	}
 }
+
+// The ways a thumbnail can be chosen for media_api.thumbnail_selection.
+const (
+	// The thumbnail closest to the requested size is chosen, preferring ones
+	// at least as large as requested but choosing a smaller one otherwise.
+	ThumbnailSelectionClosest = "closest"
+	// Only thumbnails at least as large as requested are chosen. If there
+	// aren't any, the original file is sent instead.
+	ThumbnailSelectionAtLeast = "at_least"
+)
+
+// The hash algorithms that can be used for media_api.secondary_hashes.
+const (
+	HashBLAKE2b256 = "blake2b-256"
+	HashBLAKE2b512 = "blake2b-512"
+)
+
+// SecondaryHashAlgorithms lists the hash algorithms that can be used for
+// media_api.secondary_hashes.
+var SecondaryHashAlgorithms = []string{HashBLAKE2b256, HashBLAKE2b512}
+
+func isSecondaryHashAlgorithm(algorithm string) bool {
+	for _, a := range SecondaryHashAlgorithms {
+		if a == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+// isSHA256Hash returns true if the hash is a hex or unpadded URL-safe base64
+// encoded SHA-256 hash.
+func isSHA256Hash(hash string) bool {
+	if decoded, err := hex.DecodeString(hash); err == nil {
+		return len(decoded) == sha256.Size
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(hash)
+	return err == nil && len(decoded) == sha256.Size
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/matrix-org/gomatrixserverlib"
 	log "github.com/sirupsen/logrus"
@@ -13,10 +14,19 @@ type RoomServer struct {
 	DefaultRoomVersion gomatrixserverlib.RoomVersion `yaml:"default_room_version,omitempty"`
 
 	Database DatabaseOptions `yaml:"database,omitempty"`
+
+	// How long to keep the original content of redacted events, so that it
+	// can be reviewed through the admin API, before pruning it. 0 prunes the
+	// content as soon as the redaction is validated.
+	RedactionRetention time.Duration `yaml:"redaction_retention,omitempty"`
+	// How often to prune redacted events whose retention window has passed.
+	RedactionPruneInterval time.Duration `yaml:"redaction_prune_interval,omitempty"`
 }
 
 func (c *RoomServer) Defaults(opts DefaultOpts) {
 	c.DefaultRoomVersion = gomatrixserverlib.RoomVersionV10
+	c.RedactionRetention = 0
+	c.RedactionPruneInterval = time.Hour
 	if opts.Generate {
 		if !opts.SingleDatabase {
 			c.Database.ConnectionString = "file:roomserver.db"
@@ -34,4 +44,9 @@ func (c *RoomServer) Verify(configErrs *ConfigErrors) {
 	} else if !gomatrixserverlib.StableRoomVersion(c.DefaultRoomVersion) {
 		log.Warnf("WARNING: Provided default room version %q is unstable", c.DefaultRoomVersion)
 	}
+
+	checkPositive(configErrs, "room_server.redaction_retention", int64(c.RedactionRetention))
+	if c.RedactionRetention > 0 && c.RedactionPruneInterval <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key 'room_server.redaction_prune_interval': %s", c.RedactionPruneInterval))
+	}
 }
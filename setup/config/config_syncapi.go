@@ -8,9 +8,16 @@ type SyncAPI struct {
 	RealIPHeader string `yaml:"real_ip_header"`
 
 	Fulltext Fulltext `yaml:"search"`
+
+	// Accept stream and pagination tokens issued before tokens were signed.
+	// Enabled by default so that clients don't have to start again with an
+	// initial sync after upgrading. Disable it once clients have migrated, as
+	// unsigned tokens can be crafted by clients.
+	AcceptUnsignedSyncTokens bool `yaml:"accept_unsigned_sync_tokens"`
 }
 
 func (c *SyncAPI) Defaults(opts DefaultOpts) {
+	c.AcceptUnsignedSyncTokens = true
 	c.Fulltext.Defaults(opts)
 	if opts.Generate {
 		if !opts.SingleDatabase {
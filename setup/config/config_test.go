@@ -15,8 +15,10 @@
 package config
 
 import (
+	"encoding/base64"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/matrix-org/gomatrixserverlib/fclient"
@@ -252,6 +254,116 @@ ANAf5kxmMsM0zlN2hkxl0H6o7wKlBSw3RI3cjfilXiMWRPJrzlc4
 -----END CERTIFICATE-----
 `
 
+func TestLoadThumbnailSizesDefaultMethod(t *testing.T) {
+	withoutMethod := strings.Replace(testConfig, "    method: scale\n", "", 1)
+	cfg, err := loadConfig("/my/config/dir", []byte(withoutMethod),
+		mockReadFile{
+			"/my/config/dir/matrix_key.pem": testKey,
+			"/my/config/dir/tls_cert.pem":   testCert,
+		}.readFile,
+	)
+	if err != nil {
+		t.Fatal("failed to load config:", err)
+	}
+	sizes := cfg.MediaAPI.ThumbnailSizes
+	if len(sizes) != 3 || sizes[2].ResizeMethod != "scale" {
+		t.Fatalf("expected the last thumbnail size to be scaled, got %+v", sizes)
+	}
+
+	// Verifying the config doesn't change it.
+	for i := 0; i < 2; i++ {
+		configErrors := &ConfigErrors{}
+		cfg.Verify(configErrors)
+		if len(*configErrors) > 0 {
+			t.Fatalf("configuration verification failed: %v", *configErrors)
+		}
+	}
+	if !reflect.DeepEqual(cfg.MediaAPI.ThumbnailSizes, sizes) {
+		t.Fatalf("expected verifying not to change the thumbnail sizes, got %+v", cfg.MediaAPI.ThumbnailSizes)
+	}
+}
+
+func TestLoadMediaMasterKey(t *testing.T) {
+	raw := strings.Repeat("k", MediaMasterKeySize)
+	for data, wantErr := range map[string]bool{
+		raw: false,
+		base64.StdEncoding.EncodeToString([]byte(raw)) + "\n": false,
+		base64.RawURLEncoding.EncodeToString([]byte(raw)):     false,
+		"too short": true,
+		base64.StdEncoding.EncodeToString([]byte("too short")): true,
+	} {
+		c := MediaEncryption{MasterKeyPath: "media.key"}
+		err := c.loadMasterKey("/my/config/dir", func(path string) ([]byte, error) {
+			if path != "/my/config/dir/media.key" {
+				return nil, fmt.Errorf("unexpected path %q", path)
+			}
+			return []byte(data), nil
+		})
+		if (err != nil) != wantErr {
+			t.Errorf("loadMasterKey(%q) error = %v, wantErr %v", data, err, wantErr)
+		}
+		if err == nil && string(c.MasterKey) != raw {
+			t.Errorf("loadMasterKey(%q) loaded the wrong key", data)
+		}
+	}
+}
+
+func TestLoadNewDeviceAlertEmailTemplate(t *testing.T) {
+	for data, wantErr := range map[string]bool{
+		"{{.UserID}} logged in from {{.IPAddr}}": false,
+		"{{.UserID} logged in":                   true,
+	} {
+		c := NewDeviceAlerts{Enabled: true, Email: true, EmailTemplatePath: "alert.tmpl"}
+		err := c.loadEmailTemplate("/my/config/dir", func(path string) ([]byte, error) {
+			if path != "/my/config/dir/alert.tmpl" {
+				return nil, fmt.Errorf("unexpected path %q", path)
+			}
+			return []byte(data), nil
+		})
+		if (err != nil) != wantErr {
+			t.Errorf("loadEmailTemplate(%q) error = %v, wantErr %v", data, err, wantErr)
+		}
+		if err == nil && c.EmailTemplate == nil {
+			t.Errorf("loadEmailTemplate(%q) didn't load the template", data)
+		}
+	}
+}
+
+func TestNewDeviceAlertLocalizedEmail(t *testing.T) {
+	c := NewDeviceAlerts{
+		Enabled: true,
+		Email:   true,
+		LocalizedEmails: map[string]*LocalizedEmail{
+			"de":    {TemplatePath: "de.tmpl"},
+			"pt_BR": {Subject: "Novo login"},
+		},
+	}
+	err := c.loadEmailTemplate("/my/config/dir", func(path string) ([]byte, error) {
+		if path != "/my/config/dir/de.tmpl" {
+			return nil, fmt.Errorf("unexpected path %q", path)
+		}
+		return []byte("{{.UserID}}"), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.LocalizedEmails["de"].Template == nil {
+		t.Errorf("the template for locale \"de\" wasn't loaded")
+	}
+	for locale, want := range map[string]*LocalizedEmail{
+		"":      nil,
+		"de":    c.LocalizedEmails["de"],
+		"DE-at": c.LocalizedEmails["de"],
+		"pt-BR": c.LocalizedEmails["pt_BR"],
+		"pt":    nil,
+		"fr":    nil,
+	} {
+		if got := c.LocalizedEmail(locale); got != want {
+			t.Errorf("LocalizedEmail(%q) = %v, want %v", locale, got, want)
+		}
+	}
+}
+
 func TestUnmarshalDataUnit(t *testing.T) {
 	target := struct {
 		Got DataUnit `yaml:"value"`
@@ -322,3 +434,59 @@ func Test_SigningIdentityFor(t *testing.T) {
 		})
 	}
 }
+
+func TestListenerVerify(t *testing.T) {
+	tests := map[string]struct {
+		listener Listener
+		wantErrs int
+		want     ServerAddress
+	}{
+		"disabled":    {listener: Listener{}},
+		"tcp":         {listener: Listener{Address: "127.0.0.1:8009"}, want: ServerAddress{Address: "127.0.0.1:8009", Scheme: "http"}},
+		"tls":         {listener: Listener{Address: ":8449", TLSCert: "cert.pem", TLSKey: "key.pem"}, want: ServerAddress{Address: ":8449", Scheme: "https"}},
+		"unix":        {listener: Listener{Address: "unix:/run/dendrite.sock"}, want: ServerAddress{Address: "/run/dendrite.sock", Scheme: NetworkUnix, UnixSocketPermission: 0755}},
+		"missing key": {listener: Listener{Address: ":8449", TLSCert: "cert.pem"}, wantErrs: 1, want: ServerAddress{Address: ":8449", Scheme: "http"}},
+		"bad perm":    {listener: Listener{Address: "unix:/run/dendrite.sock", UnixSocketPermission: "rwx"}, wantErrs: 1},
+		"bad address": {listener: Listener{Address: "127.0.0.1:80%"}, wantErrs: 1},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			configErrs := &ConfigErrors{}
+			tt.listener.Verify(configErrs, "global.listeners.internal")
+			if len(*configErrs) != tt.wantErrs {
+				t.Fatalf("got %d config errors, want %d: %v", len(*configErrs), tt.wantErrs, *configErrs)
+			}
+			if tt.wantErrs == 0 && tt.listener.Enabled() {
+				addr, err := tt.listener.ServerAddress()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if addr != tt.want {
+					t.Errorf("got address %+v, want %+v", addr, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestOutboundProxyVerify(t *testing.T) {
+	tests := map[string]struct {
+		proxy    OutboundProxy
+		wantErrs int
+	}{
+		"environment": {proxy: OutboundProxy{}},
+		"http":        {proxy: OutboundProxy{HTTPProxy: "http://proxy.example.com:3128", NoProxy: "localhost"}},
+		"https":       {proxy: OutboundProxy{HTTPSProxy: "socks5://127.0.0.1:1080"}},
+		"no host":     {proxy: OutboundProxy{HTTPSProxy: "proxy.example.com"}, wantErrs: 1},
+		"bad url":     {proxy: OutboundProxy{HTTPProxy: "http://proxy%", HTTPSProxy: "http://proxy%"}, wantErrs: 2},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			configErrs := &ConfigErrors{}
+			tt.proxy.Verify(configErrs)
+			if len(*configErrs) != tt.wantErrs {
+				t.Fatalf("got %d config errors, want %d: %v", len(*configErrs), tt.wantErrs, *configErrs)
+			}
+		})
+	}
+}
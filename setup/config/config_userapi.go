@@ -1,6 +1,13 @@
 package config
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
 
 type UserAPI struct {
 	Matrix *Global `yaml:"-"`
@@ -25,6 +32,155 @@ type UserAPI struct {
 	// The number of workers to start for the DeviceListUpdater. Defaults to 8.
 	// This only needs updating if the "InputDeviceListUpdate" stream keeps growing indefinitely.
 	WorkerCount int `yaml:"worker_count"`
+
+	// Notify users when a new device logs into their account.
+	NewDeviceAlerts NewDeviceAlerts `yaml:"new_device_alerts"`
+
+	// The IP addresses remembered for each device, shown to users in the /devices API.
+	DeviceSessions DeviceSessions `yaml:"device_sessions"`
+}
+
+// DeviceSessions configures how much of the session history of a device is kept.
+type DeviceSessions struct {
+	// How many IP addresses to remember per device. 0 disables the history.
+	MaxPerDevice int `yaml:"max_per_device"`
+
+	// How long to remember an IP address after it was last seen. 0 keeps them
+	// until the device is deleted.
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+// NewDeviceAlerts configures the alerts sent when a new device logs into an
+// account. Users can opt out by setting the "enabled" key of the
+// org.matrix.dendrite.new_device_alerts account data to false.
+type NewDeviceAlerts struct {
+	// Send a to-device message to the other devices of the user.
+	Enabled bool `yaml:"enabled"`
+
+	// Also send an email to the email addresses associated with the account.
+	Email bool `yaml:"email"`
+
+	// The subject of the email.
+	EmailSubject string `yaml:"email_subject"`
+
+	// Path to a text/template file used for the body of the email. If empty,
+	// a built-in template is used.
+	EmailTemplatePath Path `yaml:"email_template_path"`
+
+	// The template parsed from EmailTemplatePath when the config is loaded.
+	EmailTemplate *template.Template `yaml:"-"`
+
+	// Emails in other languages, keyed by locale such as "de" or "pt-BR", for
+	// users who chose a locale in the org.matrix.dendrite.locale account data.
+	LocalizedEmails map[string]*LocalizedEmail `yaml:"localized_emails"`
+
+	// The SMTP server used for sending emails.
+	SMTP SMTP `yaml:"smtp"`
+}
+
+// LocalizedEmail overrides the subject and template of an email for a locale.
+type LocalizedEmail struct {
+	// The subject of the email. If empty, the default subject is used.
+	Subject string `yaml:"subject"`
+
+	// Path to a text/template file used for the body of the email. If empty,
+	// the default template is used.
+	TemplatePath Path `yaml:"template_path"`
+
+	// The template parsed from TemplatePath when the config is loaded.
+	Template *template.Template `yaml:"-"`
+}
+
+type SMTP struct {
+	// The address of the SMTP server, as host:port.
+	Host string `yaml:"host"`
+
+	// The credentials to authenticate with, if required by the server.
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	// The address emails are sent from.
+	From string `yaml:"from"`
+}
+
+func (c *NewDeviceAlerts) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled || !c.Email {
+		return
+	}
+	checkNotEmpty(configErrs, "user_api.new_device_alerts.email_subject", c.EmailSubject)
+	if strings.ContainsAny(c.EmailSubject, "\r\n") {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: must not contain line breaks", "user_api.new_device_alerts.email_subject"))
+	}
+	for locale, email := range c.LocalizedEmails {
+		key := fmt.Sprintf("user_api.new_device_alerts.localized_emails.%s", locale)
+		if email == nil {
+			configErrs.Add(fmt.Sprintf("missing config key %q", key))
+			continue
+		}
+		if strings.ContainsAny(email.Subject, "\r\n") {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: must not contain line breaks", key+".subject"))
+		}
+	}
+	checkNotEmpty(configErrs, "user_api.new_device_alerts.smtp.host", c.SMTP.Host)
+	checkNotEmpty(configErrs, "user_api.new_device_alerts.smtp.from", c.SMTP.From)
+	if c.SMTP.Username != "" {
+		checkNotEmpty(configErrs, "user_api.new_device_alerts.smtp.password", c.SMTP.Password)
+	}
+}
+
+// loadEmailTemplate parses the configured email templates, so that a broken
+// template is reported at startup rather than on the first login.
+func (c *NewDeviceAlerts) loadEmailTemplate(basePath string, readFile func(string) ([]byte, error)) (err error) {
+	if !c.Enabled || !c.Email {
+		return nil
+	}
+	if c.EmailTemplate, err = loadTemplate(basePath, c.EmailTemplatePath, readFile); err != nil {
+		return err
+	}
+	for locale, email := range c.LocalizedEmails {
+		if email == nil {
+			continue
+		}
+		if email.Template, err = loadTemplate(basePath, email.TemplatePath, readFile); err != nil {
+			return fmt.Errorf("locale %q: %w", locale, err)
+		}
+	}
+	return nil
+}
+
+// LocalizedEmail returns the email configured for the locale, or for its
+// language if there is none for the region, e.g. "de" for "de-AT". Returns
+// nil if neither is configured.
+func (c *NewDeviceAlerts) LocalizedEmail(locale string) *LocalizedEmail {
+	if locale == "" {
+		return nil
+	}
+	locale = strings.ReplaceAll(locale, "_", "-")
+	base, _, _ := strings.Cut(locale, "-")
+	var language *LocalizedEmail
+	for l, email := range c.LocalizedEmails {
+		l = strings.ReplaceAll(l, "_", "-")
+		if strings.EqualFold(l, locale) {
+			return email
+		}
+		if strings.EqualFold(l, base) {
+			language = email
+		}
+	}
+	return language
+}
+
+// loadTemplate parses the text/template file at path, or returns nil if path
+// is empty.
+func loadTemplate(basePath string, path Path, readFile func(string) ([]byte, error)) (*template.Template, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := readFile(absPath(basePath, path))
+	if err != nil {
+		return nil, err
+	}
+	return template.New(string(path)).Parse(string(data))
 }
 
 const DefaultOpenIDTokenLifetimeMS = 3600000 // 60 minutes
@@ -33,6 +189,9 @@ func (c *UserAPI) Defaults(opts DefaultOpts) {
 	c.BCryptCost = bcrypt.DefaultCost
 	c.OpenIDTokenLifetimeMS = DefaultOpenIDTokenLifetimeMS
 	c.WorkerCount = 8
+	c.DeviceSessions.MaxPerDevice = 10
+	c.DeviceSessions.MaxAge = time.Hour * 24 * 90
+	c.NewDeviceAlerts.EmailSubject = "New login to your Matrix account"
 	if opts.Generate {
 		if !opts.SingleDatabase {
 			c.AccountDatabase.ConnectionString = "file:userapi_accounts.db"
@@ -42,6 +201,9 @@ func (c *UserAPI) Defaults(opts DefaultOpts) {
 
 func (c *UserAPI) Verify(configErrs *ConfigErrors) {
 	checkPositive(configErrs, "user_api.openid_token_lifetime_ms", c.OpenIDTokenLifetimeMS)
+	c.NewDeviceAlerts.Verify(configErrs)
+	checkPositive(configErrs, "user_api.device_sessions.max_per_device", int64(c.DeviceSessions.MaxPerDevice))
+	checkPositive(configErrs, "user_api.device_sessions.max_age", int64(c.DeviceSessions.MaxAge))
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "user_api.account_database.connection_string", string(c.AccountDatabase.ConnectionString))
 	}
@@ -0,0 +1,236 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package homeserver runs a Dendrite homeserver inside another Go program, for
+// example in tests, appliances or P2P experiments, instead of running the
+// dendrite binary. The components are wired up the same way as in the binary,
+// but serving the APIs is left to the caller.
+package homeserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+
+	"github.com/matrix-org/dendrite/appservice"
+	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/federationapi"
+	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup"
+	basepkg "github.com/matrix-org/dendrite/setup/base"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/setup/mscs"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/dendrite/userapi"
+	userAPI "github.com/matrix-org/dendrite/userapi/api"
+)
+
+// Options change how a homeserver is set up. The zero value is fine for tests.
+type Options struct {
+	// The process context the components run in, or nil to create one.
+	// Shutting it down stops the homeserver.
+	ProcessContext *process.ProcessContext
+	// The DNS cache used by the HTTP clients, or nil to not cache lookups.
+	DNSCache *fclient.DNSCache
+	// Whether to register Prometheus metrics. They can only be registered once
+	// per program, so this must be false if more than one homeserver is run.
+	EnableMetrics bool
+}
+
+// Homeserver is a running Dendrite homeserver, with handles to its components.
+type Homeserver struct {
+	Config         *config.Dendrite
+	ProcessContext *process.ProcessContext
+	// The routers the APIs are attached to. Most callers want Handler instead.
+	Routers httputil.Routers
+	// The monolith the public routes were added from, holding the clients and keyring.
+	Monolith *setup.Monolith
+
+	RoomserverAPI roomserverAPI.RoomserverInternalAPI
+	FederationAPI federationAPI.FederationInternalAPI
+	UserAPI       userAPI.UserInternalAPI
+	AppserviceAPI appserviceAPI.AppServiceInternalAPI
+
+	handlerOnce sync.Once
+	handler     http.Handler
+}
+
+// New verifies the config and sets up all the components of a homeserver. The
+// components start processing in the background straight away, until Stop is
+// called or the process context is shut down. NATS and the databases are
+// connected to first, so that New returns an error if they can't be reached.
+func New(cfg *config.Dendrite, opts Options) (*Homeserver, error) {
+	configErrors := &config.ConfigErrors{}
+	cfg.Verify(configErrors)
+	if len(*configErrors) > 0 {
+		return nil, fmt.Errorf("homeserver: invalid config: %s", strings.Join(*configErrors, "; "))
+	}
+
+	processCtx := opts.ProcessContext
+	if processCtx == nil {
+		processCtx = process.NewProcessContext()
+	}
+
+	// The components exit or panic if they can't reach NATS or their database,
+	// which mustn't take down the program embedding the homeserver.
+	natsInstance := jetstream.NATSInstance{}
+	if err := natsInstance.Setup(processCtx, &cfg.Global.JetStream); err != nil {
+		processCtx.ShutdownDendrite()
+		return nil, fmt.Errorf("homeserver: failed to set up NATS: %w", err)
+	}
+	cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+	if err := connectDatabases(processCtx.Context(), cm, cfg); err != nil {
+		processCtx.ShutdownDendrite()
+		return nil, fmt.Errorf("homeserver: %w", err)
+	}
+
+	federationClient := basepkg.CreateFederationClient(cfg, opts.DNSCache)
+	httpClient := basepkg.CreateClient(cfg, opts.DNSCache)
+	routers := httputil.NewRouters()
+
+	caches := caching.NewRistrettoCache(cfg.Global.Cache.EstimatedMaxSize, cfg.Global.Cache.MaxAge, opts.EnableMetrics)
+	rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, opts.EnableMetrics)
+	fsAPI := federationapi.NewInternalAPI(
+		processCtx, cfg, cm, &natsInstance, federationClient, rsAPI, caches, nil, false,
+	)
+
+	keyRing := fsAPI.KeyRing()
+
+	// The underlying roomserver implementation needs to be able to call the fedsender,
+	// and other components also need updating after their dependencies are up.
+	rsAPI.SetFederationAPI(fsAPI, keyRing)
+
+	usAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, federationClient, opts.EnableMetrics, fsAPI.IsBlacklistedOrBackingOff)
+	asAPI := appservice.NewInternalAPI(processCtx, cfg, &natsInstance, usAPI, rsAPI)
+
+	rsAPI.SetAppserviceAPI(asAPI)
+	rsAPI.SetUserAPI(usAPI)
+
+	monolith := &setup.Monolith{
+		Config:    cfg,
+		Client:    httpClient,
+		FedClient: federationClient,
+		KeyRing:   keyRing,
+
+		AppserviceAPI: asAPI,
+		FederationAPI: fsAPI,
+		RoomserverAPI: rsAPI,
+		UserAPI:       usAPI,
+	}
+	if err := monolith.AddAllPublicRoutes(processCtx, cfg, routers, cm, &natsInstance, caches, opts.EnableMetrics); err != nil {
+		processCtx.ShutdownDendrite()
+		return nil, fmt.Errorf("homeserver: failed to add public routes: %w", err)
+	}
+
+	if len(cfg.MSCs.MSCs) > 0 {
+		if err := mscs.Enable(cfg, cm, routers, monolith, caches); err != nil {
+			processCtx.ShutdownDendrite()
+			return nil, fmt.Errorf("homeserver: failed to enable MSCs: %w", err)
+		}
+	}
+
+	return &Homeserver{
+		Config:         cfg,
+		ProcessContext: processCtx,
+		Routers:        routers,
+		Monolith:       monolith,
+		RoomserverAPI:  rsAPI,
+		FederationAPI:  fsAPI,
+		UserAPI:        usAPI,
+		AppserviceAPI:  asAPI,
+	}, nil
+}
+
+// connectDatabases connects to the databases of the components and checks that
+// they can be reached.
+func connectDatabases(ctx context.Context, cm *sqlutil.Connections, cfg *config.Dendrite) error {
+	type database struct {
+		name string
+		opts *config.DatabaseOptions
+	}
+	databases := []database{
+		{"room_server.database", &cfg.RoomServer.Database},
+		{"federation_api.database", &cfg.FederationAPI.Database},
+		{"key_server.database", &cfg.KeyServer.Database},
+		{"media_api.database", &cfg.MediaAPI.Database},
+		{"sync_api.database", &cfg.SyncAPI.Database},
+		{"user_api.account_database", &cfg.UserAPI.AccountDatabase},
+	}
+	if len(cfg.MSCs.MSCs) > 0 {
+		databases = append(databases, database{"mscs.database", &cfg.MSCs.Database})
+	}
+	for _, database := range databases {
+		db, _, err := cm.Connection(database.opts)
+		if err != nil {
+			return fmt.Errorf("failed to connect to %s: %w", database.name, err)
+		}
+		if err = db.PingContext(ctx); err != nil {
+			return fmt.Errorf("failed to connect to %s: %w", database.name, err)
+		}
+	}
+	return nil
+}
+
+// Handler returns the handler serving the homeserver's public APIs, in the
+// same way as the external listeners of the dendrite binary.
+func (hs *Homeserver) Handler() http.Handler {
+	hs.handlerOnce.Do(func() {
+		hs.handler = basepkg.ExternalHandler(hs.ProcessContext, hs.Config, hs.Routers)
+	})
+	return hs.handler
+}
+
+// Serve serves the public APIs on the listener until the homeserver is stopped,
+// then returns nil.
+func (hs *Homeserver) Serve(l net.Listener) error {
+	serv := &http.Server{
+		Handler:      hs.Handler(),
+		WriteTimeout: basepkg.HTTPServerTimeout,
+		BaseContext: func(_ net.Listener) context.Context {
+			return hs.ProcessContext.Context()
+		},
+	}
+	go func() {
+		<-hs.ProcessContext.WaitForShutdown()
+		_ = serv.Shutdown(context.Background())
+	}()
+	if err := serv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Done returns a channel that is closed when the homeserver is told to stop.
+func (hs *Homeserver) Done() <-chan struct{} {
+	return hs.ProcessContext.WaitForShutdown()
+}
+
+// Stop shuts down the homeserver and waits for its components to finish. It is
+// safe to call more than once.
+func (hs *Homeserver) Stop() {
+	hs.ProcessContext.ShutdownDendrite()
+	hs.ProcessContext.WaitForComponentsToFinish()
+}
@@ -0,0 +1,68 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package homeserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/dendrite/test/testrig"
+)
+
+func TestNew(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		defer close()
+
+		serverName := cfg.Global.ServerName
+		cfg.Global.ServerName = ""
+		_, err := New(cfg, Options{ProcessContext: processCtx})
+		assert.Error(t, err)
+		cfg.Global.ServerName = serverName
+
+		hs, err := New(cfg, Options{ProcessContext: processCtx})
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer hs.Stop()
+		assert.NotNil(t, hs.RoomserverAPI)
+		assert.NotNil(t, hs.UserAPI)
+
+		srv := httptest.NewServer(hs.Handler())
+		defer srv.Close()
+		res, err := http.Get(srv.URL + "/_matrix/client/versions")
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer res.Body.Close() // nolint: errcheck
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	})
+}
+
+func TestNewUnreachableDatabase(t *testing.T) {
+	cfg, processCtx, close := testrig.CreateConfig(t, test.DBTypeSQLite)
+	defer close()
+
+	// The directory of the database doesn't exist, so it can't be opened.
+	cfg.SyncAPI.Database.ConnectionString = config.DataSource("file:" + filepath.Join(t.TempDir(), "missing", "syncapi.db"))
+	_, err := New(cfg, Options{ProcessContext: processCtx})
+	assert.ErrorContains(t, err, "sync_api.database")
+}
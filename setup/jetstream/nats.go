@@ -36,6 +36,31 @@ func DeleteAllStreams(js natsclient.JetStreamContext, cfg *config.JetStream) {
 func (s *NATSInstance) Prepare(process *process.ProcessContext, cfg *config.JetStream) (natsclient.JetStreamContext, *natsclient.Conn) {
 	natsLock.Lock()
 	defer natsLock.Unlock()
+	js, nc, err := s.start(process, cfg)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to set up NATS")
+	}
+	return js, nc
+}
+
+// Setup starts the in-process NATS server, or connects to the configured NATS
+// servers, and sets up the streams. Unlike Prepare, it returns an error rather
+// than exiting if that fails. Prepare reuses the in-process server afterwards.
+func (s *NATSInstance) Setup(process *process.ProcessContext, cfg *config.JetStream) error {
+	natsLock.Lock()
+	defer natsLock.Unlock()
+	_, nc, err := s.start(process, cfg)
+	if err != nil {
+		return err
+	}
+	if len(cfg.Addresses) != 0 {
+		// Each component connects to remote NATS servers separately.
+		nc.Close()
+	}
+	return nil
+}
+
+func (s *NATSInstance) start(process *process.ProcessContext, cfg *config.JetStream) (natsclient.JetStreamContext, *natsclient.Conn, error) {
 	// check if we need an in-process NATS Server
 	if len(cfg.Addresses) != 0 {
 		return setupNATS(process, cfg, nil)
@@ -54,7 +79,7 @@ func (s *NATSInstance) Prepare(process *process.ProcessContext, cfg *config.JetS
 		}
 		s.Server, err = natsserver.NewServer(opts)
 		if err != nil {
-			panic(err)
+			return nil, nil, fmt.Errorf("natsserver.NewServer: %w", err)
 		}
 		if !cfg.NoLog {
 			s.SetLogger(NewLogAdapter(), opts.Debug, opts.Trace)
@@ -71,24 +96,28 @@ func (s *NATSInstance) Prepare(process *process.ProcessContext, cfg *config.JetS
 		}()
 	}
 	if !s.ReadyForConnections(time.Second * 60) {
-		logrus.Fatalln("NATS did not start in time")
+		return nil, nil, fmt.Errorf("NATS did not start in time")
 	}
 	// reuse existing connections
 	if s.nc != nil {
-		return s.js, s.nc
+		return s.js, s.nc, nil
 	}
 	nc, err := natsclient.Connect("", natsclient.InProcessServer(s))
 	if err != nil {
-		logrus.Fatalln("Failed to create NATS client")
+		return nil, nil, fmt.Errorf("failed to create NATS client: %w", err)
+	}
+	js, _, err := setupNATS(process, cfg, nc)
+	if err != nil {
+		nc.Close()
+		return nil, nil, err
 	}
-	js, _ := setupNATS(process, cfg, nc)
 	s.js = js
 	s.nc = nc
-	return js, nc
+	return js, nc, nil
 }
 
 // nolint:gocyclo
-func setupNATS(process *process.ProcessContext, cfg *config.JetStream, nc *natsclient.Conn) (natsclient.JetStreamContext, *natsclient.Conn) {
+func setupNATS(process *process.ProcessContext, cfg *config.JetStream, nc *natsclient.Conn) (natsclient.JetStreamContext, *natsclient.Conn, error) {
 	if nc == nil {
 		var err error
 		opts := []natsclient.Option{}
@@ -99,22 +128,20 @@ func setupNATS(process *process.ProcessContext, cfg *config.JetStream, nc *natsc
 		}
 		nc, err = natsclient.Connect(strings.Join(cfg.Addresses, ","), opts...)
 		if err != nil {
-			logrus.WithError(err).Panic("Unable to connect to NATS")
-			return nil, nil
+			return nil, nil, fmt.Errorf("unable to connect to NATS: %w", err)
 		}
 	}
 
 	s, err := nc.JetStream()
 	if err != nil {
-		logrus.WithError(err).Panic("Unable to get JetStream context")
-		return nil, nil
+		return nil, nil, fmt.Errorf("unable to get JetStream context: %w", err)
 	}
 
 	for _, stream := range streams { // streams are defined in streams.go
 		name := cfg.Prefixed(stream.Name)
 		info, err := s.StreamInfo(name)
 		if err != nil && err != natsclient.ErrStreamNotFound {
-			logrus.WithError(err).Fatal("Unable to get stream info")
+			return nil, nil, fmt.Errorf("unable to get stream info: %w", err)
 		}
 		subjects := stream.Subjects
 		if len(subjects) == 0 {
@@ -149,7 +176,7 @@ func setupNATS(process *process.ProcessContext, cfg *config.JetStream, nc *natsc
 					// We failed to update the stream, this is a last attempt to get
 					// things working but may result in data loss.
 					if err = s.DeleteStream(name); err != nil {
-						logrus.WithError(err).Fatalf("Unable to delete stream %q", name)
+						return nil, nil, fmt.Errorf("unable to delete stream %q: %w", name, err)
 					}
 					info = nil
 				}
@@ -176,7 +203,7 @@ func setupNATS(process *process.ProcessContext, cfg *config.JetStream, nc *natsc
 				// If the stream was supposed to be in-memory to begin with
 				// then an error here is fatal so we'll give up.
 				if namespaced.Storage == natsclient.MemoryStorage {
-					logger.WithError(err).Fatal("Unable to add in-memory stream")
+					return nil, nil, fmt.Errorf("unable to add in-memory stream %q: %w", namespaced.Name, err)
 				}
 
 				// The stream was supposed to be on disk. Let's try starting
@@ -191,7 +218,7 @@ func setupNATS(process *process.ProcessContext, cfg *config.JetStream, nc *natsc
 					// We tried to add the stream in-memory instead but something
 					// went wrong. That's an unrecoverable situation so we will
 					// give up at this point.
-					logger.WithError(err).Fatal("Unable to add in-memory stream")
+					return nil, nil, fmt.Errorf("unable to add in-memory stream %q: %w", namespaced.Name, err)
 				}
 
 				if stream.Storage != namespaced.Storage {
@@ -230,5 +257,5 @@ func setupNATS(process *process.ProcessContext, cfg *config.JetStream, nc *natsc
 		}
 	}
 
-	return s, nc
+	return s, nc, nil
 }
@@ -0,0 +1,203 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package maintenance reports the size of the databases, and periodically
+// vacuums and analyzes them. It also schedules the background jobs of the
+// other components.
+package maintenance
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// Maintainer runs maintenance on the databases opened by a connection manager.
+type Maintainer struct {
+	cfg *config.DatabaseMaintenance
+	cm  *sqlutil.Connections
+	// Only run one maintenance at a time, as a scheduled maintenance and one
+	// requested through the admin API could otherwise overlap.
+	mu sync.Mutex
+}
+
+func NewMaintainer(cfg *config.DatabaseMaintenance, cm *sqlutil.Connections) *Maintainer {
+	return &Maintainer{
+		cfg: cfg,
+		cm:  cm,
+	}
+}
+
+// Setup registers the admin endpoints, and starts the scheduled maintenance
+// and size checks.
+func Setup(
+	processCtx *process.ProcessContext,
+	cfg *config.Dendrite,
+	routers httputil.Routers,
+	cm *sqlutil.Connections,
+	userAPI userapi.QueryAcccessTokenAPI,
+) *Maintainer {
+	m := NewMaintainer(&cfg.Global.DatabaseMaintenance, cm)
+
+	routers.DendriteAdmin.Handle("/admin/databaseSizes",
+		httputil.MakeAdminAPI("admin_database_sizes", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			sizes, err := m.Sizes(req.Context())
+			if err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("Failed to get the database sizes")
+				return util.JSONResponse{
+					Code: http.StatusInternalServerError,
+					JSON: spec.InternalServerError{},
+				}
+			}
+			return util.JSONResponse{
+				Code: http.StatusOK,
+				JSON: map[string]any{
+					"databases": sizes,
+				},
+			}
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	routers.DendriteAdmin.Handle("/admin/databaseMaintenance",
+		httputil.MakeAdminAPI("admin_database_maintenance", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if err := m.Run(req.Context()); err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("Failed to run the database maintenance")
+				return util.JSONResponse{
+					Code: http.StatusInternalServerError,
+					JSON: spec.InternalServerError{},
+				}
+			}
+			return util.JSONResponse{
+				Code: http.StatusOK,
+				JSON: struct{}{},
+			}
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	if m.cfg.Interval > 0 {
+		Every(processCtx, "database_maintenance", m.cfg.Interval, m.Run)
+	}
+	if m.cfg.SizeCheckInterval > 0 && len(m.cfg.TableSizeWarnings) > 0 {
+		Every(processCtx, "database_size_check", m.cfg.SizeCheckInterval, m.CheckSizes)
+	}
+	return m
+}
+
+// Sizes returns the size of each database and its tables.
+func (m *Maintainer) Sizes(ctx context.Context) ([]*DatabaseSize, error) {
+	sizes := []*DatabaseSize{}
+	for _, db := range m.cm.OpenedDatabases() {
+		size, err := databaseSize(ctx, db)
+		if err != nil {
+			return nil, err
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, nil
+}
+
+// CheckSizes logs a warning for each table that has grown beyond its
+// configured size.
+func (m *Maintainer) CheckSizes(ctx context.Context) error {
+	sizes, err := m.Sizes(ctx)
+	if err != nil {
+		return err
+	}
+	for _, db := range sizes {
+		for _, table := range db.Tables {
+			limit, ok := m.cfg.TableSizeWarnings[table.Name]
+			if !ok || table.SizeBytes == nil || *table.SizeBytes <= int64(limit) {
+				continue
+			}
+			logrus.WithFields(logrus.Fields{
+				"database":    db.Name,
+				"table":       table.Name,
+				"size_bytes":  *table.SizeBytes,
+				"limit_bytes": int64(limit),
+				"rows":        table.Rows,
+			}).Warn("Database table has grown beyond the configured size")
+		}
+	}
+	return nil
+}
+
+// Run vacuums and analyzes every database.
+func (m *Maintainer) Run(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, db := range m.cm.OpenedDatabases() {
+		name := databaseName(db.ConnectionString)
+		logger := logrus.WithField("database", name)
+		start := time.Now()
+		var err error
+		if db.ConnectionString.IsSQLite() {
+			// Run through the writer, as SQLite only allows one writer at a time.
+			err = db.Writer.Do(db.DB, nil, func(_ *sql.Tx) error {
+				return m.sqliteMaintenance(ctx, db.DB, logger)
+			})
+		} else {
+			err = postgresMaintenance(ctx, db.DB)
+		}
+		if err != nil {
+			return fmt.Errorf("database %q: %w", name, err)
+		}
+		logger.WithField("duration", time.Since(start)).Info("Database maintenance finished")
+	}
+	return nil
+}
+
+func postgresMaintenance(ctx context.Context, db *sql.DB) error {
+	// A plain VACUUM doesn't lock the tables, unlike VACUUM FULL.
+	if _, err := db.ExecContext(ctx, "VACUUM (ANALYZE)"); err != nil {
+		return fmt.Errorf("VACUUM: %w", err)
+	}
+	return nil
+}
+
+func (m *Maintainer) sqliteMaintenance(ctx context.Context, db *sql.DB, logger *logrus.Entry) error {
+	// The free pages of a database can only be reclaimed incrementally when
+	// it was created with incremental auto vacuum, or converted to it with
+	// a full VACUUM, which rewrites the whole database so isn't done here.
+	var autoVacuum int
+	if err := db.QueryRowContext(ctx, "PRAGMA auto_vacuum").Scan(&autoVacuum); err != nil {
+		return fmt.Errorf("auto_vacuum: %w", err)
+	}
+	if autoVacuum == 2 {
+		pragma := "PRAGMA incremental_vacuum"
+		if pages := m.cfg.SQLiteIncrementalVacuumPages; pages > 0 {
+			pragma = fmt.Sprintf("PRAGMA incremental_vacuum(%d)", pages)
+		}
+		if _, err := db.ExecContext(ctx, pragma); err != nil {
+			return fmt.Errorf("incremental_vacuum: %w", err)
+		}
+	} else {
+		logger.Debug("Skipping incremental vacuum as auto_vacuum isn't set to INCREMENTAL")
+	}
+	if _, err := db.ExecContext(ctx, "ANALYZE"); err != nil {
+		return fmt.Errorf("ANALYZE: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package maintenance
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/sirupsen/logrus"
+)
+
+// Job is a background job started by Schedule or Every.
+type Job struct {
+	trigger chan struct{}
+}
+
+// Trigger runs the job as soon as it isn't running, rather than waiting for
+// its interval to pass. Triggering it again before it has started only runs it
+// once. Does nothing if the job is nil, e.g. because it wasn't enabled.
+func (j *Job) Trigger() {
+	if j == nil {
+		return
+	}
+	select {
+	case j.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Every runs the job every interval until Dendrite shuts down.
+func Every(processCtx *process.ProcessContext, name string, interval time.Duration, job func(ctx context.Context) error) *Job {
+	return Schedule(processCtx, name, func() time.Duration { return interval }, job)
+}
+
+// Schedule runs the job until Dendrite shuts down, waiting for the interval it
+// returns before each run, so that the interval can follow config reloads. The
+// waits are jittered by up to 10% either way, so that instances started at the
+// same time don't keep hitting the database together. Runs of the job never
+// overlap, and the errors it returns are logged.
+func Schedule(processCtx *process.ProcessContext, name string, interval func() time.Duration, job func(ctx context.Context) error) *Job {
+	j := &Job{trigger: make(chan struct{}, 1)}
+	logger := logrus.WithField("job", name)
+	go func() {
+		for {
+			timer := time.NewTimer(withJitter(interval()))
+			select {
+			case <-processCtx.WaitForShutdown():
+				timer.Stop()
+				return
+			case <-j.trigger:
+				timer.Stop()
+			case <-timer.C:
+			}
+			ctx := processCtx.Context()
+			if ctx.Err() != nil {
+				// Shutting down as the job was triggered.
+				return
+			}
+			if err := job(ctx); err != nil {
+				logger.WithError(err).Error("Background job failed")
+			}
+		}
+	}()
+	return j
+}
+
+func withJitter(interval time.Duration) time.Duration {
+	jitter := time.Duration(rand.Int63n(int64(interval)/5 + 1))
+	return interval - interval/10 + jitter
+}
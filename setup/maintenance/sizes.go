@@ -0,0 +1,205 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package maintenance
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+const (
+	enginePostgres = "postgres"
+	engineSQLite   = "sqlite3"
+)
+
+// DatabaseSize is the size of a database and its tables.
+type DatabaseSize struct {
+	Name      string      `json:"name"`
+	Engine    string      `json:"engine"`
+	SizeBytes int64       `json:"size_bytes"`
+	Tables    []TableSize `json:"tables"`
+}
+
+// TableSize is the size of a table, including its indexes. The size is unknown
+// for SQLite databases when SQLite was built without the dbstat virtual table.
+// The number of rows is an estimate on PostgreSQL.
+type TableSize struct {
+	Name      string `json:"name"`
+	SizeBytes *int64 `json:"size_bytes,omitempty"`
+	Rows      int64  `json:"rows"`
+}
+
+const selectPostgresTableSizesSQL = "" +
+	"SELECT relname, pg_total_relation_size(relid), n_live_tup FROM pg_stat_user_tables ORDER BY relname"
+
+const selectPostgresDatabaseSizeSQL = "" +
+	"SELECT pg_database_size(current_database())"
+
+const selectSQLiteTablesSQL = "" +
+	"SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name"
+
+// The dbstat virtual table lists the pages of every table and index, so join
+// it with sqlite_master to count the indexes of a table towards its size.
+const selectSQLiteTableSizesSQL = "" +
+	"SELECT m.tbl_name, SUM(s.pgsize) FROM dbstat s JOIN sqlite_master m ON s.name = m.name GROUP BY m.tbl_name"
+
+// databaseSize returns the size of a database and its tables.
+func databaseSize(ctx context.Context, db sqlutil.OpenedDatabase) (*DatabaseSize, error) {
+	size := &DatabaseSize{
+		Name: databaseName(db.ConnectionString),
+	}
+	var err error
+	if db.ConnectionString.IsSQLite() {
+		size.Engine = engineSQLite
+		err = sqliteDatabaseSize(ctx, db.DB, size)
+	} else {
+		size.Engine = enginePostgres
+		err = postgresDatabaseSize(ctx, db.DB, size)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("database %q: %w", size.Name, err)
+	}
+	return size, nil
+}
+
+func postgresDatabaseSize(ctx context.Context, db *sql.DB, size *DatabaseSize) error {
+	if err := db.QueryRowContext(ctx, selectPostgresDatabaseSizeSQL).Scan(&size.SizeBytes); err != nil {
+		return fmt.Errorf("pg_database_size: %w", err)
+	}
+	rows, err := db.QueryContext(ctx, selectPostgresTableSizesSQL)
+	if err != nil {
+		return fmt.Errorf("pg_stat_user_tables: %w", err)
+	}
+	defer rows.Close() // nolint: errcheck
+	for rows.Next() {
+		var table TableSize
+		var tableSize int64
+		if err = rows.Scan(&table.Name, &tableSize, &table.Rows); err != nil {
+			return err
+		}
+		table.SizeBytes = &tableSize
+		size.Tables = append(size.Tables, table)
+	}
+	return rows.Err()
+}
+
+func sqliteDatabaseSize(ctx context.Context, db *sql.DB, size *DatabaseSize) error {
+	var pageCount, pageSize int64
+	if err := db.QueryRowContext(ctx, "PRAGMA page_count").Scan(&pageCount); err != nil {
+		return fmt.Errorf("page_count: %w", err)
+	}
+	if err := db.QueryRowContext(ctx, "PRAGMA page_size").Scan(&pageSize); err != nil {
+		return fmt.Errorf("page_size: %w", err)
+	}
+	size.SizeBytes = pageCount * pageSize
+
+	tables, err := queryStrings(ctx, db, selectSQLiteTablesSQL)
+	if err != nil {
+		return fmt.Errorf("sqlite_master: %w", err)
+	}
+	tableSizes, err := sqliteTableSizes(ctx, db)
+	if err != nil {
+		return err
+	}
+	for _, name := range tables {
+		table := TableSize{Name: name}
+		if tableSizes != nil {
+			tableSize := tableSizes[name]
+			table.SizeBytes = &tableSize
+		}
+		// The table names come from sqlite_master, so are safe to quote.
+		query := fmt.Sprintf(`SELECT COUNT(*) FROM "%s"`, strings.ReplaceAll(name, `"`, `""`))
+		if err = db.QueryRowContext(ctx, query).Scan(&table.Rows); err != nil {
+			return fmt.Errorf("counting rows of %s: %w", name, err)
+		}
+		size.Tables = append(size.Tables, table)
+	}
+	return nil
+}
+
+// sqliteTableSizes returns the size of each table, or nil if SQLite was built
+// without the dbstat virtual table.
+func sqliteTableSizes(ctx context.Context, db *sql.DB) (map[string]int64, error) {
+	rows, err := db.QueryContext(ctx, selectSQLiteTableSizesSQL)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such table: dbstat") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("dbstat: %w", err)
+	}
+	defer rows.Close() // nolint: errcheck
+	sizes := map[string]int64{}
+	for rows.Next() {
+		var name string
+		var size int64
+		if err = rows.Scan(&name, &size); err != nil {
+			return nil, err
+		}
+		sizes[name] = size
+	}
+	return sizes, rows.Err()
+}
+
+func queryStrings(ctx context.Context, db *sql.DB, query string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+	var result []string
+	for rows.Next() {
+		var s string
+		if err = rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		result = append(result, s)
+	}
+	return result, rows.Err()
+}
+
+// databaseName returns a name for the database that doesn't include the
+// credentials from the connection string: the file name for SQLite, and the
+// host and database name for PostgreSQL.
+func databaseName(ds config.DataSource) string {
+	s := string(ds)
+	if ds.IsSQLite() {
+		s = strings.TrimPrefix(s, "file:")
+		if i := strings.Index(s, "?"); i >= 0 {
+			s = s[:i]
+		}
+		return s
+	}
+	if u, err := url.Parse(s); err == nil && u.Scheme != "" {
+		return u.Host + u.Path
+	}
+	// A key/value connection string, e.g. "host=localhost dbname=dendrite"
+	var host, dbname string
+	for _, field := range strings.Fields(s) {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "host":
+			host = value
+		case "dbname":
+			dbname = value
+		}
+	}
+	return host + "/" + dbname
+}
@@ -15,6 +15,8 @@
 package setup
 
 import (
+	"fmt"
+
 	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
 	"github.com/matrix-org/dendrite/clientapi"
 	"github.com/matrix-org/dendrite/clientapi/api"
@@ -30,6 +32,7 @@ import (
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/setup/maintenance"
 	"github.com/matrix-org/dendrite/setup/process"
 	"github.com/matrix-org/dendrite/syncapi"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
@@ -56,7 +59,8 @@ type Monolith struct {
 	ExtUserDirectoryProvider userapi.QuerySearchProfilesAPI
 }
 
-// AddAllPublicRoutes attaches all public paths to the given router
+// AddAllPublicRoutes attaches all public paths to the given router. It returns
+// an error if a component couldn't be set up.
 func (m *Monolith) AddAllPublicRoutes(
 	processCtx *process.ProcessContext,
 	cfg *config.Dendrite,
@@ -65,23 +69,31 @@ func (m *Monolith) AddAllPublicRoutes(
 	natsInstance *jetstream.NATSInstance,
 	caches *caching.Caches,
 	enableMetrics bool,
-) {
+) error {
 	userDirectoryProvider := m.ExtUserDirectoryProvider
 	if userDirectoryProvider == nil {
 		userDirectoryProvider = m.UserAPI
 	}
-	clientapi.AddPublicRoutes(
+	if err := clientapi.AddPublicRoutes(
 		processCtx, routers, cfg, natsInstance, m.FedClient, m.RoomserverAPI, m.AppserviceAPI, transactions.New(),
 		m.FederationAPI, m.UserAPI, userDirectoryProvider,
 		m.ExtPublicRoomsProvider, enableMetrics,
-	)
-	federationapi.AddPublicRoutes(
-		processCtx, routers, cfg, natsInstance, m.UserAPI, m.FedClient, m.KeyRing, m.RoomserverAPI, m.FederationAPI, enableMetrics,
-	)
-	mediaapi.AddPublicRoutes(routers.Media, cm, cfg, m.UserAPI, m.Client)
+	); err != nil {
+		return fmt.Errorf("clientapi.AddPublicRoutes: %w", err)
+	}
+	if err := federationapi.AddPublicRoutes(
+		processCtx, routers, cfg, natsInstance, m.UserAPI, m.FedClient, m.KeyRing, m.RoomserverAPI, m.FederationAPI, caches, enableMetrics,
+	); err != nil {
+		return fmt.Errorf("federationapi.AddPublicRoutes: %w", err)
+	}
+	if err := mediaapi.AddPublicRoutes(processCtx, routers, cm, cfg, m.UserAPI, m.RoomserverAPI, m.Client); err != nil {
+		return fmt.Errorf("mediaapi.AddPublicRoutes: %w", err)
+	}
 	syncapi.AddPublicRoutes(processCtx, routers, cfg, cm, natsInstance, m.UserAPI, m.RoomserverAPI, caches, enableMetrics)
+	maintenance.Setup(processCtx, cfg, routers, cm, m.UserAPI)
 
 	if m.RelayAPI != nil {
 		relayapi.AddPublicRoutes(routers, cfg, m.KeyRing, m.RelayAPI)
 	}
+	return nil
 }
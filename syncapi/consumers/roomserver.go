@@ -54,6 +54,7 @@ type OutputRoomEventConsumer struct {
 	db           storage.Database
 	pduStream    streams.StreamProvider
 	inviteStream streams.StreamProvider
+	snapshots    *streams.RoomSnapshots
 	notifier     *notifier.Notifier
 	fts          fulltext.Indexer
 	asProducer   *producers.AppserviceEventProducer
@@ -68,6 +69,7 @@ func NewOutputRoomEventConsumer(
 	notifier *notifier.Notifier,
 	pduStream streams.StreamProvider,
 	inviteStream streams.StreamProvider,
+	snapshots *streams.RoomSnapshots,
 	rsAPI api.SyncRoomserverAPI,
 	fts *fulltext.Search,
 	asProducer *producers.AppserviceEventProducer,
@@ -82,6 +84,7 @@ func NewOutputRoomEventConsumer(
 		notifier:     notifier,
 		pduStream:    pduStream,
 		inviteStream: inviteStream,
+		snapshots:    snapshots,
 		rsAPI:        rsAPI,
 		fts:          fts,
 		asProducer:   asProducer,
@@ -169,6 +172,12 @@ func (s *OutputRoomEventConsumer) onMessage(ctx context.Context, msgs []*nats.Ms
 func (s *OutputRoomEventConsumer) onRedactEvent(
 	ctx context.Context, msg api.OutputRedactedEvent,
 ) error {
+	roomID := msg.RedactedBecause.RoomID().String()
+	s.snapshots.Changing(roomID)
+	defer func() {
+		s.snapshots.Changed(roomID, s.pduStream.LatestPosition(ctx)+1)
+	}()
+
 	err := s.db.RedactEvent(ctx, msg.RedactedEventID, msg.RedactedBecause, s.rsAPI)
 	if err != nil {
 		log.WithError(err).Error("RedactEvent error'd")
@@ -195,6 +204,19 @@ func (s *OutputRoomEventConsumer) onNewRoomEvent(
 	ctx context.Context, msg api.OutputNewRoomEvent,
 ) error {
 	ev := msg.Event
+
+	// Stop initial sync snapshots of the room from being used until the
+	// event has been written.
+	var pduPos types.StreamPosition
+	roomID := ev.RoomID().String()
+	s.snapshots.Changing(roomID)
+	defer func() {
+		if pduPos == 0 {
+			pduPos = s.pduStream.LatestPosition(ctx) + 1
+		}
+		s.snapshots.Changed(roomID, pduPos)
+	}()
+
 	addsStateEvents, missingEventIDs := msg.NeededStateEventIDs()
 
 	// Work out the list of events we need to find out about. Either
@@ -278,7 +300,7 @@ func (s *OutputRoomEventConsumer) onNewRoomEvent(
 
 	ev.UserID = *userID
 
-	pduPos, err := s.db.WriteEvent(ctx, ev, addsStateEvents, msg.AddsStateEventIDs, msg.RemovesStateEventIDs, msg.TransactionID, false, msg.HistoryVisibility)
+	pduPos, err = s.db.WriteEvent(ctx, ev, addsStateEvents, msg.AddsStateEventIDs, msg.RemovesStateEventIDs, msg.TransactionID, false, msg.HistoryVisibility)
 	if err != nil {
 		// panic rather than continue with an inconsistent database
 		log.WithFields(log.Fields{
@@ -321,6 +343,16 @@ func (s *OutputRoomEventConsumer) onOldRoomEvent(
 ) error {
 	ev := msg.Event
 
+	var pduPos types.StreamPosition
+	roomID := ev.RoomID().String()
+	s.snapshots.Changing(roomID)
+	defer func() {
+		if pduPos == 0 {
+			pduPos = s.pduStream.LatestPosition(ctx) + 1
+		}
+		s.snapshots.Changed(roomID, pduPos)
+	}()
+
 	// TODO: The state key check when excluding from sync is designed
 	// to stop us from lying to clients with old state, whilst still
 	// allowing normal timeline events through. This is an absolute
@@ -334,7 +366,7 @@ func (s *OutputRoomEventConsumer) onOldRoomEvent(
 	}
 	ev.UserID = *userID
 
-	pduPos, err := s.db.WriteEvent(ctx, ev, []*rstypes.HeaderedEvent{}, []string{}, []string{}, nil, ev.StateKey() != nil, msg.HistoryVisibility)
+	pduPos, err = s.db.WriteEvent(ctx, ev, []*rstypes.HeaderedEvent{}, []string{}, []string{}, nil, ev.StateKey() != nil, msg.HistoryVisibility)
 	if err != nil {
 		// panic rather than continue with an inconsistent database
 		log.WithFields(log.Fields{
@@ -528,6 +560,9 @@ func (s *OutputRoomEventConsumer) onPurgeRoom(
 ) error {
 	logrus.WithField("room_id", req.RoomID).Warn("Purging room from sync API")
 
+	s.snapshots.Changing(req.RoomID)
+	defer s.snapshots.Changed(req.RoomID, s.pduStream.LatestPosition(ctx)+1)
+
 	if err := s.db.PurgeRoom(ctx, req.RoomID); err != nil {
 		logrus.WithField("room_id", req.RoomID).WithError(err).Error("Failed to purge room from sync API")
 		return err
@@ -53,6 +53,7 @@ func Context(
 	syncDB storage.Database,
 	roomID, eventID string,
 	lazyLoadCache caching.LazyLoadCache,
+	tokens *types.SyncTokenVerifier,
 ) util.JSONResponse {
 	snapshot, err := syncDB.NewDatabaseSnapshot(req.Context())
 	if err != nil {
@@ -241,8 +242,8 @@ func Context(
 	}
 	start, end, err := getStartEnd(ctx, snapshot, eventsBefore, eventsAfter)
 	if err == nil {
-		response.End = end.String()
-		response.Start = start.String()
+		response.End = tokens.Sign(end.String())
+		response.Start = tokens.Sign(start.String())
 	}
 	succeeded = true
 	return util.JSONResponse{
@@ -39,6 +39,7 @@ func GetMemberships(
 	req *http.Request, device *userapi.Device, roomID string,
 	syncDB storage.Database, rsAPI api.SyncRoomserverAPI,
 	membership, notMembership *string, at string,
+	tokens *types.SyncTokenVerifier,
 ) util.JSONResponse {
 	userID, err := spec.NewUserID(device.UserID, true)
 	if err != nil {
@@ -77,7 +78,7 @@ func GetMemberships(
 	}
 	defer db.Rollback() // nolint: errcheck
 
-	atToken, err := types.NewTopologyTokenFromString(at)
+	atToken, err := tokens.TopologyToken(at)
 	if err != nil {
 		atToken = types.TopologyToken{Depth: math.MaxInt64, PDUPosition: math.MaxInt64}
 		if queryRes.HasBeenInRoom && !queryRes.IsInRoom {
@@ -75,6 +75,7 @@ func OnIncomingMessagesRequest(
 	cfg *config.SyncAPI,
 	srp *sync.RequestPool,
 	lazyLoadCache caching.LazyLoadCache,
+	tokens *types.SyncTokenVerifier,
 ) util.JSONResponse {
 	var err error
 
@@ -162,13 +163,13 @@ func OnIncomingMessagesRequest(
 			// this is because Database.GetEventsInTopologicalRange is exclusive of the lower-bound.
 			from = types.TopologyToken{}
 		}
-		fromQuery = from.String()
+		fromQuery = tokens.Sign(from.String())
 	}
 
-	from, err := types.NewTopologyTokenFromString(fromQuery)
+	from, err := tokens.TopologyToken(fromQuery)
 	if err != nil {
 		var streamToken types.StreamingToken
-		if streamToken, err = types.NewStreamTokenFromString(fromQuery); err != nil {
+		if streamToken, err = tokens.StreamToken(fromQuery); err != nil {
 			return util.JSONResponse{
 				Code: http.StatusBadRequest,
 				JSON: spec.InvalidParam("Invalid from parameter: " + err.Error()),
@@ -191,10 +192,10 @@ func OnIncomingMessagesRequest(
 	var to types.TopologyToken
 	wasToProvided := true
 	if len(toQuery) > 0 {
-		to, err = types.NewTopologyTokenFromString(toQuery)
+		to, err = tokens.TopologyToken(toQuery)
 		if err != nil {
 			var streamToken types.StreamingToken
-			if streamToken, err = types.NewStreamTokenFromString(toQuery); err != nil {
+			if streamToken, err = tokens.StreamToken(toQuery); err != nil {
 				return util.JSONResponse{
 					Code: http.StatusBadRequest,
 					JSON: spec.InvalidParam("Invalid to parameter: " + err.Error()),
@@ -290,8 +291,8 @@ func OnIncomingMessagesRequest(
 
 	res := messagesResp{
 		Chunk: clientEvents,
-		Start: start.String(),
-		End:   end.String(),
+		Start: tokens.Sign(start.String()),
+		End:   tokens.Sign(end.String()),
 	}
 	if filter.LazyLoadMembers {
 		membershipEvents, err := applyLazyLoadMembers(req.Context(), device, snapshot, roomID, clientEvents, lazyLoadCache)
@@ -308,7 +309,7 @@ func OnIncomingMessagesRequest(
 	}
 
 	if fromStream != nil {
-		res.StartStream = fromStream.String()
+		res.StartStream = tokens.Sign(fromStream.String())
 	}
 
 	// Respond with the events.
@@ -35,11 +35,12 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/synctypes"
+	syncTypes "github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/dendrite/userapi/api"
 )
 
 // nolint:gocyclo
-func Search(req *http.Request, device *api.Device, syncDB storage.Database, fts fulltext.Indexer, from *string, rsAPI roomserverAPI.SyncRoomserverAPI) util.JSONResponse {
+func Search(req *http.Request, device *api.Device, syncDB storage.Database, fts fulltext.Indexer, from *string, rsAPI roomserverAPI.SyncRoomserverAPI, tokens *syncTypes.SyncTokenVerifier) util.JSONResponse {
 	start := time.Now()
 	var (
 		searchReq SearchRequest
@@ -240,8 +241,8 @@ func Search(req *http.Request, device *api.Device, syncDB storage.Database, fts
 
 		results = append(results, Result{
 			Context: SearchContextResponse{
-				Start: startToken.String(),
-				End:   endToken.String(),
+				Start: tokens.Sign(startToken.String()),
+				End:   tokens.Sign(endToken.String()),
 				EventsAfter: synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(eventsAfter), synctypes.FormatSync, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
 					return rsAPI.QueryUserIDForSender(req.Context(), roomID, senderID)
 				}),
@@ -256,7 +256,7 @@ func TestSearch(t *testing.T) {
 				assert.NoError(t, err)
 				req := httptest.NewRequest(http.MethodPost, "/", reqBody)
 
-				res := Search(req, tc.device, db, fts, tc.from, &FakeSyncRoomserverAPI{})
+				res := Search(req, tc.device, db, fts, tc.from, &FakeSyncRoomserverAPI{}, nil)
 				if !tc.wantOK && !res.Is2xx() {
 					return
 				}
@@ -0,0 +1,271 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package streams
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+
+	rstypes "github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/syncapi/synctypes"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+// The max number of rooms to keep initial sync snapshots for. Snapshots
+// hold the current state of the room, so this bounds the memory they use.
+// It also bounds the number of rooms whose last modification is tracked.
+const roomSnapshotsMax = 1024
+
+// roomSnapshot is the precomputed current state and recent timeline of
+// a room, used to answer complete syncs without going back to the
+// current state and event tables for every room.
+type roomSnapshot struct {
+	roomID  string
+	element *list.Element
+
+	// The state is valid as of the PDU position of the database snapshot
+	// it was read from. If withoutMembers is set, membership events were
+	// left out because the client that requested it was lazy-loading.
+	state          []*rstypes.HeaderedEvent
+	withoutMembers bool
+	hasState       bool
+
+	// The timeline is the result of an unfiltered RecentEvents query
+	// with the given limit.
+	timeline        []types.StreamEvent
+	timelineLimit   int
+	timelineLimited bool
+	hasTimeline     bool
+}
+
+// RoomSnapshots caches per-room initial sync snapshots. Snapshots are
+// invalidated by the roomserver consumer, which calls Changing before it
+// modifies a room and Changed afterwards, so that a snapshot is never
+// returned for a room that has been modified since it was taken.
+type RoomSnapshots struct {
+	mutex     sync.Mutex
+	snapshots map[string]*roomSnapshot
+	lru       *list.List
+	changing  map[string]int                  // room ID -> number of in-flight modifications
+	changed   map[string]types.StreamPosition // room ID -> position of the last modification
+	// The last modification of any room that has been pruned from changed,
+	// which is assumed to be the last modification of all rooms not in it.
+	prunedPos types.StreamPosition
+}
+
+func NewRoomSnapshots() *RoomSnapshots {
+	return &RoomSnapshots{
+		snapshots: make(map[string]*roomSnapshot),
+		lru:       list.New(),
+		changing:  make(map[string]int),
+		changed:   make(map[string]types.StreamPosition),
+	}
+}
+
+// Changing marks the room as being modified. No snapshot will be returned
+// or stored for the room until Changed is called.
+func (s *RoomSnapshots) Changing(roomID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.changing[roomID]++
+	s.remove(roomID)
+}
+
+// Changed records that a modification to the room has finished, with the
+// last change visible at the given PDU position.
+func (s *RoomSnapshots) Changed(roomID string, pos types.StreamPosition) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.changing[roomID] <= 1 {
+		delete(s.changing, roomID)
+	} else {
+		s.changing[roomID]--
+	}
+	if pos > s.changedPos(roomID) {
+		s.changed[roomID] = pos
+		if len(s.changed) > roomSnapshotsMax {
+			s.pruneChanged()
+		}
+	}
+	s.remove(roomID)
+}
+
+// changedPos returns the position of the last modification to the room.
+func (s *RoomSnapshots) changedPos(roomID string) types.StreamPosition {
+	if pos, ok := s.changed[roomID]; ok {
+		return pos
+	}
+	return s.prunedPos
+}
+
+// pruneChanged forgets the older half of the tracked modifications. Rooms
+// that are forgotten are treated as modified at the newest of them, which
+// at worst means snapshots taken before it aren't used.
+func (s *RoomSnapshots) pruneChanged() {
+	positions := make([]types.StreamPosition, 0, len(s.changed))
+	for _, pos := range s.changed {
+		positions = append(positions, pos)
+	}
+	sort.Slice(positions, func(i, j int) bool {
+		return positions[i] < positions[j]
+	})
+	s.prunedPos = positions[len(positions)/2]
+	for roomID, pos := range s.changed {
+		if pos <= s.prunedPos {
+			delete(s.changed, roomID)
+		}
+	}
+}
+
+// State returns the snapshotted current state of the room. The returned
+// slice and events are copies and may be modified by the caller.
+func (s *RoomSnapshots) State(roomID string, withoutMembers bool) ([]*rstypes.HeaderedEvent, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	snapshot := s.get(roomID)
+	if snapshot == nil || !snapshot.hasState {
+		return nil, false
+	}
+	if snapshot.withoutMembers && !withoutMembers {
+		return nil, false
+	}
+	return copyState(snapshot.state, withoutMembers && !snapshot.withoutMembers), true
+}
+
+// StoreState stores the current state of the room as read from a database
+// snapshot at the given PDU position.
+func (s *RoomSnapshots) StoreState(roomID string, pos types.StreamPosition, state []*rstypes.HeaderedEvent, withoutMembers bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.storable(roomID, pos) {
+		return
+	}
+	snapshot := s.getOrCreate(roomID)
+	snapshot.state = copyState(state, false)
+	snapshot.withoutMembers = withoutMembers
+	snapshot.hasState = true
+}
+
+// Timeline returns the snapshotted recent events for the room, if there
+// have been no changes to the room after the given position.
+func (s *RoomSnapshots) Timeline(roomID string, to types.StreamPosition, limit int) (types.RecentEvents, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	snapshot := s.get(roomID)
+	if snapshot == nil || !snapshot.hasTimeline || snapshot.timelineLimit != limit {
+		return types.RecentEvents{}, false
+	}
+	if s.changedPos(roomID) > to {
+		return types.RecentEvents{}, false
+	}
+	return types.RecentEvents{
+		Limited: snapshot.timelineLimited,
+		Events:  append([]types.StreamEvent{}, snapshot.timeline...),
+	}, true
+}
+
+// StoreTimeline stores the recent events for the room, as returned by an
+// unfiltered RecentEvents query up to the given position.
+func (s *RoomSnapshots) StoreTimeline(roomID string, to types.StreamPosition, limit int, recent types.RecentEvents) {
+	// Events with transaction IDs have them added to their unsigned
+	// section for the sending device, so they can't be shared.
+	for _, ev := range recent.Events {
+		if ev.TransactionID != nil {
+			return
+		}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.storable(roomID, to) {
+		return
+	}
+	snapshot := s.getOrCreate(roomID)
+	snapshot.timeline = append([]types.StreamEvent{}, recent.Events...)
+	snapshot.timelineLimit = limit
+	snapshot.timelineLimited = recent.Limited
+	snapshot.hasTimeline = true
+}
+
+// storable returns whether something read at the given position reflects
+// every change that has been made to the room.
+func (s *RoomSnapshots) storable(roomID string, pos types.StreamPosition) bool {
+	return s.changing[roomID] == 0 && s.changedPos(roomID) <= pos
+}
+
+func (s *RoomSnapshots) get(roomID string) *roomSnapshot {
+	if s.changing[roomID] > 0 {
+		return nil
+	}
+	snapshot, ok := s.snapshots[roomID]
+	if !ok {
+		return nil
+	}
+	s.lru.MoveToFront(snapshot.element)
+	return snapshot
+}
+
+func (s *RoomSnapshots) getOrCreate(roomID string) *roomSnapshot {
+	if snapshot, ok := s.snapshots[roomID]; ok {
+		s.lru.MoveToFront(snapshot.element)
+		return snapshot
+	}
+	snapshot := &roomSnapshot{roomID: roomID}
+	snapshot.element = s.lru.PushFront(snapshot)
+	s.snapshots[roomID] = snapshot
+	for s.lru.Len() > roomSnapshotsMax {
+		s.remove(s.lru.Back().Value.(*roomSnapshot).roomID)
+	}
+	return snapshot
+}
+
+func (s *RoomSnapshots) remove(roomID string) {
+	if snapshot, ok := s.snapshots[roomID]; ok {
+		s.lru.Remove(snapshot.element)
+		delete(s.snapshots, roomID)
+	}
+}
+
+// copyState copies the state events, so that they are never shared between
+// the snapshot and the syncs it is used for, leaving out membership events if
+// withoutMembers is set.
+func copyState(state []*rstypes.HeaderedEvent, withoutMembers bool) []*rstypes.HeaderedEvent {
+	copied := make([]*rstypes.HeaderedEvent, 0, len(state))
+	for _, ev := range state {
+		if withoutMembers && ev.Type() == spec.MRoomMember {
+			continue
+		}
+		evCopy := *ev
+		copied = append(copied, &evCopy)
+	}
+	return copied
+}
+
+// snapshotStateFilter returns whether the state filter can be answered from
+// a room snapshot, i.e. it doesn't restrict the state beyond lazy-loading.
+func snapshotStateFilter(filter *synctypes.StateFilter) bool {
+	return filter.Types == nil && filter.NotTypes == nil &&
+		filter.Senders == nil && filter.NotSenders == nil &&
+		filter.ContainsURL == nil
+}
+
+// snapshotTimelineFilter returns whether the timeline filter can be answered
+// from a room snapshot, i.e. it only limits the number of events.
+func snapshotTimelineFilter(filter *synctypes.RoomEventFilter) bool {
+	return filter.Types == nil && filter.NotTypes == nil &&
+		filter.Senders == nil && filter.NotSenders == nil &&
+		filter.ContainsURL == nil
+}
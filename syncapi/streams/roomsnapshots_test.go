@@ -0,0 +1,126 @@
+package streams
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+func TestRoomSnapshots(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	state := room.CurrentState()
+	snapshots := NewRoomSnapshots()
+
+	snapshots.StoreState(room.ID, 10, state, false)
+	got, ok := snapshots.State(room.ID, false)
+	if !ok || len(got) != len(state) {
+		t.Fatalf("expected %d state events, got %d (ok: %v)", len(state), len(got), ok)
+	}
+
+	// Lazy-loading clients get the state without membership events.
+	got, ok = snapshots.State(room.ID, true)
+	if !ok {
+		t.Fatalf("expected state for lazy-loading client")
+	}
+	for _, ev := range got {
+		if ev.Type() == spec.MRoomMember {
+			t.Fatalf("unexpected membership event %s", ev.EventID())
+		}
+	}
+
+	// While the room is being changed, the snapshot must not be used or stored.
+	snapshots.Changing(room.ID)
+	if _, ok = snapshots.State(room.ID, false); ok {
+		t.Fatalf("expected no state while the room is changing")
+	}
+	snapshots.StoreState(room.ID, 20, state, false)
+	snapshots.Changed(room.ID, 15)
+	if _, ok = snapshots.State(room.ID, false); ok {
+		t.Fatalf("expected no state after the room changed")
+	}
+
+	// Snapshots taken before the change must not be stored.
+	snapshots.StoreState(room.ID, 14, state, false)
+	if _, ok = snapshots.State(room.ID, false); ok {
+		t.Fatalf("expected stale state not to be stored")
+	}
+	snapshots.StoreState(room.ID, 15, state, false)
+	if _, ok = snapshots.State(room.ID, false); !ok {
+		t.Fatalf("expected state to be stored")
+	}
+
+	// Timelines are only returned for positions after the last change.
+	recent := types.RecentEvents{Limited: true}
+	snapshots.StoreTimeline(room.ID, 15, 10, recent)
+	if _, ok = snapshots.Timeline(room.ID, 14, 10); ok {
+		t.Fatalf("expected no timeline before the last change")
+	}
+	if _, ok = snapshots.Timeline(room.ID, 15, 20); ok {
+		t.Fatalf("expected no timeline for a different limit")
+	}
+	got2, ok := snapshots.Timeline(room.ID, 15, 10)
+	if !ok || !got2.Limited {
+		t.Fatalf("expected limited timeline, got %+v (ok: %v)", got2, ok)
+	}
+}
+
+func TestRoomSnapshotsCopyState(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	state := room.CurrentState()
+	snapshots := NewRoomSnapshots()
+
+	snapshots.StoreState(room.ID, 10, state, false)
+	got, ok := snapshots.State(room.ID, false)
+	if !ok {
+		t.Fatalf("expected state to be stored")
+	}
+	// Changes made for one sync must not be seen by others.
+	got[0].Visibility = "changed"
+	got, _ = snapshots.State(room.ID, false)
+	for _, ev := range got {
+		if ev.Visibility == "changed" {
+			t.Fatalf("expected the snapshot not to share events with a sync")
+		}
+	}
+	state[0].Visibility = "changed"
+	got, _ = snapshots.State(room.ID, false)
+	for _, ev := range got {
+		if ev.Visibility == "changed" {
+			t.Fatalf("expected the snapshot not to share events with the stored state")
+		}
+	}
+}
+
+func TestRoomSnapshotsPruneChanged(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	state := room.CurrentState()
+	snapshots := NewRoomSnapshots()
+
+	snapshots.Changed(room.ID, 1)
+	for i := 0; i < roomSnapshotsMax*2; i++ {
+		snapshots.Changed(fmt.Sprintf("!room%d:test", i), types.StreamPosition(i+2))
+	}
+	if len(snapshots.changed) > roomSnapshotsMax {
+		t.Fatalf("expected at most %d tracked changes, got %d", roomSnapshotsMax, len(snapshots.changed))
+	}
+	if _, ok := snapshots.changed[room.ID]; ok {
+		t.Fatalf("expected the oldest change to be pruned")
+	}
+
+	// Rooms whose changes were pruned are treated as changed at the newest
+	// pruned change, so older snapshots are still not stored.
+	snapshots.StoreState(room.ID, 2, state, false)
+	if _, ok := snapshots.State(room.ID, false); ok {
+		t.Fatalf("expected state taken before the pruned changes not to be stored")
+	}
+	snapshots.StoreState(room.ID, types.StreamPosition(roomSnapshotsMax*2+1), state, false)
+	if _, ok := snapshots.State(room.ID, false); !ok {
+		t.Fatalf("expected state taken after the pruned changes to be stored")
+	}
+}
@@ -37,6 +37,7 @@ type PDUStreamProvider struct {
 	lazyLoadCache caching.LazyLoadCache
 	rsAPI         roomserverAPI.SyncRoomserverAPI
 	notifier      *notifier.Notifier
+	snapshots     *RoomSnapshots
 }
 
 func (p *PDUStreamProvider) Setup(
@@ -90,10 +91,49 @@ func (p *PDUStreamProvider) CompleteSync(
 		eventFormat = synctypes.FormatSyncFederation
 	}
 
-	recentEvents, err := snapshot.RecentEvents(ctx, joinedRoomIDs, r, &eventFilter, true, true)
+	// The position that the database snapshot is at, which may be ahead of
+	// the latest position we know about. Room snapshots are only stored if
+	// they reflect every change made to the room up to this position.
+	snapshotPos, err := snapshot.MaxStreamPositionForPDUs(ctx)
 	if err != nil {
+		req.Log.WithError(err).Error("p.DB.MaxStreamPositionForPDUs failed")
 		return from
 	}
+
+	// Use the snapshotted timelines of rooms where we can, and only ask
+	// the database for the recent events in the remaining rooms.
+	recentEvents := make(map[string]types.RecentEvents, len(joinedRoomIDs))
+	timelineSnapshots := snapshotTimelineFilter(&eventFilter)
+	missingRoomIDs := joinedRoomIDs
+	if timelineSnapshots {
+		missingRoomIDs = make([]string, 0, len(joinedRoomIDs))
+		for _, roomID := range joinedRoomIDs {
+			if events, ok := p.snapshots.Timeline(roomID, to, eventFilter.Limit); ok {
+				recentEvents[roomID] = events
+			} else {
+				missingRoomIDs = append(missingRoomIDs, roomID)
+			}
+		}
+	}
+	if len(missingRoomIDs) > 0 {
+		missingEvents, rerr := snapshot.RecentEvents(ctx, missingRoomIDs, r, &eventFilter, true, true)
+		if rerr != nil {
+			return from
+		}
+		// The recent events only cover changes up to both our position and
+		// the database snapshot position, whichever is the lesser.
+		timelinePos := to
+		if snapshotPos < timelinePos {
+			timelinePos = snapshotPos
+		}
+		for _, roomID := range missingRoomIDs {
+			recentEvents[roomID] = missingEvents[roomID]
+			if timelineSnapshots {
+				p.snapshots.StoreTimeline(roomID, timelinePos, eventFilter.Limit, missingEvents[roomID])
+			}
+		}
+	}
+
 	// Build up a /sync response. Add joined rooms.
 	for _, roomID := range joinedRoomIDs {
 		events := recentEvents[roomID]
@@ -106,7 +146,7 @@ func (p *PDUStreamProvider) CompleteSync(
 
 		// get the join response for each room
 		jr, jerr := p.getJoinResponseForCompleteSync(
-			ctx, snapshot, roomID, &stateFilter, req.WantFullState, req.Device, false,
+			ctx, snapshot, snapshotPos, roomID, &stateFilter, req.WantFullState, req.Device, false,
 			events.Events, events.Limited, eventFormat,
 		)
 		if jerr != nil {
@@ -143,7 +183,7 @@ func (p *PDUStreamProvider) CompleteSync(
 			var jr *types.JoinResponse
 			events := recentEvents[roomID]
 			jr, err = p.getJoinResponseForCompleteSync(
-				ctx, snapshot, roomID, &stateFilter, req.WantFullState, req.Device, true,
+				ctx, snapshot, snapshotPos, roomID, &stateFilter, req.WantFullState, req.Device, true,
 				events.Events, events.Limited, eventFormat,
 			)
 			if err != nil {
@@ -543,6 +583,7 @@ func applyHistoryVisibilityFilter(
 func (p *PDUStreamProvider) getJoinResponseForCompleteSync(
 	ctx context.Context,
 	snapshot storage.DatabaseTransaction,
+	snapshotPos types.StreamPosition,
 	roomID string,
 	stateFilter *synctypes.StateFilter,
 	wantFullState bool,
@@ -570,7 +611,7 @@ func (p *PDUStreamProvider) getJoinResponseForCompleteSync(
 		}
 	}
 
-	stateEvents, err := snapshot.CurrentState(ctx, roomID, stateFilter, excludingEventIDs)
+	stateEvents, err := p.currentState(ctx, snapshot, snapshotPos, roomID, stateFilter, excludingEventIDs)
 	if err != nil {
 		return jr, err
 	}
@@ -647,6 +688,48 @@ func (p *PDUStreamProvider) getJoinResponseForCompleteSync(
 	return jr, nil
 }
 
+// currentState returns the current state of the room for a complete sync.
+// If the state filter allows it, the state is taken from the room snapshot,
+// or read in full and snapshotted for the next complete sync.
+func (p *PDUStreamProvider) currentState(
+	ctx context.Context,
+	snapshot storage.DatabaseTransaction,
+	snapshotPos types.StreamPosition,
+	roomID string,
+	stateFilter *synctypes.StateFilter,
+	excludingEventIDs []string,
+) ([]*rstypes.HeaderedEvent, error) {
+	if !snapshotStateFilter(stateFilter) {
+		return snapshot.CurrentState(ctx, roomID, stateFilter, excludingEventIDs)
+	}
+	withoutMembers := stateFilter.LazyLoadMembers && !stateFilter.IncludeRedundantMembers
+	stateEvents, ok := p.snapshots.State(roomID, withoutMembers)
+	if !ok {
+		var err error
+		stateEvents, err = snapshot.CurrentState(ctx, roomID, &synctypes.StateFilter{
+			LazyLoadMembers: withoutMembers,
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+		p.snapshots.StoreState(roomID, snapshotPos, stateEvents, withoutMembers)
+	}
+	if len(excludingEventIDs) == 0 {
+		return stateEvents, nil
+	}
+	excluded := make(map[string]struct{}, len(excludingEventIDs))
+	for _, eventID := range excludingEventIDs {
+		excluded[eventID] = struct{}{}
+	}
+	filtered := stateEvents[:0]
+	for _, ev := range stateEvents {
+		if _, ok := excluded[ev.EventID()]; !ok {
+			filtered = append(filtered, ev)
+		}
+	}
+	return filtered, nil
+}
+
 func (p *PDUStreamProvider) lazyLoadMembers(
 	ctx context.Context, snapshot storage.DatabaseTransaction, roomID string,
 	incremental, limited bool, stateFilter *synctypes.StateFilter,
@@ -22,6 +22,7 @@ type Streams struct {
 	DeviceListStreamProvider       StreamProvider
 	NotificationDataStreamProvider StreamProvider
 	PresenceStreamProvider         StreamProvider
+	RoomSnapshots                  *RoomSnapshots
 }
 
 func NewSyncStreamProviders(
@@ -29,12 +30,14 @@ func NewSyncStreamProviders(
 	rsAPI rsapi.SyncRoomserverAPI,
 	eduCache *caching.EDUCache, lazyLoadCache caching.LazyLoadCache, notifier *notifier.Notifier,
 ) *Streams {
+	snapshots := NewRoomSnapshots()
 	streams := &Streams{
 		PDUStreamProvider: &PDUStreamProvider{
 			DefaultStreamProvider: DefaultStreamProvider{DB: d},
 			lazyLoadCache:         lazyLoadCache,
 			rsAPI:                 rsAPI,
 			notifier:              notifier,
+			snapshots:             snapshots,
 		},
 		TypingStreamProvider: &TypingStreamProvider{
 			DefaultStreamProvider: DefaultStreamProvider{DB: d},
@@ -66,6 +69,7 @@ func NewSyncStreamProviders(
 			DefaultStreamProvider: DefaultStreamProvider{DB: d},
 			notifier:              notifier,
 		},
+		RoomSnapshots: snapshots,
 	}
 
 	ctx := context.TODO()
@@ -36,14 +36,14 @@ import (
 const defaultSyncTimeout = time.Duration(0)
 const DefaultTimelineLimit = 20
 
-func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Database) (*types.SyncRequest, error) {
+func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Database, tokens *types.SyncTokenVerifier) (*types.SyncRequest, error) {
 	timeout := getTimeout(req.URL.Query().Get("timeout"))
 	fullState := req.URL.Query().Get("full_state")
 	wantFullState := fullState != "" && fullState != "false"
 	since, sinceStr := types.StreamingToken{}, req.URL.Query().Get("since")
 	if sinceStr != "" {
 		var err error
-		since, err = types.NewStreamTokenFromString(sinceStr)
+		since, err = tokens.StreamToken(sinceStr)
 		if err != nil {
 			return nil, err
 		}
@@ -90,11 +90,14 @@ func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Dat
 		"limit":     filter.Room.Timeline.Limit,
 	})
 
+	res := types.NewResponse()
+	res.SignTokens(tokens)
+
 	return &types.SyncRequest{
 		Context:           req.Context(),             //
 		Log:               logger,                    //
 		Device:            &device,                   //
-		Response:          types.NewResponse(),       // Populated by all streams
+		Response:          res,                       // Populated by all streams
 		Filter:            filter,                    //
 		Since:             since,                     //
 		Timeout:           timeout,                   //
@@ -19,6 +19,7 @@ package sync
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"net"
 	"net/http"
 	"strings"
@@ -53,6 +54,7 @@ type RequestPool struct {
 	Notifier *notifier.Notifier
 	producer PresencePublisher
 	consumer PresenceConsumer
+	tokens   *types.SyncTokenVerifier
 }
 
 type PresencePublisher interface {
@@ -69,7 +71,8 @@ func NewRequestPool(
 	userAPI userapi.SyncUserAPI,
 	rsAPI roomserverAPI.SyncRoomserverAPI,
 	streams *streams.Streams, notifier *notifier.Notifier,
-	producer PresencePublisher, consumer PresenceConsumer, enableMetrics bool,
+	producer PresencePublisher, consumer PresenceConsumer,
+	tokens *types.SyncTokenVerifier, enableMetrics bool,
 ) *RequestPool {
 	if enableMetrics {
 		prometheus.MustRegister(
@@ -87,6 +90,7 @@ func NewRequestPool(
 		Notifier: notifier,
 		producer: producer,
 		consumer: consumer,
+		tokens:   tokens,
 	}
 	go rp.cleanLastSeen()
 	go rp.cleanPresence(db, time.Minute*5)
@@ -197,6 +201,9 @@ func (rp *RequestPool) updateLastSeen(req *http.Request, device *userapi.Device)
 		RemoteAddr: remoteAddr,
 		UserAgent:  req.UserAgent(),
 	}
+	if rp.cfg.Matrix.LocationHeader != "" {
+		lsreq.Location = req.Header.Get(rp.cfg.Matrix.LocationHeader)
+	}
 	lsres := &userapi.PerformLastSeenUpdateResponse{}
 	go rp.userAPI.PerformLastSeenUpdate(req.Context(), lsreq, lsres) // nolint:errcheck
 
@@ -226,9 +233,10 @@ var waitingSyncRequests = prometheus.NewGauge(
 // until a response is ready, or it times out.
 func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.Device) util.JSONResponse {
 	// Extract values from request
-	syncReq, err := newSyncRequest(req, *device, rp.db)
+	syncReq, err := newSyncRequest(req, *device, rp.db, rp.tokens)
 	if err != nil {
-		if err == types.ErrMalformedSyncToken {
+		// Not M_UNKNOWN_TOKEN, as clients treat that as being logged out.
+		if errors.Is(err, types.ErrMalformedSyncToken) || errors.Is(err, types.ErrUnknownSyncToken) {
 			return util.JSONResponse{
 				Code: http.StatusBadRequest,
 				JSON: spec.InvalidParam(err.Error()),
@@ -519,21 +527,21 @@ func (rp *RequestPool) OnIncomingKeyChangeRequest(req *http.Request, device *use
 			JSON: spec.InvalidParam("missing ?from= or ?to="),
 		}
 	}
-	fromToken, err := types.NewStreamTokenFromString(from)
+	fromToken, err := rp.tokens.StreamToken(from)
 	if err != nil {
 		return util.JSONResponse{
 			Code: 400,
 			JSON: spec.InvalidParam("bad 'from' value"),
 		}
 	}
-	toToken, err := types.NewStreamTokenFromString(to)
+	toToken, err := rp.tokens.StreamToken(to)
 	if err != nil {
 		return util.JSONResponse{
 			Code: 400,
 			JSON: spec.InvalidParam("bad 'to' value"),
 		}
 	}
-	syncReq, err := newSyncRequest(req, *device, rp.db)
+	syncReq, err := newSyncRequest(req, *device, rp.db, rp.tokens)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("newSyncRequest failed")
 		return util.JSONResponse{
@@ -0,0 +1,119 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// SyncTokenVersion is the version of the stream and topology token format.
+// It must be bumped whenever the meaning of the positions in a token changes,
+// so that tokens handed out before the change are rejected with
+// ErrUnknownSyncToken rather than silently being misinterpreted.
+const SyncTokenVersion = "v1"
+
+// Signed tokens look like "s1_2_3_4_5_6_7_8_9~v1~<mac>". Tokens without the
+// suffix were handed out before tokens were versioned.
+const syncTokenSeparator = "~"
+
+// The MAC is truncated, it only needs to stop clients from crafting tokens.
+const syncTokenMACLength = 12
+
+// SyncTokenVerifier signs the stream and topology tokens handed out to clients
+// and verifies the ones they send back. A nil verifier neither signs nor
+// verifies tokens.
+type SyncTokenVerifier struct {
+	key            []byte
+	acceptUnsigned bool
+}
+
+// NewSyncTokenVerifier returns a verifier keyed from the server's signing key,
+// so that tokens stay valid across restarts. If acceptUnsigned is set, tokens
+// issued before tokens were signed are still accepted.
+func NewSyncTokenVerifier(privateKey ed25519.PrivateKey, acceptUnsigned bool) *SyncTokenVerifier {
+	v := &SyncTokenVerifier{acceptUnsigned: acceptUnsigned}
+	if len(privateKey) == ed25519.PrivateKeySize {
+		mac := hmac.New(sha256.New, privateKey.Seed())
+		mac.Write([]byte("dendrite sync token")) // nolint: errcheck
+		v.key = mac.Sum(nil)
+	}
+	return v
+}
+
+func syncTokenMAC(key []byte, payload string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(SyncTokenVersion + syncTokenSeparator + payload)) // nolint: errcheck
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:syncTokenMACLength])
+}
+
+// Sign appends the token version and MAC to a token.
+func (v *SyncTokenVerifier) Sign(tok string) string {
+	if v == nil || v.key == nil || tok == "" {
+		return tok
+	}
+	return tok + syncTokenSeparator + SyncTokenVersion + syncTokenSeparator + syncTokenMAC(v.key, tok)
+}
+
+// Verify checks the version and MAC of a token and returns it without them.
+// Returns ErrUnknownSyncToken if the token isn't signed and unsigned tokens
+// aren't accepted, was issued with a different version or the MAC doesn't
+// match, and ErrMalformedSyncToken if it can't be parsed.
+func (v *SyncTokenVerifier) Verify(tok string) (string, error) {
+	var key []byte
+	acceptUnsigned := true
+	if v != nil {
+		key, acceptUnsigned = v.key, v.acceptUnsigned
+	}
+	payload, suffix, signed := strings.Cut(tok, syncTokenSeparator)
+	if !signed {
+		if key != nil && !acceptUnsigned {
+			return "", ErrUnknownSyncToken
+		}
+		return tok, nil
+	}
+	version, mac, ok := strings.Cut(suffix, syncTokenSeparator)
+	if !ok {
+		return "", ErrMalformedSyncToken
+	}
+	if version != SyncTokenVersion {
+		return "", ErrUnknownSyncToken
+	}
+	if key != nil && !hmac.Equal([]byte(mac), []byte(syncTokenMAC(key, payload))) {
+		return "", ErrUnknownSyncToken
+	}
+	return payload, nil
+}
+
+// StreamToken verifies and parses a stream token sent by a client.
+func (v *SyncTokenVerifier) StreamToken(tok string) (StreamingToken, error) {
+	payload, err := v.Verify(tok)
+	if err != nil {
+		return StreamingToken{}, err
+	}
+	return NewStreamTokenFromString(payload)
+}
+
+// TopologyToken verifies and parses a topology token sent by a client.
+func (v *SyncTokenVerifier) TopologyToken(tok string) (TopologyToken, error) {
+	payload, err := v.Verify(tok)
+	if err != nil {
+		return TopologyToken{}, err
+	}
+	return NewTopologyTokenFromString(payload)
+}
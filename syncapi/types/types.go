@@ -36,6 +36,10 @@ var (
 	// error to detect whether to 400 or 401 the client. It is recommended to 401 them to force a
 	// logout.
 	ErrMalformedSyncToken = errors.New("malformed sync token")
+	// This error is returned when verifying sync tokens if the token was issued with a different
+	// token version or its MAC doesn't match. Callers should 400 the client with M_INVALID_PARAM,
+	// not M_UNKNOWN_TOKEN, which clients treat as being logged out.
+	ErrUnknownSyncToken = errors.New("unknown sync token, please start again with an initial sync")
 )
 
 type StateDelta struct {
@@ -130,9 +134,14 @@ func (s StreamingToken) MarshalText() ([]byte, error) {
 	return []byte(s.String()), nil
 }
 
-// This will be used as a fallback by json.Unmarshal.
+// This will be used as a fallback by json.Unmarshal. The MAC of signed tokens
+// isn't checked, use SyncTokenVerifier to parse tokens sent by clients.
 func (s *StreamingToken) UnmarshalText(text []byte) (err error) {
-	*s, err = NewStreamTokenFromString(string(text))
+	tok, err := (*SyncTokenVerifier)(nil).Verify(string(text))
+	if err != nil {
+		return err
+	}
+	*s, err = NewStreamTokenFromString(tok)
 	return err
 }
 
@@ -230,9 +239,14 @@ func (t TopologyToken) MarshalText() ([]byte, error) {
 	return []byte(t.String()), nil
 }
 
-// This will be used as a fallback by json.Unmarshal.
+// This will be used as a fallback by json.Unmarshal. The MAC of signed tokens
+// isn't checked, use SyncTokenVerifier to parse tokens sent by clients.
 func (t *TopologyToken) UnmarshalText(text []byte) (err error) {
-	*t, err = NewTopologyTokenFromString(string(text))
+	tok, err := (*SyncTokenVerifier)(nil).Verify(string(text))
+	if err != nil {
+		return err
+	}
+	*t, err = NewTopologyTokenFromString(tok)
 	return err
 }
 
@@ -365,6 +379,14 @@ type Response struct {
 	ToDevice            *ToDeviceResponse `json:"to_device,omitempty"`
 	DeviceLists         *DeviceLists      `json:"device_lists,omitempty"`
 	DeviceListsOTKCount map[string]int    `json:"device_one_time_keys_count,omitempty"`
+	// Signs the next_batch and prev_batch tokens, if set.
+	tokens *SyncTokenVerifier
+}
+
+// SignTokens makes the response sign its next_batch and prev_batch tokens
+// with the given verifier when it is marshalled.
+func (r *Response) SignTokens(tokens *SyncTokenVerifier) {
+	r.tokens = tokens
 }
 
 func (r Response) MarshalJSON() ([]byte, error) {
@@ -390,7 +412,27 @@ func (r Response) MarshalJSON() ([]byte, error) {
 	if r.ToDevice != nil && len(r.ToDevice.Events) == 0 {
 		a.ToDevice = nil
 	}
-	return json.Marshal(a)
+	if r.tokens == nil {
+		return json.Marshal(a)
+	}
+	if r.Rooms != nil {
+		for _, rooms := range []map[string]*JoinResponse{r.Rooms.Join, r.Rooms.Peek} {
+			for _, jr := range rooms {
+				if jr.Timeline != nil {
+					jr.Timeline.tokens = r.tokens
+				}
+			}
+		}
+		for _, lr := range r.Rooms.Leave {
+			if lr.Timeline != nil {
+				lr.Timeline.tokens = r.tokens
+			}
+		}
+	}
+	return json.Marshal(struct {
+		alias
+		NextBatch string `json:"next_batch"`
+	}{a, r.tokens.Sign(r.NextBatch.String())})
 }
 
 func (r *Response) HasUpdates() bool {
@@ -455,6 +497,19 @@ type Timeline struct {
 	Events    []synctypes.ClientEvent `json:"events"`
 	Limited   bool                    `json:"limited"`
 	PrevBatch *TopologyToken          `json:"prev_batch,omitempty"`
+	// Signs the prev_batch token, if set. See Response.SignTokens.
+	tokens *SyncTokenVerifier
+}
+
+func (t Timeline) MarshalJSON() ([]byte, error) {
+	type alias Timeline
+	if t.tokens == nil || t.PrevBatch == nil {
+		return json.Marshal(alias(t))
+	}
+	return json.Marshal(struct {
+		alias
+		PrevBatch string `json:"prev_batch,omitempty"`
+	}{alias(t), t.tokens.Sign(t.PrevBatch.String())})
 }
 
 type Summary struct {
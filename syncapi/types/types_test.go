@@ -2,9 +2,12 @@ package types
 
 import (
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"math"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/matrix-org/dendrite/roomserver/types"
@@ -81,6 +84,94 @@ func TestSyncTokens(t *testing.T) {
 	}
 }
 
+func TestSignedSyncTokens(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	tokens := NewSyncTokenVerifier(key, false)
+
+	streamToken := StreamingToken{3, 1, 2, 3, 5, 0, 0, 0, 6}
+	topologyToken := TopologyToken{3, 1}
+	signedStream, signedTopology := tokens.Sign(streamToken.String()), tokens.Sign(topologyToken.String())
+	if !strings.HasPrefix(signedStream, "s3_1_2_3_5_0_0_0_6~"+SyncTokenVersion+"~") {
+		t.Fatalf("unexpected signed stream token %q", signedStream)
+	}
+	if got, err := tokens.StreamToken(signedStream); err != nil || got != streamToken {
+		t.Errorf("StreamToken(%q) = %v, %v", signedStream, got, err)
+	}
+	if got, err := tokens.TopologyToken(signedTopology); err != nil || got != topologyToken {
+		t.Errorf("TopologyToken(%q) = %v, %v", signedTopology, got, err)
+	}
+
+	// Tokens issued before tokens were versioned are rejected, unless allowed.
+	if _, err := tokens.StreamToken("s3_1_2_3_5_0_0_0_6"); !errors.Is(err, ErrUnknownSyncToken) {
+		t.Errorf("unsigned token returned %v, want ErrUnknownSyncToken", err)
+	}
+	if _, err := tokens.TopologyToken("t3_1"); !errors.Is(err, ErrUnknownSyncToken) {
+		t.Errorf("unsigned topology token returned %v, want ErrUnknownSyncToken", err)
+	}
+	transitional := NewSyncTokenVerifier(key, true)
+	if got, err := transitional.StreamToken("s3_1_2_3_5_0_0_0_6"); err != nil || got != streamToken {
+		t.Errorf("unsigned token: got %v, %v", got, err)
+	}
+
+	unknown := []string{
+		strings.Replace(signedStream, "s3_", "s4_", 1),
+		strings.Replace(signedStream, "~"+SyncTokenVersion+"~", "~v0~", 1),
+		signedStream[:len(signedStream)-1] + flipMACChar(signedStream[len(signedStream)-1]),
+	}
+	for _, tok := range unknown {
+		for _, v := range []*SyncTokenVerifier{tokens, transitional} {
+			if _, err := v.StreamToken(tok); err != ErrUnknownSyncToken {
+				t.Errorf("StreamToken(%q) returned %v, want ErrUnknownSyncToken", tok, err)
+			}
+		}
+	}
+	if _, err := tokens.TopologyToken("t4_1~" + SyncTokenVersion + "~" + strings.Split(signedTopology, "~")[2]); err != ErrUnknownSyncToken {
+		t.Errorf("tampered topology token returned %v, want ErrUnknownSyncToken", err)
+	}
+	if _, err := tokens.StreamToken("s3_1~" + SyncTokenVersion); err != ErrMalformedSyncToken {
+		t.Errorf("token without MAC returned %v, want ErrMalformedSyncToken", err)
+	}
+
+	// Tokens in /sync responses are signed.
+	res := NewResponse()
+	res.SignTokens(tokens)
+	res.NextBatch = streamToken
+	res.Rooms.Join["!room:test"] = &JoinResponse{Timeline: &Timeline{
+		Events:    []synctypes.ClientEvent{{Type: "m.room.message"}},
+		PrevBatch: &topologyToken,
+	}}
+	b, err := json.Marshal(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		NextBatch string `json:"next_batch"`
+		Rooms     struct {
+			Join map[string]struct {
+				Timeline struct {
+					PrevBatch string `json:"prev_batch"`
+				} `json:"timeline"`
+			} `json:"join"`
+		} `json:"rooms"`
+	}
+	if err = json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.NextBatch != signedStream {
+		t.Errorf("next_batch = %q, want %q", got.NextBatch, signedStream)
+	}
+	if prevBatch := got.Rooms.Join["!room:test"].Timeline.PrevBatch; prevBatch != signedTopology {
+		t.Errorf("prev_batch = %q, want %q", prevBatch, signedTopology)
+	}
+}
+
+func flipMACChar(c byte) string {
+	if c == 'A' {
+		return "B"
+	}
+	return "A"
+}
+
 func TestNewInviteResponse(t *testing.T) {
 	event := `{"auth_events":["$SbSsh09j26UAXnjd3RZqf2lyA3Kw2sY_VZJVZQAV9yA","$EwL53onrLwQ5gL8Dv3VrOOCvHiueXu2ovLdzqkNi3lo","$l2wGmz9iAwevBDGpHT_xXLUA5O8BhORxWIGU1cGi1ZM","$GsWFJLXgdlF5HpZeyWkP72tzXYWW3uQ9X28HBuTztHE"],"content":{"avatar_url":"","displayname":"neilalexander","membership":"invite"},"depth":9,"hashes":{"sha256":"8p+Ur4f8vLFX6mkIXhxI0kegPG7X3tWy56QmvBkExAg"},"origin":"matrix.org","origin_server_ts":1602087113066,"prev_events":["$1v-O6tNwhOZcA8bvCYY-Dnj1V2ZDE58lLPxtlV97S28"],"prev_state":[],"room_id":"!XbeXirGWSPXbEaGokF:matrix.org","sender":"@neilalexander:matrix.org","signatures":{"dendrite.neilalexander.dev":{"ed25519:BMJi":"05KQ5lPw0cSFsE4A0x1z7vi/3cc8bG4WHUsFWYkhxvk/XkXMGIYAYkpNThIvSeLfdcHlbm/k10AsBSKH8Uq4DA"},"matrix.org":{"ed25519:a_RXGa":"jeovuHr9E/x0sHbFkdfxDDYV/EyoeLi98douZYqZ02iYddtKhfB7R3WLay/a+D3V3V7IW0FUmPh/A404x5sYCw"}},"state_key":"@neilalexander:dendrite.neilalexander.dev","type":"m.room.member","unsigned":{"age":2512,"invite_room_state":[{"content":{"join_rule":"invite"},"sender":"@neilalexander:matrix.org","state_key":"","type":"m.room.join_rules"},{"content":{"avatar_url":"mxc://matrix.org/BpDaozLwgLnlNStxDxvLzhPr","displayname":"neilalexander","membership":"join"},"sender":"@neilalexander:matrix.org","state_key":"@neilalexander:matrix.org","type":"m.room.member"},{"content":{"name":"Test room"},"sender":"@neilalexander:matrix.org","state_key":"","type":"m.room.name"}]},"_room_version":"5"}`
 	expected := `{"invite_state":{"events":[{"content":{"join_rule":"invite"},"sender":"@neilalexander:matrix.org","state_key":"","type":"m.room.join_rules"},{"content":{"avatar_url":"mxc://matrix.org/BpDaozLwgLnlNStxDxvLzhPr","displayname":"neilalexander","membership":"join"},"sender":"@neilalexander:matrix.org","state_key":"@neilalexander:matrix.org","type":"m.room.member"},{"content":{"name":"Test room"},"sender":"@neilalexander:matrix.org","state_key":"","type":"m.room.name"},{"content":{"avatar_url":"","displayname":"neilalexander","membership":"invite"},"event_id":"$GQmw8e8-26CQv1QuFoHBHpKF1hQj61Flg3kvv_v_XWs","origin_server_ts":1602087113066,"sender":"@neilalexander:matrix.org","state_key":"@neilalexander:dendrite.neilalexander.dev","type":"m.room.member"}]}}`
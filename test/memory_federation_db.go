@@ -18,6 +18,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"sort"
 	"sync"
 	"time"
 
@@ -42,6 +43,7 @@ type InMemoryFederationDatabase struct {
 	associatedPDUs     map[spec.ServerName]map[*receipt.Receipt]struct{}
 	associatedEDUs     map[spec.ServerName]map[*receipt.Receipt]struct{}
 	relayServers       map[spec.ServerName][]spec.ServerName
+	backoffs           map[spec.ServerName]types.ServerBackoff
 }
 
 func NewInMemoryFederationDatabase() *InMemoryFederationDatabase {
@@ -55,6 +57,7 @@ func NewInMemoryFederationDatabase() *InMemoryFederationDatabase {
 		associatedPDUs:     make(map[spec.ServerName]map[*receipt.Receipt]struct{}),
 		associatedEDUs:     make(map[spec.ServerName]map[*receipt.Receipt]struct{}),
 		relayServers:       make(map[spec.ServerName][]spec.ServerName),
+		backoffs:           make(map[spec.ServerName]types.ServerBackoff),
 	}
 }
 
@@ -312,6 +315,86 @@ func (d *InMemoryFederationDatabase) IsServerBlacklisted(
 	return isBlacklisted, nil
 }
 
+func (d *InMemoryFederationDatabase) GetBlacklistedServers(
+	ctx context.Context,
+) ([]spec.ServerName, error) {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
+
+	servers := []spec.ServerName{}
+	for server := range d.blacklistedServers {
+		servers = append(servers, server)
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i] < servers[j] })
+	return servers, nil
+}
+
+func (d *InMemoryFederationDatabase) SetServerBackoff(
+	ctx context.Context,
+	serverName spec.ServerName,
+	failureCount uint32,
+	backoffUntil spec.Timestamp,
+) error {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
+
+	d.backoffs[serverName] = types.ServerBackoff{
+		ServerName:   serverName,
+		FailureCount: failureCount,
+		BackoffUntil: backoffUntil,
+	}
+	return nil
+}
+
+func (d *InMemoryFederationDatabase) RemoveServerBackoff(
+	ctx context.Context,
+	serverName spec.ServerName,
+) error {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
+
+	delete(d.backoffs, serverName)
+	return nil
+}
+
+func (d *InMemoryFederationDatabase) RemoveAllServerBackoffs(
+	ctx context.Context,
+) error {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
+
+	d.backoffs = make(map[spec.ServerName]types.ServerBackoff)
+	return nil
+}
+
+func (d *InMemoryFederationDatabase) GetServerBackoff(
+	ctx context.Context,
+	serverName spec.ServerName,
+) (*types.ServerBackoff, error) {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
+
+	backoff, ok := d.backoffs[serverName]
+	if !ok {
+		return nil, nil
+	}
+	return &backoff, nil
+}
+
+func (d *InMemoryFederationDatabase) GetServerBackoffs(
+	ctx context.Context,
+) ([]types.ServerBackoff, error) {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
+
+	backoffs := []types.ServerBackoff{}
+	for _, backoff := range d.backoffs {
+		backoffs = append(backoffs, backoff)
+	}
+	sort.Slice(backoffs, func(i, j int) bool { return backoffs[i].ServerName < backoffs[j].ServerName })
+	return backoffs, nil
+}
+
 func (d *InMemoryFederationDatabase) SetServerAssumedOffline(
 	ctx context.Context,
 	serverName spec.ServerName,
@@ -511,3 +594,19 @@ func (d *InMemoryFederationDatabase) DeleteExpiredEDUs(ctx context.Context) erro
 func (d *InMemoryFederationDatabase) PurgeRoom(ctx context.Context, roomID string) error {
 	return nil
 }
+
+func (d *InMemoryFederationDatabase) AddPartialStateRoom(ctx context.Context, room *types.PartialStateRoom) error {
+	return nil
+}
+
+func (d *InMemoryFederationDatabase) RemovePartialStateRoom(ctx context.Context, roomID string) error {
+	return nil
+}
+
+func (d *InMemoryFederationDatabase) GetPartialStateRoom(ctx context.Context, roomID string) (*types.PartialStateRoom, error) {
+	return nil, nil
+}
+
+func (d *InMemoryFederationDatabase) GetPartialStateRooms(ctx context.Context) ([]types.PartialStateRoom, error) {
+	return nil, nil
+}
@@ -40,6 +40,7 @@ type UserInternalAPI interface {
 
 	QuerySearchProfilesAPI // used by p2p demos
 	QueryAccountByLocalpart(ctx context.Context, req *QueryAccountByLocalpartRequest, res *QueryAccountByLocalpartResponse) (err error)
+	QueryUserDataExport(ctx context.Context, req *QueryUserDataExportRequest, res *QueryUserDataExportResponse) error
 }
 
 // api functions required by the appservice api
@@ -56,6 +57,9 @@ type RoomserverUserAPI interface {
 // api functions required by the media api
 type MediaUserAPI interface {
 	QueryAcccessTokenAPI
+	QueryDevices(ctx context.Context, req *QueryDevicesRequest, res *QueryDevicesResponse) error
+	QueryUserDataExport(ctx context.Context, req *QueryUserDataExportRequest, res *QueryUserDataExportResponse) error
+	QueryPolicyVersion(ctx context.Context, req *QueryPolicyVersionRequest, res *QueryPolicyVersionResponse) error
 }
 
 // api functions required by the federation api
@@ -95,12 +99,20 @@ type ClientUserAPI interface {
 	QueryPushers(ctx context.Context, req *QueryPushersRequest, res *QueryPushersResponse) error
 	QueryPushRules(ctx context.Context, userID string) (*pushrules.AccountRuleSets, error)
 	QueryAccountAvailability(ctx context.Context, req *QueryAccountAvailabilityRequest, res *QueryAccountAvailabilityResponse) error
+	QueryPolicyVersion(ctx context.Context, req *QueryPolicyVersionRequest, res *QueryPolicyVersionResponse) error
+	QueryOutdatedPolicy(ctx context.Context, req *QueryOutdatedPolicyRequest, res *QueryOutdatedPolicyResponse) error
+	PerformUpdatePolicyVersion(ctx context.Context, req *UpdatePolicyVersionRequest, res *UpdatePolicyVersionResponse) error
+	QueryShadowBanned(ctx context.Context, localpart string, serverName spec.ServerName) (bool, error)
+	PerformAdminShadowBan(ctx context.Context, localpart string, serverName spec.ServerName, shadowBanned bool) error
 	PerformAdminCreateRegistrationToken(ctx context.Context, registrationToken *clientapi.RegistrationToken) (bool, error)
 	PerformAdminListRegistrationTokens(ctx context.Context, returnAll bool, valid bool) ([]clientapi.RegistrationToken, error)
 	PerformAdminGetRegistrationToken(ctx context.Context, tokenString string) (*clientapi.RegistrationToken, error)
 	PerformAdminDeleteRegistrationToken(ctx context.Context, tokenString string) error
 	PerformAdminUpdateRegistrationToken(ctx context.Context, tokenString string, newAttributes map[string]interface{}) (*clientapi.RegistrationToken, error)
 	PerformAccountCreation(ctx context.Context, req *PerformAccountCreationRequest, res *PerformAccountCreationResponse) error
+	// PerformGuestUpgrade turns a guest account into a user account with the given
+	// password, keeping its user ID. Returns ErrorForbidden if the account isn't a guest account.
+	PerformGuestUpgrade(ctx context.Context, localpart string, serverName spec.ServerName, password string) error
 	PerformDeviceCreation(ctx context.Context, req *PerformDeviceCreationRequest, res *PerformDeviceCreationResponse) error
 	PerformDeviceUpdate(ctx context.Context, req *PerformDeviceUpdateRequest, res *PerformDeviceUpdateResponse) error
 	PerformDeviceDeletion(ctx context.Context, req *PerformDeviceDeletionRequest, res *PerformDeviceDeletionResponse) error
@@ -296,12 +308,57 @@ type QueryAccountDataResponse struct {
 // QueryDevicesRequest is the request for QueryDevices
 type QueryDevicesRequest struct {
 	UserID string
+	// Also return the session history of the devices.
+	IncludeSessions bool
 }
 
 // QueryDevicesResponse is the response for QueryDevices
 type QueryDevicesResponse struct {
 	UserExists bool
 	Devices    []Device
+	// The session history of each device, keyed by device ID, most recent first.
+	// Only populated if IncludeSessions was set.
+	Sessions map[string][]DeviceSession
+}
+
+// QueryUserDataExportRequest is the request for QueryUserDataExport
+type QueryUserDataExportRequest struct {
+	UserID string
+}
+
+// QueryUserDataExportResponse is the response for QueryUserDataExport. It holds the
+// data of a local user for a data portability request, apart from their media.
+type QueryUserDataExportResponse struct {
+	Profile     UserDataExportProfile
+	AccountData map[string]json.RawMessage // type -> data
+	Devices     []UserDataExportDevice
+	// The rooms that the user is joined to
+	Rooms []UserDataExportRoom
+}
+
+// UserDataExportProfile is the profile of the user in a data export.
+type UserDataExportProfile struct {
+	UserID      string `json:"user_id"`
+	DisplayName string `json:"displayname,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+// UserDataExportDevice is a device of the user in a data export. Access tokens are
+// deliberately left out.
+type UserDataExportDevice struct {
+	DeviceID    string `json:"device_id"`
+	DisplayName string `json:"display_name,omitempty"`
+	LastSeenTS  int64  `json:"last_seen_ts,omitempty"`
+	LastSeenIP  string `json:"last_seen_ip,omitempty"`
+	UserAgent   string `json:"user_agent,omitempty"`
+}
+
+// UserDataExportRoom is a room that the user is joined to in a data export.
+type UserDataExportRoom struct {
+	RoomID      string                     `json:"room_id"`
+	AccountData map[string]json.RawMessage `json:"account_data"`
+	// The events that the user sent in the room
+	Events []json.RawMessage `json:"events"`
 }
 
 // QuerySearchProfilesRequest is the request for QueryProfile
@@ -355,6 +412,8 @@ type PerformLastSeenUpdateRequest struct {
 	DeviceID   string
 	RemoteAddr string
 	UserAgent  string
+	// The approximate location of the client, if known.
+	Location string
 }
 
 // PerformLastSeenUpdateResponse is the response for PerformLastSeenUpdate.
@@ -375,6 +434,8 @@ type PerformDeviceCreationRequest struct {
 	IPAddr string
 	// Useragent for this device
 	UserAgent string
+	// optional: approximate location of this device, used in new device alerts
+	Location string
 	// NoDeviceListUpdate determines whether we should avoid sending a device list
 	// update for this account. Generally the only reason to do this is if the account
 	// is an appservice account.
@@ -395,11 +456,14 @@ type PerformDeviceCreationResponse struct {
 type PerformAccountDeactivationRequest struct {
 	Localpart  string
 	ServerName spec.ServerName // optional: if blank, default server name used
+	DryRun     bool            // if set, nothing is changed and the response lists what would be
 }
 
 // PerformAccountDeactivationResponse is the response for PerformAccountDeactivation
 type PerformAccountDeactivationResponse struct {
 	AccountDeactivated bool
+	Rooms              []string // the rooms the user was made to leave
+	Devices            []string // the IDs of the devices that were deleted
 }
 
 // PerformOpenIDTokenCreationRequest is the request for PerformOpenIDTokenCreation
@@ -444,6 +508,16 @@ type Device struct {
 	AccountType  AccountType
 }
 
+// DeviceSession is an IP address a device was seen using.
+type DeviceSession struct {
+	IPAddr    string
+	UserAgent string
+	// The approximate location of the client, if known.
+	Location    string
+	FirstSeenTS int64
+	LastSeenTS  int64
+}
+
 func (d *Device) UserDomain() spec.ServerName {
 	_, domain, err := gomatrixserverlib.SplitID('@', d.UserID)
 	if err != nil {
@@ -606,6 +680,40 @@ type QueryAccountAvailabilityResponse struct {
 	Available bool
 }
 
+// QueryPolicyVersionRequest is the request for QueryPolicyVersion
+type QueryPolicyVersionRequest struct {
+	Localpart  string
+	ServerName spec.ServerName
+}
+
+// QueryPolicyVersionResponse is the response for QueryPolicyVersion
+type QueryPolicyVersionResponse struct {
+	PolicyVersion string
+}
+
+// QueryOutdatedPolicyRequest is the request for QueryOutdatedPolicy
+type QueryOutdatedPolicyRequest struct {
+	PolicyVersion string
+}
+
+// QueryOutdatedPolicyResponse is the response for QueryOutdatedPolicy
+type QueryOutdatedPolicyResponse struct {
+	UserIDs []string
+}
+
+// UpdatePolicyVersionRequest is the request for PerformUpdatePolicyVersion
+type UpdatePolicyVersionRequest struct {
+	PolicyVersion string
+	Localpart     string
+	ServerName    spec.ServerName
+	// ServerNoticeUpdate is true if the user was sent a server notice about the
+	// policy version rather than having accepted it.
+	ServerNoticeUpdate bool
+}
+
+// UpdatePolicyVersionResponse is the response for PerformUpdatePolicyVersion
+type UpdatePolicyVersionResponse struct{}
+
 type QueryAccountByPasswordRequest struct {
 	Localpart         string
 	ServerName        spec.ServerName
@@ -0,0 +1,312 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+const (
+	// NewDeviceAlertsAccountDataType is the global account data users can set
+	// to {"enabled": false} to stop receiving new device alerts.
+	NewDeviceAlertsAccountDataType = "org.matrix.dendrite.new_device_alerts"
+	// NewDeviceEventType is the type of the to-device message sent to the other
+	// devices of a user when a new device logs in.
+	NewDeviceEventType = "org.matrix.dendrite.new_device"
+	// LocaleAccountDataType is the global account data users can set to e.g.
+	// {"locale": "de"} to receive emails in their language, if the server has
+	// localized emails for it.
+	LocaleAccountDataType = "org.matrix.dendrite.locale"
+)
+
+// newDeviceAlert is the content of the new device to-device message.
+type newDeviceAlert struct {
+	DeviceID    string         `json:"device_id"`
+	DisplayName string         `json:"display_name,omitempty"`
+	IPAddr      string         `json:"ip,omitempty"`
+	UserAgent   string         `json:"user_agent,omitempty"`
+	Location    string         `json:"location,omitempty"`
+	LoggedInAt  spec.Timestamp `json:"logged_in_at"`
+}
+
+// sendNewDeviceAlert notifies the user about a device that just logged into
+// their account, unless alerts are disabled or the user opted out. Failures are
+// only logged, as they shouldn't prevent the login.
+func (a *UserInternalAPI) sendNewDeviceAlert(ctx context.Context, req *api.PerformDeviceCreationRequest, dev *api.Device) {
+	cfg := &a.Config.NewDeviceAlerts
+	if !cfg.Enabled {
+		return
+	}
+	logger := util.GetLogger(ctx).WithFields(logrus.Fields{
+		"user_id":   dev.UserID,
+		"device_id": dev.ID,
+	})
+	if !a.newDeviceAlertsEnabledFor(ctx, req.Localpart, dev.UserDomain()) {
+		return
+	}
+
+	alert := newDeviceAlert{
+		DeviceID:    dev.ID,
+		DisplayName: dev.DisplayName,
+		IPAddr:      stripPort(req.IPAddr),
+		UserAgent:   req.UserAgent,
+		Location:    req.Location,
+		LoggedInAt:  spec.AsTimestamp(time.Now()),
+	}
+	content, err := json.Marshal(alert)
+	if err != nil {
+		logger.WithError(err).Error("Failed to marshal new device alert")
+		return
+	}
+	devices, err := a.DB.GetDevicesByLocalpart(ctx, req.Localpart, dev.UserDomain())
+	if err != nil {
+		logger.WithError(err).Error("Failed to get devices for new device alert")
+		return
+	}
+	for _, other := range devices {
+		if other.ID == dev.ID {
+			continue
+		}
+		if err = a.SyncProducer.SendToDevice(dev.UserID, other.ID, gomatrixserverlib.SendToDeviceEvent{
+			Sender:  dev.UserID,
+			Type:    NewDeviceEventType,
+			Content: content,
+		}); err != nil {
+			logger.WithError(err).Error("Failed to send new device alert")
+		}
+	}
+
+	if !cfg.Email {
+		return
+	}
+	threepids, err := a.DB.GetThreePIDsForLocalpart(ctx, req.Localpart, dev.UserDomain())
+	if err != nil {
+		logger.WithError(err).Error("Failed to get email addresses for new device alert")
+		return
+	}
+	var to []string
+	for _, threepid := range threepids {
+		if threepid.Medium == "email" {
+			to = append(to, threepid.Address)
+		}
+	}
+	if len(to) == 0 {
+		return
+	}
+	locale := a.emailLocale(ctx, req.Localpart, dev.UserDomain())
+	subject, body, err := newDeviceAlertEmail(cfg, locale, dev.UserID, &alert)
+	if err != nil {
+		logger.WithError(err).Error("Failed to build new device alert email")
+		return
+	}
+	// Sending emails can take a while, so don't hold up the login. The login
+	// request context is done once it has been answered, so use the process
+	// context, which is cancelled on shutdown.
+	go func() {
+		if err := sendEmail(a.ProcessContext.Context(), &cfg.SMTP, to, subject, body); err != nil {
+			logger.WithError(err).Error("Failed to send new device alert email")
+		}
+	}()
+}
+
+// newDeviceAlertsEnabledFor returns false if the user opted out of new device alerts.
+func (a *UserInternalAPI) newDeviceAlertsEnabledFor(ctx context.Context, localpart string, serverName spec.ServerName) bool {
+	data, err := a.DB.GetAccountDataByType(ctx, localpart, serverName, "", NewDeviceAlertsAccountDataType)
+	if err != nil || data == nil {
+		return true
+	}
+	var settings struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err = json.Unmarshal(data, &settings); err != nil || settings.Enabled == nil {
+		return true
+	}
+	return *settings.Enabled
+}
+
+// emailLocale returns the locale the user chose for emails, or an empty string.
+func (a *UserInternalAPI) emailLocale(ctx context.Context, localpart string, serverName spec.ServerName) string {
+	data, err := a.DB.GetAccountDataByType(ctx, localpart, serverName, "", LocaleAccountDataType)
+	if err != nil || data == nil {
+		return ""
+	}
+	var settings struct {
+		Locale string `json:"locale"`
+	}
+	if err = json.Unmarshal(data, &settings); err != nil {
+		return ""
+	}
+	return settings.Locale
+}
+
+// defaultNewDeviceAlertEmailTemplate is used when no template is configured.
+var defaultNewDeviceAlertEmailTemplate = template.Must(template.New("new_device_alert").Parse(`A new device logged into your account {{.UserID}}.
+
+Device ID: {{.DeviceID}}
+{{if .DisplayName}}Device name: {{.DisplayName}}
+{{end}}{{if .IPAddr}}IP address: {{.IPAddr}}
+{{end}}{{if .UserAgent}}User agent: {{.UserAgent}}
+{{end}}{{if .Location}}Approximate location: {{.Location}}
+{{end}}Time: {{.Time}}
+
+If this wasn't you, change your password and log out the device from one of your other sessions.
+`))
+
+// newDeviceAlertEmailData is passed to the new device alert email template.
+type newDeviceAlertEmailData struct {
+	UserID      string
+	DeviceID    string
+	DisplayName string
+	IPAddr      string
+	UserAgent   string
+	Location    string
+	Time        string
+}
+
+// newDeviceAlertEmail returns the subject and the rendered body of the email
+// for the locale, falling back to the configured email template, or the default
+// one if none is configured.
+func newDeviceAlertEmail(cfg *config.NewDeviceAlerts, locale, userID string, alert *newDeviceAlert) (string, string, error) {
+	subject, tmpl := cfg.EmailSubject, cfg.EmailTemplate
+	if tmpl == nil {
+		tmpl = defaultNewDeviceAlertEmailTemplate
+	}
+	if localized := cfg.LocalizedEmail(locale); localized != nil {
+		if localized.Subject != "" {
+			subject = localized.Subject
+		}
+		if localized.Template != nil {
+			tmpl = localized.Template
+		}
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, newDeviceAlertEmailData{
+		UserID:      userID,
+		DeviceID:    alert.DeviceID,
+		DisplayName: alert.DisplayName,
+		IPAddr:      alert.IPAddr,
+		UserAgent:   alert.UserAgent,
+		Location:    alert.Location,
+		Time:        alert.LoggedInAt.Time().UTC().Format(time.RFC1123),
+	}); err != nil {
+		return "", "", fmt.Errorf("failed to render new device alert email: %w", err)
+	}
+	// Mail bodies use CRLF line endings.
+	return subject, strings.ReplaceAll(strings.ReplaceAll(b.String(), "\r\n", "\n"), "\n", "\r\n"), nil
+}
+
+// smtpTimeout is how long sending an email may take before giving up.
+const smtpTimeout = time.Minute
+
+// sendEmail sends a plain text email using the configured SMTP server. It gives
+// up after smtpTimeout, or once ctx is done.
+func sendEmail(ctx context.Context, cfg *config.SMTP, to []string, subject, body string) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(body)
+
+	host, _, err := net.SplitHostPort(cfg.Host)
+	if err != nil {
+		return fmt.Errorf("invalid SMTP host %q: %w", cfg.Host, err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, smtpTimeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", cfg.Host)
+	if err != nil {
+		return fmt.Errorf("failed to connect to the SMTP server: %w", err)
+	}
+	defer conn.Close() // nolint: errcheck
+	deadline, _ := ctx.Deadline()
+	if err = conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	// Interrupt the conversation with the server if ctx is cancelled before
+	// the deadline, e.g. on shutdown.
+	sent := make(chan struct{})
+	defer close(sent)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-sent:
+		}
+	}()
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close() // nolint: errcheck
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if cfg.Username != "" {
+		if err = c.Auth(smtp.PlainAuth("", cfg.Username, cfg.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(cfg.From); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err = c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg.Bytes()); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// stripPort removes the port from an address, if it has one.
+func stripPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
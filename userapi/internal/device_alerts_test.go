@@ -0,0 +1,85 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func Test_newDeviceAlertEmail(t *testing.T) {
+	alert := &newDeviceAlert{DeviceID: "DEVICE", IPAddr: "127.0.0.1"}
+
+	cfg := &config.NewDeviceAlerts{EmailSubject: "New login"}
+	subject, body, err := newDeviceAlertEmail(cfg, "", "@alice:test", alert)
+	if err != nil {
+		t.Fatalf("failed to render default template: %v", err)
+	}
+	if subject != "New login" {
+		t.Fatalf("expected the configured subject, got %q", subject)
+	}
+	for _, want := range []string{"@alice:test", "Device ID: DEVICE\r\n", "IP address: 127.0.0.1\r\n"} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected body to contain %q, got %q", want, body)
+		}
+	}
+	if strings.Contains(body, "User agent") {
+		t.Fatalf("expected empty fields to be left out, got %q", body)
+	}
+
+	path := filepath.Join(t.TempDir(), "alert.tmpl")
+	if err = os.WriteFile(path, []byte("{{.UserID}} logged in from {{.IPAddr}}\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg.EmailTemplatePath = config.Path(path)
+	cfg.EmailTemplate, err = template.ParseFiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, body, err = newDeviceAlertEmail(cfg, "", "@alice:test", alert)
+	if err != nil {
+		t.Fatalf("failed to render custom template: %v", err)
+	}
+	if want := "@alice:test logged in from 127.0.0.1\r\n"; body != want {
+		t.Fatalf("expected %q, got %q", want, body)
+	}
+
+	cfg.LocalizedEmails = map[string]*config.LocalizedEmail{
+		"de": {
+			Subject:  "Neue Anmeldung",
+			Template: template.Must(template.New("de").Parse("{{.UserID}} hat sich von {{.IPAddr}} angemeldet\n")),
+		},
+		"fr": {Subject: "Nouvelle connexion"},
+	}
+	for locale, want := range map[string][2]string{
+		"de":    {"Neue Anmeldung", "@alice:test hat sich von 127.0.0.1 angemeldet\r\n"},
+		"de_AT": {"Neue Anmeldung", "@alice:test hat sich von 127.0.0.1 angemeldet\r\n"},
+		"fr":    {"Nouvelle connexion", "@alice:test logged in from 127.0.0.1\r\n"},
+		"nl":    {"New login", "@alice:test logged in from 127.0.0.1\r\n"},
+	} {
+		subject, body, err = newDeviceAlertEmail(cfg, locale, "@alice:test", alert)
+		if err != nil {
+			t.Fatalf("failed to render template for locale %q: %v", locale, err)
+		}
+		if subject != want[0] || body != want[1] {
+			t.Fatalf("locale %q: expected %q and %q, got %q and %q", locale, want[0], want[1], subject, body)
+		}
+	}
+}
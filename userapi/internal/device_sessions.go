@@ -0,0 +1,107 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+// How often a device session that hasn't changed is written again, to keep its
+// last seen time current. Clients sync much more often than this.
+const deviceSessionRefreshInterval = time.Minute * 10
+
+type deviceSessionKey struct {
+	localpart  string
+	serverName spec.ServerName
+	deviceID   string
+}
+
+// storedDeviceSession is the session of a device that was last written to the
+// database.
+type storedDeviceSession struct {
+	ipAddr    string
+	userAgent string
+	storedAt  time.Time
+}
+
+// storeDeviceSession adds the IP address to the session history of the device and
+// applies the configured retention limits. Nothing is written if the device is still
+// using the IP address and user agent that were last stored for it, unless that was
+// longer than deviceSessionRefreshInterval ago. Failures are only logged, as the
+// history is informational.
+func (a *UserInternalAPI) storeDeviceSession(
+	ctx context.Context, localpart string, serverName spec.ServerName, deviceID, ipAddr, userAgent, location string,
+) {
+	cfg := &a.Config.DeviceSessions
+	ipAddr = stripPort(ipAddr)
+	if cfg.MaxPerDevice <= 0 || ipAddr == "" {
+		return
+	}
+	now := time.Now()
+	key := deviceSessionKey{localpart: localpart, serverName: serverName, deviceID: deviceID}
+	if v, ok := a.storedSessions.Load(key); ok {
+		last := v.(storedDeviceSession)
+		if last.ipAddr == ipAddr && last.userAgent == userAgent && now.Sub(last.storedAt) < deviceSessionRefreshInterval {
+			return
+		}
+	}
+	var before int64
+	if cfg.MaxAge > 0 {
+		before = now.Add(-cfg.MaxAge).UnixMilli()
+	}
+	session := &api.DeviceSession{
+		IPAddr:      ipAddr,
+		UserAgent:   userAgent,
+		Location:    location,
+		FirstSeenTS: now.UnixMilli(),
+		LastSeenTS:  now.UnixMilli(),
+	}
+	if err := a.DB.StoreDeviceSession(ctx, localpart, serverName, deviceID, session, cfg.MaxPerDevice, before); err != nil {
+		util.GetLogger(ctx).WithError(err).WithFields(logrus.Fields{
+			"localpart": localpart,
+			"device_id": deviceID,
+		}).Error("Failed to store device session")
+		return
+	}
+	a.storedSessions.Store(key, storedDeviceSession{ipAddr: ipAddr, userAgent: userAgent, storedAt: now})
+	a.forgetStaleDeviceSessions(now)
+}
+
+// forgetStaleDeviceSessions stops remembering the sessions that were stored long
+// enough ago that they would be written again anyway, so that devices that are
+// no longer used don't stay in memory. It only looks at them once per refresh
+// interval.
+func (a *UserInternalAPI) forgetStaleDeviceSessions(now time.Time) {
+	a.storedSessionsMutex.Lock()
+	if now.Sub(a.storedSessionsSwept) < deviceSessionRefreshInterval {
+		a.storedSessionsMutex.Unlock()
+		return
+	}
+	a.storedSessionsSwept = now
+	a.storedSessionsMutex.Unlock()
+	a.storedSessions.Range(func(key, value interface{}) bool {
+		if now.Sub(value.(storedDeviceSession).storedAt) >= deviceSessionRefreshInterval {
+			a.storedSessions.Delete(key)
+		}
+		return true
+	})
+}
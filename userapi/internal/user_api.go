@@ -21,6 +21,7 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"sync"
 	"time"
 
 	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
@@ -40,6 +41,7 @@ import (
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	rsapi "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
 	synctypes "github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/producers"
@@ -62,6 +64,15 @@ type UserInternalAPI struct {
 	PgClient    pushgateway.Client
 	FedClient   fedsenderapi.KeyserverFederationAPI
 	Updater     *DeviceListUpdater
+	// ProcessContext outlives requests, for work such as sending emails which
+	// continues after the response.
+	ProcessContext *process.ProcessContext
+
+	// The sessions that were last stored for each device, so that they aren't
+	// written again on every request
+	storedSessions      sync.Map // deviceSessionKey -> storedDeviceSession
+	storedSessionsMutex sync.Mutex
+	storedSessionsSwept time.Time
 }
 
 func (a *UserInternalAPI) PerformAdminCreateRegistrationToken(ctx context.Context, registrationToken *clientapi.RegistrationToken) (bool, error) {
@@ -266,6 +277,31 @@ func (a *UserInternalAPI) PerformAccountCreation(ctx context.Context, req *api.P
 	return nil
 }
 
+// PerformGuestUpgrade turns the guest account into a user account with the given
+// password. The account then gets the profile and rooms of a newly registered user.
+func (a *UserInternalAPI) PerformGuestUpgrade(ctx context.Context, localpart string, serverName spec.ServerName, password string) error {
+	if !a.Config.Matrix.IsLocalServerName(serverName) {
+		return fmt.Errorf("server name %s is not local", serverName)
+	}
+	upgraded, err := a.DB.UpgradeGuestAccount(ctx, localpart, serverName, password)
+	if err != nil {
+		return fmt.Errorf("a.DB.UpgradeGuestAccount: %w", err)
+	}
+	if !upgraded {
+		return &api.ErrorForbidden{Message: "only guest accounts can be upgraded"}
+	}
+
+	if _, _, err = a.DB.SetDisplayName(ctx, localpart, serverName, localpart); err != nil {
+		return fmt.Errorf("a.DB.SetDisplayName: %w", err)
+	}
+	acc, err := a.DB.GetAccountByLocalpart(ctx, localpart, serverName)
+	if err != nil {
+		return fmt.Errorf("a.DB.GetAccountByLocalpart: %w", err)
+	}
+	postRegisterJoinRooms(a.Config, acc, a.RSAPI)
+	return nil
+}
+
 func (a *UserInternalAPI) PerformPasswordUpdate(ctx context.Context, req *api.PerformPasswordUpdateRequest, res *api.PerformPasswordUpdateResponse) error {
 	if !a.Config.Matrix.IsLocalServerName(req.ServerName) {
 		return fmt.Errorf("server name %s is not local", req.ServerName)
@@ -312,9 +348,13 @@ func (a *UserInternalAPI) PerformDeviceCreation(ctx context.Context, req *api.Pe
 	}
 	res.DeviceCreated = true
 	res.Device = dev
+	a.storeDeviceSession(ctx, req.Localpart, serverName, dev.ID, req.IPAddr, req.UserAgent, req.Location)
 	if req.NoDeviceListUpdate || isExisting {
 		return nil
 	}
+	if !req.FromRegistration {
+		a.sendNewDeviceAlert(ctx, req, dev)
+	}
 	// create empty device keys and upload them to trigger device list changes
 	return a.deviceListUpdate(dev.UserID, []string{dev.ID}, req.FromRegistration)
 }
@@ -401,6 +441,7 @@ func (a *UserInternalAPI) PerformLastSeenUpdate(
 	if err := a.DB.UpdateDeviceLastSeen(ctx, localpart, domain, req.DeviceID, req.RemoteAddr, req.UserAgent); err != nil {
 		return fmt.Errorf("a.DeviceDB.UpdateDeviceLastSeen: %w", err)
 	}
+	a.storeDeviceSession(ctx, localpart, domain, req.DeviceID, req.RemoteAddr, req.UserAgent, req.Location)
 	return nil
 }
 
@@ -521,6 +562,11 @@ func (a *UserInternalAPI) QueryDevices(ctx context.Context, req *api.QueryDevice
 	}
 	res.UserExists = true
 	res.Devices = devs
+	if req.IncludeSessions {
+		if res.Sessions, err = a.DB.GetDeviceSessions(ctx, local, domain); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -660,8 +706,24 @@ func (a *UserInternalAPI) PerformAccountDeactivation(ctx context.Context, req *a
 		return fmt.Errorf("server name %q not locally configured", serverName)
 	}
 
+	if _, err := a.DB.GetAccountByLocalpart(ctx, req.Localpart, serverName); err != nil {
+		return err
+	}
 	userID := fmt.Sprintf("@%s:%s", req.Localpart, serverName)
-	_, err := a.RSAPI.PerformAdminEvacuateUser(ctx, userID)
+	devices, err := a.DB.GetDevicesByLocalpart(ctx, req.Localpart, serverName)
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		res.Devices = append(res.Devices, device.ID)
+	}
+	if req.DryRun {
+		// Report what would be left and deleted without changing anything.
+		res.Rooms, err = a.RSAPI.PerformAdminEvacuateUser(ctx, userID, true)
+		return err
+	}
+
+	res.Rooms, err = a.RSAPI.PerformAdminEvacuateUser(ctx, userID, false)
 	if err != nil {
 		logrus.WithError(err).WithField("userID", userID).Errorf("Failed to evacuate user after account deactivation")
 	}
@@ -930,6 +992,47 @@ func (a *UserInternalAPI) QueryAccountAvailability(ctx context.Context, req *api
 	return err
 }
 
+// QueryPolicyVersion returns the policy version the given user has accepted.
+func (a *UserInternalAPI) QueryPolicyVersion(ctx context.Context, req *api.QueryPolicyVersionRequest, res *api.QueryPolicyVersionResponse) error {
+	var err error
+	res.PolicyVersion, err = a.DB.GetPrivacyPolicy(ctx, req.Localpart, req.ServerName)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	return nil
+}
+
+// QueryOutdatedPolicy returns all users who haven't accepted the given policy version yet.
+func (a *UserInternalAPI) QueryOutdatedPolicy(ctx context.Context, req *api.QueryOutdatedPolicyRequest, res *api.QueryOutdatedPolicyResponse) error {
+	var err error
+	res.UserIDs, err = a.DB.GetOutdatedPolicy(ctx, req.PolicyVersion)
+	return err
+}
+
+// PerformUpdatePolicyVersion updates the policy version the given user has accepted or was notified about.
+func (a *UserInternalAPI) PerformUpdatePolicyVersion(ctx context.Context, req *api.UpdatePolicyVersionRequest, res *api.UpdatePolicyVersionResponse) error {
+	return a.DB.UpdatePolicyVersion(ctx, req.PolicyVersion, req.Localpart, req.ServerName, req.ServerNoticeUpdate)
+}
+
+// QueryShadowBanned returns whether the given user is shadow banned.
+func (a *UserInternalAPI) QueryShadowBanned(ctx context.Context, localpart string, serverName spec.ServerName) (bool, error) {
+	shadowBanned, err := a.DB.IsShadowBanned(ctx, localpart, serverName)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return shadowBanned, err
+}
+
+// PerformAdminShadowBan shadow bans or unbans the given user. Returns
+// sql.ErrNoRows if the account doesn't exist.
+func (a *UserInternalAPI) PerformAdminShadowBan(ctx context.Context, localpart string, serverName spec.ServerName, shadowBanned bool) error {
+	acc, err := a.DB.GetAccountByLocalpart(ctx, localpart, serverName)
+	if err != nil {
+		return err
+	}
+	return a.DB.SetShadowBanned(ctx, acc.Localpart, serverName, shadowBanned)
+}
+
 func (a *UserInternalAPI) QueryAccountByPassword(ctx context.Context, req *api.QueryAccountByPasswordRequest, res *api.QueryAccountByPasswordResponse) error {
 	acc, err := a.DB.GetAccountByPassword(ctx, req.Localpart, req.ServerName, req.PlaintextPassword)
 	switch err {
@@ -0,0 +1,96 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+// QueryUserDataExport collects the profile, account data and devices of a local user
+// and the events they sent in the rooms they are joined to, for a data portability
+// request. Their media is exported by the media API.
+func (a *UserInternalAPI) QueryUserDataExport(ctx context.Context, req *api.QueryUserDataExportRequest, res *api.QueryUserDataExportResponse) error {
+	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return err
+	}
+	if !a.Config.Matrix.IsLocalServerName(domain) {
+		return fmt.Errorf("cannot export the data of remote users (server name %s)", domain)
+	}
+	userID, err := spec.NewUserID(req.UserID, true)
+	if err != nil {
+		return err
+	}
+
+	profile, err := a.QueryProfile(ctx, req.UserID)
+	if err != nil {
+		return fmt.Errorf("a.QueryProfile: %w", err)
+	}
+	res.Profile = api.UserDataExportProfile{
+		UserID:      req.UserID,
+		DisplayName: profile.DisplayName,
+		AvatarURL:   profile.AvatarURL,
+	}
+
+	global, roomAccountData, err := a.DB.GetAccountData(ctx, local, domain)
+	if err != nil {
+		return fmt.Errorf("a.DB.GetAccountData: %w", err)
+	}
+	res.AccountData = global
+
+	devices, err := a.DB.GetDevicesByLocalpart(ctx, local, domain)
+	if err != nil {
+		return fmt.Errorf("a.DB.GetDevicesByLocalpart: %w", err)
+	}
+	res.Devices = make([]api.UserDataExportDevice, 0, len(devices))
+	for _, device := range devices {
+		res.Devices = append(res.Devices, api.UserDataExportDevice{
+			DeviceID:    device.ID,
+			DisplayName: device.DisplayName,
+			LastSeenTS:  device.LastSeenTS,
+			LastSeenIP:  device.LastSeenIP,
+			UserAgent:   device.UserAgent,
+		})
+	}
+
+	roomIDs, err := a.RSAPI.QueryRoomsForUser(ctx, *userID, spec.Join)
+	if err != nil {
+		return fmt.Errorf("a.RSAPI.QueryRoomsForUser: %w", err)
+	}
+	res.Rooms = make([]api.UserDataExportRoom, 0, len(roomIDs))
+	for _, roomID := range roomIDs {
+		room := api.UserDataExportRoom{
+			RoomID:      roomID.String(),
+			AccountData: roomAccountData[roomID.String()],
+			Events:      []json.RawMessage{},
+		}
+		events, err := a.RSAPI.QueryUserEventsInRoom(ctx, roomID, *userID)
+		if err != nil {
+			return fmt.Errorf("a.RSAPI.QueryUserEventsInRoom: %w", err)
+		}
+		for _, event := range events {
+			room.Events = append(room.Events, event.JSON())
+		}
+		res.Rooms = append(res.Rooms, room)
+	}
+	return nil
+}
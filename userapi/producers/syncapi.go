@@ -10,6 +10,7 @@ import (
 
 	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/dendrite/userapi/storage"
 )
 
@@ -23,14 +24,16 @@ type SyncAPI struct {
 	producer              JetStreamPublisher
 	clientDataTopic       string
 	notificationDataTopic string
+	sendToDeviceTopic     string
 }
 
-func NewSyncAPI(db storage.UserDatabase, js JetStreamPublisher, clientDataTopic string, notificationDataTopic string) *SyncAPI {
+func NewSyncAPI(db storage.UserDatabase, js JetStreamPublisher, clientDataTopic, notificationDataTopic, sendToDeviceTopic string) *SyncAPI {
 	return &SyncAPI{
 		db:                    db,
 		producer:              js,
 		clientDataTopic:       clientDataTopic,
 		notificationDataTopic: notificationDataTopic,
+		sendToDeviceTopic:     sendToDeviceTopic,
 	}
 }
 
@@ -100,3 +103,29 @@ func (p *SyncAPI) sendNotificationData(userID string, data *eventutil.Notificati
 	_, err = p.producer.PublishMsg(m)
 	return err
 }
+
+// SendToDevice sends a to-device message to a local device.
+func (p *SyncAPI) SendToDevice(userID, deviceID string, event gomatrixserverlib.SendToDeviceEvent) error {
+	m := nats.NewMsg(p.sendToDeviceTopic)
+	m.Header.Set("sender", event.Sender)
+	m.Header.Set(jetstream.UserID, userID)
+
+	var err error
+	m.Data, err = json.Marshal(types.OutputSendToDeviceEvent{
+		UserID:            userID,
+		DeviceID:          deviceID,
+		SendToDeviceEvent: event,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"user_id":   userID,
+		"device_id": deviceID,
+		"type":      event.Type,
+	}).Tracef("Producing to topic '%s'", p.sendToDeviceTopic)
+
+	_, err = p.producer.PublishMsg(m)
+	return err
+}
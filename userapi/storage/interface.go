@@ -58,6 +58,18 @@ type Account interface {
 	GetAccountByLocalpart(ctx context.Context, localpart string, serverName spec.ServerName) (*api.Account, error)
 	DeactivateAccount(ctx context.Context, localpart string, serverName spec.ServerName) (err error)
 	SetPassword(ctx context.Context, localpart string, serverName spec.ServerName, plaintextPassword string) error
+	GetPrivacyPolicy(ctx context.Context, localpart string, serverName spec.ServerName) (policyVersion string, err error)
+	// GetOutdatedPolicy returns the user IDs of users who haven't accepted the given
+	// policy version and haven't been sent a server notice about it yet.
+	GetOutdatedPolicy(ctx context.Context, policyVersion string) (userIDs []string, err error)
+	// UpdatePolicyVersion records that the user accepted the given policy version, or,
+	// if serverNotice is true, that they were sent a server notice about it.
+	UpdatePolicyVersion(ctx context.Context, policyVersion, localpart string, serverName spec.ServerName, serverNotice bool) error
+	SetShadowBanned(ctx context.Context, localpart string, serverName spec.ServerName, shadowBanned bool) error
+	IsShadowBanned(ctx context.Context, localpart string, serverName spec.ServerName) (bool, error)
+	// UpgradeGuestAccount turns the guest account into a user account with the
+	// given password. Returns false if there is no such guest account.
+	UpgradeGuestAccount(ctx context.Context, localpart string, serverName spec.ServerName, plaintextPassword string) (bool, error)
 }
 
 type AccountData interface {
@@ -85,6 +97,10 @@ type Device interface {
 	CreateDevice(ctx context.Context, localpart string, serverName spec.ServerName, deviceID *string, accessToken string, displayName *string, ipAddr, userAgent string) (dev *api.Device, returnErr error)
 	UpdateDevice(ctx context.Context, localpart string, serverName spec.ServerName, deviceID string, displayName *string) error
 	UpdateDeviceLastSeen(ctx context.Context, localpart string, serverName spec.ServerName, deviceID, ipAddr, userAgent string) error
+	// StoreDeviceSession records the IP address a device was seen using, keeping at most
+	// maxSessions sessions per device and none last seen before the given timestamp.
+	StoreDeviceSession(ctx context.Context, localpart string, serverName spec.ServerName, deviceID string, session *api.DeviceSession, maxSessions int, before int64) error
+	GetDeviceSessions(ctx context.Context, localpart string, serverName spec.ServerName) (map[string][]api.DeviceSession, error)
 	RemoveDevices(ctx context.Context, localpart string, serverName spec.ServerName, devices []string) error
 	// RemoveAllDevices deleted all devices for this user. Returns the devices deleted.
 	RemoveAllDevices(ctx context.Context, localpart string, serverName spec.ServerName, exceptDeviceID string) (devices []api.Device, err error)
@@ -21,6 +21,7 @@ import (
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/storage/postgres/deltas"
@@ -45,7 +46,13 @@ CREATE TABLE IF NOT EXISTS userapi_accounts (
     -- If the account is currently active
     is_deactivated BOOLEAN DEFAULT FALSE,
 	-- The account_type (user = 1, guest = 2, admin = 3, appservice = 4)
-	account_type SMALLINT NOT NULL
+	account_type SMALLINT NOT NULL,
+    -- The policy version this user has accepted
+    policy_version TEXT,
+    -- The policy version the user received from the server notices room
+    policy_version_sent TEXT,
+    -- If the account is shadow banned, its events are silently dropped
+    is_shadow_banned BOOLEAN NOT NULL DEFAULT FALSE
     -- TODO:
     -- upgraded_ts, devices, any email reset stuff?
 );
@@ -71,6 +78,27 @@ const selectPasswordHashSQL = "" +
 const selectNewNumericLocalpartSQL = "" +
 	"SELECT COALESCE(MAX(localpart::bigint), 0) FROM userapi_accounts WHERE localpart ~ '^[0-9]{1,}$' AND server_name = $1"
 
+const selectPrivacyPolicySQL = "" +
+	"SELECT policy_version FROM userapi_accounts WHERE localpart = $1 AND server_name = $2"
+
+const batchSelectPrivacyPolicySQL = "" +
+	"SELECT localpart, server_name FROM userapi_accounts WHERE (policy_version IS NULL OR policy_version <> $1) AND (policy_version_sent IS NULL OR policy_version_sent <> $1) AND is_deactivated = FALSE AND account_type NOT IN (2, 4)"
+
+const updatePolicyVersionSQL = "" +
+	"UPDATE userapi_accounts SET policy_version = $1 WHERE localpart = $2 AND server_name = $3"
+
+const updatePolicyVersionSentSQL = "" +
+	"UPDATE userapi_accounts SET policy_version_sent = $1 WHERE localpart = $2 AND server_name = $3"
+
+const updateShadowBanSQL = "" +
+	"UPDATE userapi_accounts SET is_shadow_banned = $1 WHERE localpart = $2 AND server_name = $3"
+
+const selectShadowBanSQL = "" +
+	"SELECT is_shadow_banned FROM userapi_accounts WHERE localpart = $1 AND server_name = $2"
+
+const upgradeGuestAccountSQL = "" +
+	"UPDATE userapi_accounts SET account_type = 1, password_hash = $1 WHERE localpart = $2 AND server_name = $3 AND account_type = 2"
+
 type accountsStatements struct {
 	insertAccountStmt             *sql.Stmt
 	updatePasswordStmt            *sql.Stmt
@@ -78,6 +106,13 @@ type accountsStatements struct {
 	selectAccountByLocalpartStmt  *sql.Stmt
 	selectPasswordHashStmt        *sql.Stmt
 	selectNewNumericLocalpartStmt *sql.Stmt
+	selectPrivacyPolicyStmt       *sql.Stmt
+	batchSelectPrivacyPolicyStmt  *sql.Stmt
+	updatePolicyVersionStmt       *sql.Stmt
+	updatePolicyVersionSentStmt   *sql.Stmt
+	updateShadowBanStmt           *sql.Stmt
+	selectShadowBanStmt           *sql.Stmt
+	upgradeGuestAccountStmt       *sql.Stmt
 	serverName                    spec.ServerName
 }
 
@@ -101,6 +136,16 @@ func NewPostgresAccountsTable(db *sql.DB, serverName spec.ServerName) (tables.Ac
 			Up:      deltas.UpAddAccountType,
 			Down:    deltas.DownAddAccountType,
 		},
+		{
+			Version: "userapi: add policy version",
+			Up:      deltas.UpAddPolicyVersion,
+			Down:    deltas.DownAddPolicyVersion,
+		},
+		{
+			Version: "userapi: add shadow ban",
+			Up:      deltas.UpAddShadowBan,
+			Down:    deltas.DownAddShadowBan,
+		},
 	}...)
 	err = m.Up(context.Background())
 	if err != nil {
@@ -113,6 +158,13 @@ func NewPostgresAccountsTable(db *sql.DB, serverName spec.ServerName) (tables.Ac
 		{&s.selectAccountByLocalpartStmt, selectAccountByLocalpartSQL},
 		{&s.selectPasswordHashStmt, selectPasswordHashSQL},
 		{&s.selectNewNumericLocalpartStmt, selectNewNumericLocalpartSQL},
+		{&s.selectPrivacyPolicyStmt, selectPrivacyPolicySQL},
+		{&s.batchSelectPrivacyPolicyStmt, batchSelectPrivacyPolicySQL},
+		{&s.updatePolicyVersionStmt, updatePolicyVersionSQL},
+		{&s.updatePolicyVersionSentStmt, updatePolicyVersionSentSQL},
+		{&s.updateShadowBanStmt, updateShadowBanSQL},
+		{&s.selectShadowBanStmt, selectShadowBanSQL},
+		{&s.upgradeGuestAccountStmt, upgradeGuestAccountSQL},
 	}.Prepare(db)
 }
 
@@ -200,3 +252,84 @@ func (s *accountsStatements) SelectNewNumericLocalpart(
 	err = stmt.QueryRowContext(ctx, serverName).Scan(&id)
 	return id + 1, err
 }
+
+// SelectPrivacyPolicy gets the privacy policy version the user has accepted, if any.
+func (s *accountsStatements) SelectPrivacyPolicy(
+	ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName,
+) (policy string, err error) {
+	var policyVersion sql.NullString
+	stmt := sqlutil.TxStmt(txn, s.selectPrivacyPolicyStmt)
+	err = stmt.QueryRowContext(ctx, localpart, serverName).Scan(&policyVersion)
+	return policyVersion.String, err
+}
+
+// BatchSelectPrivacyPolicy gets the user IDs of all active users, other than guests
+// and appservice users, who haven't accepted the given policy version and haven't
+// been sent a server notice about it yet.
+func (s *accountsStatements) BatchSelectPrivacyPolicy(
+	ctx context.Context, txn *sql.Tx, policyVersion string,
+) (userIDs []string, err error) {
+	stmt := sqlutil.TxStmt(txn, s.batchSelectPrivacyPolicyStmt)
+	rows, err := stmt.QueryContext(ctx, policyVersion)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "BatchSelectPrivacyPolicy: rows.close() failed")
+	for rows.Next() {
+		var localpart string
+		var serverName spec.ServerName
+		if err = rows.Scan(&localpart, &serverName); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userutil.MakeUserID(localpart, serverName))
+	}
+	return userIDs, rows.Err()
+}
+
+// UpdatePolicyVersion sets the policy version the user has accepted.
+func (s *accountsStatements) UpdatePolicyVersion(
+	ctx context.Context, txn *sql.Tx, policyVersion, localpart string, serverName spec.ServerName,
+) (err error) {
+	stmt := sqlutil.TxStmt(txn, s.updatePolicyVersionStmt)
+	_, err = stmt.ExecContext(ctx, policyVersion, localpart, serverName)
+	return err
+}
+
+// UpdatePolicyVersionSent records that the user was sent a server notice for
+// the given policy version.
+func (s *accountsStatements) UpdatePolicyVersionSent(
+	ctx context.Context, txn *sql.Tx, policyVersion, localpart string, serverName spec.ServerName,
+) (err error) {
+	stmt := sqlutil.TxStmt(txn, s.updatePolicyVersionSentStmt)
+	_, err = stmt.ExecContext(ctx, policyVersion, localpart, serverName)
+	return err
+}
+
+func (s *accountsStatements) UpdateShadowBan(
+	ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, shadowBanned bool,
+) (err error) {
+	stmt := sqlutil.TxStmt(txn, s.updateShadowBanStmt)
+	_, err = stmt.ExecContext(ctx, shadowBanned, localpart, serverName)
+	return err
+}
+
+func (s *accountsStatements) SelectShadowBan(
+	ctx context.Context, localpart string, serverName spec.ServerName,
+) (shadowBanned bool, err error) {
+	err = s.selectShadowBanStmt.QueryRowContext(ctx, localpart, serverName).Scan(&shadowBanned)
+	return
+}
+
+// UpgradeGuestAccount turns the guest account into a user account with the
+// given password hash. Returns false if there is no such guest account.
+func (s *accountsStatements) UpgradeGuestAccount(
+	ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, passwordHash string,
+) (bool, error) {
+	stmt := sqlutil.TxStmt(txn, s.upgradeGuestAccountStmt)
+	res, err := stmt.ExecContext(ctx, passwordHash, localpart, serverName)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
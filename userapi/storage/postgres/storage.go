@@ -69,6 +69,10 @@ func NewDatabase(ctx context.Context, conMan *sqlutil.Connections, dbProperties
 	if err != nil {
 		return nil, fmt.Errorf("NewPostgresDevicesTable: %w", err)
 	}
+	deviceSessionsTable, err := NewPostgresDeviceSessionsTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewPostgresDeviceSessionsTable: %w", err)
+	}
 	keyBackupTable, err := NewPostgresKeyBackupTable(db)
 	if err != nil {
 		return nil, fmt.Errorf("NewPostgresKeyBackupTable: %w", err)
@@ -121,6 +125,7 @@ func NewDatabase(ctx context.Context, conMan *sqlutil.Connections, dbProperties
 		AccountDatas:          accountDataTable,
 		Accounts:              accountsTable,
 		Devices:               devicesTable,
+		DeviceSessions:        deviceSessionsTable,
 		KeyBackups:            keyBackupTable,
 		KeyBackupVersions:     keyBackupVersionTable,
 		LoginTokens:           loginTokenTable,
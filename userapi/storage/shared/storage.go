@@ -53,6 +53,7 @@ type Database struct {
 	KeyBackups            tables.KeyBackupTable
 	KeyBackupVersions     tables.KeyBackupVersionTable
 	Devices               tables.DevicesTable
+	DeviceSessions        tables.DeviceSessionsTable
 	LoginTokens           tables.LoginTokenTable
 	Notifications         tables.NotificationTable
 	Pushers               tables.PusherTable
@@ -431,6 +432,55 @@ func (d *Database) DeactivateAccount(ctx context.Context, localpart string, serv
 	})
 }
 
+// GetPrivacyPolicy returns the privacy policy version the user has accepted.
+func (d *Database) GetPrivacyPolicy(ctx context.Context, localpart string, serverName spec.ServerName) (policyVersion string, err error) {
+	return d.Accounts.SelectPrivacyPolicy(ctx, nil, localpart, serverName)
+}
+
+// GetOutdatedPolicy returns the user IDs of users who haven't accepted the given policy version yet.
+func (d *Database) GetOutdatedPolicy(ctx context.Context, policyVersion string) (userIDs []string, err error) {
+	return d.Accounts.BatchSelectPrivacyPolicy(ctx, nil, policyVersion)
+}
+
+// UpdatePolicyVersion sets the accepted policy version for the user, or the
+// version a server notice was sent for if serverNotice is true.
+func (d *Database) UpdatePolicyVersion(ctx context.Context, policyVersion, localpart string, serverName spec.ServerName, serverNotice bool) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if serverNotice {
+			return d.Accounts.UpdatePolicyVersionSent(ctx, txn, policyVersion, localpart, serverName)
+		}
+		return d.Accounts.UpdatePolicyVersion(ctx, txn, policyVersion, localpart, serverName)
+	})
+}
+
+// SetShadowBanned sets whether the account is shadow banned.
+func (d *Database) SetShadowBanned(ctx context.Context, localpart string, serverName spec.ServerName, shadowBanned bool) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.Accounts.UpdateShadowBan(ctx, txn, localpart, serverName, shadowBanned)
+	})
+}
+
+// IsShadowBanned returns whether the account is shadow banned.
+func (d *Database) IsShadowBanned(ctx context.Context, localpart string, serverName spec.ServerName) (bool, error) {
+	return d.Accounts.SelectShadowBan(ctx, localpart, serverName)
+}
+
+// UpgradeGuestAccount turns the guest account into a user account with the
+// given password. Returns false if there is no such guest account.
+func (d *Database) UpgradeGuestAccount(
+	ctx context.Context, localpart string, serverName spec.ServerName, plaintextPassword string,
+) (upgraded bool, err error) {
+	hash, err := d.hashPassword(plaintextPassword)
+	if err != nil {
+		return false, err
+	}
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		upgraded, err = d.Accounts.UpgradeGuestAccount(ctx, txn, localpart, serverName, hash)
+		return err
+	})
+	return
+}
+
 // CreateOpenIDToken persists a new token that was issued for OpenID Connect
 func (d *Database) CreateOpenIDToken(
 	ctx context.Context,
@@ -732,10 +782,10 @@ func (d *Database) RemoveDevices(
 	devices []string,
 ) error {
 	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		if err := d.Devices.DeleteDevices(ctx, txn, localpart, serverName, devices); err != sql.ErrNoRows {
+		if err := d.Devices.DeleteDevices(ctx, txn, localpart, serverName, devices); err != nil && err != sql.ErrNoRows {
 			return err
 		}
-		return nil
+		return d.DeviceSessions.DeleteStaleDeviceSessions(ctx, txn, localpart, serverName)
 	})
 }
 
@@ -752,10 +802,10 @@ func (d *Database) RemoveAllDevices(
 		if err != nil {
 			return err
 		}
-		if err := d.Devices.DeleteDevicesByLocalpart(ctx, txn, localpart, serverName, exceptDeviceID); err != sql.ErrNoRows {
+		if err := d.Devices.DeleteDevicesByLocalpart(ctx, txn, localpart, serverName, exceptDeviceID); err != nil && err != sql.ErrNoRows {
 			return err
 		}
-		return nil
+		return d.DeviceSessions.DeleteStaleDeviceSessions(ctx, txn, localpart, serverName)
 	})
 	return
 }
@@ -767,6 +817,26 @@ func (d *Database) UpdateDeviceLastSeen(ctx context.Context, localpart string, s
 	})
 }
 
+// StoreDeviceSession records that a device was seen using the IP address of the session,
+// then deletes all but the most recent maxSessions sessions of the device and those last
+// seen before the given timestamp.
+func (d *Database) StoreDeviceSession(
+	ctx context.Context, localpart string, serverName spec.ServerName, deviceID string,
+	session *api.DeviceSession, maxSessions int, before int64,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if err := d.DeviceSessions.UpsertDeviceSession(ctx, txn, localpart, serverName, deviceID, session); err != nil {
+			return err
+		}
+		return d.DeviceSessions.DeleteExpiredDeviceSessions(ctx, txn, localpart, serverName, deviceID, maxSessions, before)
+	})
+}
+
+// GetDeviceSessions returns the session history of all devices of a user, keyed by device ID.
+func (d *Database) GetDeviceSessions(ctx context.Context, localpart string, serverName spec.ServerName) (map[string][]api.DeviceSession, error) {
+	return d.DeviceSessions.SelectDeviceSessions(ctx, nil, localpart, serverName)
+}
+
 // CreateLoginToken generates a token, stores and returns it. The lifetime is
 // determined by the loginTokenLifetime given to the Database constructor.
 func (d *Database) CreateLoginToken(ctx context.Context, data *api.LoginTokenData) (*api.LoginTokenMetadata, error) {
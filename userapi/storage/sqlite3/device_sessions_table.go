@@ -0,0 +1,127 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/tables"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+const deviceSessionsSchema = `
+-- Stores the IP addresses a device was seen using, so users can tell their sessions apart.
+CREATE TABLE IF NOT EXISTS userapi_device_sessions (
+    localpart TEXT NOT NULL,
+    server_name TEXT NOT NULL,
+    device_id TEXT NOT NULL,
+    ip TEXT NOT NULL,
+    -- The most recent user agent and approximate location seen with this IP address.
+    user_agent TEXT NOT NULL DEFAULT '',
+    location TEXT NOT NULL DEFAULT '',
+    -- When this IP address was first and last seen, as unix timestamps (ms resolution).
+    first_seen_ts BIGINT NOT NULL,
+    last_seen_ts BIGINT NOT NULL,
+    UNIQUE (localpart, server_name, device_id, ip)
+);
+`
+
+const upsertDeviceSessionSQL = "" +
+	"INSERT INTO userapi_device_sessions (localpart, server_name, device_id, ip, user_agent, location, first_seen_ts, last_seen_ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $7)" +
+	" ON CONFLICT (localpart, server_name, device_id, ip)" +
+	" DO UPDATE SET user_agent = $5, location = $6, last_seen_ts = $7"
+
+const selectDeviceSessionsSQL = "" +
+	"SELECT device_id, ip, user_agent, location, first_seen_ts, last_seen_ts FROM userapi_device_sessions" +
+	" WHERE localpart = $1 AND server_name = $2 ORDER BY last_seen_ts DESC"
+
+const deleteExpiredDeviceSessionsSQL = "" +
+	"DELETE FROM userapi_device_sessions WHERE localpart = $1 AND server_name = $2 AND device_id = $3 AND (" +
+	" ip NOT IN (SELECT ip FROM userapi_device_sessions WHERE localpart = $1 AND server_name = $2 AND device_id = $3 ORDER BY last_seen_ts DESC LIMIT $4)" +
+	" OR last_seen_ts < $5)"
+
+const deleteStaleDeviceSessionsSQL = "" +
+	"DELETE FROM userapi_device_sessions WHERE localpart = $1 AND server_name = $2" +
+	" AND device_id NOT IN (SELECT device_id FROM userapi_devices WHERE localpart = $1 AND server_name = $2)"
+
+type deviceSessionsStatements struct {
+	upsertDeviceSessionStmt         *sql.Stmt
+	selectDeviceSessionsStmt        *sql.Stmt
+	deleteExpiredDeviceSessionsStmt *sql.Stmt
+	deleteStaleDeviceSessionsStmt   *sql.Stmt
+}
+
+func NewSQLiteDeviceSessionsTable(db *sql.DB) (tables.DeviceSessionsTable, error) {
+	s := &deviceSessionsStatements{}
+	_, err := db.Exec(deviceSessionsSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, sqlutil.StatementList{
+		{&s.upsertDeviceSessionStmt, upsertDeviceSessionSQL},
+		{&s.selectDeviceSessionsStmt, selectDeviceSessionsSQL},
+		{&s.deleteExpiredDeviceSessionsStmt, deleteExpiredDeviceSessionsSQL},
+		{&s.deleteStaleDeviceSessionsStmt, deleteStaleDeviceSessionsSQL},
+	}.Prepare(db)
+}
+
+func (s *deviceSessionsStatements) UpsertDeviceSession(
+	ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, deviceID string, session *api.DeviceSession,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.upsertDeviceSessionStmt)
+	_, err := stmt.ExecContext(ctx, localpart, serverName, deviceID, session.IPAddr, session.UserAgent, session.Location, session.LastSeenTS)
+	return err
+}
+
+func (s *deviceSessionsStatements) SelectDeviceSessions(
+	ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName,
+) (map[string][]api.DeviceSession, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectDeviceSessionsStmt).QueryContext(ctx, localpart, serverName)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectDeviceSessions: rows.close() failed")
+	sessions := make(map[string][]api.DeviceSession)
+	for rows.Next() {
+		var deviceID string
+		var session api.DeviceSession
+		if err = rows.Scan(&deviceID, &session.IPAddr, &session.UserAgent, &session.Location, &session.FirstSeenTS, &session.LastSeenTS); err != nil {
+			return nil, err
+		}
+		sessions[deviceID] = append(sessions[deviceID], session)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *deviceSessionsStatements) DeleteExpiredDeviceSessions(
+	ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, deviceID string, maxSessions int, before int64,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteExpiredDeviceSessionsStmt)
+	_, err := stmt.ExecContext(ctx, localpart, serverName, deviceID, maxSessions, before)
+	return err
+}
+
+func (s *deviceSessionsStatements) DeleteStaleDeviceSessions(
+	ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteStaleDeviceSessionsStmt)
+	_, err := stmt.ExecContext(ctx, localpart, serverName)
+	return err
+}
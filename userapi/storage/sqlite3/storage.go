@@ -66,6 +66,10 @@ func NewUserDatabase(ctx context.Context, conMan *sqlutil.Connections, dbPropert
 	if err != nil {
 		return nil, fmt.Errorf("NewSQLiteDevicesTable: %w", err)
 	}
+	deviceSessionsTable, err := NewSQLiteDeviceSessionsTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewSQLiteDeviceSessionsTable: %w", err)
+	}
 	keyBackupTable, err := NewSQLiteKeyBackupTable(db)
 	if err != nil {
 		return nil, fmt.Errorf("NewSQLiteKeyBackupTable: %w", err)
@@ -118,6 +122,7 @@ func NewUserDatabase(ctx context.Context, conMan *sqlutil.Connections, dbPropert
 		AccountDatas:          accountDataTable,
 		Accounts:              accountsTable,
 		Devices:               devicesTable,
+		DeviceSessions:        deviceSessionsTable,
 		KeyBackups:            keyBackupTable,
 		KeyBackupVersions:     keyBackupVersionTable,
 		LoginTokens:           loginTokenTable,
@@ -127,6 +127,21 @@ func Test_Accounts(t *testing.T) {
 		assert.NoError(t, err, "failed to get account by new password")
 		assert.Equal(t, accAlice, accGet)
 
+		// shadow ban alice and lift it again
+		shadowBanned, err := db.IsShadowBanned(ctx, aliceLocalpart, aliceDomain)
+		assert.NoError(t, err, "failed to get shadow ban")
+		assert.False(t, shadowBanned)
+		err = db.SetShadowBanned(ctx, aliceLocalpart, aliceDomain, true)
+		assert.NoError(t, err, "failed to shadow ban account")
+		shadowBanned, err = db.IsShadowBanned(ctx, aliceLocalpart, aliceDomain)
+		assert.NoError(t, err, "failed to get shadow ban")
+		assert.True(t, shadowBanned)
+		err = db.SetShadowBanned(ctx, aliceLocalpart, aliceDomain, false)
+		assert.NoError(t, err, "failed to lift shadow ban")
+		shadowBanned, err = db.IsShadowBanned(ctx, aliceLocalpart, aliceDomain)
+		assert.NoError(t, err, "failed to get shadow ban")
+		assert.False(t, shadowBanned)
+
 		// deactivate account
 		err = db.DeactivateAccount(ctx, aliceLocalpart, aliceDomain)
 		assert.NoError(t, err, "failed to deactivate account")
@@ -151,8 +166,68 @@ func Test_Accounts(t *testing.T) {
 		assert.NoError(t, err)
 
 		// Now try to create a new guest user
-		_, err = db.CreateAccount(ctx, "", aliceDomain, "", "", api.AccountTypeGuest)
+		guest, err := db.CreateAccount(ctx, "", aliceDomain, "", "", api.AccountTypeGuest)
+		assert.NoError(t, err)
+
+		// upgrade the guest to a user account, which can then log in with a password
+		upgraded, err := db.UpgradeGuestAccount(ctx, guest.Localpart, aliceDomain, "guestPassword")
+		assert.NoError(t, err, "failed to upgrade guest account")
+		assert.True(t, upgraded)
+		accGet, err = db.GetAccountByPassword(ctx, guest.Localpart, aliceDomain, "guestPassword")
+		assert.NoError(t, err, "failed to get upgraded account by password")
+		assert.Equal(t, api.AccountTypeUser, accGet.AccountType)
+		// only guest accounts can be upgraded
+		upgraded, err = db.UpgradeGuestAccount(ctx, guest.Localpart, aliceDomain, "otherPassword")
+		assert.NoError(t, err)
+		assert.False(t, upgraded)
+	})
+}
+
+func Test_PrivacyPolicy(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateUserDatabase(t, dbType)
+		defer close()
+		alice := test.NewUser(t)
+		aliceLocalpart, aliceDomain, err := gomatrixserverlib.SplitID('@', alice.ID)
+		assert.NoError(t, err)
+		bob := test.NewUser(t)
+		bobLocalpart, bobDomain, err := gomatrixserverlib.SplitID('@', bob.ID)
+		assert.NoError(t, err)
+
+		_, err = db.CreateAccount(ctx, aliceLocalpart, aliceDomain, "testing", "", api.AccountTypeUser)
+		assert.NoError(t, err, "failed to create account")
+		_, err = db.CreateAccount(ctx, bobLocalpart, bobDomain, "testing", "", api.AccountTypeUser)
+		assert.NoError(t, err, "failed to create account")
+
+		policyVersion, err := db.GetPrivacyPolicy(ctx, aliceLocalpart, aliceDomain)
+		assert.NoError(t, err)
+		assert.Equal(t, "", policyVersion)
+
+		userIDs, err := db.GetOutdatedPolicy(ctx, "1.0")
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{alice.ID, bob.ID}, userIDs)
+
+		// alice accepts the policy, bob is only sent a notice about it
+		err = db.UpdatePolicyVersion(ctx, "1.0", aliceLocalpart, aliceDomain, false)
 		assert.NoError(t, err)
+		err = db.UpdatePolicyVersion(ctx, "1.0", bobLocalpart, bobDomain, true)
+		assert.NoError(t, err)
+
+		policyVersion, err = db.GetPrivacyPolicy(ctx, aliceLocalpart, aliceDomain)
+		assert.NoError(t, err)
+		assert.Equal(t, "1.0", policyVersion)
+		policyVersion, err = db.GetPrivacyPolicy(ctx, bobLocalpart, bobDomain)
+		assert.NoError(t, err)
+		assert.Equal(t, "", policyVersion)
+
+		userIDs, err = db.GetOutdatedPolicy(ctx, "1.0")
+		assert.NoError(t, err)
+		assert.Empty(t, userIDs)
+
+		// a new policy version is outdated for everyone
+		userIDs, err = db.GetOutdatedPolicy(ctx, "2.0")
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{alice.ID, bob.ID}, userIDs)
 	})
 }
 
@@ -239,6 +314,60 @@ func Test_Devices(t *testing.T) {
 	})
 }
 
+func Test_DeviceSessions(t *testing.T) {
+	alice := test.NewUser(t)
+	localpart, domain, err := gomatrixserverlib.SplitID('@', alice.ID)
+	assert.NoError(t, err)
+	deviceID := util.RandomString(8)
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateUserDatabase(t, dbType)
+		defer close()
+
+		_, err = db.CreateDevice(ctx, localpart, domain, &deviceID, util.RandomString(16), nil, "", "")
+		assert.NoError(t, err, "unable to create device")
+
+		sessions := []api.DeviceSession{
+			{IPAddr: "10.0.0.1", UserAgent: "Element Web", FirstSeenTS: 1000, LastSeenTS: 1000},
+			{IPAddr: "10.0.0.2", UserAgent: "Element Web", Location: "DE", FirstSeenTS: 2000, LastSeenTS: 2000},
+			{IPAddr: "10.0.0.3", UserAgent: "Element Android", FirstSeenTS: 3000, LastSeenTS: 3000},
+		}
+		for i := range sessions {
+			err = db.StoreDeviceSession(ctx, localpart, domain, deviceID, &sessions[i], 10, 0)
+			assert.NoError(t, err, "unable to store device session")
+		}
+		// seeing a known IP address again only updates the session
+		err = db.StoreDeviceSession(ctx, localpart, domain, deviceID, &api.DeviceSession{
+			IPAddr: "10.0.0.1", UserAgent: "Element Desktop", FirstSeenTS: 4000, LastSeenTS: 4000,
+		}, 10, 0)
+		assert.NoError(t, err, "unable to store device session")
+		gotSessions, err := db.GetDeviceSessions(ctx, localpart, domain)
+		assert.NoError(t, err, "unable to get device sessions")
+		assert.Equal(t, map[string][]api.DeviceSession{deviceID: {
+			{IPAddr: "10.0.0.1", UserAgent: "Element Desktop", FirstSeenTS: 1000, LastSeenTS: 4000},
+			sessions[2], sessions[1],
+		}}, gotSessions)
+
+		// only the two most recent sessions seen after 2500 are kept
+		err = db.StoreDeviceSession(ctx, localpart, domain, deviceID, &api.DeviceSession{
+			IPAddr: "10.0.0.4", FirstSeenTS: 5000, LastSeenTS: 5000,
+		}, 2, 2500)
+		assert.NoError(t, err, "unable to store device session")
+		gotSessions, err = db.GetDeviceSessions(ctx, localpart, domain)
+		assert.NoError(t, err, "unable to get device sessions")
+		assert.Len(t, gotSessions[deviceID], 2)
+		assert.Equal(t, "10.0.0.4", gotSessions[deviceID][0].IPAddr)
+		assert.Equal(t, "10.0.0.1", gotSessions[deviceID][1].IPAddr)
+
+		// sessions are deleted with the device
+		err = db.RemoveDevices(ctx, localpart, domain, []string{deviceID})
+		assert.NoError(t, err, "unable to remove device")
+		gotSessions, err = db.GetDeviceSessions(ctx, localpart, domain)
+		assert.NoError(t, err, "unable to get device sessions")
+		assert.Empty(t, gotSessions)
+	})
+}
+
 func Test_KeyBackup(t *testing.T) {
 	alice := test.NewUser(t)
 	room := test.NewRoom(t, alice)
@@ -52,6 +52,13 @@ type AccountsTable interface {
 	SelectPasswordHash(ctx context.Context, localpart string, serverName spec.ServerName) (hash string, err error)
 	SelectAccountByLocalpart(ctx context.Context, localpart string, serverName spec.ServerName) (*api.Account, error)
 	SelectNewNumericLocalpart(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) (id int64, err error)
+	SelectPrivacyPolicy(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName) (policy string, err error)
+	BatchSelectPrivacyPolicy(ctx context.Context, txn *sql.Tx, policyVersion string) (userIDs []string, err error)
+	UpdatePolicyVersion(ctx context.Context, txn *sql.Tx, policyVersion, localpart string, serverName spec.ServerName) error
+	UpdatePolicyVersionSent(ctx context.Context, txn *sql.Tx, policyVersion, localpart string, serverName spec.ServerName) error
+	UpdateShadowBan(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, shadowBanned bool) error
+	SelectShadowBan(ctx context.Context, localpart string, serverName spec.ServerName) (shadowBanned bool, err error)
+	UpgradeGuestAccount(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, passwordHash string) (upgraded bool, err error)
 }
 
 type DevicesTable interface {
@@ -68,6 +75,16 @@ type DevicesTable interface {
 	UpdateDeviceLastSeen(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, deviceID, ipAddr, userAgent string) error
 }
 
+type DeviceSessionsTable interface {
+	UpsertDeviceSession(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, deviceID string, session *api.DeviceSession) error
+	SelectDeviceSessions(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName) (map[string][]api.DeviceSession, error)
+	// DeleteExpiredDeviceSessions deletes all but the most recent maxSessions sessions of a device,
+	// as well as sessions last seen before the given timestamp.
+	DeleteExpiredDeviceSessions(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, deviceID string, maxSessions int, before int64) error
+	// DeleteStaleDeviceSessions deletes the sessions of devices the user doesn't have anymore.
+	DeleteStaleDeviceSessions(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName) error
+}
+
 type KeyBackupTable interface {
 	CountKeys(ctx context.Context, txn *sql.Tx, userID, version string) (count int64, err error)
 	InsertBackupKey(ctx context.Context, txn *sql.Tx, userID, version string, key api.InternalKeyBackupSession) (err error)
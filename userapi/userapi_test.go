@@ -97,17 +97,18 @@ func MustMakeInternalAPI(t *testing.T, opts apiTestOpts, dbType test.DBType, pub
 		publisher = &dummyProducer{t: t}
 	}
 
-	syncProducer := producers.NewSyncAPI(accountDB, publisher, "client_data", "notification_data")
+	syncProducer := producers.NewSyncAPI(accountDB, publisher, "client_data", "notification_data", "send_to_device")
 	keyChangeProducer := &producers.KeyChange{DB: keyDB, JetStream: publisher, Topic: "keychange"}
 	return &internal.UserInternalAPI{
-			DB:                accountDB,
-			KeyDatabase:       keyDB,
-			Config:            &cfg.UserAPI,
-			SyncProducer:      syncProducer,
-			KeyChangeProducer: keyChangeProducer,
-		}, accountDB, func() {
-			close()
-		}
+		DB:                accountDB,
+		KeyDatabase:       keyDB,
+		Config:            &cfg.UserAPI,
+		SyncProducer:      syncProducer,
+		KeyChangeProducer: keyChangeProducer,
+		ProcessContext:    ctx,
+	}, accountDB, func() {
+		close()
+	}
 }
 
 func TestQueryProfile(t *testing.T) {
@@ -665,3 +666,105 @@ func TestDeviceIDReuse(t *testing.T) {
 		})
 	})
 }
+
+// Tests that the other devices of a user are notified about new logins, unless the user opted out.
+func TestNewDeviceAlerts(t *testing.T) {
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		publisher := &dummyProducer{t: t}
+		intAPI, _, close := MustMakeInternalAPI(t, apiTestOpts{serverName: "test"}, dbType, publisher)
+		defer close()
+		intAPI.(*internal.UserInternalAPI).Config.NewDeviceAlerts.Enabled = true
+
+		alerts := func() int {
+			count, _ := publisher.callCount.Load("send_to_device")
+			c, _ := count.(int)
+			return c
+		}
+		createDevice := func(fromRegistration bool) {
+			res := api.PerformDeviceCreationResponse{}
+			if err := intAPI.PerformDeviceCreation(ctx, &api.PerformDeviceCreationRequest{
+				Localpart: "alice", ServerName: "test", AccessToken: util.RandomString(16), IPAddr: "127.0.0.1:1234", FromRegistration: fromRegistration,
+			}, &res); err != nil {
+				t.Fatalf("failed to create device: %v", err)
+			}
+		}
+
+		// the device created when registering doesn't trigger an alert
+		createDevice(true)
+		if got := alerts(); got != 0 {
+			t.Fatalf("expected no alerts after registering, got %d", got)
+		}
+		// the first device is notified about the second one
+		createDevice(false)
+		if got := alerts(); got != 1 {
+			t.Fatalf("expected 1 alert, got %d", got)
+		}
+
+		if err := intAPI.InputAccountData(ctx, &api.InputAccountDataRequest{
+			UserID:      "@alice:test",
+			DataType:    internal.NewDeviceAlertsAccountDataType,
+			AccountData: []byte(`{"enabled":false}`),
+		}, &api.InputAccountDataResponse{}); err != nil {
+			t.Fatalf("failed to set account data: %v", err)
+		}
+		createDevice(false)
+		if got := alerts(); got != 1 {
+			t.Fatalf("expected no further alerts after opting out, got %d", got)
+		}
+	})
+}
+
+// Tests that device sessions are only written when the IP address or user agent of the device changes.
+func TestDeviceSessionsStoredOnChange(t *testing.T) {
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		intAPI, _, close := MustMakeInternalAPI(t, apiTestOpts{serverName: "test"}, dbType, nil)
+		defer close()
+		intAPI.(*internal.UserInternalAPI).Config.DeviceSessions.MaxPerDevice = 10
+
+		res := api.PerformDeviceCreationResponse{}
+		if err := intAPI.PerformDeviceCreation(ctx, &api.PerformDeviceCreationRequest{
+			Localpart: "alice", ServerName: "test", AccessToken: util.RandomString(16),
+			IPAddr: "127.0.0.1:1234", UserAgent: "client/1", NoDeviceListUpdate: true,
+		}, &res); err != nil {
+			t.Fatalf("failed to create device: %v", err)
+		}
+		sessions := func() []api.DeviceSession {
+			devices := api.QueryDevicesResponse{}
+			if err := intAPI.QueryDevices(ctx, &api.QueryDevicesRequest{UserID: "@alice:test", IncludeSessions: true}, &devices); err != nil {
+				t.Fatalf("failed to query devices: %v", err)
+			}
+			return devices.Sessions[res.Device.ID]
+		}
+		seen := func(remoteAddr, userAgent string) {
+			time.Sleep(time.Millisecond * 5)
+			if err := intAPI.PerformLastSeenUpdate(ctx, &api.PerformLastSeenUpdateRequest{
+				UserID: "@alice:test", DeviceID: res.Device.ID, RemoteAddr: remoteAddr, UserAgent: userAgent,
+			}, &api.PerformLastSeenUpdateResponse{}); err != nil {
+				t.Fatalf("failed to update last seen: %v", err)
+			}
+		}
+
+		created := sessions()
+		if len(created) != 1 {
+			t.Fatalf("expected 1 session, got %+v", created)
+		}
+		// nothing has changed, so nothing is written
+		seen("127.0.0.1:5678", "client/1")
+		if got := sessions(); !reflect.DeepEqual(created, got) {
+			t.Fatalf("expected the session to be unchanged, got %+v", got)
+		}
+		// a new user agent is stored
+		seen("127.0.0.1:5678", "client/2")
+		got := sessions()
+		if len(got) != 1 || got[0].UserAgent != "client/2" || got[0].LastSeenTS <= created[0].LastSeenTS {
+			t.Fatalf("expected the session to be updated, got %+v", got)
+		}
+		// so is a new IP address
+		seen("127.0.0.2", "client/2")
+		if got = sessions(); len(got) != 2 {
+			t.Fatalf("expected 2 sessions, got %+v", got)
+		}
+	})
+}